@@ -232,6 +232,8 @@ if test -z "$packages" ; then
         arvados-client
         arvados-controller
         arvados-dispatch-cloud
+        arvados-dispatch-condor
+        arvados-dispatch-kubernetes
         arvados-dispatch-lsf
         arvados-docker-cleaner
         arvados-health
@@ -236,6 +236,10 @@ package_go_binary cmd/arvados-server arvados-controller "$FORMAT" "$ARCH" \
     "Arvados cluster controller daemon"
 package_go_binary cmd/arvados-server arvados-dispatch-cloud "$FORMAT" "$ARCH" \
     "Arvados cluster cloud dispatch"
+package_go_binary cmd/arvados-server arvados-dispatch-condor "$FORMAT" "$ARCH" \
+    "Dispatch Arvados containers to an HTCondor pool"
+package_go_binary cmd/arvados-server arvados-dispatch-kubernetes "$FORMAT" "$ARCH" \
+    "Dispatch Arvados containers to a Kubernetes cluster"
 package_go_binary cmd/arvados-server arvados-dispatch-lsf "$FORMAT" "$ARCH" \
     "Dispatch Arvados containers to an LSF cluster"
 package_go_binary services/crunch-dispatch-local crunch-dispatch-local "$FORMAT" "$ARCH" \
@@ -49,6 +49,7 @@ var (
 		"diagnostics":          diagnostics.Command{},
 		"logs":                 logsCommand{},
 		"mount":                mount.Command,
+		"presign":              presignCommand{},
 		"shell":                shellCommand{},
 		"sudo":                 sudoCommand{},
 	})
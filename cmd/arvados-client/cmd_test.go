@@ -40,3 +40,16 @@ func (s *ClientSuite) TestVersion(c *check.C) {
 	c.Check(stdout.String(), check.Matches, `arvados-client dev \(go[0-9\.]+\)\n`)
 	c.Check(stderr.String(), check.Equals, "")
 }
+
+func (s *ClientSuite) TestPresignBadArgs(c *check.C) {
+	for _, args := range [][]string{
+		{"presign"},
+		{"presign", "zzzzz-4zz18-aaaaaaaaaaaaaaa"},
+		{"presign", "zzzzz-4zz18-aaaaaaaaaaaaaaa/"},
+		{"presign", "-expires", "0s", "zzzzz-4zz18-aaaaaaaaaaaaaaa/foo"},
+		{"presign", "zzzzz-4zz18-aaaaaaaaaaaaaaa/foo", "bar"},
+	} {
+		exited := handler.RunCommand("arvados-client", args, bytes.NewReader(nil), ioutil.Discard, ioutil.Discard)
+		c.Check(exited, check.Equals, cmd.EXIT_INVALIDARGUMENT, check.Commentf("%q", args))
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// presignCommand prints a presigned URL that can be used to download
+// (or upload) a single file in a collection without any other
+// credentials.
+type presignCommand struct{}
+
+func (presignCommand) RunCommand(prog string, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	f := flag.NewFlagSet(prog, flag.ContinueOnError)
+	method := f.String("method", "GET", "HTTP method the URL can be used with: GET (download) or PUT (upload)")
+	expires := f.Duration("expires", 24*time.Hour, "time until the URL expires (maximum 168h)")
+	if ok, code := cmd.ParseFlags(f, prog, args, "collection-uuid/path/to/file", stderr); !ok {
+		return code
+	} else if f.NArg() < 1 {
+		fmt.Fprintf(stderr, "missing required argument: collection-uuid/path/to/file (try -help)\n")
+		return 2
+	} else if f.NArg() > 1 {
+		fmt.Fprintf(stderr, "encountered extra arguments after collection-uuid/path/to/file (try -help)\n")
+		return 2
+	}
+	uuid, path, ok := strings.Cut(f.Arg(0), "/")
+	if !ok || path == "" {
+		fmt.Fprintf(stderr, "invalid argument %q: must be collection-uuid/path/to/file\n", f.Arg(0))
+		return 2
+	}
+	if *expires < time.Second {
+		fmt.Fprintf(stderr, "invalid -expires %s: must be at least 1s\n", *expires)
+		return 2
+	}
+
+	rpcconn, err := rpcFromEnv()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	resp, err := rpcconn.CollectionPresignedURL(context.Background(), arvados.PresignedURLOptions{
+		UUID:      uuid,
+		Path:      path,
+		Method:    strings.ToUpper(*method),
+		ExpiresIn: int64(*expires / time.Second),
+	})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stderr, "URL for %s expires at %s\n", resp.Method, resp.ExpiresAt.Local().Format(time.RFC3339))
+	fmt.Fprintln(stdout, resp.URL)
+	return 0
+}
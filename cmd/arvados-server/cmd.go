@@ -18,11 +18,13 @@ import (
 	"git.arvados.org/arvados.git/lib/boot"
 	"git.arvados.org/arvados.git/lib/cloud/cloudtest"
 	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/lib/condor"
 	"git.arvados.org/arvados.git/lib/config"
 	"git.arvados.org/arvados.git/lib/controller"
 	"git.arvados.org/arvados.git/lib/crunchrun"
 	"git.arvados.org/arvados.git/lib/crunchstat"
 	"git.arvados.org/arvados.git/lib/dispatchcloud"
+	"git.arvados.org/arvados.git/lib/kubernetes"
 	"git.arvados.org/arvados.git/lib/lsf"
 	"git.arvados.org/arvados.git/lib/recovercollection"
 	"git.arvados.org/arvados.git/lib/service"
@@ -43,27 +45,29 @@ var (
 		"-version":  cmd.Version,
 		"--version": cmd.Version,
 
-		"boot":               boot.Command,
-		"check":              health.CheckCommand,
-		"cloudtest":          cloudtest.Command,
-		"config-check":       config.CheckCommand,
-		"config-defaults":    config.DumpDefaultsCommand,
-		"config-dump":        config.DumpCommand,
-		"controller":         controller.Command,
-		"crunch-run":         crunchrun.Command,
-		"crunchstat":         crunchstat.Command,
-		"dispatch-cloud":     dispatchcloud.Command,
-		"dispatch-lsf":       lsf.DispatchCommand,
-		"dispatch-slurm":     dispatchslurm.Command,
-		"health":             healthCommand,
-		"instance":           dispatchcloud.InstanceCommand,
-		"keep-balance":       keepbalance.Command,
-		"keep-web":           keepweb.Command,
-		"keepproxy":          keepproxy.Command,
-		"keepstore":          keepstore.Command,
-		"recover-collection": recovercollection.Command,
-		"workbench2":         wb2command{},
-		"ws":                 ws.Command,
+		"boot":                boot.Command,
+		"check":               health.CheckCommand,
+		"cloudtest":           cloudtest.Command,
+		"config-check":        config.CheckCommand,
+		"config-defaults":     config.DumpDefaultsCommand,
+		"config-dump":         config.DumpCommand,
+		"controller":          controller.Command,
+		"crunch-run":          crunchrun.Command,
+		"crunchstat":          crunchstat.Command,
+		"dispatch-cloud":      dispatchcloud.Command,
+		"dispatch-condor":     condor.DispatchCommand,
+		"dispatch-kubernetes": kubernetes.DispatchCommand,
+		"dispatch-lsf":        lsf.DispatchCommand,
+		"dispatch-slurm":      dispatchslurm.Command,
+		"health":              healthCommand,
+		"instance":            dispatchcloud.InstanceCommand,
+		"keep-balance":        keepbalance.Command,
+		"keep-web":            keepweb.Command,
+		"keepproxy":           keepproxy.Command,
+		"keepstore":           keepstore.Command,
+		"recover-collection":  recovercollection.Command,
+		"workbench2":          wb2command{},
+		"ws":                  ws.Command,
 	})
 )
 
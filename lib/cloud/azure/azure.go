@@ -713,6 +713,10 @@ func (az *azureInstanceSet) InstanceQuotaGroup(arvados.InstanceType) cloud.Insta
 	return ""
 }
 
+func (az *azureInstanceSet) InstanceTypePrices([]arvados.InstanceType) []cloud.InstanceTypePrice {
+	return nil
+}
+
 func (az *azureInstanceSet) Stop() {
 	az.stopFunc()
 	az.stopWg.Wait()
@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"math/big"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -115,9 +116,10 @@ type ec2InstanceSet struct {
 	throttleDelayCreate    atomic.Value
 	throttleDelayInstances atomic.Value
 
-	prices        map[priceKey][]cloud.InstancePrice
-	pricesLock    sync.Mutex
-	pricesUpdated map[priceKey]time.Time
+	prices            map[priceKey][]cloud.InstancePrice
+	pricesLock        sync.Mutex
+	pricesUpdated     map[priceKey]time.Time
+	typePricesUpdated map[string]time.Time // instance type => last fetchSpotPrices
 
 	mInstances      *prometheus.GaugeVec
 	mInstanceStarts *prometheus.CounterVec
@@ -518,15 +520,12 @@ func (instanceSet *ec2InstanceSet) updateSpotPrices(instances []cloud.Instance)
 
 	instanceSet.pricesLock.Lock()
 	defer instanceSet.pricesLock.Unlock()
-	if instanceSet.prices == nil {
-		instanceSet.prices = map[priceKey][]cloud.InstancePrice{}
-		instanceSet.pricesUpdated = map[priceKey]time.Time{}
-	}
+	instanceSet.initPrices()
 
 	updateTime := time.Now()
 	staleTime := updateTime.Add(-instanceSet.ec2config.SpotPriceUpdateInterval.Duration())
 	needUpdate := false
-	allTypes := map[types.InstanceType]bool{}
+	allTypes := map[string]bool{}
 
 	for _, inst := range instances {
 		ec2inst := inst.(*ec2Instance).instance
@@ -539,16 +538,88 @@ func (instanceSet *ec2InstanceSet) updateSpotPrices(instances []cloud.Instance)
 			if instanceSet.pricesUpdated[pk].Before(staleTime) {
 				needUpdate = true
 			}
-			allTypes[ec2inst.InstanceType] = true
+			allTypes[string(ec2inst.InstanceType)] = true
 		}
 	}
 	if !needUpdate {
 		return
 	}
+	instanceSet.fetchSpotPrices(allTypes, updateTime)
+}
+
+// InstanceTypePrices returns the current spot price of each of the
+// given preemptible instance types in each availability zone where
+// a price is available, including the cost of AddedScratch. Prices
+// are looked up if they have not been updated within
+// SpotPriceUpdateInterval.
+//
+// Non-preemptible instance types are not included, because the
+// on-demand price of an instance type is fixed, and is already
+// known from the cluster configuration.
+func (instanceSet *ec2InstanceSet) InstanceTypePrices(its []arvados.InstanceType) []cloud.InstanceTypePrice {
+	if instanceSet.ec2config.SpotPriceUpdateInterval <= 0 {
+		return nil
+	}
+	instanceSet.pricesLock.Lock()
+	defer instanceSet.pricesLock.Unlock()
+	instanceSet.initPrices()
+
+	updateTime := time.Now()
+	staleTime := updateTime.Add(-instanceSet.ec2config.SpotPriceUpdateInterval.Duration())
+	staleTypes := map[string]bool{}
+	for _, it := range its {
+		if it.Preemptible && instanceSet.typePricesUpdated[it.ProviderType].Before(staleTime) {
+			staleTypes[it.ProviderType] = true
+		}
+	}
+	if len(staleTypes) > 0 {
+		instanceSet.fetchSpotPrices(staleTypes, updateTime)
+	}
+
+	var ret []cloud.InstanceTypePrice
+	for _, it := range its {
+		if !it.Preemptible {
+			continue
+		}
+		for pk, prices := range instanceSet.prices {
+			if pk.instanceType != it.ProviderType || !pk.spot || len(prices) == 0 {
+				continue
+			}
+			ret = append(ret, cloud.InstanceTypePrice{
+				InstanceType: it.Name,
+				Zone:         pk.availabilityZone,
+				StartTime:    prices[0].StartTime,
+				Price:        prices[0].Price + instanceSet.addedScratchPrice(it),
+			})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].InstanceType != ret[j].InstanceType {
+			return ret[i].InstanceType < ret[j].InstanceType
+		}
+		return ret[i].Zone < ret[j].Zone
+	})
+	return ret
+}
+
+// Caller must have pricesLock.
+func (instanceSet *ec2InstanceSet) initPrices() {
+	if instanceSet.prices == nil {
+		instanceSet.prices = map[priceKey][]cloud.InstancePrice{}
+		instanceSet.pricesUpdated = map[priceKey]time.Time{}
+		instanceSet.typePricesUpdated = map[string]time.Time{}
+	}
+}
+
+// Retrieve recent spot prices for the given instance types (e.g.,
+// "t2.micro") in all availability zones. Caller must have
+// pricesLock.
+func (instanceSet *ec2InstanceSet) fetchSpotPrices(instanceTypes map[string]bool, updateTime time.Time) {
 	var typeFilterValues []string
-	for instanceType := range allTypes {
-		typeFilterValues = append(typeFilterValues, string(instanceType))
+	for instanceType := range instanceTypes {
+		typeFilterValues = append(typeFilterValues, instanceType)
 	}
+	sort.Strings(typeFilterValues)
 	// Get 3x update interval worth of pricing data. (Ideally the
 	// AWS API would tell us "we have shown you all of the price
 	// changes up to time T", but it doesn't, so we'll just ask
@@ -563,10 +634,12 @@ func (instanceSet *ec2InstanceSet) updateSpotPrices(instances []cloud.Instance)
 			types.Filter{Name: aws.String("product-description"), Values: []string{"Linux/UNIX"}},
 		},
 	}
+	failed := false
 	for {
 		page, err := instanceSet.client.DescribeSpotPriceHistory(context.Background(), dsphi)
 		if err != nil {
 			instanceSet.logger.WithError(err).Warn("error retrieving spot instance prices")
+			failed = true
 			break
 		}
 		for _, ent := range page.SpotPriceHistory {
@@ -595,6 +668,14 @@ func (instanceSet *ec2InstanceSet) updateSpotPrices(instances []cloud.Instance)
 		}
 		dsphi.NextToken = page.NextToken
 	}
+	if !failed {
+		// Only mark the types as updated if we got all of
+		// the pages, so a failed request is retried on the
+		// next call instead of after SpotPriceUpdateInterval.
+		for instanceType := range instanceTypes {
+			instanceSet.typePricesUpdated[instanceType] = updateTime
+		}
+	}
 
 	expiredTime := updateTime.Add(-64 * instanceSet.ec2config.SpotPriceUpdateInterval.Duration())
 	for pk, last := range instanceSet.pricesUpdated {
@@ -608,6 +689,15 @@ func (instanceSet *ec2InstanceSet) updateSpotPrices(instances []cloud.Instance)
 	}
 }
 
+// addedScratchPrice returns the hourly cost of the EBS volume
+// attached to an instance of the given type to provide AddedScratch.
+func (instanceSet *ec2InstanceSet) addedScratchPrice(it arvados.InstanceType) float64 {
+	// ceil(added scratch space in GiB)
+	gib := (it.AddedScratch + 1<<30 - 1) >> 30
+	monthly := instanceSet.ec2config.EBSPrice * float64(gib)
+	return monthly / 30 / 24
+}
+
 func (instanceSet *ec2InstanceSet) Stop() {
 }
 
@@ -745,11 +835,7 @@ func (inst *ec2Instance) PriceHistory(instType arvados.InstanceType) []cloud.Ins
 	}
 	var prices []cloud.InstancePrice
 	for _, price := range inst.provider.prices[pk] {
-		// ceil(added scratch space in GiB)
-		gib := (instType.AddedScratch + 1<<30 - 1) >> 30
-		monthly := inst.provider.ec2config.EBSPrice * float64(gib)
-		hourly := monthly / 30 / 24
-		price.Price += hourly
+		price.Price += inst.provider.addedScratchPrice(instType)
 		prices = append(prices, price)
 	}
 	return prices
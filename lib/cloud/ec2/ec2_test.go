@@ -103,6 +103,8 @@ type ec2stub struct {
 	// {subnetID => error}: RunInstances returns error if subnetID
 	// matches.
 	subnetErrorOnRunInstances map[string]error
+	// DescribeSpotPriceHistory returns this error if non-nil.
+	spotPriceHistoryError error
 }
 
 func (e *ec2stub) ImportKeyPair(ctx context.Context, input *ec2.ImportKeyPairInput, _ ...func(*ec2.Options)) (*ec2.ImportKeyPairOutput, error) {
@@ -163,6 +165,9 @@ func (e *ec2stub) DescribeInstanceStatus(ctx context.Context, input *ec2.Describ
 }
 
 func (e *ec2stub) DescribeSpotPriceHistory(ctx context.Context, input *ec2.DescribeSpotPriceHistoryInput, _ ...func(*ec2.Options)) (*ec2.DescribeSpotPriceHistoryOutput, error) {
+	if e.spotPriceHistoryError != nil {
+		return nil, e.spotPriceHistoryError
+	}
 	if input.NextToken == nil || *input.NextToken == "" {
 		return &ec2.DescribeSpotPriceHistoryOutput{
 			SpotPriceHistory: []types.SpotPrice{
@@ -587,6 +592,56 @@ func (*EC2InstanceSetSuite) TestInstancePriceHistory(c *check.C) {
 	}
 }
 
+func (*EC2InstanceSetSuite) TestInstanceTypePrices(c *check.C) {
+	ap, _, cluster, _ := GetInstanceSet(c, "{}")
+	its := []arvados.InstanceType{cluster.InstanceTypes["tiny"], cluster.InstanceTypes["tiny-preemptible"]}
+
+	// Price lookups are disabled.
+	c.Check(ap.InstanceTypePrices(its), check.HasLen, 0)
+
+	ap.ec2config.SpotPriceUpdateInterval = arvados.Duration(time.Hour)
+	ap.ec2config.EBSPrice = 0.1 // $/GiB/month
+	prices := ap.InstanceTypePrices(its)
+	c.Logf("prices: %+v", prices)
+	c.Assert(len(prices) > 0, check.Equals, true)
+	for _, p := range prices {
+		// The non-preemptible type is not included.
+		c.Check(p.InstanceType, check.Equals, "tiny-preemptible")
+		c.Check(p.Zone, check.Not(check.Equals), "")
+		c.Check(p.Price > 0, check.Equals, true)
+	}
+	if *live == "" {
+		c.Check(prices, check.HasLen, 1)
+		c.Check(prices[0].Zone, check.Equals, "aa-east-1a")
+		c.Check(prices[0].Price, check.Equals, 0.01)
+	}
+
+	// AddedScratch cost is included.
+	it := cluster.InstanceTypes["tiny-preemptible"]
+	it.AddedScratch = 640 << 30
+	withScratch := ap.InstanceTypePrices([]arvados.InstanceType{it})
+	c.Assert(withScratch, check.HasLen, len(prices))
+	c.Check(withScratch[0].Price > prices[0].Price, check.Equals, true)
+}
+
+func (*EC2InstanceSetSuite) TestInstanceTypePricesRetryAfterError(c *check.C) {
+	if *live != "" {
+		c.Skip("requires stub")
+	}
+	ap, _, cluster, _ := GetInstanceSet(c, "{}")
+	its := []arvados.InstanceType{cluster.InstanceTypes["tiny-preemptible"]}
+	ap.ec2config.SpotPriceUpdateInterval = arvados.Duration(time.Hour)
+
+	ap.client.(*ec2stub).spotPriceHistoryError = &ec2stubError{Code: "InternalError"}
+	c.Check(ap.InstanceTypePrices(its), check.HasLen, 0)
+
+	// The next call retries instead of waiting for
+	// SpotPriceUpdateInterval.
+	ap.client.(*ec2stub).spotPriceHistoryError = nil
+	prices := ap.InstanceTypePrices(its)
+	c.Check(prices, check.HasLen, 1)
+}
+
 func (*EC2InstanceSetSuite) TestWrapError(c *check.C) {
 	retryError := &ec2stubError{Code: "Throttling"}
 	wrapped := wrapError(retryError, &atomic.Value{})
@@ -0,0 +1,843 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package gce
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/cloudbilling/v1"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// Driver is the gce implementation of the cloud.Driver interface.
+var Driver = cloud.DriverFunc(newGCEInstanceSet)
+
+const (
+	throttleDelayMin = time.Second
+	throttleDelayMax = time.Minute
+
+	// Maximum time to wait for an insert operation to finish
+	// (and report errors like ZONE_RESOURCE_POOL_EXHAUSTED that
+	// are only reported asynchronously).
+	createTimeout = 5 * time.Minute
+
+	// Instance metadata key used to store the instance tags.
+	// Labels are too restrictive (lowercase letters, digits,
+	// "_", and "-") to store arbitrary tags, so labels are only
+	// used to filter the instance list, and the real tags are
+	// stored in metadata.
+	tagsMetadataKey = "arvados-tags"
+
+	// Name of the Compute Engine service in the Cloud Billing
+	// catalog.
+	computeBillingService = "services/6F81-5844-456A"
+)
+
+type gceInstanceSetConfig struct {
+	Project                  string
+	Zone                     string
+	CredentialsFile          string
+	Network                  string
+	Subnet                   string
+	ServiceAccount           string
+	ExternalIP               bool
+	AdminUsername            string
+	DiskType                 string
+	DiskPrice                float64
+	SpotPriceUpdateInterval  arvados.Duration
+	MachineFamilyQuotaGroups map[string]string
+}
+
+// gceInterface is the subset of the Compute Engine and Cloud Billing
+// APIs used by the driver. Tests replace it with a stub.
+type gceInterface interface {
+	InsertInstance(ctx context.Context, inst *compute.Instance) (*compute.Operation, error)
+	WaitOperation(ctx context.Context, op *compute.Operation) (*compute.Operation, error)
+	ListInstances(ctx context.Context, filter, pageToken string) (*compute.InstanceList, error)
+	GetInstance(ctx context.Context, name string) (*compute.Instance, error)
+	SetInstanceLabels(ctx context.Context, name string, req *compute.InstancesSetLabelsRequest) (*compute.Operation, error)
+	SetInstanceMetadata(ctx context.Context, name string, md *compute.Metadata) (*compute.Operation, error)
+	DeleteInstance(ctx context.Context, name string) (*compute.Operation, error)
+	ListSkus(ctx context.Context, pageToken string) (*cloudbilling.ListSkusResponse, error)
+}
+
+// gceClient implements gceInterface using the Google API client
+// libraries.
+type gceClient struct {
+	project string
+	zone    string
+	compute *compute.Service
+	billing *cloudbilling.APIService
+}
+
+func (cl *gceClient) InsertInstance(ctx context.Context, inst *compute.Instance) (*compute.Operation, error) {
+	return cl.compute.Instances.Insert(cl.project, cl.zone, inst).Context(ctx).Do()
+}
+
+func (cl *gceClient) WaitOperation(ctx context.Context, op *compute.Operation) (*compute.Operation, error) {
+	return cl.compute.ZoneOperations.Wait(cl.project, cl.zone, op.Name).Context(ctx).Do()
+}
+
+func (cl *gceClient) ListInstances(ctx context.Context, filter, pageToken string) (*compute.InstanceList, error) {
+	return cl.compute.Instances.List(cl.project, cl.zone).Filter(filter).PageToken(pageToken).Context(ctx).Do()
+}
+
+func (cl *gceClient) GetInstance(ctx context.Context, name string) (*compute.Instance, error) {
+	return cl.compute.Instances.Get(cl.project, cl.zone, name).Context(ctx).Do()
+}
+
+func (cl *gceClient) SetInstanceLabels(ctx context.Context, name string, req *compute.InstancesSetLabelsRequest) (*compute.Operation, error) {
+	return cl.compute.Instances.SetLabels(cl.project, cl.zone, name, req).Context(ctx).Do()
+}
+
+func (cl *gceClient) SetInstanceMetadata(ctx context.Context, name string, md *compute.Metadata) (*compute.Operation, error) {
+	return cl.compute.Instances.SetMetadata(cl.project, cl.zone, name, md).Context(ctx).Do()
+}
+
+func (cl *gceClient) DeleteInstance(ctx context.Context, name string) (*compute.Operation, error) {
+	return cl.compute.Instances.Delete(cl.project, cl.zone, name).Context(ctx).Do()
+}
+
+func (cl *gceClient) ListSkus(ctx context.Context, pageToken string) (*cloudbilling.ListSkusResponse, error) {
+	return cl.billing.Services.Skus.List(computeBillingService).CurrencyCode("USD").PageToken(pageToken).Context(ctx).Do()
+}
+
+type gceInstanceSet struct {
+	gceconfig              gceInstanceSetConfig
+	instanceSetID          cloud.InstanceSetID
+	logger                 logrus.FieldLogger
+	client                 gceInterface
+	throttleDelayCreate    atomic.Value
+	throttleDelayInstances atomic.Value
+
+	prices        map[priceKey][]spotPrice
+	pricesLock    sync.Mutex
+	pricesUpdated time.Time
+
+	mInstances      prometheus.Gauge
+	mInstanceStarts *prometheus.CounterVec
+}
+
+func newGCEInstanceSet(confRaw json.RawMessage, instanceSetID cloud.InstanceSetID, _ cloud.SharedResourceTags, logger logrus.FieldLogger, reg *prometheus.Registry) (prv cloud.InstanceSet, err error) {
+	instanceSet := &gceInstanceSet{
+		instanceSetID: instanceSetID,
+		logger:        logger,
+	}
+	err = json.Unmarshal(confRaw, &instanceSet.gceconfig)
+	if err != nil {
+		return nil, err
+	}
+	if instanceSet.gceconfig.Project == "" || instanceSet.gceconfig.Zone == "" {
+		return nil, errors.New("Project and Zone must be configured")
+	}
+	if instanceSet.gceconfig.DiskType == "" {
+		instanceSet.gceconfig.DiskType = "pd-balanced"
+	}
+
+	ctx := context.Background()
+	var creds *google.Credentials
+	if fnm := instanceSet.gceconfig.CredentialsFile; fnm != "" {
+		buf, err := os.ReadFile(fnm)
+		if err != nil {
+			return nil, err
+		}
+		creds, err = google.CredentialsFromJSONWithType(ctx, buf, google.ServiceAccount, compute.CloudPlatformScope)
+		if err != nil {
+			return nil, fmt.Errorf("error loading credentials from %s: %w", fnm, err)
+		}
+	} else {
+		// Use default credentials, e.g., the service account
+		// of the VM where the dispatcher is running.
+		creds, err = google.FindDefaultCredentials(ctx, compute.CloudPlatformScope)
+		if err != nil {
+			return nil, err
+		}
+	}
+	computeSvc, err := compute.NewService(ctx, option.WithCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	billingSvc, err := cloudbilling.NewService(ctx, option.WithCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	instanceSet.client = &gceClient{
+		project: instanceSet.gceconfig.Project,
+		zone:    instanceSet.gceconfig.Zone,
+		compute: computeSvc,
+		billing: billingSvc,
+	}
+
+	// Set up metrics
+	instanceSet.mInstances = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "gce_instances",
+		Help:      "Number of instances running",
+	})
+	instanceSet.mInstanceStarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "gce_instance_starts_total",
+		Help:      "Number of attempts to start a new instance",
+	}, []string{"success"})
+	instanceSet.mInstanceStarts.WithLabelValues("0").Add(0)
+	instanceSet.mInstanceStarts.WithLabelValues("1").Add(0)
+	if reg != nil {
+		reg.MustRegister(instanceSet.mInstances)
+		reg.MustRegister(instanceSet.mInstanceStarts)
+	}
+
+	return instanceSet, nil
+}
+
+var reLabelInvalidChars = regexp.MustCompile(`[^a-z0-9_-]`)
+
+// labelString converts s to a valid label key or value: at most 63
+// lowercase letters, digits, "_", and "-". Keys must also start with
+// a letter.
+func labelString(s string, isKey bool) string {
+	s = reLabelInvalidChars.ReplaceAllString(strings.ToLower(s), "_")
+	if isKey && (s == "" || s[0] < 'a' || s[0] > 'z') {
+		s = "x" + s
+	}
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// tagLabels returns the labels that correspond to the given tags.
+//
+// Different tags can map to the same label, so labels can only be
+// used to narrow down a list of instances; the caller still needs to
+// compare the real tags.
+func tagLabels(tags cloud.InstanceTags) map[string]string {
+	labels := map[string]string{}
+	for k, v := range tags {
+		labels[labelString(k, true)] = labelString(v, false)
+	}
+	return labels
+}
+
+// labelFilter returns a list filter expression that matches
+// instances with all of the given tags.
+func labelFilter(tags cloud.InstanceTags) string {
+	var exprs []string
+	for k, v := range tagLabels(tags) {
+		exprs = append(exprs, fmt.Sprintf("(labels.%s = %q)", k, v))
+	}
+	return strings.Join(exprs, " ")
+}
+
+func (instanceSet *gceInstanceSet) zonePath(kind, name string) string {
+	return "zones/" + instanceSet.gceconfig.Zone + "/" + kind + "/" + name
+}
+
+func (instanceSet *gceInstanceSet) Create(
+	instanceType arvados.InstanceType,
+	imageID cloud.ImageID,
+	newTags cloud.InstanceTags,
+	initCommand cloud.InitCommand,
+	publicKey ssh.PublicKey) (cloud.Instance, error) {
+
+	var randomBytes [8]byte
+	if _, err := rand.Read(randomBytes[:]); err != nil {
+		return nil, err
+	}
+	name := "arvados-" + hex.EncodeToString(randomBytes[:])
+
+	tagsJSON, err := json.Marshal(newTags)
+	if err != nil {
+		return nil, err
+	}
+	startupScript := "#!/bin/sh\n" + string(initCommand) + "\n"
+	metadata := &compute.Metadata{Items: []*compute.MetadataItems{
+		{Key: tagsMetadataKey, Value: googleapi.String(string(tagsJSON))},
+		{Key: "startup-script", Value: &startupScript},
+	}}
+	if publicKey != nil {
+		sshKeys := instanceSet.gceconfig.AdminUsername + ":" + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: "ssh-keys", Value: &sshKeys})
+	}
+
+	nic := &compute.NetworkInterface{
+		Network:    instanceSet.gceconfig.Network,
+		Subnetwork: instanceSet.gceconfig.Subnet,
+	}
+	if instanceSet.gceconfig.ExternalIP {
+		nic.AccessConfigs = []*compute.AccessConfig{{
+			Name: "External NAT",
+			Type: "ONE_TO_ONE_NAT",
+		}}
+	}
+
+	inst := &compute.Instance{
+		Name:        name,
+		MachineType: instanceSet.zonePath("machineTypes", instanceType.ProviderType),
+		Labels:      tagLabels(newTags),
+		Metadata:    metadata,
+		Disks: []*compute.AttachedDisk{{
+			Boot:       true,
+			AutoDelete: true,
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				SourceImage: string(imageID),
+			},
+		}},
+		NetworkInterfaces: []*compute.NetworkInterface{nic},
+	}
+
+	if instanceType.AddedScratch > 0 {
+		inst.Disks = append(inst.Disks, &compute.AttachedDisk{
+			AutoDelete: true,
+			DeviceName: "scratch",
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				DiskSizeGb: (int64(instanceType.AddedScratch) + (1<<30 - 1)) >> 30,
+				DiskType:   instanceSet.zonePath("diskTypes", instanceSet.gceconfig.DiskType),
+			},
+		})
+	}
+
+	if instanceType.Preemptible {
+		inst.Scheduling = &compute.Scheduling{
+			ProvisioningModel:         "SPOT",
+			InstanceTerminationAction: "DELETE",
+			OnHostMaintenance:         "TERMINATE",
+			AutomaticRestart:          googleapi.Bool(false),
+		}
+	}
+
+	if instanceSet.gceconfig.ServiceAccount != "" {
+		inst.ServiceAccounts = []*compute.ServiceAccount{{
+			Email:  instanceSet.gceconfig.ServiceAccount,
+			Scopes: []string{compute.CloudPlatformScope},
+		}}
+	}
+
+	err = instanceSet.insert(inst)
+	instanceSet.mInstanceStarts.WithLabelValues(boolLabelValue[err == nil]).Add(1)
+	if err != nil {
+		return nil, wrapError(err, &instanceSet.throttleDelayCreate)
+	}
+	inst.Status = "PROVISIONING"
+	return &gceInstance{
+		provider: instanceSet,
+		instance: inst,
+	}, nil
+}
+
+// insert creates the instance and waits for the insert operation to
+// finish. If the operation fails, the returned error is an
+// *operationError.
+func (instanceSet *gceInstanceSet) insert(inst *compute.Instance) error {
+	ctx, cancel := context.WithTimeout(context.Background(), createTimeout)
+	defer cancel()
+	op, err := instanceSet.client.InsertInstance(ctx, inst)
+	for err == nil && op.Status != "DONE" {
+		// Wait returns when the operation is done or after
+		// about 2 minutes, whichever comes first.
+		op, err = instanceSet.client.WaitOperation(ctx, op)
+	}
+	if err != nil {
+		return err
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return &operationError{op.Error.Errors[0]}
+	}
+	return nil
+}
+
+func (instanceSet *gceInstanceSet) Instances(tags cloud.InstanceTags) (instances []cloud.Instance, err error) {
+	filter := labelFilter(tags)
+	pageToken := ""
+	needPrices := false
+	for {
+		list, err := instanceSet.client.ListInstances(context.Background(), filter, pageToken)
+		err = wrapError(err, &instanceSet.throttleDelayInstances)
+		if err != nil {
+			return nil, err
+		}
+		for _, inst := range list.Items {
+			instances = append(instances, &gceInstance{
+				provider: instanceSet,
+				instance: inst,
+			})
+			if isSpot(inst) {
+				needPrices = true
+			}
+		}
+		if list.NextPageToken == "" {
+			break
+		}
+		pageToken = list.NextPageToken
+	}
+	if needPrices && instanceSet.gceconfig.SpotPriceUpdateInterval > 0 {
+		instanceSet.updateSpotPrices()
+	}
+	instanceSet.mInstances.Set(float64(len(instances)))
+	return instances, nil
+}
+
+func isSpot(inst *compute.Instance) bool {
+	return inst.Scheduling != nil && (inst.Scheduling.ProvisioningModel == "SPOT" || inst.Scheduling.Preemptible)
+}
+
+type priceKey struct {
+	family string // machine family, like "n2"
+	region string // like "us-central1"
+}
+
+// spotPrice is the hourly price of one vCPU and one GiB of RAM for
+// spot instances in a given machine family and region.
+type spotPrice struct {
+	StartTime time.Time
+	Core      float64
+	RAM       float64
+}
+
+// reSpotSkuDescription matches the descriptions of per-vCPU and
+// per-GiB-RAM spot instance prices for predefined machine types in
+// the Cloud Billing catalog, like "Spot Preemptible N2 Instance Core
+// running in Americas".
+var reSpotSkuDescription = regexp.MustCompile(`^Spot Preemptible (\w+)( Predefined)? Instance (Core|Ram) running in `)
+
+// Refresh spot instance pricing data from the Cloud Billing catalog,
+// unless it was refreshed less than SpotPriceUpdateInterval ago.
+//
+// The catalog only provides the current price, so price history
+// accumulates while the dispatcher is running.
+func (instanceSet *gceInstanceSet) updateSpotPrices() {
+	instanceSet.pricesLock.Lock()
+	defer instanceSet.pricesLock.Unlock()
+	updateTime := time.Now()
+	if updateTime.Sub(instanceSet.pricesUpdated) < instanceSet.gceconfig.SpotPriceUpdateInterval.Duration() {
+		return
+	}
+	if instanceSet.prices == nil {
+		instanceSet.prices = map[priceKey][]spotPrice{}
+	}
+	current := map[priceKey]*spotPrice{}
+	pageToken := ""
+	for {
+		page, err := instanceSet.client.ListSkus(context.Background(), pageToken)
+		if err != nil {
+			instanceSet.logger.WithError(err).Warn("error retrieving spot instance prices")
+			return
+		}
+		for _, sku := range page.Skus {
+			m := reSpotSkuDescription.FindStringSubmatch(sku.Description)
+			if m == nil || len(sku.PricingInfo) == 0 || sku.PricingInfo[0].PricingExpression == nil {
+				continue
+			}
+			pi := sku.PricingInfo[0]
+			rates := pi.PricingExpression.TieredRates
+			if len(rates) == 0 || rates[len(rates)-1].UnitPrice == nil {
+				// bogus record?
+				continue
+			}
+			unitPrice := rates[len(rates)-1].UnitPrice
+			price := float64(unitPrice.Units) + float64(unitPrice.Nanos)/1e9
+			startTime, err := time.Parse(time.RFC3339Nano, pi.EffectiveTime)
+			if err != nil {
+				startTime = updateTime
+			}
+			for _, region := range sku.ServiceRegions {
+				pk := priceKey{family: strings.ToLower(m[1]), region: region}
+				sp := current[pk]
+				if sp == nil {
+					sp = &spotPrice{}
+					current[pk] = sp
+				}
+				if m[3] == "Core" {
+					sp.Core = price
+				} else {
+					sp.RAM = price
+				}
+				if startTime.After(sp.StartTime) {
+					sp.StartTime = startTime
+				}
+			}
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+	for pk, sp := range current {
+		if sp.Core == 0 || sp.RAM == 0 {
+			// Need both prices to calculate an instance
+			// price.
+			continue
+		}
+		hist := instanceSet.prices[pk]
+		if len(hist) == 0 || hist[0].Core != sp.Core || hist[0].RAM != sp.RAM {
+			instanceSet.prices[pk] = append([]spotPrice{*sp}, hist...)
+		}
+	}
+	instanceSet.pricesUpdated = updateTime
+}
+
+func (instanceSet *gceInstanceSet) Stop() {
+}
+
+// InstanceQuotaGroup returns the machine family of the given instance
+// type (e.g., "n2" for "n2-standard-4"), or the group configured for
+// that machine family in MachineFamilyQuotaGroups.
+//
+// On GCE, most machine families have their own regional vCPU quota
+// (e.g., "N2_CPUS"), while older families like N1 share the "CPUS"
+// quota.
+func (instanceSet *gceInstanceSet) InstanceQuotaGroup(it arvados.InstanceType) cloud.InstanceQuotaGroup {
+	quotaGroup := machineFamily(it.ProviderType)
+	if conf := instanceSet.gceconfig.MachineFamilyQuotaGroups[quotaGroup]; conf != "" {
+		quotaGroup = conf
+	}
+	if it.Preemptible {
+		// Spot instances use the separate preemptible vCPU
+		// quota, where one has been granted.
+		quotaGroup += "-spot"
+	}
+	return cloud.InstanceQuotaGroup(quotaGroup)
+}
+
+// machineFamily returns the machine family of a machine type, like
+// "n2" for "n2-standard-4".
+func machineFamily(machineType string) string {
+	family, _, _ := strings.Cut(strings.ToLower(machineType), "-")
+	return family
+}
+
+type gceInstance struct {
+	provider *gceInstanceSet
+	instance *compute.Instance
+}
+
+func (inst *gceInstance) ID() cloud.InstanceID {
+	return cloud.InstanceID(inst.instance.Name)
+}
+
+func (inst *gceInstance) String() string {
+	return inst.instance.Name
+}
+
+// ProviderType returns the machine type name, like "n2-standard-4".
+// The API reports the machine type as a URL.
+func (inst *gceInstance) ProviderType() string {
+	mt := inst.instance.MachineType
+	return mt[strings.LastIndex(mt, "/")+1:]
+}
+
+func (inst *gceInstance) SetTags(newTags cloud.InstanceTags) error {
+	ctx := context.Background()
+	tagsJSON, err := json.Marshal(newTags)
+	if err != nil {
+		return err
+	}
+	// Get the current metadata/label fingerprints, which must be
+	// included in the update requests.
+	current, err := inst.provider.client.GetInstance(ctx, inst.instance.Name)
+	if err != nil {
+		return err
+	}
+	md := current.Metadata
+	if md == nil {
+		md = &compute.Metadata{}
+	}
+	found := false
+	for _, item := range md.Items {
+		if item.Key == tagsMetadataKey {
+			item.Value = googleapi.String(string(tagsJSON))
+			found = true
+		}
+	}
+	if !found {
+		md.Items = append(md.Items, &compute.MetadataItems{Key: tagsMetadataKey, Value: googleapi.String(string(tagsJSON))})
+	}
+	_, err = inst.provider.client.SetInstanceMetadata(ctx, inst.instance.Name, md)
+	if err != nil {
+		return err
+	}
+	_, err = inst.provider.client.SetInstanceLabels(ctx, inst.instance.Name, &compute.InstancesSetLabelsRequest{
+		Labels:           tagLabels(newTags),
+		LabelFingerprint: current.LabelFingerprint,
+	})
+	return err
+}
+
+func (inst *gceInstance) Tags() cloud.InstanceTags {
+	if inst.instance.Metadata != nil {
+		for _, item := range inst.instance.Metadata.Items {
+			if item.Key != tagsMetadataKey || item.Value == nil {
+				continue
+			}
+			var tags cloud.InstanceTags
+			if err := json.Unmarshal([]byte(*item.Value), &tags); err == nil {
+				return tags
+			}
+		}
+	}
+	// Not created by this driver, or metadata is corrupt. Labels
+	// are the best we can do.
+	tags := cloud.InstanceTags{}
+	for k, v := range inst.instance.Labels {
+		tags[k] = v
+	}
+	return tags
+}
+
+func (inst *gceInstance) Destroy() error {
+	_, err := inst.provider.client.DeleteInstance(context.Background(), inst.instance.Name)
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusNotFound {
+		// Already deleted.
+		return nil
+	}
+	return err
+}
+
+func (inst *gceInstance) Address() string {
+	if len(inst.instance.NetworkInterfaces) > 0 {
+		return inst.instance.NetworkInterfaces[0].NetworkIP
+	}
+	return ""
+}
+
+func (inst *gceInstance) RemoteUser() string {
+	return inst.provider.gceconfig.AdminUsername
+}
+
+func (inst *gceInstance) VerifyHostKey(ssh.PublicKey, *ssh.Client) error {
+	return cloud.ErrNotImplemented
+}
+
+// PriceHistory returns the price history for this specific instance.
+//
+// Prices are only available for spot instances whose machine family
+// has per-vCPU and per-GiB spot prices in the Cloud Billing catalog.
+// The instance price is calculated from the VCPUs and RAM of the
+// given instance type, plus the cost of AddedScratch according to
+// the configured DiskPrice.
+func (inst *gceInstance) PriceHistory(instType arvados.InstanceType) []cloud.InstancePrice {
+	if !isSpot(inst.instance) {
+		return nil
+	}
+	// Use the machine type of the actual instance, in case it
+	// differs from the configured type.
+	instType.ProviderType = inst.ProviderType()
+	inst.provider.pricesLock.Lock()
+	defer inst.provider.pricesLock.Unlock()
+	return inst.provider.spotPriceHistory(instType)
+}
+
+// InstanceTypePrices returns the current spot price of each of the
+// given preemptible instance types in the configured zone, where
+// available, refreshing the Cloud Billing catalog data if it is more
+// than SpotPriceUpdateInterval old.
+//
+// Non-preemptible instance types are not included, because their
+// prices are already known from the cluster configuration.
+func (instanceSet *gceInstanceSet) InstanceTypePrices(its []arvados.InstanceType) []cloud.InstanceTypePrice {
+	if instanceSet.gceconfig.SpotPriceUpdateInterval <= 0 {
+		return nil
+	}
+	instanceSet.updateSpotPrices()
+	instanceSet.pricesLock.Lock()
+	defer instanceSet.pricesLock.Unlock()
+	var ret []cloud.InstanceTypePrice
+	for _, it := range its {
+		if !it.Preemptible {
+			continue
+		}
+		hist := instanceSet.spotPriceHistory(it)
+		if len(hist) == 0 {
+			continue
+		}
+		ret = append(ret, cloud.InstanceTypePrice{
+			InstanceType: it.Name,
+			Zone:         instanceSet.gceconfig.Zone,
+			StartTime:    hist[0].StartTime,
+			Price:        hist[0].Price,
+		})
+	}
+	return ret
+}
+
+// spotPriceHistory returns the spot price history of the given
+// instance type in the configured zone, most recent first. Caller
+// must have pricesLock.
+func (instanceSet *gceInstanceSet) spotPriceHistory(instType arvados.InstanceType) []cloud.InstancePrice {
+	// The region is the zone without the final "-x" suffix.
+	zone := instanceSet.gceconfig.Zone
+	pk := priceKey{
+		family: machineFamily(instType.ProviderType),
+		region: zone[:max(strings.LastIndex(zone, "-"), 0)],
+	}
+	var prices []cloud.InstancePrice
+	for _, sp := range instanceSet.prices[pk] {
+		// ceil(added scratch space in GiB)
+		gib := (instType.AddedScratch + 1<<30 - 1) >> 30
+		monthly := instanceSet.gceconfig.DiskPrice * float64(gib)
+		prices = append(prices, cloud.InstancePrice{
+			StartTime: sp.StartTime,
+			Price:     sp.Core*float64(instType.VCPUs) + sp.RAM*float64(instType.RAM)/(1<<30) + monthly/30/24,
+		})
+	}
+	return prices
+}
+
+// operationError is an error reported by a Compute Engine operation
+// after the API request that started it succeeded.
+type operationError struct {
+	*compute.OperationErrorErrors
+}
+
+func (err *operationError) Error() string {
+	return err.Code + ": " + err.Message
+}
+
+type rateLimitError struct {
+	error
+	earliestRetry time.Time
+}
+
+func (err rateLimitError) EarliestRetry() time.Time {
+	return err.earliestRetry
+}
+
+type capacityError struct {
+	error
+	isInstanceQuotaGroupSpecific bool
+	isInstanceTypeSpecific       bool
+}
+
+func (er *capacityError) IsCapacityError() bool {
+	return true
+}
+
+func (er *capacityError) IsInstanceQuotaGroupSpecific() bool {
+	return er.isInstanceQuotaGroupSpecific
+}
+
+func (er *capacityError) IsInstanceTypeSpecific() bool {
+	return er.isInstanceTypeSpecific
+}
+
+type gceQuotaError struct {
+	error
+}
+
+func (er *gceQuotaError) IsQuotaError() bool {
+	return true
+}
+
+// errorCode returns the error code and message from an API error or
+// an operation error. API errors report a "reason" like
+// "quotaExceeded", while operation errors report a code like
+// "QUOTA_EXCEEDED".
+func errorCode(err error) (code, message string) {
+	var operr *operationError
+	var gerr *googleapi.Error
+	if errors.As(err, &operr) {
+		return operr.Code, operr.Message
+	} else if errors.As(err, &gerr) {
+		if len(gerr.Errors) > 0 {
+			return gerr.Errors[0].Reason, gerr.Message
+		} else if gerr.Code == http.StatusTooManyRequests {
+			return "rateLimitExceeded", gerr.Message
+		}
+		return "", gerr.Message
+	}
+	return "", ""
+}
+
+var isCodeThrottle = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"RATE_LIMIT_EXCEEDED":   true,
+}
+
+var isCodeQuota = map[string]bool{
+	"quotaExceeded":  true,
+	"QUOTA_EXCEEDED": true,
+}
+
+var isCodeCapacity = map[string]bool{
+	"ZONE_RESOURCE_POOL_EXHAUSTED":              true,
+	"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS": true,
+	"resourcePoolExhausted":                     true,
+}
+
+// reCPUQuota matches the message of a quota error that refers to a
+// regional vCPU quota, like "Quota 'N2_CPUS' exceeded. Limit: 24.0
+// in region us-central1."
+var reCPUQuota = regexp.MustCompile(`Quota '(\w+_)?CPUS' exceeded`)
+
+// isErrorCapacity determines whether the given error indicates lack
+// of capacity to run a specific instance type (i.e., retrying with
+// any other instance type might succeed) or an instance quota group
+// (i.e., retrying with an instance type in a different machine
+// family might succeed).
+func isErrorCapacity(err error) (instcap bool, groupcap bool) {
+	code, message := errorCode(err)
+	if isCodeQuota[code] && reCPUQuota.MatchString(message) {
+		return false, true
+	}
+	if isCodeCapacity[code] {
+		return true, false
+	}
+	return false, false
+}
+
+func wrapError(err error, throttleValue *atomic.Value) error {
+	code, _ := errorCode(err)
+	if isCodeThrottle[code] {
+		// Back off exponentially until an upstream call
+		// either succeeds or returns a non-throttle error.
+		d, _ := throttleValue.Load().(time.Duration)
+		d = d*3/2 + time.Second
+		if d < throttleDelayMin {
+			d = throttleDelayMin
+		} else if d > throttleDelayMax {
+			d = throttleDelayMax
+		}
+		throttleValue.Store(d)
+		return rateLimitError{error: err, earliestRetry: time.Now().Add(d)}
+	} else if instcap, groupcap := isErrorCapacity(err); instcap || groupcap {
+		return &capacityError{
+			error:                        err,
+			isInstanceTypeSpecific:       !groupcap,
+			isInstanceQuotaGroupSpecific: groupcap,
+		}
+	} else if isCodeQuota[code] {
+		return &gceQuotaError{error: err}
+	} else if err != nil {
+		throttleValue.Store(time.Duration(0))
+		return err
+	}
+	throttleValue.Store(time.Duration(0))
+	return nil
+}
+
+var boolLabelValue = map[bool]string{false: "0", true: "1"}
@@ -0,0 +1,674 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+//
+//
+// How to manually run individual tests against the real cloud:
+//
+// $ go test -v git.arvados.org/arvados.git/lib/cloud/gce -live-gce-cfg gceconfig.yml -check.f=TestCreate
+//
+// Tests should be run individually and in the order they are listed in the file:
+//
+// Example gceconfig.yml:
+//
+// ImageIDForTestSuite: projects/my-project/global/images/arvados-compute-xxxx
+// DriverParameters:
+//       Project: my-project
+//       Zone: us-central1-a
+//       CredentialsFile: /path/to/service-account.json
+//       Subnet: regions/us-central1/subnetworks/default
+//       AdminUsername: crunch
+
+package gce
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/config"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/cloudbilling/v1"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	check "gopkg.in/check.v1"
+)
+
+var live = flag.String("live-gce-cfg", "", "Test with real GCE API, provide config file")
+
+// Gocheck boilerplate
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type GCEInstanceSetSuite struct{}
+
+var _ = check.Suite(&GCEInstanceSetSuite{})
+
+type testConfig struct {
+	ImageIDForTestSuite string
+	DriverParameters    json.RawMessage
+}
+
+// gcestub is an in-memory implementation of gceInterface.
+type gcestub struct {
+	sync.Mutex
+	instances  map[string]*compute.Instance
+	skus       []*cloudbilling.Sku
+	insertCall []*compute.Instance
+	// If not nil, the insert operation fails with this error.
+	operationError *compute.OperationErrorErrors
+	// If not nil, API calls fail with this error.
+	apiError error
+}
+
+func (e *gcestub) InsertInstance(ctx context.Context, inst *compute.Instance) (*compute.Operation, error) {
+	e.Lock()
+	defer e.Unlock()
+	e.insertCall = append(e.insertCall, inst)
+	if e.apiError != nil {
+		return nil, e.apiError
+	}
+	if e.operationError != nil {
+		return &compute.Operation{Name: "op-insert", Status: "RUNNING"}, nil
+	}
+	stored := *inst
+	stored.Status = "RUNNING"
+	stored.MachineType = "https://www.googleapis.com/compute/v1/projects/test-project/" + inst.MachineType
+	stored.NetworkInterfaces = []*compute.NetworkInterface{{NetworkIP: fmt.Sprintf("10.1.2.%d", len(e.instances)+3)}}
+	stored.Metadata = &compute.Metadata{Items: inst.Metadata.Items, Fingerprint: "md-fingerprint-0"}
+	stored.LabelFingerprint = "label-fingerprint-0"
+	e.instances[inst.Name] = &stored
+	return &compute.Operation{Name: "op-insert", Status: "DONE"}, nil
+}
+
+func (e *gcestub) WaitOperation(ctx context.Context, op *compute.Operation) (*compute.Operation, error) {
+	e.Lock()
+	defer e.Unlock()
+	done := *op
+	done.Status = "DONE"
+	if e.operationError != nil {
+		done.Error = &compute.OperationError{Errors: []*compute.OperationErrorErrors{e.operationError}}
+	}
+	return &done, nil
+}
+
+func (e *gcestub) ListInstances(ctx context.Context, filter, pageToken string) (*compute.InstanceList, error) {
+	e.Lock()
+	defer e.Unlock()
+	if e.apiError != nil {
+		return nil, e.apiError
+	}
+	var names []string
+	for name, inst := range e.instances {
+		match := name > pageToken
+		for k, v := range inst.Labels {
+			if strings.Contains(filter, "(labels."+k+" ") && !strings.Contains(filter, fmt.Sprintf("(labels.%s = %q)", k, v)) {
+				match = false
+			}
+		}
+		if match {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	// Return one instance per page, to exercise paging.
+	var list compute.InstanceList
+	if len(names) > 0 {
+		list.Items = []*compute.Instance{e.instances[names[0]]}
+	}
+	if len(names) > 1 {
+		list.NextPageToken = names[0]
+	}
+	return &list, nil
+}
+
+func (e *gcestub) GetInstance(ctx context.Context, name string) (*compute.Instance, error) {
+	e.Lock()
+	defer e.Unlock()
+	inst, ok := e.instances[name]
+	if !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound}
+	}
+	copied := *inst
+	md := *inst.Metadata
+	md.Items = append([]*compute.MetadataItems(nil), md.Items...)
+	copied.Metadata = &md
+	return &copied, nil
+}
+
+func (e *gcestub) SetInstanceLabels(ctx context.Context, name string, req *compute.InstancesSetLabelsRequest) (*compute.Operation, error) {
+	e.Lock()
+	defer e.Unlock()
+	inst, ok := e.instances[name]
+	if !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound}
+	}
+	if req.LabelFingerprint != inst.LabelFingerprint {
+		return nil, &googleapi.Error{Code: http.StatusPreconditionFailed}
+	}
+	inst.Labels = req.Labels
+	inst.LabelFingerprint += "+"
+	return &compute.Operation{Status: "RUNNING"}, nil
+}
+
+func (e *gcestub) SetInstanceMetadata(ctx context.Context, name string, md *compute.Metadata) (*compute.Operation, error) {
+	e.Lock()
+	defer e.Unlock()
+	inst, ok := e.instances[name]
+	if !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound}
+	}
+	if md.Fingerprint != inst.Metadata.Fingerprint {
+		return nil, &googleapi.Error{Code: http.StatusPreconditionFailed}
+	}
+	inst.Metadata = &compute.Metadata{Items: md.Items, Fingerprint: md.Fingerprint + "+"}
+	return &compute.Operation{Status: "RUNNING"}, nil
+}
+
+func (e *gcestub) DeleteInstance(ctx context.Context, name string) (*compute.Operation, error) {
+	e.Lock()
+	defer e.Unlock()
+	if _, ok := e.instances[name]; !ok {
+		return nil, &googleapi.Error{Code: http.StatusNotFound}
+	}
+	delete(e.instances, name)
+	return &compute.Operation{Status: "RUNNING"}, nil
+}
+
+func (e *gcestub) ListSkus(ctx context.Context, pageToken string) (*cloudbilling.ListSkusResponse, error) {
+	e.Lock()
+	defer e.Unlock()
+	if pageToken == "" && len(e.skus) > 1 {
+		return &cloudbilling.ListSkusResponse{Skus: e.skus[:1], NextPageToken: "next"}, nil
+	} else if pageToken != "" {
+		return &cloudbilling.ListSkusResponse{Skus: e.skus[1:]}, nil
+	}
+	return &cloudbilling.ListSkusResponse{Skus: e.skus}, nil
+}
+
+func stubSku(description, region string, price float64, effective time.Time) *cloudbilling.Sku {
+	units := int64(price)
+	return &cloudbilling.Sku{
+		Description:    description,
+		ServiceRegions: []string{region},
+		PricingInfo: []*cloudbilling.PricingInfo{{
+			EffectiveTime: effective.Format(time.RFC3339Nano),
+			PricingExpression: &cloudbilling.PricingExpression{
+				TieredRates: []*cloudbilling.TierRate{{
+					UnitPrice: &cloudbilling.Money{
+						CurrencyCode: "USD",
+						Units:        units,
+						Nanos:        int64((price - float64(units)) * 1e9),
+					},
+				}},
+			},
+		}},
+	}
+}
+
+func GetInstanceSet(c *check.C, conf string) (*gceInstanceSet, cloud.ImageID, arvados.Cluster, *prometheus.Registry) {
+	reg := prometheus.NewRegistry()
+	cluster := arvados.Cluster{
+		InstanceTypes: arvados.InstanceTypeMap(map[string]arvados.InstanceType{
+			"tiny": {
+				Name:         "tiny",
+				ProviderType: "e2-small",
+				VCPUs:        2,
+				RAM:          2 << 30,
+				Scratch:      10000000000,
+				Price:        .02,
+				Preemptible:  false,
+			},
+			"tiny-with-extra-scratch": {
+				Name:         "tiny-with-extra-scratch",
+				ProviderType: "e2-small",
+				VCPUs:        2,
+				RAM:          2 << 30,
+				Price:        .02,
+				Preemptible:  false,
+				AddedScratch: 20000000000,
+			},
+			"tiny-preemptible": {
+				Name:         "tiny-preemptible",
+				ProviderType: "e2-small",
+				VCPUs:        2,
+				RAM:          2 << 30,
+				Scratch:      10000000000,
+				Price:        .02,
+				Preemptible:  true,
+			},
+		})}
+	if *live != "" {
+		var exampleCfg testConfig
+		err := config.LoadFile(&exampleCfg, *live)
+		c.Assert(err, check.IsNil)
+
+		is, err := newGCEInstanceSet(exampleCfg.DriverParameters, "test123", nil, logrus.StandardLogger(), reg)
+		c.Assert(err, check.IsNil)
+		return is.(*gceInstanceSet), cloud.ImageID(exampleCfg.ImageIDForTestSuite), cluster, reg
+	}
+	credsFile := filepath.Join(c.MkDir(), "creds.json")
+	err := os.WriteFile(credsFile, []byte(`{"type":"service_account","project_id":"test-project","client_email":"dispatch@test-project.iam.gserviceaccount.com","private_key":"","token_uri":"http://localhost:1/token"}`), 0600)
+	c.Assert(err, check.IsNil)
+	var params map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(conf), &params), check.IsNil)
+	params["Project"] = "test-project"
+	params["Zone"] = "aa-east1-b"
+	params["CredentialsFile"] = credsFile
+	params["AdminUsername"] = "crunch"
+	confWithDefaults, err := json.Marshal(params)
+	c.Assert(err, check.IsNil)
+	is, err := newGCEInstanceSet(confWithDefaults, "test123", nil, ctxlog.TestLogger(c), reg)
+	c.Assert(err, check.IsNil)
+	is.(*gceInstanceSet).client = &gcestub{instances: map[string]*compute.Instance{}}
+	return is.(*gceInstanceSet), cloud.ImageID("projects/test-project/global/images/blob"), cluster, reg
+}
+
+func (*GCEInstanceSetSuite) TestNewInstanceSetConfig(c *check.C) {
+	_, err := newGCEInstanceSet(json.RawMessage(`{"Zone":"aa-east1-b"}`), "test123", nil, ctxlog.TestLogger(c), nil)
+	c.Check(err, check.ErrorMatches, `Project and Zone must be configured`)
+	_, err = newGCEInstanceSet(json.RawMessage(`{"Project":"test-project","Zone":"aa-east1-b","CredentialsFile":"/nonexistent"}`), "test123", nil, ctxlog.TestLogger(c), nil)
+	c.Check(err, check.NotNil)
+}
+
+func (*GCEInstanceSetSuite) TestCreate(c *check.C) {
+	ap, img, cluster, reg := GetInstanceSet(c, "{}")
+	pk, _ := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"],
+		img, map[string]string{
+			"TestTagName":          "test tag value",
+			"ArvadosInstanceSetID": "zzzzz-zzzzz-zzzzzzzzzzzzzzz",
+		}, "umask 0600; echo -n test-file-data >/var/run/test-file", pk)
+	c.Assert(err, check.IsNil)
+
+	tags := inst.Tags()
+	c.Check(tags["TestTagName"], check.Equals, "test tag value")
+	c.Check(inst.ProviderType(), check.Equals, "e2-small")
+	c.Logf("inst.String()=%v Address()=%v Tags()=%v", inst.String(), inst.Address(), tags)
+
+	if *live == "" {
+		calls := ap.client.(*gcestub).insertCall
+		c.Assert(calls, check.HasLen, 1)
+		created := calls[0]
+		c.Check(created.Name, check.Matches, `arvados-[0-9a-f]{16}`)
+		c.Check(created.MachineType, check.Equals, "zones/aa-east1-b/machineTypes/e2-small")
+		c.Check(created.Disks, check.HasLen, 1)
+		c.Check(created.Disks[0].InitializeParams.SourceImage, check.Equals, string(img))
+		c.Check(created.Scheduling, check.IsNil)
+		c.Check(created.NetworkInterfaces[0].AccessConfigs, check.HasLen, 0)
+		c.Check(created.ServiceAccounts, check.HasLen, 0)
+		c.Check(created.Labels, check.DeepEquals, map[string]string{
+			"testtagname":          "test_tag_value",
+			"arvadosinstancesetid": "zzzzz-zzzzz-zzzzzzzzzzzzzzz",
+		})
+		md := map[string]string{}
+		for _, item := range created.Metadata.Items {
+			md[item.Key] = *item.Value
+		}
+		c.Check(md["startup-script"], check.Equals, "#!/bin/sh\numask 0600; echo -n test-file-data >/var/run/test-file\n")
+		c.Check(md["ssh-keys"], check.Matches, `crunch:ssh-rsa \S+`)
+		c.Check(md[tagsMetadataKey], check.Matches, `\{.*"TestTagName":"test tag value".*\}`)
+
+		metrics := arvadostest.GatherMetricsAsString(reg)
+		c.Check(metrics, check.Matches, `(?ms).*`+
+			`arvados_dispatchcloud_gce_instance_starts_total{success="0"} 0\n`+
+			`arvados_dispatchcloud_gce_instance_starts_total{success="1"} 1\n`+
+			`.*`)
+	}
+}
+
+func (*GCEInstanceSetSuite) TestCreateWithExtraScratch(c *check.C) {
+	ap, img, cluster, _ := GetInstanceSet(c, `{"DiskType": "pd-ssd"}`)
+	inst, err := ap.Create(cluster.InstanceTypes["tiny-with-extra-scratch"],
+		img, map[string]string{
+			"TestTagName": "test tag value",
+		}, "umask 0600; echo -n test-file-data >/var/run/test-file", nil)
+
+	c.Assert(err, check.IsNil)
+
+	tags := inst.Tags()
+	c.Check(tags["TestTagName"], check.Equals, "test tag value")
+	c.Logf("inst.String()=%v Address()=%v Tags()=%v", inst.String(), inst.Address(), tags)
+
+	if *live == "" {
+		created := ap.client.(*gcestub).insertCall[0]
+		c.Assert(created.Disks, check.HasLen, 2)
+		c.Check(created.Disks[1].AutoDelete, check.Equals, true)
+		c.Check(created.Disks[1].InitializeParams.DiskSizeGb, check.Equals, int64(19))
+		c.Check(created.Disks[1].InitializeParams.DiskType, check.Equals, "zones/aa-east1-b/diskTypes/pd-ssd")
+		// No ssh-keys entry, because publickey arg was nil
+		for _, item := range created.Metadata.Items {
+			c.Check(item.Key, check.Not(check.Equals), "ssh-keys")
+		}
+	}
+}
+
+func (*GCEInstanceSetSuite) TestCreatePreemptible(c *check.C) {
+	ap, img, cluster, _ := GetInstanceSet(c, `{"ServiceAccount": "compute@test-project.iam.gserviceaccount.com", "ExternalIP": true}`)
+	pk, _ := test.LoadTestKey(c, "../../dispatchcloud/test/sshkey_dispatch")
+
+	inst, err := ap.Create(cluster.InstanceTypes["tiny-preemptible"],
+		img, map[string]string{
+			"TestTagName": "test tag value",
+		}, "umask 0600; echo -n test-file-data >/var/run/test-file", pk)
+
+	c.Assert(err, check.IsNil)
+
+	tags := inst.Tags()
+	c.Check(tags["TestTagName"], check.Equals, "test tag value")
+	c.Logf("inst.String()=%v Address()=%v Tags()=%v", inst.String(), inst.Address(), tags)
+
+	if *live == "" {
+		created := ap.client.(*gcestub).insertCall[0]
+		c.Assert(created.Scheduling, check.NotNil)
+		c.Check(created.Scheduling.ProvisioningModel, check.Equals, "SPOT")
+		c.Check(created.Scheduling.InstanceTerminationAction, check.Equals, "DELETE")
+		c.Check(created.ServiceAccounts[0].Email, check.Equals, "compute@test-project.iam.gserviceaccount.com")
+		c.Check(created.NetworkInterfaces[0].AccessConfigs, check.HasLen, 1)
+	}
+}
+
+func (*GCEInstanceSetSuite) TestCreateOperationError(c *check.C) {
+	if *live != "" {
+		c.Skip("not applicable in live mode")
+		return
+	}
+	ap, img, cluster, reg := GetInstanceSet(c, "{}")
+	ap.client.(*gcestub).operationError = &compute.OperationErrorErrors{
+		Code:    "ZONE_RESOURCE_POOL_EXHAUSTED",
+		Message: "The zone 'projects/test-project/zones/aa-east1-b' does not have enough resources available to fulfill the request.",
+	}
+	_, err := ap.Create(cluster.InstanceTypes["tiny"], img, nil, "", nil)
+	c.Check(err, check.ErrorMatches, `ZONE_RESOURCE_POOL_EXHAUSTED: .*`)
+	caperr, ok := err.(cloud.CapacityError)
+	if c.Check(ok, check.Equals, true) {
+		c.Check(caperr.IsInstanceTypeSpecific(), check.Equals, true)
+	}
+	metrics := arvadostest.GatherMetricsAsString(reg)
+	c.Check(metrics, check.Matches, `(?ms).*`+
+		`arvados_dispatchcloud_gce_instance_starts_total{success="0"} 1\n`+
+		`arvados_dispatchcloud_gce_instance_starts_total{success="1"} 0\n`+
+		`.*`)
+}
+
+func (*GCEInstanceSetSuite) TestListInstances(c *check.C) {
+	ap, img, cluster, reg := GetInstanceSet(c, "{}")
+	tags := cloud.InstanceTags{"ArvadosInstanceSetID": "test-list-instances"}
+	for i := 0; i < 3; i++ {
+		inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, tags, "true", nil)
+		c.Assert(err, check.IsNil)
+		defer inst.Destroy()
+	}
+	if *live == "" {
+		_, err := ap.Create(cluster.InstanceTypes["tiny"], img, cloud.InstanceTags{"ArvadosInstanceSetID": "other"}, "true", nil)
+		c.Assert(err, check.IsNil)
+	}
+
+	l, err := ap.Instances(tags)
+	c.Assert(err, check.IsNil)
+	c.Check(l, check.HasLen, 3)
+	for _, i := range l {
+		tg := i.Tags()
+		c.Logf("%v %v %v", i.String(), i.Address(), tg)
+		c.Check(tg["ArvadosInstanceSetID"], check.Equals, "test-list-instances")
+		c.Check(i.ProviderType(), check.Equals, "e2-small")
+	}
+
+	metrics := arvadostest.GatherMetricsAsString(reg)
+	c.Check(metrics, check.Matches, `(?ms).*`+
+		`arvados_dispatchcloud_gce_instances 3\n`+
+		`.*`)
+}
+
+func (*GCEInstanceSetSuite) TestTagInstances(c *check.C) {
+	ap, img, cluster, _ := GetInstanceSet(c, "{}")
+	tags := cloud.InstanceTags{"ArvadosInstanceSetID": "test-tag-instances"}
+	inst, err := ap.Create(cluster.InstanceTypes["tiny"], img, tags, "true", nil)
+	c.Assert(err, check.IsNil)
+	defer inst.Destroy()
+
+	l, err := ap.Instances(tags)
+	c.Assert(err, check.IsNil)
+	c.Assert(l, check.HasLen, 1)
+	tg := l[0].Tags()
+	tg["TestTag2"] = "123 Test Tag 2"
+	c.Check(l[0].SetTags(tg), check.IsNil)
+
+	l, err = ap.Instances(cloud.InstanceTags{"TestTag2": "123 Test Tag 2"})
+	c.Assert(err, check.IsNil)
+	c.Assert(l, check.HasLen, 1)
+	c.Check(l[0].Tags(), check.DeepEquals, tg)
+}
+
+func (*GCEInstanceSetSuite) TestDestroyInstances(c *check.C) {
+	ap, img, cluster, _ := GetInstanceSet(c, "{}")
+	tags := cloud.InstanceTags{"ArvadosInstanceSetID": "test-destroy-instances"}
+	_, err := ap.Create(cluster.InstanceTypes["tiny"], img, tags, "true", nil)
+	c.Assert(err, check.IsNil)
+	l, err := ap.Instances(tags)
+	c.Assert(err, check.IsNil)
+
+	for _, i := range l {
+		c.Check(i.Destroy(), check.IsNil)
+		// Destroying an instance that is already gone is not
+		// an error.
+		c.Check(i.Destroy(), check.IsNil)
+	}
+}
+
+func (*GCEInstanceSetSuite) TestInstancePriceHistory(c *check.C) {
+	if *live != "" {
+		c.Skip("not applicable in live mode")
+		return
+	}
+	ap, img, cluster, _ := GetInstanceSet(c, `{"SpotPriceUpdateInterval": "1h", "DiskPrice": 0.1}`)
+	t0 := time.Now().Add(-time.Hour).UTC().Round(time.Second)
+	stub := ap.client.(*gcestub)
+	stub.skus = []*cloudbilling.Sku{
+		stubSku("Spot Preemptible E2 Instance Core running in Americas", "aa-east1", 0.01, t0),
+		stubSku("Spot Preemptible E2 Instance Ram running in Americas", "aa-east1", 0.001, t0.Add(time.Minute)),
+		stubSku("Spot Preemptible E2 Instance Core running in Americas", "bb-west1", 0.02, t0),
+		stubSku("Spot Preemptible E2 Instance Ram running in Americas", "bb-west1", 0.002, t0),
+		stubSku("Spot Preemptible N2 Custom Instance Core running in Americas", "aa-east1", 0.5, t0),
+		stubSku("E2 Instance Core running in Americas", "aa-east1", 0.03, t0),
+	}
+	tags := cloud.InstanceTags{"arvados-gce-driver": "test"}
+	_, err := ap.Create(cluster.InstanceTypes["tiny-preemptible"], img, tags, "true", nil)
+	c.Assert(err, check.IsNil)
+	_, err = ap.Create(cluster.InstanceTypes["tiny"], img, tags, "true", nil)
+	c.Assert(err, check.IsNil)
+
+	instances, err := ap.Instances(tags)
+	c.Assert(err, check.IsNil)
+	c.Assert(instances, check.HasLen, 2)
+	for _, inst := range instances {
+		it := cluster.InstanceTypes["tiny"]
+		hist := inst.PriceHistory(it)
+		c.Logf("%s price history: %v", inst.ID(), hist)
+		if !isSpot(inst.(*gceInstance).instance) {
+			c.Check(hist, check.HasLen, 0)
+			continue
+		}
+		c.Assert(hist, check.HasLen, 1)
+		c.Check(hist[0].StartTime.Equal(t0.Add(time.Minute)), check.Equals, true)
+		c.Check(hist[0].Price, check.Equals, 0.01*2+0.001*2)
+
+		it.AddedScratch = 720 << 30
+		histWithScratch := inst.PriceHistory(it)
+		c.Logf("%s price history with 720 GiB scratch: %v", inst.ID(), histWithScratch)
+		c.Check(histWithScratch[0].Price-hist[0].Price > 0.099, check.Equals, true)
+		c.Check(histWithScratch[0].Price-hist[0].Price < 0.101, check.Equals, true)
+	}
+
+	// Price changes are added to the history after
+	// SpotPriceUpdateInterval.
+	stub.skus[0] = stubSku("Spot Preemptible E2 Instance Core running in Americas", "aa-east1", 0.005, t0.Add(30*time.Minute))
+	_, err = ap.Instances(tags)
+	c.Assert(err, check.IsNil)
+	c.Check(ap.prices[priceKey{"e2", "aa-east1"}], check.HasLen, 1)
+	ap.pricesUpdated = ap.pricesUpdated.Add(-time.Hour)
+	instances, err = ap.Instances(tags)
+	c.Assert(err, check.IsNil)
+	for _, inst := range instances {
+		if hist := inst.PriceHistory(cluster.InstanceTypes["tiny"]); len(hist) > 0 {
+			c.Check(hist, check.HasLen, 2)
+			c.Check(hist[0].Price, check.Equals, 0.005*2+0.001*2)
+		}
+	}
+}
+
+func (*GCEInstanceSetSuite) TestInstanceTypePrices(c *check.C) {
+	if *live != "" {
+		c.Skip("not applicable in live mode")
+		return
+	}
+	ap, _, cluster, _ := GetInstanceSet(c, `{"SpotPriceUpdateInterval": "1h", "DiskPrice": 0.1}`)
+	t0 := time.Now().Add(-time.Hour).UTC().Round(time.Second)
+	stub := ap.client.(*gcestub)
+	stub.skus = []*cloudbilling.Sku{
+		stubSku("Spot Preemptible E2 Instance Core running in Americas", "aa-east1", 0.01, t0),
+		stubSku("Spot Preemptible E2 Instance Ram running in Americas", "aa-east1", 0.001, t0),
+	}
+	// Prices are available without any running instances, and
+	// only for preemptible types.
+	prices := ap.InstanceTypePrices([]arvados.InstanceType{cluster.InstanceTypes["tiny"], cluster.InstanceTypes["tiny-preemptible"]})
+	c.Assert(prices, check.HasLen, 1)
+	c.Check(prices[0].InstanceType, check.Equals, "tiny-preemptible")
+	c.Check(prices[0].Zone, check.Equals, ap.gceconfig.Zone)
+	c.Check(prices[0].Price, check.Equals, 0.01*2+0.001*2)
+	c.Check(prices[0].StartTime.Equal(t0), check.Equals, true)
+}
+
+func (*GCEInstanceSetSuite) TestWrapError(c *check.C) {
+	retryError := &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}
+	wrapped := wrapError(retryError, &atomic.Value{})
+	_, ok := wrapped.(cloud.RateLimitError)
+	c.Check(ok, check.Equals, true)
+
+	retryError = &googleapi.Error{Code: http.StatusTooManyRequests}
+	wrapped = wrapError(retryError, &atomic.Value{})
+	_, ok = wrapped.(cloud.RateLimitError)
+	c.Check(ok, check.Equals, true)
+
+	for _, quotaError := range []error{
+		&operationError{&compute.OperationErrorErrors{Code: "QUOTA_EXCEEDED", Message: "Quota 'INSTANCES' exceeded.  Limit: 24.0 in region aa-east1."}},
+		&googleapi.Error{Code: http.StatusForbidden, Message: "Quota 'SSD_TOTAL_GB' exceeded.  Limit: 500.0 in region aa-east1.", Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}},
+	} {
+		wrapped = wrapError(quotaError, &atomic.Value{})
+		_, ok = wrapped.(cloud.QuotaError)
+		c.Check(ok, check.Equals, true)
+		_, ok = wrapped.(cloud.CapacityError)
+		c.Check(ok, check.Equals, false)
+	}
+
+	for _, trial := range []struct {
+		err                error
+		typeSpecific       bool
+		quotaGroupSpecific bool
+	}{
+		{
+			err:                &operationError{&compute.OperationErrorErrors{Code: "ZONE_RESOURCE_POOL_EXHAUSTED", Message: "The zone 'projects/test-project/zones/aa-east1-b' does not have enough resources available to fulfill the request.  Try a different zone, or try again later."}},
+			typeSpecific:       true,
+			quotaGroupSpecific: false,
+		},
+		{
+			err:                &operationError{&compute.OperationErrorErrors{Code: "ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS", Message: "The zone 'projects/test-project/zones/aa-east1-b' does not have enough resources available to fulfill the request.  '(resource type:compute)'."}},
+			typeSpecific:       true,
+			quotaGroupSpecific: false,
+		},
+		{
+			err:                &operationError{&compute.OperationErrorErrors{Code: "QUOTA_EXCEEDED", Message: "Quota 'N2_CPUS' exceeded.  Limit: 24.0 in region aa-east1."}},
+			typeSpecific:       false,
+			quotaGroupSpecific: true,
+		},
+		{
+			err:                &googleapi.Error{Code: http.StatusForbidden, Message: "Quota 'PREEMPTIBLE_CPUS' exceeded.  Limit: 8.0 in region aa-east1.", Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}},
+			typeSpecific:       false,
+			quotaGroupSpecific: true,
+		},
+		{
+			err:                &googleapi.Error{Code: http.StatusForbidden, Message: "Quota 'CPUS' exceeded.  Limit: 8.0 in region aa-east1.", Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}},
+			typeSpecific:       false,
+			quotaGroupSpecific: true,
+		},
+	} {
+		wrapped = wrapError(trial.err, &atomic.Value{})
+		caperr, ok := wrapped.(cloud.CapacityError)
+		if !c.Check(ok, check.Equals, true, check.Commentf("%s", trial.err)) {
+			continue
+		}
+		c.Check(caperr.IsCapacityError(), check.Equals, true)
+		c.Check(caperr.IsInstanceTypeSpecific(), check.Equals, trial.typeSpecific)
+		c.Check(caperr.IsInstanceQuotaGroupSpecific(), check.Equals, trial.quotaGroupSpecific)
+	}
+
+	c.Check(wrapError(nil, &atomic.Value{}), check.IsNil)
+	otherError := errors.New("misc error")
+	c.Check(wrapError(otherError, &atomic.Value{}), check.Equals, otherError)
+}
+
+func (*GCEInstanceSetSuite) TestInstanceQuotaGroup(c *check.C) {
+	ap, _, _, _ := GetInstanceSet(c, `{
+  "MachineFamilyQuotaGroups": {
+    "n1": "cpus",
+    "e2": "cpus"
+  }
+}`)
+
+	for _, trial := range []struct {
+		ptype      string
+		spot       bool
+		quotaGroup cloud.InstanceQuotaGroup
+	}{
+		{ptype: "n1-standard-4", quotaGroup: "cpus"},
+		{ptype: "e2-small", quotaGroup: "cpus"},
+		{ptype: "e2-small", spot: true, quotaGroup: "cpus-spot"},
+		{ptype: "n2-highmem-8", quotaGroup: "n2"},
+		{ptype: "n2-highmem-8", spot: true, quotaGroup: "n2-spot"},
+		{ptype: "c3d-standard-360-lssd", quotaGroup: "c3d"},
+		{ptype: "a2-highgpu-1g", quotaGroup: "a2"},
+		{ptype: "", quotaGroup: ""},
+	} {
+		c.Check(ap.InstanceQuotaGroup(arvados.InstanceType{
+			ProviderType: trial.ptype,
+			Preemptible:  trial.spot,
+		}), check.Equals, trial.quotaGroup)
+	}
+}
+
+func (*GCEInstanceSetSuite) TestLabelString(c *check.C) {
+	for _, trial := range []struct {
+		in    string
+		isKey bool
+		out   string
+	}{
+		{"ArvadosInstanceSetID", true, "arvadosinstancesetid"},
+		{"zzzzz-zzzzz-zzzzzzzzzzzzzzz", false, "zzzzz-zzzzz-zzzzzzzzzzzzzzz"},
+		{"m4.large", false, "m4_large"},
+		{"1tag", true, "x1tag"},
+		{"", true, "x"},
+		{"", false, ""},
+		{strings.Repeat("a", 70), false, strings.Repeat("a", 63)},
+	} {
+		c.Check(labelString(trial.in, trial.isKey), check.Equals, trial.out)
+	}
+}
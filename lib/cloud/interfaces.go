@@ -171,6 +171,13 @@ type InstanceSet interface {
 	// separate quotas.
 	InstanceQuotaGroup(arvados.InstanceType) InstanceQuotaGroup
 
+	// Return the current prices of the given instance types,
+	// including types that have no running instances, if the
+	// driver is able to look them up. There may be more than one
+	// entry per instance type, e.g., one per availability
+	// zone. A driver that has no price information returns nil.
+	InstanceTypePrices([]arvados.InstanceType) []InstanceTypePrice
+
 	// Stop any background tasks and release other resources.
 	Stop()
 }
@@ -180,6 +187,15 @@ type InstancePrice struct {
 	Price     float64
 }
 
+// InstanceTypePrice is the current price of an instance type in a
+// particular zone.
+type InstanceTypePrice struct {
+	InstanceType string // arvados.InstanceType name
+	Zone         string // availability zone or region, if applicable
+	StartTime    time.Time
+	Price        float64
+}
+
 type InitCommand string
 
 // A Driver returns an InstanceSet that uses the given InstanceSetID
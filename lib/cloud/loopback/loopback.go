@@ -118,6 +118,10 @@ func (is *instanceSet) InstanceQuotaGroup(arvados.InstanceType) cloud.InstanceQu
 	return ""
 }
 
+func (is *instanceSet) InstanceTypePrices([]arvados.InstanceType) []cloud.InstanceTypePrice {
+	return nil
+}
+
 func (is *instanceSet) Stop() {
 	is.mtx.Lock()
 	defer is.mtx.Unlock()
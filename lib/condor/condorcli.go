@@ -0,0 +1,169 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package condor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+// HTCondor JobStatus values.
+const (
+	jobIdle               = 1
+	jobRunning            = 2
+	jobRemoved            = 3
+	jobCompleted          = 4
+	jobHeld               = 5
+	jobTransferringOutput = 6
+	jobSuspended          = 7
+)
+
+// ClassAd attribute used to identify jobs submitted by the
+// dispatcher.
+const uuidAttr = "ArvadosContainerUUID"
+
+type condorqEntry struct {
+	ID         string // ClusterId.ProcId
+	UUID       string
+	Status     int
+	Priority   int64
+	HoldReason string
+}
+
+// Finished returns true if the job has been removed or has completed,
+// i.e., it will not run (again) even though it is still listed in
+// the queue.
+func (ent condorqEntry) Finished() bool {
+	return ent.Status == jobRemoved || ent.Status == jobCompleted
+}
+
+type condorcli struct {
+	logger logrus.FieldLogger
+	// (for testing) if non-nil, call stubCommand() instead of
+	// exec.Command() when running condor command line programs.
+	stubCommand func(string, ...string) *exec.Cmd
+}
+
+func (cli condorcli) command(prog string, args ...string) *exec.Cmd {
+	if f := cli.stubCommand; f != nil {
+		return f(prog, args...)
+	} else {
+		return exec.Command(prog, args...)
+	}
+}
+
+var condorSubmitTerseRegexp = regexp.MustCompile(`^(\d+)\.\d+ - \d+\.\d+\s*$`)
+
+// CondorSubmit submits a job using the given submit description,
+// and returns the new job's cluster ID. The Arvados API credentials
+// and the given env vars are added to condor_submit's environment,
+// where the "getenv" command in the submit description can pick
+// them up.
+func (cli condorcli) CondorSubmit(description []byte, args []string, env map[string]string, arv *arvados.Client) (string, error) {
+	cli.logger.Infof("condor_submit command %q description %q", args, description)
+	cmd := cli.command(args[0], args[1:]...)
+	cmd.Env = append([]string(nil), os.Environ()...)
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Env = append(cmd.Env, "ARVADOS_API_HOST="+arv.APIHost)
+	cmd.Env = append(cmd.Env, "ARVADOS_API_TOKEN="+arv.AuthToken)
+	if arv.Insecure {
+		cmd.Env = append(cmd.Env, "ARVADOS_API_HOST_INSECURE=1")
+	}
+	cmd.Stdin = bytes.NewReader(description)
+	out, err := cmd.Output()
+	cli.logger.WithField("stdout", string(out)).Infof("condor_submit finished")
+	if err != nil {
+		return "", errWithStderr(err)
+	}
+	m := condorSubmitTerseRegexp.FindStringSubmatch(string(out))
+	if m == nil {
+		return "", fmt.Errorf("could not parse condor_submit output %q", out)
+	}
+	return m[1], nil
+}
+
+// CondorQ returns all jobs in the queue that were submitted by an
+// Arvados dispatcher.
+func (cli condorcli) CondorQ() ([]condorqEntry, error) {
+	cli.logger.Debugf("CondorQ()")
+	cmd := cli.command("condor_q", "-allusers", "-constraint", uuidAttr+" =!= undefined", "-af:jt", uuidAttr, "JobStatus", "JobPrio", "HoldReason")
+	buf, err := cmd.Output()
+	if err != nil {
+		return nil, errWithStderr(err)
+	}
+	return parseCondorQ(buf)
+}
+
+// parseCondorQ parses the tab-separated output of "condor_q -af:jt
+// ArvadosContainerUUID JobStatus JobPrio HoldReason".
+func parseCondorQ(buf []byte) ([]condorqEntry, error) {
+	var ents []condorqEntry
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, "\t", 5)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("could not parse condor_q output line %q", line)
+		}
+		status, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse JobStatus in condor_q output line %q", line)
+		}
+		prio, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse JobPrio in condor_q output line %q", line)
+		}
+		ent := condorqEntry{
+			ID:       fields[0],
+			UUID:     fields[1],
+			Status:   status,
+			Priority: prio,
+		}
+		if fields[4] != "undefined" {
+			ent.HoldReason = fields[4]
+		}
+		ents = append(ents, ent)
+	}
+	return ents, nil
+}
+
+func (cli condorcli) CondorRm(id string) error {
+	cli.logger.Infof("CondorRm(%s)", id)
+	cmd := cli.command("condor_rm", id)
+	buf, err := cmd.CombinedOutput()
+	if err == nil || strings.Contains(string(buf), "not found") {
+		return nil
+	} else {
+		return fmt.Errorf("%s (%q)", err, buf)
+	}
+}
+
+func (cli condorcli) CondorPrio(id string, priority int64) error {
+	cli.logger.Infof("CondorPrio(%s, %d)", id, priority)
+	cmd := cli.command("condor_prio", "-p", fmt.Sprintf("%d", priority), id)
+	buf, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s (%q)", err, buf)
+	}
+	return nil
+}
+
+func errWithStderr(err error) error {
+	if err, ok := err.(*exec.ExitError); ok {
+		return fmt.Errorf("%s (%q)", err, err.Stderr)
+	}
+	return err
+}
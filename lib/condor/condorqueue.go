@@ -0,0 +1,192 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package condor
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type condorqueue struct {
+	logger    logrus.FieldLogger
+	period    time.Duration
+	condorcli *condorcli
+
+	initOnce  sync.Once
+	mutex     sync.Mutex
+	nextReady chan (<-chan struct{})
+	latest    map[string]condorqEntry
+	// job ID => priority most recently set with condor_prio
+	prioritySet map[string]int64
+
+	// container UUID => Arvados container priority
+	arvPriority map[string]int64
+	// distinct values of arvPriority, sorted (nil if arvPriority
+	// has changed since it was last computed)
+	arvPrioritySorted []int64
+}
+
+// Lookup waits for the next queue update (so even a job that was only
+// submitted a nanosecond ago will show up) and then returns the
+// HTCondor queue information corresponding to the given container UUID.
+func (q *condorqueue) Lookup(uuid string) (condorqEntry, bool) {
+	ent, ok := q.getNext()[uuid]
+	return ent, ok
+}
+
+// All waits for the next queue update, then returns the container
+// UUIDs of all jobs in the queue. Used by checkCondorQueueForOrphans().
+func (q *condorqueue) All() []string {
+	latest := q.getNext()
+	uuids := make([]string, 0, len(latest))
+	for uuid := range latest {
+		uuids = append(uuids, uuid)
+	}
+	return uuids
+}
+
+// Rank records the Arvados priority of the given container, and
+// returns the corresponding HTCondor job priority.
+//
+// Arvados container priorities are too large (typically around
+// 1e18) for HTCondor's JobPrio, which is an int. Instead, the
+// HTCondor job priority is the container's rank among all containers
+// tracked by this dispatcher: 1 for the lowest Arvados priority, 2
+// for the next lowest, and so on. Containers with equal Arvados
+// priorities get equal ranks.
+func (q *condorqueue) Rank(uuid string, priority int64) int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.rank(uuid, priority)
+}
+
+// Caller must hold q.mutex.
+func (q *condorqueue) rank(uuid string, priority int64) int64 {
+	if q.arvPriority == nil {
+		q.arvPriority = map[string]int64{}
+	}
+	if old, ok := q.arvPriority[uuid]; !ok || old != priority {
+		q.arvPriority[uuid] = priority
+		q.arvPrioritySorted = nil
+	}
+	if q.arvPrioritySorted == nil {
+		distinct := map[int64]bool{}
+		for _, p := range q.arvPriority {
+			distinct[p] = true
+		}
+		sorted := make([]int64, 0, len(distinct))
+		for p := range distinct {
+			sorted = append(sorted, p)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		q.arvPrioritySorted = sorted
+	}
+	return int64(sort.Search(len(q.arvPrioritySorted), func(i int) bool { return q.arvPrioritySorted[i] >= priority })) + 1
+}
+
+// Forget removes the given container from the set of containers
+// used to compute ranks.
+func (q *condorqueue) Forget(uuid string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if _, ok := q.arvPriority[uuid]; ok {
+		delete(q.arvPriority, uuid)
+		q.arvPrioritySorted = nil
+	}
+}
+
+// SetPriority changes the HTCondor job priority of the given
+// container's job to its rank (see Rank), if it is in the queue and
+// its priority is not already set to that value.
+//
+// The ranks of other containers may change as a result, but their
+// jobs are not updated until SetPriority is called for them.
+func (q *condorqueue) SetPriority(uuid string, arvPriority int64) {
+	q.initOnce.Do(q.init)
+	q.mutex.Lock()
+	priority := q.rank(uuid, arvPriority)
+	ent, ok := q.latest[uuid]
+	set, pending := q.prioritySet[ent.ID]
+	q.mutex.Unlock()
+	if !ok || ent.Priority == priority || (pending && set == priority) {
+		return
+	}
+	err := q.condorcli.CondorPrio(ent.ID, priority)
+	if err != nil {
+		q.logger.Warnf("%s: condor_prio(%s): %s", uuid, ent.ID, err)
+		return
+	}
+	// Avoid running condor_prio again before the next queue
+	// update shows the new priority.
+	q.mutex.Lock()
+	q.prioritySet[ent.ID] = priority
+	q.mutex.Unlock()
+}
+
+func (q *condorqueue) getNext() map[string]condorqEntry {
+	q.initOnce.Do(q.init)
+	<-(<-q.nextReady)
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.latest
+}
+
+func (q *condorqueue) init() {
+	q.nextReady = make(chan (<-chan struct{}))
+	q.prioritySet = map[string]int64{}
+	ticker := time.NewTicker(q.period)
+	go func() {
+		for range ticker.C {
+			// Send a new "next update ready" channel to
+			// the next goroutine that wants one (and any
+			// others that have already queued up since
+			// the first one started waiting).
+			//
+			// Below, when we get a new update, we'll
+			// signal that to the other goroutines by
+			// closing the ready chan.
+			ready := make(chan struct{})
+			q.nextReady <- ready
+			for {
+				select {
+				case q.nextReady <- ready:
+					continue
+				default:
+				}
+				break
+			}
+			// Run condor_q repeatedly if needed, until we
+			// get valid output.
+			var ents []condorqEntry
+			for {
+				q.logger.Debug("running condor_q")
+				var err error
+				ents, err = q.condorcli.CondorQ()
+				if err == nil {
+					break
+				}
+				q.logger.Warnf("condor_q: %s", err)
+				<-ticker.C
+			}
+			next := make(map[string]condorqEntry, len(ents))
+			for _, ent := range ents {
+				next[ent.UUID] = ent
+			}
+			// Replace q.latest and notify all the
+			// goroutines that the "next update" they
+			// asked for is now ready.
+			q.mutex.Lock()
+			q.latest = next
+			for id := range q.prioritySet {
+				delete(q.prioritySet, id)
+			}
+			q.mutex.Unlock()
+			close(ready)
+		}
+	}()
+}
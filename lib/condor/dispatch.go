@@ -0,0 +1,449 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package condor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/lib/controller/dblock"
+	"git.arvados.org/arvados.git/lib/ctrlctx"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/container"
+	"git.arvados.org/arvados.git/lib/service"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/dispatch"
+	"git.arvados.org/arvados.git/sdk/go/health"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+var DispatchCommand cmd.Handler = service.Command(arvados.ServiceNameDispatchCondor, newHandler)
+
+func newHandler(ctx context.Context, cluster *arvados.Cluster, token string, reg *prometheus.Registry) service.Handler {
+	ac, err := arvados.NewClientFromConfig(cluster)
+	if err != nil {
+		return service.ErrorHandler(ctx, cluster, fmt.Errorf("error initializing client from cluster config: %s", err))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	d := &dispatcher{
+		Cluster:   cluster,
+		Context:   ctx,
+		ArvClient: ac,
+		AuthToken: token,
+		Registry:  reg,
+		cancel:    cancel,
+	}
+	go d.Start()
+	return d
+}
+
+type dispatcher struct {
+	Cluster   *arvados.Cluster
+	Context   context.Context
+	ArvClient *arvados.Client
+	AuthToken string
+	Registry  *prometheus.Registry
+
+	logger        logrus.FieldLogger
+	dbConnector   ctrlctx.DBConnector
+	condorcli     condorcli
+	condorqueue   condorqueue
+	arvDispatcher *dispatch.Dispatcher
+	httpHandler   http.Handler
+
+	initOnce sync.Once
+	stopped  chan struct{}
+	cancel   context.CancelFunc
+}
+
+// Start starts the dispatcher. Start can be called multiple times
+// with no ill effect.
+func (disp *dispatcher) Start() {
+	disp.initOnce.Do(func() {
+		disp.init()
+		dblock.Dispatch.Lock(context.Background(), disp.dbConnector.GetDB)
+		go func() {
+			disp.stopped = make(chan struct{})
+			defer close(disp.stopped)
+			defer dblock.Dispatch.Unlock()
+			disp.checkCondorQueueForOrphans()
+			err := disp.arvDispatcher.Run(disp.Context)
+			if err != nil {
+				disp.logger.Error(err)
+			}
+		}()
+	})
+}
+
+// ServeHTTP implements service.Handler.
+func (disp *dispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	disp.Start()
+	disp.httpHandler.ServeHTTP(w, r)
+}
+
+// CheckHealth implements service.Handler.
+func (disp *dispatcher) CheckHealth() error {
+	disp.Start()
+	select {
+	case <-disp.stopped:
+		return errors.New("stopped")
+	default:
+		return nil
+	}
+}
+
+// Done implements service.Handler.
+func (disp *dispatcher) Done() <-chan struct{} {
+	return disp.stopped
+}
+
+// Stop dispatching containers and release resources. Used by tests.
+func (disp *dispatcher) Close() {
+	disp.Start()
+	disp.cancel()
+	<-disp.stopped
+}
+
+func (disp *dispatcher) init() {
+	disp.logger = ctxlog.FromContext(disp.Context)
+	disp.condorcli.logger = disp.logger
+	disp.condorqueue = condorqueue{
+		logger:    disp.logger,
+		period:    disp.Cluster.Containers.CloudVMs.PollInterval.Duration(),
+		condorcli: &disp.condorcli,
+	}
+	disp.ArvClient.AuthToken = disp.AuthToken
+	disp.dbConnector = ctrlctx.DBConnector{PostgreSQL: disp.Cluster.PostgreSQL}
+
+	arv, err := arvadosclient.New(disp.ArvClient)
+	if err != nil {
+		disp.logger.Fatalf("Error making Arvados client: %v", err)
+	}
+	arv.Retries = 25
+	arv.ApiToken = disp.AuthToken
+	disp.arvDispatcher = &dispatch.Dispatcher{
+		Arv:            arv,
+		Logger:         disp.logger,
+		BatchSize:      disp.Cluster.API.MaxItemsPerResponse,
+		RunContainer:   disp.runContainer,
+		PollPeriod:     time.Duration(disp.Cluster.Containers.CloudVMs.PollInterval),
+		MinRetryPeriod: time.Duration(disp.Cluster.Containers.MinRetryPeriod),
+	}
+
+	if disp.Cluster.ManagementToken == "" {
+		disp.httpHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Management API authentication is not configured", http.StatusForbidden)
+		})
+	} else {
+		mux := httprouter.New()
+		metricsH := promhttp.HandlerFor(disp.Registry, promhttp.HandlerOpts{
+			ErrorLog: disp.logger,
+		})
+		mux.Handler("GET", "/metrics", metricsH)
+		mux.Handler("GET", "/metrics.json", metricsH)
+		mux.Handler("GET", "/_health/:check", &health.Handler{
+			Token:  disp.Cluster.ManagementToken,
+			Prefix: "/_health/",
+			Routes: health.Routes{"ping": disp.CheckHealth},
+		})
+		disp.httpHandler = auth.RequireLiteralToken(disp.Cluster.ManagementToken, mux)
+	}
+}
+
+func (disp *dispatcher) runContainer(_ *dispatch.Dispatcher, ctr arvados.Container, status <-chan arvados.Container) error {
+	ctx, cancel := context.WithCancel(disp.Context)
+	defer cancel()
+	defer disp.condorqueue.Forget(ctr.UUID)
+
+	if ctr.State != dispatch.Locked {
+		// already started by prior invocation
+	} else if _, ok := disp.condorqueue.Lookup(ctr.UUID); !ok {
+		_, err := container.ChooseInstanceType(disp.Cluster, &ctr)
+		if err != nil && err != container.ErrInstanceTypesNotConfigured {
+			return disp.cancelWithError(ctr.UUID, err.Error())
+		}
+		disp.logger.Printf("Submitting container %s to HTCondor", ctr.UUID)
+		cmd := []string{disp.Cluster.Containers.CrunchRunCommand}
+		cmd = append(cmd, "--runtime-engine="+disp.Cluster.Containers.RuntimeEngine)
+		cmd = append(cmd, disp.Cluster.Containers.CrunchRunArgumentsList...)
+		err = disp.submit(ctr, cmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	disp.logger.Printf("Start monitoring container %v in state %q", ctr.UUID, ctr.State)
+	defer disp.logger.Printf("Done monitoring container %s", ctr.UUID)
+
+	// If the job is put on hold, the hold reason is sent here
+	// before cancel() is called.
+	held := make(chan string, 1)
+	go func(uuid string) {
+		for ctx.Err() == nil {
+			qent, ok := disp.condorqueue.Lookup(uuid)
+			if !ok || qent.Finished() {
+				// If the container disappears from
+				// the condor queue, there is no point
+				// in waiting for further dispatch
+				// updates: just clean up and return.
+				disp.logger.Printf("container %s job disappeared from HTCondor queue", uuid)
+				cancel()
+				return
+			}
+			if qent.Status == jobHeld {
+				// A held job will not run until an
+				// administrator releases it, which is
+				// unlikely to happen unattended, and
+				// it is likely to be held again if it
+				// is resubmitted.
+				disp.logger.Printf("container %s job %s is held: %s", uuid, qent.ID, qent.HoldReason)
+				if qent.HoldReason == "" {
+					held <- "unknown reason"
+				} else {
+					held <- qent.HoldReason
+				}
+				cancel()
+				return
+			}
+		}
+	}(ctr.UUID)
+
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			select {
+			case reason := <-held:
+				err := disp.cancelWithError(ctr.UUID, "HTCondor job held: "+reason)
+				if err != nil {
+					disp.logger.Printf("error cancelling held container %s: %s", ctr.UUID, err)
+				}
+				// Remove the held job below.
+				done = true
+				continue
+			default:
+			}
+			// Disappeared from condor queue
+			if err := disp.arvDispatcher.Arv.Get("containers", ctr.UUID, nil, &ctr); err != nil {
+				disp.logger.Printf("error getting final container state for %s: %s", ctr.UUID, err)
+			}
+			switch ctr.State {
+			case dispatch.Running:
+				disp.arvDispatcher.UpdateState(ctr.UUID, dispatch.Cancelled)
+			case dispatch.Locked:
+				disp.arvDispatcher.Unlock(ctr.UUID)
+			}
+			return nil
+		case updated, ok := <-status:
+			if !ok {
+				// status channel is closed, which is
+				// how arvDispatcher tells us to stop
+				// touching the container record, kill
+				// off any remaining condor jobs, etc.
+				done = true
+				break
+			}
+			if updated.State != ctr.State {
+				disp.logger.Infof("container %s changed state from %s to %s", ctr.UUID, ctr.State, updated.State)
+			}
+			ctr = updated
+			if ctr.Priority < 1 {
+				disp.logger.Printf("container %s has state %s, priority %d: remove condor job", ctr.UUID, ctr.State, ctr.Priority)
+				disp.condorRm(ctr)
+			} else {
+				disp.condorqueue.SetPriority(ctr.UUID, int64(ctr.Priority))
+			}
+		}
+	}
+	disp.logger.Printf("container %s is done", ctr.UUID)
+
+	// Try "condor_rm" every few seconds until the condor job
+	// disappears from the queue.
+	ticker := time.NewTicker(disp.Cluster.Containers.CloudVMs.PollInterval.Duration() / 2)
+	defer ticker.Stop()
+	for qent, ok := disp.condorqueue.Lookup(ctr.UUID); ok && !qent.Finished(); qent, ok = disp.condorqueue.Lookup(ctr.UUID) {
+		err := disp.condorcli.CondorRm(qent.ID)
+		if err != nil {
+			disp.logger.Warnf("%s: condor_rm(%s): %s", ctr.UUID, qent.ID, err)
+		}
+		<-ticker.C
+	}
+	return nil
+}
+
+// cancelWithError sets the given error message in the container's
+// runtime_status and then cancels the container.
+func (disp *dispatcher) cancelWithError(uuid, msg string) error {
+	err := disp.arvDispatcher.Arv.Update("containers", uuid, arvadosclient.Dict{
+		"container": map[string]interface{}{
+			"runtime_status": map[string]string{
+				"error": msg,
+			},
+		},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("error setting runtime_status on %s: %s", uuid, err)
+	}
+	return disp.arvDispatcher.UpdateState(uuid, dispatch.Cancelled)
+}
+
+func (disp *dispatcher) submit(container arvados.Container, crunchRunCommand []string) error {
+	// Start with an empty slice here to ensure append() doesn't
+	// modify crunchRunCommand's underlying array
+	var crArgs []string
+	crArgs = append(crArgs, crunchRunCommand...)
+	crArgs = append(crArgs, container.UUID)
+
+	h := hmac.New(sha256.New, []byte(disp.Cluster.SystemRootToken))
+	fmt.Fprint(h, container.UUID)
+	authsecret := fmt.Sprintf("%x", h.Sum(nil))
+
+	desc, err := disp.submitDescription(container, crArgs)
+	if err != nil {
+		return err
+	}
+	args := []string{"condor_submit", "-terse", "-"}
+	if u := disp.Cluster.Containers.HTCondor.SubmitSudoUser; u != "" {
+		args = append([]string{"sudo", "-E", "-u", u}, args...)
+	}
+	id, err := disp.condorcli.CondorSubmit(desc, args, map[string]string{"GatewayAuthSecret": authsecret}, disp.ArvClient)
+	if err != nil {
+		return err
+	}
+	disp.logger.Printf("container %s submitted as HTCondor job %s", container.UUID, id)
+	return nil
+}
+
+func (disp *dispatcher) condorRm(ctr arvados.Container) {
+	if qent, ok := disp.condorqueue.Lookup(ctr.UUID); !ok || qent.Finished() {
+		disp.logger.Debugf("condor_rm(%s): redundant, job not in queue", ctr.UUID)
+	} else if err := disp.condorcli.CondorRm(qent.ID); err != nil {
+		disp.logger.Warnf("%s: condor_rm(%s): %s", ctr.UUID, qent.ID, err)
+	}
+}
+
+// submitDescription returns a condor_submit description that runs
+// crArgs on an execute node with the resources needed by the given
+// container.
+func (disp *dispatcher) submitDescription(ctr arvados.Container, crArgs []string) ([]byte, error) {
+	tmp := int64(math.Ceil(float64(container.EstimateScratchSpace(&ctr)) / 1048576))
+	vcpus := ctr.RuntimeConstraints.VCPUs
+	mem := int64(math.Ceil(float64(ctr.RuntimeConstraints.RAM+
+		ctr.RuntimeConstraints.KeepCacheRAM+
+		int64(disp.Cluster.Containers.ReserveExtraRAM)) / 1048576))
+
+	maxruntime := time.Duration(ctr.SchedulingParameters.MaxRunTime) * time.Second
+	if maxruntime == 0 {
+		maxruntime = disp.Cluster.Containers.HTCondor.MaxRunTimeDefault.Duration()
+	}
+	if maxruntime > 0 {
+		maxruntime += disp.Cluster.Containers.HTCondor.MaxRunTimeOverhead.Duration()
+	}
+	maxrunseconds := int64(math.Ceil(maxruntime.Seconds()))
+
+	repl := map[string]string{
+		"%%": "%",
+		"%C": fmt.Sprintf("%d", vcpus),
+		"%M": fmt.Sprintf("%d", mem),
+		"%T": fmt.Sprintf("%d", tmp),
+		"%U": ctr.UUID,
+		"%G": fmt.Sprintf("%d", ctr.RuntimeConstraints.GPU.DeviceCount),
+		"%W": fmt.Sprintf("%d", maxrunseconds),
+	}
+
+	re := regexp.MustCompile(`%.`)
+	var substitutionErrors string
+	var lines []string
+	var template []string
+	template = append(template, disp.Cluster.Containers.HTCondor.SubmitDescription...)
+	if ctr.RuntimeConstraints.GPU.DeviceCount > 0 {
+		template = append(template, disp.Cluster.Containers.HTCondor.SubmitGPUDescription...)
+	}
+	for _, line := range template {
+		if maxrunseconds == 0 && strings.Contains(strings.Replace(line, "%%", "", -1), "%W") {
+			// There is no way to say "unlimited" in
+			// the places %W is likely to be used, so
+			// we drop the whole line when max runtime
+			// is unknown.
+			continue
+		}
+		lines = append(lines, re.ReplaceAllStringFunc(line, func(s string) string {
+			subst := repl[s]
+			if len(subst) == 0 {
+				substitutionErrors += fmt.Sprintf("Unknown substitution parameter %s in SubmitDescription, ", s)
+			}
+			return subst
+		}))
+	}
+	if len(substitutionErrors) != 0 {
+		return nil, fmt.Errorf("%s", substitutionErrors[:len(substitutionErrors)-2])
+	}
+
+	arguments, err := condorArguments(crArgs[1:])
+	if err != nil {
+		return nil, err
+	}
+	lines = append(lines,
+		"executable = "+crArgs[0],
+		"arguments = "+arguments,
+		"transfer_executable = false",
+		"getenv = ARVADOS_API_HOST, ARVADOS_API_TOKEN, ARVADOS_API_HOST_INSECURE, GatewayAuthSecret",
+		"batch_name = "+ctr.UUID,
+		fmt.Sprintf("+%s = %q", uuidAttr, ctr.UUID),
+		fmt.Sprintf("priority = %d", disp.condorqueue.Rank(ctr.UUID, int64(ctr.Priority))),
+		"queue",
+	)
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+// Check the next condor_q report, and invoke TrackContainer for all
+// the containers in the report. This gives us a chance to cancel
+// existing Arvados condor jobs (started by a previous dispatch
+// process) that never released their condor job allocations even
+// though their container states are Cancelled or Complete. See
+// https://dev.arvados.org/issues/10979
+func (disp *dispatcher) checkCondorQueueForOrphans() {
+	containerUuidPattern := regexp.MustCompile(`^[a-z0-9]{5}-dz642-[a-z0-9]{15}$`)
+	for _, uuid := range disp.condorqueue.All() {
+		if !containerUuidPattern.MatchString(uuid) || !strings.HasPrefix(uuid, disp.Cluster.ClusterID) {
+			continue
+		}
+		err := disp.arvDispatcher.TrackContainer(uuid)
+		if err != nil {
+			disp.logger.Warnf("checkCondorQueueForOrphans: TrackContainer(%s): %s", uuid, err)
+		}
+	}
+}
+
+// condorArguments returns the given arguments in the HTCondor "new
+// syntax" for the "arguments" submit command: the whole list is
+// enclosed in double quotes, each argument is enclosed in single
+// quotes, and literal quotes are doubled.
+func condorArguments(args []string) (string, error) {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "\r\n") {
+			return "", fmt.Errorf("cannot pass argument %q to condor_submit: contains newline", arg)
+		}
+		arg = strings.Replace(arg, `"`, `""`, -1)
+		arg = strings.Replace(arg, `'`, `''`, -1)
+		quoted = append(quoted, `'`+arg+`'`)
+	}
+	return `"` + strings.Join(quoted, " ") + `"`, nil
+}
@@ -0,0 +1,583 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package condor
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/config"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&suite{})
+
+type suite struct {
+	disp          *dispatcher
+	crTooBig      arvados.ContainerRequest
+	crPending     arvados.ContainerRequest
+	crCUDARequest arvados.ContainerRequest
+	crMaxRunTime  arvados.ContainerRequest
+}
+
+func (s *suite) TearDownTest(c *check.C) {
+	s.disp.Close()
+	arvadostest.ResetDB(c)
+}
+
+func (s *suite) SetUpTest(c *check.C) {
+	arvadostest.ResetDB(c)
+
+	cfg, err := config.NewLoader(nil, ctxlog.TestLogger(c)).Load()
+	c.Assert(err, check.IsNil)
+	cluster, err := cfg.GetCluster("")
+	c.Assert(err, check.IsNil)
+	cluster.Containers.ReserveExtraRAM = 256 << 20
+	cluster.Containers.CloudVMs.PollInterval = arvados.Duration(time.Second / 4)
+	cluster.Containers.MinRetryPeriod = arvados.Duration(time.Second / 4)
+	cluster.InstanceTypes = arvados.InstanceTypeMap{
+		"biggest_available_node": arvados.InstanceType{
+			RAM:             100 << 30, // 100 GiB
+			VCPUs:           4,
+			IncludedScratch: 100 << 30,
+			Scratch:         100 << 30,
+		},
+		"biggest_available_node_with_gpu": arvados.InstanceType{
+			RAM:             100 << 30, // 100 GiB
+			VCPUs:           4,
+			IncludedScratch: 100 << 30,
+			Scratch:         100 << 30,
+			GPU: arvados.GPUFeatures{
+				Stack:          "cuda",
+				DriverVersion:  "11.0",
+				HardwareTarget: "8.0",
+				DeviceCount:    2,
+				VRAM:           8000000000,
+			},
+		}}
+	s.disp = newHandler(context.Background(), cluster, arvadostest.SystemRootToken, prometheus.NewRegistry()).(*dispatcher)
+	s.disp.condorcli.stubCommand = func(string, ...string) *exec.Cmd {
+		return exec.Command("bash", "-c", "echo >&2 unimplemented stub; false")
+	}
+	err = arvados.NewClientFromEnv().RequestAndDecode(&s.crTooBig, "POST", "arvados/v1/container_requests", nil, map[string]interface{}{
+		"container_request": map[string]interface{}{
+			"runtime_constraints": arvados.RuntimeConstraints{
+				RAM:   1000000000000,
+				VCPUs: 1,
+			},
+			"container_image":     arvadostest.DockerImage112PDH,
+			"command":             []string{"sleep", "1"},
+			"mounts":              map[string]arvados.Mount{"/mnt/out": {Kind: "tmp", Capacity: 1000}},
+			"output_path":         "/mnt/out",
+			"state":               arvados.ContainerRequestStateCommitted,
+			"priority":            1,
+			"container_count_max": 1,
+		},
+	})
+	c.Assert(err, check.IsNil)
+
+	err = arvados.NewClientFromEnv().RequestAndDecode(&s.crPending, "POST", "arvados/v1/container_requests", nil, map[string]interface{}{
+		"container_request": map[string]interface{}{
+			"runtime_constraints": arvados.RuntimeConstraints{
+				RAM:           100000000,
+				VCPUs:         2,
+				KeepCacheDisk: 8 << 30,
+			},
+			"container_image":     arvadostest.DockerImage112PDH,
+			"command":             []string{"sleep", "1"},
+			"mounts":              map[string]arvados.Mount{"/mnt/out": {Kind: "tmp", Capacity: 1000}},
+			"output_path":         "/mnt/out",
+			"state":               arvados.ContainerRequestStateCommitted,
+			"priority":            1,
+			"container_count_max": 1,
+		},
+	})
+	c.Assert(err, check.IsNil)
+
+	err = arvados.NewClientFromEnv().RequestAndDecode(&s.crCUDARequest, "POST", "arvados/v1/container_requests", nil, map[string]interface{}{
+		"container_request": map[string]interface{}{
+			"runtime_constraints": arvados.RuntimeConstraints{
+				RAM:   16000000000,
+				VCPUs: 4,
+				GPU: arvados.GPURuntimeConstraints{
+					Stack:          "cuda",
+					DeviceCount:    1,
+					DriverVersion:  "11.0",
+					HardwareTarget: []string{"8.0"},
+					VRAM:           8000000000,
+				},
+			},
+			"container_image":     arvadostest.DockerImage112PDH,
+			"command":             []string{"sleep", "1"},
+			"mounts":              map[string]arvados.Mount{"/mnt/out": {Kind: "tmp", Capacity: 1000}},
+			"output_path":         "/mnt/out",
+			"state":               arvados.ContainerRequestStateCommitted,
+			"priority":            1,
+			"container_count_max": 1,
+		},
+	})
+	c.Assert(err, check.IsNil)
+
+	err = arvados.NewClientFromEnv().RequestAndDecode(&s.crMaxRunTime, "POST", "arvados/v1/container_requests", nil, map[string]interface{}{
+		"container_request": map[string]interface{}{
+			"runtime_constraints": arvados.RuntimeConstraints{
+				RAM:   1000000,
+				VCPUs: 1,
+			},
+			"scheduling_parameters": arvados.SchedulingParameters{
+				MaxRunTime: 124,
+			},
+			"container_image":     arvadostest.DockerImage112PDH,
+			"command":             []string{"sleep", "123"},
+			"mounts":              map[string]arvados.Mount{"/mnt/out": {Kind: "tmp", Capacity: 1000}},
+			"output_path":         "/mnt/out",
+			"state":               arvados.ContainerRequestStateCommitted,
+			"priority":            1,
+			"container_count_max": 1,
+		},
+	})
+	c.Assert(err, check.IsNil)
+}
+
+type condorstub struct {
+	sudoUser  string
+	errorRate float64
+}
+
+const stubHoldReason = "Error from slot1@compute0: no GPU available"
+
+func (stub condorstub) stubCommand(s *suite, c *check.C) func(prog string, args ...string) *exec.Cmd {
+	mtx := sync.Mutex{}
+	nextjobid := 100
+	fakejobq := map[string]condorqEntry{}
+	// condor_submit reads the submit description on stdin, which
+	// we can't see from here. Instead, the stub condor_submit
+	// command saves it in subdir, and collect() parses it later.
+	subdir := c.MkDir()
+	var submitted []int
+	expect := map[string]map[string]string{
+		arvadostest.LockedContainerUUID: {
+			"request_cpus":   "4",
+			"request_memory": "11701MB",
+			"request_disk":   "1MB",
+		},
+		arvadostest.QueuedContainerUUID: {
+			"request_cpus":   "4",
+			"request_memory": "11701MB",
+			"request_disk":   "45777MB",
+		},
+		s.crPending.ContainerUUID: {
+			"request_cpus":   "2",
+			"request_memory": "352MB",
+			"request_disk":   "8448MB",
+		},
+		s.crCUDARequest.ContainerUUID: {
+			"request_cpus":   "4",
+			"request_memory": "15515MB",
+			"request_disk":   "15515MB",
+			"request_gpus":   "1",
+		},
+		s.crMaxRunTime.ContainerUUID: {
+			"request_cpus":             "1",
+			"request_memory":           "257MB",
+			"request_disk":             "2304MB",
+			"allowed_execute_duration": "424", // 124s + 5m overhead
+		},
+	}
+	// collect adds jobs to fakejobq after the stub condor_submit
+	// has saved their submit descriptions. Caller must hold mtx.
+	collect := func() {
+		var pending []int
+		for _, id := range submitted {
+			buf, err := os.ReadFile(filepath.Join(subdir, fmt.Sprintf("%d.sub", id)))
+			if os.IsNotExist(err) {
+				pending = append(pending, id)
+				continue
+			}
+			c.Assert(err, check.IsNil)
+			desc := map[string]string{}
+			for _, line := range strings.Split(string(buf), "\n") {
+				if k, v, ok := strings.Cut(line, " = "); ok {
+					desc[k] = v
+				}
+			}
+			uuid, err := strconv.Unquote(desc["+"+uuidAttr])
+			c.Check(err, check.IsNil)
+			exp, ok := expect[uuid]
+			if !ok {
+				c.Errorf("unexpected uuid passed to condor_submit: description %q", buf)
+				continue
+			}
+			for k, v := range exp {
+				c.Check(desc[k], check.Equals, v, check.Commentf("%s %s", uuid, k))
+			}
+			for _, k := range []string{"request_gpus", "allowed_execute_duration"} {
+				if _, ok := exp[k]; !ok {
+					c.Check(desc[k], check.Equals, "", check.Commentf("%s %s", uuid, k))
+				}
+			}
+			c.Check(desc["executable"], check.Equals, "crunch-run")
+			c.Check(desc["arguments"], check.Equals, `"'--runtime-engine=docker' '`+uuid+`'"`)
+			c.Check(desc["batch_name"], check.Equals, uuid)
+			prio, err := strconv.ParseInt(desc["priority"], 10, 64)
+			c.Check(err, check.IsNil)
+			ent := condorqEntry{
+				ID:       fmt.Sprintf("%d.0", id),
+				UUID:     uuid,
+				Status:   jobRunning,
+				Priority: prio,
+			}
+			switch uuid {
+			case s.crPending.ContainerUUID:
+				ent.Status = jobIdle
+			case s.crCUDARequest.ContainerUUID:
+				ent.Status = jobHeld
+				ent.HoldReason = stubHoldReason
+			}
+			fakejobq[ent.ID] = ent
+		}
+		submitted = pending
+	}
+	return func(prog string, args ...string) *exec.Cmd {
+		c.Logf("stubCommand: %q %q", prog, args)
+		if rand.Float64() < stub.errorRate {
+			return exec.Command("bash", "-c", "echo >&2 'stub random failure' && false")
+		}
+		if stub.sudoUser != "" && len(args) > 3 &&
+			prog == "sudo" &&
+			args[0] == "-E" &&
+			args[1] == "-u" &&
+			args[2] == stub.sudoUser {
+			prog, args = args[3], args[4:]
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		collect()
+		switch prog {
+		case "condor_submit":
+			c.Check(args, check.DeepEquals, []string{"-terse", "-"})
+			id := nextjobid
+			nextjobid++
+			submitted = append(submitted, id)
+			return exec.Command("bash", "-c", `cat >"$1.tmp" && mv "$1.tmp" "$1" && echo "$2.0 - $2.0"`, "-",
+				filepath.Join(subdir, fmt.Sprintf("%d.sub", id)), fmt.Sprintf("%d", id))
+		case "condor_q":
+			c.Check(args, check.DeepEquals, []string{"-allusers", "-constraint", "ArvadosContainerUUID =!= undefined", "-af:jt", "ArvadosContainerUUID", "JobStatus", "JobPrio", "HoldReason"})
+			var out string
+			for _, ent := range fakejobq {
+				holdReason := ent.HoldReason
+				if holdReason == "" {
+					holdReason = "undefined"
+				}
+				out += fmt.Sprintf("%s\t%s\t%d\t%d\t%s\n", ent.ID, ent.UUID, ent.Status, ent.Priority, holdReason)
+			}
+			c.Logf("condor_q out: %q", out)
+			return exec.Command("printf", "%s", out)
+		case "condor_rm":
+			id := args[0]
+			if _, ok := fakejobq[id]; !ok {
+				return exec.Command("bash", "-c", fmt.Sprintf("echo >&2 'Job %s not found'; false", id))
+			}
+			go func() {
+				time.Sleep(time.Millisecond)
+				mtx.Lock()
+				delete(fakejobq, id)
+				mtx.Unlock()
+			}()
+			return exec.Command("echo", fmt.Sprintf("Job %s marked for removal", id))
+		case "condor_prio":
+			c.Assert(args, check.HasLen, 3)
+			c.Check(args[0], check.Equals, "-p")
+			prio, err := strconv.ParseInt(args[1], 10, 64)
+			c.Check(err, check.IsNil)
+			ent, ok := fakejobq[args[2]]
+			if !ok {
+				return exec.Command("bash", "-c", fmt.Sprintf("echo >&2 'Job %s not found'; false", args[2]))
+			}
+			ent.Priority = prio
+			fakejobq[args[2]] = ent
+			return exec.Command("true")
+		default:
+			return exec.Command("bash", "-c", fmt.Sprintf("echo >&2 'stub: command not found: %+q'", prog))
+		}
+	}
+}
+
+func (s *suite) TestSubmit(c *check.C) {
+	s.disp.condorcli.stubCommand = condorstub{
+		errorRate: 0.1,
+		sudoUser:  s.disp.Cluster.Containers.HTCondor.SubmitSudoUser,
+	}.stubCommand(s, c)
+	s.disp.Start()
+
+	deadline := time.Now().Add(20 * time.Second)
+	for range time.NewTicker(time.Second).C {
+		if time.Now().After(deadline) {
+			c.Error("timed out")
+			break
+		}
+		// "crTooBig" should never be submitted to condor
+		// because it is bigger than any configured instance
+		// type
+		if ent, ok := s.disp.condorqueue.Lookup(s.crTooBig.ContainerUUID); ok {
+			c.Errorf("Lookup(crTooBig) == true, ent = %#v", ent)
+			break
+		}
+		// "queuedcontainer" should be running
+		if _, ok := s.disp.condorqueue.Lookup(arvadostest.QueuedContainerUUID); !ok {
+			c.Log("Lookup(queuedcontainer) == false")
+			continue
+		}
+		// "crPending" should be idle
+		if _, ok := s.disp.condorqueue.Lookup(s.crPending.ContainerUUID); !ok {
+			c.Log("Lookup(crPending) == false")
+			continue
+		}
+		// "crMaxRunTime" should be running
+		if _, ok := s.disp.condorqueue.Lookup(s.crMaxRunTime.ContainerUUID); !ok {
+			c.Log("Lookup(crMaxRunTime) == false")
+			continue
+		}
+		// "lockedcontainer" should be removed because it has
+		// priority 0 (no matching container requests)
+		if ent, ok := s.disp.condorqueue.Lookup(arvadostest.LockedContainerUUID); ok {
+			c.Logf("Lookup(lockedcontainer) == true, ent = %#v", ent)
+			continue
+		}
+		// "crCUDARequest" should be removed because the stub
+		// puts it on hold
+		if ent, ok := s.disp.condorqueue.Lookup(s.crCUDARequest.ContainerUUID); ok {
+			c.Logf("Lookup(crCUDARequest) == true, ent = %#v", ent)
+			continue
+		}
+		var ctr arvados.Container
+		if err := s.disp.arvDispatcher.Arv.Get("containers", arvadostest.LockedContainerUUID, nil, &ctr); err != nil {
+			c.Logf("error getting container state for %s: %s", arvadostest.LockedContainerUUID, err)
+			continue
+		} else if ctr.State != arvados.ContainerStateQueued {
+			c.Logf("LockedContainer is not in the HTCondor queue but its arvados record has not been updated to state==Queued (state is %q)", ctr.State)
+			continue
+		}
+
+		if err := s.disp.arvDispatcher.Arv.Get("containers", s.crCUDARequest.ContainerUUID, nil, &ctr); err != nil {
+			c.Logf("error getting container state for %s: %s", s.crCUDARequest.ContainerUUID, err)
+			continue
+		} else if ctr.State != arvados.ContainerStateCancelled {
+			c.Logf("held container %s has not been updated to state==Cancelled (state is %q)", s.crCUDARequest.ContainerUUID, ctr.State)
+			continue
+		} else {
+			c.Check(ctr.RuntimeStatus["error"], check.Equals, "HTCondor job held: "+stubHoldReason)
+		}
+
+		if err := s.disp.arvDispatcher.Arv.Get("containers", s.crTooBig.ContainerUUID, nil, &ctr); err != nil {
+			c.Logf("error getting container state for %s: %s", s.crTooBig.ContainerUUID, err)
+			continue
+		} else if ctr.State != arvados.ContainerStateCancelled {
+			c.Logf("container %s is not in the HTCondor queue but its arvados record has not been updated to state==Cancelled (state is %q)", s.crTooBig.ContainerUUID, ctr.State)
+			continue
+		} else {
+			c.Check(ctr.RuntimeStatus["error"], check.Equals, "constraints not satisfiable by any configured instance type")
+		}
+		c.Log("reached desired state")
+		break
+	}
+}
+
+var _ = check.Suite(&submitSuite{})
+
+// submitSuite tests submit description generation without an
+// Arvados API server.
+type submitSuite struct {
+	disp *dispatcher
+}
+
+func (s *submitSuite) SetUpTest(c *check.C) {
+	cluster := &arvados.Cluster{}
+	cluster.Containers.ReserveExtraRAM = 256 << 20
+	cluster.Containers.HTCondor.SubmitDescription = []string{
+		"universe = vanilla",
+		"request_cpus = %C",
+		"request_memory = %MMB",
+		"request_disk = %TMB",
+		"allowed_execute_duration = %W",
+	}
+	cluster.Containers.HTCondor.SubmitGPUDescription = []string{"request_gpus = %G"}
+	cluster.Containers.HTCondor.MaxRunTimeOverhead = arvados.Duration(5 * time.Minute)
+	s.disp = &dispatcher{Cluster: cluster}
+}
+
+func (s *submitSuite) TestSubmitDescription(c *check.C) {
+	ctr := arvados.Container{
+		UUID:     "zzzzz-dz642-abcdeabcdeabcde",
+		Priority: 562948349670000000,
+		RuntimeConstraints: arvados.RuntimeConstraints{
+			RAM:          1 << 30,
+			KeepCacheRAM: 256 << 20,
+			VCPUs:        2,
+		},
+		Mounts: map[string]arvados.Mount{
+			"/tmp": {Kind: "tmp", Capacity: 1 << 30},
+		},
+	}
+	desc, err := s.disp.submitDescription(ctr, []string{"/usr/bin/crunch-run", "--runtime-engine=singularity", ctr.UUID})
+	c.Assert(err, check.IsNil)
+	c.Check(string(desc), check.Equals, `universe = vanilla
+request_cpus = 2
+request_memory = 1536MB
+request_disk = 1024MB
+executable = /usr/bin/crunch-run
+arguments = "'--runtime-engine=singularity' 'zzzzz-dz642-abcdeabcdeabcde'"
+transfer_executable = false
+getenv = ARVADOS_API_HOST, ARVADOS_API_TOKEN, ARVADOS_API_HOST_INSECURE, GatewayAuthSecret
+batch_name = zzzzz-dz642-abcdeabcdeabcde
++ArvadosContainerUUID = "zzzzz-dz642-abcdeabcdeabcde"
+priority = 1
+queue
+`)
+
+	// max_run_time and GPUs
+	ctr.SchedulingParameters.MaxRunTime = 3600
+	ctr.RuntimeConstraints.GPU.DeviceCount = 2
+	desc, err = s.disp.submitDescription(ctr, []string{"crunch-run", ctr.UUID})
+	c.Assert(err, check.IsNil)
+	c.Check(string(desc), check.Matches, `(?ms).*^allowed_execute_duration = 3900\nrequest_gpus = 2\nexecutable = crunch-run\n.*`)
+
+	// MaxRunTimeDefault applies when max_run_time is not set
+	ctr.SchedulingParameters.MaxRunTime = 0
+	s.disp.Cluster.Containers.HTCondor.MaxRunTimeDefault = arvados.Duration(time.Hour)
+	desc, err = s.disp.submitDescription(ctr, []string{"crunch-run", ctr.UUID})
+	c.Assert(err, check.IsNil)
+	c.Check(string(desc), check.Matches, `(?ms).*^allowed_execute_duration = 3900$.*`)
+
+	// The GPU lines must not be appended to the cluster config
+	c.Check(s.disp.Cluster.Containers.HTCondor.SubmitDescription, check.HasLen, 5)
+}
+
+func (s *submitSuite) TestSubstitutions(c *check.C) {
+	s.disp.Cluster.Containers.HTCondor.SubmitDescription = []string{"zebra = %Z"}
+	_, err := s.disp.submitDescription(arvados.Container{}, []string{"crunch-run"})
+	c.Check(err, check.ErrorMatches, `Unknown substitution parameter %Z in SubmitDescription`)
+
+	s.disp.Cluster.Containers.HTCondor.SubmitDescription = []string{
+		"+Example = \"%U\"",
+		"literal = 100%%",
+		"never = %W",
+		"literal_w = %%W",
+	}
+	desc, err := s.disp.submitDescription(arvados.Container{UUID: "zzzzz-dz642-asdfasdfasdfasd"}, []string{"crunch-run"})
+	c.Check(err, check.IsNil)
+	lines := strings.Split(string(desc), "\n")
+	c.Check(lines[:3], check.DeepEquals, []string{
+		`+Example = "zzzzz-dz642-asdfasdfasdfasd"`,
+		`literal = 100%`,
+		`literal_w = %W`,
+	})
+}
+
+func (s *submitSuite) TestCondorArguments(c *check.C) {
+	for _, trial := range []struct {
+		args   []string
+		expect string
+	}{
+		{nil, `""`},
+		{[]string{"--foo=bar", "baz"}, `"'--foo=bar' 'baz'"`},
+		{[]string{"with space", "it's"}, `"'with space' 'it''s'"`},
+		{[]string{`say "hi"`}, `"'say ""hi""'"`},
+	} {
+		got, err := condorArguments(trial.args)
+		c.Check(err, check.IsNil)
+		c.Check(got, check.Equals, trial.expect, check.Commentf("%q", trial.args))
+	}
+	_, err := condorArguments([]string{"two\nlines"})
+	c.Check(err, check.ErrorMatches, `.*contains newline`)
+}
+
+func (s *submitSuite) TestParseCondorQ(c *check.C) {
+	ents, err := parseCondorQ([]byte("12.0\tzzzzz-dz642-aaaaaaaaaaaaaaa\t2\t5\tundefined\n" +
+		"13.0\tzzzzz-dz642-bbbbbbbbbbbbbbb\t5\t-3\tError from slot1@node: job exceeded allowed execute duration\n"))
+	c.Assert(err, check.IsNil)
+	sort.Slice(ents, func(i, j int) bool { return ents[i].ID < ents[j].ID })
+	c.Check(ents, check.DeepEquals, []condorqEntry{
+		{ID: "12.0", UUID: "zzzzz-dz642-aaaaaaaaaaaaaaa", Status: jobRunning, Priority: 5},
+		{ID: "13.0", UUID: "zzzzz-dz642-bbbbbbbbbbbbbbb", Status: jobHeld, Priority: -3, HoldReason: "Error from slot1@node: job exceeded allowed execute duration"},
+	})
+
+	_, err = parseCondorQ([]byte("12.0\tzzzzz-dz642-aaaaaaaaaaaaaaa\t2\n"))
+	c.Check(err, check.ErrorMatches, `could not parse condor_q output line .*`)
+	_, err = parseCondorQ([]byte("12.0\tzzzzz-dz642-aaaaaaaaaaaaaaa\tR\t5\tundefined\n"))
+	c.Check(err, check.ErrorMatches, `could not parse JobStatus .*`)
+}
+
+func (s *submitSuite) TestSetPriority(c *check.C) {
+	var prioCalls [][]string
+	cli := &condorcli{
+		logger: ctxlog.TestLogger(c),
+		stubCommand: func(prog string, args ...string) *exec.Cmd {
+			c.Check(prog, check.Equals, "condor_prio")
+			prioCalls = append(prioCalls, args)
+			return exec.Command("true")
+		},
+	}
+	q := &condorqueue{logger: cli.logger, condorcli: cli}
+	// Use a static queue instead of polling condor_q.
+	q.initOnce.Do(func() {})
+	q.prioritySet = map[string]int64{}
+	q.latest = map[string]condorqEntry{
+		"zzzzz-dz642-aaaaaaaaaaaaaaa": {ID: "12.0", UUID: "zzzzz-dz642-aaaaaaaaaaaaaaa", Status: jobIdle, Priority: 1},
+		"zzzzz-dz642-bbbbbbbbbbbbbbb": {ID: "13.0", UUID: "zzzzz-dz642-bbbbbbbbbbbbbbb", Status: jobIdle, Priority: 1},
+	}
+
+	// Realistic Arvados priorities, which don't fit in an int.
+	const (
+		prioLow  = 562948349670000000
+		prioMid  = 562949953421000000
+		prioHigh = 1125899906842000000
+	)
+
+	// Already at rank 1, and unknown uuid: no-op
+	q.SetPriority("zzzzz-dz642-aaaaaaaaaaaaaaa", prioLow)
+	q.SetPriority("zzzzz-dz642-zzzzzzzzzzzzzzz", prioLow)
+	c.Check(prioCalls, check.HasLen, 0)
+
+	// Higher priority gets rank 2. Second call is redundant
+	// until the next queue update.
+	q.SetPriority("zzzzz-dz642-bbbbbbbbbbbbbbb", prioHigh)
+	q.SetPriority("zzzzz-dz642-bbbbbbbbbbbbbbb", prioHigh)
+	c.Check(prioCalls, check.DeepEquals, [][]string{{"-p", "2", "13.0"}})
+
+	// A container with an intermediate priority pushes the
+	// higher-priority container's rank up.
+	c.Check(q.Rank("zzzzz-dz642-ccccccccccccccc", prioMid), check.Equals, int64(2))
+	q.SetPriority("zzzzz-dz642-bbbbbbbbbbbbbbb", prioHigh)
+	c.Check(prioCalls, check.DeepEquals, [][]string{{"-p", "2", "13.0"}, {"-p", "3", "13.0"}})
+
+	// Equal priorities get equal ranks.
+	c.Check(q.Rank("zzzzz-dz642-ddddddddddddddd", prioMid), check.Equals, int64(2))
+
+	// Forgotten containers no longer affect ranks.
+	q.Forget("zzzzz-dz642-ccccccccccccccc")
+	q.Forget("zzzzz-dz642-ddddddddddddddd")
+	q.Forget("zzzzz-dz642-zzzzzzzzzzzzzzz")
+	c.Check(q.Rank("zzzzz-dz642-bbbbbbbbbbbbbbb", prioHigh), check.Equals, int64(2))
+	c.Check(q.Rank("zzzzz-dz642-aaaaaaaaaaaaaaa", prioLow), check.Equals, int64(1))
+}
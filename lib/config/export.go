@@ -92,6 +92,7 @@ var whitelist = map[string]bool{
 	"Collections":                                         true,
 	"Collections.BalanceCollectionBatch":                  false,
 	"Collections.BalanceCollectionBuffers":                false,
+	"Collections.BalanceFullIndexInterval":                false,
 	"Collections.BalancePeriod":                           false,
 	"Collections.BalancePullLimit":                        false,
 	"Collections.BalanceTimeout":                          false,
@@ -100,6 +101,8 @@ var whitelist = map[string]bool{
 	"Collections.BlobDeleteConcurrency":                   false,
 	"Collections.BlobMissingReport":                       false,
 	"Collections.BlobReplicateConcurrency":                false,
+	"Collections.BlobScrubInterval":                       false,
+	"Collections.BlobScrubRate":                           false,
 	"Collections.BlobSigning":                             true,
 	"Collections.BlobSigningKey":                          false,
 	"Collections.BlobSigningTTL":                          true,
@@ -117,6 +120,7 @@ var whitelist = map[string]bool{
 	"Collections.ManagedProperties.*.*":                   true,
 	"Collections.PreserveVersionIfIdle":                   true,
 	"Collections.S3FolderObjects":                         true,
+	"Collections.S3MultipartUploadTTL":                    false,
 	"Collections.TrashSweepInterval":                      false,
 	"Collections.TrustAllContent":                         true,
 	"Collections.WebDAVCache":                             false,
@@ -126,18 +130,22 @@ var whitelist = map[string]bool{
 	"Collections.WebDAVPermission":                        false,
 	"Containers":                                          true,
 	"Containers.AlwaysUsePreemptibleInstances":            true,
+	"Containers.Budgets":                                  false,
 	"Containers.CloudVMs":                                 false,
 	"Containers.CrunchRunArgumentsList":                   false,
 	"Containers.CrunchRunCommand":                         false,
 	"Containers.DefaultKeepCacheRAM":                      true,
 	"Containers.DispatchPrivateKey":                       false,
+	"Containers.HTCondor":                                 false,
 	"Containers.LocalKeepBlobBuffersPerVCPU":              false,
 	"Containers.LocalKeepLogsToContainerLog":              false,
 	"Containers.Logging":                                  false,
 	"Containers.LogReuseDecisions":                        false,
+	"Containers.Kubernetes":                               false,
 	"Containers.LSF":                                      false,
 	"Containers.MaxDispatchAttempts":                      false,
 	"Containers.MaximumPriceFactor":                       true,
+	"Containers.MaxPreemptibleInterruptions":              false,
 	"Containers.MaxRetryAttempts":                         true,
 	"Containers.MinRetryPeriod":                           true,
 	"Containers.MaxRunningContainersPerInstance":          true,
@@ -218,6 +226,8 @@ var whitelist = map[string]bool{
 	"Services.*.InternalURLs":                             false,
 	"StorageClasses":                                      true,
 	"StorageClasses.*":                                    true,
+	"StorageClasses.*.ColdAfter":                          false,
+	"StorageClasses.*.ColdStorageClass":                   false,
 	"StorageClasses.*.Default":                            true,
 	"StorageClasses.*.Priority":                           true,
 	"SystemLogs":                                          false,
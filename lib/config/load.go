@@ -338,11 +338,14 @@ func (ldr *Loader) Load() (*arvados.Config, error) {
 			ldr.checkToken(fmt.Sprintf("Clusters.%s.Collections.BlobSigningKey", id), cc.Collections.BlobSigningKey, true, false),
 			checkKeyConflict(fmt.Sprintf("Clusters.%s.PostgreSQL.Connection", id), cc.PostgreSQL.Connection),
 			ldr.checkEnum("Containers.LocalKeepLogsToContainerLog", cc.Containers.LocalKeepLogsToContainerLog, "none", "all", "errors"),
+			ldr.checkEnum("Containers.CloudVMs.FairShareMode", cc.Containers.CloudVMs.FairShareMode, "", "user", "project"),
+			ldr.checkEnum("Containers.Budgets.Period", cc.Containers.Budgets.Period, "monthly", "weekly", "daily"),
 			ldr.checkEmptyKeepstores(cc),
 			ldr.checkUnlistedKeepstores(cc),
 			ldr.checkLocalKeepBlobBuffers(cc),
 			ldr.checkStorageClasses(cc),
 			ldr.checkGPUVersions(cc),
+			ldr.checkWarmPool(cc),
 			// TODO: check non-empty Rendezvous on
 			// services other than Keepstore
 		} {
@@ -505,6 +508,10 @@ func (ldr *Loader) checkLocalKeepBlobBuffers(cc arvados.Cluster) error {
 	if kbb == 0 {
 		return nil
 	}
+	if cc.Collections.BalanceFullIndexInterval > 0 {
+		ldr.Logger.Warnf("LocalKeepBlobBuffersPerVCPU is %d but will not be used because Collections.BalanceFullIndexInterval is non-zero -- suggest changing to 0", kbb)
+		return nil
+	}
 	for uuid, vol := range cc.Volumes {
 		if len(vol.AccessViaHosts) > 0 {
 			ldr.Logger.Warnf("LocalKeepBlobBuffersPerVCPU is %d but will not be used because at least one volume (%s) uses AccessViaHosts -- suggest changing to 0", kbb, uuid)
@@ -539,13 +546,45 @@ func (ldr *Loader) checkStorageClasses(cc arvados.Cluster) error {
 		if sc.Default {
 			haveDefault = true
 		}
+		if sc.ColdStorageClass == "" {
+			continue
+		} else if sc.ColdStorageClass == classid {
+			return fmt.Errorf("StorageClasses.%s.ColdStorageClass must be a different storage class", classid)
+		} else if _, ok := cc.StorageClasses[sc.ColdStorageClass]; !ok {
+			return fmt.Errorf("StorageClasses.%s.ColdStorageClass refers to storage class %q that is not defined in StorageClasses", classid, sc.ColdStorageClass)
+		} else if sc.ColdAfter <= 0 {
+			return fmt.Errorf("StorageClasses.%s.ColdAfter must be greater than zero", classid)
+		}
 	}
 	if !haveDefault {
 		return fmt.Errorf("there is no default storage class (at least one entry in StorageClasses must have Default: true)")
 	}
+	// Keep-balance can't tell whether a block in a cold storage
+	// class has been read since it was moved there unless all of
+	// the volumes in that class record read times. Otherwise,
+	// blocks would be moved back and forth between the hot and
+	// cold storage classes indefinitely.
+	for volid, vol := range cc.Volumes {
+		if readTimeDrivers[vol.Driver] {
+			continue
+		}
+		for classid, sc := range cc.StorageClasses {
+			if sc.ColdStorageClass != "" && vol.StorageClasses[sc.ColdStorageClass] {
+				return fmt.Errorf("%s: volume driver %q does not record read times, so the volume cannot provide storage class %q, which is the ColdStorageClass of storage class %q", volid, vol.Driver, sc.ColdStorageClass, classid)
+			}
+		}
+	}
 	return nil
 }
 
+// Volume drivers that record block read times, which are needed by
+// volumes in a cold storage class (see ColdStorageClass). This must
+// match the keepstore drivers that implement BlockMarkRead.
+var readTimeDrivers = map[string]bool{
+	"Directory": true,
+	"S3":        true,
+}
+
 func (ldr *Loader) checkGPUVersions(cc arvados.Cluster) error {
 	for _, it := range cc.InstanceTypes {
 		if it.GPU.DeviceCount == 0 {
@@ -560,6 +599,18 @@ func (ldr *Loader) checkGPUVersions(cc arvados.Cluster) error {
 	return nil
 }
 
+func (ldr *Loader) checkWarmPool(cc arvados.Cluster) error {
+	for name, wp := range cc.Containers.CloudVMs.WarmPool {
+		if _, ok := cc.InstanceTypes[name]; !ok {
+			return fmt.Errorf("Containers.CloudVMs.WarmPool.%s refers to instance type %q that is not defined in InstanceTypes", name, name)
+		}
+		if err := wp.Validate(); err != nil {
+			return fmt.Errorf("Containers.CloudVMs.WarmPool.%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
 func checkKeyConflict(label string, m map[string]string) error {
 	saw := map[string]bool{}
 	for k := range m {
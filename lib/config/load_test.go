@@ -674,6 +674,19 @@ Clusters:
 `, &logbuf).Load()
 	c.Assert(err, check.IsNil)
 	c.Check(logbuf.String(), check.Matches, `(?ms).*LocalKeepBlobBuffersPerVCPU is 1 but will not be used because at least one volume \(z\) uses AccessViaHosts -- suggest changing to 0.*`)
+
+	logbuf.Reset()
+	_, err = testLoader(c, `
+Clusters:
+ z1111:
+  Collections:
+   BalanceFullIndexInterval: 24h
+  Volumes:
+   z:
+    Replication: 2
+`, &logbuf).Load()
+	c.Assert(err, check.IsNil)
+	c.Check(logbuf.String(), check.Matches, `(?ms).*LocalKeepBlobBuffersPerVCPU is 1 but will not be used because Collections.BalanceFullIndexInterval is non-zero -- suggest changing to 0.*`)
 }
 
 func (s *LoadSuite) TestImplicitStorageClasses(c *check.C) {
@@ -788,6 +801,133 @@ Clusters:
 	c.Assert(err, check.ErrorMatches, `there is no default storage class.*`)
 }
 
+func (s *LoadSuite) TestColdStorageClass(c *check.C) {
+	ldr := testLoader(c, `
+Clusters:
+ z1111:
+  StorageClasses:
+   hot:
+    Default: true
+    ColdStorageClass: cold
+    ColdAfter: 2160h
+   cold: {}
+  Volumes:
+   z:
+    Driver: Directory
+    StorageClasses:
+     hot: true
+     cold: true`, nil)
+	cfg, err := ldr.Load()
+	c.Assert(err, check.IsNil)
+	cc, err := cfg.GetCluster("z1111")
+	c.Assert(err, check.IsNil)
+	c.Check(cc.StorageClasses["hot"].ColdStorageClass, check.Equals, "cold")
+	c.Check(cc.StorageClasses["hot"].ColdAfter, check.Equals, arvados.Duration(90*24*time.Hour))
+	c.Check(cc.StorageClasses["cold"].ColdStorageClass, check.Equals, "")
+
+	for _, trial := range []struct {
+		cold      string
+		coldAfter string
+		expect    string
+	}{
+		{"nx", "1h", `StorageClasses.hot.ColdStorageClass refers to storage class "nx" that is not defined.*`},
+		{"hot", "1h", `StorageClasses.hot.ColdStorageClass must be a different storage class`},
+		{"cold", "0s", `StorageClasses.hot.ColdAfter must be greater than zero`},
+	} {
+		ldr := testLoader(c, `
+Clusters:
+ z1111:
+  StorageClasses:
+   hot:
+    Default: true
+    ColdStorageClass: `+trial.cold+`
+    ColdAfter: `+trial.coldAfter+`
+   cold: {}
+  Volumes:
+   z:
+    StorageClasses:
+     hot: true`, nil)
+		_, err := ldr.Load()
+		c.Check(err, check.ErrorMatches, trial.expect)
+	}
+}
+
+func (s *LoadSuite) TestColdStorageClassDriver(c *check.C) {
+	for _, trial := range []struct {
+		hotDriver  string
+		coldDriver string
+		expect     string
+	}{
+		{"S3", "Directory", ``},
+		{"Azure", "S3", ``},
+		{"S3", "Azure", `cold: volume driver "Azure" does not record read times, so the volume cannot provide storage class "cold", which is the ColdStorageClass of storage class "hot"`},
+		{"S3", "ErasureCoded", `cold: volume driver "ErasureCoded" does not record read times.*`},
+	} {
+		ldr := testLoader(c, `
+Clusters:
+ z1111:
+  StorageClasses:
+   hot:
+    Default: true
+    ColdStorageClass: cold
+    ColdAfter: 2160h
+   cold: {}
+  Volumes:
+   hot:
+    Driver: `+trial.hotDriver+`
+    DriverParameters: {}
+    StorageClasses:
+     hot: true
+   cold:
+    Driver: `+trial.coldDriver+`
+    DriverParameters: {}
+    StorageClasses:
+     cold: true`, nil)
+		_, err := ldr.Load()
+		if trial.expect == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.expect)
+		}
+	}
+}
+
+func (s *LoadSuite) TestWarmPool(c *check.C) {
+	for _, trial := range []struct {
+		warmPool string
+		expect   string
+	}{
+		{`{Type1: {MinIdle: 2, Schedule: ["Mon-Fri 08:00-18:00"], TimeZone: America/New_York}}`, ``},
+		{`{Type2: {MinIdle: 1}}`, `Containers.CloudVMs.WarmPool.Type2 refers to instance type "Type2" that is not defined.*`},
+		{`{Type1: {MinIdle: -1}}`, `Containers.CloudVMs.WarmPool.Type1: .*MinIdle.*`},
+		{`{Type1: {MinIdle: 1, Schedule: ["Mon-Fri 8am-6pm"]}}`, `Containers.CloudVMs.WarmPool.Type1: invalid schedule entry.*`},
+		{`{Type1: {MinIdle: 1, TimeZone: Nowhere/Special}}`, `Containers.CloudVMs.WarmPool.Type1: .*Nowhere/Special.*`},
+	} {
+		c.Logf("trial: %s", trial.warmPool)
+		ldr := testLoader(c, `
+Clusters:
+ z1111:
+  InstanceTypes:
+   Type1:
+    RAM: 12345M
+    VCPUs: 8
+    Price: 1.23
+  Containers:
+   CloudVMs:
+    WarmPool: `+trial.warmPool, nil)
+		cfg, err := ldr.Load()
+		if trial.expect != "" {
+			c.Check(err, check.ErrorMatches, trial.expect)
+			continue
+		}
+		c.Assert(err, check.IsNil)
+		cc, err := cfg.GetCluster("z1111")
+		c.Assert(err, check.IsNil)
+		c.Check(cc.Containers.CloudVMs.WarmPool["Type1"].MinIdle, check.Equals, 2)
+		c.Check(cc.Containers.CloudVMs.WarmPool["Type1"].TimeZone, check.Equals, "America/New_York")
+	}
+}
+
 func (s *LoadSuite) TestPreemptiblePriceFactor(c *check.C) {
 	yaml := `
 Clusters:
@@ -409,6 +409,10 @@ func (conn *Conn) CollectionUntrash(ctx context.Context, options arvados.Untrash
 	return conn.chooseBackend(options.UUID).CollectionUntrash(ctx, options)
 }
 
+func (conn *Conn) CollectionPresignedURL(ctx context.Context, options arvados.PresignedURLOptions) (arvados.PresignedURL, error) {
+	return conn.chooseBackend(options.UUID).CollectionPresignedURL(ctx, options)
+}
+
 func (conn *Conn) ComputedPermissionList(ctx context.Context, options arvados.ListOptions) (arvados.ComputedPermissionList, error) {
 	return conn.local.ComputedPermissionList(ctx, options)
 }
@@ -578,6 +582,10 @@ func (conn *Conn) GroupUntrash(ctx context.Context, options arvados.UntrashOptio
 	return conn.chooseBackend(options.UUID).GroupUntrash(ctx, options)
 }
 
+func (conn *Conn) GroupBudget(ctx context.Context, options arvados.GetOptions) (arvados.GroupBudget, error) {
+	return conn.chooseBackend(options.UUID).GroupBudget(ctx, options)
+}
+
 func (conn *Conn) LinkCreate(ctx context.Context, options arvados.CreateOptions) (arvados.Link, error) {
 	return conn.chooseBackend(options.ClusterID).LinkCreate(ctx, options)
 }
@@ -9,7 +9,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"sort"
 	"strings"
 	"time"
@@ -19,6 +21,8 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/auth"
 	"git.arvados.org/arvados.git/sdk/go/httpserver"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 )
 
 // CollectionGet defers to railsProxy for everything except blob
@@ -111,6 +115,9 @@ func (conn *Conn) CollectionUpdate(ctx context.Context, opts arvados.UpdateOptio
 	if opts.Attrs, err = conn.applyReplaceSegmentsOption(ctx, opts.UUID, opts.Attrs, opts.ReplaceSegments); err != nil {
 		return arvados.Collection{}, err
 	}
+	if opts.Attrs, err = conn.applyMergePropertiesOption(ctx, opts.UUID, opts.Attrs, opts.MergeProperties); err != nil {
+		return arvados.Collection{}, err
+	}
 	resp, err := conn.railsProxy.CollectionUpdate(ctx, opts)
 	if err != nil {
 		return resp, err
@@ -119,6 +126,114 @@ func (conn *Conn) CollectionUpdate(ctx context.Context, opts arvados.UpdateOptio
 	return resp, nil
 }
 
+// Default and maximum lifetime of a presigned URL. The maximum is
+// the same as in Amazon S3, and is enforced by keep-web.
+const (
+	presignedURLDefaultTTL = 24 * time.Hour
+	presignedURLMaxTTL     = 7 * 24 * time.Hour
+)
+
+// CollectionPresignedURL returns a presigned S3 URL that can be used
+// to retrieve (GET) or upload (PUT) a single file in the given
+// collection via keep-web, without any other credentials, until it
+// expires.
+//
+// The URL is signed using the caller's token, so it stops working
+// if the token is revoked. The token secret itself is not included
+// in the URL.
+func (conn *Conn) CollectionPresignedURL(ctx context.Context, opts arvados.PresignedURLOptions) (arvados.PresignedURL, error) {
+	conn.logActivity(ctx)
+	method := opts.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	if method != http.MethodGet && method != http.MethodPut {
+		return arvados.PresignedURL{}, httpserver.Errorf(http.StatusBadRequest, "invalid method %q: must be GET or PUT", opts.Method)
+	}
+	if strings.Index(opts.UUID, "-4zz18-") != 5 {
+		return arvados.PresignedURL{}, httpserver.Errorf(http.StatusBadRequest, "invalid collection UUID %q", opts.UUID)
+	}
+	filepath := strings.TrimPrefix(path.Clean("/"+opts.Path), "/")
+	if filepath == "" || strings.HasSuffix(opts.Path, "/") {
+		return arvados.PresignedURL{}, httpserver.Errorf(http.StatusBadRequest, "invalid path %q: must be a file path", opts.Path)
+	}
+	ttl := presignedURLDefaultTTL
+	if opts.ExpiresIn != 0 {
+		ttl = time.Duration(opts.ExpiresIn) * time.Second
+	}
+	if ttl < time.Second || ttl > presignedURLMaxTTL {
+		return arvados.PresignedURL{}, httpserver.Errorf(http.StatusBadRequest, "invalid expires_in %d: must be between 1 and %d seconds", opts.ExpiresIn, int64(presignedURLMaxTTL/time.Second))
+	}
+	base := conn.cluster.Services.WebDAVDownload.ExternalURL
+	if base.Host == "" {
+		return arvados.PresignedURL{}, httpserver.Errorf(http.StatusNotImplemented, "presigned URLs are not available: Services.WebDAVDownload.ExternalURL is not configured")
+	}
+	// Ensure the collection exists and the caller can read it.
+	// Write permission (for PUT) is checked by keep-web when the
+	// URL is used.
+	_, err := conn.railsProxy.CollectionGet(ctx, arvados.GetOptions{UUID: opts.UUID, Select: []string{"uuid"}})
+	if err != nil {
+		return arvados.PresignedURL{}, err
+	}
+	aca, err := conn.railsProxy.APIClientAuthorizationCurrent(ctx, arvados.GetOptions{})
+	if err != nil {
+		return arvados.PresignedURL{}, err
+	}
+	if !strings.HasPrefix(aca.UUID, conn.cluster.ClusterID+"-") || aca.APIToken == "" {
+		return arvados.PresignedURL{}, httpserver.Errorf(http.StatusBadRequest, "presigned URLs can only be created using a token issued by this cluster")
+	}
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	if !aca.ExpiresAt.IsZero() && aca.ExpiresAt.Before(expiresAt) {
+		return arvados.PresignedURL{}, httpserver.Errorf(http.StatusBadRequest, "requested expiry time %s is later than the expiry time of the token being used (%s)", expiresAt.UTC().Format(time.RFC3339), aca.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+
+	u := &url.URL{
+		Scheme: base.Scheme,
+		Host:   base.Host,
+		Path:   "/" + opts.UUID + "/" + filepath,
+	}
+	// Escape the path the same way keep-web does when computing
+	// the canonical request, and tell the signer not to escape it
+	// again.
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = url.Values{"X-Amz-Expires": {fmt.Sprintf("%d", int64(ttl/time.Second))}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return arvados.PresignedURL{}, err
+	}
+	signer := v4.NewSigner(func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true })
+	signed, _, err := signer.PresignHTTP(ctx, aws.Credentials{
+		AccessKeyID:     aca.UUID,
+		SecretAccessKey: aca.APIToken,
+	}, req, "UNSIGNED-PAYLOAD", "s3", "auto", now)
+	if err != nil {
+		return arvados.PresignedURL{}, err
+	}
+	return arvados.PresignedURL{
+		URL:       signed,
+		Method:    method,
+		ExpiresAt: expiresAt.UTC(),
+	}, nil
+}
+
+// s3EscapePath percent-encodes every byte in s except unreserved
+// characters and "/", as required by the S3 V4 signature algorithm.
+func s3EscapePath(s string) string {
+	var out strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'a' && c <= 'z') ||
+			(c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			out.WriteByte(c)
+		} else {
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
+
 func (conn *Conn) signCollection(ctx context.Context, coll *arvados.Collection) {
 	if coll.IsTrashed || coll.ManifestText == "" || !conn.cluster.Collections.BlobSigning {
 		return
@@ -382,3 +497,77 @@ func (conn *Conn) applyReplaceSegmentsOption(ctx context.Context, fromUUID strin
 	}
 	return attrs, nil
 }
+
+// applyMergePropertiesOption merges mergeProps into the current
+// properties of the collection or group with the given UUID, and
+// returns attrs with the resulting properties. The caller must
+// already hold the lock on the UUID, so concurrent updates to other
+// properties are not lost.
+//
+// A null value removes the property. An object value is merged one
+// level deep into the current value (if it is also an object): null
+// values remove keys, other values replace them, and the property is
+// removed if no keys remain. Any other value replaces the property.
+func (conn *Conn) applyMergePropertiesOption(ctx context.Context, uuid string, attrs map[string]interface{}, mergeProps map[string]interface{}) (map[string]interface{}, error) {
+	if len(mergeProps) == 0 {
+		return attrs, nil
+	}
+	if _, ok := attrs["properties"]; ok {
+		return nil, httpserver.Errorf(http.StatusBadRequest, "invalid request: cannot provide both attrs['properties'] and merge_properties")
+	}
+	var current map[string]interface{}
+	if strings.Index(uuid, "-j7d0g-") == 5 {
+		grp, err := conn.railsProxy.GroupGet(ctx, arvados.GetOptions{UUID: uuid, Select: []string{"uuid", "properties"}})
+		if err != nil {
+			return nil, err
+		}
+		current = grp.Properties
+	} else {
+		coll, err := conn.CollectionGet(ctx, arvados.GetOptions{UUID: uuid, Select: []string{"uuid", "properties"}})
+		if err != nil {
+			return nil, err
+		}
+		current = coll.Properties
+	}
+	props := map[string]interface{}{}
+	for k, v := range current {
+		props[k] = v
+	}
+	for k, v := range mergeProps {
+		newmap, isMap := v.(map[string]interface{})
+		switch {
+		case v == nil:
+			delete(props, k)
+		case isMap:
+			merged := map[string]interface{}{}
+			if oldmap, ok := props[k].(map[string]interface{}); ok {
+				for k2, v2 := range oldmap {
+					merged[k2] = v2
+				}
+			}
+			for k2, v2 := range newmap {
+				if v2 == nil {
+					delete(merged, k2)
+				} else {
+					merged[k2] = v2
+				}
+			}
+			if len(merged) == 0 {
+				delete(props, k)
+			} else {
+				props[k] = merged
+			}
+		default:
+			props[k] = v
+		}
+	}
+	err := conn.checkProperties(ctx, props)
+	if err != nil {
+		return nil, err
+	}
+	if attrs == nil {
+		attrs = make(map[string]interface{}, 1)
+	}
+	attrs["properties"] = props
+	return attrs, nil
+}
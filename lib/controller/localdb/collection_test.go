@@ -6,10 +6,14 @@ package localdb
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/fs"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -80,6 +84,44 @@ func (s *CollectionSuite) TestCollectionCreateAndUpdateWithProperties(c *check.C
 	}
 }
 
+func (s *CollectionSuite) TestMergeProperties(c *check.C) {
+	coll, err := s.localdb.CollectionCreate(s.userctx, arvados.CreateOptions{
+		Attrs: map[string]interface{}{
+			"properties": map[string]interface{}{
+				"keep":    "this",
+				"replace": "this",
+				"remove":  "this",
+				"nested":  map[string]interface{}{"keep": "this", "replace": "this", "remove": "this"},
+				"emptied": map[string]interface{}{"remove": "this"},
+			},
+		}})
+	c.Assert(err, check.IsNil)
+	coll, err = s.localdb.CollectionUpdate(s.userctx, arvados.UpdateOptions{
+		UUID:   coll.UUID,
+		Select: []string{"uuid", "properties"},
+		MergeProperties: map[string]interface{}{
+			"replace": "that",
+			"remove":  nil,
+			"nested":  map[string]interface{}{"replace": "that", "remove": nil, "add": map[string]interface{}{"a": "b"}},
+			"emptied": map[string]interface{}{"remove": nil},
+			"new":     map[string]interface{}{"a": "b", "c": nil},
+		}})
+	c.Assert(err, check.IsNil)
+	c.Check(coll.Properties, check.DeepEquals, map[string]interface{}{
+		"keep":    "this",
+		"replace": "that",
+		"nested":  map[string]interface{}{"keep": "this", "replace": "that", "add": map[string]interface{}{"a": "b"}},
+		"new":     map[string]interface{}{"a": "b"},
+	})
+
+	_, err = s.localdb.CollectionUpdate(s.userctx, arvados.UpdateOptions{
+		UUID:            coll.UUID,
+		Attrs:           map[string]interface{}{"properties": map[string]interface{}{}},
+		MergeProperties: map[string]interface{}{"a": "b"},
+	})
+	c.Check(err, check.ErrorMatches, `.*cannot provide both.*`)
+}
+
 func (s *CollectionSuite) TestSignatures(c *check.C) {
 	resp, err := s.localdb.CollectionGet(s.userctx, arvados.GetOptions{UUID: arvadostest.FooCollection})
 	c.Check(err, check.IsNil)
@@ -799,3 +841,81 @@ func (s *replaceSegmentsSuite) TestInvalidReplacementLength(c *check.C) {
 func stripSignatures(manifest string) string {
 	return regexp.MustCompile(`\+A[^ ]+`).ReplaceAllString(manifest, "")
 }
+
+func (s *CollectionSuite) TestPresignedURL(c *check.C) {
+	s.cluster.Services.WebDAVDownload.ExternalURL = arvados.URL{Scheme: "https", Host: "download.example.com", Path: "/"}
+	for _, method := range []string{"", "GET", "PUT"} {
+		resp, err := s.localdb.CollectionPresignedURL(s.userctx, arvados.PresignedURLOptions{
+			UUID:   arvadostest.FooCollection,
+			Path:   "dir/foo bar,baz.txt",
+			Method: method,
+		})
+		c.Assert(err, check.IsNil)
+		if method == "" {
+			method = "GET"
+		}
+		c.Check(resp.Method, check.Equals, method)
+		c.Check(resp.ExpiresAt.Sub(time.Now()) > 23*time.Hour, check.Equals, true)
+		c.Check(resp.ExpiresAt.Sub(time.Now()) <= 24*time.Hour, check.Equals, true)
+		c.Check(resp.URL, check.Not(check.Matches), `.*`+strings.Split(arvadostest.ActiveTokenV2, "/")[2]+`.*`)
+
+		u, err := url.Parse(resp.URL)
+		c.Assert(err, check.IsNil)
+		c.Check(u.Host, check.Equals, "download.example.com")
+		c.Check(u.EscapedPath(), check.Equals, "/"+arvadostest.FooCollection+"/dir/foo%20bar%2Cbaz.txt")
+		q := u.Query()
+		c.Check(q.Get("X-Amz-Algorithm"), check.Equals, "AWS4-HMAC-SHA256")
+		c.Check(q.Get("X-Amz-Credential"), check.Matches, arvadostest.ActiveTokenUUID+`/\d{8}/auto/s3/aws4_request`)
+		c.Check(q.Get("X-Amz-Expires"), check.Equals, "86400")
+		c.Check(q.Get("X-Amz-SignedHeaders"), check.Equals, "host")
+
+		// Check the signature the same way keep-web does.
+		sig := q.Get("X-Amz-Signature")
+		q.Del("X-Amz-Signature")
+		scope := strings.SplitN(q.Get("X-Amz-Credential"), "/", 2)[1]
+		canonicalRequest := method + "\n" + u.EscapedPath() + "\n" + strings.Replace(q.Encode(), "+", "%20", -1) + "\nhost:" + u.Host + "\n\nhost\nUNSIGNED-PAYLOAD"
+		crhash := sha256.Sum256([]byte(canonicalRequest))
+		stringToSign := "AWS4-HMAC-SHA256\n" + q.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(crhash[:])
+		key := []byte("AWS4" + arvadostest.ActiveToken)
+		for _, msg := range append(strings.Split(scope, "/")[:3], "aws4_request", stringToSign) {
+			h := hmac.New(sha256.New, key)
+			h.Write([]byte(msg))
+			key = h.Sum(nil)
+		}
+		c.Check(hex.EncodeToString(key), check.Equals, sig)
+	}
+
+	resp, err := s.localdb.CollectionPresignedURL(s.userctx, arvados.PresignedURLOptions{
+		UUID:      arvadostest.FooCollection,
+		Path:      "foo",
+		ExpiresIn: 3600,
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(resp.URL, check.Matches, `.*X-Amz-Expires=3600.*`)
+	c.Check(resp.ExpiresAt.Sub(time.Now()) <= time.Hour, check.Equals, true)
+
+	for _, trial := range []struct {
+		opts      arvados.PresignedURLOptions
+		errorCode int
+	}{
+		{arvados.PresignedURLOptions{UUID: arvadostest.FooCollection, Path: "foo", Method: "DELETE"}, http.StatusBadRequest},
+		{arvados.PresignedURLOptions{UUID: arvadostest.FooCollection, Path: ""}, http.StatusBadRequest},
+		{arvados.PresignedURLOptions{UUID: arvadostest.FooCollection, Path: "dir/"}, http.StatusBadRequest},
+		{arvados.PresignedURLOptions{UUID: arvadostest.FooCollection, Path: "foo", ExpiresIn: 8 * 86400}, http.StatusBadRequest},
+		{arvados.PresignedURLOptions{UUID: arvadostest.FooCollection, Path: "foo", ExpiresIn: -1}, http.StatusBadRequest},
+		{arvados.PresignedURLOptions{UUID: arvadostest.FooCollectionPDH, Path: "foo"}, http.StatusBadRequest},
+		{arvados.PresignedURLOptions{UUID: arvadostest.NonexistentCollection, Path: "foo"}, http.StatusNotFound},
+	} {
+		c.Logf("trial %+v", trial.opts)
+		_, err := s.localdb.CollectionPresignedURL(s.userctx, trial.opts)
+		c.Check(err, check.NotNil)
+		var se httpserver.HTTPStatusError
+		if c.Check(errors.As(err, &se), check.Equals, true) {
+			c.Check(se.HTTPStatus(), check.Equals, trial.errorCode)
+		}
+	}
+
+	s.cluster.Services.WebDAVDownload.ExternalURL = arvados.URL{}
+	_, err = s.localdb.CollectionPresignedURL(s.userctx, arvados.PresignedURLOptions{UUID: arvadostest.FooCollection, Path: "foo"})
+	c.Check(err, check.ErrorMatches, `.*WebDAVDownload.ExternalURL is not configured.*`)
+}
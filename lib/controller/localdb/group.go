@@ -5,21 +5,31 @@
 package localdb
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"strings"
+	"time"
 
+	"git.arvados.org/arvados.git/lib/ctrlctx"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/httpserver"
 )
 
 // GroupCreate defers to railsProxy for everything except vocabulary
-// checking.
+// and budget property checking.
 func (conn *Conn) GroupCreate(ctx context.Context, opts arvados.CreateOptions) (arvados.Group, error) {
 	conn.logActivity(ctx)
 	err := conn.checkProperties(ctx, opts.Attrs["properties"])
 	if err != nil {
 		return arvados.Group{}, err
 	}
+	err = conn.checkBudgetProperty(ctx, "", opts.Attrs["properties"])
+	if err != nil {
+		return arvados.Group{}, err
+	}
 	resp, err := conn.railsProxy.GroupCreate(ctx, opts)
 	if err != nil {
 		return resp, err
@@ -27,19 +37,95 @@ func (conn *Conn) GroupCreate(ctx context.Context, opts arvados.CreateOptions) (
 	return resp, nil
 }
 
+// checkBudgetProperty returns an error if the given properties
+// would add, change, or remove the budget property of the given
+// group (or a new group, if uuid is empty) and the caller is not an
+// admin, or if the new budget property is not valid.
+func (conn *Conn) checkBudgetProperty(ctx context.Context, uuid string, properties interface{}) error {
+	props, ok := properties.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	var oldval interface{}
+	if uuid != "" {
+		grp, err := conn.railsProxy.GroupGet(ctx, arvados.GetOptions{UUID: uuid, Select: []string{"properties"}})
+		if err != nil {
+			return err
+		}
+		oldval = grp.Properties[arvados.GroupBudgetProperty]
+	}
+	newval := props[arvados.GroupBudgetProperty]
+	oldjson, err := json.Marshal(oldval)
+	if err != nil {
+		return err
+	}
+	newjson, err := json.Marshal(newval)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(oldjson, newjson) {
+		return nil
+	}
+	if newval != nil {
+		if _, err := parseProjectBudget(newval); err != nil {
+			return httpserver.ErrorWithStatus(err, http.StatusBadRequest)
+		}
+	}
+	user, err := conn.railsProxy.UserGetCurrent(ctx, arvados.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if !user.IsAdmin {
+		return httpserver.Errorf(http.StatusForbidden, "only admins can change the %s property", arvados.GroupBudgetProperty)
+	}
+	return nil
+}
+
+// parseProjectBudget returns the budget stored in a project's
+// budget property.
+func parseProjectBudget(val interface{}) (arvados.ProjectBudget, error) {
+	var budget arvados.ProjectBudget
+	buf, err := json.Marshal(val)
+	if err != nil {
+		return budget, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&budget); err != nil {
+		return budget, fmt.Errorf("invalid %s property %s: %w", arvados.GroupBudgetProperty, buf, err)
+	}
+	if budget.Limit < 0 || budget.SoftLimit < 0 {
+		return budget, fmt.Errorf("invalid %s property %s: limits must not be negative", arvados.GroupBudgetProperty, buf)
+	}
+	return budget, nil
+}
+
 func (conn *Conn) GroupGet(ctx context.Context, opts arvados.GetOptions) (arvados.Group, error) {
 	conn.logActivity(ctx)
 	return conn.railsProxy.GroupGet(ctx, opts)
 }
 
 // GroupUpdate defers to railsProxy for everything except vocabulary
-// checking.
+// and budget property checking, and the merge_properties option.
 func (conn *Conn) GroupUpdate(ctx context.Context, opts arvados.UpdateOptions) (arvados.Group, error) {
 	conn.logActivity(ctx)
 	err := conn.checkProperties(ctx, opts.Attrs["properties"])
 	if err != nil {
 		return arvados.Group{}, err
 	}
+	if len(opts.MergeProperties) > 0 {
+		err = conn.lockUUID(ctx, opts.UUID)
+		if err != nil {
+			return arvados.Group{}, err
+		}
+		if opts.Attrs, err = conn.applyMergePropertiesOption(ctx, opts.UUID, opts.Attrs, opts.MergeProperties); err != nil {
+			return arvados.Group{}, err
+		}
+	}
+	err = conn.checkBudgetProperty(ctx, opts.UUID, opts.Attrs["properties"])
+	if err != nil {
+		return arvados.Group{}, err
+	}
 	resp, err := conn.railsProxy.GroupUpdate(ctx, opts)
 	if err != nil {
 		return resp, err
@@ -106,3 +192,90 @@ func (conn *Conn) GroupContents(ctx context.Context, options arvados.GroupConten
 
 	return conn.railsProxy.GroupContents(ctx, options)
 }
+
+// GroupBudget returns the budget of the given project (as set in
+// its budget property), and its spend during the current budget
+// period.
+//
+// Spend is the cost of top-level container requests owned by the
+// project or its subprojects. For a container request that is still
+// running, the cost of the current container (as last reported by
+// crunch-run) is added to the cost of previous attempts. Each
+// request's cost is assumed to accrue at a constant rate between the
+// time its container started and the time it finished (or now, if it
+// is still running), and only the portion that falls within the
+// current period is counted.
+func (conn *Conn) GroupBudget(ctx context.Context, opts arvados.GetOptions) (arvados.GroupBudget, error) {
+	conn.logActivity(ctx)
+	if strings.Index(opts.UUID, "-j7d0g-") != 5 {
+		return arvados.GroupBudget{}, httpserver.Errorf(http.StatusBadRequest, "invalid project UUID %q", opts.UUID)
+	}
+	// This also ensures the caller has permission to read the
+	// project.
+	grp, err := conn.railsProxy.GroupGet(ctx, arvados.GetOptions{UUID: opts.UUID, Select: []string{"uuid", "properties"}})
+	if err != nil {
+		return arvados.GroupBudget{}, err
+	}
+	now := time.Now()
+	budget := arvados.GroupBudget{
+		UUID:        opts.UUID,
+		PeriodStart: budgetPeriodStart(conn.cluster.Containers.Budgets.Period, now),
+	}
+	if val, ok := grp.Properties[arvados.GroupBudgetProperty]; ok {
+		cfg, err := parseProjectBudget(val)
+		if err != nil {
+			return arvados.GroupBudget{}, err
+		}
+		budget.Limit = cfg.Limit
+		budget.SoftLimit = cfg.SoftLimit
+	}
+	tx, err := ctrlctx.CurrentTx(ctx)
+	if err != nil {
+		return arvados.GroupBudget{}, err
+	}
+	err = tx.GetContext(ctx, &budget.Spend, `
+select coalesce(sum(cost * case
+	when t1 <= t0 then 1
+	else extract(epoch from (t1 - greatest(t0, $2))) / extract(epoch from (t1 - t0))
+	end), 0)
+from (
+	select cr.cumulative_cost +
+		case when cr.state = 'Committed' and c.state in ('Locked', 'Running') then c.cost + c.subrequests_cost else 0 end as cost,
+		coalesce(c.started_at, cr.created_at) as t0,
+		case when cr.state = 'Committed' then $3 else coalesce(c.finished_at, cr.modified_at) end as t1
+	from container_requests cr
+	left join containers c on c.uuid = cr.container_uuid
+	where cr.owner_uuid in (select target_uuid from project_subtree_with_trash_at($1, null))
+		and cr.requesting_container_uuid is null
+		and (cr.state = 'Committed' or (cr.state = 'Final' and cr.modified_at >= $2))
+) as crs
+where t1 >= $2`,
+		opts.UUID, budget.PeriodStart, now.UTC())
+	if err != nil {
+		return arvados.GroupBudget{}, err
+	}
+	switch {
+	case budget.Limit > 0 && budget.Spend >= budget.Limit:
+		budget.Status = arvados.GroupBudgetStatusExceeded
+	case budget.SoftLimit > 0 && budget.Spend >= budget.SoftLimit:
+		budget.Status = arvados.GroupBudgetStatusWarning
+	case budget.Limit > 0 || budget.SoftLimit > 0:
+		budget.Status = arvados.GroupBudgetStatusOK
+	}
+	return budget, nil
+}
+
+// budgetPeriodStart returns the start of the budget period
+// ("monthly", "weekly", or "daily") that contains t.
+func budgetPeriodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case "daily":
+		return day
+	case "weekly":
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
@@ -5,6 +5,8 @@
 package localdb
 
 import (
+	"time"
+
 	"git.arvados.org/arvados.git/lib/ctrlctx"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
@@ -216,3 +218,225 @@ func (s *GroupSuite) TestCanWriteCanManageResponses(c *check.C) {
 		}
 	}
 }
+
+func (s *GroupSuite) TestGroupBudget(c *check.C) {
+	project, err := s.localdb.GroupCreate(s.userctx, arvados.CreateOptions{
+		Attrs: map[string]interface{}{
+			"group_class": "project",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	subproject, err := s.localdb.GroupCreate(s.userctx, arvados.CreateOptions{
+		Attrs: map[string]interface{}{
+			"owner_uuid":  project.UUID,
+			"group_class": "project",
+		},
+	})
+	c.Assert(err, check.IsNil)
+
+	// No budget configured, no spend yet.
+	budget, err := s.localdb.GroupBudget(s.userctx, arvados.GetOptions{UUID: project.UUID})
+	c.Assert(err, check.IsNil)
+	c.Check(budget.UUID, check.Equals, project.UUID)
+	c.Check(budget.Spend, check.Equals, 0.0)
+	c.Check(budget.Status, check.Equals, "")
+	c.Check(budget.PeriodStart.Day(), check.Equals, 1)
+
+	// Move a top-level container request into the subproject.
+	// Its container finished in the current period.
+	now := time.Now().UTC()
+	_, err = s.tx.ExecContext(s.ctx, `update container_requests
+		set owner_uuid=$1, requesting_container_uuid=null, state='Final', modified_at=$2, cumulative_cost=12.5
+		where uuid=$3`, subproject.UUID, now, arvadostest.CompletedContainerRequestUUID)
+	c.Assert(err, check.IsNil)
+	_, err = s.tx.ExecContext(s.ctx, `update containers
+		set started_at=$1, finished_at=$2
+		where uuid=(select container_uuid from container_requests where uuid=$3)`,
+		budget.PeriodStart, now, arvadostest.CompletedContainerRequestUUID)
+	c.Assert(err, check.IsNil)
+
+	adminctx := ctrlctx.NewWithToken(s.ctx, s.cluster, arvadostest.AdminToken)
+	for _, trial := range []struct {
+		limit     float64
+		softLimit float64
+		status    string
+	}{
+		{0, 0, ""},
+		{20, 0, arvados.GroupBudgetStatusOK},
+		{20, 10, arvados.GroupBudgetStatusWarning},
+		{12, 10, arvados.GroupBudgetStatusExceeded},
+	} {
+		_, err = s.localdb.GroupUpdate(adminctx, arvados.UpdateOptions{
+			UUID: project.UUID,
+			Attrs: map[string]interface{}{
+				"properties": map[string]interface{}{
+					arvados.GroupBudgetProperty: map[string]interface{}{"limit": trial.limit, "soft_limit": trial.softLimit},
+				},
+			},
+		})
+		c.Assert(err, check.IsNil)
+		budget, err := s.localdb.GroupBudget(s.userctx, arvados.GetOptions{UUID: project.UUID})
+		c.Assert(err, check.IsNil)
+		c.Check(budget.Spend, check.Equals, 12.5)
+		c.Check(budget.Limit, check.Equals, trial.limit)
+		c.Check(budget.SoftLimit, check.Equals, trial.softLimit)
+		c.Check(budget.Status, check.Equals, trial.status)
+	}
+
+	// Only the part of the container's run time that falls in the
+	// current period is counted.
+	_, err = s.tx.ExecContext(s.ctx, `update containers
+		set started_at=$1
+		where uuid=(select container_uuid from container_requests where uuid=$2)`,
+		budget.PeriodStart.Add(-now.Sub(budget.PeriodStart)), arvadostest.CompletedContainerRequestUUID)
+	c.Assert(err, check.IsNil)
+	budget, err = s.localdb.GroupBudget(s.userctx, arvados.GetOptions{UUID: project.UUID})
+	c.Assert(err, check.IsNil)
+	c.Check(budget.Spend > 6.2 && budget.Spend < 6.3, check.Equals, true, check.Commentf("spend %v", budget.Spend))
+
+	// A container that finished before the current period is not
+	// counted, even if its request was modified since then.
+	_, err = s.tx.ExecContext(s.ctx, `update containers
+		set started_at=$1, finished_at=$2
+		where uuid=(select container_uuid from container_requests where uuid=$3)`,
+		budget.PeriodStart.Add(-2*time.Hour), budget.PeriodStart.Add(-time.Hour), arvadostest.CompletedContainerRequestUUID)
+	c.Assert(err, check.IsNil)
+	budget, err = s.localdb.GroupBudget(s.userctx, arvados.GetOptions{UUID: project.UUID})
+	c.Assert(err, check.IsNil)
+	c.Check(budget.Spend, check.Equals, 0.0)
+
+	// Users who cannot read the project cannot see its budget.
+	ctxSpectator := ctrlctx.NewWithToken(s.ctx, s.cluster, arvadostest.SpectatorToken)
+	_, err = s.localdb.GroupBudget(ctxSpectator, arvados.GetOptions{UUID: project.UUID})
+	c.Check(err, check.ErrorMatches, `.*404.*`)
+
+	_, err = s.localdb.GroupBudget(s.userctx, arvados.GetOptions{UUID: arvadostest.ActiveUserUUID})
+	c.Check(err, check.ErrorMatches, `.*invalid project UUID.*`)
+}
+
+func (s *GroupSuite) TestBudgetProperty(c *check.C) {
+	adminctx := ctrlctx.NewWithToken(s.ctx, s.cluster, arvadostest.AdminToken)
+	budgetProps := map[string]interface{}{
+		"foo":                       "bar",
+		arvados.GroupBudgetProperty: map[string]interface{}{"limit": 100, "soft_limit": 80},
+	}
+
+	// Non-admins cannot set a budget.
+	_, err := s.localdb.GroupCreate(s.userctx, arvados.CreateOptions{
+		Attrs: map[string]interface{}{
+			"group_class": "project",
+			"properties":  budgetProps,
+		},
+	})
+	c.Check(err, check.ErrorMatches, `.*only admins can change the arv:budget property.*`)
+
+	project, err := s.localdb.GroupCreate(s.userctx, arvados.CreateOptions{
+		Attrs: map[string]interface{}{
+			"group_class": "project",
+		},
+	})
+	c.Assert(err, check.IsNil)
+	_, err = s.localdb.GroupUpdate(s.userctx, arvados.UpdateOptions{
+		UUID:  project.UUID,
+		Attrs: map[string]interface{}{"properties": budgetProps},
+	})
+	c.Check(err, check.ErrorMatches, `.*only admins can change the arv:budget property.*`)
+
+	// Admins can.
+	_, err = s.localdb.GroupUpdate(adminctx, arvados.UpdateOptions{
+		UUID:  project.UUID,
+		Attrs: map[string]interface{}{"properties": budgetProps},
+	})
+	c.Assert(err, check.IsNil)
+
+	// Non-admins can change other properties, as long as the
+	// budget is unchanged.
+	project, err = s.localdb.GroupUpdate(s.userctx, arvados.UpdateOptions{
+		UUID: project.UUID,
+		Attrs: map[string]interface{}{"properties": map[string]interface{}{
+			"foo":                       "baz",
+			arvados.GroupBudgetProperty: map[string]interface{}{"limit": 100.0, "soft_limit": 80.0},
+		}},
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(project.Properties["foo"], check.Equals, "baz")
+
+	// Non-admins cannot change or remove the budget.
+	for _, props := range []map[string]interface{}{
+		{arvados.GroupBudgetProperty: map[string]interface{}{"limit": 1000, "soft_limit": 80}},
+		{"foo": "baz"},
+	} {
+		_, err = s.localdb.GroupUpdate(s.userctx, arvados.UpdateOptions{
+			UUID:  project.UUID,
+			Attrs: map[string]interface{}{"properties": props},
+		})
+		c.Check(err, check.ErrorMatches, `.*only admins can change the arv:budget property.*`)
+	}
+
+	// Invalid budgets are rejected.
+	for _, val := range []interface{}{
+		"100",
+		map[string]interface{}{"limit": "100"},
+		map[string]interface{}{"limit": -1},
+		map[string]interface{}{"hard_limit": 100},
+	} {
+		_, err = s.localdb.GroupUpdate(adminctx, arvados.UpdateOptions{
+			UUID:  project.UUID,
+			Attrs: map[string]interface{}{"properties": map[string]interface{}{arvados.GroupBudgetProperty: val}},
+		})
+		c.Check(err, check.ErrorMatches, `.*invalid arv:budget property.*`, check.Commentf("%#v", val))
+	}
+}
+
+func (s *GroupSuite) TestMergeProperties(c *check.C) {
+	grp, err := s.localdb.GroupCreate(s.userctx, arvados.CreateOptions{
+		Attrs: map[string]interface{}{
+			"group_class": "project",
+			"properties": map[string]interface{}{
+				"keep":    "this",
+				"replace": "this",
+				"remove":  "this",
+			},
+		}})
+	c.Assert(err, check.IsNil)
+	grp, err = s.localdb.GroupUpdate(s.userctx, arvados.UpdateOptions{
+		UUID:   grp.UUID,
+		Select: []string{"uuid", "properties"},
+		MergeProperties: map[string]interface{}{
+			"replace": "that",
+			"remove":  nil,
+			"new":     "value",
+		}})
+	c.Assert(err, check.IsNil)
+	c.Check(grp.Properties, check.DeepEquals, map[string]interface{}{
+		"keep":    "this",
+		"replace": "that",
+		"new":     "value",
+	})
+
+	// Non-admins cannot change the budget using
+	// merge_properties either.
+	_, err = s.localdb.GroupUpdate(s.userctx, arvados.UpdateOptions{
+		UUID:            grp.UUID,
+		MergeProperties: map[string]interface{}{arvados.GroupBudgetProperty: map[string]interface{}{"limit": 1}},
+	})
+	c.Check(err, check.ErrorMatches, `.*only admins can change the arv:budget property.*`)
+
+	_, err = s.localdb.GroupUpdate(s.userctx, arvados.UpdateOptions{
+		UUID:            grp.UUID,
+		Attrs:           map[string]interface{}{"properties": map[string]interface{}{}},
+		MergeProperties: map[string]interface{}{"a": "b"},
+	})
+	c.Check(err, check.ErrorMatches, `.*cannot provide both.*`)
+}
+
+func (s *GroupSuite) TestBudgetPeriodStart(c *check.C) {
+	// Wednesday
+	t := time.Date(2024, 5, 15, 13, 14, 15, 0, time.FixedZone("X", -7*3600))
+	c.Check(budgetPeriodStart("monthly", t), check.Equals, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	c.Check(budgetPeriodStart("weekly", t), check.Equals, time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC))
+	c.Check(budgetPeriodStart("daily", t), check.Equals, time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC))
+	// Sunday evening in UTC-7 is Monday in UTC
+	t = time.Date(2024, 5, 19, 20, 0, 0, 0, time.FixedZone("X", -7*3600))
+	c.Check(budgetPeriodStart("weekly", t), check.Equals, time.Date(2024, 5, 20, 0, 0, 0, 0, time.UTC))
+}
@@ -194,8 +194,9 @@ func (rtr *router) transcode(src interface{}, dst interface{}) error {
 }
 
 var intParams = map[string]bool{
-	"limit":  true,
-	"offset": true,
+	"limit":      true,
+	"offset":     true,
+	"expires_in": true,
 }
 
 var boolParams = map[string]bool{
@@ -189,6 +189,13 @@ func (rtr *router) addRoutes() {
 				return rtr.backend.CollectionUntrash(ctx, *opts.(*arvados.UntrashOptions))
 			},
 		},
+		{
+			arvados.EndpointCollectionPresignedURL,
+			func() interface{} { return &arvados.PresignedURLOptions{} },
+			func(ctx context.Context, opts interface{}) (interface{}, error) {
+				return rtr.backend.CollectionPresignedURL(ctx, *opts.(*arvados.PresignedURLOptions))
+			},
+		},
 		{
 			arvados.EndpointComputedPermissionList,
 			func() interface{} { return &arvados.ListOptions{Limit: -1} },
@@ -414,6 +421,13 @@ func (rtr *router) addRoutes() {
 				return rtr.backend.GroupUntrash(ctx, *opts.(*arvados.UntrashOptions))
 			},
 		},
+		{
+			arvados.EndpointGroupBudget,
+			func() interface{} { return &arvados.GetOptions{} },
+			func(ctx context.Context, opts interface{}) (interface{}, error) {
+				return rtr.backend.GroupBudget(ctx, *opts.(*arvados.GetOptions))
+			},
+		},
 		{
 			arvados.EndpointLinkCreate,
 			func() interface{} { return &arvados.CreateOptions{} },
@@ -342,6 +342,13 @@ func (conn *Conn) CollectionUntrash(ctx context.Context, options arvados.Untrash
 	return resp, err
 }
 
+func (conn *Conn) CollectionPresignedURL(ctx context.Context, options arvados.PresignedURLOptions) (arvados.PresignedURL, error) {
+	ep := arvados.EndpointCollectionPresignedURL
+	var resp arvados.PresignedURL
+	err := conn.requestAndDecode(ctx, &resp, ep, nil, options)
+	return resp, err
+}
+
 func (conn *Conn) ComputedPermissionList(ctx context.Context, options arvados.ListOptions) (arvados.ComputedPermissionList, error) {
 	ep := arvados.EndpointComputedPermissionList
 	var resp arvados.ComputedPermissionList
@@ -632,6 +639,13 @@ func (conn *Conn) GroupUntrash(ctx context.Context, options arvados.UntrashOptio
 	return resp, err
 }
 
+func (conn *Conn) GroupBudget(ctx context.Context, options arvados.GetOptions) (arvados.GroupBudget, error) {
+	ep := arvados.EndpointGroupBudget
+	var resp arvados.GroupBudget
+	err := conn.requestAndDecode(ctx, &resp, ep, nil, options)
+	return resp, err
+}
+
 func (conn *Conn) LinkCreate(ctx context.Context, options arvados.CreateOptions) (arvados.Link, error) {
 	ep := arvados.EndpointLinkCreate
 	var resp arvados.Link
@@ -0,0 +1,249 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package crunchrun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+)
+
+// How long to keep a checkpoint collection before it is trashed. A
+// checkpoint is only used by the next attempt to run the same
+// container, which normally starts within minutes.
+const checkpointTTL = 7 * 24 * time.Hour
+
+// checkpointAndStop saves the state of the running container in a
+// new collection, stops the container, and adds the collection's
+// PDH to the container's runtime_status (along with the given
+// status fields) so the API server can restore the container from
+// the checkpoint when retrying it.
+//
+// The collection contains the checkpoint files saved by the
+// container runtime in "checkpoint/", and the contents of each
+// writable tmp mount in "mounts/{path}".
+//
+// If the container runtime fails to checkpoint the container, it is
+// left running, and an error is returned.
+func (runner *ContainerRunner) checkpointAndStop(status arvadosclient.Dict) error {
+	// Hold cStateLock until the checkpoint is saved, so the
+	// container is not stopped by a signal, and Run() does not
+	// finalize the container record, in the meantime.
+	runner.cStateLock.Lock()
+	defer runner.cStateLock.Unlock()
+	if !runner.cStarted {
+		return errors.New("container has not started")
+	} else if runner.cCancelled {
+		return errors.New("container is already stopping")
+	}
+	dir, err := runner.MkTempDir(runner.parentTemp, "checkpoint")
+	if err != nil {
+		return fmt.Errorf("error creating checkpoint temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	runner.CrunchLog.Printf("Checkpointing container")
+	err = runner.executor.Checkpoint(dir)
+	if err != nil {
+		return err
+	}
+	// The container has stopped. Even if we fail to save the
+	// checkpoint below, the container is now cancelled.
+	runner.cCancelled = true
+
+	cfs, err := (&arvados.Collection{}).FileSystem(runner.containerClient, runner.ContainerKeepClient)
+	if err != nil {
+		return err
+	}
+	err = copyDirToCollection(cfs, "checkpoint", dir, runner.CrunchLog)
+	if err != nil {
+		return fmt.Errorf("error saving checkpoint files: %w", err)
+	}
+	for _, mntpath := range runner.checkpointMounts() {
+		err = copyDirToCollection(cfs, "mounts"+mntpath, runner.bindmounts[mntpath].HostPath, runner.CrunchLog)
+		if err != nil {
+			return fmt.Errorf("error saving contents of %s: %w", mntpath, err)
+		}
+	}
+	txt, err := cfs.MarshalManifest(".")
+	if err != nil {
+		return err
+	}
+	var coll arvados.Collection
+	err = runner.ContainerArvClient.Create("collections", arvadosclient.Dict{
+		"ensure_unique_name": true,
+		"select":             []string{"uuid", "portable_data_hash"},
+		"collection": arvadosclient.Dict{
+			"name":          "checkpoint for " + runner.Container.UUID,
+			"manifest_text": txt,
+			"trash_at":      time.Now().Add(checkpointTTL).UTC().Format(time.RFC3339Nano),
+			"properties": arvadosclient.Dict{
+				"type":           "checkpoint",
+				"container_uuid": runner.Container.UUID,
+			},
+		},
+	}, &coll)
+	if err != nil {
+		return fmt.Errorf("error creating checkpoint collection: %w", err)
+	}
+	runner.CrunchLog.Printf("Saved checkpoint in collection %s (%s)", coll.UUID, coll.PortableDataHash)
+	newstatus := arvadosclient.Dict{"checkpoint": coll.PortableDataHash}
+	for k, v := range status {
+		newstatus[k] = v
+	}
+	runner.updateRuntimeStatus(newstatus)
+	return nil
+}
+
+// restoreCheckpoint copies the checkpoint saved by a previous attempt
+// to run the container (see checkpointAndStop) to the local
+// filesystem, and arranges for the container runtime to restore the
+// container from it when the container is started.
+//
+// Files saved from writable tmp mounts are copied into the
+// corresponding mount directories, except where a file already
+// exists (e.g., a literal file mounted inside the output directory).
+//
+// SetupMounts must be called first.
+func (runner *ContainerRunner) restoreCheckpoint() error {
+	pdh := runner.Container.SchedulingParameters.Checkpoint
+	runner.CrunchLog.Printf("Restoring container from checkpoint %s", pdh)
+	var coll arvados.Collection
+	err := runner.ContainerArvClient.Get("collections", pdh, nil, &coll)
+	if err != nil {
+		return fmt.Errorf("error getting checkpoint collection %s: %w", pdh, err)
+	}
+	cfs, err := coll.FileSystem(runner.containerClient, runner.ContainerKeepClient)
+	if err != nil {
+		return err
+	}
+	dir, err := runner.MkTempDir(runner.parentTemp, "checkpoint")
+	if err != nil {
+		return fmt.Errorf("error creating checkpoint temp dir: %w", err)
+	}
+	err = copyDirFromCollection(dir, cfs, "checkpoint")
+	if err != nil {
+		return fmt.Errorf("error copying checkpoint files: %w", err)
+	}
+	for _, mntpath := range runner.checkpointMounts() {
+		err = copyDirFromCollection(runner.bindmounts[mntpath].HostPath, cfs, "mounts"+mntpath)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Nothing was saved from this mount.
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error restoring contents of %s: %w", mntpath, err)
+		}
+	}
+	return runner.executor.Restore(dir)
+}
+
+// checkpointMounts returns the container paths of the writable tmp
+// mounts whose contents are saved in a checkpoint, in sorted order.
+func (runner *ContainerRunner) checkpointMounts() []string {
+	var paths []string
+	for mntpath, bind := range runner.bindmounts {
+		if runner.Container.Mounts[mntpath].Kind == "tmp" && !bind.ReadOnly {
+			paths = append(paths, mntpath)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// copyDirToCollection copies the directories and regular files in
+// srcdir on the local filesystem to dstdir in cfs. Other types of
+// files (e.g., symlinks) cannot be stored in a collection, and are
+// skipped.
+func copyDirToCollection(cfs arvados.CollectionFileSystem, dstdir, srcdir string, logger printfer) error {
+	for i := range dstdir {
+		if dstdir[i] == '/' {
+			if err := cfs.Mkdir(dstdir[:i], 0777); err != nil && !errors.Is(err, os.ErrExist) {
+				return err
+			}
+		}
+	}
+	return filepath.WalkDir(srcdir, func(src string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcdir, src)
+		if err != nil {
+			return err
+		}
+		dst := path.Join(dstdir, filepath.ToSlash(rel))
+		switch {
+		case d.IsDir():
+			if err := cfs.Mkdir(dst, 0777); err != nil && !errors.Is(err, os.ErrExist) {
+				return err
+			}
+			return nil
+		case d.Type().IsRegular():
+			return copyFileToCollection(cfs, dst, src)
+		default:
+			logger.Printf("checkpoint: skipping %s (not a regular file or directory)", src)
+			return nil
+		}
+	})
+}
+
+func copyFileToCollection(cfs arvados.CollectionFileSystem, dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := cfs.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyDirFromCollection copies srcdir in cfs to dstdir on the local
+// filesystem. Files that already exist in dstdir are left alone.
+func copyDirFromCollection(dstdir string, cfs arvados.CollectionFileSystem, srcdir string) error {
+	return fs.WalkDir(arvados.FS(cfs), srcdir, func(src string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dstdir, filepath.FromSlash(strings.TrimPrefix(src[len(srcdir):], "/")))
+		if d.IsDir() {
+			return os.MkdirAll(dst, 0777)
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			return nil
+		}
+		in, err := arvados.FS(cfs).Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
@@ -159,6 +159,11 @@ type ContainerRunner struct {
 
 	cStateLock sync.Mutex
 	cCancelled bool // StopContainer() invoked
+	cStarted   bool // StartContainer() succeeded
+
+	// Host paths of the container's mounts, as returned by
+	// SetupMounts(). Used when saving and restoring checkpoints.
+	bindmounts map[string]bindmount
 
 	enableMemoryLimit bool
 	enableNetwork     string // one of "default" or "always"
@@ -1056,6 +1061,7 @@ func (runner *ContainerRunner) StartContainer() error {
 		}
 		return fmt.Errorf("could not start container: %v%s", err, advice)
 	}
+	runner.cStarted = true
 	return nil
 }
 
@@ -1273,15 +1279,22 @@ func (runner *ContainerRunner) checkSpotInterruptionNotices() {
 			lastmetadata = metadata
 			text := fmt.Sprintf("Cloud provider scheduled instance %s at %s", metadata.Action, metadata.Time.UTC().Format(time.RFC3339))
 			runner.CrunchLog.Printf("%s", text)
-			runner.updateRuntimeStatus(arvadosclient.Dict{
+			status := arvadosclient.Dict{
 				"warning":          "preemption notice",
 				"warningDetail":    text,
 				"preemptionNotice": text,
-			})
+			}
+			runner.updateRuntimeStatus(status)
 			if proc, err := os.FindProcess(os.Getpid()); err == nil {
 				// trigger updateLogs
 				proc.Signal(syscall.SIGUSR1)
 			}
+			if runner.Container.SchedulingParameters.CheckpointOnInterruption {
+				err := runner.checkpointAndStop(status)
+				if err != nil {
+					runner.CrunchLog.Printf("Could not checkpoint container: %s", err)
+				}
+			}
 		}
 	}
 }
@@ -1720,6 +1733,7 @@ func (runner *ContainerRunner) Run() (err error) {
 		err = fmt.Errorf("While setting up mounts: %v", err)
 		return
 	}
+	runner.bindmounts = bindmounts
 
 	// check for and/or load image
 	imageID, err := runner.LoadImage()
@@ -1733,6 +1747,16 @@ func (runner *ContainerRunner) Run() (err error) {
 		return
 	}
 
+	if runner.Container.SchedulingParameters.Checkpoint != "" {
+		// If this fails, the container is cancelled, and the
+		// next attempt (if any) starts from the beginning.
+		err = runner.restoreCheckpoint()
+		if err != nil {
+			err = fmt.Errorf("error restoring checkpoint: %w", err)
+			return
+		}
+	}
+
 	err = runner.CreateContainer(imageID, bindmounts)
 	if err != nil {
 		return
@@ -2205,6 +2229,10 @@ func startLocalKeepstore(configData ConfigData, logbuf io.Writer) (*exec.Cmd, er
 		fmt.Fprint(logbuf, "not starting a local keepstore process because cluster config file was not loaded\n")
 		return nil, nil
 	}
+	if configData.Cluster.Collections.BalanceFullIndexInterval > 0 {
+		fmt.Fprint(logbuf, "not starting a local keepstore process because Collections.BalanceFullIndexInterval is non-zero (keep-balance relies on keepstore servers' change journals)\n")
+		return nil, nil
+	}
 	for uuid, vol := range configData.Cluster.Volumes {
 		if len(vol.AccessViaHosts) > 0 {
 			fmt.Fprintf(logbuf, "not starting a local keepstore process because a volume (%s) uses AccessViaHosts\n", uuid)
@@ -2225,6 +2253,7 @@ func startLocalKeepstore(configData ConfigData, logbuf io.Writer) (*exec.Cmd, er
 	ccfg.Collections.BlobTrash = false
 	ccfg.Collections.BlobTrashConcurrency = 0
 	ccfg.Collections.BlobDeleteConcurrency = 0
+	ccfg.Collections.BlobScrubInterval = 0
 
 	addrs, err := processIPs(os.Getpid())
 	if err != nil {
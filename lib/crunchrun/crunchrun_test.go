@@ -22,6 +22,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"regexp"
 	"runtime/pprof"
 	"strings"
@@ -123,6 +124,7 @@ type ArvTestClient struct {
 	Content []arvadosclient.Dict
 	arvados.Container
 	secretMounts []byte
+	manifests    map[string]string // pdh => manifest text returned by Get("collections", pdh)
 	sync.Mutex
 	WasSetRunning bool
 	callraw       bool
@@ -149,6 +151,10 @@ type stubExecutor struct {
 	closed      bool
 	runFunc     func() int
 	exit        chan int
+
+	checkpointErr error
+	checkpointed  bool
+	restored      []byte // content of checkpoint file passed to Restore
 }
 
 func (e *stubExecutor) LoadImage(imageId string, tarball string, container arvados.Container, keepMount string,
@@ -167,6 +173,23 @@ func (e *stubExecutor) Start() error {
 func (e *stubExecutor) Pid() int    { return 1115883 } // matches pid in ../crunchstat/testdata/debian12/proc/
 func (e *stubExecutor) Stop() error { e.stopped = true; go func() { e.exit <- -1 }(); return e.stopErr }
 func (e *stubExecutor) Close()      { e.closed = true }
+func (e *stubExecutor) Checkpoint(dir string) error {
+	if e.checkpointErr != nil {
+		return e.checkpointErr
+	}
+	err := os.WriteFile(filepath.Join(dir, "pages-1.img"), []byte("fake checkpoint"), 0600)
+	if err != nil {
+		return err
+	}
+	e.checkpointed = true
+	go func() { e.exit <- 0 }()
+	return nil
+}
+func (e *stubExecutor) Restore(dir string) error {
+	buf, err := os.ReadFile(filepath.Join(dir, "pages-1.img"))
+	e.restored = buf
+	return err
+}
 func (e *stubExecutor) Wait(context.Context) (int, error) {
 	return <-e.exit, e.waitErr
 }
@@ -285,6 +308,8 @@ func (client *ArvTestClient) Get(resourceType string, uuid string, parameters ar
 			output.(*arvados.Collection).ManifestText = normalizedManifestWithSubdirs
 		} else if uuid == denormalizedWithSubdirsPDH {
 			output.(*arvados.Collection).ManifestText = denormalizedManifestWithSubdirs
+		} else if mt, ok := client.manifests[uuid]; ok {
+			output.(*arvados.Collection).ManifestText = mt
 		}
 	}
 	if resourceType == "containers" {
@@ -703,7 +728,7 @@ func (s *TestSuite) fullRunHelper(c *C, record string, extraMounts []string, fn
 	}
 	client, _ := apiStub()
 	s.runner.MkArvClient = func(token string) (IArvadosClient, IKeepClient, *arvados.Client, error) {
-		return &ArvTestClient{secretMounts: secretMounts}, &s.testContainerKeepClient, client, nil
+		return &ArvTestClient{secretMounts: secretMounts, manifests: s.api.manifests}, &s.testContainerKeepClient, client, nil
 	}
 
 	if extraMounts != nil && len(extraMounts) > 0 {
@@ -905,6 +930,120 @@ func (s *TestSuite) testSpotInterruptionNotice(c *C, failureRate float64) {
 	c.Check(checkedLogs, Equals, true)
 }
 
+func (s *TestSuite) TestCheckpointAndStop(c *C) {
+	checkpointErr := make(chan error, 1)
+	s.fullRunHelper(c, `{
+    "command": ["sleep", "10"],
+    "container_image": "`+arvadostest.DockerImage112PDH+`",
+    "cwd": ".",
+    "environment": {},
+    "mounts": {"/tmp": {"kind": "tmp"} },
+    "output_path": "/tmp",
+    "priority": 1,
+    "runtime_constraints": {},
+    "scheduling_parameters": {"checkpoint_on_interruption": true},
+    "state": "Locked"
+}`, nil, func() int {
+		os.WriteFile(s.runner.HostOutputDir+"/partial.txt", []byte("partial output"), 0666)
+		go func() {
+			checkpointErr <- s.runner.checkpointAndStop(arvadosclient.Dict{"warning": "preemption notice"})
+		}()
+		// If the checkpoint succeeds, the container exits
+		// before this returns.
+		time.Sleep(5 * time.Second)
+		return 0
+	})
+
+	c.Check(<-checkpointErr, IsNil)
+	c.Check(s.executor.checkpointed, Equals, true)
+	c.Check(s.api.CalledWith("container.state", "Cancelled"), NotNil)
+	c.Check(s.api.CalledWith("container.state", "Complete"), IsNil)
+
+	ckpt := s.runner.ContainerArvClient.(*ArvTestClient).CalledWith("collection.name", "checkpoint for "+s.runner.Container.UUID)
+	c.Assert(ckpt, NotNil)
+	coll := ckpt["collection"].(arvadosclient.Dict)
+	c.Check(coll["properties"].(arvadosclient.Dict)["type"], Equals, "checkpoint")
+	c.Check(coll["trash_at"], NotNil)
+	mt := coll["manifest_text"].(string)
+	c.Check(mt, Matches, `(?ms)^\./checkpoint \S+ 0:15:pages-1\.img$.*`)
+	c.Check(mt, Matches, `(?ms).*^\./mounts/tmp \S+ 0:14:partial\.txt$.*`)
+
+	pdh := fmt.Sprintf("%x+%d", md5.Sum([]byte(mt)), len(mt))
+	status := s.api.CalledWith("container.runtime_status.checkpoint", pdh)
+	c.Assert(status, NotNil)
+	c.Check(status["container"].(arvadosclient.Dict)["runtime_status"].(arvadosclient.Dict)["warning"], Equals, "preemption notice")
+	c.Check(logFileContent(c, s.runner, "crunch-run.txt"), Matches, `(?ms).*Saved checkpoint in collection .*`)
+}
+
+func (s *TestSuite) TestCheckpointNotSupported(c *C) {
+	var checkpointErr error
+	s.executor.checkpointErr = errCheckpointNotSupported
+	s.fullRunHelper(c, `{
+    "command": ["sleep", "3"],
+    "container_image": "`+arvadostest.DockerImage112PDH+`",
+    "cwd": ".",
+    "environment": {},
+    "mounts": {"/tmp": {"kind": "tmp"} },
+    "output_path": "/tmp",
+    "priority": 1,
+    "runtime_constraints": {},
+    "scheduling_parameters": {"checkpoint_on_interruption": true},
+    "state": "Locked"
+}`, nil, func() int {
+		checkpointErr = s.runner.checkpointAndStop(arvadosclient.Dict{"warning": "preemption notice"})
+		return 0
+	})
+
+	// The container keeps running, and completes normally.
+	c.Check(checkpointErr, Equals, errCheckpointNotSupported)
+	c.Check(s.api.CalledWith("container.state", "Complete"), NotNil)
+	c.Check(s.api.CalledWith("container.runtime_status.warning", "preemption notice"), IsNil)
+}
+
+func (s *TestSuite) TestRestoreFromCheckpoint(c *C) {
+	cfs, err := (&arvados.Collection{}).FileSystem(s.client, &s.testContainerKeepClient)
+	c.Assert(err, IsNil)
+	for _, dir := range []string{"checkpoint", "mounts", "mounts/tmp"} {
+		c.Assert(cfs.Mkdir(dir, 0777), IsNil)
+	}
+	for fnm, data := range map[string]string{
+		"checkpoint/pages-1.img": "fake checkpoint",
+		"mounts/tmp/partial.txt": "partial output",
+	} {
+		f, err := cfs.OpenFile(fnm, os.O_CREATE|os.O_WRONLY, 0666)
+		c.Assert(err, IsNil)
+		_, err = f.Write([]byte(data))
+		c.Assert(err, IsNil)
+		c.Assert(f.Close(), IsNil)
+	}
+	mt, err := cfs.MarshalManifest(".")
+	c.Assert(err, IsNil)
+	pdh := arvados.PortableDataHash(mt)
+	s.api.manifests = map[string]string{pdh: mt}
+
+	var partial []byte
+	s.fullRunHelper(c, `{
+    "command": ["sleep", "1"],
+    "container_image": "`+arvadostest.DockerImage112PDH+`",
+    "cwd": ".",
+    "environment": {},
+    "mounts": {"/tmp": {"kind": "tmp"} },
+    "output_path": "/tmp",
+    "priority": 1,
+    "runtime_constraints": {},
+    "scheduling_parameters": {"checkpoint_on_interruption": true, "checkpoint": "`+pdh+`"},
+    "state": "Locked"
+}`, nil, func() int {
+		partial, _ = os.ReadFile(s.runner.HostOutputDir + "/partial.txt")
+		return 0
+	})
+
+	c.Check(string(s.executor.restored), Equals, "fake checkpoint")
+	c.Check(string(partial), Equals, "partial output")
+	c.Check(s.api.CalledWith("container.state", "Complete"), NotNil)
+	c.Check(logFileContent(c, s.runner, "crunch-run.txt"), Matches, `(?ms).*Restoring container from checkpoint `+regexp.QuoteMeta(pdh)+`.*`)
+}
+
 func (s *TestSuite) TestRunTimeExceeded(c *C) {
 	s.fullRunHelper(c, `{
     "command": ["sleep", "3"],
@@ -2389,6 +2528,16 @@ func (s *TestSuite) TestSIGUSR2CostUpdate(c *C) {
 	c.Check(fmt.Sprintf("%.3f", costUpdates[1]), Equals, "7.600")
 }
 
+func (s *TestSuite) TestNoLocalKeepstoreWithIncrementalIndex(c *C) {
+	cluster := &arvados.Cluster{}
+	cluster.Collections.BalanceFullIndexInterval = arvados.Duration(24 * time.Hour)
+	var logbuf bytes.Buffer
+	cmd, err := startLocalKeepstore(ConfigData{KeepBuffers: 1, Cluster: cluster}, &logbuf)
+	c.Check(err, IsNil)
+	c.Check(cmd, IsNil)
+	c.Check(logbuf.String(), Matches, `not starting a local keepstore process because Collections.BalanceFullIndexInterval is non-zero .*\n`)
+}
+
 func (s *TestSuite) TestLocalKeepstoreAddr(c *C) {
 	c.Check(localKeepstoreAddr(nil), Equals, "0.0.0.0")
 
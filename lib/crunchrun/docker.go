@@ -10,6 +10,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
@@ -18,6 +19,7 @@ import (
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/docker/docker/api/types/checkpoint"
 	dockercontainer "github.com/docker/docker/api/types/container"
 	dockerclient "github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/jsonmessage"
@@ -32,6 +34,11 @@ const minDockerRAM = int64(16 * 1024 * 1024)
 // https://docs.docker.com/reference/api/engine/.
 const DockerAPIVersion = "1.48"
 
+// Checkpoint name used by Checkpoint and Restore. Each checkpoint is
+// saved in its own directory, so there is no need to distinguish
+// between checkpoints by name.
+const dockerCheckpointID = "crunch-run"
+
 // Number of consecutive "inspect container" failures before
 // concluding Docker is unresponsive, giving up, and cancelling the
 // container.
@@ -46,6 +53,7 @@ type dockerExecutor struct {
 	savedIPAddress   atomic.Value
 	doneIO           chan struct{}
 	errIO            error
+	restoreDir       string // if non-empty, Start restores from checkpoint in this dir
 }
 
 func newDockerExecutor(containerUUID string, logf func(string, ...interface{}), watchdogInterval time.Duration) (*dockerExecutor, error) {
@@ -280,7 +288,35 @@ func (e *dockerExecutor) Pid() int {
 }
 
 func (e *dockerExecutor) Start() error {
-	return e.dockerclient.ContainerStart(context.TODO(), e.containerID, dockercontainer.StartOptions{})
+	opts := dockercontainer.StartOptions{}
+	if e.restoreDir != "" {
+		opts.CheckpointID = dockerCheckpointID
+		opts.CheckpointDir = e.restoreDir
+	}
+	return e.dockerclient.ContainerStart(context.TODO(), e.containerID, opts)
+}
+
+// Checkpoint uses "docker checkpoint create" to save the container's
+// state in dir. This requires the docker daemon to have experimental
+// features enabled, and CRIU to be installed.
+func (e *dockerExecutor) Checkpoint(dir string) error {
+	err := e.dockerclient.CheckpointCreate(context.TODO(), e.containerID, checkpoint.CreateOptions{
+		CheckpointID:  dockerCheckpointID,
+		CheckpointDir: dir,
+		Exit:          true,
+	})
+	if err != nil {
+		return fmt.Errorf("docker checkpoint create: %w", err)
+	}
+	return nil
+}
+
+func (e *dockerExecutor) Restore(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, dockerCheckpointID)); err != nil {
+		return err
+	}
+	e.restoreDir = dir
+	return nil
 }
 
 func (e *dockerExecutor) Stop() error {
@@ -5,11 +5,14 @@ package crunchrun
 
 import (
 	"context"
+	"errors"
 	"io"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 )
 
+var errCheckpointNotSupported = errors.New("container runtime does not support checkpoint/restore")
+
 type bindmount struct {
 	HostPath string
 	ReadOnly bool
@@ -59,6 +62,19 @@ type containerExecutor interface {
 	// Stop the container immediately
 	Stop() error
 
+	// Checkpoint saves the state of the running container's
+	// processes in dir (using CRIU) and stops the container.
+	// Returns errCheckpointNotSupported if the runtime engine
+	// cannot checkpoint containers.
+	Checkpoint(dir string) error
+
+	// Restore arranges for the next call to Start to restore the
+	// container's processes from a checkpoint previously saved in
+	// dir by Checkpoint, instead of running the command from the
+	// beginning. Returns errCheckpointNotSupported if the runtime
+	// engine cannot restore containers.
+	Restore(dir string) error
+
 	// Release resources (temp dirs, stopped containers)
 	Close()
 
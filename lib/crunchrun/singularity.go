@@ -495,6 +495,14 @@ func (e *singularityExecutor) Stop() error {
 	return e.child.Process.Signal(syscall.SIGKILL)
 }
 
+func (e *singularityExecutor) Checkpoint(dir string) error {
+	return errCheckpointNotSupported
+}
+
+func (e *singularityExecutor) Restore(dir string) error {
+	return errCheckpointNotSupported
+}
+
 func (e *singularityExecutor) Wait(context.Context) (int, error) {
 	err := e.child.Wait()
 	if err, ok := err.(*exec.ExitError); ok {
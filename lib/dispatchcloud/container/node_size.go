@@ -172,11 +172,33 @@ func versionLess(vs1 string, vs2 string) (bool, error) {
 //
 // The error is non-nil if and only if the returned slice is empty.
 func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) ([]arvados.InstanceType, error) {
+	return chooseInstanceType(cc, ctr, math.Max(cc.Containers.MaximumPriceFactor, 1))
+}
+
+// CompatibleInstanceTypes returns all of the arvados.InstanceTypes
+// that can run ctr, regardless of price, sorted with lower prices
+// first.
+//
+// The error is non-nil if and only if the returned slice is empty.
+func CompatibleInstanceTypes(cc *arvados.Cluster, ctr *arvados.Container) ([]arvados.InstanceType, error) {
+	return chooseInstanceType(cc, ctr, 0)
+}
+
+// chooseInstanceType returns the instance types that can run ctr and
+// cost no more than maxPriceFactor times the cheapest such type. If
+// maxPriceFactor is zero, there is no price limit.
+func chooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container, maxPriceFactor float64) ([]arvados.InstanceType, error) {
 	if len(cc.InstanceTypes) == 0 {
 		return nil, ErrInstanceTypesNotConfigured
 	}
 	need := InstanceResourcesNeeded(cc, ctr)
-	maxPriceFactor := math.Max(cc.Containers.MaximumPriceFactor, 1)
+	preemptible := ctr.SchedulingParameters.Preemptible
+	if max := cc.Containers.MaxPreemptibleInterruptions; max > 0 && ctr.SchedulingParameters.PreemptibleInterruptions >= max {
+		// The API server normally clears the preemptible flag
+		// when it retries such a container, but the limit may
+		// have been lowered since then.
+		preemptible = false
+	}
 	var types []arvados.InstanceType
 	var maxPrice float64
 	for _, it := range cc.InstanceTypes {
@@ -217,7 +239,7 @@ func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) ([]arvados.
 		case it.Scratch < need.Scratch: // insufficient scratch
 		case it.RAM < need.RAM: // insufficient RAM
 		case it.VCPUs < need.VCPUs: // insufficient VCPUs
-		case it.Preemptible != ctr.SchedulingParameters.Preemptible: // wrong preemptable setting
+		case it.Preemptible != preemptible: // wrong preemptable setting
 		case it.GPU.Stack != ctr.RuntimeConstraints.GPU.Stack: // incompatible GPU software stack (or none available)
 		case it.GPU.DeviceCount < ctr.RuntimeConstraints.GPU.DeviceCount: // insufficient GPU devices
 		case int64(it.GPU.VRAM) < ctr.RuntimeConstraints.GPU.VRAM: // insufficient VRAM per GPU
@@ -227,6 +249,9 @@ func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) ([]arvados.
 		default:
 			// Didn't reject the node, so select it
 			types = append(types, it)
+			if maxPriceFactor == 0 {
+				continue
+			}
 			if newmax := it.Price * maxPriceFactor; newmax < maxPrice || maxPrice == 0 {
 				maxPrice = newmax
 			}
@@ -269,7 +294,7 @@ func ChooseInstanceType(cc *arvados.Cluster, ctr *arvados.Container) ([]arvados.
 	// in the loop above, but at that point maxPrice wasn't
 	// necessarily the final (lowest) maxPrice.
 	for i, it := range types {
-		if i > 0 && it.Price > maxPrice {
+		if i > 0 && maxPrice > 0 && it.Price > maxPrice {
 			types = types[:i]
 			break
 		}
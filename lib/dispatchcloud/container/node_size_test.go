@@ -140,6 +140,40 @@ func (*NodeSizeSuite) TestMaximumPriceFactor(c *check.C) {
 	c.Check(best[4].Name, check.Equals, "best+5") // max price is $2 * 1.5 = $3
 }
 
+func (*NodeSizeSuite) TestCompatibleInstanceTypes(c *check.C) {
+	menu := map[string]arvados.InstanceType{
+		"huge":   {Price: 8.0, RAM: 64000000000, VCPUs: 32, Scratch: 64 * GiB, Name: "huge"},
+		"large":  {Price: 4.0, RAM: 16000000000, VCPUs: 8, Scratch: 64 * GiB, Name: "large"},
+		"medium": {Price: 2.0, RAM: 8000000000, VCPUs: 4, Scratch: 16 * GiB, Name: "medium"},
+		"small":  {Price: 1.0, RAM: 2000000000, VCPUs: 2, Scratch: 16 * GiB, Name: "small"},
+		"tiny":   {Price: 0.5, RAM: 1000000000, VCPUs: 1, Scratch: 16 * GiB, Name: "tiny"},
+		"spot":   {Price: 0.3, RAM: 64000000000, VCPUs: 32, Scratch: 64 * GiB, Name: "spot", Preemptible: true},
+	}
+	cluster := &arvados.Cluster{InstanceTypes: menu, Containers: arvados.ContainersConfig{
+		MaximumPriceFactor: 1.5,
+	}}
+	ctr := &arvados.Container{
+		RuntimeConstraints: arvados.RuntimeConstraints{
+			VCPUs: 2,
+			RAM:   1000000000,
+		},
+	}
+	types, err := ChooseInstanceType(cluster, ctr)
+	c.Assert(err, check.IsNil)
+	c.Check(types, check.HasLen, 1)
+	types, err = CompatibleInstanceTypes(cluster, ctr)
+	c.Assert(err, check.IsNil)
+	var names []string
+	for _, it := range types {
+		names = append(names, it.Name)
+	}
+	c.Check(names, check.DeepEquals, []string{"small", "medium", "large", "huge"})
+
+	ctr.RuntimeConstraints.VCPUs = 64
+	_, err = CompatibleInstanceTypes(cluster, ctr)
+	c.Check(err, check.FitsTypeOf, ConstraintsNotSatisfiableError{})
+}
+
 func (*NodeSizeSuite) TestChooseWithBlobBuffersOverhead(c *check.C) {
 	menu := map[string]arvados.InstanceType{
 		"nearly": {Price: 2.2, RAM: 4000000000, VCPUs: 4, Scratch: 2 * GiB, Name: "small"},
@@ -193,6 +227,39 @@ func (*NodeSizeSuite) TestChoosePreemptible(c *check.C) {
 	c.Check(best[0].Preemptible, check.Equals, true)
 }
 
+func (*NodeSizeSuite) TestPreemptibleFallback(c *check.C) {
+	menu := map[string]arvados.InstanceType{
+		"ondemand": {Price: 2.2, RAM: 2000000000, VCPUs: 4, Scratch: 2 * GiB, Name: "ondemand"},
+		"spot":     {Price: 1.1, RAM: 2000000000, VCPUs: 4, Scratch: 2 * GiB, Preemptible: true, Name: "spot"},
+	}
+	ctr := &arvados.Container{
+		RuntimeConstraints: arvados.RuntimeConstraints{
+			VCPUs: 2,
+			RAM:   987654321,
+		},
+		SchedulingParameters: arvados.SchedulingParameters{
+			Preemptible:              true,
+			PreemptibleInterruptions: 2,
+		},
+	}
+	for _, trial := range []struct {
+		maxInterruptions int
+		expect           string
+	}{
+		{0, "spot"},
+		{3, "spot"},
+		{2, "ondemand"},
+		{1, "ondemand"},
+	} {
+		cluster := &arvados.Cluster{InstanceTypes: menu}
+		cluster.Containers.MaxPreemptibleInterruptions = trial.maxInterruptions
+		best, err := ChooseInstanceType(cluster, ctr)
+		c.Check(err, check.IsNil)
+		c.Assert(best, check.HasLen, 1)
+		c.Check(best[0].Name, check.Equals, trial.expect, check.Commentf("MaxPreemptibleInterruptions %d", trial.maxInterruptions))
+	}
+}
+
 func (*NodeSizeSuite) TestScratchForDockerImage(c *check.C) {
 	n := EstimateScratchSpace(&arvados.Container{
 		ContainerImage: "d5025c0f29f6eef304a7358afa82a822+342",
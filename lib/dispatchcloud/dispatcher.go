@@ -38,6 +38,7 @@ type pool interface {
 	scheduler.WorkerPool
 	CheckHealth() error
 	Instances() []worker.InstanceView
+	InstanceTypePrices() []worker.InstanceTypePriceView
 	SetIdleBehavior(cloud.InstanceID, worker.IdleBehavior) error
 	KillInstance(id cloud.InstanceID, reason string) error
 	Stop()
@@ -174,6 +175,7 @@ func (disp *dispatcher) initialize() {
 		mux.HandlerFunc("POST", "/arvados/v1/dispatch/instances/drain", disp.apiInstanceDrain)
 		mux.HandlerFunc("POST", "/arvados/v1/dispatch/instances/run", disp.apiInstanceRun)
 		mux.HandlerFunc("POST", "/arvados/v1/dispatch/instances/kill", disp.apiInstanceKill)
+		mux.HandlerFunc("GET", "/arvados/v1/dispatch/instance_types", disp.apiInstanceTypes)
 		metricsH := promhttp.HandlerFor(disp.Registry, promhttp.HandlerOpts{
 			ErrorLog: disp.logger,
 		})
@@ -250,6 +252,16 @@ func (disp *dispatcher) apiInstances(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// Management API: configured and current prices of all instance
+// types.
+func (disp *dispatcher) apiInstanceTypes(w http.ResponseWriter, r *http.Request) {
+	var resp struct {
+		Items []worker.InstanceTypePriceView `json:"items"`
+	}
+	resp.Items = disp.pool.InstanceTypePrices()
+	json.NewEncoder(w).Encode(resp)
+}
+
 // Management API: set idle behavior to "hold" for specified instance.
 func (disp *dispatcher) apiInstanceHold(w http.ResponseWriter, r *http.Request) {
 	disp.apiInstanceIdleBehavior(w, r, worker.IdleBehaviorHold)
@@ -331,6 +331,88 @@ func (s *DispatcherSuite) TestDispatchToStubDriver(c *check.C) {
 	c.Check(resp.Body.String(), check.Matches, `(?ms).*max_concurrent_containers [1-9][0-9e+.]*`)
 }
 
+// TestBinPackingStubDriver checks that, with BinPacking enabled, the
+// dispatcher runs a queue of small containers on fewer, larger
+// instances when that is cheaper.
+func (s *DispatcherSuite) TestBinPackingStubDriver(c *check.C) {
+	Drivers["test"] = s.stubDriver
+	s.cluster.Containers.CloudVMs.BinPacking = true
+	s.cluster.Containers.MaximumPriceFactor = 1
+	small, large := test.InstanceType(1), test.InstanceType(4)
+	// A large instance costs less than two small instances.
+	large.Price = small.Price * 1.8
+	s.cluster.InstanceTypes = arvados.InstanceTypeMap{
+		small.Name: small,
+		large.Name: large,
+	}
+	queue := &test.Queue{
+		ChooseType: func(ctr *arvados.Container) ([]arvados.InstanceType, error) {
+			return container.ChooseInstanceType(s.cluster, ctr)
+		},
+		Logger: ctxlog.TestLogger(c),
+	}
+	const n = 8
+	for i := 0; i < n; i++ {
+		queue.Containers = append(queue.Containers, arvados.Container{
+			UUID:     test.ContainerUUID(i + 1),
+			State:    arvados.ContainerStateQueued,
+			Priority: int64(100 - i),
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				RAM:   1 << 30,
+				VCPUs: 1,
+			},
+		})
+	}
+	s.disp.queue = queue
+	s.disp.setupOnce.Do(s.disp.initialize)
+
+	var mtx sync.Mutex
+	done := make(chan struct{})
+	waiting := map[string]struct{}{}
+	for _, ctr := range queue.Containers {
+		waiting[ctr.UUID] = struct{}{}
+	}
+	created := map[string]int{}
+	s.stubDriver.Queue = queue
+	s.stubDriver.SetupVM = func(stubvm *test.StubVM) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		created[stubvm.Instance().ProviderType()]++
+		stubvm.Boot = time.Now().Add(time.Millisecond)
+		stubvm.ExtraCrunchRunArgs = "'--runtime-engine=stub' '--foo' '--extra='\\''args'\\'''"
+		stubvm.ExecuteContainer = func(ctr arvados.Container) int {
+			mtx.Lock()
+			defer mtx.Unlock()
+			if _, ok := waiting[ctr.UUID]; ok {
+				delete(waiting, ctr.UUID)
+				if len(waiting) == 0 {
+					close(done)
+				}
+			}
+			return 0
+		}
+		return nil
+	}
+	s.stubDriver.Bugf = c.Errorf
+
+	go s.disp.run()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		mtx.Lock()
+		defer mtx.Unlock()
+		c.Fatalf("timed out waiting for %d containers: %q", len(waiting), waiting)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	c.Logf("created instances: %v", created)
+	c.Check(created[large.ProviderType] > 0, check.Equals, true)
+	c.Check(created[small.ProviderType]+created[large.ProviderType] < n, check.Equals, true)
+	cost := float64(created[small.ProviderType])*small.Price + float64(created[large.ProviderType])*large.Price
+	c.Check(cost < n*small.Price, check.Equals, true)
+}
+
 func (s *DispatcherSuite) TestManagementAPI_Permissions(c *check.C) {
 	s.cluster.ManagementToken = "abcdefgh"
 	Drivers["test"] = s.stubDriver
@@ -539,6 +621,56 @@ func (s *DispatcherSuite) TestManagementAPI_Instances(c *check.C) {
 	c.Check(sr.Items[0].IdleBehavior, check.Equals, "run")
 }
 
+func (s *DispatcherSuite) TestManagementAPI_InstanceTypes(c *check.C) {
+	s.cluster.ManagementToken = "abcdefgh"
+	s.cluster.InstanceTypes = arvados.InstanceTypeMap{
+		test.InstanceType(1).Name: test.InstanceType(1),
+		test.InstanceType(2).Name: test.InstanceType(2),
+	}
+	s.stubDriver.InstanceTypePrices = map[string]float64{test.InstanceType(2).Name: 0.1}
+	Drivers["test"] = s.stubDriver
+	s.disp.setupOnce.Do(s.disp.initialize)
+	go s.disp.run()
+	defer s.disp.Close()
+
+	type zonePrice struct {
+		Zone  string
+		Price float64
+	}
+	type instanceType struct {
+		ArvadosInstanceType string      `json:"arvados_instance_type"`
+		ConfiguredPrice     float64     `json:"configured_price"`
+		CurrentPrice        float64     `json:"current_price"`
+		Zones               []zonePrice `json:"zones"`
+	}
+	var sr struct {
+		Items []instanceType
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		req := httptest.NewRequest("GET", "/arvados/v1/dispatch/instance_types", nil)
+		req.Header.Set("Authorization", "Bearer abcdefgh")
+		resp := httptest.NewRecorder()
+		s.disp.ServeHTTP(resp, req)
+		c.Check(resp.Code, check.Equals, http.StatusOK)
+		err := json.Unmarshal(resp.Body.Bytes(), &sr)
+		c.Check(err, check.IsNil)
+		if len(sr.Items) == 2 && len(sr.Items[0].Zones) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.Fatalf("timed out waiting for current prices: %+v", sr)
+		}
+	}
+	// The type with the lowest current price is listed first.
+	c.Check(sr.Items[0].ArvadosInstanceType, check.Equals, test.InstanceType(2).Name)
+	c.Check(sr.Items[0].ConfiguredPrice, check.Equals, test.InstanceType(2).Price)
+	c.Check(sr.Items[0].CurrentPrice, check.Equals, 0.1)
+	c.Check(sr.Items[0].Zones, check.DeepEquals, []zonePrice{{Zone: "stub-zone", Price: 0.1}})
+	c.Check(sr.Items[1].ArvadosInstanceType, check.Equals, test.InstanceType(1).Name)
+	c.Check(sr.Items[1].CurrentPrice, check.Equals, test.InstanceType(1).Price)
+	c.Check(sr.Items[1].Zones, check.HasLen, 0)
+}
+
 func (s *DispatcherSuite) TestManagementCommand_Instances(c *check.C) {
 	s.cluster.ManagementToken = "abcdefgh"
 	Drivers["test"] = s.stubDriver
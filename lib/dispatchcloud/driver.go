@@ -11,6 +11,7 @@ import (
 	"git.arvados.org/arvados.git/lib/cloud"
 	"git.arvados.org/arvados.git/lib/cloud/azure"
 	"git.arvados.org/arvados.git/lib/cloud/ec2"
+	"git.arvados.org/arvados.git/lib/cloud/gce"
 	"git.arvados.org/arvados.git/lib/cloud/loopback"
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"github.com/prometheus/client_golang/prometheus"
@@ -24,6 +25,7 @@ import (
 var Drivers = map[string]cloud.Driver{
 	"azure":    azure.Driver,
 	"ec2":      ec2.Driver,
+	"gce":      gce.Driver,
 	"loopback": loopback.Driver,
 }
 
@@ -0,0 +1,143 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"time"
+
+	"git.arvados.org/arvados.git/lib/dispatchcloud/container"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/worker"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Maximum number of queue entries (after the one that needs a new
+// instance) that packInstanceType considers packing onto the same
+// instance.
+const packLookahead = 100
+
+// Ignore price differences smaller than this, so rounding errors
+// don't cause us to choose a larger instance type when there is no
+// real saving.
+const packMinSavings = 1e-6
+
+// packInstanceType returns the instance type to create for
+// sorted[i], given that it is the cheapest type that is eligible and
+// available.
+//
+// If a larger instance type can also run some of the containers that
+// follow sorted[i] in the queue, and currently costs less than running
+// each of them on its own cheapest eligible type, packInstanceType returns
+// the larger type that saves the most, along with the UUIDs of the
+// containers (including sorted[i]) that it would run. Otherwise, it
+// returns the given type and a nil slice.
+//
+// Containers are only packed if they would otherwise need a new
+// instance, i.e., none of the given instances (with the given
+// remaining resources) can accommodate them.
+func (sch *Scheduler) packInstanceType(sorted []QueueEnt, i int, it arvados.InstanceType, instances []worker.InstanceView, instanceResources []container.InstanceResources, running map[string]time.Time) (arvados.InstanceType, []string) {
+	candidates, err := container.CompatibleInstanceTypes(sch.cluster, &sorted[i].Container)
+	if err != nil {
+		return it, nil
+	}
+	maxPerInstance := sch.cluster.Containers.CloudVMs.MaxRunningContainersPerInstance
+	// compatible[uuid] is the set of instance types that can run
+	// the container, regardless of price. It is populated as
+	// needed.
+	compatible := map[string]map[string]bool{}
+	isCompatible := func(ent *QueueEnt, typeName string) bool {
+		types, ok := compatible[ent.Container.UUID]
+		if !ok {
+			types = map[string]bool{}
+			cts, _ := container.CompatibleInstanceTypes(sch.cluster, &ent.Container)
+			for _, ct := range cts {
+				types[ct.Name] = true
+			}
+			compatible[ent.Container.UUID] = types
+		}
+		return types[typeName]
+	}
+	// fitsExisting returns true if ent can run on an instance
+	// that already exists (or is already being created).
+	fitsExisting := func(ent *QueueEnt) bool {
+		for k, inst := range instances {
+			if inst.IdleBehavior != worker.IdleBehaviorRun || inst.WorkerState == worker.StateShutdown {
+				continue
+			}
+			for _, et := range ent.InstanceTypes {
+				if et.Name == inst.ArvadosInstanceType && instanceResources[k].Accommodates(ent.InstanceResources) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	itPrice := sch.pool.CurrentPrice(it)
+	best, bestPacked, bestSavings := it, []string(nil), packMinSavings
+	for _, candidate := range candidates {
+		candidatePrice := sch.pool.CurrentPrice(candidate)
+		if candidatePrice <= itPrice || sch.pool.AtCapacity(candidate) {
+			continue
+		}
+		remaining := instanceResourcesForInstanceType(candidate).Sub(sorted[i].InstanceResources)
+		packed := []string{sorted[i].Container.UUID}
+		separately := itPrice
+		for j := i + 1; j < len(sorted) && j <= i+packLookahead; j++ {
+			if maxPerInstance > 0 && len(packed) >= maxPerInstance {
+				break
+			}
+			ent := &sorted[j]
+			if !sch.packable(ent, running) ||
+				!remaining.Accommodates(ent.InstanceResources) ||
+				!isCompatible(ent, candidate.Name) ||
+				fitsExisting(ent) {
+				continue
+			}
+			remaining = remaining.Sub(ent.InstanceResources)
+			packed = append(packed, ent.Container.UUID)
+			separately += sch.pool.CurrentPrice(ent.InstanceTypes[0])
+		}
+		if savings := separately - candidatePrice; len(packed) > 1 && savings > bestSavings {
+			best, bestPacked, bestSavings = candidate, packed, savings
+		}
+	}
+	return best, bestPacked
+}
+
+// packable returns true if ent is a container that could be started
+// on an instance created for a different container.
+func (sch *Scheduler) packable(ent *QueueEnt, running map[string]time.Time) bool {
+	ctr := &ent.Container
+	if _, ok := running[ctr.UUID]; ok {
+		return false
+	}
+	if ctr.Priority < 1 || len(ent.InstanceTypes) == 0 {
+		return false
+	}
+	if ctr.State != arvados.ContainerStateQueued && ctr.State != arvados.ContainerStateLocked {
+		return false
+	}
+	if ctr.SchedulingParameters.GangID != "" {
+		// Gang members are started together, so they
+		// shouldn't hold up other containers' instances.
+		return false
+	}
+	if sch.budgets != nil {
+		if _, hold := sch.budgets.hold(ctr); hold {
+			return false
+		}
+	}
+	return true
+}
+
+// prunePackedTypes forgets the packed instance types of containers
+// that are no longer in the queue.
+func (sch *Scheduler) prunePackedTypes(ents map[string]container.QueueEnt) {
+	for uuid := range sch.packedTypes {
+		if _, ok := ents[uuid]; !ok {
+			delete(sch.packedTypes, uuid)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"context"
+
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&BinPackSuite{})
+
+type BinPackSuite struct {
+	SchedulerSuite
+}
+
+// Enable bin-packing, and use an instance type menu where larger
+// instances are cheaper per container.
+func (s *BinPackSuite) enableBinPacking() {
+	s.testCluster.Containers.CloudVMs.BinPacking = true
+	// A medium instance costs less than two small instances, and
+	// a large instance costs less than four.
+	s.testCluster.InstanceTypes = arvados.InstanceTypeMap{
+		"small":  {Name: "small", ProviderType: "p-small", VCPUs: 1, RAM: 11 << 30 / 10, Scratch: 4 << 30, Price: 1},
+		"medium": {Name: "medium", ProviderType: "p-medium", VCPUs: 2, RAM: 22 << 30 / 10, Scratch: 8 << 30, Price: 1.8},
+		"large":  {Name: "large", ProviderType: "p-large", VCPUs: 4, RAM: 44 << 30 / 10, Scratch: 16 << 30, Price: 3},
+	}
+}
+
+// Return a queue with n locked containers that each fit on a small
+// instance.
+func (s *BinPackSuite) setupQueue(n int) *test.Queue {
+	s.enableBinPacking()
+	queue := &test.Queue{ChooseType: s.chooseType}
+	for i := 1; i <= n; i++ {
+		queue.Containers = append(queue.Containers, arvados.Container{
+			UUID:     test.ContainerUUID(i),
+			Priority: int64(100 - i),
+			State:    arvados.ContainerStateLocked,
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: 1,
+				RAM:   1 << 30,
+			},
+		})
+	}
+	queue.Update()
+	return queue
+}
+
+func (s *BinPackSuite) createdTypes(pool *stubPool) []string {
+	var names []string
+	for _, it := range pool.creates {
+		names = append(names, it.Name)
+	}
+	return names
+}
+
+// Four containers are packed onto one large instance, and started
+// when it is ready.
+func (s *BinPackSuite) TestPackNewInstance(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(4)
+	pool := &stubPool{quota: 10, canCreate: 10}
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster)
+	sch.runQueue()
+	c.Check(s.createdTypes(pool), check.DeepEquals, []string{"large"})
+	for _, ent := range sch.Queue() {
+		c.Check(ent.SchedulingStatus, check.Equals, "Waiting for a large instance to boot and be ready to accept work.")
+	}
+	c.Check(sch.packedTypes, check.HasLen, 4)
+
+	// On the next iteration, the containers still use the large
+	// instance, even though "large" is not one of their eligible
+	// instance types.
+	pool.bootAllInstances()
+	sch.runQueue()
+	c.Check(s.createdTypes(pool), check.DeepEquals, []string{"large"})
+	c.Check(pool.starts, check.DeepEquals, []string{test.ContainerUUID(1), test.ContainerUUID(2), test.ContainerUUID(3), test.ContainerUUID(4)})
+
+	// Packed types are forgotten when containers leave the queue.
+	queue.Containers = nil
+	queue.Update()
+	sch.runQueue()
+	c.Check(sch.packedTypes, check.HasLen, 0)
+}
+
+func (s *BinPackSuite) TestDisabled(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(4)
+	s.testCluster.Containers.CloudVMs.BinPacking = false
+	pool := &stubPool{quota: 10, canCreate: 10}
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster)
+	sch.runQueue()
+	c.Check(s.createdTypes(pool), check.DeepEquals, []string{"small", "small", "small", "small"})
+	c.Check(sch.packedTypes, check.HasLen, 0)
+}
+
+// A single container is not worth packing, so a small instance is
+// used.
+func (s *BinPackSuite) TestSingleContainer(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(1)
+	pool := &stubPool{quota: 10, canCreate: 10}
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster)
+	sch.runQueue()
+	c.Check(s.createdTypes(pool), check.DeepEquals, []string{"small"})
+}
+
+// Containers that can run on an existing idle instance are not
+// counted when deciding whether to create a larger instance.
+func (s *BinPackSuite) TestExistingInstance(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(3)
+	pool := &stubPool{quota: 10, canCreate: 10}
+	pool.Create(s.testCluster.InstanceTypes["small"])
+	pool.bootAllInstances()
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster)
+	sch.runQueue()
+	// Container 1 starts on the existing instance; containers 2
+	// and 3 are packed onto a medium instance (1.8 < 2*1).
+	c.Check(pool.starts, check.DeepEquals, []string{test.ContainerUUID(1)})
+	c.Check(s.createdTypes(pool), check.DeepEquals, []string{"small", "medium"})
+}
+
+// MaxRunningContainersPerInstance limits how many containers are
+// packed onto an instance.
+func (s *BinPackSuite) TestMaxRunningContainersPerInstance(c *check.C) {
+	s.testCluster.Containers.CloudVMs.MaxRunningContainersPerInstance = 2
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(4)
+	pool := &stubPool{quota: 10, canCreate: 10}
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster)
+	sch.runQueue()
+	c.Check(s.createdTypes(pool), check.DeepEquals, []string{"medium", "medium"})
+}
+
+// Containers that need different kinds of instances (here,
+// preemptible and non-preemptible) are not packed together.
+func (s *BinPackSuite) TestIncompatible(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(2)
+	for _, name := range []string{"small", "medium", "large"} {
+		it := s.testCluster.InstanceTypes[name]
+		it.Name += "-spot"
+		it.ProviderType += "-spot"
+		it.Preemptible = true
+		it.Price /= 2
+		s.testCluster.InstanceTypes[it.Name] = it
+	}
+	queue.Containers[1].SchedulingParameters.Preemptible = true
+	queue.Update()
+	pool := &stubPool{quota: 10, canCreate: 10}
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster)
+	sch.runQueue()
+	c.Check(s.createdTypes(pool), check.DeepEquals, []string{"small", "small-spot"})
+}
@@ -0,0 +1,290 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+const budgetExceededWarning = "Project budget exceeded"
+
+// budgets periodically retrieves the current spend of each project
+// that has a budget property, and determines which containers
+// should be held in the queue because the project that owns them
+// (or one of its parent projects) has exceeded its budget.
+type budgets struct {
+	interval time.Duration
+	logger   logrus.FieldLogger
+	owners   *containerOwners
+	wakeup   func()
+
+	// Tests can replace these.
+	listBudgeted     func() ([]string, error)
+	getBudget        func(uuid string) (arvados.GroupBudget, error)
+	listSubprojects  func(uuid string) ([]string, error)
+	setRuntimeStatus func(uuid string, status map[string]interface{}) error
+
+	mtx        sync.Mutex
+	status     map[string]arvados.GroupBudget // budgeted project uuid => last retrieved status
+	exceeded   map[string]string              // project uuid => uuid of budgeted project that is over its limit
+	refreshed  time.Time
+	refreshing bool
+	held       map[string]bool // containers whose runtime_status says they are held
+}
+
+// newBudgets returns a budgets for the given scheduler, or nil if
+// project budgets are not enabled.
+func newBudgets(sch *Scheduler) *budgets {
+	cfg := sch.cluster.Containers.Budgets
+	if !cfg.Enable {
+		return nil
+	}
+	interval := time.Duration(cfg.RefreshInterval)
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	return &budgets{
+		interval: interval,
+		logger:   sch.logger,
+		owners:   sch.owners,
+		wakeup:   func() { sch.wakeup.Reset(time.Second / 4) },
+		listBudgeted: func() ([]string, error) {
+			return listBudgetedProjects(sch.client)
+		},
+		getBudget: func(uuid string) (arvados.GroupBudget, error) {
+			var budget arvados.GroupBudget
+			err := sch.client.RequestAndDecode(&budget, "GET", "arvados/v1/groups/"+uuid+"/budget", nil, nil)
+			return budget, err
+		},
+		listSubprojects: func(uuid string) ([]string, error) {
+			return listSubprojects(sch.client, uuid)
+		},
+		setRuntimeStatus: func(uuid string, status map[string]interface{}) error {
+			return sch.client.RequestAndDecode(nil, "PUT", "arvados/v1/containers/"+uuid, nil, map[string]map[string]interface{}{
+				"container": {"runtime_status": status},
+			})
+		},
+		status:   map[string]arvados.GroupBudget{},
+		exceeded: map[string]string{},
+		held:     map[string]bool{},
+	}
+}
+
+// refresh starts a background update of project spend, if the last
+// update is older than the configured refresh interval.
+func (b *budgets) refresh() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.refreshing || time.Since(b.refreshed) < b.interval {
+		return
+	}
+	b.refreshing = true
+	go func() {
+		status, exceeded := b.load()
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		b.refreshing = false
+		b.refreshed = time.Now()
+		changed := len(exceeded) != len(b.exceeded)
+		for uuid, budget := range status {
+			logger := b.logger.WithFields(logrus.Fields{
+				"ProjectUUID": uuid,
+				"Spend":       budget.Spend,
+				"Limit":       budget.Limit,
+				"SoftLimit":   budget.SoftLimit,
+			})
+			if prev := b.status[uuid].Status; prev == budget.Status {
+				continue
+			}
+			changed = true
+			switch budget.Status {
+			case arvados.GroupBudgetStatusExceeded:
+				logger.Warn("project has exceeded its budget, new containers will be held in the queue")
+			case arvados.GroupBudgetStatusWarning:
+				logger.Warn("project spend has reached its soft limit")
+			default:
+				logger.Info("project spend is within its budget")
+			}
+		}
+		b.status = status
+		b.exceeded = exceeded
+		if changed {
+			b.wakeup()
+		}
+	}()
+}
+
+// load retrieves the current status of each budgeted project, and
+// returns the set of projects (including subprojects) that are over
+// budget. If a project's status cannot be retrieved, its previous
+// status is retained. If the list of budgeted projects cannot be
+// retrieved, the previously budgeted projects are checked.
+func (b *budgets) load() (map[string]arvados.GroupBudget, map[string]string) {
+	b.mtx.Lock()
+	prevStatus := b.status
+	prevExceeded := b.exceeded
+	b.mtx.Unlock()
+	projects, err := b.listBudgeted()
+	if err != nil {
+		b.logger.WithError(err).Warn("error listing budgeted projects")
+		projects = nil
+		for uuid := range prevStatus {
+			projects = append(projects, uuid)
+		}
+	}
+	status := map[string]arvados.GroupBudget{}
+	exceeded := map[string]string{}
+	for _, uuid := range projects {
+		logger := b.logger.WithField("ProjectUUID", uuid)
+		budget, err := b.getBudget(uuid)
+		if err != nil {
+			logger.WithError(err).Warn("error retrieving project budget status")
+			budget = prevStatus[uuid]
+		}
+		status[uuid] = budget
+		if budget.Status != arvados.GroupBudgetStatusExceeded {
+			continue
+		}
+		subprojects, err := b.listSubprojects(uuid)
+		if err != nil {
+			logger.WithError(err).Warn("error listing subprojects")
+			for sub, top := range prevExceeded {
+				if top == uuid {
+					subprojects = append(subprojects, sub)
+				}
+			}
+		}
+		exceeded[uuid] = uuid
+		for _, sub := range subprojects {
+			exceeded[sub] = uuid
+		}
+	}
+	return status, exceeded
+}
+
+// hold returns the UUID of the project whose budget has been
+// exceeded, if the given container should not be started for that
+// reason.
+//
+// If the container's owner has not been looked up yet, hold returns
+// "", true: the container should not be started until we know
+// whether its project is over budget.
+func (b *budgets) hold(ctr *arvados.Container) (string, bool) {
+	owner, ok := b.owners.get(ctr.UUID)
+	if !ok {
+		return "", true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	project, ok := b.exceeded[owner]
+	return project, ok
+}
+
+// updateRuntimeStatus adds a warning to the runtime_status of newly
+// held containers that are still queued, and clears the warning from
+// containers that are no longer held.
+func (b *budgets) updateRuntimeStatus(heldNow map[string]string, queued map[string]bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for uuid, project := range heldNow {
+		if b.held[uuid] || !queued[uuid] {
+			continue
+		}
+		b.held[uuid] = true
+		limit := b.status[project].Limit
+		go func() {
+			err := b.setRuntimeStatus(uuid, map[string]interface{}{
+				"warning":       budgetExceededWarning,
+				"warningDetail": fmt.Sprintf("Project %s has exceeded its budget of %v. This container will not be started until the budget period ends or the budget is increased.", project, limit),
+			})
+			if err != nil {
+				b.logger.WithField("ContainerUUID", uuid).WithError(err).Warn("error setting runtime_status")
+			}
+		}()
+	}
+	for uuid := range b.held {
+		if _, ok := heldNow[uuid]; ok {
+			continue
+		}
+		delete(b.held, uuid)
+		if !queued[uuid] {
+			// If the container has been locked, the API
+			// server has already cleared its
+			// runtime_status.
+			continue
+		}
+		go func() {
+			err := b.setRuntimeStatus(uuid, map[string]interface{}{})
+			if err != nil {
+				b.logger.WithField("ContainerUUID", uuid).WithError(err).Warn("error clearing runtime_status")
+			}
+		}()
+	}
+}
+
+// listBudgetedProjects returns the UUIDs of all projects that have a
+// budget property.
+func listBudgetedProjects(client *arvados.Client) ([]string, error) {
+	var uuids []string
+	for offset := 0; ; {
+		var list arvados.GroupList
+		err := client.RequestAndDecode(&list, "GET", "arvados/v1/groups", nil, map[string]interface{}{
+			"filters": []arvados.Filter{{"group_class", "=", "project"}, {"properties", "exists", arvados.GroupBudgetProperty}},
+			"select":  []string{"uuid"},
+			"count":   "none",
+			"limit":   1000,
+			"offset":  offset,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(list.Items) == 0 {
+			break
+		}
+		for _, grp := range list.Items {
+			uuids = append(uuids, grp.UUID)
+		}
+		offset += len(list.Items)
+	}
+	return uuids, nil
+}
+
+// listSubprojects returns the UUIDs of all projects below the given
+// project.
+func listSubprojects(client *arvados.Client, uuid string) ([]string, error) {
+	var uuids []string
+	for offset := 0; ; {
+		var list arvados.ObjectList
+		err := client.RequestAndDecode(&list, "GET", "arvados/v1/groups/contents", nil, map[string]interface{}{
+			"uuid":      uuid,
+			"recursive": true,
+			"filters":   []arvados.Filter{{"uuid", "is_a", "arvados#group"}, {"groups.group_class", "=", "project"}},
+			"select":    []string{"uuid"},
+			"count":     "none",
+			"limit":     1000,
+			"offset":    offset,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(list.Items) == 0 {
+			break
+		}
+		for _, item := range list.Items {
+			if item, ok := item.(map[string]interface{}); ok {
+				if uuid, ok := item["uuid"].(string); ok {
+					uuids = append(uuids, uuid)
+				}
+			}
+		}
+		offset += len(list.Items)
+	}
+	return uuids, nil
+}
@@ -0,0 +1,312 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&BudgetSuite{})
+
+type BudgetSuite struct {
+	SchedulerSuite
+}
+
+func (s *BudgetSuite) waitFor(c *check.C, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		c.Assert(time.Now().Before(deadline), check.Equals, true)
+	}
+}
+
+func (s *BudgetSuite) TestHoldOverBudget(c *check.C) {
+	project := "zzzzz-j7d0g-budgetedproject"
+	subproject := "zzzzz-j7d0g-budgetedsubproj"
+	otherProject := "zzzzz-j7d0g-otherproject00"
+	s.testCluster.Containers.Budgets.Enable = true
+	s.testCluster.Containers.Budgets.RefreshInterval = arvados.Duration(time.Hour)
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+
+	owners := map[string]string{
+		test.ContainerUUID(1): project,
+		test.ContainerUUID(2): subproject,
+		test.ContainerUUID(3): otherProject,
+		test.ContainerUUID(4): project,
+	}
+	queue := &test.Queue{ChooseType: s.chooseType}
+	for i := 1; i <= 4; i++ {
+		queue.Containers = append(queue.Containers, arvados.Container{
+			UUID:     test.ContainerUUID(i),
+			State:    arvados.ContainerStateQueued,
+			Priority: int64(10 - i),
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: 1,
+				RAM:   1 << 30,
+			},
+		})
+	}
+	// Container 4 was locked before the budget was exceeded.
+	queue.Containers[3].State = arvados.ContainerStateLocked
+	queue.Update()
+	pool := &stubPool{quota: 10, canCreate: 10}
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster)
+	c.Assert(sch.budgets, check.NotNil)
+
+	sch.owners.lookup = func(uuids []string) (map[string]string, error) {
+		found := map[string]string{}
+		for _, uuid := range uuids {
+			found[uuid] = owners[uuid]
+		}
+		return found, nil
+	}
+	var mtx sync.Mutex
+	budget := arvados.GroupBudget{UUID: project, Limit: 10, SoftLimit: 8, Spend: 12, Status: arvados.GroupBudgetStatusExceeded}
+	sch.budgets.listBudgeted = func() ([]string, error) {
+		return []string{project}, nil
+	}
+	sch.budgets.getBudget = func(uuid string) (arvados.GroupBudget, error) {
+		c.Check(uuid, check.Equals, project)
+		mtx.Lock()
+		defer mtx.Unlock()
+		return budget, nil
+	}
+	sch.budgets.listSubprojects = func(uuid string) ([]string, error) {
+		c.Check(uuid, check.Equals, project)
+		return []string{subproject}, nil
+	}
+	runtimeStatus := map[string]map[string]interface{}{}
+	sch.budgets.setRuntimeStatus = func(uuid string, status map[string]interface{}) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		runtimeStatus[uuid] = status
+		return nil
+	}
+	waitRuntimeStatus := func(n int) []string {
+		var uuids []string
+		s.waitFor(c, func() bool {
+			mtx.Lock()
+			defer mtx.Unlock()
+			uuids = nil
+			for uuid := range runtimeStatus {
+				uuids = append(uuids, uuid)
+			}
+			return len(uuids) == n
+		})
+		sort.Strings(uuids)
+		return uuids
+	}
+
+	// Look up owners and budget status before the first
+	// runQueue, as if the containers had been in the queue for
+	// a while.
+	ents, _ := queue.Entries()
+	sch.owners.update(ents)
+	sch.budgets.refresh()
+	s.waitFor(c, func() bool {
+		_, ok := sch.owners.get(test.ContainerUUID(4))
+		sch.budgets.mtx.Lock()
+		defer sch.budgets.mtx.Unlock()
+		return ok && !sch.budgets.refreshed.IsZero()
+	})
+
+	sch.runQueue()
+	for _, ent := range sch.Queue() {
+		held := strings.Contains(ent.SchedulingStatus, "exceeded its budget")
+		c.Check(held, check.Equals, ent.Container.UUID != test.ContainerUUID(3), check.Commentf("%s: %s", ent.Container.UUID, ent.SchedulingStatus))
+	}
+	// Container 3 is locked in the background.
+	s.waitFor(c, func() bool { return len(queue.StateChanges()) == 2 })
+	changes := queue.StateChanges()
+	sort.Slice(changes, func(i, j int) bool { return changes[i].UUID < changes[j].UUID })
+	c.Check(changes, check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(3), From: "Queued", To: "Locked"},
+		{UUID: test.ContainerUUID(4), From: "Locked", To: "Queued"},
+	})
+	c.Check(waitRuntimeStatus(2), check.DeepEquals, []string{test.ContainerUUID(1), test.ContainerUUID(2)})
+	mtx.Lock()
+	c.Check(runtimeStatus[test.ContainerUUID(1)]["warning"], check.Equals, budgetExceededWarning)
+	c.Check(runtimeStatus[test.ContainerUUID(2)]["warningDetail"], check.Matches, `Project `+project+` has exceeded its budget of 10\..*`)
+	runtimeStatus = map[string]map[string]interface{}{}
+	mtx.Unlock()
+
+	// Container 4 is now queued (after unlock) so its
+	// runtime_status gets updated too.
+	queue.Update()
+	sch.runQueue()
+	c.Check(waitRuntimeStatus(1), check.DeepEquals, []string{test.ContainerUUID(4)})
+
+	// Budget is raised, so the containers are released and
+	// their runtime_status is cleared.
+	mtx.Lock()
+	budget.Limit = 20
+	budget.Status = arvados.GroupBudgetStatusWarning
+	runtimeStatus = map[string]map[string]interface{}{}
+	mtx.Unlock()
+	sch.budgets.mtx.Lock()
+	sch.budgets.refreshed = time.Time{}
+	sch.budgets.mtx.Unlock()
+	sch.runQueue()
+	s.waitFor(c, func() bool {
+		sch.budgets.mtx.Lock()
+		defer sch.budgets.mtx.Unlock()
+		return !sch.budgets.refreshed.IsZero()
+	})
+	sch.runQueue()
+	for _, ent := range sch.Queue() {
+		c.Check(ent.SchedulingStatus, check.Not(check.Matches), `.*exceeded its budget.*`)
+	}
+	c.Check(waitRuntimeStatus(3), check.DeepEquals, []string{test.ContainerUUID(1), test.ContainerUUID(2), test.ContainerUUID(4)})
+	mtx.Lock()
+	for _, status := range runtimeStatus {
+		c.Check(status, check.HasLen, 0)
+	}
+	mtx.Unlock()
+}
+
+// A container whose owner has not been looked up yet is not started,
+// because it might belong to a project that is over budget.
+func (s *BudgetSuite) TestHoldPendingOwnerLookup(c *check.C) {
+	project := "zzzzz-j7d0g-budgetedproject"
+	s.testCluster.Containers.Budgets.Enable = true
+	s.testCluster.Containers.Budgets.RefreshInterval = arvados.Duration(time.Hour)
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+
+	queue := &test.Queue{ChooseType: s.chooseType}
+	for i := 1; i <= 3; i++ {
+		queue.Containers = append(queue.Containers, arvados.Container{
+			UUID:     test.ContainerUUID(i),
+			State:    arvados.ContainerStateQueued,
+			Priority: int64(10 - i),
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: 1,
+				RAM:   1 << 30,
+			},
+		})
+	}
+	queue.Update()
+	pool := &stubPool{quota: 10, canCreate: 10}
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster)
+	c.Assert(sch.budgets, check.NotNil)
+
+	// Container 1 belongs to the over-budget project, container
+	// 2 belongs to another project, and container 3 has no
+	// container request.
+	owners := map[string]string{
+		test.ContainerUUID(1): project,
+		test.ContainerUUID(2): "zzzzz-j7d0g-otherproject00",
+	}
+	release := make(chan struct{})
+	sch.owners.lookup = func(uuids []string) (map[string]string, error) {
+		<-release
+		found := map[string]string{}
+		for _, uuid := range uuids {
+			if owner, ok := owners[uuid]; ok {
+				found[uuid] = owner
+			}
+		}
+		return found, nil
+	}
+	sch.budgets.listBudgeted = func() ([]string, error) {
+		return []string{project}, nil
+	}
+	sch.budgets.getBudget = func(uuid string) (arvados.GroupBudget, error) {
+		return arvados.GroupBudget{UUID: project, Limit: 10, Spend: 12, Status: arvados.GroupBudgetStatusExceeded}, nil
+	}
+	sch.budgets.listSubprojects = func(uuid string) ([]string, error) {
+		return nil, nil
+	}
+	sch.budgets.setRuntimeStatus = func(uuid string, status map[string]interface{}) error {
+		return nil
+	}
+	sch.budgets.refresh()
+	s.waitFor(c, func() bool {
+		sch.budgets.mtx.Lock()
+		defer sch.budgets.mtx.Unlock()
+		return !sch.budgets.refreshed.IsZero()
+	})
+
+	// Owner lookup is blocked, so nothing is started.
+	sch.runQueue()
+	for _, ent := range sch.Queue() {
+		c.Check(ent.SchedulingStatus, check.Equals, schedStatusBudgetPending, check.Commentf("%s", ent.Container.UUID))
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.StateChanges(), check.HasLen, 0)
+
+	close(release)
+	s.waitFor(c, func() bool {
+		_, ok := sch.owners.get(test.ContainerUUID(3))
+		return ok
+	})
+	sch.runQueue()
+	for _, ent := range sch.Queue() {
+		held := strings.Contains(ent.SchedulingStatus, "exceeded its budget")
+		c.Check(held, check.Equals, ent.Container.UUID == test.ContainerUUID(1), check.Commentf("%s: %s", ent.Container.UUID, ent.SchedulingStatus))
+		c.Check(ent.SchedulingStatus, check.Not(check.Equals), schedStatusBudgetPending)
+	}
+	s.waitFor(c, func() bool { return len(queue.StateChanges()) == 2 })
+	changes := queue.StateChanges()
+	sort.Slice(changes, func(i, j int) bool { return changes[i].UUID < changes[j].UUID })
+	c.Check(changes, check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(2), From: "Queued", To: "Locked"},
+		{UUID: test.ContainerUUID(3), From: "Queued", To: "Locked"},
+	})
+}
+
+func (s *BudgetSuite) TestNoBudgets(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	sch := New(ctx, arvados.NewClientFromEnv(), &test.Queue{ChooseType: s.chooseType}, &stubPool{}, nil, &s.testCluster)
+	c.Check(sch.budgets, check.IsNil)
+	c.Check(sch.owners, check.IsNil)
+	sch.runQueue()
+}
+
+// If the budget status cannot be retrieved, the previous status is
+// retained.
+func (s *BudgetSuite) TestRefreshError(c *check.C) {
+	project := "zzzzz-j7d0g-budgetedproject"
+	s.testCluster.Containers.Budgets.Enable = true
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	sch := New(ctx, arvados.NewClientFromEnv(), &test.Queue{ChooseType: s.chooseType}, &stubPool{}, nil, &s.testCluster)
+	fail := false
+	sch.budgets.listBudgeted = func() ([]string, error) {
+		if fail {
+			return nil, context.DeadlineExceeded
+		}
+		return []string{project}, nil
+	}
+	sch.budgets.getBudget = func(uuid string) (arvados.GroupBudget, error) {
+		if fail {
+			return arvados.GroupBudget{}, context.DeadlineExceeded
+		}
+		return arvados.GroupBudget{UUID: project, Limit: 10, Spend: 11, Status: arvados.GroupBudgetStatusExceeded}, nil
+	}
+	sch.budgets.listSubprojects = func(uuid string) ([]string, error) {
+		if fail {
+			return nil, context.DeadlineExceeded
+		}
+		return []string{"zzzzz-j7d0g-budgetedsubproj"}, nil
+	}
+	status, exceeded := sch.budgets.load()
+	c.Check(status[project].Spend, check.Equals, 11.0)
+	c.Check(exceeded, check.HasLen, 2)
+	sch.budgets.status, sch.budgets.exceeded = status, exceeded
+
+	fail = true
+	status, exceeded = sch.budgets.load()
+	c.Check(status[project].Spend, check.Equals, 11.0)
+	c.Check(exceeded, check.DeepEquals, map[string]string{
+		project:                       project,
+		"zzzzz-j7d0g-budgetedsubproj": project,
+	})
+}
@@ -0,0 +1,336 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+// FairShareStatus reports the fair-share accounting that determined
+// a container's position in the queue.
+type FairShareStatus struct {
+	// User or project UUID the container's usage is accounted to.
+	Key string `json:"key"`
+	// Configured shares for Key.
+	Shares float64 `json:"shares"`
+	// Recent usage by Key, in core-hours, with exponential decay
+	// applied.
+	UsageCoreHours float64 `json:"usage_core_hours"`
+	// UsageCoreHours divided by Shares. Owners with lower
+	// normalized usage are served first.
+	NormalizedUsage float64 `json:"normalized_usage"`
+}
+
+// fairShare tracks recent usage per user or project, and reorders
+// the queue so owners with less usage (relative to their configured
+// shares) are served ahead of owners with more.
+type fairShare struct {
+	mode     string // "user" or "project"
+	halfLife time.Duration
+	shares   map[string]float64
+	logger   logrus.FieldLogger
+	owners   *containerOwners // used in "project" mode
+
+	// listUsage returns containers that have run since the given
+	// time. Tests can replace this.
+	listUsage func(since time.Time) ([]arvados.Container, error)
+
+	mtx     sync.Mutex
+	usage   map[string]float64 // key => decayed core-hours
+	updated time.Time          // time usage was last decayed/accrued
+}
+
+// newFairShare returns a fairShare for the given scheduler, or nil if
+// fair-share scheduling is not enabled in the cluster config.
+func newFairShare(sch *Scheduler) *fairShare {
+	cfg := sch.cluster.Containers.CloudVMs
+	if cfg.FairShareMode == "" {
+		return nil
+	}
+	halfLife := time.Duration(cfg.FairShareHalfLife)
+	if halfLife <= 0 {
+		halfLife = 24 * time.Hour
+	}
+	fs := &fairShare{
+		mode:     cfg.FairShareMode,
+		halfLife: halfLife,
+		shares:   cfg.FairShares,
+		logger:   sch.logger.WithField("FairShareMode", cfg.FairShareMode),
+		owners:   sch.owners,
+		usage:    map[string]float64{},
+	}
+	fs.listUsage = func(since time.Time) ([]arvados.Container, error) {
+		return listRecentContainers(sch.client, since)
+	}
+	return fs
+}
+
+func (fs *fairShare) sharesFor(key string) float64 {
+	if s, ok := fs.shares[key]; ok && s > 0 {
+		return s
+	}
+	return 1
+}
+
+// decay returns the factor by which usage recorded at time t should
+// be multiplied to get its weight at time now.
+func (fs *fairShare) decay(t, now time.Time) float64 {
+	return math.Pow(0.5, float64(now.Sub(t))/float64(fs.halfLife))
+}
+
+// Caller must have lock.
+func (fs *fairShare) keyLocked(ctr *arvados.Container) (string, bool) {
+	if fs.mode == "user" {
+		return ctr.RuntimeUserUUID, ctr.RuntimeUserUUID != ""
+	}
+	key, ok := fs.owners.get(ctr.UUID)
+	return key, ok && key != ""
+}
+
+// backfill loads usage from containers that ran recently, before
+// this dispatcher process started. Errors are logged and otherwise
+// ignored: in that case usage is accounted only from the time the
+// dispatcher started.
+func (fs *fairShare) backfill() {
+	now := time.Now()
+	since := now.Add(-4 * fs.halfLife)
+	ctrs, err := fs.listUsage(since)
+	if err != nil {
+		fs.logger.WithError(err).Warn("error loading recent container usage, fair-share accounting will start from zero")
+		return
+	}
+	var owners map[string]string
+	if fs.mode == "project" {
+		owners = map[string]string{}
+		for i := 0; i < len(ctrs); i += ownerLookupBatch {
+			var uuids []string
+			for _, ctr := range ctrs[i:min(i+ownerLookupBatch, len(ctrs))] {
+				uuids = append(uuids, ctr.UUID)
+			}
+			found, err := fs.owners.lookup(uuids)
+			if err != nil {
+				fs.logger.WithError(err).Warn("error looking up container request owners, fair-share accounting will start from zero")
+				return
+			}
+			for uuid, key := range found {
+				owners[uuid] = key
+			}
+		}
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	for _, ctr := range ctrs {
+		if ctr.StartedAt == nil {
+			continue
+		}
+		finished := now
+		if ctr.FinishedAt != nil {
+			finished = *ctr.FinishedAt
+		}
+		key := ctr.RuntimeUserUUID
+		if fs.mode == "project" {
+			key = owners[ctr.UUID]
+		}
+		if key == "" || !finished.After(*ctr.StartedAt) {
+			continue
+		}
+		coreHours := float64(ctr.RuntimeConstraints.VCPUs) * finished.Sub(*ctr.StartedAt).Hours()
+		fs.usage[key] += coreHours * fs.decay(finished, now)
+	}
+	fs.updated = now
+	fs.logger.Infof("loaded usage from %d recent containers", len(ctrs))
+}
+
+// accrueLocked applies decay to all recorded usage, and adds usage for the
+// currently running containers since the last call.
+//
+// Caller must have lock.
+func (fs *fairShare) accrueLocked(now time.Time, running map[string]time.Time, containers map[string]*arvados.Container) {
+	if !fs.updated.IsZero() && now.After(fs.updated) {
+		hours := now.Sub(fs.updated).Hours()
+		factor := fs.decay(fs.updated, now)
+		for key, usage := range fs.usage {
+			usage *= factor
+			if usage < 1e-6 {
+				delete(fs.usage, key)
+			} else {
+				fs.usage[key] = usage
+			}
+		}
+		for uuid, exited := range running {
+			ctr := containers[uuid]
+			if !exited.IsZero() || ctr == nil {
+				continue
+			}
+			if key, ok := fs.keyLocked(ctr); ok {
+				// Approximate the decayed integral
+				// over the interval by its midpoint.
+				fs.usage[key] += float64(ctr.RuntimeConstraints.VCPUs) * hours * math.Sqrt(factor)
+			}
+		}
+	}
+	fs.updated = now
+}
+
+// reorder accounts for recent usage, then reorders the given
+// (already sorted) queue entries so that, within each group of
+// running, locked, and queued containers, owners with lower usage
+// relative to their shares are served first. Each owner's own
+// containers stay in the same order relative to one another.
+//
+// It also fills in the FairShare status of each entry.
+func (fs *fairShare) reorder(sorted []QueueEnt, running map[string]time.Time) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+
+	containers := map[string]*arvados.Container{}
+	for i := range sorted {
+		containers[sorted[i].Container.UUID] = &sorted[i].Container
+	}
+	fs.accrueLocked(time.Now(), running, containers)
+
+	// Projected usage starts with recorded usage, plus one hour
+	// of each container that is currently running.  As the
+	// interleaving loop below takes containers from each owner's
+	// list, it adds one hour of the container's VCPUs to the
+	// owner's projected usage.
+	projected := map[string]float64{}
+	for key, usage := range fs.usage {
+		projected[key] = usage
+	}
+	for uuid, exited := range running {
+		if ctr := containers[uuid]; ctr != nil && exited.IsZero() {
+			if key, ok := fs.keyLocked(ctr); ok {
+				projected[key] += float64(ctr.RuntimeConstraints.VCPUs)
+			}
+		}
+	}
+
+	for i := range sorted {
+		if key, ok := fs.keyLocked(&sorted[i].Container); ok {
+			shares := fs.sharesFor(key)
+			sorted[i].FairShare = &FairShareStatus{
+				Key:             key,
+				Shares:          shares,
+				UsageCoreHours:  fs.usage[key],
+				NormalizedUsage: fs.usage[key] / shares,
+			}
+		}
+	}
+
+	tier := func(ent *QueueEnt) int {
+		if _, ok := running[ent.Container.UUID]; ok {
+			return 0
+		} else if ent.Container.State == arvados.ContainerStateLocked {
+			return 1
+		} else {
+			return 2
+		}
+	}
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && tier(&sorted[end]) == tier(&sorted[start]) && sorted[end].Container.Priority > 0 {
+			end++
+		}
+		if end == start {
+			start++
+			continue
+		}
+		if tier(&sorted[start]) > 0 {
+			fs.interleaveLocked(sorted[start:end], projected)
+		}
+		start = end
+	}
+}
+
+// interleaveLocked reorders ents by repeatedly taking the next entry
+// from the owner with the lowest projected usage per share. Ties are
+// broken by the original order. Entries whose owner is not yet known
+// are moved to the end, in their original order.
+//
+// Caller must have lock.
+func (fs *fairShare) interleaveLocked(ents []QueueEnt, projected map[string]float64) {
+	queues := map[string][]QueueEnt{}
+	var keys []string
+	var unknown []QueueEnt
+	for _, ent := range ents {
+		if ent.FairShare == nil {
+			unknown = append(unknown, ent)
+			continue
+		}
+		key := ent.FairShare.Key
+		if queues[key] == nil {
+			keys = append(keys, key)
+		}
+		queues[key] = append(queues[key], ent)
+	}
+	index := map[string]int{}
+	for i, ent := range ents {
+		index[ent.Container.UUID] = i
+	}
+	// pos returns the original position of the next entry to be
+	// taken from queues[key].
+	pos := func(key string) int {
+		return index[queues[key][0].Container.UUID]
+	}
+	out := make([]QueueEnt, 0, len(ents))
+	for len(keys) > 0 {
+		best := 0
+		bestUsage := projected[keys[0]] / fs.sharesFor(keys[0])
+		for i, key := range keys[1:] {
+			usage := projected[key] / fs.sharesFor(key)
+			if usage < bestUsage || (usage == bestUsage && pos(key) < pos(keys[best])) {
+				best, bestUsage = i+1, usage
+			}
+		}
+		key := keys[best]
+		ent := queues[key][0]
+		out = append(out, ent)
+		projected[key] += float64(ent.Container.RuntimeConstraints.VCPUs)
+		queues[key] = queues[key][1:]
+		if len(queues[key]) == 0 {
+			keys = append(keys[:best], keys[best+1:]...)
+		}
+	}
+	out = append(out, unknown...)
+	copy(ents, out)
+}
+
+// listRecentContainers returns containers that have started, and have
+// been modified since the given time.
+func listRecentContainers(client *arvados.Client, since time.Time) ([]arvados.Container, error) {
+	var results []arvados.Container
+	limitParam := 1000
+	filters := []arvados.Filter{
+		{"state", "in", []arvados.ContainerState{arvados.ContainerStateRunning, arvados.ContainerStateComplete, arvados.ContainerStateCancelled}},
+		{"started_at", "!=", nil},
+		{"modified_at", ">=", since},
+	}
+	params := arvados.ResourceListParams{
+		Select:  []string{"uuid", "runtime_user_uuid", "runtime_constraints", "started_at", "finished_at"},
+		Filters: filters,
+		Order:   "uuid",
+		Limit:   &limitParam,
+		Count:   "none",
+	}
+	for {
+		var list arvados.ContainerList
+		err := client.RequestAndDecode(&list, "GET", "arvados/v1/containers", nil, params)
+		if err != nil {
+			return nil, err
+		}
+		if len(list.Items) == 0 {
+			break
+		}
+		results = append(results, list.Items...)
+		params.Filters = append(filters, arvados.Filter{"uuid", ">", list.Items[len(list.Items)-1].UUID})
+	}
+	return results, nil
+}
@@ -0,0 +1,241 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&FairShareSuite{})
+
+type FairShareSuite struct {
+	SchedulerSuite
+}
+
+var (
+	fairShareUserA = "zzzzz-tpzed-aaaaaaaaaaaaaaa"
+	fairShareUserB = "zzzzz-tpzed-bbbbbbbbbbbbbbb"
+	fairShareUserC = "zzzzz-tpzed-ccccccccccccccc"
+)
+
+// Return a queue with nA containers submitted by user A with
+// priority 10, followed by nB containers submitted by user B with
+// priority 1, and nC containers submitted by user C with priority 1.
+func (s *FairShareSuite) setupQueue(nA, nB, nC int) *test.Queue {
+	queue := &test.Queue{ChooseType: s.chooseType}
+	for i, n := range []int{nA, nB, nC} {
+		for j := 0; j < n; j++ {
+			ctr := arvados.Container{
+				UUID:            test.ContainerUUID(len(queue.Containers) + 1),
+				State:           arvados.ContainerStateQueued,
+				Priority:        10,
+				RuntimeUserUUID: []string{fairShareUserA, fairShareUserB, fairShareUserC}[i],
+				RuntimeConstraints: arvados.RuntimeConstraints{
+					VCPUs: 1,
+					RAM:   1 << 30,
+				},
+			}
+			if i > 0 {
+				ctr.Priority = 1
+			}
+			queue.Containers = append(queue.Containers, ctr)
+		}
+	}
+	queue.Update()
+	return queue
+}
+
+func (s *FairShareSuite) queueOwners(sch *Scheduler) []string {
+	var owners []string
+	for _, ent := range sch.Queue() {
+		owners = append(owners, ent.Container.RuntimeUserUUID)
+	}
+	return owners
+}
+
+func (s *FairShareSuite) TestDisabled(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(3, 2, 0)
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, &stubPool{}, nil, &s.testCluster)
+	c.Check(sch.fairShare, check.IsNil)
+	sch.runQueue()
+	c.Check(s.queueOwners(sch), check.DeepEquals, []string{
+		fairShareUserA, fairShareUserA, fairShareUserA,
+		fairShareUserB, fairShareUserB,
+	})
+	for _, ent := range sch.Queue() {
+		c.Check(ent.FairShare, check.IsNil)
+	}
+}
+
+// With no recorded usage, users' containers are interleaved, even
+// though user A's containers have higher priority.
+func (s *FairShareSuite) TestUserMode_NoUsage(c *check.C) {
+	s.testCluster.Containers.CloudVMs.FairShareMode = "user"
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(4, 2, 0)
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, &stubPool{}, nil, &s.testCluster)
+	sch.runQueue()
+	c.Check(s.queueOwners(sch), check.DeepEquals, []string{
+		fairShareUserA, fairShareUserB, fairShareUserA, fairShareUserB,
+		fairShareUserA, fairShareUserA,
+	})
+	// Each user's containers are still in their original order.
+	c.Check(sch.Queue()[0].Container.UUID, check.Equals, test.ContainerUUID(1))
+	c.Check(sch.Queue()[2].Container.UUID, check.Equals, test.ContainerUUID(2))
+	for _, ent := range sch.Queue() {
+		c.Assert(ent.FairShare, check.NotNil)
+		c.Check(ent.FairShare.Key, check.Equals, ent.Container.RuntimeUserUUID)
+		c.Check(ent.FairShare.Shares, check.Equals, 1.0)
+		c.Check(ent.FairShare.UsageCoreHours, check.Equals, 0.0)
+	}
+}
+
+// User A has used more than their share recently, so users B and C
+// go first.
+func (s *FairShareSuite) TestUserMode_RecentUsage(c *check.C) {
+	s.testCluster.Containers.CloudVMs.FairShareMode = "user"
+	s.testCluster.Containers.CloudVMs.FairShares = map[string]float64{fairShareUserA: 2}
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(2, 3, 1)
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, &stubPool{}, nil, &s.testCluster)
+	sch.fairShare.usage[fairShareUserA] = 4
+	sch.fairShare.usage[fairShareUserB] = 1
+	sch.runQueue()
+	// Normalized usage is A=2, B=1, C=0.  Taking a container
+	// adds 1 to B or C, or 0.5 to A.
+	c.Check(s.queueOwners(sch), check.DeepEquals, []string{
+		fairShareUserC, // A=2, B=1, C=0
+		fairShareUserB, // A=2, B=1
+		fairShareUserA, // A=2, B=2 (tie, A is first in original order)
+		fairShareUserB, // A=2.5, B=2
+		fairShareUserA, // A=2.5, B=3
+		fairShareUserB,
+	})
+	ent := sch.Queue()[2]
+	c.Assert(ent.FairShare, check.NotNil)
+	c.Check(ent.FairShare.Shares, check.Equals, 2.0)
+	c.Check(ent.FairShare.UsageCoreHours > 3.99, check.Equals, true)
+	c.Check(ent.FairShare.NormalizedUsage > 1.99, check.Equals, true)
+}
+
+// Locked containers stay ahead of queued containers regardless of
+// fair-share usage.
+func (s *FairShareSuite) TestUserMode_LockedFirst(c *check.C) {
+	s.testCluster.Containers.CloudVMs.FairShareMode = "user"
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(2, 2, 0)
+	queue.Containers[1].State = arvados.ContainerStateLocked
+	queue.Update()
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, &stubPool{}, nil, &s.testCluster)
+	sch.fairShare.usage[fairShareUserA] = 100
+	sch.runQueue()
+	c.Check(sch.Queue()[0].Container.UUID, check.Equals, test.ContainerUUID(2))
+	c.Check(s.queueOwners(sch), check.DeepEquals, []string{
+		fairShareUserA, fairShareUserB, fairShareUserB, fairShareUserA,
+	})
+}
+
+func (s *FairShareSuite) TestProjectMode(c *check.C) {
+	s.testCluster.Containers.CloudVMs.FairShareMode = "project"
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	// All containers are submitted by user A, but the last two
+	// are in a different project.
+	queue := s.setupQueue(4, 0, 0)
+	queue.Containers[2].Priority = 5
+	queue.Containers[3].Priority = 5
+	queue.Update()
+	projectA := "zzzzz-j7d0g-aaaaaaaaaaaaaaa"
+	projectB := "zzzzz-j7d0g-bbbbbbbbbbbbbbb"
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, &stubPool{}, nil, &s.testCluster)
+	lookups := make(chan []string, 10)
+	sch.owners.lookup = func(uuids []string) (map[string]string, error) {
+		lookups <- uuids
+		owners := map[string]string{}
+		for _, uuid := range uuids {
+			if uuid == test.ContainerUUID(3) || uuid == test.ContainerUUID(4) {
+				owners[uuid] = projectB
+			} else {
+				owners[uuid] = projectA
+			}
+		}
+		return owners, nil
+	}
+
+	// Owners are not known yet, so the queue is in priority
+	// order.
+	sch.runQueue()
+	c.Check(sch.Queue()[0].FairShare, check.IsNil)
+	c.Check(sch.Queue()[1].Container.UUID, check.Equals, test.ContainerUUID(2))
+	select {
+	case uuids := <-lookups:
+		c.Check(uuids, check.HasLen, 4)
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for lookup")
+	}
+	// Wait for the lookup goroutine to store its results.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		sch.owners.mtx.Lock()
+		n := len(sch.owners.owners)
+		sch.owners.mtx.Unlock()
+		if n == 4 {
+			break
+		}
+		c.Assert(time.Now().Before(deadline), check.Equals, true)
+	}
+
+	sch.runQueue()
+	var got []string
+	for _, ent := range sch.Queue() {
+		c.Assert(ent.FairShare, check.NotNil)
+		got = append(got, ent.FairShare.Key)
+	}
+	c.Check(got, check.DeepEquals, []string{projectA, projectB, projectA, projectB})
+	c.Check(lookups, check.HasLen, 0)
+}
+
+func (s *FairShareSuite) TestBackfillAndDecay(c *check.C) {
+	s.testCluster.Containers.CloudVMs.FairShareMode = "user"
+	s.testCluster.Containers.CloudVMs.FairShareHalfLife = arvados.Duration(time.Hour)
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(0, 0, 0)
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, &stubPool{}, nil, &s.testCluster)
+	now := time.Now()
+	t0, t1, t2 := now.Add(-3*time.Hour), now.Add(-time.Hour), now.Add(-time.Hour/2)
+	sch.fairShare.listUsage = func(since time.Time) ([]arvados.Container, error) {
+		c.Check(since.Before(now.Add(-4*time.Hour+time.Minute)), check.Equals, true)
+		return []arvados.Container{
+			// 2 VCPUs for 2 hours, finished one
+			// half-life ago.
+			{UUID: test.ContainerUUID(1), RuntimeUserUUID: fairShareUserA, RuntimeConstraints: arvados.RuntimeConstraints{VCPUs: 2}, StartedAt: &t0, FinishedAt: &t1},
+			// Still running.
+			{UUID: test.ContainerUUID(2), RuntimeUserUUID: fairShareUserB, RuntimeConstraints: arvados.RuntimeConstraints{VCPUs: 4}, StartedAt: &t2},
+		}, nil
+	}
+	sch.fairShare.backfill()
+	c.Check(sch.fairShare.usage[fairShareUserA] > 1.99, check.Equals, true)
+	c.Check(sch.fairShare.usage[fairShareUserA] < 2.01, check.Equals, true)
+	c.Check(sch.fairShare.usage[fairShareUserB] > 1.99, check.Equals, true)
+	c.Check(sch.fairShare.usage[fairShareUserB] < 2.01, check.Equals, true)
+
+	// After one more half-life, with user B's container still
+	// running, user A's usage has halved and user B's has
+	// increased.
+	sch.fairShare.mtx.Lock()
+	sch.fairShare.accrueLocked(sch.fairShare.updated.Add(time.Hour), map[string]time.Time{test.ContainerUUID(2): {}}, map[string]*arvados.Container{
+		test.ContainerUUID(2): {UUID: test.ContainerUUID(2), RuntimeUserUUID: fairShareUserB, RuntimeConstraints: arvados.RuntimeConstraints{VCPUs: 4}},
+	})
+	sch.fairShare.mtx.Unlock()
+	c.Check(sch.fairShare.usage[fairShareUserA] > 0.99, check.Equals, true)
+	c.Check(sch.fairShare.usage[fairShareUserA] < 1.01, check.Equals, true)
+	c.Check(sch.fairShare.usage[fairShareUserB] > 1+4*0.7, check.Equals, true)
+	c.Check(sch.fairShare.usage[fairShareUserB] < 1+4*0.71, check.Equals, true)
+}
@@ -0,0 +1,176 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+// gangState is the state of a gang (a set of containers with the
+// same runtime user and SchedulingParameters.GangID, which must be
+// started together) during a single runQueue iteration.
+type gangState struct {
+	id      string // SchedulingParameters.GangID
+	user    string // RuntimeUserUUID
+	size    int    // SchedulingParameters.GangSize
+	members []int  // indexes (in sorted queue) of members with priority > 0
+	running int    // number of members already running
+	ready   []gangStart
+}
+
+// gangStart is a locked gang member that has been allocated to an
+// instance that is ready to start it.
+type gangStart struct {
+	idx      int
+	instance cloud.InstanceID
+}
+
+// assembled returns true if enough members of the gang have been
+// submitted.
+func (g *gangState) assembled() bool {
+	return len(g.members) >= g.size
+}
+
+// gangKey returns the key used to identify the given container's
+// gang, or "" if it is not a member of a gang.
+//
+// Gang IDs are chosen by users, so the same gang ID submitted by
+// different users identifies different gangs.
+func gangKey(ctr arvados.Container) string {
+	if ctr.SchedulingParameters.GangID == "" {
+		return ""
+	}
+	return ctr.RuntimeUserUUID + "/" + ctr.SchedulingParameters.GangID
+}
+
+// collectGangs returns the gangs represented in the sorted queue,
+// keyed by gangKey.
+func collectGangs(sorted []QueueEnt, running map[string]time.Time) map[string]*gangState {
+	gangs := map[string]*gangState{}
+	for i, ent := range sorted {
+		key := gangKey(ent.Container)
+		if key == "" || ent.Container.Priority < 1 {
+			continue
+		}
+		g := gangs[key]
+		if g == nil {
+			g = &gangState{
+				id:   ent.Container.SchedulingParameters.GangID,
+				user: ent.Container.RuntimeUserUUID,
+			}
+			gangs[key] = g
+		}
+		if size := ent.Container.SchedulingParameters.GangSize; size > g.size {
+			g.size = size
+		}
+		g.members = append(g.members, i)
+		if _, ok := running[ent.Container.UUID]; ok {
+			g.running++
+		}
+	}
+	return gangs
+}
+
+func (sch *Scheduler) gangTimeout() time.Duration {
+	if t := time.Duration(sch.cluster.Containers.CloudVMs.GangTimeout); t > 0 {
+		return t
+	}
+	return 10 * time.Minute
+}
+
+// startGangs starts the members of each gang whose members are all
+// either running or ready to start. If a gang has locked members but
+// has not been started within the configured timeout, its locked
+// members are unlocked, and the gang is not locked again until
+// another timeout interval has passed.
+//
+// It returns the number of containers that are waiting for other
+// members of their gang.
+func (sch *Scheduler) startGangs(gangs map[string]*gangState, sorted []QueueEnt, running map[string]time.Time) int {
+	now := time.Now()
+	timeout := sch.gangTimeout()
+	waiting := 0
+	for key, g := range gangs {
+		logger := sch.logger.WithFields(logrus.Fields{
+			"GangID":          g.id,
+			"RuntimeUserUUID": g.user,
+		})
+		if g.assembled() && g.running+len(g.ready) >= len(g.members) {
+			for _, start := range g.ready {
+				ent := &sorted[start.idx]
+				if sch.pool.StartContainer(start.instance, ent.Container) {
+					ent.SchedulingStatus = schedStatusPreparingRuntimeEnvironment
+				} else {
+					// The instance became unavailable
+					// since we checked it. The rest of
+					// the gang is already starting, so
+					// this member will be started on the
+					// next iteration.
+					ent.SchedulingStatus = fmt.Sprintf(schedStatusGangWaiting, g.id)
+					waiting++
+				}
+			}
+			if len(g.ready) > 0 {
+				logger.WithField("Containers", len(g.ready)).Info("starting gang")
+			}
+			delete(sch.gangWaiting, key)
+			continue
+		}
+		var locked []arvados.Container
+		for _, idx := range g.members {
+			ctr := sorted[idx].Container
+			if _, ok := running[ctr.UUID]; !ok {
+				waiting++
+				if ctr.State == arvados.ContainerStateLocked {
+					locked = append(locked, ctr)
+				}
+			}
+		}
+		if len(locked) == 0 {
+			delete(sch.gangWaiting, key)
+			continue
+		}
+		since, ok := sch.gangWaiting[key]
+		if !ok {
+			sch.gangWaiting[key] = now
+			continue
+		}
+		if now.Sub(since) < timeout {
+			continue
+		}
+		logger.WithFields(logrus.Fields{
+			"Members":     len(g.members),
+			"GangSize":    g.size,
+			"Ready":       len(g.ready),
+			"GangTimeout": arvados.Duration(timeout),
+		}).Warn("gang could not be started within timeout, unlocking members")
+		for _, ctr := range locked {
+			logger := logger.WithField("ContainerUUID", ctr.UUID)
+			logger.Info("unlock because gang could not be started")
+			err := sch.queue.Unlock(ctr.UUID)
+			if err != nil {
+				logger.WithError(err).Warn("error unlocking")
+			}
+		}
+		delete(sch.gangWaiting, key)
+		sch.gangRetry[key] = now.Add(timeout)
+	}
+	for key := range sch.gangWaiting {
+		if gangs[key] == nil {
+			delete(sch.gangWaiting, key)
+		}
+	}
+	for key, t := range sch.gangRetry {
+		if gangs[key] == nil || now.After(t) {
+			delete(sch.gangRetry, key)
+		}
+	}
+	return waiting
+}
@@ -0,0 +1,181 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/dispatchcloud/test"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/worker"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&GangSuite{})
+
+type GangSuite struct {
+	SchedulerSuite
+}
+
+const testGangID = "zzzzz-gang-test"
+
+// Return a queue with n members of a gang of the given size, in the
+// given state, followed by a non-gang container with lower priority.
+func (s *GangSuite) setupQueue(n, size int, state arvados.ContainerState) *test.Queue {
+	queue := &test.Queue{ChooseType: s.chooseType}
+	for i := 1; i <= n+1; i++ {
+		ctr := arvados.Container{
+			UUID:     test.ContainerUUID(i),
+			Priority: 10,
+			State:    state,
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				VCPUs: 1,
+				RAM:   1 << 30,
+			},
+		}
+		if i <= n {
+			ctr.SchedulingParameters.GangID = testGangID
+			ctr.SchedulingParameters.GangSize = size
+		} else {
+			ctr.Priority = 1
+		}
+		queue.Containers = append(queue.Containers, ctr)
+	}
+	queue.Update()
+	return queue
+}
+
+// Members of a gang are not locked until all members have been
+// submitted.
+func (s *GangSuite) TestIncomplete(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(2, 3, arvados.ContainerStateQueued)
+	pool := &stubPool{quota: 10, canCreate: 10}
+	for i := 0; i < 3; i++ {
+		pool.Create(test.InstanceType(1))
+	}
+	pool.bootAllInstances()
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster)
+	sch.runQueue()
+	for _, ent := range sch.Queue() {
+		if ent.Container.SchedulingParameters.GangID != "" {
+			c.Check(ent.SchedulingStatus, check.Equals, "Waiting for 1 more containers in gang "+testGangID+" to be submitted.")
+		}
+	}
+	// Only the non-gang container is locked.
+	for deadline := time.Now().Add(time.Second); len(queue.StateChanges()) < 1; time.Sleep(time.Millisecond) {
+		c.Assert(time.Now().Before(deadline), check.Equals, true)
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.StateChanges(), check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(3), From: "Queued", To: "Locked"},
+	})
+}
+
+// Containers submitted by different users with the same gang ID are
+// not members of the same gang.
+func (s *GangSuite) TestSameIDDifferentUsers(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(2, 2, arvados.ContainerStateQueued)
+	queue.Containers[0].RuntimeUserUUID = "zzzzz-tpzed-000000000000001"
+	queue.Containers[1].RuntimeUserUUID = "zzzzz-tpzed-000000000000002"
+	queue.Update()
+	pool := &stubPool{quota: 10, canCreate: 10}
+	for i := 0; i < 3; i++ {
+		pool.Create(test.InstanceType(1))
+	}
+	pool.bootAllInstances()
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster)
+	sch.runQueue()
+	for _, ent := range sch.Queue() {
+		if ent.Container.SchedulingParameters.GangID != "" {
+			c.Check(ent.SchedulingStatus, check.Equals, "Waiting for 1 more containers in gang "+testGangID+" to be submitted.")
+		}
+	}
+	// Only the non-gang container is locked.
+	for deadline := time.Now().Add(time.Second); len(queue.StateChanges()) < 1; time.Sleep(time.Millisecond) {
+		c.Assert(time.Now().Before(deadline), check.Equals, true)
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.StateChanges(), check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(3), From: "Queued", To: "Locked"},
+	})
+}
+
+// No members are started until instances are ready for all of them,
+// and a lower-priority container does not take the instances that
+// are reserved for the gang.
+func (s *GangSuite) TestStartTogether(c *check.C) {
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(3, 3, arvados.ContainerStateLocked)
+	pool := &stubPool{quota: 10, canCreate: 3}
+	for i := 0; i < 3; i++ {
+		pool.Create(test.InstanceType(1))
+	}
+	pool.bootAllInstances()
+	// One instance is still booting.
+	pool.workers["i-0000003"].WorkerState = worker.StateBooting
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster)
+	sch.runQueue()
+	c.Check(pool.starts, check.HasLen, 0)
+	c.Check(sch.Queue()[0].SchedulingStatus, check.Equals, "Waiting for other containers in gang "+testGangID+" to be ready to start.")
+	c.Check(sch.Queue()[2].SchedulingStatus, check.Equals, "Waiting for a type1 instance to boot and be ready to accept work.")
+	c.Check(sch.Queue()[3].Container.UUID, check.Equals, test.ContainerUUID(4))
+	c.Check(sch.Queue()[3].SchedulingStatus, check.Not(check.Equals), schedStatusPreparingRuntimeEnvironment)
+	c.Check(testutil.ToFloat64(sch.mContainersWaitingForGang), check.Equals, 3.0)
+
+	pool.bootAllInstances()
+	sch.runQueue()
+	c.Check(pool.starts, check.DeepEquals, []string{test.ContainerUUID(1), test.ContainerUUID(2), test.ContainerUUID(3)})
+	for _, ent := range sch.Queue()[:3] {
+		c.Check(ent.SchedulingStatus, check.Equals, schedStatusPreparingRuntimeEnvironment)
+	}
+	c.Check(testutil.ToFloat64(sch.mContainersWaitingForGang), check.Equals, 0.0)
+}
+
+// If the gang cannot be started within GangTimeout, locked members
+// are unlocked, and not locked again until another GangTimeout has
+// passed.
+func (s *GangSuite) TestTimeout(c *check.C) {
+	s.testCluster.Containers.CloudVMs.GangTimeout = arvados.Duration(time.Hour)
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	queue := s.setupQueue(2, 2, arvados.ContainerStateLocked)
+	queue.Containers = queue.Containers[:2]
+	queue.Update()
+	// Only one instance is available, and no more can be
+	// created.
+	pool := &stubPool{quota: 10, canCreate: 1}
+	pool.Create(test.InstanceType(1))
+	pool.bootAllInstances()
+	sch := New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster)
+	key := gangKey(queue.Containers[0])
+	sch.runQueue()
+	c.Check(pool.starts, check.HasLen, 0)
+	c.Check(queue.StateChanges(), check.HasLen, 0)
+	c.Check(sch.gangWaiting[key].IsZero(), check.Equals, false)
+
+	// Timeout has not been reached yet.
+	sch.runQueue()
+	c.Check(queue.StateChanges(), check.HasLen, 0)
+
+	sch.gangWaiting[key] = time.Now().Add(-2 * time.Hour)
+	sch.runQueue()
+	c.Check(pool.starts, check.HasLen, 0)
+	c.Check(queue.StateChanges(), check.DeepEquals, []test.QueueStateChange{
+		{UUID: test.ContainerUUID(1), From: "Locked", To: "Queued"},
+		{UUID: test.ContainerUUID(2), From: "Locked", To: "Queued"},
+	})
+	c.Check(sch.gangRetry[key].After(time.Now().Add(59*time.Minute)), check.Equals, true)
+
+	sch.runQueue()
+	time.Sleep(10 * time.Millisecond)
+	c.Check(queue.StateChanges(), check.HasLen, 2)
+	for _, ent := range sch.Queue() {
+		c.Check(ent.SchedulingStatus, check.Matches, `Gang `+testGangID+` could not be started within the time limit\. Waiting until .* to try again\.`)
+	}
+}
@@ -37,6 +37,7 @@ type WorkerPool interface {
 	CountWorkers() map[worker.State]int
 	AtCapacity(arvados.InstanceType) bool
 	AtQuota() bool
+	CurrentPrice(arvados.InstanceType) float64
 	Create(arvados.InstanceType) (worker.InstanceView, bool)
 	Shutdown(cloud.InstanceID) bool
 	StartContainer(cloud.InstanceID, arvados.Container) bool
@@ -0,0 +1,128 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package scheduler
+
+import (
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/dispatchcloud/container"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+// Number of container UUIDs per container_requests lookup.
+const ownerLookupBatch = 100
+
+// containerOwners tracks the project that owns the highest-priority
+// container request for each queued container. Owners are looked up
+// in the background, so they are not known the first time a
+// container is seen.
+type containerOwners struct {
+	logger logrus.FieldLogger
+	wakeup func()
+
+	// lookup returns the project UUID for each of the given
+	// container UUIDs. Containers whose owner cannot be
+	// determined are omitted, and are recorded as having no
+	// owner. Tests can replace this.
+	lookup func(uuids []string) (map[string]string, error)
+
+	mtx     sync.Mutex
+	owners  map[string]string // container uuid => project uuid
+	looking bool              // lookup call in progress
+}
+
+func newContainerOwners(sch *Scheduler) *containerOwners {
+	return &containerOwners{
+		logger: sch.logger,
+		wakeup: func() { sch.wakeup.Reset(time.Second / 4) },
+		lookup: func(uuids []string) (map[string]string, error) {
+			return lookupContainerRequestOwners(sch.client, uuids)
+		},
+		owners: map[string]string{},
+	}
+}
+
+// get returns the owner of the given container, if known. The owner
+// is "" if the container has been looked up but has no container
+// request.
+func (co *containerOwners) get(uuid string) (string, bool) {
+	co.mtx.Lock()
+	defer co.mtx.Unlock()
+	owner, ok := co.owners[uuid]
+	return owner, ok
+}
+
+// update forgets owners of containers that have left the queue, and
+// starts a background lookup for containers whose owners are not yet
+// known.
+func (co *containerOwners) update(ents map[string]container.QueueEnt) {
+	co.mtx.Lock()
+	defer co.mtx.Unlock()
+	for uuid := range co.owners {
+		if _, ok := ents[uuid]; !ok {
+			delete(co.owners, uuid)
+		}
+	}
+	if co.looking {
+		return
+	}
+	var todo []string
+	for uuid, ent := range ents {
+		if _, ok := co.owners[uuid]; !ok && ent.Container.Priority > 0 {
+			todo = append(todo, uuid)
+			if len(todo) >= ownerLookupBatch {
+				break
+			}
+		}
+	}
+	if len(todo) == 0 {
+		return
+	}
+	co.looking = true
+	go func() {
+		found, err := co.lookup(todo)
+		co.mtx.Lock()
+		defer co.mtx.Unlock()
+		co.looking = false
+		if err != nil {
+			co.logger.WithError(err).Warn("error looking up container request owners")
+			return
+		}
+		for _, uuid := range todo {
+			// If there is no container request, the
+			// owner is "" -- i.e., known not to be in
+			// any budgeted project.
+			co.owners[uuid] = found[uuid]
+		}
+		co.wakeup()
+	}()
+}
+
+// lookupContainerRequestOwners returns the owner_uuid of the
+// highest-priority container request for each of the given
+// containers.
+func lookupContainerRequestOwners(client *arvados.Client, uuids []string) (map[string]string, error) {
+	owners := map[string]string{}
+	limitParam := 1000
+	var list arvados.ContainerRequestList
+	err := client.RequestAndDecode(&list, "GET", "arvados/v1/container_requests", nil, arvados.ResourceListParams{
+		Select:  []string{"container_uuid", "owner_uuid", "priority"},
+		Filters: []arvados.Filter{{"container_uuid", "in", uuids}},
+		Order:   "priority desc",
+		Limit:   &limitParam,
+		Count:   "none",
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, cr := range list.Items {
+		if _, ok := owners[cr.ContainerUUID]; !ok {
+			owners[cr.ContainerUUID] = cr.OwnerUUID
+		}
+	}
+	return owners, nil
+}
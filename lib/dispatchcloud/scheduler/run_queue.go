@@ -25,6 +25,10 @@ type QueueEnt struct {
 	// Human-readable scheduling status as of the last scheduling
 	// iteration.
 	SchedulingStatus string `json:"scheduling_status"`
+
+	// Fair-share accounting for this container's owner, if
+	// fair-share scheduling is enabled and the owner is known.
+	FairShare *FairShareStatus `json:"fair_share,omitempty"`
 }
 
 const (
@@ -36,6 +40,11 @@ const (
 	schedStatusWaitingInstanceType         = "Waiting in queue at position %v.  Cluster is at capacity for all eligible instance types (%v) and cannot start a new instance right now."
 	schedStatusWaitingCloudResources       = "Waiting in queue at position %v.  Cluster is at cloud account limits and cannot start any new instances right now."
 	schedStatusWaitingClusterCapacity      = "Waiting in queue at position %v.  Cluster is at capacity and cannot start any new instances right now."
+	schedStatusBudgetExceeded              = "This container will not be started because project %v has exceeded its budget."
+	schedStatusBudgetPending               = "Waiting to check the budget of the project that owns this container."
+	schedStatusGangIncomplete              = "Waiting for %v more containers in gang %v to be submitted."
+	schedStatusGangWaiting                 = "Waiting for other containers in gang %v to be ready to start."
+	schedStatusGangRetry                   = "Gang %v could not be started within the time limit. Waiting until %v to try again."
 )
 
 func instanceResourcesForInstanceType(it arvados.InstanceType) container.InstanceResources {
@@ -75,6 +84,25 @@ func (sch *Scheduler) instanceSort(a, b worker.InstanceView) bool {
 	return false
 }
 
+// sortByCurrentPrice returns a copy of the given instance types,
+// sorted by their current prices as reported by the worker pool, so
+// the type that is currently cheapest is tried first. Types with
+// equal current prices remain in their original order.
+func (sch *Scheduler) sortByCurrentPrice(types []arvados.InstanceType) []arvados.InstanceType {
+	if len(types) < 2 {
+		return types
+	}
+	prices := make(map[string]float64, len(types))
+	for _, it := range types {
+		prices[it.Name] = sch.pool.CurrentPrice(it)
+	}
+	sorted := append([]arvados.InstanceType(nil), types...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return prices[sorted[i].Name] < prices[sorted[j].Name]
+	})
+	return sorted
+}
+
 func (sch *Scheduler) runQueue() {
 	running := sch.pool.Running()
 	instances := sch.pool.Instances()
@@ -96,8 +124,16 @@ func (sch *Scheduler) runQueue() {
 	}
 
 	unsorted, _ := sch.queue.Entries()
+	if sch.owners != nil {
+		sch.owners.update(unsorted)
+	}
+	if sch.budgets != nil {
+		sch.budgets.refresh()
+	}
+	sch.prunePackedTypes(unsorted)
 	sorted := make([]QueueEnt, 0, len(unsorted))
 	for _, ent := range unsorted {
+		ent.InstanceTypes = sch.sortByCurrentPrice(ent.InstanceTypes)
 		sorted = append(sorted, QueueEnt{QueueEnt: ent})
 	}
 	sort.Slice(sorted, func(i, j int) bool {
@@ -134,6 +170,9 @@ func (sch *Scheduler) runQueue() {
 			return sorted[i].FirstSeenAt.Before(sorted[j].FirstSeenAt)
 		}
 	})
+	if sch.fairShare != nil {
+		sch.fairShare.reorder(sorted, running)
+	}
 
 	containers := map[string]*arvados.Container{}
 	for i := range sorted {
@@ -238,6 +277,15 @@ func (sch *Scheduler) runQueue() {
 	var overmaxsuper []QueueEnt        // unmappable because max supervisors (these are not included in overquota)
 	var containerAllocatedWorkerBootingCount int
 
+	// overbudget maps UUIDs of containers that are not being
+	// started to the UUID of the project that has exceeded its
+	// budget.
+	overbudget := map[string]string{}
+
+	// gangs tracks members of each gang, so they can be started
+	// all at once after the tryrun loop.
+	gangs := collectGangs(sorted, running)
+
 	// trying is #containers running + #containers we're trying to
 	// start. We stop trying to start more containers if this
 	// reaches the dynamic maxContainers limit.
@@ -270,10 +318,38 @@ tryrun:
 			sorted[i].SchedulingStatus = fmt.Sprintf(schedStatusSupervisorLimitReached, len(overmaxsuper))
 			continue
 		}
+		if sch.budgets != nil {
+			if project, hold := sch.budgets.hold(&ctr); hold && project == "" {
+				// Owner lookup is still in progress.
+				sorted[i].SchedulingStatus = schedStatusBudgetPending
+				continue
+			} else if hold {
+				overbudget[ctr.UUID] = project
+				sorted[i].SchedulingStatus = fmt.Sprintf(schedStatusBudgetExceeded, project)
+				continue
+			}
+		}
+		var gang *gangState
+		if key := gangKey(ctr); key != "" {
+			gang = gangs[key]
+			if !gang.assembled() {
+				sorted[i].SchedulingStatus = fmt.Sprintf(schedStatusGangIncomplete, gang.size-len(gang.members), gang.id)
+				continue
+			}
+			if retry, ok := sch.gangRetry[key]; ok && ctr.State == arvados.ContainerStateQueued {
+				sorted[i].SchedulingStatus = fmt.Sprintf(schedStatusGangRetry, gang.id, retry.UTC().Format(time.RFC3339))
+				continue
+			}
+		}
 		eligibleTypes := map[string]bool{}
 		for _, it := range types {
 			eligibleTypes[it.Name] = true
 		}
+		if name, ok := sch.packedTypes[ctr.UUID]; ok {
+			// A larger instance was created to run
+			// this container along with others.
+			eligibleTypes[name] = true
+		}
 		// bestInstIdx>=0 means instances[bestInstIdx] is where we should
 		// try to run ctr (it's one of the eligible instance
 		// types, and has enough resources to accommodate
@@ -400,6 +476,12 @@ tryrun:
 				} else if sch.pool.KillContainer(ctr.UUID, "about to start") {
 					sorted[i].SchedulingStatus = schedStatusWaitingForPreviousAttempt
 					logger.Info("not restarting yet: crunch-run process from previous attempt has not exited")
+				} else if gang != nil {
+					// Start this container after the
+					// loop, if the rest of its gang is
+					// also ready.
+					gang.ready = append(gang.ready, gangStart{idx: i, instance: inst.Instance})
+					sorted[i].SchedulingStatus = fmt.Sprintf(schedStatusGangWaiting, gang.id)
 				} else if sch.pool.StartContainer(inst.Instance, ctr) {
 					sorted[i].SchedulingStatus = schedStatusPreparingRuntimeEnvironment
 					logger.Trace("StartContainer => true")
@@ -442,7 +524,14 @@ tryrun:
 				logger.Trace("all eligible types at capacity")
 				continue
 			}
-			logger = logger.WithField("InstanceType", availableType.Name)
+			var packed []string
+			if sch.cluster.Containers.CloudVMs.BinPacking {
+				availableType, packed = sch.packInstanceType(sorted, i, availableType, instances, instanceResources, running)
+			}
+			logger = logger.WithFields(logrus.Fields{
+				"InstanceType": availableType.Name,
+				"CurrentPrice": sch.pool.CurrentPrice(availableType),
+			})
 			newInstance, ok := sch.pool.Create(availableType)
 			if !ok {
 				// Failed despite not being at quota,
@@ -455,6 +544,12 @@ tryrun:
 			// about the eventual outcome, so we don't
 			// need to.)
 			sorted[i].SchedulingStatus = fmt.Sprintf(schedStatusWaitingNewInstance, availableType.Name)
+			if len(packed) > 0 {
+				for _, uuid := range packed {
+					sch.packedTypes[uuid] = availableType.Name
+				}
+				logger = logger.WithField("PackedContainers", len(packed))
+			}
 			logger.Info("creating new instance")
 			// Don't bother trying to start the container
 			// yet -- obviously the instance will take
@@ -472,8 +567,10 @@ tryrun:
 		}
 	}
 
+	sch.mContainersWaitingForGang.Set(float64(sch.startGangs(gangs, sorted, running)))
 	sch.mContainersAllocatedNotStarted.Set(float64(containerAllocatedWorkerBootingCount))
 	sch.mContainersNotAllocatedOverQuota.Set(float64(len(overquota) + len(overmaxsuper)))
+	sch.mContainersHeldOverBudget.Set(float64(len(overbudget)))
 
 	var qreason string
 	if sch.pool.AtQuota() {
@@ -528,6 +625,24 @@ tryrun:
 			}
 		}
 	}
+	if sch.budgets != nil {
+		queued := map[string]bool{}
+		for _, ent := range sorted {
+			if ent.Container.State == arvados.ContainerStateQueued {
+				queued[ent.Container.UUID] = true
+			} else if _, held := overbudget[ent.Container.UUID]; held && ent.Container.State == arvados.ContainerStateLocked {
+				// Locked before the budget was
+				// exceeded, but not started yet.
+				logger := sch.logger.WithField("ContainerUUID", ent.Container.UUID)
+				logger.Info("unlock because project budget exceeded")
+				err := sch.queue.Unlock(ent.Container.UUID)
+				if err != nil {
+					logger.WithError(err).Warn("error unlocking")
+				}
+			}
+		}
+		sch.budgets.updateRuntimeStatus(overbudget, queued)
+	}
 	if len(overquota) > 0 {
 		// Shut down idle workers that didn't get any
 		// containers mapped onto them before we hit quota.
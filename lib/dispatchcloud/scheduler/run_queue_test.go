@@ -33,6 +33,7 @@ type stubPool struct {
 	creates   []arvados.InstanceType
 	starts    []string
 	shutdowns int
+	prices    map[string]float64 // instance type name => current price, if different from configured price
 	sync.Mutex
 }
 
@@ -57,6 +58,14 @@ func (p *stubPool) AtCapacity(it arvados.InstanceType) bool {
 	}
 	return supply < 1
 }
+func (p *stubPool) CurrentPrice(it arvados.InstanceType) float64 {
+	p.Lock()
+	defer p.Unlock()
+	if price, ok := p.prices[it.Name]; ok {
+		return price
+	}
+	return it.Price
+}
 func (p *stubPool) Subscribe() <-chan struct{}  { return p.notify }
 func (p *stubPool) Unsubscribe(<-chan struct{}) {}
 func (p *stubPool) Running() map[string]time.Time {
@@ -287,6 +296,21 @@ func (s *SchedulerSuite) TestPackContainers_IdleInstance_TooBig(c *check.C) {
 	c.Check(pool.starts, check.HasLen, 0)
 }
 
+// The current price of type-3 instances (e.g., a spot price reported
+// by the cloud driver) is lower than the price of type-2 instances,
+// so type-3 instances are created, even though type-2 is cheaper
+// according to the configured prices.
+func (s *SchedulerSuite) TestPackContainers_CurrentPrice(c *check.C) {
+	queue, pool := s.setupTestPackContainers(c)
+	pool.prices = map[string]float64{test.InstanceType(3).Name: 0.2}
+	ctx := ctxlog.Context(context.Background(), ctxlog.TestLogger(c))
+	New(ctx, arvados.NewClientFromEnv(), queue, pool, nil, &s.testCluster).runQueue()
+	c.Check(pool.creates, check.DeepEquals, []arvados.InstanceType{
+		test.InstanceType(3), test.InstanceType(3),
+	})
+	c.Check(pool.starts, check.HasLen, 0)
+}
+
 // A type-3 instance is running a container, is within
 // MaximumPriceFactor, and has room for 2 more.  Start 2 containers on
 // the type-3 instance, and create a new instance for the last
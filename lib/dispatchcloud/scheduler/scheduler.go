@@ -50,8 +50,18 @@ type Scheduler struct {
 	maxContainers        int       // dynamic container limit (0 = unlimited), see runQueue()
 	instancesWithinQuota int       // max concurrency achieved since last quota error (0 = no quota error yet)
 
+	owners    *containerOwners // nil if neither fair-share "project" mode nor budgets are enabled
+	fairShare *fairShare       // nil if fair-share scheduling is disabled
+	budgets   *budgets         // nil if no project budgets are configured
+
+	gangWaiting map[string]time.Time // gangKey => time we started waiting for locked members to be startable
+	gangRetry   map[string]time.Time // gangKey => earliest time to lock members again after timeout
+	packedTypes map[string]string    // container UUID => larger instance type it was packed onto, see packInstanceType()
+
 	mContainersAllocatedNotStarted   prometheus.Gauge
 	mContainersNotAllocatedOverQuota prometheus.Gauge
+	mContainersHeldOverBudget        prometheus.Gauge
+	mContainersWaitingForGang        prometheus.Gauge
 	mLongestWaitTimeSinceQueue       prometheus.Gauge
 	mLast503Time                     prometheus.Gauge
 	mMaxContainerConcurrency         prometheus.Gauge
@@ -75,6 +85,10 @@ func New(ctx context.Context, client *arvados.Client, queue ContainerQueue, pool
 		stop:    make(chan struct{}),
 		stopped: make(chan struct{}),
 		uuidOp:  map[string]string{},
+
+		gangWaiting: map[string]time.Time{},
+		gangRetry:   map[string]time.Time{},
+		packedTypes: map[string]string{},
 	}
 	minQuota := cluster.Containers.CloudVMs.InitialQuotaEstimate
 	if minQuota > 0 {
@@ -82,6 +96,11 @@ func New(ctx context.Context, client *arvados.Client, queue ContainerQueue, pool
 	} else {
 		sch.maxContainers = cluster.Containers.CloudVMs.MaxInstances
 	}
+	if cluster.Containers.CloudVMs.FairShareMode == "project" || cluster.Containers.Budgets.Enable {
+		sch.owners = newContainerOwners(sch)
+	}
+	sch.fairShare = newFairShare(sch)
+	sch.budgets = newBudgets(sch)
 	sch.registerMetrics(reg)
 	return sch
 }
@@ -104,6 +123,20 @@ func (sch *Scheduler) registerMetrics(reg *prometheus.Registry) {
 		Help:      "Number of containers not allocated to a worker because the system has hit a quota.",
 	})
 	reg.MustRegister(sch.mContainersNotAllocatedOverQuota)
+	sch.mContainersHeldOverBudget = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "containers_held_over_budget",
+		Help:      "Number of containers not started because their project has exceeded its budget.",
+	})
+	reg.MustRegister(sch.mContainersHeldOverBudget)
+	sch.mContainersWaitingForGang = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "containers_waiting_for_gang",
+		Help:      "Number of containers not started because other members of their gang are not ready.",
+	})
+	reg.MustRegister(sch.mContainersWaitingForGang)
 	sch.mLongestWaitTimeSinceQueue = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "arvados",
 		Subsystem: "dispatchcloud",
@@ -217,6 +250,12 @@ func (sch *Scheduler) run() {
 	sch.fixStaleLocks()
 	sch.logger.Infof("FixStaleLocks finished (%s), starting scheduling.", time.Since(t0))
 
+	if sch.fairShare != nil {
+		t0 = time.Now()
+		sch.fairShare.backfill()
+		sch.logger.Infof("Fair-share usage backfill finished (%s).", time.Since(t0))
+	}
+
 	poolNotify := sch.pool.Subscribe()
 	defer sch.pool.Unsubscribe(poolNotify)
 
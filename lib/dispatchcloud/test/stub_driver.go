@@ -60,6 +60,10 @@ type StubDriver struct {
 
 	QuotaMaxInstances int
 
+	// Current prices to report from InstanceTypePrices, keyed
+	// by InstanceType name.
+	InstanceTypePrices map[string]float64
+
 	// If true, Create and Destroy calls block until Release() is
 	// called.
 	HoldCloudOps bool
@@ -189,6 +193,24 @@ func (sis *StubInstanceSet) InstanceQuotaGroup(it arvados.InstanceType) cloud.In
 	return cloud.InstanceQuotaGroup(it.ProviderType[:1] + suffix)
 }
 
+// InstanceTypePrices returns the prices in the driver's
+// InstanceTypePrices map for the given instance types, in zone
+// "stub-zone".
+func (sis *StubInstanceSet) InstanceTypePrices(its []arvados.InstanceType) []cloud.InstanceTypePrice {
+	var prices []cloud.InstanceTypePrice
+	for _, it := range its {
+		if price, ok := sis.driver.InstanceTypePrices[it.Name]; ok {
+			prices = append(prices, cloud.InstanceTypePrice{
+				InstanceType: it.Name,
+				Zone:         "stub-zone",
+				StartTime:    time.Now(),
+				Price:        price,
+			})
+		}
+	}
+	return prices
+}
+
 func (sis *StubInstanceSet) Stop() {
 	sis.mtx.Lock()
 	defer sis.mtx.Unlock()
@@ -118,6 +118,7 @@ func NewPool(logger logrus.FieldLogger, arvClient *arvados.Client, reg *promethe
 		maxProbesPerSecond:             cluster.Containers.CloudVMs.MaxProbesPerSecond,
 		maxConcurrentInstanceCreateOps: cluster.Containers.CloudVMs.MaxConcurrentInstanceCreateOps,
 		maxInstances:                   cluster.Containers.CloudVMs.MaxInstances,
+		warmPool:                       map[string]arvados.WarmPoolConfig{},
 		probeInterval:                  duration(cluster.Containers.CloudVMs.ProbeInterval, defaultProbeInterval),
 		syncInterval:                   duration(cluster.Containers.CloudVMs.SyncInterval, defaultSyncInterval),
 		timeoutIdle:                    duration(cluster.Containers.CloudVMs.TimeoutIdle, defaultTimeoutIdle),
@@ -134,12 +135,23 @@ func NewPool(logger logrus.FieldLogger, arvClient *arvados.Client, reg *promethe
 		runnerArgs:                     append([]string{"--runtime-engine=" + cluster.Containers.RuntimeEngine}, cluster.Containers.CrunchRunArgumentsList...),
 		stop:                           make(chan bool),
 	}
+	for name, wpc := range cluster.Containers.CloudVMs.WarmPool {
+		logger := logger.WithField("InstanceType", name)
+		if _, ok := cluster.InstanceTypes[name]; !ok {
+			logger.Warn("ignoring WarmPool entry for undefined instance type")
+		} else if err := wpc.Validate(); err != nil {
+			logger.WithError(err).Warn("ignoring invalid WarmPool entry")
+		} else if wpc.MinIdle > 0 {
+			wp.warmPool[name] = wpc
+		}
+	}
 	wp.registerMetrics(reg)
 	go func() {
 		wp.setupOnce.Do(wp.setup)
 		go wp.runMetrics()
 		go wp.runProbes()
 		go wp.runSync()
+		go wp.runWarmPool()
 	}()
 	return wp
 }
@@ -165,6 +177,7 @@ type Pool struct {
 	maxProbesPerSecond             int
 	maxConcurrentInstanceCreateOps int
 	maxInstances                   int
+	warmPool                       map[string]arvados.WarmPoolConfig // instance type name => warm pool config
 	timeoutIdle                    time.Duration
 	timeoutBooting                 time.Duration
 	timeoutProbe                   time.Duration
@@ -188,6 +201,7 @@ type Pool struct {
 	atQuotaUntil               time.Time
 	atQuotaErr                 cloud.QuotaError
 	atCapacityUntil            map[interface{}]time.Time
+	prices                     map[string][]cloud.InstanceTypePrice // instance type name => current prices reported by driver
 	stop                       chan bool
 	mtx                        sync.RWMutex
 	setupOnce                  sync.Once
@@ -198,6 +212,8 @@ type Pool struct {
 	mContainersRunning        prometheus.Gauge
 	mInstances                *prometheus.GaugeVec
 	mInstancesPrice           *prometheus.GaugeVec
+	mWarmPoolInstances        *prometheus.GaugeVec
+	mWarmPoolPrice            prometheus.Gauge
 	mVCPUs                    *prometheus.GaugeVec
 	mMemory                   *prometheus.GaugeVec
 	mBootOutcomes             *prometheus.CounterVec
@@ -694,6 +710,20 @@ func (wp *Pool) registerMetrics(reg *prometheus.Registry) {
 		Help:      "Price of cloud VMs.",
 	}, []string{"category"})
 	reg.MustRegister(wp.mInstancesPrice)
+	wp.mWarmPoolInstances = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "warm_pool_instances",
+		Help:      "Number of idle or booting cloud VMs kept available by the WarmPool configuration.",
+	}, []string{"instance_type"})
+	reg.MustRegister(wp.mWarmPoolInstances)
+	wp.mWarmPoolPrice = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "arvados",
+		Subsystem: "dispatchcloud",
+		Name:      "warm_pool_price",
+		Help:      "Price of idle or booting cloud VMs kept available by the WarmPool configuration.",
+	})
+	reg.MustRegister(wp.mWarmPoolPrice)
 	wp.mVCPUs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "arvados",
 		Subsystem: "dispatchcloud",
@@ -829,6 +859,17 @@ func (wp *Pool) updateMetrics() {
 	for k, v := range instances {
 		wp.mInstances.WithLabelValues(k.cat, k.instType).Set(float64(v))
 	}
+
+	warmCount := map[string]int{}
+	warmPrice := 0.0
+	for wkr := range wp.warmPoolWorkers(wp.warmPoolTargets(now)) {
+		warmCount[wkr.instType.Name]++
+		warmPrice += wkr.instType.Price
+	}
+	for name := range wp.warmPool {
+		wp.mWarmPoolInstances.WithLabelValues(name).Set(float64(warmCount[name]))
+	}
+	wp.mWarmPoolPrice.Set(warmPrice)
 	wp.mContainersRunning.Set(float64(running))
 
 	if len(probed) == 0 {
@@ -863,8 +904,9 @@ func (wp *Pool) runProbes() {
 
 		workers = workers[:0]
 		wp.mtx.Lock()
+		warm := wp.warmPoolWorkers(wp.warmPoolTargets(time.Now()))
 		for id, wkr := range wp.workers {
-			if wkr.state == StateShutdown || wkr.shutdownIfIdle() {
+			if wkr.state == StateShutdown || (!warm[wkr] && wkr.shutdownIfIdle()) {
 				continue
 			}
 			workers = append(workers, id)
@@ -1042,6 +1084,7 @@ func (wp *Pool) getInstancesAndSync() error {
 		return err
 	}
 	wp.sync(threshold, instances)
+	wp.updatePrices()
 	wp.logger.Debug("sync done")
 	return nil
 }
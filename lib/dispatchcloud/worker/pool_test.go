@@ -484,6 +484,147 @@ func (suite *PoolSuite) TestInstanceQuotaGroup(c *check.C) {
 	c.Check(created, check.Equals, true)
 }
 
+func (suite *PoolSuite) TestInstanceTypePrices(c *check.C) {
+	typeA := arvados.InstanceType{Name: "a1s", ProviderType: "a1.small", VCPUs: 1, RAM: 1 * GiB, Price: .01, Preemptible: true}
+	typeB := arvados.InstanceType{Name: "b1s", ProviderType: "b1.small", VCPUs: 1, RAM: 1 * GiB, Price: .02, Preemptible: true}
+	driver := test.StubDriver{
+		InstanceTypePrices: map[string]float64{
+			typeB.Name:     .005,
+			"unconfigured": .001,
+		},
+	}
+	instanceSet, err := driver.InstanceSet(nil, "test-instance-set-id", nil, suite.logger, nil)
+	c.Assert(err, check.IsNil)
+	defer instanceSet.Stop()
+	pool := &Pool{
+		logger:      suite.logger,
+		newExecutor: func(cloud.Instance) Executor { return &stubExecutor{} },
+		cluster:     suite.testCluster,
+		instanceSet: &throttledInstanceSet{InstanceSet: instanceSet},
+		instanceTypes: arvados.InstanceTypeMap{
+			typeA.Name: typeA,
+			typeB.Name: typeB,
+		},
+	}
+
+	// Before the first update, configured prices are used.
+	c.Check(pool.CurrentPrice(typeA), check.Equals, .01)
+	c.Check(pool.CurrentPrice(typeB), check.Equals, .02)
+
+	pool.updatePrices()
+	c.Check(pool.CurrentPrice(typeA), check.Equals, .01)
+	c.Check(pool.CurrentPrice(typeB), check.Equals, .005)
+
+	views := pool.InstanceTypePrices()
+	c.Assert(views, check.HasLen, 2)
+	c.Check(views[0].ArvadosInstanceType, check.Equals, typeB.Name)
+	c.Check(views[0].ConfiguredPrice, check.Equals, .02)
+	c.Check(views[0].CurrentPrice, check.Equals, .005)
+	c.Assert(views[0].Zones, check.HasLen, 1)
+	c.Check(views[0].Zones[0].Zone, check.Equals, "stub-zone")
+	c.Check(views[1].ArvadosInstanceType, check.Equals, typeA.Name)
+	c.Check(views[1].CurrentPrice, check.Equals, .01)
+	c.Check(views[1].Zones, check.HasLen, 0)
+}
+
+func (suite *PoolSuite) TestWarmPool(c *check.C) {
+	type1 := test.InstanceType(1)
+	type2 := test.InstanceType(2)
+	driver := &test.StubDriver{}
+	instanceSetID := cloud.InstanceSetID("test-instance-set-id")
+	is, err := driver.InstanceSet(nil, instanceSetID, nil, suite.logger, nil)
+	c.Assert(err, check.IsNil)
+	defer is.Stop()
+
+	newExecutor := func(cloud.Instance) Executor {
+		return &stubExecutor{
+			response: map[string]stubResp{
+				"crunch-run-custom --list": {},
+				"true":                     {},
+			},
+		}
+	}
+	suite.testCluster.Containers.CloudVMs = arvados.CloudVMsConfig{
+		BootProbeCommand:   "true",
+		MaxProbesPerSecond: 1000,
+		ProbeInterval:      arvados.Duration(time.Millisecond * 10),
+		SyncInterval:       arvados.Duration(time.Millisecond * 10),
+		TimeoutIdle:        arvados.Duration(time.Millisecond * 50),
+		TagKeyPrefix:       "testprefix:",
+		WarmPool: map[string]arvados.WarmPoolConfig{
+			type1.Name: {MinIdle: 2},
+			// Outside its schedule (unless the test runs
+			// exactly at midnight), so it has no effect
+			type2.Name: {MinIdle: 1, Schedule: []string{"00:00-00:01"}, TimeZone: "UTC"},
+			// Not a configured instance type
+			"type9": {MinIdle: 1},
+		},
+	}
+	suite.testCluster.Containers.CrunchRunCommand = "crunch-run-custom"
+	suite.testCluster.InstanceTypes = arvados.InstanceTypeMap{
+		type1.Name: type1,
+		type2.Name: type2,
+	}
+
+	reg := prometheus.NewRegistry()
+	pool := NewPool(suite.logger, arvados.NewClientFromEnv(), reg, instanceSetID, is, newExecutor, nil, suite.testCluster)
+	defer pool.Stop()
+	notify := pool.Subscribe()
+	defer pool.Unsubscribe(notify)
+
+	// The pool boots the warm pool instances on its own, with an
+	// empty queue.
+	suite.wait(c, pool, notify, func() bool {
+		ivs := suite.instancesByType(pool, type1)
+		return len(ivs) == 2 && ivs[0].WorkerState == StateIdle && ivs[1].WorkerState == StateIdle
+	})
+
+	// A type2 instance is subject to TimeoutIdle as usual.
+	_, ok := pool.Create(type2)
+	c.Check(ok, check.Equals, true)
+	suite.wait(c, pool, notify, func() bool {
+		return len(suite.instancesByType(pool, type2)) == 1
+	})
+	suite.wait(c, pool, notify, func() bool {
+		return len(suite.instancesByType(pool, type2)) == 0
+	})
+
+	// The warm pool instances have been idle for longer than
+	// TimeoutIdle, but are still there.
+	ivs := suite.instancesByType(pool, type1)
+	c.Check(ivs, check.HasLen, 2)
+	for _, iv := range ivs {
+		c.Check(iv.WorkerState, check.Equals, StateIdle)
+		c.Check(time.Since(iv.LastBusy) > 50*time.Millisecond, check.Equals, true)
+	}
+
+	// Once one of them is unavailable, the pool boots a
+	// replacement.
+	c.Check(pool.SetIdleBehavior(ivs[0].Instance, IdleBehaviorHold), check.IsNil)
+	suite.wait(c, pool, notify, func() bool {
+		return len(suite.instancesByType(pool, type1)) == 3
+	})
+
+	pool.updateMetrics()
+	metrics := map[string]float64{}
+	mfs, err := reg.Gather()
+	c.Assert(err, check.IsNil)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			name := mf.GetName()
+			for _, l := range m.GetLabel() {
+				name += "," + l.GetName() + "=" + l.GetValue()
+			}
+			if g := m.GetGauge(); g != nil {
+				metrics[name] = g.GetValue()
+			}
+		}
+	}
+	c.Check(metrics["arvados_dispatchcloud_warm_pool_instances,instance_type=type1"], check.Equals, 2.0)
+	c.Check(metrics["arvados_dispatchcloud_warm_pool_instances,instance_type=type2"], check.Equals, 0.0)
+	c.Check(metrics["arvados_dispatchcloud_warm_pool_price"], check.Equals, type1.Price*2)
+}
+
 func (suite *PoolSuite) instancesByType(pool *Pool, it arvados.InstanceType) []InstanceView {
 	var ivs []InstanceView
 	for _, iv := range pool.Instances() {
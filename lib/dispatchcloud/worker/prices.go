@@ -0,0 +1,113 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package worker
+
+import (
+	"sort"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cloud"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// InstanceTypePriceView shows the configured and current prices of
+// an instance type, for the management API.
+type InstanceTypePriceView struct {
+	ArvadosInstanceType  string          `json:"arvados_instance_type"`
+	ProviderInstanceType string          `json:"provider_instance_type"`
+	Preemptible          bool            `json:"preemptible"`
+	ConfiguredPrice      float64         `json:"configured_price"`
+	CurrentPrice         float64         `json:"current_price"`
+	Zones                []ZonePriceView `json:"zones"`
+}
+
+// ZonePriceView is the current price of an instance type in one
+// zone, as reported by the cloud driver.
+type ZonePriceView struct {
+	Zone      string    `json:"zone"`
+	Price     float64   `json:"price"`
+	StartTime time.Time `json:"start_time"`
+}
+
+// Get current instance type prices from the cloud driver, and
+// replace the pool's price table.
+func (wp *Pool) updatePrices() {
+	its := make([]arvados.InstanceType, 0, len(wp.instanceTypes))
+	for _, it := range wp.instanceTypes {
+		its = append(its, it)
+	}
+	sort.Slice(its, func(i, j int) bool {
+		return its[i].Name < its[j].Name
+	})
+	prices := map[string][]cloud.InstanceTypePrice{}
+	for _, p := range wp.instanceSet.InstanceTypePrices(its) {
+		if _, ok := wp.instanceTypes[p.InstanceType]; ok && p.Price > 0 {
+			prices[p.InstanceType] = append(prices[p.InstanceType], p)
+		}
+	}
+	wp.mtx.Lock()
+	defer wp.mtx.Unlock()
+	wp.prices = prices
+}
+
+// CurrentPrice returns the current price of the given instance
+// type. If the cloud driver reported prices for the type in more than
+// one zone, the highest of them is returned, since the pool does not
+// control which zone a new instance is created in. If the cloud
+// driver did not report any prices, the configured price is
+// returned.
+func (wp *Pool) CurrentPrice(it arvados.InstanceType) float64 {
+	wp.mtx.RLock()
+	defer wp.mtx.RUnlock()
+	return wp.currentPrice(it)
+}
+
+// Caller must have lock.
+func (wp *Pool) currentPrice(it arvados.InstanceType) float64 {
+	zones := wp.prices[it.Name]
+	if len(zones) == 0 {
+		return it.Price
+	}
+	price := 0.0
+	for _, p := range zones {
+		if p.Price > price {
+			price = p.Price
+		}
+	}
+	return price
+}
+
+// InstanceTypePrices returns the configured and current prices of
+// all configured instance types, sorted by current price.
+func (wp *Pool) InstanceTypePrices() []InstanceTypePriceView {
+	wp.mtx.RLock()
+	defer wp.mtx.RUnlock()
+	r := make([]InstanceTypePriceView, 0, len(wp.instanceTypes))
+	for _, it := range wp.instanceTypes {
+		view := InstanceTypePriceView{
+			ArvadosInstanceType:  it.Name,
+			ProviderInstanceType: it.ProviderType,
+			Preemptible:          it.Preemptible,
+			ConfiguredPrice:      it.Price,
+			CurrentPrice:         wp.currentPrice(it),
+			Zones:                []ZonePriceView{},
+		}
+		for _, p := range wp.prices[it.Name] {
+			view.Zones = append(view.Zones, ZonePriceView{
+				Zone:      p.Zone,
+				Price:     p.Price,
+				StartTime: p.StartTime,
+			})
+		}
+		r = append(r, view)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].CurrentPrice != r[j].CurrentPrice {
+			return r[i].CurrentPrice < r[j].CurrentPrice
+		}
+		return r[i].ArvadosInstanceType < r[j].ArvadosInstanceType
+	})
+	return r
+}
@@ -0,0 +1,136 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package worker
+
+import (
+	"sort"
+	"time"
+)
+
+// warmPoolTargets returns the number of booted, idle workers the
+// pool should keep available for each instance type at the given
+// time, according to the WarmPool configuration.
+func (wp *Pool) warmPoolTargets(t time.Time) map[string]int {
+	targets := map[string]int{}
+	for name, wpc := range wp.warmPool {
+		if n := wpc.MinIdleAt(t); n > 0 {
+			targets[name] = n
+		}
+	}
+	return targets
+}
+
+// availableForWarmPool returns true if the worker is (or will soon
+// be) ready to start a container without booting a new instance.
+//
+// Caller must have lock.
+func (wkr *worker) availableForWarmPool() bool {
+	return wkr.idleBehavior == IdleBehaviorRun &&
+		(wkr.state == StateBooting || wkr.state == StateIdle) &&
+		len(wkr.running)+len(wkr.starting) == 0
+}
+
+// warmPoolDeficit returns the number of instances of each type that
+// need to be created to reach the given warm pool targets.
+//
+// Caller must have lock.
+func (wp *Pool) warmPoolDeficit(targets map[string]int) map[string]int {
+	deficit := map[string]int{}
+	for name, n := range targets {
+		deficit[name] = n
+	}
+	for _, cc := range wp.creating {
+		deficit[cc.instanceType.Name]--
+	}
+	for _, wkr := range wp.workers {
+		if wkr.availableForWarmPool() {
+			deficit[wkr.instType.Name]--
+		}
+	}
+	for name, n := range deficit {
+		if n <= 0 {
+			delete(deficit, name)
+		}
+	}
+	return deficit
+}
+
+// runWarmPool periodically creates instances as needed to maintain
+// the configured warm pool.
+func (wp *Pool) runWarmPool() {
+	if len(wp.warmPool) == 0 {
+		return
+	}
+	// Don't create anything until we know which instances
+	// already exist.
+	wp.waitUntilLoaded()
+	ticker := time.NewTicker(wp.probeInterval)
+	defer ticker.Stop()
+	for {
+		wp.fillWarmPool(time.Now())
+		select {
+		case <-wp.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fillWarmPool creates instances to make up any shortfall in the
+// warm pool at the given time.
+func (wp *Pool) fillWarmPool(t time.Time) {
+	wp.mtx.RLock()
+	deficit := wp.warmPoolDeficit(wp.warmPoolTargets(t))
+	wp.mtx.RUnlock()
+	names := make([]string, 0, len(deficit))
+	for name := range deficit {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		it := wp.instanceTypes[name]
+		for i := 0; i < deficit[name]; i++ {
+			if _, ok := wp.Create(it); !ok {
+				// Create has already logged the
+				// reason (quota, rate limit, etc.)
+				break
+			}
+			wp.logger.WithField("InstanceType", name).Info("creating instance for warm pool")
+		}
+	}
+}
+
+// warmPoolWorkers returns the workers that are currently
+// counted toward the warm pool targets: for each instance type, up
+// to the target number of booting or idle workers, preferring idle
+// ones.
+//
+// Caller must have lock.
+func (wp *Pool) warmPoolWorkers(targets map[string]int) map[*worker]bool {
+	var avail []*worker
+	for _, wkr := range wp.workers {
+		if targets[wkr.instType.Name] > 0 && wkr.availableForWarmPool() {
+			avail = append(avail, wkr)
+		}
+	}
+	sort.Slice(avail, func(i, j int) bool {
+		if si, sj := avail[i].state == StateIdle, avail[j].state == StateIdle; si != sj {
+			return si
+		}
+		return avail[i].appeared.Before(avail[j].appeared)
+	})
+	remaining := map[string]int{}
+	for name, n := range targets {
+		remaining[name] = n
+	}
+	warm := map[*worker]bool{}
+	for _, wkr := range avail {
+		if remaining[wkr.instType.Name] > 0 {
+			remaining[wkr.instType.Name]--
+			warm[wkr] = true
+		}
+	}
+	return warm
+}
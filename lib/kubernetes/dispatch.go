@@ -0,0 +1,475 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+// Package kubernetes implements arvados-dispatch-kubernetes, which
+// runs each Arvados container in a crunch-run pod on an existing
+// Kubernetes cluster.
+package kubernetes
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/cmd"
+	"git.arvados.org/arvados.git/lib/controller/dblock"
+	"git.arvados.org/arvados.git/lib/ctrlctx"
+	"git.arvados.org/arvados.git/lib/dispatchcloud/container"
+	"git.arvados.org/arvados.git/lib/service"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
+	"git.arvados.org/arvados.git/sdk/go/auth"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"git.arvados.org/arvados.git/sdk/go/dispatch"
+	"git.arvados.org/arvados.git/sdk/go/health"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+var DispatchCommand cmd.Handler = service.Command(arvados.ServiceNameDispatchKubernetes, newHandler)
+
+func newHandler(ctx context.Context, cluster *arvados.Cluster, token string, reg *prometheus.Registry) service.Handler {
+	ac, err := arvados.NewClientFromConfig(cluster)
+	if err != nil {
+		return service.ErrorHandler(ctx, cluster, fmt.Errorf("error initializing client from cluster config: %s", err))
+	}
+	kubecli, err := newKubeClient(cluster, ctxlog.FromContext(ctx))
+	if err != nil {
+		return service.ErrorHandler(ctx, cluster, fmt.Errorf("error initializing Kubernetes client: %s", err))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	d := &dispatcher{
+		Cluster:   cluster,
+		Context:   ctx,
+		ArvClient: ac,
+		AuthToken: token,
+		Registry:  reg,
+		kubecli:   kubecli,
+		cancel:    cancel,
+	}
+	go d.Start()
+	return d
+}
+
+type dispatcher struct {
+	Cluster   *arvados.Cluster
+	Context   context.Context
+	ArvClient *arvados.Client
+	AuthToken string
+	Registry  *prometheus.Registry
+
+	logger        logrus.FieldLogger
+	dbConnector   ctrlctx.DBConnector
+	kubecli       *kubeClient
+	kubequeue     kubequeue
+	arvDispatcher *dispatch.Dispatcher
+	httpHandler   http.Handler
+
+	initOnce sync.Once
+	stopped  chan struct{}
+	cancel   context.CancelFunc
+}
+
+// Start starts the dispatcher. Start can be called multiple times
+// with no ill effect.
+func (disp *dispatcher) Start() {
+	disp.initOnce.Do(func() {
+		disp.init()
+		dblock.Dispatch.Lock(context.Background(), disp.dbConnector.GetDB)
+		go func() {
+			disp.stopped = make(chan struct{})
+			defer close(disp.stopped)
+			defer dblock.Dispatch.Unlock()
+			disp.checkPodsForOrphans()
+			err := disp.arvDispatcher.Run(disp.Context)
+			if err != nil {
+				disp.logger.Error(err)
+			}
+		}()
+	})
+}
+
+// ServeHTTP implements service.Handler.
+func (disp *dispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	disp.Start()
+	disp.httpHandler.ServeHTTP(w, r)
+}
+
+// CheckHealth implements service.Handler.
+func (disp *dispatcher) CheckHealth() error {
+	disp.Start()
+	select {
+	case <-disp.stopped:
+		return errors.New("stopped")
+	default:
+		return nil
+	}
+}
+
+// Done implements service.Handler.
+func (disp *dispatcher) Done() <-chan struct{} {
+	return disp.stopped
+}
+
+// Stop dispatching containers and release resources. Used by tests.
+func (disp *dispatcher) Close() {
+	disp.Start()
+	disp.cancel()
+	<-disp.stopped
+}
+
+func (disp *dispatcher) init() {
+	disp.logger = ctxlog.FromContext(disp.Context)
+	disp.kubecli.logger = disp.logger
+	disp.kubequeue = kubequeue{
+		logger:  disp.logger,
+		period:  disp.Cluster.Containers.CloudVMs.PollInterval.Duration(),
+		kubecli: disp.kubecli,
+	}
+	disp.ArvClient.AuthToken = disp.AuthToken
+	disp.dbConnector = ctrlctx.DBConnector{PostgreSQL: disp.Cluster.PostgreSQL}
+
+	arv, err := arvadosclient.New(disp.ArvClient)
+	if err != nil {
+		disp.logger.Fatalf("Error making Arvados client: %v", err)
+	}
+	arv.Retries = 25
+	arv.ApiToken = disp.AuthToken
+	disp.arvDispatcher = &dispatch.Dispatcher{
+		Arv:            arv,
+		Logger:         disp.logger,
+		BatchSize:      disp.Cluster.API.MaxItemsPerResponse,
+		RunContainer:   disp.runContainer,
+		PollPeriod:     time.Duration(disp.Cluster.Containers.CloudVMs.PollInterval),
+		MinRetryPeriod: time.Duration(disp.Cluster.Containers.MinRetryPeriod),
+	}
+
+	if disp.Cluster.ManagementToken == "" {
+		disp.httpHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Management API authentication is not configured", http.StatusForbidden)
+		})
+	} else {
+		mux := httprouter.New()
+		metricsH := promhttp.HandlerFor(disp.Registry, promhttp.HandlerOpts{
+			ErrorLog: disp.logger,
+		})
+		mux.Handler("GET", "/metrics", metricsH)
+		mux.Handler("GET", "/metrics.json", metricsH)
+		mux.Handler("GET", "/_health/:check", &health.Handler{
+			Token:  disp.Cluster.ManagementToken,
+			Prefix: "/_health/",
+			Routes: health.Routes{"ping": disp.CheckHealth},
+		})
+		disp.httpHandler = auth.RequireLiteralToken(disp.Cluster.ManagementToken, mux)
+	}
+}
+
+func (disp *dispatcher) runContainer(_ *dispatch.Dispatcher, ctr arvados.Container, status <-chan arvados.Container) error {
+	ctx, cancel := context.WithCancel(disp.Context)
+	defer cancel()
+
+	if ctr.State != dispatch.Locked {
+		// already started by prior invocation
+	} else if _, ok := disp.kubequeue.Lookup(ctr.UUID); !ok {
+		_, err := container.ChooseInstanceType(disp.Cluster, &ctr)
+		if err != nil && err != container.ErrInstanceTypesNotConfigured {
+			err := disp.arvDispatcher.Arv.Update("containers", ctr.UUID, arvadosclient.Dict{
+				"container": map[string]interface{}{
+					"runtime_status": map[string]string{
+						"error": err.Error(),
+					},
+				},
+			}, nil)
+			if err != nil {
+				return fmt.Errorf("error setting runtime_status on %s: %s", ctr.UUID, err)
+			}
+			return disp.arvDispatcher.UpdateState(ctr.UUID, dispatch.Cancelled)
+		}
+		disp.logger.Printf("Submitting container %s to Kubernetes", ctr.UUID)
+		cmd := []string{disp.Cluster.Containers.CrunchRunCommand}
+		cmd = append(cmd, "--runtime-engine="+disp.Cluster.Containers.RuntimeEngine)
+		cmd = append(cmd, disp.Cluster.Containers.CrunchRunArgumentsList...)
+		err = disp.submit(ctx, ctr, cmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	disp.logger.Printf("Start monitoring container %v in state %q", ctr.UUID, ctr.State)
+	defer disp.logger.Printf("Done monitoring container %s", ctr.UUID)
+
+	finished := make(chan podEntry, 1)
+	go func(uuid string) {
+		for ctx.Err() == nil {
+			ent, ok := disp.kubequeue.Lookup(uuid)
+			if !ok {
+				// If the pod disappears, there is no
+				// point in waiting for further
+				// dispatch updates: just clean up and
+				// return.
+				disp.logger.Printf("container %s pod disappeared", uuid)
+				cancel()
+				return
+			}
+			if ent.Finished() {
+				// crunch-run has exited, so the
+				// container will not make any further
+				// progress.
+				disp.logger.Printf("container %s pod %s is %s", uuid, ent.Name, ent.Phase)
+				finished <- ent
+				cancel()
+				return
+			}
+		}
+	}(ctr.UUID)
+
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			// Pod finished or disappeared
+			if err := disp.arvDispatcher.Arv.Get("containers", ctr.UUID, nil, &ctr); err != nil {
+				disp.logger.Printf("error getting final container state for %s: %s", ctr.UUID, err)
+			}
+			switch ctr.State {
+			case dispatch.Running:
+				select {
+				case ent := <-finished:
+					if msg := ent.FailureMessage(); msg != "" {
+						disp.setRuntimeError(ctr.UUID, msg)
+					}
+				default:
+				}
+				disp.arvDispatcher.UpdateState(ctr.UUID, dispatch.Cancelled)
+			case dispatch.Locked:
+				disp.arvDispatcher.Unlock(ctr.UUID)
+			}
+			done = true
+		case updated, ok := <-status:
+			if !ok {
+				// status channel is closed, which is
+				// how arvDispatcher tells us to stop
+				// touching the container record, kill
+				// off any remaining pods, etc.
+				done = true
+				break
+			}
+			if updated.State != ctr.State {
+				disp.logger.Infof("container %s changed state from %s to %s", ctr.UUID, ctr.State, updated.State)
+			}
+			ctr = updated
+			if ctr.Priority < 1 {
+				disp.logger.Printf("container %s has state %s, priority %d: delete pod", ctr.UUID, ctr.State, ctr.Priority)
+				disp.deletePod(ctr)
+			} else {
+				disp.kubequeue.SetPriority(ctr.UUID, int64(ctr.Priority))
+			}
+		}
+	}
+	disp.logger.Printf("container %s is done", ctr.UUID)
+
+	// Try deleting the pod every few seconds until it disappears
+	// from the queue. Kubernetes deletes the pod's secret along
+	// with the pod.
+	ticker := time.NewTicker(disp.Cluster.Containers.CloudVMs.PollInterval.Duration() / 2)
+	defer ticker.Stop()
+	for ent, ok := disp.kubequeue.Lookup(ctr.UUID); ok; ent, ok = disp.kubequeue.Lookup(ctr.UUID) {
+		err := disp.kubecli.DeletePod(disp.Context, ent.Name)
+		if err != nil {
+			disp.logger.Warnf("%s: DeletePod(%s): %s", ctr.UUID, ent.Name, err)
+		}
+		if disp.Context.Err() != nil {
+			break
+		}
+		<-ticker.C
+	}
+	return nil
+}
+
+func (disp *dispatcher) setRuntimeError(uuid, msg string) {
+	err := disp.arvDispatcher.Arv.Update("containers", uuid, arvadosclient.Dict{
+		"container": map[string]interface{}{
+			"runtime_status": map[string]string{
+				"error": msg,
+			},
+		},
+	}, nil)
+	if err != nil {
+		disp.logger.Warnf("error setting runtime_status on %s: %s", uuid, err)
+	}
+}
+
+// submit creates a pod that runs crunch-run for the given container,
+// and a secret (owned by the pod) that provides crunch-run's API
+// token and gateway secret.
+func (disp *dispatcher) submit(ctx context.Context, ctr arvados.Container, crunchRunCommand []string) error {
+	h := hmac.New(sha256.New, []byte(disp.Cluster.SystemRootToken))
+	fmt.Fprint(h, ctr.UUID)
+	authsecret := fmt.Sprintf("%x", h.Sum(nil))
+
+	p, err := disp.pod(ctr, crunchRunCommand)
+	if err != nil {
+		return err
+	}
+	created, err := disp.kubecli.CreatePod(ctx, p)
+	if err != nil {
+		return err
+	}
+	err = disp.kubecli.CreateSecret(ctx, secret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: objectMeta{
+			Name:   p.Metadata.Name,
+			Labels: p.Metadata.Labels,
+			OwnerReferences: []ownerReference{{
+				APIVersion: "v1",
+				Kind:       "Pod",
+				Name:       created.Metadata.Name,
+				UID:        created.Metadata.UID,
+			}},
+		},
+		StringData: map[string]string{
+			"ARVADOS_API_TOKEN": disp.ArvClient.AuthToken,
+			"GatewayAuthSecret": authsecret,
+		},
+	})
+	if err != nil {
+		if err := disp.kubecli.DeletePod(ctx, p.Metadata.Name); err != nil {
+			disp.logger.Warnf("%s: DeletePod(%s): %s", ctr.UUID, p.Metadata.Name, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (disp *dispatcher) deletePod(ctr arvados.Container) {
+	if ent, ok := disp.kubequeue.Lookup(ctr.UUID); !ok {
+		disp.logger.Debugf("deletePod(%s): redundant, pod not in queue", ctr.UUID)
+	} else if err := disp.kubecli.DeletePod(disp.Context, ent.Name); err != nil {
+		disp.logger.Warnf("%s: DeletePod(%s): %s", ctr.UUID, ent.Name, err)
+	}
+}
+
+// podName returns the name of the pod that runs the given container.
+func podName(uuid string) string {
+	return "crunch-run-" + uuid
+}
+
+// pod returns the pod spec for running the given container. Resource
+// requests and limits are derived from
+// container.InstanceResourcesNeeded.
+func (disp *dispatcher) pod(ctr arvados.Container, crunchRunCommand []string) (pod, error) {
+	kc := disp.Cluster.Containers.Kubernetes
+	if kc.Image == "" {
+		return pod{}, errors.New("Containers.Kubernetes.Image is not configured")
+	}
+	need := container.InstanceResourcesNeeded(disp.Cluster, &ctr)
+	cpu := fmt.Sprintf("%d", need.VCPUs)
+	mem := fmt.Sprintf("%d", int64(need.RAM))
+	scratch := fmt.Sprintf("%d", int64(need.Scratch))
+	res := resources{
+		Requests: map[string]string{
+			"cpu":               cpu,
+			"memory":            mem,
+			"ephemeral-storage": scratch,
+		},
+		Limits: map[string]string{
+			"cpu":    cpu,
+			"memory": mem,
+		},
+	}
+	if n := need.GPUs; n > 0 {
+		var name string
+		switch stack := ctr.RuntimeConstraints.GPU.Stack; stack {
+		case "cuda":
+			name = kc.CUDAResourceName
+		case "rocm":
+			name = kc.ROCmResourceName
+		default:
+			return pod{}, fmt.Errorf("unsupported GPU stack %q", stack)
+		}
+		if name == "" {
+			return pod{}, fmt.Errorf("no Kubernetes resource name configured for GPU stack %q", ctr.RuntimeConstraints.GPU.Stack)
+		}
+		res.Limits[name] = fmt.Sprintf("%d", n)
+	}
+
+	var deadline int64
+	maxruntime := time.Duration(ctr.SchedulingParameters.MaxRunTime) * time.Second
+	if maxruntime == 0 {
+		maxruntime = kc.MaxRunTimeDefault.Duration()
+	}
+	if maxruntime > 0 {
+		maxruntime += kc.MaxRunTimeOverhead.Duration()
+		deadline = int64(math.Ceil(maxruntime.Seconds()))
+	}
+
+	env := []envVar{{Name: "ARVADOS_API_HOST", Value: disp.ArvClient.APIHost}}
+	if disp.ArvClient.Insecure {
+		env = append(env, envVar{Name: "ARVADOS_API_HOST_INSECURE", Value: "1"})
+	}
+
+	name := podName(ctr.UUID)
+	var crArgs []string
+	crArgs = append(crArgs, crunchRunCommand...)
+	crArgs = append(crArgs, ctr.UUID)
+	return pod{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Metadata: objectMeta{
+			Name: name,
+			Labels: map[string]string{
+				labelManagedBy:     managedByValue,
+				labelContainerUUID: ctr.UUID,
+			},
+		},
+		Spec: podSpec{
+			RestartPolicy:         "Never",
+			ServiceAccountName:    kc.ServiceAccountName,
+			NodeSelector:          kc.NodeSelector,
+			ActiveDeadlineSeconds: deadline,
+			Containers: []podContainer{{
+				Name:            "crunch-run",
+				Image:           kc.Image,
+				ImagePullPolicy: kc.ImagePullPolicy,
+				Command:         crArgs,
+				Env:             env,
+				EnvFrom:         []envFromSource{{SecretRef: &secretRef{Name: name}}},
+				Resources:       res,
+				SecurityContext: &securityContext{Privileged: kc.Privileged},
+				VolumeMounts:    []volumeMount{{Name: "tmp", MountPath: "/tmp"}},
+			}},
+			Volumes: []volume{{
+				Name:     "tmp",
+				EmptyDir: &emptyDirSource{SizeLimit: scratch},
+			}},
+		},
+	}, nil
+}
+
+// Check the next pod list, and invoke TrackContainer for all the
+// containers in the list. This gives us a chance to delete pods
+// (started by a previous dispatch process) whose container states
+// are Cancelled or Complete.
+func (disp *dispatcher) checkPodsForOrphans() {
+	containerUuidPattern := regexp.MustCompile(`^[a-z0-9]{5}-dz642-[a-z0-9]{15}$`)
+	for _, uuid := range disp.kubequeue.All() {
+		if !containerUuidPattern.MatchString(uuid) || !strings.HasPrefix(uuid, disp.Cluster.ClusterID) {
+			continue
+		}
+		err := disp.arvDispatcher.TrackContainer(uuid)
+		if err != nil {
+			disp.logger.Warnf("checkPodsForOrphans: TrackContainer(%s): %s", uuid, err)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package kubernetes
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.arvados.org/arvados.git/lib/config"
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/arvadostest"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(&podSuite{})
+
+// podSuite tests pod spec generation without an Arvados API server.
+type podSuite struct {
+	disp *dispatcher
+}
+
+func (s *podSuite) SetUpTest(c *check.C) {
+	cluster := &arvados.Cluster{SystemRootToken: "xyzzy"}
+	cluster.Containers.ReserveExtraRAM = 256 << 20
+	cluster.Containers.Kubernetes.Image = "example/crunch-run:latest"
+	cluster.Containers.Kubernetes.ImagePullPolicy = "IfNotPresent"
+	cluster.Containers.Kubernetes.Privileged = true
+	cluster.Containers.Kubernetes.CUDAResourceName = "nvidia.com/gpu"
+	cluster.Containers.Kubernetes.ROCmResourceName = "amd.com/gpu"
+	cluster.Containers.Kubernetes.MaxRunTimeOverhead = arvados.Duration(5 * time.Minute)
+	s.disp = &dispatcher{
+		Cluster:   cluster,
+		ArvClient: &arvados.Client{APIHost: "zzzzz.example.com", AuthToken: "xyzzy"},
+	}
+}
+
+func (s *podSuite) TestPodSpec(c *check.C) {
+	ctr := arvados.Container{
+		UUID: "zzzzz-dz642-abcdeabcdeabcde",
+		RuntimeConstraints: arvados.RuntimeConstraints{
+			RAM:          1 << 30,
+			KeepCacheRAM: 256 << 20,
+			VCPUs:        2,
+		},
+		Mounts: map[string]arvados.Mount{
+			"/tmp": {Kind: "tmp", Capacity: 1 << 30},
+		},
+	}
+	p, err := s.disp.pod(ctr, []string{"crunch-run", "--runtime-engine=singularity"})
+	c.Assert(err, check.IsNil)
+	c.Check(p.Metadata.Name, check.Equals, "crunch-run-zzzzz-dz642-abcdeabcdeabcde")
+	c.Check(p.Metadata.Labels, check.DeepEquals, map[string]string{
+		"app.kubernetes.io/managed-by": "arvados-dispatch-kubernetes",
+		"arvados.org/container-uuid":   ctr.UUID,
+	})
+	c.Check(p.Spec.RestartPolicy, check.Equals, "Never")
+	c.Check(p.Spec.ActiveDeadlineSeconds, check.Equals, int64(0))
+	c.Assert(p.Spec.Containers, check.HasLen, 1)
+	pc := p.Spec.Containers[0]
+	c.Check(pc.Image, check.Equals, "example/crunch-run:latest")
+	c.Check(pc.Command, check.DeepEquals, []string{"crunch-run", "--runtime-engine=singularity", ctr.UUID})
+	c.Check(pc.Env, check.DeepEquals, []envVar{{Name: "ARVADOS_API_HOST", Value: "zzzzz.example.com"}})
+	c.Check(pc.EnvFrom, check.DeepEquals, []envFromSource{{SecretRef: &secretRef{Name: p.Metadata.Name}}})
+	c.Check(pc.SecurityContext.Privileged, check.Equals, true)
+
+	// RAM: (1 GiB + 256 MiB cache + 256 MiB reserved) / 0.95
+	// Scratch: 1 GiB tmp (no docker image to account for)
+	c.Check(pc.Resources, check.DeepEquals, resources{
+		Requests: map[string]string{
+			"cpu":               "2",
+			"memory":            "1695381827",
+			"ephemeral-storage": "1073741824",
+		},
+		Limits: map[string]string{
+			"cpu":    "2",
+			"memory": "1695381827",
+		},
+	})
+	c.Check(p.Spec.Volumes, check.DeepEquals, []volume{{
+		Name:     "tmp",
+		EmptyDir: &emptyDirSource{SizeLimit: "1073741824"},
+	}})
+	c.Check(pc.VolumeMounts, check.DeepEquals, []volumeMount{{Name: "tmp", MountPath: "/tmp"}})
+}
+
+func (s *podSuite) TestPodSpecGPU(c *check.C) {
+	for _, trial := range []struct {
+		stack    string
+		resource string
+	}{
+		{"cuda", "nvidia.com/gpu"},
+		{"rocm", "amd.com/gpu"},
+	} {
+		p, err := s.disp.pod(arvados.Container{
+			UUID: "zzzzz-dz642-abcdeabcdeabcde",
+			RuntimeConstraints: arvados.RuntimeConstraints{
+				RAM:   1 << 30,
+				VCPUs: 4,
+				GPU: arvados.GPURuntimeConstraints{
+					Stack:       trial.stack,
+					DeviceCount: 2,
+				},
+			},
+		}, []string{"crunch-run"})
+		c.Assert(err, check.IsNil)
+		c.Check(p.Spec.Containers[0].Resources.Limits[trial.resource], check.Equals, "2")
+	}
+
+	s.disp.Cluster.Containers.Kubernetes.ROCmResourceName = ""
+	_, err := s.disp.pod(arvados.Container{
+		RuntimeConstraints: arvados.RuntimeConstraints{
+			GPU: arvados.GPURuntimeConstraints{Stack: "rocm", DeviceCount: 1},
+		},
+	}, []string{"crunch-run"})
+	c.Check(err, check.ErrorMatches, `no Kubernetes resource name configured for GPU stack "rocm"`)
+}
+
+func (s *podSuite) TestPodSpecMaxRunTime(c *check.C) {
+	ctr := arvados.Container{
+		SchedulingParameters: arvados.SchedulingParameters{MaxRunTime: 124},
+	}
+	p, err := s.disp.pod(ctr, []string{"crunch-run"})
+	c.Assert(err, check.IsNil)
+	c.Check(p.Spec.ActiveDeadlineSeconds, check.Equals, int64(124+300))
+
+	ctr.SchedulingParameters.MaxRunTime = 0
+	s.disp.Cluster.Containers.Kubernetes.MaxRunTimeDefault = arvados.Duration(time.Hour)
+	p, err = s.disp.pod(ctr, []string{"crunch-run"})
+	c.Assert(err, check.IsNil)
+	c.Check(p.Spec.ActiveDeadlineSeconds, check.Equals, int64(3600+300))
+}
+
+func (s *podSuite) TestPodSpecNoImage(c *check.C) {
+	s.disp.Cluster.Containers.Kubernetes.Image = ""
+	_, err := s.disp.pod(arvados.Container{}, []string{"crunch-run"})
+	c.Check(err, check.ErrorMatches, `Containers.Kubernetes.Image is not configured`)
+}
+
+var _ = check.Suite(&suite{})
+
+// suite tests the dispatcher with a fake Kubernetes API server and
+// a real Arvados API server.
+type suite struct {
+	disp     *dispatcher
+	kubeapi  *fakeKubeAPI
+	kubesrv  *httptest.Server
+	crTooBig arvados.ContainerRequest
+}
+
+func (s *suite) TearDownTest(c *check.C) {
+	s.disp.Close()
+	s.kubesrv.Close()
+	arvadostest.ResetDB(c)
+}
+
+func (s *suite) SetUpTest(c *check.C) {
+	arvadostest.ResetDB(c)
+
+	s.kubeapi = &fakeKubeAPI{Token: "testtoken", Namespace: "arvados"}
+	s.kubesrv = httptest.NewServer(s.kubeapi)
+	tokenFile := filepath.Join(c.MkDir(), "token")
+	c.Assert(os.WriteFile(tokenFile, []byte("testtoken"), 0600), check.IsNil)
+
+	cfg, err := config.NewLoader(nil, ctxlog.TestLogger(c)).Load()
+	c.Assert(err, check.IsNil)
+	cluster, err := cfg.GetCluster("")
+	c.Assert(err, check.IsNil)
+	cluster.Containers.CloudVMs.PollInterval = arvados.Duration(time.Second / 4)
+	cluster.Containers.MinRetryPeriod = arvados.Duration(time.Second / 4)
+	cluster.Containers.Kubernetes.APIServerURL = s.kubesrv.URL
+	cluster.Containers.Kubernetes.BearerTokenFile = tokenFile
+	cluster.Containers.Kubernetes.Namespace = "arvados"
+	cluster.Containers.Kubernetes.Image = "example/crunch-run:latest"
+	cluster.InstanceTypes = arvados.InstanceTypeMap{
+		"biggest_available_node": arvados.InstanceType{
+			RAM:             100 << 30, // 100 GiB
+			VCPUs:           4,
+			IncludedScratch: 100 << 30,
+			Scratch:         100 << 30,
+		}}
+	s.disp = newHandler(context.Background(), cluster, arvadostest.SystemRootToken, prometheus.NewRegistry()).(*dispatcher)
+
+	err = arvados.NewClientFromEnv().RequestAndDecode(&s.crTooBig, "POST", "arvados/v1/container_requests", nil, map[string]interface{}{
+		"container_request": map[string]interface{}{
+			"runtime_constraints": arvados.RuntimeConstraints{
+				RAM:   1000000000000,
+				VCPUs: 1,
+			},
+			"container_image":     arvadostest.DockerImage112PDH,
+			"command":             []string{"sleep", "1"},
+			"mounts":              map[string]arvados.Mount{"/mnt/out": {Kind: "tmp", Capacity: 1000}},
+			"output_path":         "/mnt/out",
+			"state":               arvados.ContainerRequestStateCommitted,
+			"priority":            1,
+			"container_count_max": 1,
+		},
+	})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *suite) TestSubmit(c *check.C) {
+	s.disp.Start()
+
+	deadline := time.Now().Add(20 * time.Second)
+	for range time.NewTicker(time.Second).C {
+		if time.Now().After(deadline) {
+			c.Error("timed out")
+			break
+		}
+		// "crTooBig" should never be submitted because it is
+		// bigger than any configured instance type
+		if ent, ok := s.disp.kubequeue.Lookup(s.crTooBig.ContainerUUID); ok {
+			c.Errorf("Lookup(crTooBig) == true, ent = %#v", ent)
+			break
+		}
+		// "queuedcontainer" should have a pod and a secret
+		ent, ok := s.disp.kubequeue.Lookup(arvadostest.QueuedContainerUUID)
+		if !ok {
+			c.Log("Lookup(queuedcontainer) == false")
+			continue
+		}
+		sec, ok := s.kubeapi.Secret(ent.Name)
+		if !ok {
+			c.Logf("no secret for pod %s", ent.Name)
+			continue
+		}
+		c.Check(sec.StringData["ARVADOS_API_TOKEN"], check.Equals, arvadostest.SystemRootToken)
+		c.Check(sec.Metadata.OwnerReferences, check.DeepEquals, []ownerReference{{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Name:       ent.Name,
+			UID:        ent.UID,
+		}})
+		// "lockedcontainer" should be cancelled because it
+		// has priority 0 (no matching container requests)
+		if ent, ok := s.disp.kubequeue.Lookup(arvadostest.LockedContainerUUID); ok {
+			c.Logf("Lookup(lockedcontainer) == true, ent = %#v", ent)
+			continue
+		}
+		var ctr arvados.Container
+		if err := s.disp.arvDispatcher.Arv.Get("containers", arvadostest.LockedContainerUUID, nil, &ctr); err != nil {
+			c.Logf("error getting container state for %s: %s", arvadostest.LockedContainerUUID, err)
+			continue
+		} else if ctr.State != arvados.ContainerStateQueued {
+			c.Logf("LockedContainer has no pod but its arvados record has not been updated to state==Queued (state is %q)", ctr.State)
+			continue
+		}
+
+		if err := s.disp.arvDispatcher.Arv.Get("containers", s.crTooBig.ContainerUUID, nil, &ctr); err != nil {
+			c.Logf("error getting container state for %s: %s", s.crTooBig.ContainerUUID, err)
+			continue
+		} else if ctr.State != arvados.ContainerStateCancelled {
+			c.Logf("container %s has no pod but its arvados record has not been updated to state==Cancelled (state is %q)", s.crTooBig.ContainerUUID, ctr.State)
+			continue
+		} else {
+			c.Check(ctr.RuntimeStatus["error"], check.Equals, "constraints not satisfiable by any configured instance type")
+		}
+		c.Log("reached desired state")
+		break
+	}
+}
+
+func (s *suite) TestPodFailed(c *check.C) {
+	// Simulate crunch-run starting the container, then the pod
+	// being killed by Kubernetes.
+	s.kubeapi.onCreatePod = func(p *pod) {
+		if p.Metadata.Labels[labelContainerUUID] != arvadostest.QueuedContainerUUID {
+			return
+		}
+		go func(name string) {
+			client := arvados.NewClientFromEnv()
+			client.AuthToken = arvadostest.SystemRootToken
+			err := client.RequestAndDecode(nil, "PATCH", "arvados/v1/containers/"+arvadostest.QueuedContainerUUID, nil, map[string]interface{}{
+				"container": map[string]interface{}{"state": arvados.ContainerStateRunning},
+			})
+			c.Check(err, check.IsNil)
+			s.kubeapi.SetPodStatus(name, podStatus{
+				Phase: "Failed",
+				ContainerStatuses: []containerStatus{{
+					Name: "crunch-run",
+					State: containerState{Terminated: &containerStateTerminated{
+						ExitCode: 137,
+						Reason:   "OOMKilled",
+					}},
+				}},
+			})
+		}(p.Metadata.Name)
+	}
+	s.disp.Start()
+
+	deadline := time.Now().Add(20 * time.Second)
+	for range time.NewTicker(time.Second).C {
+		if time.Now().After(deadline) {
+			c.Error("timed out")
+			break
+		}
+		var ctr arvados.Container
+		if err := s.disp.arvDispatcher.Arv.Get("containers", arvadostest.QueuedContainerUUID, nil, &ctr); err != nil {
+			c.Logf("error getting container state: %s", err)
+			continue
+		} else if ctr.State != arvados.ContainerStateCancelled {
+			c.Logf("container state is %q", ctr.State)
+			continue
+		}
+		c.Check(ctr.RuntimeStatus["error"], check.Matches, `Kubernetes pod crunch-run-.* failed: crunch-run OOMKilled \(exit code 137\)`)
+		if _, ok := s.kubeapi.Pod(podName(arvadostest.QueuedContainerUUID)); ok {
+			c.Log("pod has not been deleted yet")
+			continue
+		}
+		break
+	}
+}
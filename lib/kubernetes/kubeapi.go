@@ -0,0 +1,332 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+// Location of the service account credentials that Kubernetes
+// provides to pods. Used when APIServerURL is not configured.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Subset of the Kubernetes v1 API object schemas used by the
+// dispatcher.
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	UID             string            `json:"uid,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	OwnerReferences []ownerReference  `json:"ownerReferences,omitempty"`
+}
+
+type ownerReference struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
+}
+
+type pod struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   objectMeta `json:"metadata"`
+	Spec       podSpec    `json:"spec"`
+	Status     podStatus  `json:"status"`
+}
+
+type podSpec struct {
+	RestartPolicy         string            `json:"restartPolicy"`
+	ServiceAccountName    string            `json:"serviceAccountName,omitempty"`
+	NodeSelector          map[string]string `json:"nodeSelector,omitempty"`
+	ActiveDeadlineSeconds int64             `json:"activeDeadlineSeconds,omitempty"`
+	Containers            []podContainer    `json:"containers"`
+	Volumes               []volume          `json:"volumes,omitempty"`
+}
+
+type podContainer struct {
+	Name            string           `json:"name"`
+	Image           string           `json:"image"`
+	ImagePullPolicy string           `json:"imagePullPolicy,omitempty"`
+	Command         []string         `json:"command"`
+	Env             []envVar         `json:"env,omitempty"`
+	EnvFrom         []envFromSource  `json:"envFrom,omitempty"`
+	Resources       resources        `json:"resources"`
+	SecurityContext *securityContext `json:"securityContext,omitempty"`
+	VolumeMounts    []volumeMount    `json:"volumeMounts,omitempty"`
+}
+
+type envVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type envFromSource struct {
+	SecretRef *secretRef `json:"secretRef,omitempty"`
+}
+
+type secretRef struct {
+	Name string `json:"name"`
+}
+
+type resources struct {
+	Requests map[string]string `json:"requests,omitempty"`
+	Limits   map[string]string `json:"limits,omitempty"`
+}
+
+type securityContext struct {
+	Privileged bool `json:"privileged"`
+}
+
+type volume struct {
+	Name     string          `json:"name"`
+	EmptyDir *emptyDirSource `json:"emptyDir,omitempty"`
+}
+
+type emptyDirSource struct {
+	SizeLimit string `json:"sizeLimit,omitempty"`
+}
+
+type volumeMount struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+}
+
+type podStatus struct {
+	Phase             string            `json:"phase,omitempty"`
+	Reason            string            `json:"reason,omitempty"`
+	Message           string            `json:"message,omitempty"`
+	ContainerStatuses []containerStatus `json:"containerStatuses,omitempty"`
+}
+
+type containerStatus struct {
+	Name  string         `json:"name"`
+	State containerState `json:"state"`
+}
+
+type containerState struct {
+	Waiting    *containerStateReason     `json:"waiting,omitempty"`
+	Terminated *containerStateTerminated `json:"terminated,omitempty"`
+}
+
+type containerStateReason struct {
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type containerStateTerminated struct {
+	ExitCode int    `json:"exitCode"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+type podList struct {
+	Items []pod `json:"items"`
+}
+
+type secret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   objectMeta        `json:"metadata"`
+	StringData map[string]string `json:"stringData"`
+}
+
+// statusError is the error returned by the Kubernetes API server,
+// e.g., {"kind":"Status","status":"Failure","reason":"NotFound",...}.
+type statusError struct {
+	HTTPStatus int    `json:"-"`
+	Status     string `json:"status"`
+	Reason     string `json:"reason"`
+	Message    string `json:"message"`
+}
+
+func (e *statusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%d %s: %s", e.HTTPStatus, e.Reason, e.Message)
+	}
+	return fmt.Sprintf("%d %s", e.HTTPStatus, http.StatusText(e.HTTPStatus))
+}
+
+func isNotFound(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.HTTPStatus == http.StatusNotFound
+}
+
+// kubeClient is a minimal client for the Kubernetes REST API,
+// sufficient to manage crunch-run pods in a single namespace.
+type kubeClient struct {
+	logger     logrus.FieldLogger
+	baseURL    *url.URL
+	namespace  string
+	tokenFile  string
+	httpClient *http.Client
+}
+
+// newKubeClient returns a kubeClient configured according to
+// cluster.Containers.Kubernetes. If APIServerURL is empty, it uses
+// the in-cluster configuration provided by Kubernetes to pods.
+func newKubeClient(cluster *arvados.Cluster, logger logrus.FieldLogger) (*kubeClient, error) {
+	kc := cluster.Containers.Kubernetes
+	cli := &kubeClient{
+		logger:    logger,
+		namespace: kc.Namespace,
+		tokenFile: kc.BearerTokenFile,
+	}
+	caFile := kc.CACertificateFile
+	apiURL := kc.APIServerURL
+	if apiURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("Containers.Kubernetes.APIServerURL is not configured, and KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT environment variables are not set")
+		}
+		apiURL = "https://" + net.JoinHostPort(host, port)
+		if cli.tokenFile == "" {
+			cli.tokenFile = serviceAccountDir + "/token"
+		}
+		if caFile == "" {
+			caFile = serviceAccountDir + "/ca.crt"
+		}
+		if cli.namespace == "" {
+			buf, err := os.ReadFile(serviceAccountDir + "/namespace")
+			if err != nil {
+				return nil, fmt.Errorf("Containers.Kubernetes.Namespace is not configured, and could not read service account namespace: %w", err)
+			}
+			cli.namespace = strings.TrimSpace(string(buf))
+		}
+	}
+	if cli.namespace == "" {
+		cli.namespace = "default"
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing Kubernetes API server URL %q: %w", apiURL, err)
+	}
+	cli.baseURL = u
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: kc.InsecureSkipVerify}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading Kubernetes CA certificate: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	cli.httpClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+	return cli, nil
+}
+
+// CreatePod creates the given pod and returns the pod object
+// returned by the API server (which includes the new pod's UID).
+func (cli *kubeClient) CreatePod(ctx context.Context, p pod) (pod, error) {
+	cli.logger.Infof("CreatePod(%s)", p.Metadata.Name)
+	var created pod
+	err := cli.request(ctx, "POST", cli.path("pods", ""), nil, p, &created)
+	return created, err
+}
+
+// ListPods returns all pods in the namespace that match the given
+// label selector.
+func (cli *kubeClient) ListPods(ctx context.Context, labelSelector string) ([]pod, error) {
+	cli.logger.Debugf("ListPods(%s)", labelSelector)
+	var resp podList
+	err := cli.request(ctx, "GET", cli.path("pods", ""), url.Values{"labelSelector": {labelSelector}}, nil, &resp)
+	return resp.Items, err
+}
+
+// DeletePod deletes the named pod. It is not an error if the pod
+// does not exist.
+func (cli *kubeClient) DeletePod(ctx context.Context, name string) error {
+	cli.logger.Infof("DeletePod(%s)", name)
+	err := cli.request(ctx, "DELETE", cli.path("pods", name), nil, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// CreateSecret creates the given secret.
+func (cli *kubeClient) CreateSecret(ctx context.Context, s secret) error {
+	cli.logger.Infof("CreateSecret(%s)", s.Metadata.Name)
+	return cli.request(ctx, "POST", cli.path("secrets", ""), nil, s, nil)
+}
+
+func (cli *kubeClient) path(resource, name string) string {
+	p := "/api/v1/namespaces/" + url.PathEscape(cli.namespace) + "/" + resource
+	if name != "" {
+		p += "/" + url.PathEscape(name)
+	}
+	return p
+}
+
+func (cli *kubeClient) request(ctx context.Context, method, path string, query url.Values, body, resp interface{}) error {
+	u := *cli.baseURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = query.Encode()
+	var reqBody io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cli.tokenFile != "" {
+		// Read the token every time, because service
+		// account tokens are rotated periodically.
+		token, err := os.ReadFile(cli.tokenFile)
+		if err != nil {
+			return fmt.Errorf("error reading Kubernetes API token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	res, err := cli.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		se := &statusError{HTTPStatus: res.StatusCode}
+		buf, _ := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+		json.Unmarshal(buf, se)
+		return fmt.Errorf("%s %s: %w", method, path, se)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
@@ -0,0 +1,290 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"gopkg.in/check.v1"
+)
+
+// fakeKubeAPI is a minimal in-memory implementation of the parts of
+// the Kubernetes API used by the dispatcher.
+type fakeKubeAPI struct {
+	Token     string
+	Namespace string
+
+	mtx     sync.Mutex
+	nextUID int
+	pods    map[string]*pod
+	secrets map[string]*secret
+	// If non-nil, called when a pod is created, e.g., to
+	// simulate the pod running to completion.
+	onCreatePod func(*pod)
+}
+
+func (api *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+api.Token {
+		api.errorResponse(w, http.StatusUnauthorized, "Unauthorized", "")
+		return
+	}
+	prefix := "/api/v1/namespaces/" + api.Namespace + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		api.errorResponse(w, http.StatusNotFound, "NotFound", r.URL.Path)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	switch {
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "pods":
+		var p pod
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			api.errorResponse(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		if _, exists := api.pods[p.Metadata.Name]; exists {
+			api.errorResponse(w, http.StatusConflict, "AlreadyExists", p.Metadata.Name)
+			return
+		}
+		api.nextUID++
+		p.Metadata.Namespace = api.Namespace
+		p.Metadata.UID = fmt.Sprintf("uid-%d", api.nextUID)
+		p.Status = podStatus{Phase: "Pending"}
+		if api.pods == nil {
+			api.pods = map[string]*pod{}
+		}
+		api.pods[p.Metadata.Name] = &p
+		if api.onCreatePod != nil {
+			api.onCreatePod(&p)
+		}
+		json.NewEncoder(w).Encode(p)
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "pods":
+		var resp podList
+		k, v, _ := strings.Cut(r.FormValue("labelSelector"), "=")
+		for _, p := range api.pods {
+			if k == "" || p.Metadata.Labels[k] == v {
+				resp.Items = append(resp.Items, *p)
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "pods":
+		p, ok := api.pods[parts[1]]
+		if !ok {
+			api.errorResponse(w, http.StatusNotFound, "NotFound", parts[1])
+			return
+		}
+		delete(api.pods, parts[1])
+		// Garbage-collect secrets owned by the pod.
+		for name, s := range api.secrets {
+			for _, ref := range s.Metadata.OwnerReferences {
+				if ref.UID == p.Metadata.UID {
+					delete(api.secrets, name)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(p)
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "secrets":
+		var s secret
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			api.errorResponse(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		if api.secrets == nil {
+			api.secrets = map[string]*secret{}
+		}
+		api.secrets[s.Metadata.Name] = &s
+		json.NewEncoder(w).Encode(s)
+	default:
+		api.errorResponse(w, http.StatusNotFound, "NotFound", r.URL.Path)
+	}
+}
+
+func (api *fakeKubeAPI) errorResponse(w http.ResponseWriter, code int, reason, message string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(statusError{Status: "Failure", Reason: reason, Message: message})
+}
+
+// Pod returns a copy of the named pod.
+func (api *fakeKubeAPI) Pod(name string) (pod, bool) {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	p, ok := api.pods[name]
+	if !ok {
+		return pod{}, false
+	}
+	return *p, true
+}
+
+// Secret returns a copy of the named secret.
+func (api *fakeKubeAPI) Secret(name string) (secret, bool) {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	s, ok := api.secrets[name]
+	if !ok {
+		return secret{}, false
+	}
+	return *s, true
+}
+
+// SetPodStatus replaces the status of the named pod.
+func (api *fakeKubeAPI) SetPodStatus(name string, status podStatus) {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	if p, ok := api.pods[name]; ok {
+		p.Status = status
+	}
+}
+
+var _ = check.Suite(&kubeClientSuite{})
+
+type kubeClientSuite struct {
+	api     *fakeKubeAPI
+	srv     *httptest.Server
+	cluster *arvados.Cluster
+}
+
+func (s *kubeClientSuite) SetUpTest(c *check.C) {
+	s.api = &fakeKubeAPI{Token: "testtoken", Namespace: "testns"}
+	s.srv = httptest.NewServer(s.api)
+	tokenFile := filepath.Join(c.MkDir(), "token")
+	c.Assert(os.WriteFile(tokenFile, []byte("testtoken\n"), 0600), check.IsNil)
+	s.cluster = &arvados.Cluster{}
+	s.cluster.Containers.Kubernetes.APIServerURL = s.srv.URL
+	s.cluster.Containers.Kubernetes.BearerTokenFile = tokenFile
+	s.cluster.Containers.Kubernetes.Namespace = "testns"
+}
+
+func (s *kubeClientSuite) TearDownTest(c *check.C) {
+	s.srv.Close()
+}
+
+func (s *kubeClientSuite) TestCreateListDelete(c *check.C) {
+	cli, err := newKubeClient(s.cluster, ctxlog.TestLogger(c))
+	c.Assert(err, check.IsNil)
+	ctx := context.Background()
+
+	for _, name := range []string{"pod1", "pod2"} {
+		created, err := cli.CreatePod(ctx, pod{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Metadata: objectMeta{
+				Name:   name,
+				Labels: map[string]string{labelManagedBy: managedByValue},
+			},
+		})
+		c.Assert(err, check.IsNil)
+		c.Check(created.Metadata.UID, check.Not(check.Equals), "")
+		c.Check(created.Status.Phase, check.Equals, "Pending")
+	}
+	_, err = cli.CreatePod(ctx, pod{Metadata: objectMeta{Name: "unmanaged"}})
+	c.Assert(err, check.IsNil)
+
+	pods, err := cli.ListPods(ctx, labelManagedBy+"="+managedByValue)
+	c.Assert(err, check.IsNil)
+	c.Check(pods, check.HasLen, 2)
+
+	_, err = cli.CreatePod(ctx, pod{Metadata: objectMeta{Name: "pod1"}})
+	c.Check(err, check.ErrorMatches, `.*409 AlreadyExists.*`)
+
+	c.Check(cli.DeletePod(ctx, "pod1"), check.IsNil)
+	// Deleting a nonexistent pod is not an error
+	c.Check(cli.DeletePod(ctx, "pod1"), check.IsNil)
+	pods, err = cli.ListPods(ctx, labelManagedBy+"="+managedByValue)
+	c.Assert(err, check.IsNil)
+	c.Assert(pods, check.HasLen, 1)
+	c.Check(pods[0].Metadata.Name, check.Equals, "pod2")
+}
+
+func (s *kubeClientSuite) TestBadToken(c *check.C) {
+	s.api.Token = "othertoken"
+	cli, err := newKubeClient(s.cluster, ctxlog.TestLogger(c))
+	c.Assert(err, check.IsNil)
+	_, err = cli.ListPods(context.Background(), "")
+	c.Check(err, check.ErrorMatches, `.*401 Unauthorized.*`)
+	c.Check(isNotFound(err), check.Equals, false)
+}
+
+func (s *kubeClientSuite) TestInClusterConfig(c *check.C) {
+	tlssrv := httptest.NewTLSServer(s.api)
+	defer tlssrv.Close()
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(tlssrv.URL, "https://"))
+	c.Assert(err, check.IsNil)
+
+	dir := c.MkDir()
+	defer func(orig string) { serviceAccountDir = orig }(serviceAccountDir)
+	serviceAccountDir = dir
+	c.Assert(os.WriteFile(filepath.Join(dir, "token"), []byte("testtoken"), 0600), check.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dir, "namespace"), []byte("testns\n"), 0600), check.IsNil)
+
+	s.cluster.Containers.Kubernetes.APIServerURL = ""
+	s.cluster.Containers.Kubernetes.BearerTokenFile = ""
+	s.cluster.Containers.Kubernetes.Namespace = ""
+
+	for _, k := range []string{"KUBERNETES_SERVICE_HOST", "KUBERNETES_SERVICE_PORT"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Unsetenv(k)
+	}
+	_, err = newKubeClient(s.cluster, ctxlog.TestLogger(c))
+	c.Check(err, check.ErrorMatches, `.*KUBERNETES_SERVICE_HOST.*`)
+
+	os.Setenv("KUBERNETES_SERVICE_HOST", host)
+	os.Setenv("KUBERNETES_SERVICE_PORT", port)
+	_, err = newKubeClient(s.cluster, ctxlog.TestLogger(c))
+	c.Check(err, check.ErrorMatches, `error reading Kubernetes CA certificate: .*`)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlssrv.Certificate().Raw})
+	c.Assert(os.WriteFile(filepath.Join(dir, "ca.crt"), certPEM, 0600), check.IsNil)
+	cli, err := newKubeClient(s.cluster, ctxlog.TestLogger(c))
+	c.Assert(err, check.IsNil)
+	c.Check(cli.namespace, check.Equals, "testns")
+	_, err = cli.ListPods(context.Background(), "")
+	c.Check(err, check.IsNil)
+}
+
+func (s *kubeClientSuite) TestPodEntry(c *check.C) {
+	ent := newPodEntry(pod{
+		Metadata: objectMeta{Name: "crunch-run-zzzzz-dz642-000000000000000"},
+		Status: podStatus{
+			Phase: "Failed",
+			ContainerStatuses: []containerStatus{{
+				Name: "crunch-run",
+				State: containerState{Terminated: &containerStateTerminated{
+					ExitCode: 137,
+					Reason:   "OOMKilled",
+				}},
+			}},
+		},
+	})
+	c.Check(ent.Finished(), check.Equals, true)
+	c.Check(ent.FailureMessage(), check.Equals, "Kubernetes pod crunch-run-zzzzz-dz642-000000000000000 failed: crunch-run OOMKilled (exit code 137)")
+
+	ent = newPodEntry(pod{
+		Metadata: objectMeta{Name: "p"},
+		Status:   podStatus{Phase: "Failed", Reason: "DeadlineExceeded", Message: "Pod was active on the node longer than the specified deadline"},
+	})
+	c.Check(ent.FailureMessage(), check.Equals, "Kubernetes pod p failed: DeadlineExceeded: Pod was active on the node longer than the specified deadline")
+
+	for _, phase := range []string{"Pending", "Running", "Unknown"} {
+		ent = newPodEntry(pod{Status: podStatus{Phase: phase}})
+		c.Check(ent.Finished(), check.Equals, false)
+		c.Check(ent.FailureMessage(), check.Equals, "")
+	}
+	ent = newPodEntry(pod{Status: podStatus{Phase: "Succeeded"}})
+	c.Check(ent.Finished(), check.Equals, true)
+	c.Check(ent.FailureMessage(), check.Equals, "")
+}
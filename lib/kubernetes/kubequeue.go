@@ -0,0 +1,175 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Labels applied to every pod created by the dispatcher.
+const (
+	labelManagedBy     = "app.kubernetes.io/managed-by"
+	labelContainerUUID = "arvados.org/container-uuid"
+	managedByValue     = "arvados-dispatch-kubernetes"
+)
+
+// podEntry is the dispatcher's view of a crunch-run pod, as of the
+// most recent queue update.
+type podEntry struct {
+	Name    string
+	UID     string
+	Phase   string
+	Reason  string
+	Message string
+	// Reason and exit code of the crunch-run container, if it
+	// has terminated
+	TerminatedReason string
+	ExitCode         int
+}
+
+func newPodEntry(p pod) podEntry {
+	ent := podEntry{
+		Name:    p.Metadata.Name,
+		UID:     p.Metadata.UID,
+		Phase:   p.Status.Phase,
+		Reason:  p.Status.Reason,
+		Message: p.Status.Message,
+	}
+	for _, cs := range p.Status.ContainerStatuses {
+		if t := cs.State.Terminated; t != nil {
+			ent.TerminatedReason = t.Reason
+			ent.ExitCode = t.ExitCode
+		}
+	}
+	return ent
+}
+
+// Finished returns true if the pod has terminated and will not run
+// (or restart) crunch-run again.
+func (ent podEntry) Finished() bool {
+	return ent.Phase == "Succeeded" || ent.Phase == "Failed"
+}
+
+// FailureMessage returns a description of the reason the pod failed,
+// suitable for the container's runtime_status, or "" if the pod did
+// not fail.
+func (ent podEntry) FailureMessage() string {
+	if ent.Phase != "Failed" {
+		return ""
+	}
+	msg := fmt.Sprintf("Kubernetes pod %s failed", ent.Name)
+	if ent.TerminatedReason != "" {
+		msg += fmt.Sprintf(": crunch-run %s (exit code %d)", ent.TerminatedReason, ent.ExitCode)
+	}
+	if ent.Reason != "" {
+		msg += ": " + ent.Reason
+	}
+	if ent.Message != "" {
+		msg += ": " + ent.Message
+	}
+	return msg
+}
+
+type kubequeue struct {
+	logger  logrus.FieldLogger
+	period  time.Duration
+	kubecli *kubeClient
+
+	initOnce  sync.Once
+	mutex     sync.Mutex
+	nextReady chan (<-chan struct{})
+	latest    map[string]podEntry
+}
+
+// Lookup waits for the next queue update (so even a pod that was
+// only created a nanosecond ago will show up) and then returns the
+// pod information corresponding to the given container UUID.
+func (q *kubequeue) Lookup(uuid string) (podEntry, bool) {
+	ent, ok := q.getNext()[uuid]
+	return ent, ok
+}
+
+// All waits for the next queue update, then returns the container
+// UUIDs of all pods in the queue. Used by checkPodsForOrphans().
+func (q *kubequeue) All() []string {
+	latest := q.getNext()
+	names := make([]string, 0, len(latest))
+	for name := range latest {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (q *kubequeue) SetPriority(uuid string, priority int64) {
+	q.initOnce.Do(q.init)
+	q.logger.Debug("SetPriority is not implemented")
+}
+
+func (q *kubequeue) getNext() map[string]podEntry {
+	q.initOnce.Do(q.init)
+	<-(<-q.nextReady)
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.latest
+}
+
+func (q *kubequeue) init() {
+	q.nextReady = make(chan (<-chan struct{}))
+	ticker := time.NewTicker(q.period)
+	go func() {
+		for range ticker.C {
+			// Send a new "next update ready" channel to
+			// the next goroutine that wants one (and any
+			// others that have already queued up since
+			// the first one started waiting).
+			//
+			// Below, when we get a new update, we'll
+			// signal that to the other goroutines by
+			// closing the ready chan.
+			ready := make(chan struct{})
+			q.nextReady <- ready
+			for {
+				select {
+				case q.nextReady <- ready:
+					continue
+				default:
+				}
+				break
+			}
+			// List pods repeatedly if needed, until we
+			// get a valid response.
+			var pods []pod
+			for {
+				var err error
+				pods, err = q.kubecli.ListPods(context.Background(), labelManagedBy+"="+managedByValue)
+				if err == nil {
+					break
+				}
+				q.logger.Warnf("list pods: %s", err)
+				<-ticker.C
+			}
+			next := make(map[string]podEntry, len(pods))
+			for _, p := range pods {
+				uuid := p.Metadata.Labels[labelContainerUUID]
+				if uuid == "" {
+					continue
+				}
+				next[uuid] = newPodEntry(p)
+			}
+			// Replace q.latest and notify all the
+			// goroutines that the "next update" they
+			// asked for is now ready.
+			q.mutex.Lock()
+			q.latest = next
+			q.mutex.Unlock()
+			close(ready)
+		}
+	}()
+}
@@ -43,6 +43,7 @@ var (
 	EndpointCollectionDelete                = APIEndpoint{"DELETE", "arvados/v1/collections/{uuid}", ""}
 	EndpointCollectionTrash                 = APIEndpoint{"POST", "arvados/v1/collections/{uuid}/trash", ""}
 	EndpointCollectionUntrash               = APIEndpoint{"POST", "arvados/v1/collections/{uuid}/untrash", ""}
+	EndpointCollectionPresignedURL          = APIEndpoint{"POST", "arvados/v1/collections/{uuid}/presigned_url", ""}
 	EndpointComputedPermissionList          = APIEndpoint{"GET", "arvados/v1/computed_permissions", ""}
 	EndpointContainerCreate                 = APIEndpoint{"POST", "arvados/v1/containers", "container"}
 	EndpointContainerUpdate                 = APIEndpoint{"PATCH", "arvados/v1/containers/{uuid}", "container"}
@@ -73,6 +74,7 @@ var (
 	EndpointGroupDelete                     = APIEndpoint{"DELETE", "arvados/v1/groups/{uuid}", ""}
 	EndpointGroupTrash                      = APIEndpoint{"POST", "arvados/v1/groups/{uuid}/trash", ""}
 	EndpointGroupUntrash                    = APIEndpoint{"POST", "arvados/v1/groups/{uuid}/untrash", ""}
+	EndpointGroupBudget                     = APIEndpoint{"GET", "arvados/v1/groups/{uuid}/budget", ""}
 	EndpointLinkCreate                      = APIEndpoint{"POST", "arvados/v1/links", "link"}
 	EndpointLinkUpdate                      = APIEndpoint{"PATCH", "arvados/v1/links/{uuid}", "link"}
 	EndpointLinkGet                         = APIEndpoint{"GET", "arvados/v1/links/{uuid}", ""}
@@ -152,6 +154,13 @@ type UntrashOptions struct {
 	EnsureUniqueName bool   `json:"ensure_unique_name"`
 }
 
+type PresignedURLOptions struct {
+	UUID      string `json:"uuid"`
+	Path      string `json:"path"`
+	Method    string `json:"method"`     // "GET" (default) or "PUT"
+	ExpiresIn int64  `json:"expires_in"` // seconds
+}
+
 type ListOptions struct {
 	ClusterID          string                 `json:"cluster_id"`
 	Select             []string               `json:"select"`
@@ -186,9 +195,11 @@ type UpdateOptions struct {
 	Select           []string               `json:"select"`
 	BypassFederation bool                   `json:"bypass_federation"`
 	// ReplaceFiles and ReplaceSegments only apply when updating a
-	// collection.
+	// collection. MergeProperties applies when updating a
+	// collection or a group.
 	ReplaceFiles    map[string]string             `json:"replace_files"`
 	ReplaceSegments map[BlockSegment]BlockSegment `json:"replace_segments"`
+	MergeProperties map[string]interface{}        `json:"merge_properties"`
 }
 
 type GroupContentsOptions struct {
@@ -323,6 +334,7 @@ type API interface {
 	CollectionDelete(ctx context.Context, options DeleteOptions) (Collection, error)
 	CollectionTrash(ctx context.Context, options DeleteOptions) (Collection, error)
 	CollectionUntrash(ctx context.Context, options UntrashOptions) (Collection, error)
+	CollectionPresignedURL(ctx context.Context, options PresignedURLOptions) (PresignedURL, error)
 	ComputedPermissionList(ctx context.Context, options ListOptions) (ComputedPermissionList, error)
 	ContainerCreate(ctx context.Context, options CreateOptions) (Container, error)
 	ContainerUpdate(ctx context.Context, options UpdateOptions) (Container, error)
@@ -351,6 +363,7 @@ type API interface {
 	GroupDelete(ctx context.Context, options DeleteOptions) (Group, error)
 	GroupTrash(ctx context.Context, options DeleteOptions) (Group, error)
 	GroupUntrash(ctx context.Context, options UntrashOptions) (Group, error)
+	GroupBudget(ctx context.Context, options GetOptions) (GroupBudget, error)
 	LinkCreate(ctx context.Context, options CreateOptions) (Link, error)
 	LinkUpdate(ctx context.Context, options UpdateOptions) (Link, error)
 	LinkGet(ctx context.Context, options GetOptions) (Link, error)
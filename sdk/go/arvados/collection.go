@@ -103,6 +103,15 @@ type CollectionList struct {
 	Limit          int          `json:"limit"`
 }
 
+// PresignedURL is a URL that can be used, without any other
+// credentials, to retrieve or upload a single file in a collection
+// until the given expiry time.
+type PresignedURL struct {
+	URL       string    `json:"url"`
+	Method    string    `json:"method"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 // PortableDataHash computes the portable data hash of the given
 // manifest.
 func PortableDataHash(mt string) string {
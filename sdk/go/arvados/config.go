@@ -134,6 +134,8 @@ type Cluster struct {
 		BlobTrashConcurrency         int
 		BlobDeleteConcurrency        int
 		BlobReplicateConcurrency     int
+		BlobScrubInterval            Duration
+		BlobScrubRate                ByteSize
 		CollectionVersioning         bool
 		DefaultTrashLifetime         Duration
 		DefaultReplication           int
@@ -143,6 +145,7 @@ type Cluster struct {
 		TrustAllContent              bool
 		ForwardSlashNameSubstitution string
 		S3FolderObjects              bool
+		S3MultipartUploadTTL         Duration
 
 		BlobMissingReport        string
 		BalancePeriod            Duration
@@ -152,6 +155,7 @@ type Cluster struct {
 		BalanceUpdateLimit       int
 		BalancePullLimit         int
 		BalanceTrashLimit        int
+		BalanceFullIndexInterval Duration
 
 		WebDAVCache WebDAVCacheConfig
 
@@ -287,8 +291,10 @@ type Cluster struct {
 }
 
 type StorageClassConfig struct {
-	Default  bool
-	Priority int
+	Default          bool
+	Priority         int
+	ColdStorageClass string
+	ColdAfter        Duration
 }
 
 type Volume struct {
@@ -299,6 +305,22 @@ type Volume struct {
 	StorageClasses         map[string]bool
 	Driver                 string
 	DriverParameters       json.RawMessage
+	Compression            string
+	CompressionSizeCache   int
+	Encryption             VolumeEncryption
+	Cache                  VolumeCache
+}
+
+type VolumeCache struct {
+	Dir     string
+	MaxSize ByteSizeOrPercent
+}
+
+type VolumeEncryption struct {
+	KeyID             string
+	Keys              map[string]string
+	ReencryptInterval Duration
+	AllowPlaintext    bool
 }
 
 type S3VolumeDriverParameters struct {
@@ -333,6 +355,35 @@ type DirectoryVolumeDriverParameters struct {
 	Serialize bool
 }
 
+type HTTPBlobVolumeDriverParameters struct {
+	Endpoint            string
+	AuthorizationHeader string
+	Insecure            bool
+	IndexPageSize       int
+	ConnectTimeout      Duration
+	ReadTimeout         Duration
+}
+
+type GCSVolumeDriverParameters struct {
+	Bucket          string
+	CredentialsFile string
+	Endpoint        string
+	IndexPageSize   int
+	ConnectTimeout  Duration
+	ReadTimeout     Duration
+}
+
+type ErasureCodedVolumeDriverParameters struct {
+	DataShards   int
+	ParityShards int
+	ShardVolumes []ErasureCodedShardVolume
+}
+
+type ErasureCodedShardVolume struct {
+	Driver           string
+	DriverParameters json.RawMessage
+}
+
 type VolumeAccess struct {
 	ReadOnly bool
 }
@@ -342,6 +393,8 @@ type Services struct {
 	ContainerWebServices ServiceWithPortRange
 	Controller           Service
 	DispatchCloud        Service
+	DispatchCondor       Service
+	DispatchKubernetes   Service
 	DispatchLSF          Service
 	DispatchSLURM        Service
 	Health               Service
@@ -500,6 +553,7 @@ type ContainersConfig struct {
 	SupportedDockerImageFormats   StringSet
 	AlwaysUsePreemptibleInstances bool
 	PreemptiblePriceFactor        float64
+	MaxPreemptibleInterruptions   int
 	MaximumPriceFactor            float64
 	RuntimeEngine                 string
 	LocalKeepBlobBuffersPerVCPU   int
@@ -509,6 +563,11 @@ type ContainersConfig struct {
 		LogUpdatePeriod Duration
 		LogUpdateSize   ByteSize
 	}
+	Budgets struct {
+		Enable          bool
+		Period          string
+		RefreshInterval Duration
+	}
 	ShellAccess struct {
 		Admin bool
 		User  bool
@@ -526,6 +585,29 @@ type ContainersConfig struct {
 		MaxRunTimeOverhead Duration
 		MaxRunTimeDefault  Duration
 	}
+	HTCondor struct {
+		SubmitSudoUser       string
+		SubmitDescription    []string
+		SubmitGPUDescription []string
+		MaxRunTimeOverhead   Duration
+		MaxRunTimeDefault    Duration
+	}
+	Kubernetes struct {
+		APIServerURL       string
+		BearerTokenFile    string
+		CACertificateFile  string
+		InsecureSkipVerify bool
+		Namespace          string
+		Image              string
+		ImagePullPolicy    string
+		Privileged         bool
+		ServiceAccountName string
+		NodeSelector       map[string]string
+		CUDAResourceName   string
+		ROCmResourceName   string
+		MaxRunTimeOverhead Duration
+		MaxRunTimeDefault  Duration
+	}
 }
 
 type CloudVMsConfig struct {
@@ -541,9 +623,14 @@ type CloudVMsConfig struct {
 	MaxProbesPerSecond              int
 	MaxConcurrentInstanceCreateOps  int
 	MaxRunningContainersPerInstance int
+	BinPacking                      bool
 	MaxInstances                    int
 	InitialQuotaEstimate            int
 	SupervisorFraction              float64
+	FairShareMode                   string
+	FairShareHalfLife               Duration
+	FairShares                      map[string]float64
+	GangTimeout                     Duration
 	PollInterval                    Duration
 	ProbeInterval                   Duration
 	SSHPort                         string
@@ -557,11 +644,20 @@ type CloudVMsConfig struct {
 	TimeoutTERM                     Duration
 	ResourceTags                    map[string]string
 	TagKeyPrefix                    string
+	WarmPool                        map[string]WarmPoolConfig
 
 	Driver           string
 	DriverParameters json.RawMessage
 }
 
+// WarmPoolConfig is the cloud dispatcher's warm pool configuration
+// for a single instance type. See WarmPoolConfig.MinIdleAt.
+type WarmPoolConfig struct {
+	MinIdle  int
+	Schedule []string
+	TimeZone string
+}
+
 type InstanceTypeMap map[string]InstanceType
 
 var errDuplicateInstanceTypeName = errors.New("duplicate instance type name")
@@ -642,37 +738,41 @@ func (ss *StringSet) UnmarshalJSON(data []byte) error {
 type ServiceName string
 
 const (
-	ServiceNameController    ServiceName = "arvados-controller"
-	ServiceNameDispatchCloud ServiceName = "arvados-dispatch-cloud"
-	ServiceNameDispatchLSF   ServiceName = "arvados-dispatch-lsf"
-	ServiceNameDispatchSLURM ServiceName = "crunch-dispatch-slurm"
-	ServiceNameHealth        ServiceName = "arvados-health"
-	ServiceNameKeepbalance   ServiceName = "keep-balance"
-	ServiceNameKeepproxy     ServiceName = "keepproxy"
-	ServiceNameKeepstore     ServiceName = "keepstore"
-	ServiceNameKeepweb       ServiceName = "keep-web"
-	ServiceNameRailsAPI      ServiceName = "arvados-api-server"
-	ServiceNameWebsocket     ServiceName = "arvados-ws"
-	ServiceNameWorkbench1    ServiceName = "arvados-workbench1"
-	ServiceNameWorkbench2    ServiceName = "arvados-workbench2"
+	ServiceNameController         ServiceName = "arvados-controller"
+	ServiceNameDispatchCloud      ServiceName = "arvados-dispatch-cloud"
+	ServiceNameDispatchCondor     ServiceName = "arvados-dispatch-condor"
+	ServiceNameDispatchKubernetes ServiceName = "arvados-dispatch-kubernetes"
+	ServiceNameDispatchLSF        ServiceName = "arvados-dispatch-lsf"
+	ServiceNameDispatchSLURM      ServiceName = "crunch-dispatch-slurm"
+	ServiceNameHealth             ServiceName = "arvados-health"
+	ServiceNameKeepbalance        ServiceName = "keep-balance"
+	ServiceNameKeepproxy          ServiceName = "keepproxy"
+	ServiceNameKeepstore          ServiceName = "keepstore"
+	ServiceNameKeepweb            ServiceName = "keep-web"
+	ServiceNameRailsAPI           ServiceName = "arvados-api-server"
+	ServiceNameWebsocket          ServiceName = "arvados-ws"
+	ServiceNameWorkbench1         ServiceName = "arvados-workbench1"
+	ServiceNameWorkbench2         ServiceName = "arvados-workbench2"
 )
 
 // Map returns all services as a map, suitable for iterating over all
 // services or looking up a service by name.
 func (svcs Services) Map() map[ServiceName]Service {
 	return map[ServiceName]Service{
-		ServiceNameController:    svcs.Controller,
-		ServiceNameDispatchCloud: svcs.DispatchCloud,
-		ServiceNameDispatchLSF:   svcs.DispatchLSF,
-		ServiceNameDispatchSLURM: svcs.DispatchSLURM,
-		ServiceNameHealth:        svcs.Health,
-		ServiceNameKeepbalance:   svcs.Keepbalance,
-		ServiceNameKeepproxy:     svcs.Keepproxy,
-		ServiceNameKeepstore:     svcs.Keepstore,
-		ServiceNameKeepweb:       svcs.WebDAV,
-		ServiceNameRailsAPI:      svcs.RailsAPI,
-		ServiceNameWebsocket:     svcs.Websocket,
-		ServiceNameWorkbench1:    svcs.Workbench1,
-		ServiceNameWorkbench2:    svcs.Workbench2,
+		ServiceNameController:         svcs.Controller,
+		ServiceNameDispatchCloud:      svcs.DispatchCloud,
+		ServiceNameDispatchCondor:     svcs.DispatchCondor,
+		ServiceNameDispatchKubernetes: svcs.DispatchKubernetes,
+		ServiceNameDispatchLSF:        svcs.DispatchLSF,
+		ServiceNameDispatchSLURM:      svcs.DispatchSLURM,
+		ServiceNameHealth:             svcs.Health,
+		ServiceNameKeepbalance:        svcs.Keepbalance,
+		ServiceNameKeepproxy:          svcs.Keepproxy,
+		ServiceNameKeepstore:          svcs.Keepstore,
+		ServiceNameKeepweb:            svcs.WebDAV,
+		ServiceNameRailsAPI:           svcs.RailsAPI,
+		ServiceNameWebsocket:          svcs.Websocket,
+		ServiceNameWorkbench1:         svcs.Workbench1,
+		ServiceNameWorkbench2:         svcs.Workbench2,
 	}
 }
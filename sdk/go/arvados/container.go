@@ -121,10 +121,15 @@ type RuntimeConstraints struct {
 // SchedulingParameters specify a container's scheduling parameters
 // such as Partitions
 type SchedulingParameters struct {
-	Partitions  []string `json:"partitions"`
-	Preemptible bool     `json:"preemptible"`
-	MaxRunTime  int      `json:"max_run_time"`
-	Supervisor  bool     `json:"supervisor"`
+	Partitions               []string `json:"partitions"`
+	Preemptible              bool     `json:"preemptible"`
+	MaxRunTime               int      `json:"max_run_time"`
+	Supervisor               bool     `json:"supervisor"`
+	GangID                   string   `json:"gang_id,omitempty"`
+	GangSize                 int      `json:"gang_size,omitempty"`
+	PreemptibleInterruptions int      `json:"preemptible_interruptions,omitempty"`
+	CheckpointOnInterruption bool     `json:"checkpoint_on_interruption,omitempty"`
+	Checkpoint               string   `json:"checkpoint,omitempty"`
 }
 
 // ContainerList is an arvados#containerList resource.
@@ -47,6 +47,37 @@ type ObjectList struct {
 	Limit          int           `json:"limit"`
 }
 
+// GroupBudget is the current spend and configured budget of a
+// project, as returned by the groups/{uuid}/budget API.
+type GroupBudget struct {
+	UUID        string    `json:"uuid"`
+	Limit       float64   `json:"limit"`
+	SoftLimit   float64   `json:"soft_limit"`
+	Spend       float64   `json:"spend"`
+	PeriodStart time.Time `json:"period_start"`
+	// Status is "ok", "warning" (spend has reached SoftLimit), or
+	// "exceeded" (spend has reached Limit). It is empty if no
+	// budget is configured for the project.
+	Status string `json:"status"`
+}
+
+// GroupBudgetProperty is the project property that holds the
+// project's budget. Only admins can set or change it.
+const GroupBudgetProperty = "arv:budget"
+
+// ProjectBudget is the value of a project's GroupBudgetProperty,
+// e.g., {"limit": 1000, "soft_limit": 800}.
+type ProjectBudget struct {
+	Limit     float64 `json:"limit"`
+	SoftLimit float64 `json:"soft_limit"`
+}
+
+const (
+	GroupBudgetStatusOK       = "ok"
+	GroupBudgetStatusWarning  = "warning"
+	GroupBudgetStatusExceeded = "exceeded"
+)
+
 func (g Group) resourceName() string {
 	return "group"
 }
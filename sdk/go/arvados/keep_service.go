@@ -7,6 +7,7 @@ package arvados
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -53,8 +54,19 @@ type KeepServiceIndexEntry struct {
 	SizedDigest
 	// Time of last write, in nanoseconds since Unix epoch
 	Mtime int64
+	// Time of last read, in nanoseconds since Unix epoch, or 0
+	// if unknown (only reported by IndexMountReadTimes)
+	ReadTime int64
+	// Block has been removed from the mount since the time
+	// passed to IndexMountChanges (Mtime is zero)
+	Removed bool
 }
 
+// ErrIndexChangesUnavailable is returned by IndexMountChanges when the
+// keep service cannot report the changes since the requested time,
+// and the caller needs to get a full index instead.
+var ErrIndexChangesUnavailable = errors.New("index of changes is not available")
+
 // EachKeepService calls f once for every readable
 // KeepService. EachKeepService stops if it encounters an
 // error, such as f returning a non-nil error.
@@ -146,25 +158,72 @@ func (s *KeepService) Untrash(ctx context.Context, c *Client, blk string) error
 
 // IndexMount returns an unsorted list of blocks at the given mount point.
 func (s *KeepService) IndexMount(ctx context.Context, c *Client, mountUUID string, prefix string) ([]KeepServiceIndexEntry, error) {
-	return s.index(ctx, c, prefix, s.url("mounts/"+mountUUID+"/blocks?prefix="+prefix))
+	return s.index(ctx, c, prefix, s.url("mounts/"+mountUUID+"/blocks?prefix="+prefix), false)
+}
+
+// IndexMountChanges returns an unsorted list of blocks at the given
+// mount point that were added, touched, or removed since the given
+// time (in nanoseconds since Unix epoch). If since is zero, it
+// returns a full index, like IndexMount.
+//
+// It also returns the time to pass as "since" in the next call to
+// get only the blocks that change after this call, or 0 if the keep
+// service does not support incremental indexes for this mount.
+//
+// If the keep service cannot report the changes since the given
+// time, the returned error wraps ErrIndexChangesUnavailable.
+func (s *KeepService) IndexMountChanges(ctx context.Context, c *Client, mountUUID string, prefix string, since int64) ([]KeepServiceIndexEntry, int64, error) {
+	url := s.url("mounts/" + mountUUID + "/blocks?prefix=" + prefix)
+	if since > 0 {
+		url += "&since=" + strconv.FormatInt(since, 10)
+	}
+	entries, header, err := s.indexWithHeader(ctx, c, prefix, url, false, since > 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	asOf, err := strconv.ParseInt(header.Get("X-Keep-Index-Time"), 10, 64)
+	if err != nil {
+		asOf = 0
+	}
+	return entries, asOf, nil
+}
+
+// IndexMountReadTimes is like IndexMount, but also reports the time
+// each block was last read. It returns an error if the mount does not
+// record read times.
+func (s *KeepService) IndexMountReadTimes(ctx context.Context, c *Client, mountUUID string, prefix string) ([]KeepServiceIndexEntry, error) {
+	return s.index(ctx, c, prefix, s.url("mounts/"+mountUUID+"/readtimes?prefix="+prefix), true)
 }
 
 // Index returns an unsorted list of blocks that can be retrieved from
 // this server.
 func (s *KeepService) Index(ctx context.Context, c *Client, prefix string) ([]KeepServiceIndexEntry, error) {
-	return s.index(ctx, c, prefix, s.url("index/"+prefix))
+	return s.index(ctx, c, prefix, s.url("index/"+prefix), false)
 }
 
-func (s *KeepService) index(ctx context.Context, c *Client, prefix, url string) ([]KeepServiceIndexEntry, error) {
+func (s *KeepService) index(ctx context.Context, c *Client, prefix, url string, readTimes bool) ([]KeepServiceIndexEntry, error) {
+	entries, _, err := s.indexWithHeader(ctx, c, prefix, url, readTimes, false)
+	return entries, err
+}
+
+// indexWithHeader retrieves and parses an index response, and
+// returns the response headers along with the index entries. If
+// changes is true, the response is an index of changes, where
+// removed blocks are listed with mtime "-".
+func (s *KeepService) indexWithHeader(ctx context.Context, c *Client, prefix, url string, readTimes, changes bool) ([]KeepServiceIndexEntry, http.Header, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("NewRequestWithContext(%v): %v", url, err)
+		return nil, nil, fmt.Errorf("NewRequestWithContext(%v): %v", url, err)
 	}
 	resp, err := c.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("Do(%v): %v", url, err)
+		return nil, nil, fmt.Errorf("Do(%v): %v", url, err)
+	} else if changes && (resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("%v: %d %v: %w", url, resp.StatusCode, resp.Status, ErrIndexChangesUnavailable)
 	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("%v: %d %v", url, resp.StatusCode, resp.Status)
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("%v: %d %v", url, resp.StatusCode, resp.Status)
 	}
 	defer resp.Body.Close()
 
@@ -185,12 +244,16 @@ func (s *KeepService) index(ctx context.Context, c *Client, prefix, url string)
 		}
 	}()
 
+	nfields := 2
+	if readTimes {
+		nfields = 3
+	}
 	var entries []KeepServiceIndexEntry
 	scanner := bufio.NewScanner(resp.Body)
 	sawEOF := false
 	for scanner.Scan() {
 		if ctx.Err() != nil {
-			return nil, ctx.Err()
+			return nil, nil, ctx.Err()
 		}
 		if scanner.Err() != nil {
 			// If we encounter a read error (timeout,
@@ -200,7 +263,7 @@ func (s *KeepService) index(ctx context.Context, c *Client, prefix, url string)
 			break
 		}
 		if sawEOF {
-			return nil, fmt.Errorf("Index response contained non-terminal blank line")
+			return nil, nil, fmt.Errorf("Index response contained non-terminal blank line")
 		}
 		line := scanner.Text()
 		if line == "" {
@@ -208,15 +271,23 @@ func (s *KeepService) index(ctx context.Context, c *Client, prefix, url string)
 			continue
 		}
 		fields := strings.Split(line, " ")
-		if len(fields) != 2 {
-			return nil, fmt.Errorf("Malformed index line %q: %d fields", line, len(fields))
+		if len(fields) != nfields {
+			return nil, nil, fmt.Errorf("Malformed index line %q: %d fields", line, len(fields))
 		}
 		if !strings.HasPrefix(fields[0], prefix) {
-			return nil, fmt.Errorf("Index response included block %q despite asking for prefix %q", fields[0], prefix)
+			return nil, nil, fmt.Errorf("Index response included block %q despite asking for prefix %q", fields[0], prefix)
+		}
+		if changes && fields[1] == "-" {
+			entries = append(entries, KeepServiceIndexEntry{
+				SizedDigest: SizedDigest(fields[0]),
+				Removed:     true,
+			})
+			atomic.AddInt64(&progress, 1)
+			continue
 		}
 		mtime, err := strconv.ParseInt(fields[1], 10, 64)
 		if err != nil {
-			return nil, fmt.Errorf("Malformed index line %q: mtime: %v", line, err)
+			return nil, nil, fmt.Errorf("Malformed index line %q: mtime: %v", line, err)
 		}
 		if mtime < 1e12 {
 			// An old version of keepstore is giving us
@@ -226,17 +297,25 @@ func (s *KeepService) index(ctx context.Context, c *Client, prefix, url string)
 			// 33658-09-27.)
 			mtime = mtime * 1e9
 		}
+		var readTime int64
+		if readTimes {
+			readTime, err = strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Malformed index line %q: read time: %v", line, err)
+			}
+		}
 		entries = append(entries, KeepServiceIndexEntry{
 			SizedDigest: SizedDigest(fields[0]),
 			Mtime:       mtime,
+			ReadTime:    readTime,
 		})
 		atomic.AddInt64(&progress, 1)
 	}
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("Error scanning index response: %v", err)
+		return nil, nil, fmt.Errorf("Error scanning index response: %v", err)
 	}
 	if !sawEOF {
-		return nil, fmt.Errorf("Index response had no EOF marker")
+		return nil, nil, fmt.Errorf("Index response had no EOF marker")
 	}
-	return entries, nil
+	return entries, resp.Header, nil
 }
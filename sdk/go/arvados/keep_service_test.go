@@ -6,7 +6,12 @@ package arvados
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 
 	check "gopkg.in/check.v1"
 )
@@ -26,3 +31,50 @@ func (*KeepServiceSuite) TestIndexTimeout(c *check.C) {
 	_, err := (&KeepService{}).IndexMount(context.Background(), client, "fake", "")
 	c.Check(err, check.ErrorMatches, `.*timeout.*`)
 }
+
+func (*KeepServiceSuite) TestIndexMountChanges(c *check.C) {
+	var reqs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reqs = append(reqs, req.URL.RequestURI())
+		switch req.FormValue("since") {
+		case "":
+			w.Header().Set("X-Keep-Index-Time", "1700000000000000000")
+			fmt.Fprint(w, "acbd18db4cc2f85cedef654fccc4a4d8+3 1600000000000000000\n\n")
+		case "1700000000000000000":
+			w.Header().Set("X-Keep-Index-Time", "1700000001000000000")
+			fmt.Fprint(w, "37b51d194a7513e45b56f6524f2d51f2+3 1700000000500000000\nacbd18db4cc2f85cedef654fccc4a4d8+3 -\n\n")
+		default:
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer srv.Close()
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	c.Assert(err, check.IsNil)
+	portnum, _ := strconv.Atoi(port)
+	ks := &KeepService{ServiceHost: host, ServicePort: portnum}
+	client := &Client{Client: http.DefaultClient, APIHost: "zzzzz.arvadosapi.com", AuthToken: "xyzzy"}
+
+	ents, asOf, err := ks.IndexMountChanges(context.Background(), client, "zzzzz-nyw5e-000000000000000", "", 0)
+	c.Check(err, check.IsNil)
+	c.Check(asOf, check.Equals, int64(1700000000000000000))
+	c.Check(ents, check.DeepEquals, []KeepServiceIndexEntry{
+		{SizedDigest: "acbd18db4cc2f85cedef654fccc4a4d8+3", Mtime: 1600000000000000000},
+	})
+
+	ents, asOf, err = ks.IndexMountChanges(context.Background(), client, "zzzzz-nyw5e-000000000000000", "", asOf)
+	c.Check(err, check.IsNil)
+	c.Check(asOf, check.Equals, int64(1700000001000000000))
+	c.Check(ents, check.DeepEquals, []KeepServiceIndexEntry{
+		{SizedDigest: "37b51d194a7513e45b56f6524f2d51f2+3", Mtime: 1700000000500000000},
+		{SizedDigest: "acbd18db4cc2f85cedef654fccc4a4d8+3", Removed: true},
+	})
+
+	_, _, err = ks.IndexMountChanges(context.Background(), client, "zzzzz-nyw5e-000000000000000", "", 1)
+	c.Check(errors.Is(err, ErrIndexChangesUnavailable), check.Equals, true)
+
+	c.Check(reqs, check.DeepEquals, []string{
+		"/mounts/zzzzz-nyw5e-000000000000000/blocks?prefix=",
+		"/mounts/zzzzz-nyw5e-000000000000000/blocks?prefix=&since=1700000000000000000",
+		"/mounts/zzzzz-nyw5e-000000000000000/blocks?prefix=&since=1",
+	})
+}
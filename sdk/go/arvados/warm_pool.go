@@ -0,0 +1,139 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdayAbbrev = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// warmPoolWindow is a parsed WarmPoolConfig.Schedule entry.
+type warmPoolWindow struct {
+	days       [7]bool
+	start, end int // minutes since midnight
+}
+
+var warmPoolWindowRegexp = regexp.MustCompile(`^(?:(\S+)\s+)?(\d\d?):(\d\d)-(\d\d?):(\d\d)$`)
+
+// parseWarmPoolWindow parses a schedule entry like "Mon-Fri
+// 08:00-18:00", "Sat,Sun 10:00-14:00", or "22:00-06:00" (every day).
+func parseWarmPoolWindow(s string) (warmPoolWindow, error) {
+	var w warmPoolWindow
+	m := warmPoolWindowRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return w, fmt.Errorf("invalid schedule entry %q: expected format \"[days] HH:MM-HH:MM\"", s)
+	}
+	if m[1] == "" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	} else {
+		for _, dayrange := range strings.Split(strings.ToLower(m[1]), ",") {
+			first, last, isRange := strings.Cut(dayrange, "-")
+			if !isRange {
+				last = first
+			}
+			d0, ok0 := weekdayAbbrev[first]
+			d1, ok1 := weekdayAbbrev[last]
+			if !ok0 || !ok1 {
+				return w, fmt.Errorf("invalid schedule entry %q: unrecognized day %q (expected Sun, Mon, ..., Sat)", s, dayrange)
+			}
+			for d := d0; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == d1 {
+					break
+				}
+			}
+		}
+	}
+	var hhmm [4]int
+	for i := range hhmm {
+		hhmm[i], _ = strconv.Atoi(m[i+2])
+	}
+	if hhmm[0] > 23 || hhmm[1] > 59 || hhmm[2] > 24 || hhmm[3] > 59 || (hhmm[2] == 24 && hhmm[3] > 0) {
+		return w, fmt.Errorf("invalid schedule entry %q: time out of range", s)
+	}
+	w.start = hhmm[0]*60 + hhmm[1]
+	w.end = hhmm[2]*60 + hhmm[3]
+	if w.start == w.end {
+		return w, fmt.Errorf("invalid schedule entry %q: start and end times are equal", s)
+	}
+	return w, nil
+}
+
+// contains returns true if t (expressed in the schedule's time
+// zone) is in the window. A window whose end time is earlier than
+// its start time extends past midnight into the following day.
+func (w warmPoolWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	return (w.days[day] && minute >= w.start) ||
+		(w.days[(day+6)%7] && minute < w.end)
+}
+
+func (wpc WarmPoolConfig) location() (*time.Location, error) {
+	if wpc.TimeZone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(wpc.TimeZone)
+}
+
+// Validate returns an error if the TimeZone or Schedule entries
+// cannot be parsed.
+func (wpc WarmPoolConfig) Validate() error {
+	if wpc.MinIdle < 0 {
+		return fmt.Errorf("MinIdle must not be negative")
+	}
+	if _, err := wpc.location(); err != nil {
+		return fmt.Errorf("invalid TimeZone: %w", err)
+	}
+	for _, s := range wpc.Schedule {
+		if _, err := parseWarmPoolWindow(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MinIdleAt returns the number of idle instances that should be
+// kept available at time t: MinIdle if the Schedule is empty or t
+// falls within one of its entries, otherwise zero. Invalid Schedule
+// entries (see Validate) are ignored.
+func (wpc WarmPoolConfig) MinIdleAt(t time.Time) int {
+	if wpc.MinIdle <= 0 {
+		return 0
+	}
+	if len(wpc.Schedule) == 0 {
+		return wpc.MinIdle
+	}
+	loc, err := wpc.location()
+	if err != nil {
+		return 0
+	}
+	t = t.In(loc)
+	for _, s := range wpc.Schedule {
+		w, err := parseWarmPoolWindow(s)
+		if err == nil && w.contains(t) {
+			return wpc.MinIdle
+		}
+	}
+	return 0
+}
@@ -0,0 +1,79 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package arvados
+
+import (
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&WarmPoolSuite{})
+
+type WarmPoolSuite struct{}
+
+func (s *WarmPoolSuite) TestValidate(c *check.C) {
+	for _, trial := range []struct {
+		cfg WarmPoolConfig
+		err string
+	}{
+		{WarmPoolConfig{MinIdle: 1}, ""},
+		{WarmPoolConfig{MinIdle: 1, Schedule: []string{"Mon-Fri 08:00-18:00", "sat,SUN 10:00-14:30", "22:00-06:00", "Fri-Mon 00:00-24:00"}, TimeZone: "America/New_York"}, ""},
+		{WarmPoolConfig{MinIdle: -1}, `MinIdle must not be negative`},
+		{WarmPoolConfig{TimeZone: "Nowhere/Special"}, `invalid TimeZone: .*`},
+		{WarmPoolConfig{Schedule: []string{"08:00"}}, `invalid schedule entry "08:00": expected format .*`},
+		{WarmPoolConfig{Schedule: []string{"Mon-Fry 08:00-18:00"}}, `.*unrecognized day "mon-fry".*`},
+		{WarmPoolConfig{Schedule: []string{"08:00-25:00"}}, `.*time out of range`},
+		{WarmPoolConfig{Schedule: []string{"08:60-12:00"}}, `.*time out of range`},
+		{WarmPoolConfig{Schedule: []string{"08:00-08:00"}}, `.*start and end times are equal`},
+	} {
+		err := trial.cfg.Validate()
+		if trial.err == "" {
+			c.Check(err, check.IsNil, check.Commentf("%+v", trial.cfg))
+		} else {
+			c.Check(err, check.ErrorMatches, trial.err, check.Commentf("%+v", trial.cfg))
+		}
+	}
+}
+
+func (s *WarmPoolSuite) TestMinIdleAt(c *check.C) {
+	cfg := WarmPoolConfig{
+		MinIdle:  3,
+		Schedule: []string{"Mon-Fri 08:00-18:00", "Sat 22:00-02:00"},
+		TimeZone: "UTC",
+	}
+	for _, trial := range []struct {
+		t      string
+		expect int
+	}{
+		{"2024-01-08T07:59:00Z", 0}, // Monday
+		{"2024-01-08T08:00:00Z", 3},
+		{"2024-01-12T17:59:59Z", 3}, // Friday
+		{"2024-01-12T18:00:00Z", 0},
+		{"2024-01-13T12:00:00Z", 0}, // Saturday
+		{"2024-01-13T23:00:00Z", 3},
+		{"2024-01-14T01:30:00Z", 3}, // Sunday, continuing Saturday's window
+		{"2024-01-14T02:00:00Z", 0},
+		{"2024-01-14T23:00:00Z", 0},
+		// 08:00 in New York is 13:00 UTC
+		{"2024-01-08T08:00:00-05:00", 3},
+	} {
+		t, err := time.Parse(time.RFC3339, trial.t)
+		c.Assert(err, check.IsNil)
+		c.Check(cfg.MinIdleAt(t), check.Equals, trial.expect, check.Commentf("%s", trial.t))
+	}
+
+	cfg.TimeZone = "America/New_York"
+	t, _ := time.Parse(time.RFC3339, "2024-01-08T13:30:00Z")
+	c.Check(cfg.MinIdleAt(t), check.Equals, 3)
+	t, _ = time.Parse(time.RFC3339, "2024-01-08T12:30:00Z")
+	c.Check(cfg.MinIdleAt(t), check.Equals, 0)
+
+	// No schedule means always
+	cfg.Schedule = nil
+	c.Check(cfg.MinIdleAt(t), check.Equals, 3)
+	cfg.MinIdle = 0
+	c.Check(cfg.MinIdleAt(t), check.Equals, 0)
+}
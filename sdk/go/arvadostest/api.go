@@ -108,6 +108,10 @@ func (as *APIStub) CollectionUntrash(ctx context.Context, options arvados.Untras
 	as.appendCall(ctx, as.CollectionUntrash, options)
 	return arvados.Collection{}, as.Error
 }
+func (as *APIStub) CollectionPresignedURL(ctx context.Context, options arvados.PresignedURLOptions) (arvados.PresignedURL, error) {
+	as.appendCall(ctx, as.CollectionPresignedURL, options)
+	return arvados.PresignedURL{}, as.Error
+}
 func (as *APIStub) ComputedPermissionList(ctx context.Context, options arvados.ListOptions) (arvados.ComputedPermissionList, error) {
 	as.appendCall(ctx, as.ComputedPermissionList, options)
 	return arvados.ComputedPermissionList{}, as.Error
@@ -232,6 +236,10 @@ func (as *APIStub) GroupUntrash(ctx context.Context, options arvados.UntrashOpti
 	as.appendCall(ctx, as.GroupUntrash, options)
 	return arvados.Group{}, as.Error
 }
+func (as *APIStub) GroupBudget(ctx context.Context, options arvados.GetOptions) (arvados.GroupBudget, error) {
+	as.appendCall(ctx, as.GroupBudget, options)
+	return arvados.GroupBudget{}, as.Error
+}
 func (as *APIStub) LinkCreate(ctx context.Context, options arvados.CreateOptions) (arvados.Link, error) {
 	as.appendCall(ctx, as.LinkCreate, options)
 	return arvados.Link{}, as.Error
@@ -224,6 +224,8 @@ func (agg *Aggregator) ClusterHealth() ClusterHealthResponse {
 	for svcName, sh := range resp.Services {
 		switch svcName {
 		case arvados.ServiceNameDispatchCloud,
+			arvados.ServiceNameDispatchCondor,
+			arvados.ServiceNameDispatchKubernetes,
 			arvados.ServiceNameDispatchLSF,
 			arvados.ServiceNameDispatchSLURM:
 			// ok to not run any given dispatcher
@@ -383,6 +383,8 @@ func (s *AggregatorSuite) setAllServiceURLs(listen string) {
 	for _, svc := range []*arvados.Service{
 		&svcs.Controller,
 		&svcs.DispatchCloud,
+		&svcs.DispatchCondor,
+		&svcs.DispatchKubernetes,
 		&svcs.DispatchLSF,
 		&svcs.DispatchSLURM,
 		&svcs.Keepbalance,
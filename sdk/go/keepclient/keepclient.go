@@ -103,6 +103,7 @@ const (
 	XKeepStorageClassesConfirmed = "X-Keep-Storage-Classes-Confirmed"
 	XKeepSignature               = "X-Keep-Signature"
 	XKeepLocator                 = "X-Keep-Locator"
+	XKeepIndexTime               = "X-Keep-Index-Time"
 )
 
 type HTTPClient interface {
@@ -923,6 +923,25 @@ Refer to the [replace_segments reference][] for details.
         additionalProperties: {type: 'string'},
       }
     end
+    # Likewise 'merge_properties', which only applies to updates of
+    # collections and groups.
+    ['collections', 'groups'].each do |resource|
+      discovery[:resources][resource][:methods][:update][:parameters]['merge_properties'] = {
+        type: 'object',
+        description:
+          "Add, delete, and replace individual properties without
+overwriting other properties. Refer to the
+[merge_properties reference][] for details.
+
+[merge_properties reference]: https://doc.arvados.org/api/methods/collections.html#merge_properties
+
+",
+        required: false,
+        location: 'query',
+        properties: {},
+        additionalProperties: true,
+      }
+    end
 
     discovery[:resources]['configs'] = {
       methods: {
@@ -62,6 +62,7 @@ class Container < ArvadosModel
   before_save :update_secret_mounts_md5
   before_save :scrub_secrets
   before_save :clear_runtime_status_when_queued
+  before_save :retain_preemptible_fallback_status
   before_save :assign_external_ports
   after_save :update_cr_logs
   after_save :handle_completed
@@ -400,6 +401,14 @@ class Container < ArvadosModel
       return usable
     end
 
+    if attrs[:scheduling_parameters]['gang_id']
+      # A gang member has to be started along with the other
+      # members of its own gang, so it can't share a container that
+      # is queued or running as part of a different gang (or none).
+      log_reuse_info { "done, gang members only reuse completed containers" }
+      return nil
+    end
+
     # Check for non-failing Running candidates and return the most likely to finish sooner.
     log_reuse_info { "checking for state=Running..." }
     running = candidates.where(state: Running).
@@ -562,7 +571,7 @@ class Container < ArvadosModel
   def validate_runtime_status
     [
       'error', 'errorDetail', 'warning', 'warningDetail', 'activity',
-      'preemptionNotice',
+      'preemptionNotice', 'preemptibleFallback', 'checkpoint',
     ].each do |k|
       if self.runtime_status.andand.include?(k) && !self.runtime_status[k].is_a?(String)
         errors.add(:runtime_status, "'#{k}' value must be a string")
@@ -591,7 +600,7 @@ class Container < ArvadosModel
       permitted.push :priority, :runtime_status, :log, :lock_count
 
     when Queued
-      permitted.push :priority
+      permitted.push :priority, :runtime_status
 
     when Running
       permitted.push :priority, :output_properties, :gateway_address, *progress_attrs
@@ -765,12 +774,27 @@ class Container < ArvadosModel
   end
 
   def clear_runtime_status_when_queued
-    # Avoid leaking status messages between different dispatch attempts
-    if self.state_was == Locked && self.state == Queued
+    # Avoid leaking status messages between different dispatch
+    # attempts, or from the queue (e.g., "project budget exceeded")
+    # to the dispatch attempt.
+    if (self.state_was == Locked && self.state == Queued) ||
+       (self.state_was == Queued && self.state == Locked)
       self.runtime_status = {}
     end
   end
 
+  def retain_preemptible_fallback_status
+    # The preemptibleFallback message is set when the container is
+    # created as a retry (see handle_completed) and explains why it
+    # is not running on a preemptible instance.  Keep it when the
+    # dispatcher or crunch-run replaces runtime_status.
+    fallback = self.runtime_status_was.andand["preemptibleFallback"]
+    if fallback && !self.new_record? && self.runtime_status_changed? &&
+       !(self.runtime_status || {}).include?("preemptibleFallback")
+      self.runtime_status = (self.runtime_status || {}).merge("preemptibleFallback" => fallback)
+    end
+  end
+
   def assign_external_ports
     if state_was == Running && state != Running
       ActiveRecord::Base.connection.exec_query(
@@ -899,6 +923,44 @@ class Container < ArvadosModel
               end,
             }
 
+            # gang_id, gang_size: from the first request that is part
+            # of a gang, if any
+            gang_req = retryable_requests.find { |req| req.scheduling_parameters["gang_id"] }
+            if gang_req
+              scheduling_parameters[:gang_id] = gang_req.scheduling_parameters["gang_id"]
+              scheduling_parameters[:gang_size] = gang_req.scheduling_parameters["gang_size"]
+            end
+
+            # preemptible_interruptions: number of times this
+            # container and its predecessors were interrupted while
+            # running on a preemptible instance.  After
+            # Containers.MaxPreemptibleInterruptions, retry on a
+            # non-preemptible instance instead.
+            retry_runtime_status = {}
+            interruptions = self.scheduling_parameters["preemptible_interruptions"] || 0
+            if self.scheduling_parameters["preemptible"] && self.runtime_status.andand["preemptionNotice"]
+              interruptions += 1
+            end
+            if interruptions > 0
+              scheduling_parameters[:preemptible_interruptions] = interruptions
+              max_interruptions = Rails.configuration.Containers.MaxPreemptibleInterruptions
+              if scheduling_parameters[:preemptible] && max_interruptions > 0 && interruptions >= max_interruptions
+                scheduling_parameters[:preemptible] = false
+                retry_runtime_status["preemptibleFallback"] = "Scheduled on a non-preemptible instance after #{interruptions} interruption#{interruptions == 1 ? '' : 's'} on preemptible instances (Containers.MaxPreemptibleInterruptions=#{max_interruptions})"
+              end
+            end
+
+            # checkpoint_on_interruption: true if all are true,
+            # else false.  If so, and this container saved a
+            # checkpoint when it was interrupted, the next
+            # container is restored from that checkpoint.
+            if retryable_requests.map { |req| req.scheduling_parameters["checkpoint_on_interruption"] }.all?
+              scheduling_parameters[:checkpoint_on_interruption] = true
+              if self.runtime_status.andand["checkpoint"]
+                scheduling_parameters[:checkpoint] = self.runtime_status["checkpoint"]
+              end
+            end
+
             c_attrs = {
               command: self.command,
               cwd: self.cwd,
@@ -912,7 +974,8 @@ class Container < ArvadosModel
               secret_mounts: prev_secret_mounts,
               runtime_token: prev_runtime_token,
               runtime_user_uuid: self.runtime_user_uuid,
-              runtime_auth_scopes: self.runtime_auth_scopes
+              runtime_auth_scopes: self.runtime_auth_scopes,
+              runtime_status: retry_runtime_status,
             }
             c = Container.create! c_attrs
             retryable_requests.each do |cr|
@@ -677,9 +677,27 @@ class ContainerRequest < ArvadosModel
        scheduling_parameters['max_run_time'] < 0)
       errors.add :scheduling_parameters, "max_run_time must be positive integer"
     end
+    if scheduling_parameters.include? 'gang_id' and
+      (!scheduling_parameters['gang_id'].is_a?(String) ||
+       scheduling_parameters['gang_id'].empty?)
+      errors.add :scheduling_parameters, "gang_id must be a non-empty string"
+    end
+    if scheduling_parameters.include? 'gang_size' and
+      (!scheduling_parameters['gang_size'].is_a?(Integer) ||
+       scheduling_parameters['gang_size'] < 1)
+      errors.add :scheduling_parameters, "gang_size must be positive integer"
+    end
+    if scheduling_parameters.include?('gang_id') != scheduling_parameters.include?('gang_size')
+      errors.add :scheduling_parameters, "gang_id and gang_size must be given together"
+    end
+    if scheduling_parameters.include? 'checkpoint_on_interruption' and
+      ![true, false].include?(scheduling_parameters['checkpoint_on_interruption'])
+      errors.add :scheduling_parameters, "checkpoint_on_interruption must be true or false"
+    end
     disallow_extra_keys(
       :scheduling_parameters, scheduling_parameters,
-      ['max_run_time', 'partitions', 'preemptible', 'supervisor'])
+      ['max_run_time', 'partitions', 'preemptible', 'supervisor', 'gang_id', 'gang_size',
+       'checkpoint_on_interruption'])
 
     # Configuration could change before state changes to Committed, so
     # this is not flagged as an error for an Uncommitted.  We also
@@ -1381,6 +1381,16 @@ class ContainerRequestTest < ActiveSupport::TestCase
     [{"max_run_time" => -1}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
     [{"max_run_time" => -1}, ContainerRequest::Uncommitted, ActiveRecord::RecordInvalid],
     [{"max_run_time" => 86400}, ContainerRequest::Committed],
+    [{"gang_id" => "mpi-job-1", "gang_size" => 4}, ContainerRequest::Committed],
+    [{"gang_id" => "mpi-job-1"}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"gang_size" => 4}, ContainerRequest::Uncommitted, ActiveRecord::RecordInvalid],
+    [{"gang_id" => "", "gang_size" => 4}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"gang_id" => 1, "gang_size" => 4}, ContainerRequest::Uncommitted, ActiveRecord::RecordInvalid],
+    [{"gang_id" => "mpi-job-1", "gang_size" => 0}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"gang_id" => "mpi-job-1", "gang_size" => "4"}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"checkpoint_on_interruption" => true}, ContainerRequest::Committed],
+    [{"checkpoint_on_interruption" => "yes"}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
+    [{"checkpoint" => "fa7aeb5140e2848d39b416daeef4ffc5+45"}, ContainerRequest::Committed, ActiveRecord::RecordInvalid],
   ].each do |sp, state, expected|
     test "create container request with scheduling_parameters #{sp} in state #{state} and verify #{expected}" do
       common_attrs = {cwd: "/test",
@@ -227,8 +227,14 @@ class ContainerTest < ActiveSupport::TestCase
 
     set_user_from_auth :system_user
 
-    # Allow updates when state = Locked
+    # Allow dispatcher to explain why a container is still queued
+    c1.update! runtime_status: {'warning' => 'Project budget exceeded'}
+    assert c1.runtime_status.key? 'warning'
+
+    # Allow updates when state = Locked, and reset when
+    # transitioning from Queued to Locked
     c1.update! state: Container::Locked
+    assert_equal c1.runtime_status, {}
     c1.update! runtime_status: {'error' => 'Oops!'}
     assert c1.runtime_status.key? 'error'
 
@@ -569,6 +575,20 @@ class ContainerTest < ActiveSupport::TestCase
     end
   end
 
+  [Container::Queued, Container::Locked, Container::Running].each do |c1_state|
+    test "find_reusable for gang member should not reuse a #{c1_state} container" do
+      set_user_from_auth :active
+      c1_attrs = REUSABLE_COMMON_ATTRS.merge({environment: {"test" => name}, scheduling_parameters: {"gang_id" => "gang1", "gang_size" => 2}})
+      c1, _ = minimal_new(c1_attrs)
+      set_user_from_auth :system_user
+      c1.update!({state: Container::Locked}) if c1_state != Container::Queued
+      c1.update!({state: Container::Running}) if c1_state == Container::Running
+      assert_nil Container.find_reusable(c1_attrs)
+      # A request that isn't part of a gang can still reuse it.
+      assert_equal c1.uuid, Container.find_reusable(c1_attrs.merge({scheduling_parameters: {}}))&.uuid
+    end
+  end
+
   test "find_reusable with logging disabled" do
     set_user_from_auth :active
     Rails.logger.expects(:info).never
@@ -1318,6 +1338,109 @@ class ContainerTest < ActiveSupport::TestCase
     assert_equal(30, actual["max_run_time"])
   end
 
+  test "retry requests scheduled with gang parameters" do
+    container = retry_with_scheduling_parameters([{"gang_id" => "gang1", "gang_size" => 3}])
+    actual = container.scheduling_parameters
+    assert_equal("gang1", actual["gang_id"])
+    assert_equal(3, actual["gang_size"])
+  end
+
+  def interrupt_preemptible(container)
+    container.lock
+    container.update!(state: Container::Running)
+    container.update!(runtime_status: {
+                        "warning" => "preemption notice",
+                        "preemptionNotice" => "Spot instance interruption notice",
+                      })
+    container.update!(state: Container::Cancelled)
+    container.reload
+  end
+
+  [
+    [0, 3, true],
+    [3, 2, true],
+    [2, 2, false],
+    [1, 1, false],
+  ].each do |max_interruptions, interruptions, expect_preemptible|
+    test "retry after #{interruptions} preemptible interruptions with MaxPreemptibleInterruptions=#{max_interruptions}" do
+      configure_preemptible_instance_type
+      Rails.configuration.Containers.MaxPreemptibleInterruptions = max_interruptions
+      set_user_from_auth :admin
+      container, request = minimal_new(scheduling_parameters: {"preemptible" => true},
+                                       container_count_max: interruptions + 1)
+      interruptions.times do |i|
+        interrupt_preemptible(container)
+        request.reload
+        assert_not_equal(container.uuid, request.container_uuid)
+        container = Container.find_by_uuid(request.container_uuid)
+        assert_equal(i+1, container.scheduling_parameters["preemptible_interruptions"])
+      end
+      assert_equal(expect_preemptible, container.scheduling_parameters["preemptible"])
+      if expect_preemptible
+        refute_includes(container.runtime_status, "preemptibleFallback")
+      else
+        assert_match(/after #{interruptions} interruption/, container.runtime_status["preemptibleFallback"])
+
+        # The fallback message survives dispatch and crunch-run
+        # runtime_status updates.
+        container.lock
+        container.update!(state: Container::Running)
+        container.update!(runtime_status: {"activity" => "running"})
+        container.reload
+        assert_equal("running", container.runtime_status["activity"])
+        assert_match(/after #{interruptions} interruption/, container.runtime_status["preemptibleFallback"])
+      end
+    end
+  end
+
+  test "retry after cancellation without preemption notice is not counted" do
+    configure_preemptible_instance_type
+    Rails.configuration.Containers.MaxPreemptibleInterruptions = 1
+    container = retry_with_scheduling_parameters([{"preemptible" => true}])
+    assert_equal(true, container.scheduling_parameters["preemptible"])
+    refute_includes(container.scheduling_parameters, "preemptible_interruptions")
+    refute_includes(container.runtime_status, "preemptibleFallback")
+  end
+
+  [
+    [[{"checkpoint_on_interruption" => true}], true],
+    [[{"checkpoint_on_interruption" => true}, {"checkpoint_on_interruption" => true}], true],
+    [[{"checkpoint_on_interruption" => true}, {"checkpoint_on_interruption" => false}], false],
+    [[{"checkpoint_on_interruption" => true}, {}], false],
+  ].each do |param_hashes, expect_checkpoint|
+    test "retry with checkpoint from #{param_hashes}" do
+      set_user_from_auth :admin
+      containers = param_hashes.map do |sp|
+        minimal_new(scheduling_parameters: sp)
+      end
+      container, request = containers.first
+      container.lock
+      container.update!(state: Container::Running)
+      container.update!(runtime_status: {
+                          "warning" => "preemption notice",
+                          "preemptionNotice" => "Spot instance interruption notice",
+                          "checkpoint" => "fa7aeb5140e2848d39b416daeef4ffc5+45",
+                        })
+      container.update!(state: Container::Cancelled)
+      request.reload
+      retried = Container.find_by_uuid(request.container_uuid)
+      assert_not_equal(container.uuid, retried.uuid)
+      if expect_checkpoint
+        assert_equal(true, retried.scheduling_parameters["checkpoint_on_interruption"])
+        assert_equal("fa7aeb5140e2848d39b416daeef4ffc5+45", retried.scheduling_parameters["checkpoint"])
+      else
+        refute_includes(retried.scheduling_parameters, "checkpoint_on_interruption")
+        refute_includes(retried.scheduling_parameters, "checkpoint")
+      end
+    end
+  end
+
+  test "retry without checkpoint starts from the beginning" do
+    container = retry_with_scheduling_parameters([{"checkpoint_on_interruption" => true}])
+    assert_equal(true, container.scheduling_parameters["checkpoint_on_interruption"])
+    refute_includes(container.scheduling_parameters, "checkpoint")
+  end
+
   test "retry requests with unset scheduling parameters" do
     configure_preemptible_instance_type
     param_hashes = vary_parameters(
@@ -58,12 +58,18 @@ type Balancer struct {
 	classes       []string
 	mounts        int
 	mountsByClass map[string]map[*KeepMount]bool
+	coldStorage   map[string]coldStoragePolicy
 	collScanned   int64
 	serviceRoots  map[string]string
 	errors        []error
 	stats         balancerStats
 	mutex         sync.Mutex
 	lostBlocks    io.Writer
+
+	// See indexState
+	fullIndexInterval time.Duration
+	prevIndexState    *indexState
+	indexState        *indexState
 }
 
 // Run performs a balance operation using the given config and
@@ -152,9 +158,20 @@ func (bal *Balancer) Run(ctx context.Context, client *arvados.Client, cluster *a
 		nextRunOptions.SafeRendezvousState = rs
 	}
 
+	bal.setupColdStorage(cluster)
+	bal.fullIndexInterval = cluster.Collections.BalanceFullIndexInterval.Duration()
+	if bal.fullIndexInterval > 0 && len(bal.coldStorage) > 0 {
+		bal.logf("not using incremental indexes because cold storage classes are configured")
+		bal.fullIndexInterval = 0
+	}
+	// GetCurrentState modifies the previous block state map, so
+	// it can't be reused if we fail below.
+	bal.prevIndexState = runOptions.indexState
+	nextRunOptions.indexState = nil
 	if err = bal.GetCurrentState(ctx, client, cluster.Collections.BalanceCollectionBatch, cluster.Collections.BalanceCollectionBuffers); err != nil {
 		return
 	}
+	nextRunOptions.indexState = bal.indexState
 	bal.setupLookupTables(cluster)
 	bal.ComputeChangeSets()
 	bal.PrintStatistics()
@@ -413,7 +430,28 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 	for mnt := range equivMount {
 		maxRepl += mnt.Replication
 	}
-	bal.BlockStateMap = NewBlockStateMap(maxRepl)
+	// If possible, reuse the block state map from the previous
+	// run, and retrieve only the changes since then from the
+	// mounts whose previous index is still usable.
+	incremental := bal.incrementalMounts(equivMount)
+	if len(incremental) > 0 {
+		remap := map[*KeepMount]*KeepMount{}
+		for mnt, st := range incremental {
+			remap[st.mnt] = mnt
+		}
+		bal.BlockStateMap = bal.prevIndexState.bsm
+		bal.BlockStateMap.reset(maxRepl, remap)
+	} else {
+		bal.BlockStateMap = NewBlockStateMap(maxRepl)
+	}
+	bal.prevIndexState = nil
+	if bal.fullIndexInterval > 0 {
+		bal.indexState = &indexState{
+			bsm:         bal.BlockStateMap,
+			chunkPrefix: bal.ChunkPrefix,
+			mounts:      map[string]indexMountState{},
+		}
+	}
 	// Start one goroutine for each (non-redundant) mount:
 	// retrieve the index, and add the returned blocks to
 	// BlockStateMap.
@@ -421,8 +459,47 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 		wg.Add(1)
 		go func(mounts []*KeepMount) {
 			defer wg.Done()
+			var idx []arvados.KeepServiceIndexEntry
+			var err error
+			if st, ok := incremental[mounts[0]]; ok {
+				bal.logf("mount %s: retrieve changes since %s from %s", mounts[0], time.Unix(0, st.asOf).UTC().Format(time.RFC3339Nano), mounts[0].KeepService)
+				var asOf int64
+				idx, asOf, err = mounts[0].KeepService.IndexMountChanges(ctx, c, mounts[0].UUID, bal.ChunkPrefix, st.asOf)
+				if err == nil && asOf > 0 {
+					bal.BlockStateMap.ApplyChanges(mounts[0], idx)
+					bal.indexState.set(mounts[0], asOf, st.fullAt)
+					bal.logf("mount %s: applied %d changes to map", mounts[0], len(idx))
+					return
+				} else if err != nil && !errors.Is(err, arvados.ErrIndexChangesUnavailable) {
+					select {
+					case errs <- fmt.Errorf("%s: retrieve index: %v", mounts[0], err):
+					default:
+					}
+					cancel()
+					return
+				}
+				bal.logf("mount %s: changes are not available, retrieving full index", mounts[0])
+				bal.BlockStateMap.RemoveReplicas(mounts[0])
+			}
 			bal.logf("mount %s: retrieve index from %s", mounts[0], mounts[0].KeepService)
-			idx, err := mounts[0].KeepService.IndexMount(ctx, c, mounts[0].UUID, bal.ChunkPrefix)
+			readTimes := false
+			if len(bal.coldStorage) > 0 {
+				idx, err = mounts[0].KeepService.IndexMountReadTimes(ctx, c, mounts[0].UUID, bal.ChunkPrefix)
+				if err == nil {
+					readTimes = true
+				} else if ctx.Err() == nil {
+					// Blocks stored on this mount
+					// will not be considered cold.
+					bal.logf("mount %s: cannot retrieve read times, falling back to regular index: %s", mounts[0], err)
+				}
+			}
+			var asOf int64
+			fullAt := time.Now()
+			if !readTimes && bal.fullIndexInterval > 0 {
+				idx, asOf, err = mounts[0].KeepService.IndexMountChanges(ctx, c, mounts[0].UUID, bal.ChunkPrefix, 0)
+			} else if !readTimes {
+				idx, err = mounts[0].KeepService.IndexMount(ctx, c, mounts[0].UUID, bal.ChunkPrefix)
+			}
 			if err != nil {
 				select {
 				case errs <- fmt.Errorf("%s: retrieve index: %v", mounts[0], err):
@@ -438,10 +515,14 @@ func (bal *Balancer) GetCurrentState(ctx context.Context, c *arvados.Client, pag
 				return
 			}
 			for _, mount := range mounts {
+				mount.ReadTimes = readTimes
 				bal.logf("%s: add %d entries to map", mount, len(idx))
 				bal.BlockStateMap.AddReplicas(mount, idx)
 				bal.logf("%s: added %d entries to map at %dx (%d replicas)", mount, len(idx), mount.Replication, len(idx)*mount.Replication)
 			}
+			if asOf > 0 && len(mounts) == 1 {
+				bal.indexState.set(mounts[0], asOf, fullAt)
+			}
 			bal.logf("mount %s: index done", mounts[0])
 		}(mounts)
 	}
@@ -629,6 +710,81 @@ func (bal *Balancer) setupLookupTables(cluster *arvados.Cluster) {
 	}
 }
 
+// coldStoragePolicy indicates that blocks in a storage class should
+// be moved to a different storage class when they have not been read
+// or written since a given time.
+type coldStoragePolicy struct {
+	class  string // storage class to move cold blocks to
+	before int64  // cutoff time, in nanoseconds since Unix epoch
+}
+
+func (bal *Balancer) setupColdStorage(cluster *arvados.Cluster) {
+	bal.coldStorage = nil
+	now := time.Now()
+	for class, sc := range cluster.StorageClasses {
+		if sc.ColdStorageClass == "" {
+			continue
+		}
+		if bal.coldStorage == nil {
+			bal.coldStorage = map[string]coldStoragePolicy{}
+		}
+		bal.coldStorage[class] = coldStoragePolicy{
+			class:  sc.ColdStorageClass,
+			before: now.Add(-sc.ColdAfter.Duration()).UnixNano(),
+		}
+	}
+}
+
+// desiredReplication returns the desired replication for each storage
+// class, after moving the replication desired in each storage class
+// with a cold storage policy to the policy's storage class if the
+// block is cold (see isCold).
+//
+// The returned map must not be modified: if no replication is moved,
+// it is the shared map referenced by blk.Desired.
+func (bal *Balancer) desiredReplication(blk *BlockState) (desired map[string]int, cold bool) {
+	if blk.Desired == nil {
+		return nil, false
+	}
+	desired = *blk.Desired
+	if len(bal.coldStorage) == 0 {
+		return desired, false
+	}
+	moved := make(map[string]int, len(desired))
+	for class, n := range desired {
+		if policy, ok := bal.coldStorage[class]; ok && n > 0 && bal.isCold(blk, policy) {
+			class = policy.class
+			cold = true
+		}
+		if n > moved[class] {
+			moved[class] = n
+		}
+	}
+	if !cold {
+		return desired, false
+	}
+	return moved, true
+}
+
+// isCold returns true if the given block has not been read since the
+// policy's cutoff time, and has not been written since then except by
+// pulling replicas to the policy's storage class. If the read time of
+// any replica is unknown, isCold returns false.
+func (bal *Balancer) isCold(blk *BlockState, policy coldStoragePolicy) bool {
+	if len(blk.Replicas) == 0 {
+		return false
+	}
+	for _, r := range blk.Replicas {
+		if !r.KeepMount.ReadTimes || r.ReadTime >= policy.before {
+			return false
+		}
+		if r.Mtime >= policy.before && !bal.mountsByClass[policy.class][r.KeepMount] {
+			return false
+		}
+	}
+	return true
+}
+
 const (
 	changeStay = iota
 	changePull
@@ -654,6 +810,7 @@ type balanceResult struct {
 	blk        *BlockState
 	blkid      arvados.SizedDigest
 	lost       bool
+	cold       bool
 	blockState balancedBlockState
 	classState map[string]balancedBlockState
 }
@@ -669,6 +826,8 @@ type slot struct {
 func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) balanceResult {
 	bal.Logger.Debugf("balanceBlock: %v %+v", blkid, blk)
 
+	desiredRepl, cold := bal.desiredReplication(blk)
+
 	// Build a list of all slots (one per mounted volume).
 	slots := make([]slot, 0, bal.mounts)
 	for _, srv := range bal.KeepServices {
@@ -706,10 +865,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 
 	unsafeToDelete := make(map[int64]bool, len(slots))
 	for _, class := range bal.classes {
-		if blk.Desired == nil {
-			continue
-		}
-		desired := (*blk.Desired)[class]
+		desired := desiredRepl[class]
 		if desired == 0 {
 			continue
 		}
@@ -848,11 +1004,7 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 
 	classState := make(map[string]balancedBlockState, len(bal.classes))
 	for _, class := range bal.classes {
-		desired := 0
-		if blk.Desired != nil {
-			desired = (*blk.Desired)[class]
-		}
-		classState[class] = computeBlockState(slots, bal.mountsByClass[class], len(blk.Replicas), desired)
+		classState[class] = computeBlockState(slots, bal.mountsByClass[class], len(blk.Replicas), desiredRepl[class])
 	}
 	blockState := computeBlockState(slots, nil, len(blk.Replicas), 0)
 
@@ -924,16 +1076,13 @@ func (bal *Balancer) balanceBlock(blkid arvados.SizedDigest, blk *BlockState) ba
 		}
 	}
 	if bal.Dumper != nil {
-		var desired map[string]int
-		if blk.Desired != nil {
-			desired = *blk.Desired
-		}
-		bal.Dumper.Printf("%s refs=%d needed=%d unneeded=%d pulling=%v %v %v", blkid, blk.RefCount, blockState.needed, blockState.unneeded, blockState.pulling, desired, changes)
+		bal.Dumper.Printf("%s refs=%d needed=%d unneeded=%d pulling=%v %v %v", blkid, blk.RefCount, blockState.needed, blockState.unneeded, blockState.pulling, desiredRepl, changes)
 	}
 	return balanceResult{
 		blk:        blk,
 		blkid:      blkid,
 		lost:       lost,
+		cold:       cold,
 		blockState: blockState,
 		classState: classState,
 	}
@@ -993,6 +1142,7 @@ type balancerStats struct {
 	underrep        blocksNBytes
 	unachievable    blocksNBytes
 	justright       blocksNBytes
+	cold            blocksNBytes
 	desired         blocksNBytes
 	current         blocksNBytes
 	pulls           int
@@ -1105,6 +1255,12 @@ func (bal *Balancer) collectStatistics(results <-chan balanceResult) {
 			s.justright.bytes += bytes * int64(bs.needed)
 		}
 
+		if result.cold {
+			s.cold.replicas += len(result.blk.Replicas)
+			s.cold.blocks++
+			s.cold.bytes += bytes * int64(len(result.blk.Replicas))
+		}
+
 		if bs.needed > 0 {
 			s.desired.replicas += bs.needed
 			s.desired.blocks++
@@ -1142,6 +1298,9 @@ func (bal *Balancer) PrintStatistics() {
 	bal.logf("%s overreplicated (have>want>0)", bal.stats.overrep)
 	bal.logf("%s unreferenced (have>want=0, new)", bal.stats.unref)
 	bal.logf("%s garbage (have>want=0, old)", bal.stats.garbage)
+	if len(bal.coldStorage) > 0 {
+		bal.logf("%s cold (moved to cold storage class)", bal.stats.cold)
+	}
 	for _, class := range bal.classes {
 		cs := bal.stats.classStats[class]
 		bal.logf("===")
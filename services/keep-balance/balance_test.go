@@ -46,6 +46,7 @@ type tester struct {
 	desired     map[string]int
 	current     slots
 	timestamps  []int64
+	readTimes   []int64
 	shouldPull  slots
 	shouldTrash slots
 
@@ -104,6 +105,7 @@ func (bal *balancerSuite) SetUpTest(c *check.C) {
 	}
 
 	bal.MinMtime = time.Now().UnixNano() - bal.signatureTTL*1e9
+	bal.coldStorage = nil
 	bal.cleanupMounts()
 }
 
@@ -746,6 +748,63 @@ func (bal *balancerSuite) TestChangeStorageClasses(c *check.C) {
 		current: slots{0, 1}})
 }
 
+func (bal *balancerSuite) TestColdStorage(c *check.C) {
+	// For known block 0, servers 13 and 9 are slots 5 and 9 in
+	// probe order. They provide storage class "cold".
+	for _, i := range []int{9, 13} {
+		bal.srvs[i].mounts[0].StorageClasses = map[string]bool{"cold": true}
+	}
+	for _, srv := range bal.srvs {
+		srv.mounts[0].ReadTimes = true
+	}
+	now := time.Now().UnixNano()
+	old := now - (bal.signatureTTL+86400)*1e9
+	bal.coldStorage = map[string]coldStoragePolicy{
+		"default": {class: "cold", before: now - 3600e9},
+	}
+	// Not read or written recently: pull to the best mounts with
+	// class "cold", and don't trash anything until those pulls
+	// succeed.
+	bal.try(c, tester{
+		desired:    map[string]int{"default": 2},
+		current:    slots{0, 1},
+		timestamps: []int64{old, old},
+		readTimes:  []int64{old, 0},
+		shouldPull: slots{5, 9},
+		expectClassState: map[string]balancedBlockState{
+			"default": {needed: 2},
+			"cold":    {pulling: 2},
+		}})
+	// Newly pulled replicas on "cold" mounts don't make the block
+	// hot, so the replicas on "default" mounts are trashed. (The
+	// pulls don't update the read times of the source replicas:
+	// keepstore only records reads by clients.)
+	bal.try(c, tester{
+		desired:     map[string]int{"default": 2},
+		current:     slots{0, 1, 5, 9},
+		timestamps:  []int64{old, old + 1, now, now + 1},
+		readTimes:   []int64{old, 0, 0, 0},
+		shouldTrash: slots{0, 1}})
+	// Read recently: move back to "default".
+	bal.try(c, tester{
+		desired:    map[string]int{"default": 2},
+		current:    slots{5, 9},
+		timestamps: []int64{old, old + 1},
+		readTimes:  []int64{0, now},
+		shouldPull: slots{0, 1}})
+	// Written recently.
+	bal.try(c, tester{
+		desired:    map[string]int{"default": 2},
+		current:    slots{0, 1},
+		timestamps: []int64{old, now}})
+	// Read time of one replica is unknown.
+	bal.srvList(0, slots{1})[0].mounts[0].ReadTimes = false
+	bal.try(c, tester{
+		desired:    map[string]int{"default": 2},
+		current:    slots{0, 1},
+		timestamps: []int64{old, old + 1}})
+}
+
 // Clear all servers' changesets, balance a single block, and verify
 // the appropriate changes for that block have been added to the
 // changesets.
@@ -758,6 +817,9 @@ func (bal *balancerSuite) try(c *check.C, t tester) {
 	for i, t := range t.timestamps {
 		blk.Replicas[i].Mtime = t
 	}
+	for i, t := range t.readTimes {
+		blk.Replicas[i].ReadTime = t
+	}
 	result := bal.balanceBlock(knownBlkid(t.known), blk)
 
 	var didPull, didTrash slots
@@ -823,7 +885,7 @@ func (bal *balancerSuite) replList(knownBlockID int, order slots) (repls []Repli
 		n := nextMnt[srv]
 		nextMnt[srv] = (n + 1) % len(srv.mounts)
 
-		repls = append(repls, Replica{srv.mounts[n], mtime})
+		repls = append(repls, Replica{KeepMount: srv.mounts[n], Mtime: mtime})
 		mtime++
 	}
 	return
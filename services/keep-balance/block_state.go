@@ -16,7 +16,8 @@ import (
 // response.
 type Replica struct {
 	*KeepMount
-	Mtime int64
+	Mtime    int64
+	ReadTime int64 // 0 if unknown
 }
 
 // BlockState indicates the desired storage class and number of
@@ -39,6 +40,15 @@ func (bs *BlockState) addReplica(r Replica) {
 	bs.Refs = nil
 }
 
+func (bs *BlockState) removeReplica(mnt *KeepMount) {
+	for i, r := range bs.Replicas {
+		if r.KeepMount == mnt {
+			bs.Replicas = append(bs.Replicas[:i], bs.Replicas[i+1:]...)
+			return
+		}
+	}
+}
+
 func (bs *BlockState) increaseDesired(pool *mapPool, pdh string, classes []string, n int) {
 	if pdh != "" && len(bs.Replicas) == 0 {
 		// Note we only track PDHs if there's a possibility
@@ -109,10 +119,85 @@ func (bsm *BlockStateMap) AddReplicas(mnt *KeepMount, idx []arvados.KeepServiceI
 		bsm.get(ent.SizedDigest).addReplica(Replica{
 			KeepMount: mnt,
 			Mtime:     ent.Mtime,
+			ReadTime:  ent.ReadTime,
 		})
 	}
 }
 
+// ApplyChanges updates the map according to an index of changes
+// (see (*arvados.KeepService)IndexMountChanges) on mnt since the
+// replicas in the map were reported: blocks listed as removed no
+// longer have a replica on mnt, and other listed blocks have a
+// replica on mnt with the given mtime.
+func (bsm *BlockStateMap) ApplyChanges(mnt *KeepMount, changes []arvados.KeepServiceIndexEntry) {
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+
+	for _, ent := range changes {
+		blk := bsm.entries[ent.SizedDigest]
+		if blk == nil {
+			if ent.Removed {
+				continue
+			}
+			blk = bsm.get(ent.SizedDigest)
+		}
+		blk.removeReplica(mnt)
+		if !ent.Removed {
+			blk.addReplica(Replica{
+				KeepMount: mnt,
+				Mtime:     ent.Mtime,
+				ReadTime:  ent.ReadTime,
+			})
+		} else if len(blk.Replicas) == 0 && blk.RefCount == 0 {
+			delete(bsm.entries, ent.SizedDigest)
+		}
+	}
+}
+
+// RemoveReplicas updates the map to indicate that mnt has no
+// replicas. It is used before retrieving a full index of a mount
+// whose replicas were carried over from a previous balance operation.
+func (bsm *BlockStateMap) RemoveReplicas(mnt *KeepMount) {
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+
+	for blkid, blk := range bsm.entries {
+		blk.removeReplica(mnt)
+		if len(blk.Replicas) == 0 && blk.RefCount == 0 {
+			delete(bsm.entries, blkid)
+		}
+	}
+}
+
+// reset prepares a BlockStateMap from a previous balance operation to
+// be reused, so only the changes since then need to be applied. It
+// clears the desired replication of all blocks, and retains only the
+// replicas on the mounts in remap, replacing each of those mounts
+// with the corresponding new KeepMount.
+//
+// Entries that have no remaining replicas are removed.
+func (bsm *BlockStateMap) reset(maxReplication int, remap map[*KeepMount]*KeepMount) {
+	bsm.mutex.Lock()
+	defer bsm.mutex.Unlock()
+
+	bsm.pool = mapPool{Maximum: maxReplication + 1}
+	for blkid, blk := range bsm.entries {
+		replicas := blk.Replicas[:0]
+		for _, r := range blk.Replicas {
+			if mnt := remap[r.KeepMount]; mnt != nil {
+				r.KeepMount = mnt
+				replicas = append(replicas, r)
+			}
+		}
+		if len(replicas) == 0 {
+			delete(bsm.entries, blkid)
+			continue
+		}
+		clear(blk.Replicas[len(replicas):])
+		*blk = BlockState{Replicas: replicas}
+	}
+}
+
 // IncreaseDesired updates the map to indicate the desired replication
 // for the given blocks in the given storage class is at least n.
 //
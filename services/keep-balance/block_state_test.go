@@ -120,6 +120,104 @@ func (s *confirmedReplicationSuite) TestConcurrency(c *check.C) {
 	wg.Wait()
 }
 
+var _ = check.Suite(&incrementalIndexSuite{})
+
+type incrementalIndexSuite struct{}
+
+func (s *incrementalIndexSuite) TestResetAndApplyChanges(c *check.C) {
+	srv := &KeepService{KeepService: arvados.KeepService{UUID: "zzzzz-bi6l4-000000000000000"}}
+	mnt1 := &KeepMount{KeepMount: arvados.KeepMount{UUID: "zzzzz-mount-000000000000001", Replication: 1}, KeepService: srv}
+	mnt2 := &KeepMount{KeepMount: arvados.KeepMount{UUID: "zzzzz-mount-000000000000002", Replication: 1}, KeepService: srv}
+	bsm := NewBlockStateMap(2)
+	bsm.AddReplicas(mnt1, []arvados.KeepServiceIndexEntry{
+		{SizedDigest: knownBlkid(1), Mtime: 1},
+		{SizedDigest: knownBlkid(2), Mtime: 1},
+	})
+	bsm.AddReplicas(mnt2, []arvados.KeepServiceIndexEntry{
+		{SizedDigest: knownBlkid(2), Mtime: 1},
+		{SizedDigest: knownBlkid(3), Mtime: 1},
+	})
+	bsm.IncreaseDesired("", nil, 2, []arvados.SizedDigest{knownBlkid(1), knownBlkid(2)})
+
+	// Next run: mnt1 is updated incrementally, mnt2 will be
+	// fully re-indexed.
+	newmnt1 := &KeepMount{KeepMount: mnt1.KeepMount, KeepService: srv}
+	bsm.reset(2, map[*KeepMount]*KeepMount{mnt1: newmnt1})
+	c.Check(bsm.entries, check.HasLen, 2)
+	for _, blkid := range []arvados.SizedDigest{knownBlkid(1), knownBlkid(2)} {
+		blk := bsm.entries[blkid]
+		c.Assert(blk, check.NotNil)
+		c.Check(blk.Replicas, check.DeepEquals, []Replica{{KeepMount: newmnt1, Mtime: 1}})
+		c.Check(blk.RefCount, check.Equals, 0)
+		c.Check(blk.Desired, check.IsNil)
+	}
+	c.Check(bsm.entries[knownBlkid(3)], check.IsNil)
+
+	bsm.IncreaseDesired("", nil, 1, []arvados.SizedDigest{knownBlkid(2)})
+	bsm.ApplyChanges(newmnt1, []arvados.KeepServiceIndexEntry{
+		{SizedDigest: knownBlkid(1), Removed: true},
+		{SizedDigest: knownBlkid(2), Removed: true},
+		{SizedDigest: knownBlkid(4), Mtime: 2},
+		{SizedDigest: knownBlkid(5), Removed: true},
+	})
+	c.Check(bsm.entries[knownBlkid(1)], check.IsNil)
+	c.Check(bsm.entries[knownBlkid(2)].Replicas, check.HasLen, 0)
+	c.Check(bsm.entries[knownBlkid(2)].RefCount, check.Equals, 1)
+	c.Check(bsm.entries[knownBlkid(4)].Replicas, check.DeepEquals, []Replica{{KeepMount: newmnt1, Mtime: 2}})
+	c.Check(bsm.entries[knownBlkid(5)], check.IsNil)
+
+	bsm.ApplyChanges(newmnt1, []arvados.KeepServiceIndexEntry{
+		{SizedDigest: knownBlkid(4), Mtime: 3},
+	})
+	c.Check(bsm.entries[knownBlkid(4)].Replicas, check.DeepEquals, []Replica{{KeepMount: newmnt1, Mtime: 3}})
+
+	bsm.RemoveReplicas(newmnt1)
+	c.Check(bsm.entries[knownBlkid(4)], check.IsNil)
+	c.Check(bsm.entries[knownBlkid(2)], check.NotNil)
+}
+
+func (s *incrementalIndexSuite) TestIncrementalMounts(c *check.C) {
+	srv1 := &KeepService{KeepService: arvados.KeepService{UUID: "zzzzz-bi6l4-000000000000001"}}
+	srv2 := &KeepService{KeepService: arvados.KeepService{UUID: "zzzzz-bi6l4-000000000000002"}}
+	newMount := func(srv *KeepService, uuid string) *KeepMount {
+		return &KeepMount{KeepMount: arvados.KeepMount{UUID: uuid}, KeepService: srv}
+	}
+	prev := &indexState{mounts: map[string]indexMountState{}}
+	for _, mnt := range []*KeepMount{
+		newMount(srv1, "zzzzz-mount-000000000000001"),
+		newMount(srv1, "zzzzz-mount-000000000000002"),
+		newMount(srv1, "zzzzz-mount-000000000000003"),
+		newMount(srv2, "zzzzz-mount-000000000000003"),
+	} {
+		prev.set(mnt, 1, time.Now())
+	}
+	prev.set(newMount(srv1, "zzzzz-mount-000000000000004"), 1, time.Now().Add(-2*time.Hour))
+
+	// mount 1 is usable; mount 2 is now accessed through a
+	// different server; mount 3 is accessed through two servers;
+	// mount 4 is due for a full index.
+	mnt1 := newMount(srv1, "zzzzz-mount-000000000000001")
+	mnt2 := newMount(srv2, "zzzzz-mount-000000000000002")
+	mnt3 := newMount(srv1, "zzzzz-mount-000000000000003")
+	mnt4 := newMount(srv1, "zzzzz-mount-000000000000004")
+	equivMount := map[*KeepMount][]*KeepMount{
+		mnt1: {mnt1},
+		mnt2: {mnt2},
+		mnt3: {mnt3, newMount(srv2, "zzzzz-mount-000000000000003")},
+		mnt4: {mnt4},
+	}
+	bal := &Balancer{prevIndexState: prev, fullIndexInterval: time.Hour}
+	incremental := bal.incrementalMounts(equivMount)
+	c.Check(incremental, check.HasLen, 1)
+	c.Check(incremental[mnt1].asOf, check.Equals, int64(1))
+
+	bal.ChunkPrefix = "abc"
+	c.Check(bal.incrementalMounts(equivMount), check.HasLen, 0)
+	bal.ChunkPrefix = ""
+	bal.fullIndexInterval = 0
+	c.Check(bal.incrementalMounts(equivMount), check.HasLen, 0)
+}
+
 var _ = check.Suite(&mapPoolSuite{})
 
 type mapPoolSuite struct{}
@@ -0,0 +1,62 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepbalance
+
+import (
+	"sync"
+	"time"
+)
+
+// indexState is the information about keepstore indexes that is
+// carried over from one balance operation to the next when
+// Collections.BalanceFullIndexInterval is non-zero, so the next
+// operation only needs to retrieve the changes on each mount.
+type indexState struct {
+	bsm         *BlockStateMap
+	chunkPrefix string
+	mounts      map[string]indexMountState // keyed by indexStateKey(mnt)
+	mtx         sync.Mutex
+}
+
+type indexMountState struct {
+	mnt    *KeepMount // KeepMount referenced by replicas in bsm
+	asOf   int64      // "since" value for the next incremental index
+	fullAt time.Time  // time of the most recent full index
+}
+
+func indexStateKey(mnt *KeepMount) string {
+	return mnt.KeepService.UUID + "/" + mnt.UUID
+}
+
+func (is *indexState) set(mnt *KeepMount, asOf int64, fullAt time.Time) {
+	is.mtx.Lock()
+	defer is.mtx.Unlock()
+	is.mounts[indexStateKey(mnt)] = indexMountState{mnt: mnt, asOf: asOf, fullAt: fullAt}
+}
+
+// incrementalMounts returns the mounts (from equivMount, see
+// GetCurrentState) that can be updated with an incremental index,
+// along with their state from the previous balance operation.
+func (bal *Balancer) incrementalMounts(equivMount map[*KeepMount][]*KeepMount) map[*KeepMount]indexMountState {
+	prev := bal.prevIndexState
+	if bal.fullIndexInterval <= 0 || prev == nil || prev.chunkPrefix != bal.ChunkPrefix {
+		return nil
+	}
+	incremental := map[*KeepMount]indexMountState{}
+	for mnt, mounts := range equivMount {
+		if len(mounts) > 1 {
+			// The volume can be written through more than
+			// one keepstore server, so a single server's
+			// change journal is not enough.
+			continue
+		}
+		st, ok := prev.mounts[indexStateKey(mnt)]
+		if !ok || st.asOf <= 0 || time.Since(st.fullAt) >= bal.fullIndexInterval {
+			continue
+		}
+		incremental[mnt] = st
+	}
+	return incremental
+}
@@ -99,6 +99,10 @@ func (srv *KeepService) discoverMounts(c *arvados.Client) error {
 type KeepMount struct {
 	arvados.KeepMount
 	KeepService *KeepService
+
+	// ReadTimes is true if the mount's index included last-read
+	// times.
+	ReadTimes bool
 }
 
 // String implements fmt.Stringer.
@@ -68,6 +68,7 @@ func (m *metrics) UpdateStats(s balancerStats) {
 		"underreplicated":   {s.underrep, "underreplicated"},
 		"unachievable":      {s.unachievable, "unachievable"},
 		"balanced":          {s.justright, "optimally balanced"},
+		"cold":              {s.cold, "cold (moved to cold storage class)"},
 		"desired":           {s.desired, "desired"},
 		"lost":              {s.lost, "lost"},
 		"dedup_byte_ratio":  {s.dedupByteRatio(), "deduplication ratio, bytes referenced / bytes stored"},
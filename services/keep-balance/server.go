@@ -37,6 +37,12 @@ type RunOptions struct {
 	// we need to watch out for races. See
 	// (*Balancer)ClearTrashLists.
 	SafeRendezvousState string
+
+	// Block state and keepstore index times from the most recent
+	// successful balance operation, used to retrieve incremental
+	// indexes when Collections.BalanceFullIndexInterval is
+	// non-zero. See indexState.
+	indexState *indexState
 }
 
 type Server struct {
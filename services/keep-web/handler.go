@@ -632,9 +632,9 @@ func (h *handler) ServeHTTP(wOrig http.ResponseWriter, r *http.Request) {
 	}
 	if acceptlist := strings.Split(accept, ","); len(acceptlist) == 1 {
 		mediatype, _, err := mime.ParseMediaType(acceptlist[0])
-		if err == nil && mediatype == "application/zip" {
+		if format := archiveFormats[mediatype]; err == nil && format != nil {
 			releaseSession()
-			h.serveZip(w, r, session, sessionFS, fstarget, tokenUser)
+			h.serveArchive(w, r, session, sessionFS, fstarget, tokenUser, format)
 			return
 		}
 	}
@@ -34,6 +34,7 @@ const (
 	s3MaxKeys                 = 1000
 	s3SignAlgorithm           = "AWS4-HMAC-SHA256"
 	s3MaxClockSkew            = 5 * time.Minute
+	s3MaxPresignedExpiry      = 7 * 24 * time.Hour
 	s3SecretCacheTidyInterval = time.Minute
 )
 
@@ -163,8 +164,28 @@ func s3querystring(u *url.URL) string {
 
 var reMultipleSlashChars = regexp.MustCompile(`//+`)
 
+// s3presigned returns true if r is a presigned request, i.e., its V4
+// signature is given in the query string instead of an Authorization
+// header.
+func s3presigned(r *http.Request) bool {
+	return r.Header.Get("Authorization") == "" && r.URL.Query().Get("X-Amz-Algorithm") == s3SignAlgorithm
+}
+
 func s3stringToSign(alg, scope, signedHeaders string, r *http.Request) (string, error) {
-	timefmt, timestr := "20060102T150405Z", r.Header.Get("X-Amz-Date")
+	amzDate, payloadHash, u := r.Header.Get("X-Amz-Date"), r.Header.Get("X-Amz-Content-Sha256"), r.URL
+	if s3presigned(r) {
+		query := r.URL.Query()
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = query.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = "UNSIGNED-PAYLOAD"
+		}
+		// The signature itself is not part of the
+		// canonical query string.
+		query.Del("X-Amz-Signature")
+		u = &url.URL{RawQuery: query.Encode()}
+	}
+	timefmt, timestr := "20060102T150405Z", amzDate
 	if timestr == "" {
 		timefmt, timestr = time.RFC1123, r.Header.Get("Date")
 	}
@@ -172,7 +193,17 @@ func s3stringToSign(alg, scope, signedHeaders string, r *http.Request) (string,
 	if err != nil {
 		return "", fmt.Errorf("invalid timestamp %q: %s", timestr, err)
 	}
-	if skew := time.Now().Sub(t); skew < -s3MaxClockSkew || skew > s3MaxClockSkew {
+	if s3presigned(r) {
+		expires, err := strconv.Atoi(r.URL.Query().Get("X-Amz-Expires"))
+		if err != nil || expires < 1 || expires > int(s3MaxPresignedExpiry/time.Second) {
+			return "", fmt.Errorf("invalid X-Amz-Expires %q", r.URL.Query().Get("X-Amz-Expires"))
+		}
+		if skew := time.Now().Sub(t); skew < -s3MaxClockSkew {
+			return "", errors.New("exceeded max clock skew")
+		} else if time.Now().After(t.Add(time.Duration(expires) * time.Second)) {
+			return "", errors.New("presigned URL has expired")
+		}
+	} else if skew := time.Now().Sub(t); skew < -s3MaxClockSkew || skew > s3MaxClockSkew {
 		return "", errors.New("exceeded max clock skew")
 	}
 
@@ -187,9 +218,9 @@ func s3stringToSign(alg, scope, signedHeaders string, r *http.Request) (string,
 
 	normalizedPath := normalizePath(r.URL.Path)
 	ctxlog.FromContext(r.Context()).Debugf("normalizedPath %s", normalizedPath)
-	canonicalRequest := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s", r.Method, normalizedPath, s3querystring(r.URL), canonicalHeaders, signedHeaders, r.Header.Get("X-Amz-Content-Sha256"))
+	canonicalRequest := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s", r.Method, normalizedPath, s3querystring(u), canonicalHeaders, signedHeaders, payloadHash)
 	ctxlog.FromContext(r.Context()).Debugf("s3stringToSign: canonicalRequest %s", canonicalRequest)
-	return fmt.Sprintf("%s\n%s\n%s\n%s", alg, r.Header.Get("X-Amz-Date"), scope, hashdigest(sha256.New(), canonicalRequest)), nil
+	return fmt.Sprintf("%s\n%s\n%s\n%s", alg, amzDate, scope, hashdigest(sha256.New(), canonicalRequest)), nil
 }
 
 func normalizePath(s string) string {
@@ -274,26 +305,37 @@ func (h *handler) updateS3SecretCache(aca *arvados.APIClientAuthorization, key s
 // Arvados token that corresponds to the given accessKey. An error is
 // returned if accessKey is not a valid token UUID or the signature
 // does not match.
+//
+// The signature can be given in the Authorization header, or (in a
+// presigned URL) in the query string.
 func (h *handler) checks3signature(r *http.Request) (string, error) {
 	var key, scope, signedHeaders, signature string
-	authstring := strings.TrimPrefix(r.Header.Get("Authorization"), s3SignAlgorithm+" ")
-	for _, cmpt := range strings.Split(authstring, ",") {
-		cmpt = strings.TrimSpace(cmpt)
-		split := strings.SplitN(cmpt, "=", 2)
-		switch {
-		case len(split) != 2:
-			// (?) ignore
-		case split[0] == "Credential":
-			keyandscope := strings.SplitN(split[1], "/", 2)
-			if len(keyandscope) == 2 {
-				key, scope = keyandscope[0], keyandscope[1]
+	var credential string
+	if s3presigned(r) {
+		query := r.URL.Query()
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+	} else {
+		authstring := strings.TrimPrefix(r.Header.Get("Authorization"), s3SignAlgorithm+" ")
+		for _, cmpt := range strings.Split(authstring, ",") {
+			cmpt = strings.TrimSpace(cmpt)
+			split := strings.SplitN(cmpt, "=", 2)
+			switch {
+			case len(split) != 2:
+				// (?) ignore
+			case split[0] == "Credential":
+				credential = split[1]
+			case split[0] == "SignedHeaders":
+				signedHeaders = split[1]
+			case split[0] == "Signature":
+				signature = split[1]
 			}
-		case split[0] == "SignedHeaders":
-			signedHeaders = split[1]
-		case split[0] == "Signature":
-			signature = split[1]
 		}
 	}
+	if keyandscope := strings.SplitN(credential, "/", 2); len(keyandscope) == 2 {
+		key, scope = keyandscope[0], keyandscope[1]
+	}
 	keyIsUUID := len(key) == 27 && key[5:12] == "-gj3su-"
 	unescapedKey := unescapeKey(key)
 
@@ -387,7 +429,7 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			return true
 		}
 		token = unescapeKey(split[0])
-	} else if strings.HasPrefix(auth, s3SignAlgorithm+" ") {
+	} else if strings.HasPrefix(auth, s3SignAlgorithm+" ") || s3presigned(r) {
 		t, err := h.checks3signature(r)
 		if err != nil {
 			s3ErrorResponse(w, SignatureDoesNotMatch, "signature verification failed: "+err.Error(), r.URL.Path, http.StatusForbidden)
@@ -415,14 +457,15 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 	}
 
 	var objectNameGiven bool
-	var bucketName string
+	var bucketName, objectName string
 	fspath := "/by_id"
 	if id := arvados.CollectionIDFromDNSName(r.Host); id != "" {
 		fspath += "/" + id
 		bucketName = id
+		objectName = strings.TrimPrefix(r.URL.Path, "/")
 		objectNameGiven = strings.Count(strings.TrimSuffix(r.URL.Path, "/"), "/") > 0
 	} else {
-		bucketName = strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+		bucketName, objectName, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
 		objectNameGiven = strings.Count(strings.TrimSuffix(r.URL.Path, "/"), "/") > 1
 	}
 	fspath += reMultipleSlashChars.ReplaceAllString(r.URL.Path, "/")
@@ -446,14 +489,45 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 		}
 	}
 
+	query := r.URL.Query()
 	switch {
+	case r.Method == http.MethodGet && !objectNameGiven && query.Has("uploads"):
+		// ListMultipartUploads
+		h.s3ListMultipartUploads(w, r, sess.client.WithRequestID(r.Header.Get("X-Request-Id")), bucketName)
+		return true
+	case objectNameGiven && (query.Has("uploads") || query.Has("uploadId")):
+		// CreateMultipartUpload, UploadPart, etc.
+		h.serveS3MultipartUpload(w, r, s3MultipartRequest{
+			sess:   sess,
+			client: sess.client.WithRequestID(r.Header.Get("X-Request-Id")),
+			fs:     fs,
+			fspath: fspath,
+			bucket: bucketName,
+			key:    objectName,
+			user:   tokenUser,
+		})
+		return true
+	case r.Method == http.MethodGet && !objectNameGiven && query.Has("versions"):
+		// ListObjectVersions
+		h.s3ListObjectVersions(w, r, sess.client.WithRequestID(r.Header.Get("X-Request-Id")), fs, bucketName)
+		return true
+	case query.Has("tagging"):
+		// GetBucketTagging, PutObjectTagging, etc.
+		h.serveS3Tagging(w, r, sess.client.WithRequestID(r.Header.Get("X-Request-Id")), fs, fspath, objectNameGiven)
+		return true
 	case r.Method == http.MethodGet && !objectNameGiven:
 		// Path is "/{uuid}" or "/{uuid}/", has no object name
 		if _, ok := r.URL.Query()["versioning"]; ok {
 			// GetBucketVersioning
 			w.Header().Set("Content-Type", "application/xml")
 			io.WriteString(w, xml.Header)
-			fmt.Fprintln(w, `<VersioningConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"/>`)
+			if h.Cluster.Collections.CollectionVersioning {
+				// Collection versions are exposed as
+				// object versions, see s3versions.go
+				fmt.Fprintln(w, `<VersioningConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Status>Enabled</Status></VersioningConfiguration>`)
+			} else {
+				fmt.Fprintln(w, `<VersioningConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/"/>`)
+			}
 		} else if _, ok = r.URL.Query()["location"]; ok {
 			// GetBucketLocation
 			w.Header().Set("Content-Type", "application/xml")
@@ -462,7 +536,7 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 				h.Cluster.ClusterID+
 				`</LocationConstraint></LocationConstraint>`)
 		} else if reRawQueryIndicatesAPI.MatchString(r.URL.RawQuery) {
-			// GetBucketWebsite ("GET /bucketid/?website"), GetBucketTagging, etc.
+			// GetBucketWebsite ("GET /bucketid/?website"), GetBucketAcl, etc.
 			s3ErrorResponse(w, InvalidRequest, "API not supported", r.URL.Path+"?"+r.URL.RawQuery, http.StatusBadRequest)
 		} else {
 			// ListObjects
@@ -475,6 +549,11 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 			s3ErrorResponse(w, InvalidRequest, "API not supported", r.URL.Path+"?"+r.URL.RawQuery, http.StatusBadRequest)
 			return true
 		}
+		if objectNameGiven && query.Has("versionId") && query.Get("versionId") != "null" {
+			// GetObject/HeadObject with a specific version
+			h.s3GetObjectVersion(w, r, sess, fs, fspath, tokenUser)
+			return true
+		}
 		fi, err := fs.Stat(fspath)
 		if r.Method == "HEAD" && !objectNameGiven {
 			// HeadBucket
@@ -661,8 +740,9 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 				return true
 			}
 			err = client.RequestAndDecode(nil, "PATCH", "arvados/v1/collections/"+coll.UUID, nil, map[string]interface{}{
-				"replace_files": map[string]string{"/" + destpath: "manifest_text/file"},
-				"collection":    map[string]interface{}{"manifest_text": manifest}})
+				"replace_files":    map[string]string{"/" + destpath: "manifest_text/file"},
+				"merge_properties": s3MetaMergeProperties(destpath, s3MetaFromHeader(r.Header)),
+				"collection":       map[string]interface{}{"manifest_text": manifest}})
 			if err != nil {
 				status := http.StatusInternalServerError
 				if te := new(arvados.TransactionError); errors.As(err, te) {
@@ -675,7 +755,7 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 		return true
 	case r.Method == http.MethodDelete:
 		if reRawQueryIndicatesAPI.MatchString(r.URL.RawQuery) {
-			// DeleteObjectTagging ("DELETE /bucketid/objectid?tagging&versionID=..."), etc.
+			// DeleteBucketCors ("DELETE /bucketid/?cors"), etc.
 			s3ErrorResponse(w, InvalidRequest, "API not supported", r.URL.Path+"?"+r.URL.RawQuery, http.StatusBadRequest)
 			return true
 		}
@@ -715,7 +795,8 @@ func (h *handler) serveS3(w http.ResponseWriter, r *http.Request) bool {
 		destpath = strings.TrimSuffix(destpath, "/")
 		client := sess.client.WithRequestID(r.Header.Get("X-Request-Id"))
 		err = client.RequestAndDecode(nil, "PATCH", "arvados/v1/collections/"+coll.UUID, nil, map[string]interface{}{
-			"replace_files": map[string]string{"/" + destpath: ""}})
+			"replace_files":    map[string]string{"/" + destpath: ""},
+			"merge_properties": s3MetaMergeProperties(destpath, nil)})
 		if err != nil {
 			status := http.StatusInternalServerError
 			if te := new(arvados.TransactionError); errors.As(err, te) {
@@ -760,16 +841,10 @@ func (h *handler) syncCollection(srcfs, dstfs arvados.CustomFileSystem, path str
 }
 
 func setFileInfoHeaders(header http.Header, fs arvados.CustomFileSystem, path string) error {
-	maybeEncode := func(s string) string {
-		for _, c := range s {
-			if c > '\u007f' || c < ' ' {
-				return mime.BEncoding.Encode("UTF-8", s)
-			}
-		}
-		return s
-	}
 	path = strings.TrimSuffix(path, "/")
+	origpath := path
 	var props map[string]interface{}
+	var meta map[string]string
 	for {
 		fi, err := fs.Stat(path)
 		if err != nil {
@@ -778,6 +853,7 @@ func setFileInfoHeaders(header http.Header, fs arvados.CustomFileSystem, path st
 		switch src := fi.Sys().(type) {
 		case *arvados.Collection:
 			props = src.Properties
+			meta = getS3Meta(props, strings.TrimPrefix(origpath[len(path):], "/"))
 			if src.PortableDataHash != "" {
 				header.Set("Etag", fmt.Sprintf(`"%s"`, src.PortableDataHash))
 			}
@@ -797,8 +873,24 @@ func setFileInfoHeaders(header http.Header, fs arvados.CustomFileSystem, path st
 		}
 		break
 	}
+	setPropertyHeaders(header, props, meta)
+	return nil
+}
+
+// setPropertyHeaders sets x-amz-meta-* headers for the given
+// collection/project properties and per-file user metadata. Where a
+// key appears in both, the per-file metadata takes precedence.
+func setPropertyHeaders(header http.Header, props map[string]interface{}, meta map[string]string) {
+	maybeEncode := func(s string) string {
+		for _, c := range s {
+			if c > '\u007f' || c < ' ' {
+				return mime.BEncoding.Encode("UTF-8", s)
+			}
+		}
+		return s
+	}
 	for k, v := range props {
-		if !validMIMEHeaderKey(k) {
+		if !validMIMEHeaderKey(k) || k == s3MetaProperty {
 			continue
 		}
 		k = "x-amz-meta-" + k
@@ -808,7 +900,11 @@ func setFileInfoHeaders(header http.Header, fs arvados.CustomFileSystem, path st
 			header.Set(k, maybeEncode(string(j)))
 		}
 	}
-	return nil
+	for k, v := range meta {
+		if validMIMEHeaderKey(k) {
+			header.Set("x-amz-meta-"+k, maybeEncode(v))
+		}
+	}
 }
 
 func validMIMEHeaderKey(k string) bool {
@@ -7,8 +7,10 @@ package keepweb
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
@@ -33,6 +35,7 @@ import (
 	aws_aws "github.com/aws/aws-sdk-go/aws"
 	aws_credentials "github.com/aws/aws-sdk-go/aws/credentials"
 	aws_session "github.com/aws/aws-sdk-go/aws/session"
+	aws_v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	aws_s3 "github.com/aws/aws-sdk-go/service/s3"
 	check "gopkg.in/check.v1"
 )
@@ -115,6 +118,200 @@ func (s *CachedS3SecretSuite) TestIsValidAtZeroTime(c *check.C) {
 	c.Check(cache.isValidAt(time.Time{}), check.Equals, false)
 }
 
+type S3MetaSuite struct{}
+
+var _ = check.Suite(&S3MetaSuite{})
+
+func (s *S3MetaSuite) TestS3Meta(c *check.C) {
+	props := map[string]interface{}{
+		"foo":          "bar",
+		s3MetaProperty: map[string]interface{}{"dir/file": map[string]interface{}{"a": "b", "x": 1}},
+	}
+	c.Check(getS3Meta(props, "dir/file"), check.DeepEquals, map[string]string{"a": "b"})
+	c.Check(getS3Meta(props, "file"), check.DeepEquals, map[string]string{})
+	c.Check(getS3Meta(map[string]interface{}{}, "file"), check.DeepEquals, map[string]string{})
+
+	c.Check(s3MetaMergeProperties("dir/file", map[string]string{"c": "d"}), check.DeepEquals, map[string]interface{}{
+		s3MetaProperty: map[string]interface{}{"dir/file": map[string]interface{}{"c": "d"}},
+	})
+	c.Check(s3MetaMergeProperties("dir/file", nil), check.DeepEquals, map[string]interface{}{
+		s3MetaProperty: map[string]interface{}{"dir/file": nil},
+	})
+	c.Check(s3MetaMergeProperties("dir/file", map[string]string{}), check.DeepEquals, map[string]interface{}{
+		s3MetaProperty: map[string]interface{}{"dir/file": nil},
+	})
+}
+
+func (s *S3MetaSuite) TestManifestFiles(c *check.C) {
+	// "foo" and "dir/foo" have the same content, stored in
+	// different block layouts.
+	files := manifestFiles(". 37b51d194a7513e45b56f6524f2d51f2+3+Afoo@bar acbd18db4cc2f85cedef654fccc4a4d8+3 0:3:bar 3:3:foo 0:0:empty\\040file\n" +
+		"./dir acbd18db4cc2f85cedef654fccc4a4d8+3 37b51d194a7513e45b56f6524f2d51f2+3 0:3:foo 0:6:foobar 0:0:.\n")
+	c.Check(files, check.HasLen, 5)
+	c.Check(files["bar"].size, check.Equals, int64(3))
+	c.Check(files["empty file"].size, check.Equals, int64(0))
+	c.Check(files["dir/foobar"].size, check.Equals, int64(6))
+	c.Check(files["foo"], check.Equals, files["dir/foo"])
+	c.Check(files["foo"], check.Not(check.Equals), files["bar"])
+}
+
+// Paging through a ListObjectVersions response, with entries for
+// later keys being discarded along the way, should produce the same
+// results as listing everything at once.
+func (s *S3MetaSuite) TestVersionListPaging(c *check.C) {
+	blocks := []string{"acbd18db4cc2f85cedef654fccc4a4d8+3", "37b51d194a7513e45b56f6524f2d51f2+3"}
+	paths := []string{"a", "b/c", "b/d", "b/e/f", "g", "h/i"}
+	var versions []arvados.Collection
+	for v := 1; v <= 30; v++ {
+		streams := map[string]string{}
+		for i, path := range paths {
+			// Each file changes content or disappears in
+			// some versions.
+			if (v+i)%7 == 0 {
+				continue
+			}
+			dir, name := ".", path
+			if cut := strings.LastIndex(path, "/"); cut >= 0 {
+				dir, name = "./"+path[:cut], path[cut+1:]
+			}
+			streams[dir] += fmt.Sprintf(" %d:3:%s", 3*((v/(i+2))%2), name)
+		}
+		var manifest string
+		for _, dir := range []string{".", "./b", "./b/e", "./h"} {
+			if toks := streams[dir]; toks != "" {
+				manifest += dir + " " + blocks[0] + " " + blocks[1] + toks + "\n"
+			}
+		}
+		versions = append(versions, arvados.Collection{Version: v, ManifestText: manifest, ModifiedAt: time.Unix(int64(v), 0)})
+	}
+	pruned := 0
+	list := func(resp *listVersionsResp, pageSize int) {
+		vl := newS3VersionList(resp, "coll/")
+		for i, v := range versions {
+			vl.add(v)
+			if pageSize > 0 && i%pageSize == 0 {
+				vl.prune()
+			}
+		}
+		vl.finish()
+		if vl.cutoff != "" {
+			pruned++
+		}
+	}
+	summary := func(resp *listVersionsResp) []string {
+		var got []string
+		for _, ent := range resp.Entries {
+			got = append(got, fmt.Sprintf("%s %s %s %v", ent.XMLName.Local, ent.Key, ent.VersionId, ent.IsLatest))
+		}
+		for _, cp := range resp.CommonPrefixes {
+			got = append(got, "prefix "+cp.Prefix)
+		}
+		return got
+	}
+	for _, delimiter := range []string{"", "/"} {
+		for _, prefix := range []string{"coll/", "coll/b/"} {
+			all := listVersionsResp{Prefix: prefix, Delimiter: delimiter, MaxKeys: 1000000}
+			list(&all, 0)
+			c.Assert(all.IsTruncated, check.Equals, false)
+			expect := summary(&all)
+			c.Assert(len(expect) > 3, check.Equals, true)
+			for _, maxKeys := range []int{1, 2, 5} {
+				for _, pageSize := range []int{1, 3} {
+					c.Logf("=== delimiter %q prefix %q maxKeys %d pageSize %d", delimiter, prefix, maxKeys, pageSize)
+					var got []string
+					var keyMarker, versionIDMarker string
+					for page := 0; page < len(expect)+1; page++ {
+						resp := listVersionsResp{Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys, KeyMarker: keyMarker, VersionIdMarker: versionIDMarker}
+						list(&resp, pageSize)
+						c.Check(len(resp.Entries)+len(resp.CommonPrefixes) <= maxKeys, check.Equals, true)
+						got = append(got, summary(&resp)...)
+						if !resp.IsTruncated {
+							break
+						}
+						keyMarker, versionIDMarker = resp.NextKeyMarker, resp.NextVersionIdMarker
+					}
+					sort.Strings(got)
+					sorted := append([]string(nil), expect...)
+					sort.Strings(sorted)
+					c.Check(got, check.DeepEquals, sorted)
+				}
+			}
+		}
+	}
+	c.Check(pruned > 0, check.Equals, true)
+}
+
+type S3PresignSuite struct{}
+
+var _ = check.Suite(&S3PresignSuite{})
+
+func (s *S3PresignSuite) TestChecks3signature(c *check.C) {
+	h := &handler{Cluster: &arvados.Cluster{}}
+	h.Cluster.Collections.WebDAVCache.TTL = arvados.Duration(time.Minute)
+	aca := &arvados.APIClientAuthorization{
+		UUID:     arvadostest.ActiveTokenUUID,
+		APIToken: arvadostest.ActiveToken,
+	}
+	h.updateS3SecretCache(aca, aca.UUID)
+	signer := aws_v4.NewSigner(aws_credentials.NewStaticCredentials(aca.UUID, aca.APIToken, ""), func(signer *aws_v4.Signer) {
+		// Same as the S3 client in aws-sdk-go
+		signer.DisableURIPathEscaping = true
+	})
+	presign := func(method, target string, expires time.Duration, signTime time.Time) *http.Request {
+		req := httptest.NewRequest(method, target, nil)
+		_, err := signer.Presign(req, nil, "s3", "zzzzz", expires, signTime)
+		c.Assert(err, check.IsNil)
+		// Simulate receiving the presigned URL on the server
+		// side.
+		u, err := url.Parse(req.URL.String())
+		c.Assert(err, check.IsNil)
+		return httptest.NewRequest(method, u.String(), nil)
+	}
+
+	for _, method := range []string{"GET", "PUT"} {
+		req := presign(method, "https://download.example.com/"+arvadostest.FooCollection+"/foo%20bar.txt", time.Hour, time.Now())
+		c.Check(s3presigned(req), check.Equals, true)
+		token, err := h.checks3signature(req)
+		c.Check(err, check.IsNil)
+		c.Check(token, check.Equals, aca.TokenV2())
+	}
+
+	c.Log("wrong method")
+	req := presign("GET", "https://download.example.com/"+arvadostest.FooCollection+"/foo", time.Hour, time.Now())
+	req.Method = "PUT"
+	_, err := h.checks3signature(req)
+	c.Check(err, check.ErrorMatches, `signature does not match.*`)
+
+	c.Log("wrong path")
+	req = presign("GET", "https://download.example.com/"+arvadostest.FooCollection+"/foo", time.Hour, time.Now())
+	req.URL.Path += "bar"
+	_, err = h.checks3signature(req)
+	c.Check(err, check.ErrorMatches, `signature does not match.*`)
+
+	c.Log("modified query")
+	req = presign("GET", "https://download.example.com/"+arvadostest.FooCollection+"/foo", time.Hour, time.Now())
+	q := req.URL.Query()
+	q.Set("X-Amz-Expires", "7200")
+	req.URL.RawQuery = q.Encode()
+	_, err = h.checks3signature(req)
+	c.Check(err, check.ErrorMatches, `signature does not match.*`)
+
+	c.Log("expired")
+	req = presign("GET", "https://download.example.com/"+arvadostest.FooCollection+"/foo", time.Hour, time.Now().Add(-2*time.Hour))
+	_, err = h.checks3signature(req)
+	c.Check(err, check.ErrorMatches, `presigned URL has expired`)
+
+	c.Log("signed in the future")
+	req = presign("GET", "https://download.example.com/"+arvadostest.FooCollection+"/foo", time.Hour, time.Now().Add(time.Hour))
+	_, err = h.checks3signature(req)
+	c.Check(err, check.ErrorMatches, `exceeded max clock skew`)
+
+	c.Log("expiry too long")
+	req = presign("GET", "https://download.example.com/"+arvadostest.FooCollection+"/foo", 8*24*time.Hour, time.Now())
+	_, err = h.checks3signature(req)
+	c.Check(err, check.ErrorMatches, `invalid X-Amz-Expires.*`)
+}
+
 type s3stage struct {
 	arv        *arvados.Client
 	ac         *arvadosclient.ArvadosClient
@@ -498,6 +695,274 @@ func (s *IntegrationSuite) TestS3PropertiesAsMetadata(c *check.C) {
 	s.checkMetaEquals(c, resp.Header, expectProjectTags)
 }
 
+func (s *IntegrationSuite) TestS3UserMetadata(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+
+	expectCollectionTags := map[string]string{
+		"String":   "string value",
+		"Array":    `["element1","element2"]`,
+		"Object":   mime.BEncoding.Encode("UTF-8", `{"key":{"key2":"value⛵"}}`),
+		"Nonascii": "=?UTF-8?b?4pu1?=",
+		"Newline":  mime.BEncoding.Encode("UTF-8", "foo\r\nX-Bad: header"),
+	}
+	expectFileTags := map[string]string{"Foo": "bar"}
+	for k, v := range expectCollectionTags {
+		expectFileTags[k] = v
+	}
+	expectFileTags["String"] = "file value"
+
+	c.Log("PUT object with user metadata")
+	err := stage.collbucket.PutReader("newfile", bytes.NewReader([]byte("foo")), 3, "application/octet-stream", s3.Private, s3.Options{
+		Meta: map[string][]string{"foo": {"bar"}, "string": {"file value"}},
+	})
+	c.Assert(err, check.IsNil)
+	resp, err := stage.collbucket.Head("newfile", nil)
+	c.Assert(err, check.IsNil)
+	s.checkMetaEquals(c, resp.Header, expectFileTags)
+	resp, err = stage.projbucket.Head(stage.coll.Name+"/newfile", nil)
+	c.Assert(err, check.IsNil)
+	s.checkMetaEquals(c, resp.Header, expectFileTags)
+
+	c.Log("metadata does not apply to other files")
+	resp, err = stage.collbucket.Head("sailboat.txt", nil)
+	c.Assert(err, check.IsNil)
+	s.checkMetaEquals(c, resp.Header, expectCollectionTags)
+
+	c.Log("PUT object without user metadata replaces existing metadata")
+	err = stage.collbucket.PutReader("newfile", bytes.NewReader([]byte("bar")), 3, "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	resp, err = stage.collbucket.Head("newfile", nil)
+	c.Assert(err, check.IsNil)
+	s.checkMetaEquals(c, resp.Header, expectCollectionTags)
+
+	c.Log("DELETE object removes its metadata")
+	err = stage.collbucket.PutReader("newfile", bytes.NewReader([]byte("foo")), 3, "application/octet-stream", s3.Private, s3.Options{
+		Meta: map[string][]string{"foo": {"bar"}},
+	})
+	c.Assert(err, check.IsNil)
+	var coll arvados.Collection
+	err = stage.arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.Properties[s3MetaProperty], check.DeepEquals, map[string]interface{}{"newfile": map[string]interface{}{"foo": "bar"}})
+	err = stage.collbucket.Del("newfile")
+	c.Assert(err, check.IsNil)
+	err = stage.arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.Properties[s3MetaProperty], check.IsNil)
+	c.Check(coll.Properties["string"], check.Equals, "string value")
+}
+
+// Concurrent uploads of different files with user metadata should
+// not overwrite each other's metadata, or tags set in the meantime.
+func (s *IntegrationSuite) TestS3ConcurrentMetadataWrites(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+
+	// Load the collection into the session cache before setting
+	// tags, so the cached properties are stale.
+	rdr, err := stage.collbucket.GetReader("emptyfile")
+	c.Assert(err, check.IsNil)
+	rdr.Close()
+	err = stage.arv.RequestAndDecode(nil, "PATCH", "arvados/v1/collections/"+stage.coll.UUID, nil, map[string]interface{}{
+		"collection": map[string]interface{}{
+			"properties": map[string]interface{}{"tag1": "value1"},
+		},
+	})
+	c.Assert(err, check.IsNil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := stage.collbucket.PutReader(fmt.Sprintf("file%d", i), bytes.NewReader([]byte("foo")), 3, "application/octet-stream", s3.Private, s3.Options{
+				Meta: map[string][]string{"index": {fmt.Sprintf("%d", i)}},
+			})
+			c.Check(err, check.IsNil)
+		}()
+	}
+	wg.Wait()
+
+	var coll arvados.Collection
+	err = stage.arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.Properties["tag1"], check.Equals, "value1")
+	for i := 0; i < 8; i++ {
+		c.Check(getS3Meta(coll.Properties, fmt.Sprintf("file%d", i)), check.DeepEquals, map[string]string{"index": fmt.Sprintf("%d", i)})
+	}
+}
+
+func (s *IntegrationSuite) TestS3PresignedURLs(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	sess := aws_session.Must(aws_session.NewSession(&aws_aws.Config{
+		Region:           aws_aws.String("auto"),
+		Endpoint:         aws_aws.String(s.testServer.URL),
+		Credentials:      aws_credentials.NewStaticCredentials(arvadostest.ActiveTokenUUID, arvadostest.ActiveToken, ""),
+		S3ForcePathStyle: aws_aws.Bool(true),
+	}))
+	client := aws_s3.New(sess)
+
+	c.Log("presigned PUT")
+	req, _ := client.PutObjectRequest(&aws_s3.PutObjectInput{
+		Bucket: aws_aws.String(stage.coll.UUID),
+		Key:    aws_aws.String("shared dir/new file.txt"),
+	})
+	puturl, err := req.Presign(time.Hour)
+	c.Assert(err, check.IsNil)
+	c.Check(puturl, check.Not(check.Matches), `.*`+arvadostest.ActiveToken+`.*`)
+	httpreq, err := http.NewRequest("PUT", puturl, strings.NewReader("shared content"))
+	c.Assert(err, check.IsNil)
+	resp, err := http.DefaultClient.Do(httpreq)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+
+	c.Log("presigned GET")
+	req, _ = client.GetObjectRequest(&aws_s3.GetObjectInput{
+		Bucket: aws_aws.String(stage.coll.UUID),
+		Key:    aws_aws.String("shared dir/new file.txt"),
+	})
+	geturl, err := req.Presign(time.Hour)
+	c.Assert(err, check.IsNil)
+	resp, err = http.Get(geturl)
+	c.Assert(err, check.IsNil)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Check(err, check.IsNil)
+	c.Check(resp.StatusCode, check.Equals, http.StatusOK)
+	c.Check(string(body), check.Equals, "shared content")
+
+	c.Log("presigned GET URL cannot be used for a different file")
+	u, err := url.Parse(geturl)
+	c.Assert(err, check.IsNil)
+	u.Path = "/" + stage.coll.UUID + "/sailboat.txt"
+	resp, err = http.Get(u.String())
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, check.Equals, http.StatusForbidden)
+
+	c.Log("presigned GET URL cannot be used for PUT")
+	httpreq, err = http.NewRequest("PUT", geturl, strings.NewReader("overwritten"))
+	c.Assert(err, check.IsNil)
+	resp, err = http.DefaultClient.Do(httpreq)
+	c.Assert(err, check.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, check.Equals, http.StatusForbidden)
+}
+
+func (s *IntegrationSuite) TestS3Tagging(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	sess := aws_session.Must(aws_session.NewSession(&aws_aws.Config{
+		Region:           aws_aws.String("auto"),
+		Endpoint:         aws_aws.String(s.testServer.URL),
+		Credentials:      aws_credentials.NewStaticCredentials(url.QueryEscape(arvadostest.ActiveTokenV2), url.QueryEscape(arvadostest.ActiveTokenV2), ""),
+		S3ForcePathStyle: aws_aws.Bool(true),
+	}))
+	client := aws_s3.New(sess)
+	tagmap := func(tags []*aws_s3.Tag) map[string]string {
+		m := map[string]string{}
+		for _, tag := range tags {
+			m[*tag.Key] = *tag.Value
+		}
+		return m
+	}
+
+	c.Log("GetBucketTagging returns string-valued collection properties")
+	bt, err := client.GetBucketTagging(&aws_s3.GetBucketTaggingInput{
+		Bucket: aws_aws.String(stage.coll.UUID),
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(tagmap(bt.TagSet), check.DeepEquals, map[string]string{
+		"string":         "string value",
+		"nonascii":       "⛵",
+		"newline":        "foo\r\nX-Bad: header",
+		"a: a\r\nInject": "bogus",
+	})
+
+	c.Log("GetBucketTagging does not return system properties")
+	err = stage.arv.RequestAndDecode(nil, "PATCH", "arvados/v1/collections/"+stage.coll.UUID, nil, map[string]interface{}{
+		"merge_properties": map[string]interface{}{"arv:test": "system value"},
+	})
+	c.Assert(err, check.IsNil)
+	bt, err = client.GetBucketTagging(&aws_s3.GetBucketTaggingInput{
+		Bucket: aws_aws.String(stage.coll.UUID),
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(tagmap(bt.TagSet), check.HasLen, 4)
+	c.Check(tagmap(bt.TagSet)["arv:test"], check.Equals, "")
+
+	c.Log("PutBucketTagging replaces string-valued collection properties")
+	_, err = client.PutBucketTagging(&aws_s3.PutBucketTaggingInput{
+		Bucket: aws_aws.String(stage.coll.UUID),
+		Tagging: &aws_s3.Tagging{TagSet: []*aws_s3.Tag{
+			{Key: aws_aws.String("foo"), Value: aws_aws.String("bar")},
+		}},
+	})
+	c.Assert(err, check.IsNil)
+	var coll arvados.Collection
+	err = stage.arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.Properties, check.DeepEquals, map[string]interface{}{
+		"foo":      "bar",
+		"arv:test": "system value",
+		"array":    []interface{}{"element1", "element2"},
+		"object":   map[string]interface{}{"key": map[string]interface{}{"key2": "value⛵"}},
+	})
+
+	c.Log("PutBucketTagging rejects system property keys")
+	_, err = client.PutBucketTagging(&aws_s3.PutBucketTaggingInput{
+		Bucket: aws_aws.String(stage.coll.UUID),
+		Tagging: &aws_s3.Tagging{TagSet: []*aws_s3.Tag{
+			{Key: aws_aws.String("arv:test"), Value: aws_aws.String("user value")},
+		}},
+	})
+	c.Check(err, check.ErrorMatches, `InvalidTag:.*`)
+
+	c.Log("GetObjectTagging returns properties of the containing collection")
+	ot, err := client.GetObjectTagging(&aws_s3.GetObjectTaggingInput{
+		Bucket: aws_aws.String(stage.proj.UUID),
+		Key:    aws_aws.String(stage.coll.Name + "/sailboat.txt"),
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(tagmap(ot.TagSet), check.DeepEquals, map[string]string{"foo": "bar"})
+
+	c.Log("PutObjectTagging on a subproject updates the subproject properties")
+	_, err = client.PutObjectTagging(&aws_s3.PutObjectTaggingInput{
+		Bucket: aws_aws.String(stage.proj.UUID),
+		Key:    aws_aws.String(stage.subproj.Name + "/"),
+		Tagging: &aws_s3.Tagging{TagSet: []*aws_s3.Tag{
+			{Key: aws_aws.String("baz"), Value: aws_aws.String("waz")},
+		}},
+	})
+	c.Assert(err, check.IsNil)
+	var subproj arvados.Group
+	err = stage.arv.RequestAndDecode(&subproj, "GET", "arvados/v1/groups/"+stage.subproj.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(subproj.Properties, check.DeepEquals, map[string]interface{}{"baz": "waz"})
+
+	c.Log("DeleteObjectTagging removes string-valued collection properties")
+	_, err = client.DeleteObjectTagging(&aws_s3.DeleteObjectTaggingInput{
+		Bucket: aws_aws.String(stage.coll.UUID),
+		Key:    aws_aws.String("sailboat.txt"),
+	})
+	c.Assert(err, check.IsNil)
+	err = stage.arv.RequestAndDecode(&coll, "GET", "arvados/v1/collections/"+stage.coll.UUID, nil, nil)
+	c.Assert(err, check.IsNil)
+	c.Check(coll.Properties["foo"], check.IsNil)
+	c.Check(coll.Properties["array"], check.NotNil)
+	c.Check(coll.Properties["arv:test"], check.Equals, "system value")
+
+	c.Log("GetObjectTagging on a nonexistent object")
+	_, err = client.GetObjectTagging(&aws_s3.GetObjectTaggingInput{
+		Bucket: aws_aws.String(stage.coll.UUID),
+		Key:    aws_aws.String("nonexistent"),
+	})
+	c.Check(err, check.ErrorMatches, `NoSuchKey:.*`)
+}
+
 func (s *IntegrationSuite) TestS3CollectionPutObjectSuccess(c *check.C) {
 	stage := s.s3setup(c)
 	defer stage.teardown(c)
@@ -585,6 +1050,128 @@ func (s *IntegrationSuite) testS3PutObjectSuccess(c *check.C, bucket *s3.Bucket,
 	}
 }
 
+func (s *IntegrationSuite) TestS3CollectionMultipartUpload(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3MultipartUpload(c, stage.collbucket, "")
+}
+func (s *IntegrationSuite) TestS3ProjectMultipartUpload(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	s.testS3MultipartUpload(c, stage.projbucket, stage.coll.Name+"/")
+}
+func (s *IntegrationSuite) testS3MultipartUpload(c *check.C, bucket *s3.Bucket, prefix string) {
+	objname := prefix + "multipart/newfile"
+	multi, err := bucket.InitMulti(objname, "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+
+	multis, _, err := bucket.ListMulti(prefix+"multipart/", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(multis, check.HasLen, 1)
+	c.Check(multis[0].Key, check.Equals, objname)
+	c.Check(multis[0].UploadId, check.Equals, multi.UploadId)
+
+	var parts []s3.Part
+	var expect []byte
+	for i, size := range []int{5 << 20, 5 << 20, 1234} {
+		buf := make([]byte, size)
+		if i == 1 {
+			// Upload a part, then replace it with
+			// different data.
+			rand.Read(buf)
+			_, err = multi.PutPart(i+1, bytes.NewReader(buf))
+			c.Assert(err, check.IsNil)
+		}
+		rand.Read(buf)
+		part, err := multi.PutPart(i+1, bytes.NewReader(buf))
+		c.Assert(err, check.IsNil)
+		sum := md5.Sum(buf)
+		c.Check(part.ETag, check.Equals, `"`+hex.EncodeToString(sum[:])+`"`)
+		parts = append(parts, part)
+		expect = append(expect, buf...)
+	}
+
+	listed, err := multi.ListParts()
+	c.Assert(err, check.IsNil)
+	c.Assert(listed, check.HasLen, 3)
+	for i, part := range listed {
+		c.Check(part.N, check.Equals, i+1)
+		c.Check(part.ETag, check.Equals, parts[i].ETag)
+		c.Check(part.Size, check.Equals, parts[i].Size)
+	}
+
+	// Parts are not visible until the upload is completed.
+	_, err = bucket.GetReader(objname)
+	c.Check(err, check.ErrorMatches, `The specified key does not exist.`)
+
+	err = multi.Complete(parts)
+	c.Assert(err, check.IsNil)
+
+	rdr, err := bucket.GetReader(objname)
+	c.Assert(err, check.IsNil)
+	buf, err := ioutil.ReadAll(rdr)
+	c.Check(err, check.IsNil)
+	c.Check(buf, check.HasLen, len(expect))
+	c.Check(bytes.Equal(buf, expect), check.Equals, true)
+
+	// Upload is no longer listed, and cannot be completed again.
+	multis, _, err = bucket.ListMulti(prefix+"multipart/", "")
+	c.Check(err, check.IsNil)
+	c.Check(multis, check.HasLen, 0)
+	err = multi.Complete(parts)
+	c.Check(err, check.NotNil)
+	c.Check(err.(*s3.Error).Code, check.Equals, "NoSuchUpload")
+}
+
+func (s *IntegrationSuite) TestS3AbortMultipartUpload(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	multi, err := stage.collbucket.InitMulti("aborted", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	_, err = multi.PutPart(1, bytes.NewReader([]byte("foo")))
+	c.Assert(err, check.IsNil)
+	err = multi.Abort()
+	c.Assert(err, check.IsNil)
+
+	multis, _, err := stage.collbucket.ListMulti("", "")
+	c.Check(err, check.IsNil)
+	c.Check(multis, check.HasLen, 0)
+	_, err = multi.PutPart(2, bytes.NewReader([]byte("bar")))
+	c.Assert(err, check.NotNil)
+	c.Check(err.(*s3.Error).Code, check.Equals, "NoSuchUpload")
+	_, err = stage.collbucket.GetReader("aborted")
+	c.Check(err, check.ErrorMatches, `The specified key does not exist.`)
+}
+
+func (s *IntegrationSuite) TestS3CompleteMultipartUploadErrors(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+	multi, err := stage.collbucket.InitMulti("newfile", "application/octet-stream", s3.Private, s3.Options{})
+	c.Assert(err, check.IsNil)
+	defer multi.Abort()
+	part, err := multi.PutPart(1, bytes.NewReader([]byte("foo")))
+	c.Assert(err, check.IsNil)
+
+	// Wrong ETag
+	err = multi.Complete([]s3.Part{{N: 1, ETag: `"37b51d194a7513e45b56f6524f2d51f2"`}})
+	c.Assert(err, check.NotNil)
+	c.Check(err.(*s3.Error).Code, check.Equals, "InvalidPart")
+	// Part never uploaded
+	err = multi.Complete([]s3.Part{part, {N: 2, ETag: part.ETag}})
+	c.Assert(err, check.NotNil)
+	c.Check(err.(*s3.Error).Code, check.Equals, "InvalidPart")
+	// Upload ID is not valid for a different key
+	other := *multi
+	other.Key = "otherfile"
+	err = other.Complete([]s3.Part{part})
+	c.Assert(err, check.NotNil)
+	c.Check(err.(*s3.Error).Code, check.Equals, "NoSuchUpload")
+
+	err = multi.Complete([]s3.Part{part})
+	c.Check(err, check.IsNil)
+	s.checkGet(c, stage, "newfile", 3)
+}
+
 func (s *IntegrationSuite) TestS3ProjectPutObjectNotSupported(c *check.C) {
 	stage := s.s3setup(c)
 	defer stage.teardown(c)
@@ -915,10 +1502,152 @@ func (s *IntegrationSuite) TestS3GetBucketVersioning(c *check.C) {
 		c.Check(resp.Header.Get("Content-Type"), check.Equals, "application/xml")
 		buf, err := ioutil.ReadAll(resp.Body)
 		c.Assert(err, check.IsNil)
+		c.Check(string(buf), check.Equals, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<VersioningConfiguration xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\"><Status>Enabled</Status></VersioningConfiguration>\n")
+	}
+	s.handler.Cluster.Collections.CollectionVersioning = false
+	for _, bucket := range []*s3.Bucket{stage.collbucket, stage.projbucket} {
+		req, err := http.NewRequest("GET", bucket.URL("/"), nil)
+		c.Check(err, check.IsNil)
+		req.Header.Set("Authorization", "AWS "+arvadostest.ActiveTokenV2+":none")
+		req.URL.RawQuery = "versioning"
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		buf, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, check.IsNil)
 		c.Check(string(buf), check.Equals, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<VersioningConfiguration xmlns=\"http://s3.amazonaws.com/doc/2006-03-01/\"/>\n")
 	}
 }
 
+func (s *IntegrationSuite) TestS3ObjectVersions(c *check.C) {
+	stage := s.s3setup(c)
+	defer stage.teardown(c)
+
+	// Save each change as a new collection version.
+	update := func(replaceFiles map[string]string, manifest string) int {
+		var coll arvados.Collection
+		err := stage.arv.RequestAndDecode(&coll, "PATCH", "arvados/v1/collections/"+stage.coll.UUID, nil, map[string]interface{}{
+			"replace_files": replaceFiles,
+			"collection": map[string]interface{}{
+				"manifest_text":    manifest,
+				"preserve_version": true,
+			},
+		})
+		c.Assert(err, check.IsNil)
+		return coll.Version
+	}
+	fooLocator, _, err := stage.kc.PutB([]byte("foo"))
+	c.Assert(err, check.IsNil)
+	barLocator, _, err := stage.kc.PutB([]byte("bar"))
+	c.Assert(err, check.IsNil)
+	v1 := update(map[string]string{"/newfile": "manifest_text/foo"}, ". "+fooLocator+" 0:3:foo\n")
+	v2 := update(map[string]string{"/emptyfile": ""}, "")
+	v3 := update(map[string]string{"/newfile": "manifest_text/bar"}, ". "+barLocator+" 0:3:bar\n")
+	c.Assert(v3 > v2 && v2 > v1, check.Equals, true)
+
+	sess := aws_session.Must(aws_session.NewSession(&aws_aws.Config{
+		Region:           aws_aws.String("auto"),
+		Endpoint:         aws_aws.String(s.testServer.URL),
+		Credentials:      aws_credentials.NewStaticCredentials(url.QueryEscape(arvadostest.ActiveTokenV2), url.QueryEscape(arvadostest.ActiveTokenV2), ""),
+		S3ForcePathStyle: aws_aws.Bool(true),
+	}))
+	client := aws_s3.New(sess)
+	for _, trial := range []struct {
+		bucket string
+		prefix string
+	}{
+		{stage.coll.UUID, ""},
+		{stage.proj.UUID, stage.coll.Name + "/"},
+	} {
+		c.Logf("=== %v", trial)
+		result, err := client.ListObjectVersions(&aws_s3.ListObjectVersionsInput{
+			Bucket: aws_aws.String(trial.bucket),
+			Prefix: aws_aws.String(trial.prefix),
+		})
+		c.Assert(err, check.IsNil)
+		var got []string
+		for _, v := range result.Versions {
+			got = append(got, fmt.Sprintf("%s %s %v %d", strings.TrimPrefix(*v.Key, trial.prefix), *v.VersionId, *v.IsLatest, *v.Size))
+		}
+		for _, m := range result.DeleteMarkers {
+			got = append(got, fmt.Sprintf("%s %s %v delete", strings.TrimPrefix(*m.Key, trial.prefix), *m.VersionId, *m.IsLatest))
+		}
+		sort.Strings(got)
+		c.Check(got, check.DeepEquals, []string{
+			fmt.Sprintf("emptyfile %d false 0", v1-1),
+			fmt.Sprintf("emptyfile %d true delete", v2),
+			fmt.Sprintf("newfile %d false 3", v1),
+			fmt.Sprintf("newfile %d true 3", v3),
+			fmt.Sprintf("sailboat.txt %d true 4", v1-1),
+		})
+
+		// Page through the same list one entry at a time.
+		var paged []string
+		input := &aws_s3.ListObjectVersionsInput{
+			Bucket:  aws_aws.String(trial.bucket),
+			Prefix:  aws_aws.String(trial.prefix),
+			MaxKeys: aws_aws.Int64(1),
+		}
+		for page := 0; ; page++ {
+			c.Assert(page < 10, check.Equals, true)
+			result, err := client.ListObjectVersions(input)
+			c.Assert(err, check.IsNil)
+			c.Check(len(result.Versions)+len(result.DeleteMarkers), check.Equals, 1)
+			for _, v := range result.Versions {
+				paged = append(paged, fmt.Sprintf("%s %s %v %d", strings.TrimPrefix(*v.Key, trial.prefix), *v.VersionId, *v.IsLatest, *v.Size))
+			}
+			for _, m := range result.DeleteMarkers {
+				paged = append(paged, fmt.Sprintf("%s %s %v delete", strings.TrimPrefix(*m.Key, trial.prefix), *m.VersionId, *m.IsLatest))
+			}
+			if !*result.IsTruncated {
+				break
+			}
+			input.KeyMarker = result.NextKeyMarker
+			input.VersionIdMarker = result.NextVersionIdMarker
+		}
+		sort.Strings(paged)
+		c.Check(paged, check.DeepEquals, got)
+
+		obj, err := client.GetObject(&aws_s3.GetObjectInput{
+			Bucket:    aws_aws.String(trial.bucket),
+			Key:       aws_aws.String(trial.prefix + "newfile"),
+			VersionId: aws_aws.String(fmt.Sprintf("%d", v2)),
+		})
+		c.Assert(err, check.IsNil)
+		buf, err := ioutil.ReadAll(obj.Body)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf), check.Equals, "foo")
+		c.Check(*obj.VersionId, check.Equals, fmt.Sprintf("%d", v2))
+
+		obj, err = client.GetObject(&aws_s3.GetObjectInput{
+			Bucket: aws_aws.String(trial.bucket),
+			Key:    aws_aws.String(trial.prefix + "newfile"),
+		})
+		c.Assert(err, check.IsNil)
+		buf, err = ioutil.ReadAll(obj.Body)
+		c.Check(err, check.IsNil)
+		c.Check(string(buf), check.Equals, "bar")
+
+		_, err = client.HeadObject(&aws_s3.HeadObjectInput{
+			Bucket:    aws_aws.String(trial.bucket),
+			Key:       aws_aws.String(trial.prefix + "emptyfile"),
+			VersionId: aws_aws.String(fmt.Sprintf("%d", v1)),
+		})
+		c.Check(err, check.IsNil)
+		_, err = client.HeadObject(&aws_s3.HeadObjectInput{
+			Bucket:    aws_aws.String(trial.bucket),
+			Key:       aws_aws.String(trial.prefix + "emptyfile"),
+			VersionId: aws_aws.String(fmt.Sprintf("%d", v2)),
+		})
+		c.Check(err, check.ErrorMatches, `NotFound:.*`)
+		_, err = client.GetObject(&aws_s3.GetObjectInput{
+			Bucket:    aws_aws.String(trial.bucket),
+			Key:       aws_aws.String(trial.prefix + "newfile"),
+			VersionId: aws_aws.String("999"),
+		})
+		c.Check(err, check.ErrorMatches, `NoSuchVersion:.*`)
+	}
+}
+
 func (s *IntegrationSuite) TestS3UnsupportedAPIs(c *check.C) {
 	stage := s.s3setup(c)
 	defer stage.teardown(c)
@@ -931,8 +1660,8 @@ func (s *IntegrationSuite) TestS3UnsupportedAPIs(c *check.C) {
 		{"GET", "/foo", "acl&versionId=1234"}, // GetObjectAcl
 		{"PUT", "/", "acl"},                   // PutBucketAcl
 		{"PUT", "/foo", "acl"},                // PutObjectAcl
-		{"DELETE", "/", "tagging"},            // DeleteBucketTagging
-		{"DELETE", "/foo", "tagging"},         // DeleteObjectTagging
+		{"DELETE", "/", "cors"},               // DeleteBucketCors
+		{"PUT", "/foo", "retention"},          // PutObjectRetention
 	} {
 		for _, bucket := range []*s3.Bucket{stage.collbucket, stage.projbucket} {
 			c.Logf("trial %v bucket %v", trial, bucket)
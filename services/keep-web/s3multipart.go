@@ -0,0 +1,602 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepweb
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+)
+
+// Multipart uploads are staged in a collection (one per upload)
+// owned by the user who initiated the upload. The upload ID is the
+// staging collection's UUID. Each part is saved in the staging
+// collection as a file named "{partNumber}.{md5}", where md5 (the
+// part's ETag) is the MD5 digest of the part data. When the upload
+// is completed, the listed parts are concatenated -- by reference,
+// without copying any data -- into the destination file, and the
+// staging collection is trashed.
+//
+// Because all of the state is stored in the staging collection,
+// the requests that make up a multipart upload can be handled by
+// different keep-web processes.
+const (
+	s3MultipartUploadType = "s3_multipart_upload"
+	s3MaxParts            = 10000
+)
+
+var (
+	NoSuchUpload     = "NoSuchUpload"
+	InvalidPart      = "InvalidPart"
+	InvalidPartOrder = "InvalidPartOrder"
+	MalformedXML     = "MalformedXML"
+
+	errNoSuchUpload = errors.New("the specified multipart upload does not exist")
+
+	reUploadID     = regexp.MustCompile(`^[0-9a-z]{5}-4zz18-[0-9a-z]{15}$`)
+	reETag         = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	reStagedPart   = regexp.MustCompile(`^([0-9]{5})\.([0-9a-f]{32})$`)
+	reFileSegToken = regexp.MustCompile(`^([0-9]+):([0-9]+):(.*)$`)
+)
+
+type initiateMultipartUploadResp struct {
+	XMLName  string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type completeMultipartUploadReq struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResp struct {
+	XMLName  string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+type s3Upload struct {
+	Key          string
+	UploadId     string
+	Initiated    string
+	StorageClass string
+}
+
+type listMultipartUploadsResp struct {
+	XMLName            string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListMultipartUploadsResult"`
+	Bucket             string
+	KeyMarker          string
+	UploadIdMarker     string
+	NextKeyMarker      string `xml:",omitempty"`
+	NextUploadIdMarker string `xml:",omitempty"`
+	Delimiter          string `xml:",omitempty"`
+	Prefix             string
+	MaxUploads         int
+	IsTruncated        bool
+	Upload             []s3Upload
+	CommonPrefixes     []commonPrefix
+}
+
+type s3Part struct {
+	PartNumber   int
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+type listPartsResp struct {
+	XMLName              string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket               string
+	Key                  string
+	UploadId             string
+	PartNumberMarker     int
+	NextPartNumberMarker int `xml:",omitempty"`
+	MaxParts             int
+	IsTruncated          bool
+	Part                 []s3Part
+	StorageClass         string
+}
+
+// s3MultipartRequest holds the parts of an S3 request that are
+// needed by the multipart upload handlers.
+type s3MultipartRequest struct {
+	sess     *cachedSession
+	client   *arvados.Client
+	fs       arvados.CustomFileSystem
+	fspath   string
+	bucket   string
+	key      string
+	uploadID string
+	user     *arvados.User
+}
+
+// serveS3MultipartUpload handles CreateMultipartUpload, UploadPart,
+// CompleteMultipartUpload, AbortMultipartUpload, and ListParts
+// requests.
+func (h *handler) serveS3MultipartUpload(w http.ResponseWriter, r *http.Request, mr s3MultipartRequest) {
+	query := r.URL.Query()
+	mr.uploadID = query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		h.s3CreateMultipartUpload(w, r, mr)
+	case r.Method == http.MethodPut && mr.uploadID != "":
+		h.s3UploadPart(w, r, mr)
+	case r.Method == http.MethodPost && mr.uploadID != "":
+		h.s3CompleteMultipartUpload(w, r, mr)
+	case r.Method == http.MethodDelete && mr.uploadID != "":
+		h.s3AbortMultipartUpload(w, r, mr)
+	case r.Method == http.MethodGet && mr.uploadID != "":
+		h.s3ListParts(w, r, mr)
+	default:
+		s3ErrorResponse(w, InvalidRequest, "method not allowed", r.URL.Path+"?"+r.URL.RawQuery, http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handler) s3CreateMultipartUpload(w http.ResponseWriter, r *http.Request, mr s3MultipartRequest) {
+	if !h.userPermittedToUploadOrDownload(http.MethodPut, mr.user) {
+		http.Error(w, "Not permitted", http.StatusForbidden)
+		return
+	}
+	if strings.HasSuffix(mr.key, "/") {
+		s3ErrorResponse(w, InvalidArgument, "invalid object name: trailing slash", r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	if coll, _ := h.determineCollection(mr.fs, mr.fspath); coll == nil {
+		s3ErrorResponse(w, InvalidArgument, "invalid argument: path is not in a collection", r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	attrs := map[string]interface{}{
+		"name": "S3 multipart upload of " + path.Base(mr.key),
+		"properties": map[string]interface{}{
+			"type":          s3MultipartUploadType,
+			"arv:s3_bucket": mr.bucket,
+			"arv:s3_key":    mr.key,
+		},
+	}
+	if meta := s3MetaFromHeader(r.Header); len(meta) > 0 {
+		// Save the user metadata to apply to the file when
+		// the upload is completed.
+		attrs["properties"].(map[string]interface{})[s3MetaProperty] = meta
+	}
+	if ttl := h.Cluster.Collections.S3MultipartUploadTTL.Duration(); ttl > 0 {
+		attrs["trash_at"] = time.Now().Add(ttl).UTC()
+	}
+	var staging arvados.Collection
+	err := mr.client.RequestAndDecode(&staging, "POST", "arvados/v1/collections", nil, map[string]interface{}{
+		"ensure_unique_name": true,
+		"select":             []string{"uuid"},
+		"collection":         attrs,
+	})
+	if err != nil {
+		s3ErrorResponse(w, InternalError, "error creating staging collection: "+err.Error(), r.URL.Path, transactionErrorStatus(err))
+		return
+	}
+	writeS3XML(w, r, initiateMultipartUploadResp{
+		Bucket:   mr.bucket,
+		Key:      mr.key,
+		UploadId: staging.UUID,
+	})
+}
+
+func (h *handler) s3UploadPart(w http.ResponseWriter, r *http.Request, mr s3MultipartRequest) {
+	if !h.userPermittedToUploadOrDownload(http.MethodPut, mr.user) {
+		http.Error(w, "Not permitted", http.StatusForbidden)
+		return
+	}
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxParts {
+		s3ErrorResponse(w, InvalidArgument, fmt.Sprintf("part number must be an integer between 1 and %d", s3MaxParts), r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		// UploadPartCopy
+		s3ErrorResponse(w, InvalidRequest, "API not supported", r.URL.Path+"?"+r.URL.RawQuery, http.StatusBadRequest)
+		return
+	}
+	staging, ok := h.s3GetMultipartUpload(w, r, mr)
+	if !ok {
+		return
+	}
+
+	// As with PutObject, write the data to a file (named "file")
+	// in a new empty collection, then use the replace_files API
+	// to add it to the staging collection.
+	tmpfs, err := (&arvados.Collection{}).FileSystem(mr.client, mr.sess.keepclient)
+	if err != nil {
+		s3ErrorResponse(w, InternalError, fmt.Sprintf("tmpfs failed: %s", err), r.URL.Path, http.StatusInternalServerError)
+		return
+	}
+	f, err := tmpfs.OpenFile("file", os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		s3ErrorResponse(w, InternalError, fmt.Sprintf("open failed: %s", err), r.URL.Path, http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), r.Body)
+	if err != nil {
+		s3ErrorResponse(w, InternalError, fmt.Sprintf("write to %q failed: %s", r.URL.Path, err), r.URL.Path, http.StatusBadGateway)
+		return
+	}
+	err = f.Close()
+	if err != nil {
+		s3ErrorResponse(w, InternalError, fmt.Sprintf("write to %q failed: close: %s", r.URL.Path, err), r.URL.Path, http.StatusBadGateway)
+		return
+	}
+	manifest, err := tmpfs.MarshalManifest(".")
+	if err != nil {
+		s3ErrorResponse(w, InternalError, fmt.Sprintf("marshal tmpfs: %s", err), r.URL.Path, http.StatusBadGateway)
+		return
+	}
+	etag := hex.EncodeToString(hash.Sum(nil))
+	partname := fmt.Sprintf("%05d.%s", partNumber, etag)
+	replace := map[string]string{"/" + partname: "manifest_text/file"}
+	// If this part was uploaded before, remove the old copy.
+	_, files := parseStagingManifest(staging.ManifestText)
+	for name := range files {
+		if m := reStagedPart.FindStringSubmatch(name); m != nil && name != partname && m[1] == partname[:5] {
+			replace["/"+name] = ""
+		}
+	}
+	err = mr.client.RequestAndDecode(nil, "PATCH", "arvados/v1/collections/"+staging.UUID, nil, map[string]interface{}{
+		"replace_files": replace,
+		"select":        []string{"uuid"},
+		"collection":    map[string]interface{}{"manifest_text": manifest}})
+	if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, transactionErrorStatus(err))
+		return
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handler) s3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request, mr s3MultipartRequest) {
+	if !h.userPermittedToUploadOrDownload(http.MethodPut, mr.user) {
+		http.Error(w, "Not permitted", http.StatusForbidden)
+		return
+	}
+	var req completeMultipartUploadReq
+	err := xml.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Parts) == 0 {
+		s3ErrorResponse(w, MalformedXML, "The XML you provided was not well-formed or did not validate against our published schema.", r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	staging, ok := h.s3GetMultipartUpload(w, r, mr)
+	if !ok {
+		return
+	}
+	coll, destpath := h.determineCollection(mr.fs, mr.fspath)
+	if coll == nil {
+		s3ErrorResponse(w, InvalidArgument, "invalid argument: path is not in a collection", r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	if fi, err := mr.fs.Stat(mr.fspath); err != nil && err.Error() == "not a directory" {
+		// requested foo/bar, but foo is a file
+		s3ErrorResponse(w, InvalidArgument, "object name conflicts with existing object", r.URL.Path, http.StatusBadRequest)
+		return
+	} else if err == nil && fi.IsDir() {
+		s3ErrorResponse(w, InvalidArgument, "object name conflicts with existing directory", r.URL.Path, http.StatusBadRequest)
+		return
+	}
+
+	// Build a manifest with a single file ("file") whose content
+	// is the concatenation of the listed parts, using the same
+	// blocks as the staging collection.
+	locators, files := parseStagingManifest(staging.ManifestText)
+	var segs []stagedSegment
+	etags := md5.New()
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			s3ErrorResponse(w, InvalidPartOrder, "The list of parts was not in ascending order.", r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		etag := strings.Trim(part.ETag, `"`)
+		partsegs, ok := files[fmt.Sprintf("%05d.%s", part.PartNumber, etag)]
+		if !reETag.MatchString(etag) || !ok {
+			s3ErrorResponse(w, InvalidPart, fmt.Sprintf("Part %d with ETag %q could not be found.", part.PartNumber, part.ETag), r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		sum, _ := hex.DecodeString(etag)
+		etags.Write(sum)
+		for _, seg := range partsegs {
+			if seg.size == 0 {
+				continue
+			} else if n := len(segs); n > 0 && segs[n-1].pos+segs[n-1].size == seg.pos {
+				// Extend the previous segment.
+				segs[n-1].size += seg.size
+			} else {
+				segs = append(segs, seg)
+			}
+		}
+	}
+	if len(locators) == 0 {
+		locators = []string{"d41d8cd98f00b204e9800998ecf8427e+0"}
+	}
+	if len(segs) == 0 {
+		segs = []stagedSegment{{0, 0}}
+	}
+	manifest := ". " + strings.Join(locators, " ")
+	for _, seg := range segs {
+		manifest += fmt.Sprintf(" %d:%d:file", seg.pos, seg.size)
+	}
+	manifest += "\n"
+
+	meta := map[string]string{}
+	if m, ok := staging.Properties[s3MetaProperty].(map[string]interface{}); ok {
+		for k, v := range m {
+			if v, ok := v.(string); ok {
+				meta[k] = v
+			}
+		}
+	}
+
+	h.logUploadOrDownload(r, mr.sess.arvadosclient, mr.fs, mr.fspath, 1, nil, mr.user)
+	err = mr.client.RequestAndDecode(nil, "PATCH", "arvados/v1/collections/"+coll.UUID, nil, map[string]interface{}{
+		"replace_files":    map[string]string{"/" + destpath: "manifest_text/file"},
+		"merge_properties": s3MetaMergeProperties(destpath, meta),
+		"select":           []string{"uuid"},
+		"collection":       map[string]interface{}{"manifest_text": manifest}})
+	if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, transactionErrorStatus(err))
+		return
+	}
+	err = mr.client.RequestAndDecode(nil, "DELETE", "arvados/v1/collections/"+staging.UUID, nil, nil)
+	if err != nil {
+		// The upload is complete, so there is no point
+		// reporting an error to the client. The staging
+		// collection will be trashed at its trash_at time.
+		ctxlog.FromContext(r.Context()).WithError(err).Warnf("error trashing multipart upload staging collection %s", staging.UUID)
+	}
+	writeS3XML(w, r, completeMultipartUploadResp{
+		Location: r.URL.Path,
+		Bucket:   mr.bucket,
+		Key:      mr.key,
+		ETag:     fmt.Sprintf(`"%x-%d"`, etags.Sum(nil), len(req.Parts)),
+	})
+}
+
+func (h *handler) s3AbortMultipartUpload(w http.ResponseWriter, r *http.Request, mr s3MultipartRequest) {
+	staging, ok := h.s3GetMultipartUpload(w, r, mr)
+	if !ok {
+		return
+	}
+	err := mr.client.RequestAndDecode(nil, "DELETE", "arvados/v1/collections/"+staging.UUID, nil, nil)
+	if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, transactionErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) s3ListParts(w http.ResponseWriter, r *http.Request, mr s3MultipartRequest) {
+	staging, ok := h.s3GetMultipartUpload(w, r, mr)
+	if !ok {
+		return
+	}
+	maxParts := s3MaxKeys
+	if mp, _ := strconv.Atoi(r.FormValue("max-parts")); mp > 0 && mp < maxParts {
+		maxParts = mp
+	}
+	marker, _ := strconv.Atoi(r.FormValue("part-number-marker"))
+	resp := listPartsResp{
+		Bucket:           mr.bucket,
+		Key:              mr.key,
+		UploadId:         staging.UUID,
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+		StorageClass:     "STANDARD",
+	}
+	_, files := parseStagingManifest(staging.ManifestText)
+	for name, segs := range files {
+		m := reStagedPart.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		if n <= marker {
+			continue
+		}
+		part := s3Part{
+			PartNumber:   n,
+			LastModified: staging.ModifiedAt.UTC().Format("2006-01-02T15:04:05.999") + "Z",
+			ETag:         `"` + m[2] + `"`,
+		}
+		for _, seg := range segs {
+			part.Size += seg.size
+		}
+		resp.Part = append(resp.Part, part)
+	}
+	sort.Slice(resp.Part, func(i, j int) bool { return resp.Part[i].PartNumber < resp.Part[j].PartNumber })
+	if len(resp.Part) > maxParts {
+		resp.Part = resp.Part[:maxParts]
+		resp.IsTruncated = true
+		resp.NextPartNumberMarker = resp.Part[maxParts-1].PartNumber
+	}
+	writeS3XML(w, r, resp)
+}
+
+// s3ListMultipartUploads handles a ListMultipartUploads request
+// ("GET /bucket?uploads").
+func (h *handler) s3ListMultipartUploads(w http.ResponseWriter, r *http.Request, client *arvados.Client, bucket string) {
+	resp := listMultipartUploadsResp{
+		Bucket:         bucket,
+		KeyMarker:      r.FormValue("key-marker"),
+		UploadIdMarker: r.FormValue("upload-id-marker"),
+		Delimiter:      r.FormValue("delimiter"),
+		Prefix:         r.FormValue("prefix"),
+		MaxUploads:     s3MaxKeys,
+	}
+	if mu, _ := strconv.Atoi(r.FormValue("max-uploads")); mu > 0 && mu < resp.MaxUploads {
+		resp.MaxUploads = mu
+	}
+	var uploads []s3Upload
+	for offset := 0; ; {
+		var list arvados.CollectionList
+		err := client.RequestAndDecode(&list, "GET", "arvados/v1/collections", nil, map[string]interface{}{
+			"filters": []arvados.Filter{
+				{"properties.type", "=", s3MultipartUploadType},
+				{"properties.arv:s3_bucket", "=", bucket},
+			},
+			"select": []string{"uuid", "properties", "created_at"},
+			"order":  "uuid",
+			"offset": offset,
+			"count":  "none",
+		})
+		if err != nil {
+			s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, transactionErrorStatus(err))
+			return
+		}
+		for _, coll := range list.Items {
+			key, _ := coll.Properties["arv:s3_key"].(string)
+			if !strings.HasPrefix(key, resp.Prefix) {
+				continue
+			}
+			uploads = append(uploads, s3Upload{
+				Key:          key,
+				UploadId:     coll.UUID,
+				Initiated:    coll.CreatedAt.UTC().Format("2006-01-02T15:04:05.999") + "Z",
+				StorageClass: "STANDARD",
+			})
+		}
+		if len(list.Items) == 0 {
+			break
+		}
+		offset += len(list.Items)
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Key != uploads[j].Key {
+			return uploads[i].Key < uploads[j].Key
+		}
+		return uploads[i].UploadId < uploads[j].UploadId
+	})
+	commonPrefixes := map[string]bool{}
+	for _, upload := range uploads {
+		if upload.Key < resp.KeyMarker ||
+			(upload.Key == resp.KeyMarker && (resp.UploadIdMarker == "" || upload.UploadId <= resp.UploadIdMarker)) {
+			continue
+		}
+		if resp.Delimiter != "" {
+			if cut := strings.Index(upload.Key[len(resp.Prefix):], resp.Delimiter); cut >= 0 {
+				prefix := upload.Key[:len(resp.Prefix)+cut+len(resp.Delimiter)]
+				if !commonPrefixes[prefix] {
+					if len(resp.Upload)+len(commonPrefixes) >= resp.MaxUploads {
+						resp.IsTruncated = true
+						break
+					}
+					commonPrefixes[prefix] = true
+					resp.CommonPrefixes = append(resp.CommonPrefixes, commonPrefix{prefix})
+				}
+				continue
+			}
+		}
+		if len(resp.Upload)+len(commonPrefixes) >= resp.MaxUploads {
+			resp.IsTruncated = true
+			break
+		}
+		resp.Upload = append(resp.Upload, upload)
+		resp.NextKeyMarker = upload.Key
+		resp.NextUploadIdMarker = upload.UploadId
+	}
+	if !resp.IsTruncated {
+		resp.NextKeyMarker = ""
+		resp.NextUploadIdMarker = ""
+	}
+	writeS3XML(w, r, resp)
+}
+
+// s3GetMultipartUpload returns the staging collection for the
+// multipart upload given in mr. If the upload does not exist, or
+// is for a different bucket/key, it sends an error response and
+// returns false.
+func (h *handler) s3GetMultipartUpload(w http.ResponseWriter, r *http.Request, mr s3MultipartRequest) (*arvados.Collection, bool) {
+	var staging arvados.Collection
+	err := errNoSuchUpload
+	if reUploadID.MatchString(mr.uploadID) {
+		err = mr.client.RequestAndDecode(&staging, "GET", "arvados/v1/collections/"+mr.uploadID, nil, map[string]interface{}{
+			"select": []string{"uuid", "manifest_text", "properties", "modified_at"},
+		})
+		if err == nil && (staging.Properties["type"] != s3MultipartUploadType ||
+			staging.Properties["arv:s3_bucket"] != mr.bucket ||
+			staging.Properties["arv:s3_key"] != mr.key) {
+			err = errNoSuchUpload
+		}
+	}
+	if err == errNoSuchUpload || transactionErrorStatus(err) == http.StatusNotFound {
+		s3ErrorResponse(w, NoSuchUpload, "The specified multipart upload does not exist. The upload ID might be invalid, or the multipart upload might have been aborted, completed, or expired.", r.URL.Path, http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, transactionErrorStatus(err))
+		return nil, false
+	}
+	return &staging, true
+}
+
+type stagedSegment struct {
+	pos  int64
+	size int64
+}
+
+// parseStagingManifest returns the block locators in the root
+// stream of a (normalized) staging collection manifest, and the
+// segments of each file in that stream.
+func parseStagingManifest(txt string) ([]string, map[string][]stagedSegment) {
+	var locators []string
+	files := map[string][]stagedSegment{}
+	for _, line := range strings.Split(txt, "\n") {
+		toks := strings.Split(line, " ")
+		if toks[0] != "." {
+			continue
+		}
+		for _, tok := range toks[1:] {
+			m := reFileSegToken.FindStringSubmatch(tok)
+			if m == nil {
+				locators = append(locators, tok)
+				continue
+			}
+			pos, _ := strconv.ParseInt(m[1], 10, 64)
+			size, _ := strconv.ParseInt(m[2], 10, 64)
+			files[m[3]] = append(files[m[3]], stagedSegment{pos, size})
+		}
+	}
+	return locators, files
+}
+
+// transactionErrorStatus returns the HTTP status code of an API
+// error, or 500 if err is not an API error.
+func transactionErrorStatus(err error) int {
+	if te := new(arvados.TransactionError); errors.As(err, te) {
+		return te.HTTPStatus()
+	}
+	return http.StatusInternalServerError
+}
+
+func writeS3XML(w http.ResponseWriter, r *http.Request, resp interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(resp); err != nil {
+		ctxlog.FromContext(r.Context()).WithError(err).Error("error writing xml response")
+	}
+}
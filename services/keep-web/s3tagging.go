@@ -0,0 +1,244 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepweb
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Collection property used to store the S3 user metadata
+// ("x-amz-meta-*" headers) given when uploading individual files.
+// The value is a map of file paths (relative to the top level of
+// the collection) to maps of lowercase metadata keys (without the
+// "x-amz-meta-" prefix) to values.
+const s3MetaProperty = "arv:s3_meta"
+
+var (
+	InvalidTag = "InvalidTag"
+)
+
+type s3Tag struct {
+	Key   string
+	Value string
+}
+
+type s3TaggingReq struct {
+	TagSet []s3Tag `xml:"TagSet>Tag"`
+}
+
+type s3TaggingResp struct {
+	XMLName string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ Tagging"`
+	// Use a nested struct so the TagSet element is included
+	// even when there are no tags.
+	TagSet struct {
+		Tag []s3Tag
+	}
+}
+
+// serveS3Tagging handles Get/Put/DeleteBucketTagging and
+// Get/Put/DeleteObjectTagging requests.
+//
+// Tags are the string-valued properties of the collection or
+// project indicated by the bucket (or, for object tagging, the
+// collection or project containing the object). Properties with
+// other types of values, and system properties (whose keys start
+// with "arv:"), are not exposed as tags, and are left alone when the
+// tags are replaced.
+//
+// Tags are replaced using merge_properties, so concurrent updates to
+// other properties are not lost.
+func (h *handler) serveS3Tagging(w http.ResponseWriter, r *http.Request, client *arvados.Client, fs arvados.CustomFileSystem, fspath string, objectNameGiven bool) {
+	if _, err := fs.Stat(fspath); os.IsNotExist(err) || (err != nil && err.Error() == "not a directory") {
+		if objectNameGiven {
+			s3ErrorResponse(w, NoSuchKey, "The specified key does not exist.", r.URL.Path, http.StatusNotFound)
+		} else {
+			s3ErrorResponse(w, NoSuchBucket, "The specified bucket does not exist.", r.URL.Path, http.StatusNotFound)
+		}
+		return
+	} else if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusInternalServerError)
+		return
+	}
+	resource, uuid, err := s3TaggingTarget(fs, fspath)
+	if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusInternalServerError)
+		return
+	} else if uuid == "" {
+		s3ErrorResponse(w, InvalidRequest, "tagging is only supported for collections and projects", r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	// Get the current properties from the API server, rather
+	// than using the (possibly stale) ones in our filesystem.
+	var current struct {
+		Properties map[string]interface{}
+	}
+	err = client.RequestAndDecode(&current, "GET", "arvados/v1/"+resource+"s/"+uuid, nil, map[string]interface{}{
+		"select": []string{"uuid", "properties"},
+	})
+	if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, transactionErrorStatus(err))
+		return
+	}
+
+	var tags []s3Tag
+	switch r.Method {
+	case http.MethodGet:
+		var resp s3TaggingResp
+		resp.TagSet.Tag = []s3Tag{}
+		for k, v := range current.Properties {
+			if s, ok := v.(string); ok && !isSystemProperty(k) {
+				resp.TagSet.Tag = append(resp.TagSet.Tag, s3Tag{k, s})
+			}
+		}
+		sort.Slice(resp.TagSet.Tag, func(i, j int) bool { return resp.TagSet.Tag[i].Key < resp.TagSet.Tag[j].Key })
+		writeS3XML(w, r, resp)
+		return
+	case http.MethodPut:
+		var req s3TaggingReq
+		err = xml.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			s3ErrorResponse(w, MalformedXML, "The XML you provided was not well-formed or did not validate against our published schema.", r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		tags = req.TagSet
+	case http.MethodDelete:
+	default:
+		s3ErrorResponse(w, InvalidRequest, "method not allowed", r.URL.Path, http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Remove existing tags that are not in the new tag set, and
+	// add/replace the new tags.
+	merge := map[string]interface{}{}
+	for k, v := range current.Properties {
+		if _, ok := v.(string); ok && !isSystemProperty(k) {
+			merge[k] = nil
+		}
+	}
+	given := map[string]bool{}
+	for _, tag := range tags {
+		if tag.Key == "" {
+			s3ErrorResponse(w, InvalidTag, "The tag key cannot be empty.", r.URL.Path, http.StatusBadRequest)
+			return
+		} else if isSystemProperty(tag.Key) {
+			s3ErrorResponse(w, InvalidTag, "Tag keys starting with \"arv:\" are reserved for system use.", r.URL.Path, http.StatusBadRequest)
+			return
+		} else if _, isString := current.Properties[tag.Key].(string); given[tag.Key] || (current.Properties[tag.Key] != nil && !isString) {
+			s3ErrorResponse(w, InvalidTag, "Cannot provide multiple Tags with the same key, or a Tag with the same key as a non-string property.", r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		given[tag.Key] = true
+		merge[tag.Key] = tag.Value
+	}
+	if len(merge) > 0 {
+		err = client.RequestAndDecode(nil, "PATCH", "arvados/v1/"+resource+"s/"+uuid, nil, map[string]interface{}{
+			"select":           []string{"uuid"},
+			"merge_properties": merge,
+		})
+	}
+	if te := new(arvados.TransactionError); errors.As(err, te) && (te.StatusCode == http.StatusBadRequest || te.StatusCode == http.StatusUnprocessableEntity) {
+		// Most likely the tags did not pass vocabulary
+		// validation.
+		s3ErrorResponse(w, InvalidTag, err.Error(), r.URL.Path, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, transactionErrorStatus(err))
+		return
+	}
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// isSystemProperty returns true if the given property key is
+// reserved for use by Arvados components.
+func isSystemProperty(key string) bool {
+	return strings.HasPrefix(key, "arv:")
+}
+
+// s3TaggingTarget returns the API resource type ("collection" or
+// "group") and UUID of the collection or project that holds the
+// tags for the given path.
+func s3TaggingTarget(fs arvados.CustomFileSystem, path string) (string, string, error) {
+	path = strings.TrimSuffix(path, "/")
+	for {
+		fi, err := fs.Stat(path)
+		if err != nil {
+			return "", "", err
+		}
+		switch src := fi.Sys().(type) {
+		case *arvados.Collection:
+			return "collection", src.UUID, nil
+		case *arvados.Group:
+			return "group", src.UUID, nil
+		default:
+			if err, ok := src.(error); ok {
+				return "", "", err
+			}
+			cut := strings.LastIndexByte(path, '/')
+			if cut < 0 {
+				return "", "", nil
+			}
+			path = path[:cut]
+		}
+	}
+}
+
+// s3MetaFromHeader returns the S3 user metadata ("x-amz-meta-*"
+// headers) in the given request headers, with lowercase keys and the
+// "x-amz-meta-" prefix removed.
+func s3MetaFromHeader(header http.Header) map[string]string {
+	meta := map[string]string{}
+	for k, v := range header {
+		if len(v) > 0 && strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			meta[strings.ToLower(k[len("x-amz-meta-"):])] = strings.Join(v, ",")
+		}
+	}
+	return meta
+}
+
+// getS3Meta returns the S3 user metadata stored in the collection
+// properties props for the file at path.
+func getS3Meta(props map[string]interface{}, path string) map[string]string {
+	all, _ := props[s3MetaProperty].(map[string]interface{})
+	filemeta, _ := all[path].(map[string]interface{})
+	meta := map[string]string{}
+	for k, v := range filemeta {
+		if s, ok := v.(string); ok {
+			meta[k] = s
+		}
+	}
+	return meta
+}
+
+// s3MetaMergeProperties returns the merge_properties parameter for a
+// collection update that replaces the S3 user metadata for the file
+// at path with meta (or removes it, if meta is empty).
+//
+// The merge is done by the API server while the collection is locked,
+// so concurrent updates to other files' metadata, or to other
+// properties, are not lost.
+func s3MetaMergeProperties(path string, meta map[string]string) map[string]interface{} {
+	var filemeta interface{}
+	if len(meta) > 0 {
+		m := map[string]interface{}{}
+		for k, v := range meta {
+			m[k] = v
+		}
+		filemeta = m
+	}
+	return map[string]interface{}{
+		s3MetaProperty: map[string]interface{}{path: filemeta},
+	}
+}
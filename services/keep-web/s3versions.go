@@ -0,0 +1,458 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepweb
+
+import (
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// Collection versions (see Collections.CollectionVersioning) are
+// exposed as S3 object versions. The version ID of an object is the
+// version number of the collection version it was read from.
+//
+// A file that exists in several consecutive collection versions
+// with the same content is listed as a single object version (the
+// oldest of them). A file that is absent from a collection version
+// but present in the previous one is listed as a delete marker.
+
+// Number of collection versions (including their manifest text)
+// to load at a time when listing object versions.
+const s3VersionsPageSize = 20
+
+var (
+	NoSuchVersion = "NoSuchVersion"
+
+	reManifestEscape = regexp.MustCompile(`\\[0-7]{3}`)
+)
+
+type listVersionsResp struct {
+	XMLName             string `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListVersionsResult"`
+	Name                string
+	Prefix              string
+	KeyMarker           string
+	VersionIdMarker     string
+	NextKeyMarker       string `xml:",omitempty"`
+	NextVersionIdMarker string `xml:",omitempty"`
+	MaxKeys             int
+	Delimiter           string `xml:",omitempty"`
+	IsTruncated         bool
+	// Version and DeleteMarker elements, interleaved in key
+	// order.
+	Entries        []s3VersionEntry
+	CommonPrefixes []commonPrefix
+}
+
+type s3VersionEntry struct {
+	XMLName      xml.Name
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	ETag         string `xml:",omitempty"`
+	Size         *int64 `xml:",omitempty"`
+	StorageClass string `xml:",omitempty"`
+}
+
+// versionedFile describes the content of a file in a collection
+// version.
+type versionedFile struct {
+	size int64
+	// MD5 digest of the file's list of block segments. If two
+	// versions of a file have the same fingerprint, they have
+	// the same content.
+	fingerprint string
+}
+
+// s3ListObjectVersions handles a ListObjectVersions request ("GET
+// /bucket?versions").
+//
+// Only one collection's versions can be listed: either the
+// collection indicated by the bucket name, or (in a project bucket)
+// the collection indicated by the prefix parameter.
+func (h *handler) s3ListObjectVersions(w http.ResponseWriter, r *http.Request, client *arvados.Client, fs arvados.CustomFileSystem, bucket string) {
+	resp := listVersionsResp{
+		Name:            bucket,
+		Prefix:          r.FormValue("prefix"),
+		KeyMarker:       r.FormValue("key-marker"),
+		VersionIdMarker: r.FormValue("version-id-marker"),
+		Delimiter:       r.FormValue("delimiter"),
+		MaxKeys:         s3MaxKeys,
+	}
+	if mk, _ := strconv.Atoi(r.FormValue("max-keys")); mk > 0 && mk < s3MaxKeys {
+		resp.MaxKeys = mk
+	}
+	coll, collpath := h.determineCollection(fs, "/by_id/"+bucket+"/"+resp.Prefix)
+	if coll == nil {
+		s3ErrorResponse(w, InvalidRequest, "object versions can only be listed in a collection: prefix must start with a collection name", r.URL.Path+"?"+r.URL.RawQuery, http.StatusBadRequest)
+		return
+	}
+	// keyBase is the part of each key that indicates the
+	// collection, e.g., "collection name/" in a project bucket.
+	keyBase := strings.TrimSuffix(resp.Prefix[:len(resp.Prefix)-len(collpath)], "/")
+	if keyBase != "" {
+		keyBase += "/"
+	}
+
+	vl := newS3VersionList(&resp, keyBase)
+	for offset := 0; ; {
+		var list arvados.CollectionList
+		err := client.RequestAndDecode(&list, "GET", "arvados/v1/collections", nil, map[string]interface{}{
+			"filters":              []arvados.Filter{{"current_version_uuid", "=", coll.UUID}},
+			"include_old_versions": true,
+			"select":               []string{"uuid", "version", "modified_at", "manifest_text"},
+			"order":                "version",
+			"offset":               offset,
+			"limit":                s3VersionsPageSize,
+			"count":                "none",
+		})
+		if err != nil {
+			s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, transactionErrorStatus(err))
+			return
+		}
+		if len(list.Items) == 0 {
+			break
+		}
+		offset += len(list.Items)
+		for _, version := range list.Items {
+			vl.add(version)
+		}
+		vl.prune()
+	}
+	vl.finish()
+	writeS3XML(w, r, resp)
+}
+
+// s3VersionList builds a ListObjectVersions response from a
+// collection's versions, which must be added in order, oldest first.
+//
+// To limit memory use, it only keeps the entries for keys that can
+// still appear in the response: once MaxKeys+1 entries/common
+// prefixes precede a key (in key order), later versions can only add
+// more entries before it, so prune discards it and the keys after
+// it.
+type s3VersionList struct {
+	resp    *listVersionsResp
+	keyBase string
+	// Object versions/delete markers for each key, oldest first.
+	entries map[string][]s3VersionEntry
+	// Files in the most recently added version.
+	prev map[string]versionedFile
+	// Keys >= cutoff have been discarded.
+	cutoff string
+}
+
+// newS3VersionList returns an s3VersionList that fills in the
+// Entries, CommonPrefixes, etc. of resp. The Prefix, KeyMarker,
+// VersionIdMarker, Delimiter and MaxKeys fields of resp must already
+// be set. keyBase is the part of each key that indicates the
+// collection, e.g., "collection name/" in a project bucket.
+func newS3VersionList(resp *listVersionsResp, keyBase string) *s3VersionList {
+	return &s3VersionList{
+		resp:    resp,
+		keyBase: keyBase,
+		entries: map[string][]s3VersionEntry{},
+		prev:    map[string]versionedFile{},
+	}
+}
+
+// itemPrefix returns the common prefix that represents the given key
+// in the response, or "" if the key is listed individually.
+func (vl *s3VersionList) itemPrefix(key string) string {
+	if vl.resp.Delimiter == "" {
+		return ""
+	}
+	cut := strings.Index(key[len(vl.resp.Prefix):], vl.resp.Delimiter)
+	if cut < 0 {
+		return ""
+	}
+	return key[:len(vl.resp.Prefix)+cut+len(vl.resp.Delimiter)]
+}
+
+// keep returns true if entries for the given key might appear in the
+// response.
+func (vl *s3VersionList) keep(key string) bool {
+	return strings.HasPrefix(key, vl.resp.Prefix) &&
+		key >= vl.resp.KeyMarker &&
+		(vl.cutoff == "" || key < vl.cutoff)
+}
+
+// add adds the object versions and delete markers for the given
+// collection version.
+func (vl *s3VersionList) add(version arvados.Collection) {
+	files := manifestFiles(version.ManifestText)
+	lastModified := version.ModifiedAt.UTC().Format("2006-01-02T15:04:05.999") + "Z"
+	versionID := strconv.Itoa(version.Version)
+	for path, file := range files {
+		key := vl.keyBase + path
+		if old, ok := vl.prev[path]; (ok && old == file) || !vl.keep(key) {
+			continue
+		}
+		size := file.size
+		vl.entries[key] = append(vl.entries[key], s3VersionEntry{
+			XMLName:      xml.Name{Local: "Version"},
+			Key:          key,
+			VersionId:    versionID,
+			LastModified: lastModified,
+			ETag:         `"` + file.fingerprint + `"`,
+			Size:         &size,
+			StorageClass: "STANDARD",
+		})
+	}
+	for path := range vl.prev {
+		key := vl.keyBase + path
+		if _, ok := files[path]; !ok && vl.keep(key) {
+			vl.entries[key] = append(vl.entries[key], s3VersionEntry{
+				XMLName:      xml.Name{Local: "DeleteMarker"},
+				Key:          key,
+				VersionId:    versionID,
+				LastModified: lastModified,
+			})
+		}
+	}
+	vl.prev = files
+}
+
+// prune discards entries for keys that cannot appear in the
+// response.
+func (vl *s3VersionList) prune() {
+	resp := vl.resp
+	var keys []string
+	for key := range vl.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	n := 0
+	seen := map[string]bool{}
+	for i, key := range keys {
+		if n > resp.MaxKeys {
+			for _, key := range keys[i:] {
+				delete(vl.entries, key)
+			}
+			vl.cutoff = key
+			return
+		}
+		if prefix := vl.itemPrefix(key); prefix != "" {
+			if !seen[prefix] && !(resp.KeyMarker != "" && strings.HasPrefix(resp.KeyMarker, prefix)) {
+				seen[prefix] = true
+				n++
+			}
+		} else if key != resp.KeyMarker {
+			n += len(vl.entries[key])
+		}
+	}
+}
+
+// finish fills in the response fields.
+func (vl *s3VersionList) finish() {
+	resp := vl.resp
+	var keys []string
+	for key := range vl.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	commonPrefixes := map[string]bool{}
+	markerVersion, _ := strconv.Atoi(resp.VersionIdMarker)
+	var nextKey, nextVersionID string
+	full := false
+	for _, key := range keys {
+		if key < resp.KeyMarker || (key == resp.KeyMarker && resp.VersionIdMarker == "") {
+			continue
+		}
+		if prefix := vl.itemPrefix(key); prefix != "" {
+			if commonPrefixes[prefix] || (resp.KeyMarker != "" && strings.HasPrefix(resp.KeyMarker, prefix)) {
+				continue
+			}
+			if full {
+				resp.IsTruncated = true
+				break
+			}
+			commonPrefixes[prefix] = true
+			resp.CommonPrefixes = append(resp.CommonPrefixes, commonPrefix{prefix})
+			nextKey, nextVersionID = prefix, ""
+			full = len(resp.Entries)+len(resp.CommonPrefixes) >= resp.MaxKeys
+			continue
+		}
+		ents := vl.entries[key]
+		// Newest version first
+		for i := len(ents) - 1; i >= 0; i-- {
+			ent := ents[i]
+			ent.IsLatest = i == len(ents)-1
+			if key == resp.KeyMarker {
+				if v, _ := strconv.Atoi(ent.VersionId); v >= markerVersion {
+					continue
+				}
+			}
+			if full {
+				resp.IsTruncated = true
+				break
+			}
+			resp.Entries = append(resp.Entries, ent)
+			nextKey, nextVersionID = key, ent.VersionId
+			full = len(resp.Entries)+len(resp.CommonPrefixes) >= resp.MaxKeys
+		}
+		if resp.IsTruncated {
+			break
+		}
+	}
+	if resp.IsTruncated {
+		resp.NextKeyMarker = nextKey
+		resp.NextVersionIdMarker = nextVersionID
+	}
+}
+
+// s3GetObjectVersion handles a GetObject or HeadObject request with
+// a versionId parameter.
+func (h *handler) s3GetObjectVersion(w http.ResponseWriter, r *http.Request, sess *cachedSession, fs arvados.CustomFileSystem, fspath string, user *arvados.User) {
+	versionID := r.URL.Query().Get("versionId")
+	version, err := strconv.Atoi(versionID)
+	if err != nil || version < 1 {
+		s3ErrorResponse(w, InvalidArgument, "Invalid version id specified", r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	coll, collpath := h.determineCollection(fs, fspath)
+	if coll == nil {
+		s3ErrorResponse(w, NoSuchKey, "The specified key does not exist.", r.URL.Path, http.StatusNotFound)
+		return
+	}
+	client := sess.client.WithRequestID(r.Header.Get("X-Request-Id"))
+	var list arvados.CollectionList
+	err = client.RequestAndDecode(&list, "GET", "arvados/v1/collections", nil, map[string]interface{}{
+		"filters": []arvados.Filter{
+			{"current_version_uuid", "=", coll.UUID},
+			{"version", "=", version},
+		},
+		"include_old_versions": true,
+		"select":               []string{"uuid", "version", "portable_data_hash", "manifest_text", "properties", "modified_at"},
+		"count":                "none",
+	})
+	if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, transactionErrorStatus(err))
+		return
+	} else if len(list.Items) == 0 {
+		s3ErrorResponse(w, NoSuchVersion, "The specified version does not exist.", r.URL.Path, http.StatusNotFound)
+		return
+	}
+	vcoll := list.Items[0]
+	vfs, err := vcoll.FileSystem(client, sess.keepclient)
+	if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusInternalServerError)
+		return
+	}
+	fi, err := vfs.Stat(collpath)
+	if os.IsNotExist(err) ||
+		(err != nil && err.Error() == "not a directory") ||
+		(fi != nil && fi.IsDir()) {
+		s3ErrorResponse(w, NoSuchKey, "The specified key does not exist.", r.URL.Path, http.StatusNotFound)
+		return
+	} else if err != nil {
+		s3ErrorResponse(w, InternalError, err.Error(), r.URL.Path, http.StatusInternalServerError)
+		return
+	}
+
+	if !h.userPermittedToUploadOrDownload(r.Method, user) {
+		http.Error(w, "Not permitted", http.StatusForbidden)
+		return
+	}
+	h.logUploadOrDownload(r, sess.arvadosclient, nil, collpath, 1, &vcoll, user)
+
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, vcoll.PortableDataHash))
+	w.Header().Set("X-Amz-Version-Id", versionID)
+	setPropertyHeaders(w.Header(), vcoll.Properties, getS3Meta(vcoll.Properties, collpath))
+	// shallow copy r, and change URL path
+	r2 := *r
+	r2.URL.Path = "/" + collpath
+	http.FileServer(vfs).ServeHTTP(w, &r2)
+}
+
+// manifestFiles returns the size and fingerprint of each file in
+// the given manifest, keyed by path (without leading "./").
+func manifestFiles(manifest string) map[string]versionedFile {
+	hashes := map[string]hash.Hash{}
+	sizes := map[string]int64{}
+	for _, line := range strings.Split(manifest, "\n") {
+		toks := strings.Split(line, " ")
+		if len(toks) < 3 {
+			continue
+		}
+		stream := unescapeManifestName(toks[0])
+		var blocks []string
+		var blockOffsets []int64
+		var streamSize int64
+		var sawFile bool
+		for _, tok := range toks[1:] {
+			m := reFileSegToken.FindStringSubmatch(tok)
+			if m == nil {
+				hints := strings.Split(tok, "+")
+				if sawFile || len(hints) < 2 {
+					// invalid manifest
+					break
+				}
+				size, _ := strconv.ParseInt(hints[1], 10, 64)
+				blocks = append(blocks, hints[0]+"+"+hints[1])
+				blockOffsets = append(blockOffsets, streamSize)
+				streamSize += size
+				continue
+			}
+			sawFile = true
+			name := unescapeManifestName(m[3])
+			if name == "." {
+				// directory marker
+				continue
+			}
+			path := strings.TrimPrefix(stream+"/"+name, "./")
+			pos, _ := strconv.ParseInt(m[1], 10, 64)
+			size, _ := strconv.ParseInt(m[2], 10, 64)
+			h := hashes[path]
+			if h == nil {
+				h = md5.New()
+				hashes[path] = h
+			}
+			sizes[path] += size
+			// Find the block segments that make up
+			// this file segment.
+			for i := sort.Search(len(blocks), func(i int) bool {
+				return i+1 == len(blocks) || blockOffsets[i+1] > pos
+			}); i < len(blocks) && size > 0; i++ {
+				blockEnd := streamSize
+				if i+1 < len(blocks) {
+					blockEnd = blockOffsets[i+1]
+				}
+				n := blockEnd - pos
+				if n > size {
+					n = size
+				}
+				fmt.Fprintf(h, "%s %d %d\n", blocks[i], pos-blockOffsets[i], n)
+				pos += n
+				size -= n
+			}
+		}
+	}
+	files := make(map[string]versionedFile, len(hashes))
+	for path, h := range hashes {
+		files[path] = versionedFile{
+			size:        sizes[path],
+			fingerprint: fmt.Sprintf("%x", h.Sum(nil)),
+		}
+	}
+	return files
+}
+
+func unescapeManifestName(s string) string {
+	return reManifestEscape.ReplaceAllStringFunc(s, func(esc string) string {
+		c, _ := strconv.ParseUint(esc[1:], 8, 8)
+		return string([]byte{byte(c)})
+	})
+}
@@ -0,0 +1,117 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepweb
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+)
+
+// writeTar writes a tar archive of the given files to w.
+//
+// Each file is preceded by entries for any of its parent directories
+// that have not already been written, so the archive preserves the
+// directory structure of the collection. Files and directories have
+// the modification times reported by collfs.
+//
+// The archive uses the PAX format, which supports long and non-ASCII
+// file names. The "Downloaded from" comment is stored in a PAX global
+// header, like "git archive" does with commit IDs.
+func (h *handler) writeTar(w io.Writer, coll *arvados.Collection, collfs fs.FS, filepaths []string, params zipParams, user arvados.User) error {
+	tw := tar.NewWriter(w)
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "pax_global_header",
+		PAXRecords: map[string]string{"comment": h.archiveComment(coll)},
+		Format:     tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	if params.IncludeCollectionMetadata {
+		buf, err := json.Marshal(collectionMetadata(coll, user))
+		if err != nil {
+			return err
+		}
+		buf = append(buf, '\n')
+		mtime := coll.ModifiedAt
+		if mtime.IsZero() {
+			mtime = time.Now()
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     "collection.json",
+			Size:     int64(len(buf)),
+			Mode:     0644,
+			ModTime:  mtime,
+			Format:   tar.FormatPAX,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(buf)
+		if err != nil {
+			return err
+		}
+	}
+	dirsWritten := map[string]bool{}
+	for _, path := range filepaths {
+		for i := range path {
+			if path[i] != '/' || dirsWritten[path[:i]] {
+				continue
+			}
+			fi, err := fs.Stat(collfs, path[:i])
+			if err != nil {
+				return err
+			}
+			err = tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     path[:i+1],
+				Mode:     0755,
+				ModTime:  fi.ModTime(),
+				Format:   tar.FormatPAX,
+			})
+			if err != nil {
+				return err
+			}
+			dirsWritten[path[:i]] = true
+		}
+		err := writeTarFile(tw, collfs, path)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, collfs fs.FS, path string) error {
+	f, err := collfs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path,
+		Size:     fi.Size(),
+		Mode:     0644,
+		ModTime:  fi.ModTime(),
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -6,6 +6,7 @@ package keepweb
 
 import (
 	"archive/zip"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,6 +20,7 @@ import (
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/klauspost/compress/zstd"
 )
 
 const rfc3339NanoFixed = "2006-01-02T15:04:05.000000000Z07:00"
@@ -29,13 +31,57 @@ type zipParams struct {
 	IncludeCollectionMetadata bool `json:"include_collection_metadata"`
 }
 
-// serveZip handles a request for a zip archive.
-func (h *handler) serveZip(w http.ResponseWriter, r *http.Request, session *cachedSession, sitefs arvados.CustomFileSystem, ziproot string, tokenUser *arvados.User) {
+// archiveFormat is a type of archive that can be served by
+// serveArchive.
+type archiveFormat struct {
+	name      string // "zip", "tar", etc., for error messages
+	mediaType string
+	ext       string // filename extension, e.g., ".zip"
+	// compress, if non-nil, returns a WriteCloser that writes
+	// the compressed form of the archive to w.
+	compress func(w io.Writer) (io.WriteCloser, error)
+	write    func(h *handler, w io.Writer, coll *arvados.Collection, collfs fs.FS, filepaths []string, params zipParams, user arvados.User) error
+}
+
+// archiveFormats maps the media types accepted in a request's Accept
+// header to archive formats.
+var archiveFormats = map[string]*archiveFormat{
+	"application/zip": {
+		name:      "zip",
+		mediaType: "application/zip",
+		ext:       ".zip",
+		write:     (*handler).writeZip,
+	},
+	"application/x-tar": {
+		name:      "tar",
+		mediaType: "application/x-tar",
+		ext:       ".tar",
+		write:     (*handler).writeTar,
+	},
+	"application/gzip": {
+		name:      "tar.gz",
+		mediaType: "application/gzip",
+		ext:       ".tar.gz",
+		compress:  func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		write:     (*handler).writeTar,
+	},
+	"application/zstd": {
+		name:      "tar.zst",
+		mediaType: "application/zstd",
+		ext:       ".tar.zst",
+		compress:  func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+		write:     (*handler).writeTar,
+	},
+}
+
+// serveArchive handles a request for a zip or tar archive.
+func (h *handler) serveArchive(w http.ResponseWriter, r *http.Request, session *cachedSession, sitefs arvados.CustomFileSystem, ziproot string, tokenUser *arvados.User, format *archiveFormat) {
 	if r.Method != "GET" && r.Method != "HEAD" && r.Method != "POST" {
 		// This is a generic 400, not 405 (method not allowed)
 		// because this method/URL combination is allowed,
-		// just not with the Accept: application/zip header.
-		http.Error(w, "zip archive can only be served via GET, HEAD, or POST", http.StatusBadRequest)
+		// just not with an Accept header that requests an
+		// archive.
+		http.Error(w, format.name+" archive can only be served via GET, HEAD, or POST", http.StatusBadRequest)
 		return
 	}
 	// Check "GET" permission regardless of r.Method, because all
@@ -46,7 +92,7 @@ func (h *handler) serveZip(w http.ResponseWriter, r *http.Request, session *cach
 	}
 	coll, subdir := h.determineCollection(sitefs, ziproot)
 	if coll == nil || subdir != "" {
-		http.Error(w, "zip archive can only be served from the root directory of a collection", http.StatusBadRequest)
+		http.Error(w, format.name+" archive can only be served from the root directory of a collection", http.StatusBadRequest)
 		return
 	}
 
@@ -125,9 +171,10 @@ func (h *handler) serveZip(w http.ResponseWriter, r *http.Request, session *cach
 	}
 
 	if params.DownloadFilename != "" {
-		// Add .zip extension if the user forgot to do that
-		if !strings.HasSuffix(strings.ToLower(params.DownloadFilename), ".zip") {
-			params.DownloadFilename += ".zip"
+		// Add .zip (etc.) extension if the user forgot to do
+		// that
+		if !strings.HasSuffix(strings.ToLower(params.DownloadFilename), format.ext) {
+			params.DownloadFilename += format.ext
 		}
 	} else {
 		// No download_filename provided. Make up a reasonable
@@ -140,7 +187,7 @@ func (h *handler) serveZip(w http.ResponseWriter, r *http.Request, session *cach
 		if len(filepaths) == 1 && len(params.Files) == 1 && filepaths[0] == params.Files[0] {
 			// If the request specified a single
 			// (non-directory) file, include the name of
-			// the file in the zip archive name.
+			// the file in the archive name.
 			_, basename := filepath.Split(filepaths[0])
 			params.DownloadFilename += " - " + basename
 		} else if len(matcher) > 0 && !matcher["/"] {
@@ -151,12 +198,12 @@ func (h *handler) serveZip(w http.ResponseWriter, r *http.Request, session *cach
 			// the entire collection.
 			params.DownloadFilename += fmt.Sprintf(" - %d files", len(filepaths))
 		}
-		params.DownloadFilename += ".zip"
+		params.DownloadFilename += format.ext
 	}
 
 	logpath := ""
 	if len(filepaths) == 1 {
-		// If downloading a zip file with exactly one file,
+		// If downloading an archive with exactly one file,
 		// log that file as collection_file_path in the audit
 		// logs.  (Otherwise, leave collection_file_path
 		// empty.)
@@ -196,51 +243,80 @@ func (h *handler) serveZip(w http.ResponseWriter, r *http.Request, session *cach
 		}
 	}
 
-	err = h.writeZip(w, coll, collfs, filepaths, params, user)
-	if err != nil {
-		ctxlog.FromContext(r.Context()).Errorf("error writing zip archive after sending response header: %s", err)
-	}
-}
-
-func (h *handler) writeZip(w http.ResponseWriter, coll *arvados.Collection, collfs fs.FS, filepaths []string, params zipParams, user arvados.User) error {
 	// Note mime.FormatMediaType() also sets the "filename*" param
 	// if params.DownloadFilename contains non-ASCII chars, as
 	// recommended by RFC 6266.
 	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": params.DownloadFilename}))
-	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Type", format.mediaType)
 	w.WriteHeader(http.StatusOK)
-	zipw := zip.NewWriter(w)
+	err = h.writeArchive(w, format, coll, collfs, filepaths, params, user)
+	if err != nil {
+		ctxlog.FromContext(r.Context()).Errorf("error writing %s archive after sending response header: %s", format.name, err)
+	}
+}
 
+// writeArchive writes an archive in the given format to w,
+// compressing it if the format calls for that.
+func (h *handler) writeArchive(w io.Writer, format *archiveFormat, coll *arvados.Collection, collfs fs.FS, filepaths []string, params zipParams, user arvados.User) error {
+	if format.compress == nil {
+		return format.write(h, w, coll, collfs, filepaths, params, user)
+	}
+	cw, err := format.compress(w)
+	if err != nil {
+		return err
+	}
+	err = format.write(h, cw, coll, collfs, filepaths, params, user)
+	if err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// archiveComment returns a comment to include in an archive of the
+// given collection, indicating where it was downloaded from.
+func (h *handler) archiveComment(coll *arvados.Collection) string {
 	u := url.URL(h.Cluster.Services.WebDAVDownload.ExternalURL)
 	if coll.UUID != "" {
 		u.Path = "/by_id/" + coll.UUID + "/"
 	} else {
 		u.Path = "/by_id/" + coll.PortableDataHash + "/"
 	}
-	err := zipw.SetComment(fmt.Sprintf("Downloaded from %s", u.String()))
+	return fmt.Sprintf("Downloaded from %s", u.String())
+}
+
+// collectionMetadata returns the content of the collection.json file
+// included in an archive when include_collection_metadata is given.
+func collectionMetadata(coll *arvados.Collection, user arvados.User) map[string]interface{} {
+	m := map[string]interface{}{
+		"portable_data_hash": coll.PortableDataHash,
+	}
+	if coll.UUID != "" {
+		m["uuid"] = coll.UUID
+		m["name"] = coll.Name
+		m["properties"] = coll.Properties
+		m["created_at"] = coll.CreatedAt.Format(rfc3339NanoFixed)
+		m["modified_at"] = coll.ModifiedAt.Format(rfc3339NanoFixed)
+		m["description"] = coll.Description
+	}
+	if user.UUID != "" {
+		m["modified_by_user"] = map[string]interface{}{
+			"email":     user.Email,
+			"full_name": user.FullName,
+			"username":  user.Username,
+			"uuid":      user.UUID,
+		}
+	}
+	return m
+}
+
+func (h *handler) writeZip(w io.Writer, coll *arvados.Collection, collfs fs.FS, filepaths []string, params zipParams, user arvados.User) error {
+	zipw := zip.NewWriter(w)
+	err := zipw.SetComment(h.archiveComment(coll))
 	if err != nil {
 		return err
 	}
 	if params.IncludeCollectionMetadata {
-		m := map[string]interface{}{
-			"portable_data_hash": coll.PortableDataHash,
-		}
-		if coll.UUID != "" {
-			m["uuid"] = coll.UUID
-			m["name"] = coll.Name
-			m["properties"] = coll.Properties
-			m["created_at"] = coll.CreatedAt.Format(rfc3339NanoFixed)
-			m["modified_at"] = coll.ModifiedAt.Format(rfc3339NanoFixed)
-			m["description"] = coll.Description
-		}
-		if user.UUID != "" {
-			m["modified_by_user"] = map[string]interface{}{
-				"email":     user.Email,
-				"full_name": user.FullName,
-				"username":  user.Username,
-				"uuid":      user.UUID,
-			}
-		}
 		zipf, err := zipw.CreateHeader(&zip.FileHeader{
 			Name:   "collection.json",
 			Method: zip.Store,
@@ -248,7 +324,7 @@ func (h *handler) writeZip(w http.ResponseWriter, coll *arvados.Collection, coll
 		if err != nil {
 			return err
 		}
-		err = json.NewEncoder(zipf).Encode(m)
+		err = json.NewEncoder(zipf).Encode(collectionMetadata(coll, user))
 		if err != nil {
 			return err
 		}
@@ -5,21 +5,26 @@
 package keepweb
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"git.arvados.org/arvados.git/sdk/go/arvadosclient"
 	"git.arvados.org/arvados.git/sdk/go/arvadostest"
 	"git.arvados.org/arvados.git/sdk/go/ctxlog"
 	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	"github.com/klauspost/compress/zstd"
 	"github.com/sirupsen/logrus"
 	. "gopkg.in/check.v1"
 )
@@ -452,6 +457,94 @@ func (s *IntegrationSuite) TestZip_WebDAVPermission_Forbidden(c *C) {
 	})
 }
 
+func (s *IntegrationSuite) TestTar_EntireCollection(c *C) {
+	s.testZip(c, testZipOptions{
+		reqMethod:         "GET",
+		reqAccept:         "application/x-tar",
+		reqToken:          arvadostest.ActiveTokenV2,
+		expectStatus:      200,
+		expectFiles:       []string{"dir1/", "dir1/dir/", "dir1/dir/file1.txt", "dir1/file1.txt", "dir2/", "dir2/file2.txt", "file0.txt"},
+		expectDisposition: `attachment; filename="keep-web zip test collection.tar"`,
+		expectZipComment:  `Downloaded from https://collections.example.com/by_id/{{stage.coll.UUID}}/`,
+	})
+}
+
+func (s *IntegrationSuite) TestTar_Metadata(c *C) {
+	s.testZip(c, testZipOptions{
+		reqMethod:    "GET",
+		reqQuery:     "?include_collection_metadata=1",
+		reqAccept:    "application/x-tar",
+		reqToken:     arvadostest.ActiveTokenV2,
+		expectStatus: 200,
+		expectFiles:  []string{"collection.json", "dir1/", "dir1/dir/", "dir1/dir/file1.txt", "dir1/file1.txt", "dir2/", "dir2/file2.txt", "file0.txt"},
+		expectMetadata: map[string]interface{}{
+			"name":               "keep-web zip test collection",
+			"portable_data_hash": "6acf043b102afcf04e3be2443e7ea2ba+223",
+			"properties": map[string]interface{}{
+				"sailboat": "⛵",
+			},
+			"uuid":        "{{stage.coll.UUID}}",
+			"description": "Description of test collection\n",
+			"created_at":  "{{stage.coll.CreatedAt}}",
+			"modified_at": "{{stage.coll.ModifiedAt}}",
+			"modified_by_user": map[string]interface{}{
+				"email":     "active-user@arvados.local",
+				"full_name": "Active User",
+				"username":  "active",
+				"uuid":      arvadostest.ActiveUserUUID,
+			},
+		},
+	})
+}
+
+func (s *IntegrationSuite) TestTarGzip_SelectFiles(c *C) {
+	s.testZip(c, testZipOptions{
+		reqMethod:         "POST",
+		reqContentType:    "application/json",
+		reqAccept:         "application/gzip",
+		reqToken:          arvadostest.ActiveTokenV2,
+		reqBody:           `{"files":["dir1/dir/file1.txt","file0.txt"]}`,
+		expectStatus:      200,
+		expectFiles:       []string{"dir1/", "dir1/dir/", "dir1/dir/file1.txt", "file0.txt"},
+		expectDisposition: `attachment; filename="keep-web zip test collection - 2 files.tar.gz"`,
+	})
+}
+
+func (s *IntegrationSuite) TestTarGzip_SpecifyDownloadFilename(c *C) {
+	s.testZip(c, testZipOptions{
+		reqMethod:         "POST",
+		reqContentType:    "application/json",
+		reqAccept:         "application/gzip",
+		reqToken:          arvadostest.ActiveTokenV2,
+		reqBody:           `{"files":["dir2"],"download_filename":"Sue"}`,
+		expectStatus:      200,
+		expectFiles:       []string{"dir2/", "dir2/file2.txt"},
+		expectDisposition: `attachment; filename=Sue.tar.gz`,
+	})
+}
+
+func (s *IntegrationSuite) TestTarZstd_AcceptMediaTypeInQuery(c *C) {
+	s.testZip(c, testZipOptions{
+		reqMethod:         "GET",
+		reqQuery:          `?accept=application/zstd&disposition=attachment`,
+		reqAccept:         `text/html`,
+		reqToken:          arvadostest.ActiveTokenV2,
+		expectStatus:      200,
+		expectFiles:       []string{"dir1/", "dir1/dir/", "dir1/dir/file1.txt", "dir1/file1.txt", "dir2/", "dir2/file2.txt", "file0.txt"},
+		expectDisposition: `attachment; filename="keep-web zip test collection.tar.zst"`,
+	})
+}
+
+func (s *IntegrationSuite) TestTar_WrongMethod(c *C) {
+	s.testZip(c, testZipOptions{
+		reqMethod:       "PUT",
+		reqAccept:       "application/x-tar",
+		reqToken:        arvadostest.ActiveTokenV2,
+		expectStatus:    http.StatusBadRequest,
+		expectBodyMatch: `tar archive can only be served via GET, HEAD, or POST\n`,
+	})
+}
+
 type testZipOptions struct {
 	filedata          map[string]string // if nil, use default set (see testZip)
 	usePDH            bool
@@ -523,21 +616,36 @@ func (s *IntegrationSuite) testZip(c *C, opts testZipOptions) {
 		}
 		return
 	}
-	zipdata, _ := io.ReadAll(resp.Body)
-	zipr, err := zip.NewReader(bytes.NewReader(zipdata), int64(len(zipdata)))
-	c.Assert(err, IsNil)
-	c.Check(zipFileNames(zipr), DeepEquals, opts.expectFiles)
+	mediatype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var names []string
+	var comment string
+	var metadata []byte
+	if mediatype == "application/zip" {
+		zipdata, _ := io.ReadAll(resp.Body)
+		zipr, err := zip.NewReader(bytes.NewReader(zipdata), int64(len(zipdata)))
+		c.Assert(err, IsNil)
+		names = zipFileNames(zipr)
+		comment = zipr.Comment
+		if f, err := zipr.Open("collection.json"); err == nil {
+			metadata, err = io.ReadAll(f)
+			c.Check(err, IsNil)
+			f.Close()
+		}
+	} else {
+		var files map[string][]byte
+		names, files, comment = readTar(c, mediatype, resp.Body)
+		metadata = files["collection.json"]
+	}
+	c.Check(names, DeepEquals, opts.expectFiles)
 	if opts.expectDisposition != "" {
 		c.Check(resp.Header.Get("Content-Disposition"), Equals, opts.expectDisposition)
 	}
 	if opts.expectZipComment != "" {
-		c.Check(zipr.Comment, Equals, strings.Replace(opts.expectZipComment, "{{stage.coll.UUID}}", stage.coll.UUID, -1))
+		c.Check(comment, Equals, strings.Replace(opts.expectZipComment, "{{stage.coll.UUID}}", stage.coll.UUID, -1))
 	}
-	f, err := zipr.Open("collection.json")
-	c.Check(err == nil, Equals, opts.expectMetadata != nil,
-		Commentf("collection.json file existence (%v) did not match expectation (%v)", err == nil, opts.expectMetadata != nil))
-	if err == nil {
-		defer f.Close()
+	c.Check(metadata != nil, Equals, opts.expectMetadata != nil,
+		Commentf("collection.json file existence (%v) did not match expectation (%v)", metadata != nil, opts.expectMetadata != nil))
+	if metadata != nil {
 		if opts.expectMetadata["uuid"] == "{{stage.coll.UUID}}" {
 			opts.expectMetadata["uuid"] = stage.coll.UUID
 		}
@@ -548,7 +656,7 @@ func (s *IntegrationSuite) testZip(c *C, opts testZipOptions) {
 			opts.expectMetadata["modified_at"] = stage.coll.ModifiedAt.Format(rfc3339NanoFixed)
 		}
 		var gotMetadata map[string]interface{}
-		json.NewDecoder(f).Decode(&gotMetadata)
+		json.Unmarshal(metadata, &gotMetadata)
 		c.Check(gotMetadata, DeepEquals, opts.expectMetadata)
 	}
 	for _, re := range opts.expectLogsMatch {
@@ -563,3 +671,129 @@ func zipFileNames(zipr *zip.Reader) []string {
 	}
 	return names
 }
+
+// readTar decompresses (according to mediatype) and reads a tar
+// archive, and returns the names of its entries (in order), the
+// content of its regular files, and the comment from its PAX global
+// header.
+func readTar(c *C, mediatype string, r io.Reader) (names []string, files map[string][]byte, comment string) {
+	switch mediatype {
+	case "application/gzip":
+		gzr, err := gzip.NewReader(r)
+		c.Assert(err, IsNil)
+		defer gzr.Close()
+		r = gzr
+	case "application/zstd":
+		zr, err := zstd.NewReader(r)
+		c.Assert(err, IsNil)
+		defer zr.Close()
+		r = zr
+	}
+	files = map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader:
+			comment = hdr.PAXRecords["comment"]
+		case tar.TypeReg:
+			files[hdr.Name], err = io.ReadAll(tr)
+			c.Assert(err, IsNil)
+			names = append(names, hdr.Name)
+		default:
+			names = append(names, hdr.Name)
+		}
+	}
+	return
+}
+
+type ArchiveSuite struct{}
+
+var _ = Suite(&ArchiveSuite{})
+
+func (s *ArchiveSuite) TestTarFormats(c *C) {
+	coll := &arvados.Collection{
+		UUID:             "zzzzz-4zz18-aaaaaaaaaaaaaaa",
+		Name:             "test collection",
+		PortableDataHash: "d41d8cd98f00b204e9800998ecf8427e+0",
+		ModifiedAt:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	cfs, err := coll.FileSystem(nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(cfs.Mkdir("dir1", 0755), IsNil)
+	c.Assert(cfs.Mkdir("dir1/dir", 0755), IsNil)
+	filedata := map[string]string{
+		"dir1/dir/file1.txt": "file1 in dir",
+		"dir1/file1.txt":     "file1",
+		"file0.txt":          "",
+	}
+	for name, data := range filedata {
+		f, err := cfs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+		c.Assert(err, IsNil)
+		_, err = f.Write([]byte(data))
+		c.Assert(err, IsNil)
+		c.Assert(f.Close(), IsNil)
+	}
+	h := &handler{Cluster: &arvados.Cluster{}}
+	h.Cluster.Services.WebDAVDownload.ExternalURL = arvados.URL{Scheme: "https", Host: "collections.example.com", Path: "/"}
+	filepaths := []string{"dir1/dir/file1.txt", "dir1/file1.txt", "file0.txt"}
+
+	for _, mediatype := range []string{"application/x-tar", "application/gzip", "application/zstd"} {
+		c.Logf("=== %s", mediatype)
+		var buf bytes.Buffer
+		err = h.writeArchive(&buf, archiveFormats[mediatype], coll, arvados.FS(cfs), filepaths, zipParams{IncludeCollectionMetadata: true}, arvados.User{})
+		c.Assert(err, IsNil)
+
+		names, files, comment := readTar(c, mediatype, &buf)
+		c.Check(names, DeepEquals, []string{"collection.json", "dir1/", "dir1/dir/", "dir1/dir/file1.txt", "dir1/file1.txt", "file0.txt"})
+		c.Check(comment, Equals, "Downloaded from https://collections.example.com/by_id/"+coll.UUID+"/")
+		for name, data := range filedata {
+			c.Check(string(files[name]), Equals, data, Commentf("%s", name))
+		}
+		var metadata map[string]interface{}
+		c.Check(json.Unmarshal(files["collection.json"], &metadata), IsNil)
+		c.Check(metadata["uuid"], Equals, coll.UUID)
+		c.Check(metadata["name"], Equals, coll.Name)
+	}
+}
+
+func (s *ArchiveSuite) TestTarModTimes(c *C) {
+	coll := &arvados.Collection{PortableDataHash: "d41d8cd98f00b204e9800998ecf8427e+0"}
+	cfs, err := coll.FileSystem(nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(cfs.Mkdir("dir1", 0755), IsNil)
+	f, err := cfs.OpenFile("dir1/file1.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	expect := map[string]time.Time{}
+	for _, name := range []string{"dir1", "dir1/file1.txt"} {
+		fi, err := cfs.Stat(name)
+		c.Assert(err, IsNil)
+		expect[name] = fi.ModTime()
+	}
+
+	h := &handler{Cluster: &arvados.Cluster{}}
+	var buf bytes.Buffer
+	err = h.writeArchive(&buf, archiveFormats["application/x-tar"], coll, arvados.FS(cfs), []string{"dir1/file1.txt"}, zipParams{}, arvados.User{})
+	c.Assert(err, IsNil)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		switch hdr.Name {
+		case "dir1/":
+			c.Check(hdr.Typeflag, Equals, byte(tar.TypeDir))
+			c.Check(hdr.ModTime.Equal(expect["dir1"]), Equals, true, Commentf("%s != %s", hdr.ModTime, expect["dir1"]))
+		case "dir1/file1.txt":
+			c.Check(hdr.Typeflag, Equals, byte(tar.TypeReg))
+			c.Check(hdr.ModTime.Equal(expect["dir1/file1.txt"]), Equals, true, Commentf("%s != %s", hdr.ModTime, expect["dir1/file1.txt"]))
+		}
+	}
+}
@@ -198,15 +198,15 @@ func (v *azureBlobVolume) get(ctx context.Context, hash string, dst io.WriterAt)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	pieceSize := BlockSize
-	if v.MaxGetBytes > 0 && v.MaxGetBytes < BlockSize {
+	pieceSize := maxStoredBlockSize
+	if v.MaxGetBytes > 0 && v.MaxGetBytes < maxStoredBlockSize {
 		pieceSize = v.MaxGetBytes
 	}
 
 	pieces := 1
-	expectSize := BlockSize
+	expectSize := maxStoredBlockSize
 	sizeKnown := false
-	if pieceSize < BlockSize {
+	if pieceSize < maxStoredBlockSize {
 		// Unfortunately the handler doesn't tell us how long
 		// the blob is expected to be, so we have to ask
 		// Azure.
@@ -214,8 +214,8 @@ func (v *azureBlobVolume) get(ctx context.Context, hash string, dst io.WriterAt)
 		if err != nil {
 			return 0, v.translateError(err)
 		}
-		if props.ContentLength > int64(BlockSize) || props.ContentLength < 0 {
-			return 0, fmt.Errorf("block %s invalid size %d (max %d)", hash, props.ContentLength, BlockSize)
+		if props.ContentLength > int64(maxStoredBlockSize) || props.ContentLength < 0 {
+			return 0, fmt.Errorf("block %s invalid size %d (max %d)", hash, props.ContentLength, maxStoredBlockSize)
 		}
 		expectSize = int(props.ContentLength)
 		pieces = (expectSize + pieceSize - 1) / pieceSize
@@ -306,6 +306,16 @@ func (v *azureBlobVolume) get(ctx context.Context, hash string, dst io.WriterAt)
 // BlockWrite stores a block on the volume. If it already exists, its
 // timestamp is updated.
 func (v *azureBlobVolume) BlockWrite(ctx context.Context, hash string, data []byte) error {
+	return v.write(ctx, hash, data, nil)
+}
+
+// BlockWriteSizeHint is like BlockWrite, but also stores the given
+// size hint in the blob metadata.
+func (v *azureBlobVolume) BlockWriteSizeHint(ctx context.Context, hash string, data []byte, sizeHint int) error {
+	return v.write(ctx, hash, data, storage.BlobMetadata{"size_hint": strconv.Itoa(sizeHint)})
+}
+
+func (v *azureBlobVolume) write(ctx context.Context, hash string, data []byte, metadata storage.BlobMetadata) error {
 	// Send the block data through a pipe, so that (if we need to)
 	// we can close the pipe early and abandon our
 	// CreateBlockBlobFromReader() goroutine, without worrying
@@ -328,7 +338,7 @@ func (v *azureBlobVolume) BlockWrite(ctx context.Context, hash string, data []by
 			body = http.NoBody
 			bufr.Close()
 		}
-		errChan <- v.container.CreateBlockBlobFromReader(hash, len(data), body, nil)
+		errChan <- v.container.CreateBlockBlobFromReader(hash, len(data), body, metadata, nil)
 	}()
 	select {
 	case <-ctx.Done():
@@ -379,6 +389,19 @@ func (v *azureBlobVolume) Mtime(hash string) (time.Time, error) {
 // Index writes a list of Keep blocks that are stored in the
 // container.
 func (v *azureBlobVolume) Index(ctx context.Context, prefix string, writer io.Writer) error {
+	return v.index(ctx, prefix, writer, false)
+}
+
+// IndexSizeHints is like Index, but also reports each block's size
+// hint. Read times are not supported.
+func (v *azureBlobVolume) IndexSizeHints(ctx context.Context, prefix string, readTimes bool, writer io.Writer) error {
+	if readTimes {
+		return errNoReadTimes
+	}
+	return v.index(ctx, prefix, writer, true)
+}
+
+func (v *azureBlobVolume) index(ctx context.Context, prefix string, writer io.Writer, sizeHints bool) error {
 	params := storage.ListBlobsParameters{
 		Prefix:  prefix,
 		Include: &storage.IncludeBlobDataset{Metadata: true},
@@ -409,7 +432,15 @@ func (v *azureBlobVolume) Index(ctx context.Context, prefix string, writer io.Wr
 				// Trashed blob; exclude it from response
 				continue
 			}
-			fmt.Fprintf(writer, "%s+%d %d\n", b.Name, b.Properties.ContentLength, modtime.UnixNano())
+			if !sizeHints {
+				fmt.Fprintf(writer, "%s+%d %d\n", b.Name, b.Properties.ContentLength, modtime.UnixNano())
+				continue
+			}
+			sizeHint, err := strconv.Atoi(b.Metadata["size_hint"])
+			if err != nil || sizeHint < 0 {
+				sizeHint = -1
+			}
+			fmt.Fprintf(writer, "%s+%d %d %d\n", b.Name, b.Properties.ContentLength, modtime.UnixNano(), sizeHint)
 		}
 		if resp.NextMarker == "" {
 			return nil
@@ -458,10 +489,17 @@ func (v *azureBlobVolume) BlockTrash(loc string) error {
 		})
 	}
 
-	// Otherwise, mark as trash
-	return v.container.SetBlobMetadata(loc, storage.BlobMetadata{
+	// Otherwise, mark as trash, keeping the size hint (if any)
+	// in case the block is untrashed.
+	metadata := storage.BlobMetadata{
 		"expires_at": fmt.Sprintf("%d", time.Now().Add(v.cluster.Collections.BlobTrashLifetime.Duration()).Unix()),
-	}, &storage.SetBlobMetadataOptions{
+	}
+	if old, err := v.container.GetBlobMetadata(loc); err != nil {
+		return v.translateError(err)
+	} else if old["size_hint"] != "" {
+		metadata["size_hint"] = old["size_hint"]
+	}
+	return v.container.SetBlobMetadata(loc, metadata, &storage.SetBlobMetadataOptions{
 		IfMatch: props.Etag,
 	})
 }
@@ -678,7 +716,7 @@ func (r *readerWithAzureLen) Len() int {
 	return r.len
 }
 
-func (c *azureContainer) CreateBlockBlobFromReader(bname string, size int, rdr io.Reader, opts *storage.PutBlobOptions) error {
+func (c *azureContainer) CreateBlockBlobFromReader(bname string, size int, rdr io.Reader, metadata storage.BlobMetadata, opts *storage.PutBlobOptions) error {
 	c.stats.TickOps("create")
 	c.stats.Tick(&c.stats.Ops, &c.stats.CreateOps)
 	if size != 0 {
@@ -688,6 +726,7 @@ func (c *azureContainer) CreateBlockBlobFromReader(bname string, size int, rdr i
 		}
 	}
 	b := c.ctr.GetBlobReference(bname)
+	b.Metadata = metadata
 	err := b.CreateBlockBlobFromReader(rdr, opts)
 	c.stats.TickErr(err)
 	return err
@@ -642,6 +642,35 @@ func (s *stubbedAzureBlobSuite) testAzureBlobVolumeContextCancel(c *check.C, tes
 	}()
 }
 
+func (s *stubbedAzureBlobSuite) TestSizeHints(c *check.C) {
+	cluster := testCluster(c)
+	cluster.Collections.BlobTrashLifetime = arvados.Duration(time.Hour)
+	v := s.newTestableAzureBlobVolume(c, newVolumeParams{
+		Cluster:      cluster,
+		ConfigVolume: arvados.Volume{Replication: 3},
+		MetricsVecs:  newVolumeMetricsVecs(prometheus.NewRegistry()),
+		BufferPool:   newBufferPool(ctxlog.TestLogger(c), 8, prometheus.NewRegistry()),
+	})
+	defer v.Teardown()
+	c.Check(supportsSizeHints(v.azureBlobVolume), check.Equals, true)
+	c.Assert(v.BlockWriteSizeHint(context.Background(), fooHash, []byte("foo"), 1234), check.IsNil)
+	c.Assert(v.BlockWrite(context.Background(), barHash, []byte("bar")), check.IsNil)
+
+	buf := new(bytes.Buffer)
+	c.Check(v.IndexSizeHints(context.Background(), "", false, buf), check.IsNil)
+	c.Check(buf.String(), check.Matches, `(?ms).*^`+fooHash+`\+3 \d+ 1234$.*`)
+	c.Check(buf.String(), check.Matches, `(?ms).*^`+barHash+`\+3 \d+ -1$.*`)
+	c.Check(v.IndexSizeHints(context.Background(), "", true, buf), check.Equals, errNoReadTimes)
+
+	// Trashing and untrashing the block keep the size hint.
+	v.TouchWithDate(fooHash, time.Now().Add(-2*cluster.Collections.BlobSigningTTL.Duration()))
+	c.Assert(v.BlockTrash(fooHash), check.IsNil)
+	c.Assert(v.BlockUntrash(fooHash), check.IsNil)
+	buf.Reset()
+	c.Check(v.IndexSizeHints(context.Background(), fooHash, false, buf), check.IsNil)
+	c.Check(buf.String(), check.Matches, fooHash+`\+3 \d+ 1234\n`)
+}
+
 func (s *stubbedAzureBlobSuite) TestStats(c *check.C) {
 	volume := s.newTestableAzureBlobVolume(c, newVolumeParams{
 		Cluster:      testCluster(c),
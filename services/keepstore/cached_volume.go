@@ -0,0 +1,398 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Start a cleanup after writing 1/cacheTidyFraction of the
+	// size limit to the cache since the last cleanup.
+	cacheTidyFraction = 20
+
+	// Temporary files older than this are assumed to be left
+	// behind by a keepstore process that crashed while writing
+	// them.
+	cacheTmpMaxAge = time.Hour
+)
+
+// cachedVolume wraps another (typically remote) volume, keeping
+// copies of blocks read from it in a local directory. Writes go
+// directly to the wrapped volume.
+//
+// The cache directory can be shared by multiple keepstore processes
+// on the same node, e.g., a keepstore service and the keepstore
+// processes started by crunch-run. Cache files are written
+// atomically, and the least recently read files are deleted by
+// whichever process holds the cleanup lock.
+//
+// If the wrapped volume stores encoded data (e.g., compressed or
+// encrypted), the data cannot be verified against the block hash, so
+// each cache file starts with the MD5 checksum of the cached data.
+//
+// Blocks can be trashed by other processes without removing them
+// from this cache (e.g., by a keepstore server on a different node
+// that uses the same backend volume), so BlockRead checks that a
+// block still exists on the wrapped volume before returning the
+// cached copy.
+type cachedVolume struct {
+	volume
+	dir         string
+	maxBytes    int64
+	encodedData bool
+	logger      logrus.FieldLogger
+
+	hits      prometheus.Counter
+	misses    prometheus.Counter
+	evictions prometheus.Counter
+	size      prometheus.Gauge
+
+	writtenSinceTidy atomic.Int64
+	tidying          atomic.Bool
+}
+
+func newCachedVolume(vol volume, params newVolumeParams) (volume, error) {
+	cfg := params.ConfigVolume.Cache
+	v := &cachedVolume{
+		volume:      vol,
+		dir:         filepath.Join(cfg.Dir, params.UUID),
+		encodedData: params.EncodedData,
+		logger:      params.Logger.WithField("Volume", vol.DeviceID()),
+	}
+	err := os.MkdirAll(filepath.Join(v.dir, "tmp"), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("Cache.Dir: %w", err)
+	}
+	v.maxBytes = int64(cfg.MaxSize.ByteSize())
+	if v.maxBytes <= 0 {
+		pct := cfg.MaxSize.Percent()
+		if pct == 0 {
+			pct = 10
+		}
+		var stat unix.Statfs_t
+		err = unix.Statfs(v.dir, &stat)
+		if err != nil {
+			return nil, fmt.Errorf("Cache.Dir: statfs: %w", err)
+		}
+		v.maxBytes = int64(stat.Blocks) * stat.Bsize * pct / 100
+	}
+	lbls := prometheus.Labels{"device_id": vol.DeviceID()}
+	v.hits = params.MetricsVecs.cacheRequests.With(prometheus.Labels{"device_id": vol.DeviceID(), "result": "hit"})
+	v.misses = params.MetricsVecs.cacheRequests.With(prometheus.Labels{"device_id": vol.DeviceID(), "result": "miss"})
+	v.evictions = params.MetricsVecs.cacheEvictions.With(lbls)
+	v.size = params.MetricsVecs.cacheBytes.With(lbls)
+	v.logger.Infof("caching blocks in %s, MaxSize %d bytes", v.dir, v.maxBytes)
+	go v.tidy()
+	return v, nil
+}
+
+// Replication returns the effective replication level of the
+// wrapped volume, or 0 if the wrapped volume does not report one.
+func (v *cachedVolume) Replication() int {
+	if rv, ok := v.volume.(interface{ Replication() int }); ok {
+		return rv.Replication()
+	}
+	return 0
+}
+
+// BlockMarkRead records the read time on the wrapped volume.
+func (v *cachedVolume) BlockMarkRead(hash string) error {
+	rv, ok := v.volume.(readTimeVolume)
+	if !ok {
+		return errNoReadTimes
+	}
+	return rv.BlockMarkRead(hash)
+}
+
+// IndexReadTimes writes the wrapped volume's read time index.
+func (v *cachedVolume) IndexReadTimes(ctx context.Context, prefix string, writeTo io.Writer) error {
+	rv, ok := v.volume.(readTimeVolume)
+	if !ok {
+		return errNoReadTimes
+	}
+	return rv.IndexReadTimes(ctx, prefix, writeTo)
+}
+
+// BlockWriteSizeHint writes the block to the wrapped volume along
+// with the given size hint, and deletes the cached copy.
+func (v *cachedVolume) BlockWriteSizeHint(ctx context.Context, hash string, data []byte, sizeHint int) error {
+	hv, ok := v.volume.(sizeHintVolume)
+	if !ok {
+		return errNoSizeHints
+	}
+	err := hv.BlockWriteSizeHint(ctx, hash, data, sizeHint)
+	if err != nil {
+		return err
+	}
+	v.removeCache(hash)
+	return nil
+}
+
+// IndexSizeHints writes the wrapped volume's size hint index.
+func (v *cachedVolume) IndexSizeHints(ctx context.Context, prefix string, readTimes bool, writeTo io.Writer) error {
+	hv, ok := v.volume.(sizeHintVolume)
+	if !ok {
+		return errNoSizeHints
+	}
+	return hv.IndexSizeHints(ctx, prefix, readTimes, writeTo)
+}
+
+func (v *cachedVolume) blockPath(hash string) string {
+	return filepath.Join(v.dir, hash[:3], hash)
+}
+
+type bypassCacheKey struct{}
+
+// bypassCache returns a context that makes cachedVolume.BlockRead
+// read directly from the wrapped volume, without using or populating
+// the cache.
+func bypassCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassCacheKey{}, true)
+}
+
+// BlockRead returns the cached copy of the block if there is one and
+// the block has not been trashed on the wrapped volume. Otherwise, it
+// reads the block from the wrapped volume and adds it to the cache.
+func (v *cachedVolume) BlockRead(ctx context.Context, hash string, w io.WriterAt) error {
+	if ctx.Value(bypassCacheKey{}) != nil {
+		return v.volume.BlockRead(ctx, hash, w)
+	}
+	if data, ok := v.readCache(hash); ok {
+		if _, err := v.volume.Mtime(hash); os.IsNotExist(err) {
+			// Trashed or deleted since it was cached.
+			v.removeCache(hash)
+			return err
+		} else if err != nil {
+			v.logger.WithError(err).Warnf("error checking whether cached block %s still exists on volume, returning cached copy anyway", hash)
+		}
+		v.hits.Inc()
+		if len(data) == 0 {
+			return nil
+		}
+		_, err := w.WriteAt(data, 0)
+		return err
+	}
+	v.misses.Inc()
+	buf := &memWriterAt{}
+	err := v.volume.BlockRead(ctx, hash, teeWriterAt{w, buf})
+	if err != nil {
+		return err
+	}
+	v.writeCache(hash, buf.buf)
+	return nil
+}
+
+// readCache returns the cached data for the given block, and false
+// if the block is not cached.
+func (v *cachedVolume) readCache(hash string) ([]byte, bool) {
+	path := v.blockPath(hash)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false
+	} else if err != nil {
+		v.logger.WithError(err).Warnf("error reading cached block %s", hash)
+		return nil, false
+	}
+	ok := false
+	if !v.encodedData {
+		ok = fmt.Sprintf("%x", md5.Sum(data)) == hash
+	} else if len(data) >= md5.Size {
+		sum := md5.Sum(data[md5.Size:])
+		ok = bytes.Equal(data[:md5.Size], sum[:])
+		data = data[md5.Size:]
+	}
+	if !ok {
+		v.logger.Warnf("deleting corrupt cached block %s", hash)
+		os.Remove(path)
+		return nil, false
+	}
+	// Files with the oldest atime are deleted first when the
+	// cache is full.
+	os.Chtimes(path, time.Now(), time.Time{})
+	return data, true
+}
+
+func (v *cachedVolume) writeCache(hash string, data []byte) {
+	path := v.blockPath(hash)
+	err := func() error {
+		f, err := os.CreateTemp(filepath.Join(v.dir, "tmp"), hash+"-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		if v.encodedData {
+			sum := md5.Sum(data)
+			_, err = f.Write(sum[:])
+			if err != nil {
+				f.Close()
+				return err
+			}
+		}
+		_, err = f.Write(data)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), path)
+	}()
+	if err != nil {
+		v.logger.WithError(err).Warnf("error adding block %s to cache", hash)
+		return
+	}
+	if v.writtenSinceTidy.Add(int64(len(data))) > v.maxBytes/cacheTidyFraction {
+		go v.tidy()
+	}
+}
+
+// BlockWrite writes the block to the wrapped volume, and deletes the
+// cached copy, which may be stale if the stored data was re-encoded
+// (e.g., re-encrypted with a different key).
+func (v *cachedVolume) BlockWrite(ctx context.Context, hash string, data []byte) error {
+	err := v.volume.BlockWrite(ctx, hash, data)
+	if err != nil {
+		return err
+	}
+	v.removeCache(hash)
+	return nil
+}
+
+// BlockRewrite rewrites the block on the wrapped volume without
+// changing its timestamp, and deletes the cached copy. If the wrapped
+// volume does not support this, BlockRewrite uses BlockWrite.
+func (v *cachedVolume) BlockRewrite(ctx context.Context, hash string, data []byte) error {
+	var err error
+	if rw, ok := v.volume.(blockRewriter); ok {
+		err = rw.BlockRewrite(ctx, hash, data)
+	} else {
+		err = v.volume.BlockWrite(ctx, hash, data)
+	}
+	if err != nil {
+		return err
+	}
+	v.removeCache(hash)
+	return nil
+}
+
+// BlockTrash trashes the block on the wrapped volume, and deletes the
+// cached copy.
+func (v *cachedVolume) BlockTrash(hash string) error {
+	err := v.volume.BlockTrash(hash)
+	if err != nil {
+		return err
+	}
+	v.removeCache(hash)
+	return nil
+}
+
+func (v *cachedVolume) removeCache(hash string) {
+	err := os.Remove(v.blockPath(hash))
+	if err != nil && !os.IsNotExist(err) {
+		v.logger.WithError(err).Warnf("error deleting cached block %s", hash)
+	}
+}
+
+// tidy deletes the least recently read cache files until the cache
+// is within its size limit.
+func (v *cachedVolume) tidy() {
+	if !v.tidying.CompareAndSwap(false, true) {
+		return
+	}
+	defer v.tidying.Store(false)
+	v.writtenSinceTidy.Store(0)
+
+	// Bail if a different process is already doing this.
+	lockfile, err := os.OpenFile(filepath.Join(v.dir, "tmp", "tidy.lock"), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		v.logger.WithError(err).Warn("error opening cache lock file")
+		return
+	}
+	defer lockfile.Close()
+	err = syscall.Flock(int(lockfile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		return
+	}
+
+	type entT struct {
+		path  string
+		atime int64
+		size  int64
+	}
+	var ents []entT
+	var total int64
+	filepath.WalkDir(v.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if filepath.Base(filepath.Dir(path)) == "tmp" {
+			if d.Name() != "tidy.lock" && time.Since(info.ModTime()) > cacheTmpMaxAge {
+				os.Remove(path)
+			}
+			return nil
+		}
+		if !keepBlockRegexp.MatchString(d.Name()) {
+			return nil
+		}
+		ent := entT{path: path, size: info.Size()}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			ent.atime = st.Atim.Nano()
+		}
+		ents = append(ents, ent)
+		total += ent.size
+		return nil
+	})
+	if total > v.maxBytes {
+		sort.Slice(ents, func(i, j int) bool { return ents[i].atime < ents[j].atime })
+		for _, ent := range ents {
+			if total <= v.maxBytes {
+				break
+			}
+			if os.Remove(ent.path) == nil {
+				total -= ent.size
+				v.evictions.Inc()
+			}
+		}
+	}
+	v.size.Set(float64(total))
+}
+
+// teeWriterAt writes to two io.WriterAts.
+type teeWriterAt struct {
+	w1, w2 io.WriterAt
+}
+
+func (t teeWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if _, err := t.w2.WriteAt(p, off); err != nil {
+		return 0, err
+	}
+	return t.w1.WriteAt(p, off)
+}
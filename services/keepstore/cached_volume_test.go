@@ -0,0 +1,271 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	check "gopkg.in/check.v1"
+)
+
+// testableCachedVolume wraps a Directory volume.
+type testableCachedVolume struct {
+	*cachedVolume
+	unixVolume *unixVolume
+}
+
+func (s *cachedVolumeSuite) newTestableVolume(c *check.C, params newVolumeParams) *testableCachedVolume {
+	params.ConfigVolume.Cache.Dir = c.MkDir()
+	params.ConfigVolume.DriverParameters = json.RawMessage(fmt.Sprintf(`{"Root": %q}`, c.MkDir()))
+	uv, err := newUnixVolume(params)
+	c.Assert(err, check.IsNil)
+	v, err := newCachedVolume(uv, params)
+	c.Assert(err, check.IsNil)
+	return &testableCachedVolume{
+		cachedVolume: v.(*cachedVolume),
+		unixVolume:   uv.(*unixVolume),
+	}
+}
+
+func (v *testableCachedVolume) TouchWithDate(hash string, t time.Time) {
+	syscall.Utime(v.unixVolume.blockPath(hash), &syscall.Utimbuf{Actime: t.Unix(), Modtime: t.Unix()})
+}
+
+func (v *testableCachedVolume) Teardown() {
+}
+
+func (v *testableCachedVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return "open", "create"
+}
+
+// newStubbedVolume returns a cachedVolume that wraps a stub volume,
+// so tests can inspect and modify the stored data.
+func (s *cachedVolumeSuite) newStubbedVolume(c *check.C, maxSize arvados.ByteSizeOrPercent) (*cachedVolume, *stubVolume) {
+	params := s.params
+	params.ConfigVolume.Cache = arvados.VolumeCache{Dir: c.MkDir(), MaxSize: maxSize}
+	stub, err := driver["stub"](params)
+	c.Assert(err, check.IsNil)
+	v, err := newCachedVolume(stub, params)
+	c.Assert(err, check.IsNil)
+	return v.(*cachedVolume), stub.(*stubVolume)
+}
+
+var _ = check.Suite(&cachedVolumeSuite{})
+
+type cachedVolumeSuite struct {
+	params newVolumeParams
+}
+
+func (s *cachedVolumeSuite) SetUpTest(c *check.C) {
+	logger := ctxlog.TestLogger(c)
+	reg := prometheus.NewRegistry()
+	s.params = newVolumeParams{
+		UUID:        "zzzzz-nyw5e-999999999999999",
+		Cluster:     testCluster(c),
+		Logger:      logger,
+		MetricsVecs: newVolumeMetricsVecs(reg),
+		BufferPool:  newBufferPool(logger, 8, reg),
+	}
+}
+
+func (s *cachedVolumeSuite) TestGeneric(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableVolume(c, params)
+	})
+}
+
+func (s *cachedVolumeSuite) TestGenericReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableVolume(c, params)
+	})
+}
+
+func (s *cachedVolumeSuite) TestHitMiss(c *check.C) {
+	v, stub := s.newStubbedVolume(c, 0)
+	stub.stubLog = &stubLog{}
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	for i := 0; i < 3; i++ {
+		buf := &brbuffer{}
+		c.Check(v.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+		c.Check(buf.String(), check.Equals, string(TestBlock))
+	}
+	c.Check(testutil.ToFloat64(v.misses), check.Equals, float64(1))
+	c.Check(testutil.ToFloat64(v.hits), check.Equals, float64(2))
+	c.Check(stub.stubLog.String(), check.Equals, "999 write e4d\n999 read e4d\n999 mtime e4d\n999 mtime e4d\n")
+
+	// Missing blocks are not cached.
+	err := v.BlockRead(context.Background(), fooHash, &brbuffer{})
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	_, err = os.Stat(v.blockPath(fooHash))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *cachedVolumeSuite) TestCorruptCacheFile(c *check.C) {
+	v, _ := s.newStubbedVolume(c, 0)
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	c.Assert(v.BlockRead(context.Background(), TestHash, &brbuffer{}), check.IsNil)
+	c.Assert(os.WriteFile(v.blockPath(TestHash), []byte("bogus"), 0600), check.IsNil)
+
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(TestBlock))
+	c.Check(testutil.ToFloat64(v.misses), check.Equals, float64(2))
+	data, err := os.ReadFile(v.blockPath(TestHash))
+	c.Check(err, check.IsNil)
+	c.Check(string(data), check.Equals, string(TestBlock))
+}
+
+func (s *cachedVolumeSuite) TestCorruptCacheFileEncodedData(c *check.C) {
+	params := s.params
+	params.ConfigVolume.Cache = arvados.VolumeCache{Dir: c.MkDir()}
+	params.EncodedData = true
+	stub, err := driver["stub"](params)
+	c.Assert(err, check.IsNil)
+	vol, err := newCachedVolume(stub, params)
+	c.Assert(err, check.IsNil)
+	v := vol.(*cachedVolume)
+	encoded := []byte("encoded data")
+	c.Assert(v.BlockWrite(context.Background(), TestHash, encoded), check.IsNil)
+	c.Assert(v.BlockRead(context.Background(), TestHash, &brbuffer{}), check.IsNil)
+
+	// Flip a bit in the cached data, leaving the checksum intact.
+	data, err := os.ReadFile(v.blockPath(TestHash))
+	c.Assert(err, check.IsNil)
+	c.Assert(data, check.HasLen, md5.Size+len(encoded))
+	data[md5.Size] ^= 1
+	c.Assert(os.WriteFile(v.blockPath(TestHash), data, 0600), check.IsNil)
+
+	// The corrupt cache file is detected and replaced with the
+	// stored data.
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(encoded))
+	c.Check(testutil.ToFloat64(v.misses), check.Equals, float64(2))
+	buf = &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(encoded))
+	c.Check(testutil.ToFloat64(v.hits), check.Equals, float64(1))
+}
+
+func (s *cachedVolumeSuite) TestWriteAndTrashInvalidate(c *check.C) {
+	v, stub := s.newStubbedVolume(c, 0)
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	c.Assert(v.BlockRead(context.Background(), TestHash, &brbuffer{}), check.IsNil)
+	_, err := os.Stat(v.blockPath(TestHash))
+	c.Assert(err, check.IsNil)
+
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	_, err = os.Stat(v.blockPath(TestHash))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	c.Assert(v.BlockRead(context.Background(), TestHash, &brbuffer{}), check.IsNil)
+	c.Assert(stub.blockTouchWithTime(TestHash, time.Now().Add(-s.params.Cluster.Collections.BlobSigningTTL.Duration())), check.IsNil)
+	c.Assert(v.BlockTrash(TestHash), check.IsNil)
+	_, err = os.Stat(v.blockPath(TestHash))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	err = v.BlockRead(context.Background(), TestHash, &brbuffer{})
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *cachedVolumeSuite) TestTrashedElsewhere(c *check.C) {
+	v, stub := s.newStubbedVolume(c, 0)
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	c.Assert(v.BlockRead(context.Background(), TestHash, &brbuffer{}), check.IsNil)
+	_, err := os.Stat(v.blockPath(TestHash))
+	c.Assert(err, check.IsNil)
+
+	// Trash the block on the backing volume without going
+	// through this cachedVolume, as another keepstore process
+	// would.
+	c.Assert(stub.blockTouchWithTime(TestHash, time.Now().Add(-s.params.Cluster.Collections.BlobSigningTTL.Duration())), check.IsNil)
+	c.Assert(stub.BlockTrash(TestHash), check.IsNil)
+
+	err = v.BlockRead(context.Background(), TestHash, &brbuffer{})
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	_, err = os.Stat(v.blockPath(TestHash))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	// After untrashing, the block is readable (and cached) again.
+	c.Assert(stub.BlockUntrash(TestHash), check.IsNil)
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(TestBlock))
+	_, err = os.Stat(v.blockPath(TestHash))
+	c.Check(err, check.IsNil)
+}
+
+func (s *cachedVolumeSuite) TestEviction(c *check.C) {
+	v, _ := s.newStubbedVolume(c, 2500)
+	// Prevent cleanup from running in the background until we're
+	// ready.
+	for !v.tidying.CompareAndSwap(false, true) {
+		time.Sleep(time.Millisecond)
+	}
+	var hashes []string
+	for i := 0; i < 5; i++ {
+		data := []byte(fmt.Sprintf("%01000d", i))
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		hashes = append(hashes, hash)
+		c.Assert(v.BlockWrite(context.Background(), hash, data), check.IsNil)
+		c.Assert(v.BlockRead(context.Background(), hash, &brbuffer{}), check.IsNil)
+		// Make read times distinguishable.
+		t := time.Now().Add(time.Duration(i-10) * time.Minute)
+		c.Assert(os.Chtimes(v.blockPath(hash), t, t), check.IsNil)
+	}
+	// Reading the oldest block makes it the most recently used.
+	c.Assert(v.BlockRead(context.Background(), hashes[0], &brbuffer{}), check.IsNil)
+
+	v.tidying.Store(false)
+	v.tidy()
+	for i, hash := range hashes {
+		_, err := os.Stat(v.blockPath(hash))
+		c.Check(err == nil, check.Equals, i == 0 || i >= 4, check.Commentf("block %d", i))
+	}
+	c.Check(testutil.ToFloat64(v.evictions), check.Equals, float64(3))
+	c.Check(testutil.ToFloat64(v.size), check.Equals, float64(2000))
+}
+
+func (s *cachedVolumeSuite) TestStaleTempFiles(c *check.C) {
+	v, _ := s.newStubbedVolume(c, 0)
+	stale := filepath.Join(v.dir, "tmp", TestHash+"-stale")
+	fresh := filepath.Join(v.dir, "tmp", TestHash+"-fresh")
+	c.Assert(os.WriteFile(stale, TestBlock, 0600), check.IsNil)
+	c.Assert(os.WriteFile(fresh, TestBlock, 0600), check.IsNil)
+	t := time.Now().Add(-2 * cacheTmpMaxAge)
+	c.Assert(os.Chtimes(stale, t, t), check.IsNil)
+	for v.tidying.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	v.tidy()
+	_, err := os.Stat(stale)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	_, err = os.Stat(fresh)
+	c.Check(err, check.IsNil)
+}
+
+func (s *cachedVolumeSuite) TestSetupMounts(c *check.C) {
+	cluster := testCluster(c)
+	cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Driver: "stub", Replication: 1, Compression: "zstd", Cache: arvados.VolumeCache{Dir: c.MkDir()}},
+	}
+	ks, cancel := testKeepstore(c, cluster, nil)
+	defer cancel()
+	c.Assert(ks.mountsW, check.HasLen, 1)
+	cv, ok := ks.mountsW[0].volume.(*compressedVolume)
+	c.Assert(ok, check.Equals, true)
+	c.Check(cv.volume, check.FitsTypeOf, &cachedVolume{})
+	c.Check(cv.volume.(*cachedVolume).encodedData, check.Equals, true)
+}
@@ -0,0 +1,218 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum number of changes recorded in each mount's change journal.
+// When the journal is full, the oldest half is discarded, and
+// incremental index requests for changes since a time before the
+// discarded entries fail with errJournalExpired.
+var changeJournalMaxEntries = 1 << 20
+
+type changeJournalEntry struct {
+	time int64
+	hash string
+}
+
+type changeJournalBlock struct {
+	last int64 // time of most recent change
+	size int   // -1 if unknown
+}
+
+// changeJournal records which blocks were written, touched, trashed,
+// or untrashed on a mount, so keep-balance can get an index of the
+// blocks that changed since its previous run instead of a full index.
+//
+// The journal only records changes made by this keepstore process,
+// and is lost when keepstore restarts.
+type changeJournal struct {
+	start  int64 // changes before this time (UnixNano) are not covered
+	log    []changeJournalEntry
+	blocks map[string]changeJournalBlock
+	mtx    sync.Mutex
+}
+
+func newChangeJournal() *changeJournal {
+	return &changeJournal{
+		start:  time.Now().UnixNano(),
+		blocks: map[string]changeJournalBlock{},
+	}
+}
+
+// record adds an entry to the journal indicating the given block
+// changed at the current time. If size is negative, the block size
+// is unknown.
+//
+// If j is nil, record does nothing.
+func (j *changeJournal) record(hash string, size int) {
+	if j == nil {
+		return
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	now := time.Now().UnixNano()
+	j.log = append(j.log, changeJournalEntry{time: now, hash: hash})
+	blk, ok := j.blocks[hash]
+	if !ok {
+		blk.size = -1
+	}
+	blk.last = now
+	if size >= 0 {
+		blk.size = size
+	}
+	j.blocks[hash] = blk
+	if len(j.log) > changeJournalMaxEntries {
+		j.discard(len(j.log) / 2)
+	}
+}
+
+// noteSize records the size of the given block, if the block is
+// already in the journal or is about to be added (e.g., before
+// trashing it, when the size could not be determined afterward).
+//
+// If j is nil, noteSize does nothing.
+func (j *changeJournal) noteSize(hash string, size int) {
+	if j == nil {
+		return
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	blk, ok := j.blocks[hash]
+	if !ok {
+		// Not yet changed. Set last=0 so the entry is removed
+		// by discard() if the block is never changed.
+		blk = changeJournalBlock{}
+	}
+	blk.size = size
+	j.blocks[hash] = blk
+}
+
+// size returns the size of the given block, and false if unknown.
+func (j *changeJournal) size(hash string) (int, bool) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	blk, ok := j.blocks[hash]
+	if !ok || blk.size < 0 {
+		return 0, false
+	}
+	return blk.size, true
+}
+
+// discard removes the oldest n entries. Caller must have lock.
+func (j *changeJournal) discard(n int) {
+	j.start = j.log[n-1].time + 1
+	for hash, blk := range j.blocks {
+		if blk.last < j.start {
+			delete(j.blocks, hash)
+		}
+	}
+	j.log = append([]changeJournalEntry(nil), j.log[n:]...)
+}
+
+// changes returns the blocks with the given prefix that changed after
+// the given time, with their sizes (-1 if unknown), sorted by hash.
+// It returns errJournalExpired if the journal does not cover the
+// entire time since then.
+func (j *changeJournal) changes(since int64, prefix string) ([]string, []int, error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if since < j.start {
+		return nil, nil, errJournalExpired
+	}
+	i := sort.Search(len(j.log), func(i int) bool { return j.log[i].time > since })
+	seen := map[string]bool{}
+	var hashes []string
+	for _, ent := range j.log[i:] {
+		if !seen[ent.hash] && strings.HasPrefix(ent.hash, prefix) {
+			seen[ent.hash] = true
+			hashes = append(hashes, ent.hash)
+		}
+	}
+	sort.Strings(hashes)
+	sizes := make([]int, len(hashes))
+	for i, hash := range hashes {
+		sizes[i] = j.blocks[hash].size
+	}
+	return hashes, sizes, nil
+}
+
+// BlockWrite writes the block to the mount's volume, and records the
+// change in the mount's change journal.
+func (mnt *mount) BlockWrite(ctx context.Context, hash string, data []byte) error {
+	err := mnt.volume.BlockWrite(ctx, hash, data)
+	if err == nil {
+		mnt.journal.record(hash, len(data))
+	}
+	return err
+}
+
+// BlockTouch updates the block's timestamp on the mount's volume, and
+// records the change in the mount's change journal.
+func (mnt *mount) BlockTouch(hash string) error {
+	err := mnt.volume.BlockTouch(hash)
+	if err == nil {
+		mnt.journal.record(hash, -1)
+	}
+	return err
+}
+
+// BlockTrash trashes the block on the mount's volume, and records the
+// change in the mount's change journal.
+func (mnt *mount) BlockTrash(hash string) error {
+	if mnt.journal != nil {
+		if _, ok := mnt.journal.size(hash); !ok {
+			// Once the block is trashed, its size will no
+			// longer be available from the volume index,
+			// but keep-balance will need it to update its
+			// block state.
+			if size, ok := mnt.indexSize(context.Background(), hash); ok {
+				mnt.journal.noteSize(hash, size)
+			}
+		}
+	}
+	err := mnt.volume.BlockTrash(hash)
+	if err == nil {
+		mnt.journal.record(hash, -1)
+	}
+	return err
+}
+
+// BlockUntrash untrashes the block on the mount's volume, and records
+// the change in the mount's change journal.
+func (mnt *mount) BlockUntrash(hash string) error {
+	err := mnt.volume.BlockUntrash(hash)
+	if err == nil {
+		mnt.journal.record(hash, -1)
+	}
+	return err
+}
+
+// indexSize returns the size of the given block according to the
+// volume index, and false if the block is not listed.
+func (mnt *mount) indexSize(ctx context.Context, hash string) (int, bool) {
+	var buf bytes.Buffer
+	if mnt.volume.Index(ctx, hash, &buf) != nil {
+		return 0, false
+	}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		locator, _, _ := strings.Cut(scanner.Text(), " ")
+		if h, sizestr, ok := strings.Cut(locator, "+"); ok && h == hash {
+			size, err := strconv.Atoi(sizestr)
+			return size, err == nil
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,142 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/keepclient"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&changeJournalSuite{})
+
+type changeJournalSuite struct{}
+
+func (s *changeJournalSuite) TestChanges(c *C) {
+	j := newChangeJournal()
+	t0 := time.Now().UnixNano()
+	j.record(fooHash, 3)
+	j.record(barHash, -1)
+	t1 := time.Now().UnixNano()
+	j.record(fooHash, -1)
+
+	hashes, sizes, err := j.changes(t0, "")
+	c.Check(err, IsNil)
+	c.Check(hashes, DeepEquals, []string{barHash, fooHash})
+	c.Check(sizes, DeepEquals, []int{-1, 3})
+
+	hashes, _, err = j.changes(t1, "")
+	c.Check(err, IsNil)
+	c.Check(hashes, DeepEquals, []string{fooHash})
+
+	hashes, _, err = j.changes(t0, "37b")
+	c.Check(err, IsNil)
+	c.Check(hashes, DeepEquals, []string{barHash})
+
+	_, _, err = j.changes(j.start-1, "")
+	c.Check(err, Equals, errJournalExpired)
+
+	j.noteSize(barHash, 3)
+	_, sizes, err = j.changes(t0, "")
+	c.Check(err, IsNil)
+	c.Check(sizes, DeepEquals, []int{3, 3})
+
+	// A nil journal ignores changes.
+	var nilj *changeJournal
+	nilj.record(fooHash, 3)
+	nilj.noteSize(fooHash, 3)
+}
+
+func (s *changeJournalSuite) TestDiscard(c *C) {
+	defer func(n int) { changeJournalMaxEntries = n }(changeJournalMaxEntries)
+	changeJournalMaxEntries = 4
+
+	j := newChangeJournal()
+	t0 := time.Now().UnixNano()
+	j.record(fooHash, 3)
+	j.record(barHash, 3)
+	j.record(barHash, 3)
+	j.record(barHash, 3)
+	_, _, err := j.changes(t0, "")
+	c.Check(err, IsNil)
+
+	// Adding a 5th entry discards the oldest 2, and the foo block
+	// is no longer tracked.
+	j.record(barHash, 3)
+	c.Check(j.log, HasLen, 3)
+	_, _, err = j.changes(t0, "")
+	c.Check(err, Equals, errJournalExpired)
+	_, ok := j.size(fooHash)
+	c.Check(ok, Equals, false)
+	hashes, _, err := j.changes(j.start, "")
+	c.Check(err, IsNil)
+	c.Check(hashes, DeepEquals, []string{barHash})
+}
+
+func (s *routerSuite) TestIndexChanges(c *C) {
+	s.cluster.Collections.BalanceFullIndexInterval = arvados.Duration(time.Hour)
+	router, cancel := testRouter(c, s.cluster, nil)
+	defer cancel()
+	mnt := router.keepstore.mounts["zzzzz-nyw5e-000000000000000"]
+	ctx := context.Background()
+	c.Assert(mnt.BlockWrite(ctx, fooHash, []byte("foo")), IsNil)
+
+	resp := call(router, "GET", "http://example/mounts/zzzzz-nyw5e-000000000000000/blocks", s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Matches, fooHash+`\+3 \d+\n\n`)
+	since := resp.Header().Get(keepclient.XKeepIndexTime)
+	_, err := strconv.ParseInt(since, 10, 64)
+	c.Assert(err, IsNil)
+
+	// No changes yet
+	resp = call(router, "GET", "http://example/mounts/zzzzz-nyw5e-000000000000000/blocks?since="+since, s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, "\n")
+
+	c.Assert(mnt.BlockWrite(ctx, barHash, []byte("bar")), IsNil)
+	c.Assert(mnt.volume.(*stubVolume).blockTouchWithTime(fooHash, time.Now().Add(-s.cluster.Collections.BlobSigningTTL.Duration())), IsNil)
+	c.Assert(mnt.BlockTrash(fooHash), IsNil)
+	resp = call(router, "GET", "http://example/mounts/zzzzz-nyw5e-000000000000000/blocks?since="+since, s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Matches, barHash+`\+3 \d+\n`+fooHash+`\+3 -\n\n`)
+	c.Check(resp.Header().Get(keepclient.XKeepIndexTime), Not(Equals), since)
+
+	resp = call(router, "GET", "http://example/mounts/zzzzz-nyw5e-000000000000000/blocks?prefix=acb&since="+since, s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Equals, fooHash+"+3 -\n\n")
+
+	c.Assert(mnt.BlockUntrash(fooHash), IsNil)
+	resp = call(router, "GET", "http://example/mounts/zzzzz-nyw5e-000000000000000/blocks?prefix=acb&since="+since, s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Matches, fooHash+`\+3 \d+\n\n`)
+
+	// Changes from before the journal started (e.g., before
+	// keepstore restarted) are not available.
+	resp = call(router, "GET", "http://example/mounts/zzzzz-nyw5e-000000000000000/blocks?since=1", s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusGone)
+
+	for _, path := range []string{
+		"/mounts/zzzzz-nyw5e-000000000000000/blocks?since=abc",
+		"/index?since=" + since,
+	} {
+		resp = call(router, "GET", "http://example"+path, s.cluster.SystemRootToken, nil, nil)
+		c.Check(resp.Code, Equals, http.StatusBadRequest, Commentf("%s", path))
+	}
+}
+
+func (s *routerSuite) TestIndexChanges_Disabled(c *C) {
+	router, cancel := testRouter(c, s.cluster, nil)
+	defer cancel()
+	resp := call(router, "GET", "http://example/mounts/zzzzz-nyw5e-000000000000000/blocks", s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Header().Get(keepclient.XKeepIndexTime), Equals, "")
+	resp = call(router, "GET", "http://example/mounts/zzzzz-nyw5e-000000000000000/blocks?since=1", s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusNotImplemented)
+}
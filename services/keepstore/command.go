@@ -28,6 +28,8 @@ func newHandlerOrErrorHandler(ctx context.Context, cluster *arvados.Cluster, tok
 	}
 	puller := newPuller(ctx, ks, reg)
 	trasher := newTrasher(ctx, ks, reg)
+	scrubber := newScrubber(ctx, ks, reg)
 	_ = newTrashEmptier(ctx, ks, reg)
-	return newRouter(ks, puller, trasher)
+	_ = newReencrypter(ctx, ks)
+	return newRouter(ks, puller, trasher, scrubber)
 }
@@ -0,0 +1,349 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed blocks start with a zstd "skippable frame" holding a
+// checksum of the block hash and the uncompressed size, followed by
+// a regular zstd frame. Standard zstd tools ignore the skippable
+// frame, so the stored data can still be decompressed with
+// "zstd -d".
+//
+// The checksum distinguishes compressed blocks from uncompressed
+// blocks (e.g., blocks written before compression was enabled) that
+// happen to start with the same bytes: an uncompressed block cannot
+// contain a checksum of its own hash.
+const (
+	compressedHeaderMagic = 0x184D2A5A
+	compressedHeaderSize  = 8 + md5.Size + 8
+
+	// Maximum number of concurrent header reads while building
+	// an index.
+	compressedIndexConcurrency = 16
+
+	// Default maximum number of entries in the size cache, if
+	// not configured.
+	compressedSizeCacheDefault = 1000000
+)
+
+// compressedVolume wraps another volume, compressing blocks in
+// BlockWrite and decompressing them in BlockRead.
+type compressedVolume struct {
+	volume
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+
+	// Uncompressed sizes of recently seen blocks, so Index can
+	// report the uncompressed size without reading the block
+	// header.
+	sizes *lru.Cache
+
+	// Wrapped volume, if it can store the uncompressed size
+	// with each block, in which case Index only needs to read
+	// the headers of blocks written without a size hint.
+	sizeHints sizeHintVolume
+}
+
+func newCompressedVolume(vol volume, params newVolumeParams) (volume, error) {
+	if params.ConfigVolume.Compression != "zstd" {
+		return nil, fmt.Errorf("unsupported Compression %q", params.ConfigVolume.Compression)
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(BlockSize))
+	if err != nil {
+		return nil, err
+	}
+	cachesize := params.ConfigVolume.CompressionSizeCache
+	if cachesize <= 0 {
+		cachesize = compressedSizeCacheDefault
+	}
+	sizes, err := lru.New(cachesize)
+	if err != nil {
+		return nil, err
+	}
+	v := &compressedVolume{
+		volume:  vol,
+		encoder: encoder,
+		decoder: decoder,
+		sizes:   sizes,
+	}
+	if supportsSizeHints(vol) {
+		v.sizeHints = vol.(sizeHintVolume)
+	}
+	return v, nil
+}
+
+// Replication returns the effective replication level of the
+// wrapped volume, or 0 if the wrapped volume does not report one.
+func (v *compressedVolume) Replication() int {
+	if rv, ok := v.volume.(interface{ Replication() int }); ok {
+		return rv.Replication()
+	}
+	return 0
+}
+
+func (v *compressedVolume) header(hash string, size int) []byte {
+	hdr := make([]byte, compressedHeaderSize)
+	binary.LittleEndian.PutUint32(hdr, compressedHeaderMagic)
+	binary.LittleEndian.PutUint32(hdr[4:], compressedHeaderSize-8)
+	sum := md5.Sum([]byte(hash))
+	copy(hdr[8:], sum[:])
+	binary.LittleEndian.PutUint64(hdr[8+md5.Size:], uint64(size))
+	return hdr
+}
+
+// parseHeader returns the uncompressed size and true if buf starts
+// with a valid header for the given hash.
+func (v *compressedVolume) parseHeader(hash string, buf []byte) (int, bool) {
+	if len(buf) < compressedHeaderSize {
+		return 0, false
+	}
+	want := v.header(hash, 0)
+	if !bytes.Equal(buf[:8+md5.Size], want[:8+md5.Size]) {
+		return 0, false
+	}
+	size := binary.LittleEndian.Uint64(buf[8+md5.Size:])
+	if size > BlockSize {
+		return 0, false
+	}
+	return int(size), true
+}
+
+func (v *compressedVolume) setSize(hash string, size int) {
+	v.sizes.Add(hash, size)
+}
+
+func (v *compressedVolume) getSize(hash string) (int, bool) {
+	size, ok := v.sizes.Get(hash)
+	if !ok {
+		return 0, false
+	}
+	return size.(int), true
+}
+
+// BlockWrite compresses the block and writes it to the wrapped
+// volume. If compression would not reduce the size, the block is
+// written as-is. If the wrapped volume supports size hints, the
+// uncompressed size is stored with the block.
+func (v *compressedVolume) BlockWrite(ctx context.Context, hash string, data []byte) error {
+	buf := v.encoder.EncodeAll(data, v.header(hash, len(data)))
+	if len(buf) >= len(data) {
+		buf = data
+	}
+	var err error
+	if v.sizeHints != nil {
+		err = v.sizeHints.BlockWriteSizeHint(ctx, hash, buf, len(data))
+	} else {
+		err = v.volume.BlockWrite(ctx, hash, buf)
+	}
+	if err == nil {
+		v.setSize(hash, len(data))
+	}
+	return err
+}
+
+// BlockRead reads the stored block from the wrapped volume, and
+// decompresses it if it was stored in compressed form.
+func (v *compressedVolume) BlockRead(ctx context.Context, hash string, w io.WriterAt) error {
+	buf := &memWriterAt{}
+	err := v.volume.BlockRead(ctx, hash, buf)
+	if err != nil {
+		return err
+	}
+	data := buf.buf
+	if size, ok := v.parseHeader(hash, data); ok {
+		data, err = v.decoder.DecodeAll(data[compressedHeaderSize:], make([]byte, 0, size))
+		if err != nil {
+			return fmt.Errorf("error decompressing block %s: %w", hash, err)
+		}
+		if len(data) != size {
+			return fmt.Errorf("error decompressing block %s: got %d bytes, expected %d", hash, len(data), size)
+		}
+	}
+	v.setSize(hash, len(data))
+	if len(data) == 0 {
+		return nil
+	}
+	_, err = w.WriteAt(data, 0)
+	return err
+}
+
+// readSize returns the uncompressed size of a stored block by
+// reading its header.
+func (v *compressedVolume) readSize(ctx context.Context, hash string, storedSize int) (int, error) {
+	if storedSize < compressedHeaderSize {
+		return storedSize, nil
+	}
+	hw := newHeaderWriter(compressedHeaderSize)
+	err := v.volume.BlockRead(ctx, hash, hw)
+	if err != nil && !errors.Is(err, errHeaderRead) {
+		return 0, err
+	}
+	if size, ok := v.parseHeader(hash, hw.buf); ok {
+		return size, nil
+	}
+	return storedSize, nil
+}
+
+type compressedIndexEntry struct {
+	hash  string
+	size  int
+	hint  int
+	mtime string
+	err   error
+}
+
+// Index writes the wrapped volume's index, replacing stored sizes
+// with uncompressed sizes.
+//
+// Uncompressed sizes are taken from the size hints stored with the
+// blocks, if the wrapped volume supports them, or the size cache.
+// Otherwise, the block header is read.
+func (v *compressedVolume) Index(ctx context.Context, prefix string, writeTo io.Writer) error {
+	if v.sizeHints != nil {
+		return v.index(ctx, prefix, writeTo, true, func(ctx context.Context, prefix string, w io.Writer) error {
+			return v.sizeHints.IndexSizeHints(ctx, prefix, false, w)
+		})
+	}
+	return v.index(ctx, prefix, writeTo, false, v.volume.Index)
+}
+
+// BlockMarkRead records the read time on the wrapped volume.
+func (v *compressedVolume) BlockMarkRead(hash string) error {
+	rv, ok := v.volume.(readTimeVolume)
+	if !ok {
+		return errNoReadTimes
+	}
+	return rv.BlockMarkRead(hash)
+}
+
+// IndexReadTimes writes the wrapped volume's read time index,
+// replacing stored sizes with uncompressed sizes.
+func (v *compressedVolume) IndexReadTimes(ctx context.Context, prefix string, writeTo io.Writer) error {
+	rv, ok := v.volume.(readTimeVolume)
+	if !ok {
+		return errNoReadTimes
+	}
+	if v.sizeHints != nil {
+		return v.index(ctx, prefix, writeTo, true, func(ctx context.Context, prefix string, w io.Writer) error {
+			return v.sizeHints.IndexSizeHints(ctx, prefix, true, w)
+		})
+	}
+	return v.index(ctx, prefix, writeTo, false, rv.IndexReadTimes)
+}
+
+// index writes the index generated by the given func, replacing
+// stored sizes with uncompressed sizes. If hints is true, the last
+// field of each line is a size hint (see sizeHintVolume), which is
+// used if available and removed from the output.
+func (v *compressedVolume) index(ctx context.Context, prefix string, writeTo io.Writer, hints bool, index func(context.Context, string, io.Writer) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(index(ctx, prefix, pw))
+	}()
+	defer pr.Close()
+	scanner := bufio.NewScanner(pr)
+	var batch []*compressedIndexEntry
+	flush := func() error {
+		var wg sync.WaitGroup
+		todo := make(chan *compressedIndexEntry)
+		for i := 0; i < compressedIndexConcurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ent := range todo {
+					ent.size, ent.err = v.readSize(ctx, ent.hash, ent.size)
+					if ent.err == nil {
+						v.setSize(ent.hash, ent.size)
+					}
+				}
+			}()
+		}
+		for _, ent := range batch {
+			if ent.hint >= 0 {
+				ent.size = ent.hint
+			} else if size, ok := v.getSize(ent.hash); ok {
+				ent.size = size
+			} else {
+				todo <- ent
+			}
+		}
+		close(todo)
+		wg.Wait()
+		for _, ent := range batch {
+			if os.IsNotExist(ent.err) {
+				// The block was deleted since the
+				// wrapped volume's index was generated.
+				continue
+			} else if ent.err != nil {
+				return ent.err
+			}
+			_, err := fmt.Fprintf(writeTo, "%s+%d %s\n", ent.hash, ent.size, ent.mtime)
+			if err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for scanner.Scan() {
+		locator, mtime, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		hash, sizestr, ok := strings.Cut(locator, "+")
+		if !ok || !keepBlockRegexp.MatchString(hash) {
+			continue
+		}
+		size, err := strconv.Atoi(sizestr)
+		if err != nil {
+			continue
+		}
+		hint := -1
+		if hints {
+			cut := strings.LastIndexByte(mtime, ' ')
+			if cut < 0 {
+				continue
+			}
+			hint, err = strconv.Atoi(mtime[cut+1:])
+			if err != nil || hint > BlockSize {
+				hint = -1
+			}
+			mtime = mtime[:cut]
+		}
+		batch = append(batch, &compressedIndexEntry{hash: hash, size: size, mtime: mtime, hint: hint})
+		if len(batch) >= 1000 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
@@ -0,0 +1,279 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+// testableCompressedVolume wraps a Directory volume.
+type testableCompressedVolume struct {
+	*compressedVolume
+	unixVolume *unixVolume
+}
+
+func (s *compressedVolumeSuite) newTestableVolume(c *check.C, params newVolumeParams) *testableCompressedVolume {
+	params.ConfigVolume.Compression = "zstd"
+	params.ConfigVolume.DriverParameters = json.RawMessage(fmt.Sprintf(`{"Root": %q}`, c.MkDir()))
+	params.EncodedData = true
+	uv, err := newUnixVolume(params)
+	c.Assert(err, check.IsNil)
+	v, err := newCompressedVolume(uv, params)
+	c.Assert(err, check.IsNil)
+	return &testableCompressedVolume{
+		compressedVolume: v.(*compressedVolume),
+		unixVolume:       uv.(*unixVolume),
+	}
+}
+
+func (v *testableCompressedVolume) TouchWithDate(hash string, t time.Time) {
+	syscall.Utime(v.unixVolume.blockPath(hash), &syscall.Utimbuf{Actime: t.Unix(), Modtime: t.Unix()})
+}
+
+func (v *testableCompressedVolume) Teardown() {
+}
+
+func (v *testableCompressedVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return "open", "create"
+}
+
+// newStubbedVolume returns a compressedVolume that wraps a stub
+// volume, so tests can inspect the stored data.
+func (s *compressedVolumeSuite) newStubbedVolume(c *check.C) (*compressedVolume, *stubVolume) {
+	params := s.params
+	params.ConfigVolume.Compression = "zstd"
+	stub, err := driver["stub"](params)
+	c.Assert(err, check.IsNil)
+	return s.rewrap(c, stub), stub.(*stubVolume)
+}
+
+// rewrap returns a new compressedVolume wrapping the given volume,
+// with no cached block sizes.
+func (s *compressedVolumeSuite) rewrap(c *check.C, vol volume) *compressedVolume {
+	params := s.params
+	params.ConfigVolume.Compression = "zstd"
+	v, err := newCompressedVolume(vol, params)
+	c.Assert(err, check.IsNil)
+	return v.(*compressedVolume)
+}
+
+var _ = check.Suite(&compressedVolumeSuite{})
+
+type compressedVolumeSuite struct {
+	params newVolumeParams
+}
+
+func (s *compressedVolumeSuite) SetUpTest(c *check.C) {
+	logger := ctxlog.TestLogger(c)
+	reg := prometheus.NewRegistry()
+	s.params = newVolumeParams{
+		UUID:        "zzzzz-nyw5e-999999999999999",
+		Cluster:     testCluster(c),
+		Logger:      logger,
+		MetricsVecs: newVolumeMetricsVecs(reg),
+		BufferPool:  newBufferPool(logger, 8, reg),
+	}
+}
+
+func (s *compressedVolumeSuite) TestGeneric(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableVolume(c, params)
+	})
+}
+
+func (s *compressedVolumeSuite) TestGenericReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableVolume(c, params)
+	})
+}
+
+func (s *compressedVolumeSuite) TestUnsupported(c *check.C) {
+	params := s.params
+	params.ConfigVolume.Compression = "bogus"
+	_, err := newCompressedVolume(&stubVolume{}, params)
+	c.Check(err, check.ErrorMatches, `unsupported Compression "bogus"`)
+}
+
+func (s *compressedVolumeSuite) TestCompressible(c *check.C) {
+	v, stub := s.newStubbedVolume(c)
+	data := bytes.Repeat([]byte("ACGT"), 100000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(v.BlockWrite(context.Background(), hash, data), check.IsNil)
+	stored := stub.data[hash].data
+	c.Check(len(stored) < len(data)/10, check.Equals, true)
+
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), hash, buf), check.IsNil)
+	c.Check(bytes.Equal(buf.Bytes(), data), check.Equals, true)
+
+	// A new wrapper has no cached sizes, so it needs to read the
+	// header to report the uncompressed size.
+	v2 := s.rewrap(c, stub)
+	idx := &bytes.Buffer{}
+	c.Check(v2.Index(context.Background(), "", idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, hash, len(data)))
+}
+
+func (s *compressedVolumeSuite) TestIncompressible(c *check.C) {
+	v, stub := s.newStubbedVolume(c)
+	data := make([]byte, 100000)
+	rand.Read(data)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(v.BlockWrite(context.Background(), hash, data), check.IsNil)
+	c.Check(bytes.Equal(stub.data[hash].data, data), check.Equals, true)
+
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), hash, buf), check.IsNil)
+	c.Check(bytes.Equal(buf.Bytes(), data), check.Equals, true)
+}
+
+func (s *compressedVolumeSuite) TestUncompressedBlocks(c *check.C) {
+	v, stub := s.newStubbedVolume(c)
+	// Uncompressed blocks written before compression was
+	// enabled, including one that is itself zstd-compressed data
+	// and one that starts with a compressed block header for a
+	// different hash.
+	var blocks [][]byte
+	blocks = append(blocks, bytes.Repeat([]byte("ACGT"), 1000))
+	blocks = append(blocks, v.encoder.EncodeAll(bytes.Repeat([]byte("ACGT"), 1000), nil))
+	blocks = append(blocks, v.encoder.EncodeAll(bytes.Repeat([]byte("ACGT"), 1000), v.header(TestHash, 4000)))
+	for _, data := range blocks {
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		c.Assert(stub.BlockWrite(context.Background(), hash, data), check.IsNil)
+
+		buf := &brbuffer{}
+		c.Check(v.BlockRead(context.Background(), hash, buf), check.IsNil)
+		c.Check(bytes.Equal(buf.Bytes(), data), check.Equals, true)
+
+		v2 := s.rewrap(c, stub)
+		idx := &bytes.Buffer{}
+		c.Check(v2.Index(context.Background(), hash, idx), check.IsNil)
+		c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, hash, len(data)))
+	}
+}
+
+func (s *compressedVolumeSuite) TestIndexManyBlocks(c *check.C) {
+	v, stub := s.newStubbedVolume(c)
+	for i := 0; i < 2500; i++ {
+		data := []byte(fmt.Sprintf("%0100d", i))
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		c.Assert(v.BlockWrite(context.Background(), hash, data), check.IsNil)
+	}
+	v2 := s.rewrap(c, stub)
+	idx := &bytes.Buffer{}
+	c.Check(v2.Index(context.Background(), "", idx), check.IsNil)
+	c.Check(bytes.Count(idx.Bytes(), []byte("\n")), check.Equals, 2500)
+	c.Check(bytes.Count(idx.Bytes(), []byte("+100 ")), check.Equals, 2500)
+}
+
+func (s *compressedVolumeSuite) TestSizeCacheLimit(c *check.C) {
+	s.params.ConfigVolume.CompressionSizeCache = 100
+	v, _ := s.newStubbedVolume(c)
+	for i := 0; i < 250; i++ {
+		data := bytes.Repeat([]byte(fmt.Sprintf("%04d", i)), 1000)
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		c.Assert(v.BlockWrite(context.Background(), hash, data), check.IsNil)
+	}
+	c.Check(v.sizes.Len(), check.Equals, 100)
+
+	// Sizes that were evicted from the cache are read from the
+	// block headers.
+	idx := &bytes.Buffer{}
+	c.Check(v.Index(context.Background(), "", idx), check.IsNil)
+	c.Check(bytes.Count(idx.Bytes(), []byte("\n")), check.Equals, 250)
+	c.Check(bytes.Count(idx.Bytes(), []byte("+4000 ")), check.Equals, 250)
+	c.Check(v.sizes.Len(), check.Equals, 100)
+}
+
+func (s *compressedVolumeSuite) TestReadTimes(c *check.C) {
+	v := s.newTestableVolume(c, s.params)
+	data := bytes.Repeat([]byte("ACGT"), 100000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(v.BlockWrite(context.Background(), hash, data), check.IsNil)
+	c.Check(supportsReadTimes(v.compressedVolume), check.Equals, true)
+	c.Check(v.BlockMarkRead(hash), check.IsNil)
+	idx := &bytes.Buffer{}
+	c.Check(v.IndexReadTimes(context.Background(), "", idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+ [1-9]\d*\n`, hash, len(data)))
+
+	stubbed, _ := s.newStubbedVolume(c)
+	c.Check(supportsReadTimes(stubbed), check.Equals, false)
+	c.Check(stubbed.BlockMarkRead(hash), check.Equals, errNoReadTimes)
+}
+
+func (s *compressedVolumeSuite) TestSizeHints(c *check.C) {
+	v := s.newTestableVolume(c, s.params)
+	c.Check(supportsSizeHints(v.unixVolume), check.Equals, true)
+	data := bytes.Repeat([]byte("ACGT"), 100000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(v.BlockWrite(context.Background(), hash, data), check.IsNil)
+	if v.unixVolume.getSizeHint(v.unixVolume.blockPath(hash)) < 0 {
+		c.Skip("filesystem does not support extended attributes")
+	}
+	c.Check(v.unixVolume.getSizeHint(v.unixVolume.blockPath(hash)), check.Equals, len(data))
+
+	// A block written before compression was enabled has no
+	// size hint.
+	olddata := bytes.Repeat([]byte("TGCA"), 1000)
+	oldhash := fmt.Sprintf("%x", md5.Sum(olddata))
+	c.Assert(v.unixVolume.BlockWrite(context.Background(), oldhash, olddata), check.IsNil)
+
+	// A new wrapper has no cached sizes, but only needs to read
+	// the header of the block without a size hint. (Each index
+	// also opens the volume's root directory.)
+	v2 := s.rewrap(c, v.unixVolume)
+	opens := v.unixVolume.os.stats.OpenOps
+	idx := &bytes.Buffer{}
+	c.Check(v2.Index(context.Background(), hash, idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, hash, len(data)))
+	c.Check(v.unixVolume.os.stats.OpenOps, check.Equals, opens+1)
+
+	idx.Reset()
+	c.Check(v2.Index(context.Background(), oldhash, idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, oldhash, len(olddata)))
+	c.Check(v.unixVolume.os.stats.OpenOps, check.Equals, opens+3)
+
+	c.Check(v2.BlockMarkRead(hash), check.IsNil)
+	opens = v.unixVolume.os.stats.OpenOps
+	idx.Reset()
+	c.Check(s.rewrap(c, v.unixVolume).IndexReadTimes(context.Background(), hash, idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+ [1-9]\d*\n`, hash, len(data)))
+	c.Check(v.unixVolume.os.stats.OpenOps, check.Equals, opens+1)
+
+	// Rewriting, trashing, and untrashing the block keep the
+	// size hint.
+	c.Assert(v.unixVolume.BlockRewrite(context.Background(), hash, v.encoder.EncodeAll(data, v.header(hash, len(data)))), check.IsNil)
+	s.params.Cluster.Collections.BlobSigningTTL = 0
+	s.params.Cluster.Collections.BlobTrashLifetime = arvados.Duration(time.Hour)
+	c.Assert(v.unixVolume.BlockTrash(hash), check.IsNil)
+	c.Assert(v.unixVolume.BlockUntrash(hash), check.IsNil)
+	c.Check(v.unixVolume.getSizeHint(v.unixVolume.blockPath(hash)), check.Equals, len(data))
+
+	stubbed, _ := s.newStubbedVolume(c)
+	c.Check(supportsSizeHints(stubbed.volume), check.Equals, false)
+}
+
+func (s *compressedVolumeSuite) TestSetupMounts(c *check.C) {
+	cluster := testCluster(c)
+	cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Driver: "stub", Replication: 1, Compression: "zstd"},
+	}
+	ks, cancel := testKeepstore(c, cluster, nil)
+	defer cancel()
+	c.Assert(ks.mountsW, check.HasLen, 1)
+	c.Check(ks.mountsW[0].volume, check.FitsTypeOf, &compressedVolume{})
+}
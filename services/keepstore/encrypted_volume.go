@@ -0,0 +1,393 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/sirupsen/logrus"
+)
+
+// Encrypted blocks are stored as a header -- "ARVE", the key ID
+// (zero-padded to 16 bytes), and a 12-byte nonce -- followed by the
+// AES-256-GCM ciphertext and tag. The block hash and the key ID are
+// authenticated along with the ciphertext, so stored data cannot be
+// substituted for a different block or relabeled with a different
+// key ID.
+const (
+	encryptedMagic      = "ARVE"
+	encryptedKeyIDSize  = 16
+	encryptedHeaderSize = len(encryptedMagic) + encryptedKeyIDSize + 12
+	encryptedOverhead   = encryptedHeaderSize + 16
+
+	// Number of blocks to re-encrypt concurrently after a key
+	// rotation.
+	reencryptConcurrency = 4
+)
+
+// encryptedVolume wraps another volume, encrypting blocks in
+// BlockWrite and decrypting them in BlockRead.
+type encryptedVolume struct {
+	volume
+	arvados.VolumeEncryption
+	aeads  map[string]cipher.AEAD
+	logger logrus.FieldLogger
+}
+
+func newEncryptedVolume(vol volume, params newVolumeParams) (volume, error) {
+	v := &encryptedVolume{
+		volume:           vol,
+		VolumeEncryption: params.ConfigVolume.Encryption,
+		aeads:            map[string]cipher.AEAD{},
+		logger:           params.Logger.WithField("Volume", vol.DeviceID()),
+	}
+	for id, key := range v.Keys {
+		if id == "" || len(id) > encryptedKeyIDSize || strings.ContainsRune(id, 0) {
+			return nil, fmt.Errorf("Encryption.Keys: invalid key ID %q (must be 1 to %d characters)", id, encryptedKeyIDSize)
+		}
+		buf, err := hex.DecodeString(key)
+		if err != nil || len(buf) != 32 {
+			return nil, fmt.Errorf("Encryption.Keys[%q]: key must be 64 hex digits", id)
+		}
+		block, err := aes.NewCipher(buf)
+		if err != nil {
+			return nil, fmt.Errorf("Encryption.Keys[%q]: %w", id, err)
+		}
+		v.aeads[id], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("Encryption.Keys[%q]: %w", id, err)
+		}
+	}
+	if v.aeads[v.KeyID] == nil {
+		return nil, fmt.Errorf("Encryption.KeyID %q does not match any entry in Encryption.Keys", v.KeyID)
+	}
+	return v, nil
+}
+
+// Replication returns the effective replication level of the
+// wrapped volume, or 0 if the wrapped volume does not report one.
+func (v *encryptedVolume) Replication() int {
+	if rv, ok := v.volume.(interface{ Replication() int }); ok {
+		return rv.Replication()
+	}
+	return 0
+}
+
+// keyID returns the key ID from the given header, and false if the
+// header is not valid.
+func (v *encryptedVolume) keyID(hdr []byte) (string, bool) {
+	if len(hdr) < encryptedHeaderSize || string(hdr[:len(encryptedMagic)]) != encryptedMagic {
+		return "", false
+	}
+	return strings.TrimRight(string(hdr[len(encryptedMagic):len(encryptedMagic)+encryptedKeyIDSize]), "\x00"), true
+}
+
+func (v *encryptedVolume) additionalData(hash string, hdr []byte) []byte {
+	return append([]byte(hash), hdr[:len(encryptedMagic)+encryptedKeyIDSize]...)
+}
+
+// BlockWrite encrypts the block with the current key and writes it
+// to the wrapped volume.
+func (v *encryptedVolume) BlockWrite(ctx context.Context, hash string, data []byte) error {
+	buf, err := v.encrypt(hash, data)
+	if err != nil {
+		return err
+	}
+	return v.volume.BlockWrite(ctx, hash, buf)
+}
+
+// encrypt returns the header and ciphertext to store for the given
+// block, using the current key.
+func (v *encryptedVolume) encrypt(hash string, data []byte) ([]byte, error) {
+	aead := v.aeads[v.KeyID]
+	buf := make([]byte, encryptedHeaderSize, encryptedOverhead+len(data))
+	copy(buf, encryptedMagic)
+	copy(buf[len(encryptedMagic):], v.KeyID)
+	nonce := buf[len(encryptedMagic)+encryptedKeyIDSize:]
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(buf, nonce, data, v.additionalData(hash, buf)), nil
+}
+
+// BlockRead reads the stored block from the wrapped volume and
+// decrypts it.
+//
+// If AllowPlaintext is enabled, a stored block that cannot be
+// decrypted is returned as-is, provided its MD5 hash matches. This
+// allows encryption to be enabled on a volume that already has
+// unencrypted blocks.
+func (v *encryptedVolume) BlockRead(ctx context.Context, hash string, w io.WriterAt) error {
+	buf := &memWriterAt{}
+	err := v.volume.BlockRead(ctx, hash, buf)
+	if err != nil {
+		return err
+	}
+	data, err := v.decrypt(hash, buf.buf)
+	if err != nil && v.AllowPlaintext && fmt.Sprintf("%x", md5.Sum(buf.buf)) == hash {
+		data, err = buf.buf, nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	_, err = w.WriteAt(data, 0)
+	return err
+}
+
+// decrypt returns the decrypted data from the given stored block.
+func (v *encryptedVolume) decrypt(hash string, stored []byte) ([]byte, error) {
+	keyID, ok := v.keyID(stored)
+	if !ok || len(stored) < encryptedOverhead {
+		return nil, fmt.Errorf("block %s is not encrypted (see Encryption.AllowPlaintext)", hash)
+	}
+	aead := v.aeads[keyID]
+	if aead == nil {
+		return nil, fmt.Errorf("block %s is encrypted with unknown key ID %q", hash, keyID)
+	}
+	hdr := stored[:encryptedHeaderSize]
+	data, err := aead.Open(nil, hdr[len(encryptedMagic)+encryptedKeyIDSize:], stored[encryptedHeaderSize:], v.additionalData(hash, hdr))
+	if err != nil {
+		v.logger.WithError(err).Warnf("BlockRead(%s): decryption failed", hash)
+		return nil, errChecksum
+	}
+	return data, nil
+}
+
+// isEncrypted returns true if the given stored block starts with an
+// encryption header.
+func (v *encryptedVolume) isEncrypted(ctx context.Context, hash string) (bool, error) {
+	hw := newHeaderWriter(encryptedHeaderSize)
+	err := v.volume.BlockRead(ctx, hash, hw)
+	if err != nil && !errors.Is(err, errHeaderRead) {
+		return false, err
+	}
+	_, ok := v.keyID(hw.buf)
+	return ok, nil
+}
+
+// Index writes the wrapped volume's index, replacing stored sizes
+// with decrypted sizes.
+//
+// If AllowPlaintext is enabled, Index reads the header of each block
+// to find out whether it is encrypted.
+func (v *encryptedVolume) Index(ctx context.Context, prefix string, writeTo io.Writer) error {
+	return v.index(ctx, prefix, writeTo, v.volume.Index)
+}
+
+// BlockMarkRead records the read time on the wrapped volume.
+func (v *encryptedVolume) BlockMarkRead(hash string) error {
+	rv, ok := v.volume.(readTimeVolume)
+	if !ok {
+		return errNoReadTimes
+	}
+	return rv.BlockMarkRead(hash)
+}
+
+// IndexReadTimes writes the wrapped volume's read time index,
+// replacing stored sizes with decrypted sizes.
+func (v *encryptedVolume) IndexReadTimes(ctx context.Context, prefix string, writeTo io.Writer) error {
+	rv, ok := v.volume.(readTimeVolume)
+	if !ok {
+		return errNoReadTimes
+	}
+	return v.index(ctx, prefix, writeTo, rv.IndexReadTimes)
+}
+
+// BlockWriteSizeHint encrypts the block with the current key and
+// writes it to the wrapped volume along with the given size hint.
+func (v *encryptedVolume) BlockWriteSizeHint(ctx context.Context, hash string, data []byte, sizeHint int) error {
+	hv, ok := v.volume.(sizeHintVolume)
+	if !ok {
+		return errNoSizeHints
+	}
+	buf, err := v.encrypt(hash, data)
+	if err != nil {
+		return err
+	}
+	return hv.BlockWriteSizeHint(ctx, hash, buf, sizeHint)
+}
+
+// IndexSizeHints writes the wrapped volume's size hint index,
+// replacing stored sizes with decrypted sizes.
+func (v *encryptedVolume) IndexSizeHints(ctx context.Context, prefix string, readTimes bool, writeTo io.Writer) error {
+	hv, ok := v.volume.(sizeHintVolume)
+	if !ok {
+		return errNoSizeHints
+	}
+	return v.index(ctx, prefix, writeTo, func(ctx context.Context, prefix string, w io.Writer) error {
+		return hv.IndexSizeHints(ctx, prefix, readTimes, w)
+	})
+}
+
+func (v *encryptedVolume) index(ctx context.Context, prefix string, writeTo io.Writer, index func(context.Context, string, io.Writer) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(index(ctx, prefix, pw))
+	}()
+	defer pr.Close()
+	scanner := bufio.NewScanner(pr)
+	for scanner.Scan() {
+		locator, mtime, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		hash, sizestr, ok := strings.Cut(locator, "+")
+		if !ok || !keepBlockRegexp.MatchString(hash) {
+			continue
+		}
+		size, err := strconv.Atoi(sizestr)
+		if err != nil {
+			continue
+		}
+		if v.AllowPlaintext {
+			if size >= encryptedOverhead {
+				encrypted, err := v.isEncrypted(ctx, hash)
+				if os.IsNotExist(err) {
+					// Deleted since the index was
+					// generated.
+					continue
+				} else if err != nil {
+					return err
+				} else if encrypted {
+					size -= encryptedOverhead
+				}
+			}
+		} else if size < encryptedOverhead {
+			v.logger.Warnf("Index: block %s is too small (%d bytes) to be an encrypted block, omitting from index", hash, size)
+			continue
+		} else {
+			size -= encryptedOverhead
+		}
+		_, err = fmt.Fprintf(writeTo, "%s+%d %s\n", hash, size, mtime)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// reencrypt re-encrypts, with the current key, all blocks that were
+// encrypted with other keys (or not encrypted, if AllowPlaintext is
+// enabled). It returns true if it checked every block and found none
+// that needed to be re-encrypted, in which case there is no need to
+// call it again until the configuration changes.
+func (v *encryptedVolume) reencrypt(ctx context.Context) bool {
+	if len(v.aeads) < 2 && !v.AllowPlaintext {
+		// Nothing can be encrypted with a different key.
+		return true
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(v.volume.Index(ctx, "", pw))
+	}()
+	defer pr.Close()
+
+	var done, failed atomic.Int64
+	todo := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < reencryptConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for hash := range todo {
+				ok, err := v.reencryptBlock(ctx, hash)
+				if err != nil && !os.IsNotExist(err) {
+					v.logger.WithError(err).Warnf("reencrypt: error re-encrypting block %s", hash)
+					failed.Add(1)
+				} else if ok {
+					done.Add(1)
+				}
+			}
+		}()
+	}
+	scanner := bufio.NewScanner(pr)
+	for scanner.Scan() && ctx.Err() == nil {
+		hash, _, _ := strings.Cut(scanner.Text(), "+")
+		if keepBlockRegexp.MatchString(hash) {
+			todo <- hash
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if err := scanner.Err(); err != nil {
+		v.logger.WithError(err).Warn("reencrypt: error getting index")
+		return false
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	if failed.Load() > 0 {
+		v.logger.Warnf("reencrypt: re-encrypted %d blocks with key %q, %d blocks failed", done.Load(), v.KeyID, failed.Load())
+		return false
+	} else if done.Load() > 0 {
+		v.logger.Infof("reencrypt: re-encrypted %d blocks with key %q, no blocks remain encrypted with other keys", done.Load(), v.KeyID)
+		return false
+	}
+	if v.AllowPlaintext {
+		v.logger.Infof("reencrypt: no blocks are unencrypted or encrypted with keys other than %q, not checking again until keepstore restarts (Encryption.AllowPlaintext can now be disabled)", v.KeyID)
+	} else {
+		v.logger.Infof("reencrypt: no blocks are encrypted with keys other than %q, not checking again until keepstore restarts", v.KeyID)
+	}
+	return true
+}
+
+// reencryptBlock re-encrypts the given block with the current key if
+// it was encrypted with a different key (or not encrypted, if
+// AllowPlaintext is enabled). It returns true if the block was
+// re-encrypted.
+func (v *encryptedVolume) reencryptBlock(ctx context.Context, hash string) (bool, error) {
+	hw := newHeaderWriter(encryptedHeaderSize)
+	err := v.volume.BlockRead(ctx, hash, hw)
+	if err != nil && !errors.Is(err, errHeaderRead) {
+		return false, err
+	}
+	if keyID, ok := v.keyID(hw.buf); !ok && !v.AllowPlaintext {
+		return false, fmt.Errorf("block %s is not encrypted", hash)
+	} else if ok && keyID == v.KeyID {
+		return false, nil
+	}
+	buf := &memWriterAt{}
+	err = v.BlockRead(ctx, hash, buf)
+	if err != nil {
+		return false, err
+	}
+	data, err := v.encrypt(hash, buf.buf)
+	if err != nil {
+		return false, err
+	}
+	// Keep the block's timestamp unchanged if possible, so
+	// re-encrypting doesn't delay garbage collection or make old
+	// blocks look recently written. If the block is trashed after
+	// we read it, writing it here may effectively untrash it.
+	// That is harmless: keep-balance will trash it again later.
+	if rw, ok := v.volume.(blockRewriter); ok {
+		err = rw.BlockRewrite(ctx, hash, data)
+	} else {
+		err = v.volume.BlockWrite(ctx, hash, data)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
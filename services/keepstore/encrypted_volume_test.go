@@ -0,0 +1,340 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+const (
+	testEncryptionKey1 = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testEncryptionKey2 = "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff000102030405060708090a0b0c0d0e0f"
+)
+
+// testableEncryptedVolume wraps a Directory volume.
+type testableEncryptedVolume struct {
+	*encryptedVolume
+	unixVolume *unixVolume
+}
+
+func (s *encryptedVolumeSuite) newTestableVolume(c *check.C, params newVolumeParams) *testableEncryptedVolume {
+	params.ConfigVolume.Encryption = arvados.VolumeEncryption{
+		KeyID: "key1",
+		Keys:  map[string]string{"key1": testEncryptionKey1},
+	}
+	params.ConfigVolume.DriverParameters = json.RawMessage(fmt.Sprintf(`{"Root": %q}`, c.MkDir()))
+	params.EncodedData = true
+	uv, err := newUnixVolume(params)
+	c.Assert(err, check.IsNil)
+	v, err := newEncryptedVolume(uv, params)
+	c.Assert(err, check.IsNil)
+	return &testableEncryptedVolume{
+		encryptedVolume: v.(*encryptedVolume),
+		unixVolume:      uv.(*unixVolume),
+	}
+}
+
+func (v *testableEncryptedVolume) TouchWithDate(hash string, t time.Time) {
+	syscall.Utime(v.unixVolume.blockPath(hash), &syscall.Utimbuf{Actime: t.Unix(), Modtime: t.Unix()})
+}
+
+func (v *testableEncryptedVolume) Teardown() {
+}
+
+func (v *testableEncryptedVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return "open", "create"
+}
+
+// newStubbedVolume returns an encryptedVolume that wraps the given
+// stub volume (or a new stub volume, if nil), so tests can inspect
+// the stored data.
+func (s *encryptedVolumeSuite) newStubbedVolume(c *check.C, stub *stubVolume, enc arvados.VolumeEncryption) (*encryptedVolume, *stubVolume) {
+	params := s.params
+	params.ConfigVolume.Encryption = enc
+	if stub == nil {
+		vol, err := driver["stub"](params)
+		c.Assert(err, check.IsNil)
+		stub = vol.(*stubVolume)
+	}
+	v, err := newEncryptedVolume(stub, params)
+	c.Assert(err, check.IsNil)
+	return v.(*encryptedVolume), stub
+}
+
+var _ = check.Suite(&encryptedVolumeSuite{})
+
+type encryptedVolumeSuite struct {
+	params newVolumeParams
+}
+
+func (s *encryptedVolumeSuite) SetUpTest(c *check.C) {
+	logger := ctxlog.TestLogger(c)
+	reg := prometheus.NewRegistry()
+	s.params = newVolumeParams{
+		UUID:        "zzzzz-nyw5e-999999999999999",
+		Cluster:     testCluster(c),
+		Logger:      logger,
+		MetricsVecs: newVolumeMetricsVecs(reg),
+		BufferPool:  newBufferPool(logger, 8, reg),
+	}
+}
+
+func (s *encryptedVolumeSuite) TestGeneric(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableVolume(c, params)
+	})
+}
+
+func (s *encryptedVolumeSuite) TestGenericReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableVolume(c, params)
+	})
+}
+
+func (s *encryptedVolumeSuite) TestConfig(c *check.C) {
+	for _, trial := range []struct {
+		enc arvados.VolumeEncryption
+		err string
+	}{
+		{arvados.VolumeEncryption{Keys: map[string]string{"key1": testEncryptionKey1}}, `Encryption.KeyID "" does not match.*`},
+		{arvados.VolumeEncryption{KeyID: "key2", Keys: map[string]string{"key1": testEncryptionKey1}}, `Encryption.KeyID "key2" does not match.*`},
+		{arvados.VolumeEncryption{KeyID: "key1", Keys: map[string]string{"key1": "abcdef"}}, `Encryption.Keys\["key1"\]: key must be 64 hex digits`},
+		{arvados.VolumeEncryption{KeyID: "key1", Keys: map[string]string{"key1": strings.Repeat("z", 64)}}, `Encryption.Keys\["key1"\]: key must be 64 hex digits`},
+		{arvados.VolumeEncryption{KeyID: "key1", Keys: map[string]string{"key1": testEncryptionKey1, "a-very-long-key-id": testEncryptionKey2}}, `Encryption.Keys: invalid key ID.*`},
+		{arvados.VolumeEncryption{KeyID: "key1", Keys: map[string]string{"key1": testEncryptionKey1, "key2": testEncryptionKey2}}, ``},
+	} {
+		params := s.params
+		params.ConfigVolume.Encryption = trial.enc
+		_, err := newEncryptedVolume(&stubVolume{}, params)
+		if trial.err == "" {
+			c.Check(err, check.IsNil)
+		} else {
+			c.Check(err, check.ErrorMatches, trial.err)
+		}
+	}
+}
+
+func (s *encryptedVolumeSuite) TestStoredData(c *check.C) {
+	v, stub := s.newStubbedVolume(c, nil, arvados.VolumeEncryption{
+		KeyID: "key1",
+		Keys:  map[string]string{"key1": testEncryptionKey1},
+	})
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	stored := stub.data[TestHash].data
+	c.Check(stored, check.HasLen, len(TestBlock)+encryptedOverhead)
+	c.Check(string(stored[:8]), check.Equals, "ARVEkey1")
+	c.Check(bytes.Contains(stored, TestBlock), check.Equals, false)
+
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(TestBlock))
+
+	idx := &bytes.Buffer{}
+	c.Check(v.Index(context.Background(), "", idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, TestHash, len(TestBlock)))
+}
+
+func (s *encryptedVolumeSuite) TestTamper(c *check.C) {
+	v, stub := s.newStubbedVolume(c, nil, arvados.VolumeEncryption{
+		KeyID: "key1",
+		Keys:  map[string]string{"key1": testEncryptionKey1},
+	})
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	c.Assert(v.BlockWrite(context.Background(), TestHash2, TestBlock2), check.IsNil)
+
+	// Stored data for one block is moved to a different block
+	stub.data[TestHash2] = stub.data[TestHash]
+	err := v.BlockRead(context.Background(), TestHash2, brdiscard)
+	c.Check(err, check.Equals, errChecksum)
+
+	// Stored data is modified
+	ent := stub.data[TestHash]
+	ent.data[encryptedHeaderSize+1] ^= 1
+	err = v.BlockRead(context.Background(), TestHash, brdiscard)
+	c.Check(err, check.Equals, errChecksum)
+
+	// Stored data is not encrypted at all
+	stub.data[TestHash3] = stubData{data: TestBlock3, mtime: time.Now()}
+	err = v.BlockRead(context.Background(), TestHash3, brdiscard)
+	c.Check(err, check.ErrorMatches, `block .* is not encrypted .*`)
+}
+
+func (s *encryptedVolumeSuite) TestAllowPlaintext(c *check.C) {
+	v, stub := s.newStubbedVolume(c, nil, arvados.VolumeEncryption{
+		KeyID:          "key1",
+		Keys:           map[string]string{"key1": testEncryptionKey1},
+		AllowPlaintext: true,
+	})
+	old := time.Now().Add(-time.Hour).Round(0)
+	// Unencrypted blocks written before encryption was enabled,
+	// including one that is smaller than the encryption overhead
+	// and one that is larger.
+	bigBlock := bytes.Repeat([]byte("x"), encryptedOverhead*2)
+	bigHash := fmt.Sprintf("%x", md5.Sum(bigBlock))
+	stub.data[TestHash] = stubData{data: TestBlock, mtime: old}
+	stub.data[bigHash] = stubData{data: bigBlock, mtime: old}
+	c.Assert(v.BlockWrite(context.Background(), TestHash2, TestBlock2), check.IsNil)
+
+	for hash, data := range map[string][]byte{TestHash: TestBlock, bigHash: bigBlock, TestHash2: TestBlock2} {
+		buf := &brbuffer{}
+		c.Check(v.BlockRead(context.Background(), hash, buf), check.IsNil)
+		c.Check(buf.String(), check.Equals, string(data))
+	}
+	idx := &bytes.Buffer{}
+	c.Check(v.Index(context.Background(), "", idx), check.IsNil)
+	c.Check(strings.Contains(idx.String(), fmt.Sprintf("%s+%d ", TestHash, len(TestBlock))), check.Equals, true)
+	c.Check(strings.Contains(idx.String(), fmt.Sprintf("%s+%d ", bigHash, len(bigBlock))), check.Equals, true)
+	c.Check(strings.Contains(idx.String(), fmt.Sprintf("%s+%d ", TestHash2, len(TestBlock2))), check.Equals, true)
+
+	// Unencrypted data that doesn't match the block hash is
+	// rejected.
+	stub.data[TestHash3] = stubData{data: TestBlock, mtime: old}
+	c.Check(v.BlockRead(context.Background(), TestHash3, brdiscard), check.NotNil)
+	delete(stub.data, TestHash3)
+
+	// Unencrypted blocks are encrypted in the background, keeping
+	// their timestamps.
+	c.Check(v.reencrypt(context.Background()), check.Equals, false)
+	for _, hash := range []string{TestHash, bigHash} {
+		c.Check(string(stub.data[hash].data[:8]), check.Equals, "ARVEkey1")
+		c.Check(stub.data[hash].mtime.Equal(old), check.Equals, true)
+	}
+	c.Check(v.reencrypt(context.Background()), check.Equals, true)
+
+	// Without AllowPlaintext, unencrypted blocks are not readable.
+	v, _ = s.newStubbedVolume(c, stub, arvados.VolumeEncryption{
+		KeyID: "key1",
+		Keys:  map[string]string{"key1": testEncryptionKey1},
+	})
+	stub.data[TestHash3] = stubData{data: TestBlock3, mtime: old}
+	c.Check(v.BlockRead(context.Background(), TestHash3, brdiscard), check.ErrorMatches, `block .* is not encrypted .*`)
+}
+
+func (s *encryptedVolumeSuite) TestKeyRotation(c *check.C) {
+	v1, stub := s.newStubbedVolume(c, nil, arvados.VolumeEncryption{
+		KeyID: "key1",
+		Keys:  map[string]string{"key1": testEncryptionKey1},
+	})
+	var hashes []string
+	for i := 0; i < 20; i++ {
+		data := []byte(fmt.Sprintf("block %d", i))
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		hashes = append(hashes, hash)
+		c.Assert(v1.BlockWrite(context.Background(), hash, data), check.IsNil)
+	}
+
+	// Add key2 and make it current. Blocks encrypted with key1
+	// are still readable.
+	v2, _ := s.newStubbedVolume(c, stub, arvados.VolumeEncryption{
+		KeyID: "key2",
+		Keys:  map[string]string{"key1": testEncryptionKey1, "key2": testEncryptionKey2},
+	})
+	c.Check(v2.BlockRead(context.Background(), hashes[0], brdiscard), check.IsNil)
+	c.Assert(v2.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	c.Check(string(stub.data[TestHash].data[:8]), check.Equals, "ARVEkey2")
+
+	// Re-encrypt everything with key2. Timestamps are not
+	// changed.
+	old := time.Now().Add(-time.Hour).Round(0)
+	for _, hash := range hashes {
+		c.Assert(stub.blockTouchWithTime(hash, old), check.IsNil)
+	}
+	c.Check(v2.reencrypt(context.Background()), check.Equals, false)
+	for _, hash := range hashes {
+		c.Check(string(stub.data[hash].data[:8]), check.Equals, "ARVEkey2")
+		c.Check(stub.data[hash].mtime.Equal(old), check.Equals, true)
+	}
+
+	// Another pass finds nothing to re-encrypt, and reports that
+	// it doesn't need to be called again.
+	c.Check(v2.reencrypt(context.Background()), check.Equals, true)
+
+	// Remove key1. All blocks are still readable.
+	v3, _ := s.newStubbedVolume(c, stub, arvados.VolumeEncryption{
+		KeyID: "key2",
+		Keys:  map[string]string{"key2": testEncryptionKey2},
+	})
+	for i, hash := range hashes {
+		buf := &brbuffer{}
+		c.Check(v3.BlockRead(context.Background(), hash, buf), check.IsNil)
+		c.Check(buf.String(), check.Equals, fmt.Sprintf("block %d", i))
+	}
+
+	// Blocks encrypted with a key that is no longer configured
+	// are not readable.
+	v4, _ := s.newStubbedVolume(c, stub, arvados.VolumeEncryption{
+		KeyID: "key1",
+		Keys:  map[string]string{"key1": testEncryptionKey1},
+	})
+	err := v4.BlockRead(context.Background(), hashes[0], brdiscard)
+	c.Check(err, check.ErrorMatches, `block .* is encrypted with unknown key ID "key2"`)
+}
+
+func (s *encryptedVolumeSuite) TestCompressed(c *check.C) {
+	enc, stub := s.newStubbedVolume(c, nil, arvados.VolumeEncryption{
+		KeyID: "key1",
+		Keys:  map[string]string{"key1": testEncryptionKey1},
+	})
+	params := s.params
+	params.ConfigVolume.Compression = "zstd"
+	v, err := newCompressedVolume(enc, params)
+	c.Assert(err, check.IsNil)
+
+	data := bytes.Repeat([]byte("ACGT"), 100000)
+	hash := fmt.Sprintf("%x", md5.Sum(data))
+	c.Assert(v.BlockWrite(context.Background(), hash, data), check.IsNil)
+	c.Check(len(stub.data[hash].data) < len(data)/10, check.Equals, true)
+
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), hash, buf), check.IsNil)
+	c.Check(bytes.Equal(buf.Bytes(), data), check.Equals, true)
+
+	v, err = newCompressedVolume(enc, params)
+	c.Assert(err, check.IsNil)
+	idx := &bytes.Buffer{}
+	c.Check(v.Index(context.Background(), "", idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, hash, len(data)))
+}
+
+func (s *encryptedVolumeSuite) TestSetupMounts(c *check.C) {
+	cluster := testCluster(c)
+	cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {
+			Driver:      "stub",
+			Replication: 1,
+			Encryption: arvados.VolumeEncryption{
+				KeyID: "key1",
+				Keys:  map[string]string{"key1": testEncryptionKey1},
+			},
+		},
+		"zzzzz-nyw5e-111111111111111": {
+			Driver:      "stub",
+			Replication: 1,
+			Compression: "zstd",
+			Encryption: arvados.VolumeEncryption{
+				KeyID: "key1",
+				Keys:  map[string]string{"key1": testEncryptionKey1},
+			},
+		},
+	}
+	ks, cancel := testKeepstore(c, cluster, nil)
+	defer cancel()
+	c.Assert(ks.mountsW, check.HasLen, 2)
+	c.Check(ks.mountsW[0].volume, check.FitsTypeOf, &encryptedVolume{})
+	c.Check(ks.mountsW[1].volume, check.FitsTypeOf, &compressedVolume{})
+	c.Check(ks.mountsW[1].volume.(*compressedVolume).volume, check.FitsTypeOf, &encryptedVolume{})
+}
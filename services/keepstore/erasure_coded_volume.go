@@ -0,0 +1,689 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/klauspost/reedsolomon"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	driver["ErasureCoded"] = newErasureCodedVolume
+}
+
+// Size of the trailer appended to each parity shard, which holds the
+// size of the original block.
+const ecTrailerSize = 8
+
+// erasureCodedVolume stores each block as DataShards+ParityShards
+// Reed-Solomon shards, one on each of the underlying shard volumes,
+// under the same name as the original block.
+//
+// The block data is split into DataShards pieces of equal length L
+// (except that the last non-empty piece may be shorter, and any
+// following pieces are empty), which are stored as-is so the block
+// size can be computed from the shard sizes reported by the
+// underlying volumes' indexes. Each parity shard is L bytes of parity
+// data, computed as if the data shards were zero-padded to L bytes,
+// followed by an 8-byte trailer holding the block size.
+//
+// Any DataShards of the shards are sufficient to reconstruct the
+// block, so the volume tolerates the loss of up to ParityShards
+// underlying volumes.
+type erasureCodedVolume struct {
+	arvados.ErasureCodedVolumeDriverParameters
+
+	cluster  *arvados.Cluster
+	logger   logrus.FieldLogger
+	readonly bool
+	shards   []volume
+	enc      reedsolomon.Encoder
+	stats    erasureCodedStats
+}
+
+func newErasureCodedVolume(params newVolumeParams) (volume, error) {
+	v := &erasureCodedVolume{
+		cluster:  params.Cluster,
+		readonly: params.ConfigVolume.ReadOnly,
+	}
+	err := json.Unmarshal(params.ConfigVolume.DriverParameters, v)
+	if err != nil {
+		return nil, err
+	}
+	if v.DataShards < 1 || v.ParityShards < 1 {
+		return nil, errors.New("DriverParameters: DataShards and ParityShards must be at least 1")
+	}
+	if v.DataShards+v.ParityShards > 256 {
+		return nil, errors.New("DriverParameters: DataShards+ParityShards must not exceed 256")
+	}
+	if len(v.ShardVolumes) != v.DataShards+v.ParityShards {
+		return nil, fmt.Errorf("DriverParameters: ShardVolumes must have exactly DataShards+ParityShards (%d) entries, not %d", v.DataShards+v.ParityShards, len(v.ShardVolumes))
+	}
+	v.enc, err = reedsolomon.New(v.DataShards, v.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	for i, cfg := range v.ShardVolumes {
+		if cfg.Driver == "ErasureCoded" {
+			return nil, fmt.Errorf("DriverParameters: ShardVolumes[%d]: nested ErasureCoded volumes are not supported", i)
+		}
+		dri, ok := driver[cfg.Driver]
+		if !ok {
+			return nil, fmt.Errorf("DriverParameters: ShardVolumes[%d]: invalid driver %q", i, cfg.Driver)
+		}
+		vol, err := dri(newVolumeParams{
+			UUID:    params.UUID,
+			Cluster: params.Cluster,
+			ConfigVolume: arvados.Volume{
+				ReadOnly:               params.ConfigVolume.ReadOnly,
+				AllowTrashWhenReadOnly: params.ConfigVolume.AllowTrashWhenReadOnly,
+				Replication:            1,
+				Driver:                 cfg.Driver,
+				DriverParameters:       cfg.DriverParameters,
+			},
+			Logger:      params.Logger.WithField("Shard", i),
+			MetricsVecs: params.MetricsVecs,
+			BufferPool:  params.BufferPool,
+			EncodedData: true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("DriverParameters: ShardVolumes[%d]: %w", i, err)
+		}
+		v.shards = append(v.shards, vol)
+	}
+	v.logger = params.Logger.WithField("Volume", v.DeviceID())
+	lbls := prometheus.Labels{"device_id": v.DeviceID()}
+	v.stats.opsCounters, v.stats.errCounters, v.stats.ioBytes = params.MetricsVecs.getCounterVecsFor(lbls)
+	return v, nil
+}
+
+// DeviceID returns an ID composed of the shard layout and the
+// underlying volumes' device IDs.
+func (v *erasureCodedVolume) DeviceID() string {
+	ids := make([]string, len(v.shards))
+	for i, vol := range v.shards {
+		ids[i] = vol.DeviceID()
+	}
+	return fmt.Sprintf("erasurecoded://%d+%d/%s", v.DataShards, v.ParityShards, strings.Join(ids, ","))
+}
+
+// Replication returns the effective replication level, i.e., the
+// number of full copies that would tolerate the same number of
+// device failures.
+func (v *erasureCodedVolume) Replication() int {
+	return v.ParityShards + 1
+}
+
+// shardLen returns the length of each (padded) data shard for a
+// block of the given size.
+func (v *erasureCodedVolume) shardLen(size int) int {
+	return (size + v.DataShards - 1) / v.DataShards
+}
+
+// dataShardLen returns the stored (unpadded) length of data shard i
+// for a block of the given size.
+func (v *erasureCodedVolume) dataShardLen(i, size int) int {
+	l := v.shardLen(size)
+	return max(0, min(l, size-i*l))
+}
+
+// encode splits data into shards, and computes parity shards.
+func (v *erasureCodedVolume) encode(data []byte) ([][]byte, error) {
+	l := v.shardLen(len(data))
+	shards := make([][]byte, len(v.shards))
+	padded := make([][]byte, len(v.shards))
+	for i := 0; i < v.DataShards; i++ {
+		start := min(i*l, len(data))
+		shards[i] = data[start : start+v.dataShardLen(i, len(data))]
+		if len(shards[i]) == l {
+			padded[i] = shards[i]
+		} else {
+			padded[i] = make([]byte, l)
+			copy(padded[i], shards[i])
+		}
+	}
+	for i := v.DataShards; i < len(v.shards); i++ {
+		shards[i] = make([]byte, l+ecTrailerSize)
+		padded[i] = shards[i][:l]
+		binary.BigEndian.PutUint64(shards[i][l:], uint64(len(data)))
+	}
+	if l > 0 {
+		err := v.enc.Encode(padded)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return shards, nil
+}
+
+// eachShard calls f concurrently for the specified shard volumes (or
+// all shard volumes, if idxs is nil), and returns a slice of errors,
+// one for each shard volume. The error is nil for shard volumes that
+// succeeded or were not specified.
+func (v *erasureCodedVolume) eachShard(idxs []int, f func(i int, vol volume) error) []error {
+	if idxs == nil {
+		for i := range v.shards {
+			idxs = append(idxs, i)
+		}
+	}
+	errs := make([]error, len(v.shards))
+	var wg sync.WaitGroup
+	for _, i := range idxs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = f(i, v.shards[i])
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// combineErrors returns nil if at least need of the given errors are
+// nil. Otherwise it returns the first error other than
+// os.ErrNotExist, or os.ErrNotExist if there are no other errors.
+func combineErrors(errs []error, need int) error {
+	ok := 0
+	var errToCaller error = os.ErrNotExist
+	for _, err := range errs {
+		if err == nil {
+			ok++
+		} else if !os.IsNotExist(err) && os.IsNotExist(errToCaller) {
+			errToCaller = err
+		}
+	}
+	if ok >= need {
+		return nil
+	}
+	return errToCaller
+}
+
+// BlockRead reads the data shards, and (if any data shards are
+// missing) the parity shards, reconstructing the block if necessary.
+//
+// When scrubbing (see bypassCache), it also reads the parity shards
+// even if all data shards are present, so missing parity shards are
+// found.
+//
+// After reconstructing a block, BlockRead rewrites any shards that
+// were missing or had the wrong size, so the block can tolerate the
+// loss of ParityShards more shard volumes again.
+func (v *erasureCodedVolume) BlockRead(ctx context.Context, hash string, w io.WriterAt) error {
+	v.stats.TickOps("get")
+	v.stats.Tick(&v.stats.Ops, &v.stats.GetOps)
+	err := v.blockRead(ctx, hash, w)
+	if !os.IsNotExist(err) {
+		v.stats.TickErr(err)
+	}
+	return err
+}
+
+func (v *erasureCodedVolume) blockRead(ctx context.Context, hash string, w io.WriterAt) error {
+	bufs := make([]*memWriterAt, len(v.shards))
+	readShard := func(i int, vol volume) error {
+		bufs[i] = &memWriterAt{}
+		err := vol.BlockRead(ctx, hash, bufs[i])
+		if err != nil {
+			bufs[i] = nil
+		}
+		return err
+	}
+	dataIdxs := make([]int, v.DataShards)
+	for i := range dataIdxs {
+		dataIdxs[i] = i
+	}
+	errs := v.eachShard(dataIdxs, readShard)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	verifyAll := ctx.Value(bypassCacheKey{}) != nil
+	dataSize, dataOK := v.checkDataShards(bufs)
+	if dataOK && !verifyAll {
+		return v.writeShards(w, bufs, dataSize)
+	}
+
+	missing := 0
+	for i := 0; i < v.DataShards; i++ {
+		if bufs[i] == nil {
+			missing++
+		}
+	}
+	if missing > v.ParityShards {
+		// Even if all parity shards are available, we
+		// won't be able to reconstruct the block.
+		return combineErrors(errs, v.DataShards)
+	}
+	parityIdxs := make([]int, v.ParityShards)
+	for i := range parityIdxs {
+		parityIdxs[i] = v.DataShards + i
+	}
+	for i, err := range v.eachShard(parityIdxs, readShard) {
+		if i >= v.DataShards {
+			errs[i] = err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	size, ok := dataSize, dataOK
+	if !ok {
+		size, ok = v.sizeFromParity(bufs)
+	}
+	if !ok {
+		return combineErrors(errs, len(v.shards))
+	}
+	l := v.shardLen(size)
+	padded := make([][]byte, len(v.shards))
+	have := 0
+	// Shards that are missing or have the wrong size, and can be
+	// rewritten once the block is reconstructed. Shards that
+	// could not be read for other reasons (e.g., the shard volume
+	// is unavailable) are left alone.
+	var repair []int
+	for i, buf := range bufs {
+		switch {
+		case buf == nil:
+			if os.IsNotExist(errs[i]) {
+				repair = append(repair, i)
+			}
+		case i < v.DataShards && len(buf.buf) != v.dataShardLen(i, size):
+			v.logger.Warnf("BlockRead(%s): data shard %d has wrong size %d, expected %d", hash, i, len(buf.buf), v.dataShardLen(i, size))
+			repair = append(repair, i)
+		case i >= v.DataShards && len(buf.buf) != l+ecTrailerSize:
+			v.logger.Warnf("BlockRead(%s): parity shard %d has wrong size %d, expected %d", hash, i, len(buf.buf), l+ecTrailerSize)
+			repair = append(repair, i)
+		case i < v.DataShards:
+			padded[i] = append(buf.buf, make([]byte, l-len(buf.buf))...)
+			have++
+		default:
+			padded[i] = buf.buf[:l]
+			have++
+		}
+	}
+	if have < v.DataShards {
+		err := combineErrors(errs, len(v.shards))
+		if err == nil {
+			err = fmt.Errorf("BlockRead(%s): too few consistent shards (%d < %d)", hash, have, v.DataShards)
+		}
+		return err
+	}
+	if l > 0 && slices.ContainsFunc(padded[:v.DataShards], func(b []byte) bool { return b == nil }) {
+		v.stats.TickOps("reconstruct")
+		v.stats.Tick(&v.stats.ReconstructOps)
+		v.logger.Infof("BlockRead(%s): reconstructing from %d of %d shards", hash, have, len(v.shards))
+		err := v.enc.ReconstructData(padded)
+		if err != nil {
+			return err
+		}
+	}
+	for i := 0; i < v.DataShards; i++ {
+		bufs[i] = &memWriterAt{buf: padded[i][:v.dataShardLen(i, size)]}
+	}
+	err := v.writeShards(w, bufs, size)
+	if err == nil && len(repair) > 0 {
+		v.repairShards(ctx, hash, bufs, size, repair)
+	}
+	return err
+}
+
+// repairShards re-encodes a reconstructed block and rewrites the
+// indicated shards. Errors are logged, not returned: the caller has
+// already read the block successfully.
+//
+// The rewritten shards get the current time as their timestamp, so
+// the block's Mtime is updated as if it had been touched.
+func (v *erasureCodedVolume) repairShards(ctx context.Context, hash string, bufs []*memWriterAt, size int, repair []int) {
+	if v.readonly {
+		v.logger.Warnf("BlockRead(%s): not rewriting %d missing/damaged shards because volume is read-only", hash, len(repair))
+		return
+	}
+	data := make([]byte, 0, size)
+	for i := 0; i < v.DataShards; i++ {
+		data = append(data, bufs[i].buf...)
+	}
+	shards, err := v.encode(data)
+	if err != nil {
+		v.logger.WithError(err).Errorf("BlockRead(%s): error re-encoding block to rewrite shards", hash)
+		return
+	}
+	v.stats.TickOps("repair")
+	v.stats.Tick(&v.stats.RepairOps)
+	errs := v.eachShard(repair, func(i int, vol volume) error {
+		return vol.BlockWrite(ctx, hash, shards[i])
+	})
+	for _, i := range repair {
+		if errs[i] != nil {
+			v.logger.WithError(errs[i]).Warnf("BlockRead(%s): error rewriting shard %d", hash, i)
+		} else {
+			v.logger.Infof("BlockRead(%s): rewrote shard %d", hash, i)
+		}
+	}
+}
+
+// checkDataShards returns the block size and true if all data shards
+// are present and have lengths consistent with each other.
+func (v *erasureCodedVolume) checkDataShards(bufs []*memWriterAt) (int, bool) {
+	size := 0
+	for i := 0; i < v.DataShards; i++ {
+		if bufs[i] == nil {
+			return 0, false
+		}
+		size += len(bufs[i].buf)
+	}
+	for i := 0; i < v.DataShards; i++ {
+		if len(bufs[i].buf) != v.dataShardLen(i, size) {
+			return 0, false
+		}
+	}
+	return size, true
+}
+
+// sizeFromParity returns the block size indicated by the trailer of
+// the first available parity shard.
+func (v *erasureCodedVolume) sizeFromParity(bufs []*memWriterAt) (int, bool) {
+	for _, buf := range bufs[v.DataShards:] {
+		if buf == nil || len(buf.buf) < ecTrailerSize {
+			continue
+		}
+		size := binary.BigEndian.Uint64(buf.buf[len(buf.buf)-ecTrailerSize:])
+		if size > maxStoredBlockSize {
+			continue
+		}
+		return int(size), true
+	}
+	return 0, false
+}
+
+func (v *erasureCodedVolume) writeShards(w io.WriterAt, bufs []*memWriterAt, size int) error {
+	l := v.shardLen(size)
+	for i := 0; i < v.DataShards; i++ {
+		if len(bufs[i].buf) == 0 {
+			continue
+		}
+		_, err := w.WriteAt(bufs[i].buf, int64(i*l))
+		if err != nil {
+			return err
+		}
+	}
+	v.stats.TickInBytes(uint64(size))
+	return nil
+}
+
+// BlockWrite encodes the block and writes the shards to the shard
+// volumes. It returns an error unless all shards are written
+// successfully.
+func (v *erasureCodedVolume) BlockWrite(ctx context.Context, hash string, data []byte) error {
+	v.stats.TickOps("put")
+	v.stats.Tick(&v.stats.Ops, &v.stats.PutOps)
+	shards, err := v.encode(data)
+	if err != nil {
+		v.stats.TickErr(err)
+		return err
+	}
+	errs := v.eachShard(nil, func(i int, vol volume) error {
+		return vol.BlockWrite(ctx, hash, shards[i])
+	})
+	allFull := true
+	for _, err := range errs {
+		if err != nil && err != errFull {
+			allFull = false
+		}
+	}
+	err = combineErrors(errs, len(v.shards))
+	if err != nil && allFull {
+		err = errFull
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	v.stats.TickErr(err)
+	if err == nil {
+		v.stats.TickOutBytes(uint64(len(data)))
+	}
+	return err
+}
+
+// BlockTouch updates the timestamps on all shards. It succeeds if
+// enough shards are updated to reconstruct the block.
+func (v *erasureCodedVolume) BlockTouch(hash string) error {
+	errs := v.eachShard(nil, func(i int, vol volume) error {
+		return vol.BlockTouch(hash)
+	})
+	return combineErrors(errs, v.DataShards)
+}
+
+// Mtime returns the most recent timestamp of the available shards.
+func (v *erasureCodedVolume) Mtime(hash string) (time.Time, error) {
+	mtimes := make([]time.Time, len(v.shards))
+	errs := v.eachShard(nil, func(i int, vol volume) (err error) {
+		mtimes[i], err = vol.Mtime(hash)
+		return
+	})
+	if err := combineErrors(errs, v.DataShards); err != nil {
+		return time.Time{}, err
+	}
+	var newest time.Time
+	for i, t := range mtimes {
+		if errs[i] == nil && t.After(newest) {
+			newest = t
+		}
+	}
+	return newest, nil
+}
+
+// BlockTrash trashes all shards.
+func (v *erasureCodedVolume) BlockTrash(hash string) error {
+	// Each shard volume checks its own timestamp, but we check
+	// the most recent timestamp first to avoid trashing some
+	// shards and not others.
+	if t, err := v.Mtime(hash); err != nil {
+		return err
+	} else if time.Since(t) < v.cluster.Collections.BlobSigningTTL.Duration() {
+		return nil
+	}
+	errs := v.eachShard(nil, func(i int, vol volume) error {
+		err := vol.BlockTrash(hash)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+	return combineErrors(errs, len(v.shards))
+}
+
+// BlockUntrash untrashes all trashed shards.
+func (v *erasureCodedVolume) BlockUntrash(hash string) error {
+	errs := v.eachShard(nil, func(i int, vol volume) error {
+		return vol.BlockUntrash(hash)
+	})
+	return combineErrors(errs, 1)
+}
+
+// EmptyTrash empties the trash on all shard volumes.
+func (v *erasureCodedVolume) EmptyTrash() {
+	v.eachShard(nil, func(i int, vol volume) error {
+		vol.EmptyTrash()
+		return nil
+	})
+}
+
+type ecIndexEntry struct {
+	sizes []int64 // -1 if shard is missing
+	have  int
+	mtime int64
+}
+
+// Index writes an index of blocks that have enough shards to be
+// reconstructed.
+//
+// The shard volumes' indexes are not necessarily sorted, so they are
+// merged in memory. To limit memory use, the index is assembled for
+// one two-digit prefix at a time.
+func (v *erasureCodedVolume) Index(ctx context.Context, prefix string, writeTo io.Writer) error {
+	prefixes := []string{prefix}
+	for len(prefixes[0]) < 2 {
+		var expanded []string
+		for _, p := range prefixes {
+			for _, c := range "0123456789abcdef" {
+				expanded = append(expanded, p+string(c))
+			}
+		}
+		prefixes = expanded
+	}
+	for _, p := range prefixes {
+		err := v.indexPrefix(ctx, p, writeTo)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *erasureCodedVolume) indexPrefix(ctx context.Context, prefix string, writeTo io.Writer) error {
+	bufs := make([]bytes.Buffer, len(v.shards))
+	errs := v.eachShard(nil, func(i int, vol volume) error {
+		return vol.Index(ctx, prefix, &bufs[i])
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	// Blocks can be read as long as DataShards shard volumes are
+	// available, so they can be listed too.
+	if err := combineErrors(errs, v.DataShards); err != nil {
+		return err
+	}
+	for i, err := range errs {
+		if err != nil {
+			bufs[i].Reset()
+			v.logger.WithError(err).Warnf("Index: error getting index from shard %d, listing blocks with enough shards on other volumes", i)
+		}
+	}
+	entries := map[string]*ecIndexEntry{}
+	for i := range bufs {
+		for _, line := range strings.Split(bufs[i].String(), "\n") {
+			locator, mtimestr, ok := strings.Cut(line, " ")
+			if !ok {
+				continue
+			}
+			hash, sizestr, ok := strings.Cut(locator, "+")
+			if !ok || !keepBlockRegexp.MatchString(hash) {
+				continue
+			}
+			size, err := strconv.ParseInt(sizestr, 10, 64)
+			if err != nil {
+				continue
+			}
+			mtime, err := strconv.ParseInt(mtimestr, 10, 64)
+			if err != nil {
+				continue
+			}
+			ent := entries[hash]
+			if ent == nil {
+				ent = &ecIndexEntry{sizes: make([]int64, len(v.shards))}
+				for j := range ent.sizes {
+					ent.sizes[j] = -1
+				}
+				entries[hash] = ent
+			}
+			if ent.sizes[i] < 0 {
+				ent.have++
+			}
+			ent.sizes[i] = size
+			if mtime > ent.mtime {
+				ent.mtime = mtime
+			}
+		}
+	}
+	hashes := make([]string, 0, len(entries))
+	for hash, ent := range entries {
+		if ent.have >= v.DataShards {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		ent := entries[hash]
+		size, err := v.indexSize(hash, ent)
+		if err != nil {
+			v.logger.WithError(err).Warnf("Index: cannot determine size of %s, omitting from index", hash)
+			continue
+		}
+		_, err = fmt.Fprintf(writeTo, "%s+%d %d\n", hash, size, ent.mtime)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexSize returns the block size, using the data shard sizes
+// reported by the shard volumes' indexes if possible. Otherwise, it
+// reads a parity shard to get the size from its trailer.
+func (v *erasureCodedVolume) indexSize(hash string, ent *ecIndexEntry) (int64, error) {
+	var size int64
+	for i := 0; i < v.DataShards; i++ {
+		if ent.sizes[i] < 0 {
+			size = -1
+			break
+		}
+		size += ent.sizes[i]
+	}
+	if size >= 0 {
+		return size, nil
+	}
+	for i := v.DataShards; i < len(v.shards); i++ {
+		if ent.sizes[i] < ecTrailerSize {
+			continue
+		}
+		buf := &memWriterAt{}
+		err := v.shards[i].BlockRead(context.Background(), hash, buf)
+		if err != nil {
+			continue
+		}
+		if size, ok := v.sizeFromParity(append(make([]*memWriterAt, v.DataShards), buf)); ok {
+			return int64(size), nil
+		}
+	}
+	return 0, errors.New("no readable parity shards")
+}
+
+// InternalStats returns operation and I/O counters.
+func (v *erasureCodedVolume) InternalStats() interface{} {
+	return &v.stats
+}
+
+type erasureCodedStats struct {
+	statsTicker
+	Ops            uint64
+	GetOps         uint64
+	PutOps         uint64
+	ReconstructOps uint64
+	RepairOps      uint64
+}
+
+func (s *erasureCodedStats) TickErr(err error) {
+	if err == nil {
+		return
+	}
+	s.statsTicker.TickErr(err, fmt.Sprintf("%T", err))
+}
@@ -0,0 +1,286 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+type testableErasureCodedVolume struct {
+	*erasureCodedVolume
+}
+
+func (s *erasureCodedVolumeSuite) newTestableVolume(c *check.C, params newVolumeParams, k, m int) *testableErasureCodedVolume {
+	ecparams := arvados.ErasureCodedVolumeDriverParameters{
+		DataShards:   k,
+		ParityShards: m,
+	}
+	for i := 0; i < k+m; i++ {
+		ecparams.ShardVolumes = append(ecparams.ShardVolumes, arvados.ErasureCodedShardVolume{Driver: "stub"})
+	}
+	var err error
+	params.ConfigVolume.Driver = "ErasureCoded"
+	params.ConfigVolume.DriverParameters, err = json.Marshal(ecparams)
+	c.Assert(err, check.IsNil)
+	v, err := newErasureCodedVolume(params)
+	c.Assert(err, check.IsNil)
+	return &testableErasureCodedVolume{v.(*erasureCodedVolume)}
+}
+
+func (v *testableErasureCodedVolume) TouchWithDate(hash string, t time.Time) {
+	for _, vol := range v.shards {
+		vol.(*stubVolume).blockTouchWithTime(hash, t)
+	}
+}
+
+func (v *testableErasureCodedVolume) Teardown() {
+}
+
+func (v *testableErasureCodedVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return "get", "put"
+}
+
+// stub returns the stub volume used for shard i.
+func (v *testableErasureCodedVolume) stub(i int) *stubVolume {
+	return v.shards[i].(*stubVolume)
+}
+
+var _ = check.Suite(&erasureCodedVolumeSuite{})
+
+type erasureCodedVolumeSuite struct {
+	params newVolumeParams
+}
+
+func (s *erasureCodedVolumeSuite) SetUpTest(c *check.C) {
+	logger := ctxlog.TestLogger(c)
+	reg := prometheus.NewRegistry()
+	s.params = newVolumeParams{
+		UUID:        "zzzzz-nyw5e-999999999999999",
+		Cluster:     testCluster(c),
+		Logger:      logger,
+		MetricsVecs: newVolumeMetricsVecs(reg),
+		BufferPool:  newBufferPool(logger, 8, reg),
+	}
+}
+
+func (s *erasureCodedVolumeSuite) TestGeneric(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableVolume(c, params, 4, 2)
+	})
+}
+
+func (s *erasureCodedVolumeSuite) TestGenericReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableVolume(c, params, 4, 2)
+	})
+}
+
+func (s *erasureCodedVolumeSuite) TestNewVolumeFromConfig(c *check.C) {
+	for _, trial := range []struct {
+		params string
+		ok     bool
+	}{
+		{`{}`, false},
+		{`{"DataShards": 2, "ParityShards": 0, "ShardVolumes": [{"Driver": "stub"}, {"Driver": "stub"}]}`, false},
+		{`{"DataShards": 2, "ParityShards": 1, "ShardVolumes": [{"Driver": "stub"}, {"Driver": "stub"}]}`, false},
+		{`{"DataShards": 1, "ParityShards": 1, "ShardVolumes": [{"Driver": "stub"}, {"Driver": "bogus"}]}`, false},
+		{`{"DataShards": 1, "ParityShards": 1, "ShardVolumes": [{"Driver": "stub"}, {"Driver": "ErasureCoded"}]}`, false},
+		{`{"DataShards": 1, "ParityShards": 1, "ShardVolumes": [{"Driver": "stub"}, {"Driver": "Directory", "DriverParameters": {}}]}`, false},
+		{`{"DataShards": 2, "ParityShards": 1, "ShardVolumes": [{"Driver": "stub"}, {"Driver": "stub"}, {"Driver": "stub"}]}`, true},
+	} {
+		c.Logf("trial: %s", trial.params)
+		params := s.params
+		params.ConfigVolume.DriverParameters = json.RawMessage(trial.params)
+		v, err := newErasureCodedVolume(params)
+		if !trial.ok {
+			c.Check(err, check.NotNil)
+			continue
+		}
+		c.Assert(err, check.IsNil)
+		c.Check(v.DeviceID(), check.Matches, `erasurecoded://2\+1/.*,.*,.*`)
+		c.Check(v.(*erasureCodedVolume).Replication(), check.Equals, 2)
+	}
+}
+
+func (s *erasureCodedVolumeSuite) TestDirectoryShards(c *check.C) {
+	ecparams := arvados.ErasureCodedVolumeDriverParameters{DataShards: 2, ParityShards: 1}
+	var roots []string
+	for i := 0; i < 3; i++ {
+		roots = append(roots, c.MkDir())
+		dp, err := json.Marshal(arvados.DirectoryVolumeDriverParameters{Root: roots[i]})
+		c.Assert(err, check.IsNil)
+		ecparams.ShardVolumes = append(ecparams.ShardVolumes, arvados.ErasureCodedShardVolume{
+			Driver:           "Directory",
+			DriverParameters: dp,
+		})
+	}
+	params := s.params
+	params.ConfigVolume.DriverParameters, _ = json.Marshal(ecparams)
+	v, err := newErasureCodedVolume(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	c.Assert(os.Remove(roots[0]+"/"+TestHash[:3]+"/"+TestHash), check.IsNil)
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(TestBlock))
+}
+
+func (s *erasureCodedVolumeSuite) TestDegradedRead(c *check.C) {
+	v := s.newTestableVolume(c, s.params, 4, 2)
+	for _, size := range []int{0, 1, 3, 4, 5, 1000, 65537} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		c.Assert(v.BlockWrite(context.Background(), hash, data), check.IsNil)
+		for _, lose := range [][]int{nil, {0}, {3}, {0, 5}, {1, 2}, {4, 5}} {
+			c.Logf("size %d, lose %v", size, lose)
+			for _, i := range lose {
+				v.stub(i).mtx.Lock()
+				v.stub(i).data[hash+"-saved"] = v.stub(i).data[hash]
+				delete(v.stub(i).data, hash)
+				v.stub(i).mtx.Unlock()
+			}
+			buf := &brbuffer{}
+			err := v.BlockRead(context.Background(), hash, buf)
+			c.Check(err, check.IsNil)
+			c.Check(buf.Len(), check.Equals, size)
+			c.Check(bytes.Equal(buf.Bytes(), data), check.Equals, true)
+
+			idx := &bytes.Buffer{}
+			c.Check(v.Index(context.Background(), hash[:4], idx), check.IsNil)
+			c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, hash, size))
+
+			for _, i := range lose {
+				v.stub(i).mtx.Lock()
+				v.stub(i).data[hash] = v.stub(i).data[hash+"-saved"]
+				delete(v.stub(i).data, hash+"-saved")
+				v.stub(i).mtx.Unlock()
+			}
+		}
+	}
+}
+
+func (s *erasureCodedVolumeSuite) TestTooManyShardsMissing(c *check.C) {
+	v := s.newTestableVolume(c, s.params, 4, 2)
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	for _, i := range []int{0, 4, 5} {
+		delete(v.stub(i).data, TestHash)
+	}
+	err := v.BlockRead(context.Background(), TestHash, brdiscard)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	idx := &bytes.Buffer{}
+	c.Check(v.Index(context.Background(), "", idx), check.IsNil)
+	c.Check(idx.String(), check.Equals, "")
+
+	_, err = v.Mtime(TestHash)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *erasureCodedVolumeSuite) TestRepairShards(c *check.C) {
+	v := s.newTestableVolume(c, s.params, 4, 2)
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	want := make([]stubData, 6)
+	for i := range want {
+		want[i] = v.stub(i).data[TestHash]
+	}
+
+	// A missing data shard causes the parity shards to be read,
+	// and all missing shards to be rewritten.
+	delete(v.stub(1).data, TestHash)
+	delete(v.stub(4).data, TestHash)
+	c.Check(v.BlockRead(context.Background(), TestHash, brdiscard), check.IsNil)
+	for _, i := range []int{1, 4} {
+		c.Check(v.stub(i).data[TestHash].data, check.DeepEquals, want[i].data)
+	}
+
+	// A missing parity shard is not noticed by a normal read...
+	delete(v.stub(5).data, TestHash)
+	c.Check(v.BlockRead(context.Background(), TestHash, brdiscard), check.IsNil)
+	_, ok := v.stub(5).data[TestHash]
+	c.Check(ok, check.Equals, false)
+	// ...but it is noticed and rewritten by a scrub read.
+	c.Check(v.BlockRead(bypassCache(context.Background()), TestHash, brdiscard), check.IsNil)
+	c.Check(v.stub(5).data[TestHash].data, check.DeepEquals, want[5].data)
+
+	// Shards are not rewritten on a read-only volume.
+	params := s.params
+	params.ConfigVolume.ReadOnly = true
+	v = s.newTestableVolume(c, params, 4, 2)
+	for i := range want {
+		v.stub(i).data[TestHash] = want[i]
+	}
+	delete(v.stub(0).data, TestHash)
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(TestBlock))
+	_, ok = v.stub(0).data[TestHash]
+	c.Check(ok, check.Equals, false)
+}
+
+func (s *erasureCodedVolumeSuite) TestIndexShardError(c *check.C) {
+	v := s.newTestableVolume(c, s.params, 4, 2)
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	indexError := func(context.Context, string, io.Writer) error { return fmt.Errorf("test error") }
+
+	// Index succeeds with ParityShards shard volumes down.
+	delete(v.stub(0).data, TestHash)
+	v.stub(1).index = indexError
+	idx := &bytes.Buffer{}
+	c.Check(v.Index(context.Background(), "", idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, TestHash, len(TestBlock)))
+
+	// Index fails with more than ParityShards shard volumes
+	// down.
+	v.stub(2).index = indexError
+	v.stub(3).index = indexError
+	idx.Reset()
+	c.Check(v.Index(context.Background(), "", idx), check.ErrorMatches, `test error`)
+}
+
+func (s *erasureCodedVolumeSuite) TestShardWriteError(c *check.C) {
+	v := s.newTestableVolume(c, s.params, 2, 1)
+	v.stub(2).blockWrite = func(context.Context, string, []byte) error {
+		return errFull
+	}
+	c.Check(v.BlockWrite(context.Background(), TestHash, TestBlock), check.Equals, errFull)
+	v.stub(1).blockWrite = func(context.Context, string, []byte) error {
+		return fmt.Errorf("test error")
+	}
+	c.Check(v.BlockWrite(context.Background(), TestHash, TestBlock), check.ErrorMatches, `test error`)
+}
+
+func (s *erasureCodedVolumeSuite) TestMountReplication(c *check.C) {
+	cluster := testCluster(c)
+	dp, err := json.Marshal(arvados.ErasureCodedVolumeDriverParameters{
+		DataShards:   2,
+		ParityShards: 2,
+		ShardVolumes: []arvados.ErasureCodedShardVolume{{Driver: "stub"}, {Driver: "stub"}, {Driver: "stub"}, {Driver: "stub"}},
+	})
+	c.Assert(err, check.IsNil)
+	cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Driver: "ErasureCoded", DriverParameters: dp, Replication: 1},
+	}
+	ks, cancel := testKeepstore(c, cluster, nil)
+	defer cancel()
+	c.Assert(ks.mountsW, check.HasLen, 1)
+	c.Check(ks.mountsW[0].Replication, check.Equals, 3)
+	c.Check(strings.HasPrefix(ks.mountsW[0].KeepMount.DeviceID, "erasurecoded://2+2/"), check.Equals, true)
+}
@@ -0,0 +1,620 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+func init() {
+	driver["GCS"] = newGCSVolume
+}
+
+const (
+	gcsDefaultConnectTimeout = arvados.Duration(time.Minute)
+	gcsDefaultReadTimeout    = arvados.Duration(10 * time.Minute)
+	gcsDefaultIndexPageSize  = 1000
+
+	// Maximum number of attempts to update an object's metadata
+	// when it is being modified concurrently by another request.
+	gcsMaxPatchAttempts = 5
+
+	// Custom object metadata keys.
+	gcsMtimeKey     = "arvados-mtime"      // block timestamp (unix nanoseconds)
+	gcsExpiresAtKey = "arvados-expires-at" // if present, block is trashed (unix nanoseconds)
+	gcsSizeHintKey  = "arvados-size-hint"  // size hint (see sizeHintVolume)
+)
+
+// gcsListFields are the object fields needed by Index and EmptyTrash.
+const gcsListFields = "items(name,size,updated,metadata,generation,metageneration),nextPageToken"
+
+// gcsVolume stores blocks in a Google Cloud Storage bucket, using
+// the JSON API. Each block is stored as an object named {hash}.
+//
+// The block timestamp and trash state are stored in custom object
+// metadata, so touching, trashing, and untrashing a block only
+// updates its metadata. Updates use generation and metageneration
+// preconditions, so a block is never trashed or deleted if it has
+// been rewritten or touched since its timestamp was checked.
+type gcsVolume struct {
+	arvados.GCSVolumeDriverParameters
+
+	cluster    *arvados.Cluster
+	volume     arvados.Volume
+	logger     logrus.FieldLogger
+	metrics    *volumeMetricsVecs
+	bufferPool *bufferPool
+	svc        *storage.Service
+	stats      gcsStats
+
+	encodedData bool
+}
+
+func newGCSVolume(params newVolumeParams) (volume, error) {
+	v := &gcsVolume{
+		cluster:     params.Cluster,
+		volume:      params.ConfigVolume,
+		metrics:     params.MetricsVecs,
+		bufferPool:  params.BufferPool,
+		encodedData: params.EncodedData,
+	}
+	err := json.Unmarshal(params.ConfigVolume.DriverParameters, v)
+	if err != nil {
+		return nil, err
+	}
+	v.logger = params.Logger.WithField("Volume", v.DeviceID())
+	return v, v.check()
+}
+
+func (v *gcsVolume) check() error {
+	if v.Bucket == "" {
+		return errors.New("DriverParameters: Bucket must be provided")
+	}
+	if v.Endpoint != "" {
+		u, err := url.Parse(v.Endpoint)
+		if err != nil {
+			return fmt.Errorf("error parsing Endpoint %q: %w", v.Endpoint, err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid Endpoint %q: scheme must be http or https", v.Endpoint)
+		}
+	}
+	if v.IndexPageSize == 0 {
+		v.IndexPageSize = gcsDefaultIndexPageSize
+	}
+	// Zero timeouts mean "wait forever", which is a bad
+	// default. Default to long timeouts instead.
+	if v.ConnectTimeout == 0 {
+		v.ConnectTimeout = gcsDefaultConnectTimeout
+	}
+	if v.ReadTimeout == 0 {
+		v.ReadTimeout = gcsDefaultReadTimeout
+	}
+
+	ctx := context.Background()
+	var creds *google.Credentials
+	var err error
+	if v.CredentialsFile != "" {
+		buf, err := os.ReadFile(v.CredentialsFile)
+		if err != nil {
+			return fmt.Errorf("error reading CredentialsFile: %w", err)
+		}
+		creds, err = google.CredentialsFromJSONWithType(ctx, buf, google.ServiceAccount, storage.DevstorageReadWriteScope)
+		if err != nil {
+			return fmt.Errorf("error loading CredentialsFile %q: %w", v.CredentialsFile, err)
+		}
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, storage.DevstorageReadWriteScope)
+		if err != nil {
+			return fmt.Errorf("error finding default Google Cloud credentials (CredentialsFile is empty): %w", err)
+		}
+	}
+	client := &http.Client{
+		Timeout: v.ReadTimeout.Duration(),
+		Transport: &oauth2.Transport{
+			Source: creds.TokenSource,
+			Base: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   v.ConnectTimeout.Duration(),
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				MaxIdleConnsPerHost: 16,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+	}
+	opts := []option.ClientOption{option.WithHTTPClient(client)}
+	if v.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(v.Endpoint))
+	}
+	v.svc, err = storage.NewService(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("error creating GCS client: %w", err)
+	}
+
+	lbls := prometheus.Labels{"device_id": v.DeviceID()}
+	v.stats.opsCounters, v.stats.errCounters, v.stats.ioBytes = v.metrics.getCounterVecsFor(lbls)
+	return nil
+}
+
+// DeviceID returns a globally unique ID for the storage bucket.
+func (v *gcsVolume) DeviceID() string {
+	if v.Endpoint == "" {
+		return "gs://" + v.Bucket
+	}
+	return "gs://" + v.Bucket + "@" + strings.TrimPrefix(strings.TrimPrefix(v.Endpoint, "https://"), "http://")
+}
+
+// If possible, translate an error returned by the GCS client to a
+// recognizable error like os.ErrNotExist.
+func (v *gcsVolume) translateError(err error) error {
+	var gerr *googleapi.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.Canceled):
+		return context.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return context.DeadlineExceeded
+	case errors.As(err, &gerr) && gerr.Code == http.StatusNotFound:
+		return os.ErrNotExist
+	case errors.As(err, &gerr) && (gerr.Code == http.StatusServiceUnavailable || gerr.Code == http.StatusTooManyRequests):
+		return errVolumeUnavailable
+	default:
+		return err
+	}
+}
+
+// isPreconditionFailed returns true if err indicates that the object
+// was modified since the generation/metageneration given in a
+// request's preconditions.
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+func (v *gcsVolume) isKeepBlock(s string) bool {
+	return keepBlockRegexp.MatchString(s)
+}
+
+// attrs returns the given object's metadata.
+func (v *gcsVolume) attrs(ctx context.Context, hash string) (*storage.Object, error) {
+	v.stats.TickOps("get_metadata")
+	v.stats.Tick(&v.stats.Ops, &v.stats.GetMetadataOps)
+	obj, err := v.svc.Objects.Get(v.Bucket, hash).Context(ctx).Do()
+	v.stats.TickErr(err)
+	return obj, v.translateError(err)
+}
+
+// patch updates the given object's metadata, setting the keys in set
+// and removing the keys in remove. It fails if the object has been
+// modified since prev was retrieved.
+func (v *gcsVolume) patch(prev *storage.Object, set map[string]string, remove ...string) error {
+	v.stats.TickOps("patch")
+	v.stats.Tick(&v.stats.Ops, &v.stats.PatchOps)
+	obj := &storage.Object{Metadata: set}
+	for _, key := range remove {
+		obj.NullFields = append(obj.NullFields, "Metadata."+key)
+	}
+	_, err := v.svc.Objects.Patch(v.Bucket, prev.Name, obj).
+		IfGenerationMatch(prev.Generation).
+		IfMetagenerationMatch(prev.Metageneration).
+		Do()
+	v.stats.TickErr(err)
+	if isPreconditionFailed(err) {
+		return err
+	}
+	return v.translateError(err)
+}
+
+// del deletes the given object, unless it has been modified since
+// the given generation and metageneration.
+func (v *gcsVolume) del(name string, generation, metageneration int64) error {
+	v.stats.TickOps("delete")
+	v.stats.Tick(&v.stats.Ops, &v.stats.DelOps)
+	err := v.svc.Objects.Delete(v.Bucket, name).
+		IfGenerationMatch(generation).
+		IfMetagenerationMatch(metageneration).
+		Do()
+	v.stats.TickErr(err)
+	if isPreconditionFailed(err) {
+		return err
+	}
+	return v.translateError(err)
+}
+
+// gcsTrashed returns true if the given object is marked as trash.
+func gcsTrashed(obj *storage.Object) bool {
+	return obj.Metadata[gcsExpiresAtKey] != ""
+}
+
+// gcsMtime returns the block timestamp of the given object.
+func gcsMtime(obj *storage.Object) (time.Time, error) {
+	if s := obj.Metadata[gcsMtimeKey]; s != "" {
+		ns, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("object %q has invalid %s metadata %q: %w", obj.Name, gcsMtimeKey, s, err)
+		}
+		return time.Unix(0, ns), nil
+	}
+	// Object was stored by some other means, without our
+	// metadata. Use the object's own modification time.
+	t, err := time.Parse(time.RFC3339Nano, obj.Updated)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("object %q has invalid updated time %q: %w", obj.Name, obj.Updated, err)
+	}
+	return t, nil
+}
+
+// BlockRead reads a Keep block from the bucket.
+func (v *gcsVolume) BlockRead(ctx context.Context, hash string, w io.WriterAt) error {
+	for attempt := 0; ; attempt++ {
+		obj, err := v.attrs(ctx, hash)
+		if err != nil {
+			return err
+		}
+		if gcsTrashed(obj) {
+			return os.ErrNotExist
+		}
+		if obj.Size > maxStoredBlockSize {
+			return fmt.Errorf("object %q: invalid size %d (max %d)", hash, obj.Size, maxStoredBlockSize)
+		}
+		err = v.get(ctx, obj, w)
+		if isPreconditionFailed(err) && attempt < 2 {
+			// Replaced since we got the metadata. The new
+			// data should be the same, so try again.
+			continue
+		}
+		return err
+	}
+}
+
+// get copies the given generation of an object to w.
+func (v *gcsVolume) get(ctx context.Context, obj *storage.Object, w io.WriterAt) error {
+	v.stats.TickOps("get")
+	v.stats.Tick(&v.stats.Ops, &v.stats.GetOps)
+	resp, err := v.svc.Objects.Get(v.Bucket, obj.Name).IfGenerationMatch(obj.Generation).Context(ctx).Download()
+	v.stats.TickErr(err)
+	if isPreconditionFailed(err) {
+		return err
+	} else if err != nil {
+		return v.translateError(err)
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.NewOffsetWriter(w, 0), newCountingReader(resp.Body, v.stats.TickInBytes))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		v.stats.TickErr(err)
+		return err
+	} else if uint64(n) != obj.Size {
+		return fmt.Errorf("object %q: short read (%d of %d bytes)", obj.Name, n, obj.Size)
+	}
+	return nil
+}
+
+// BlockWrite stores a block in the bucket, replacing any existing
+// object (including a trashed one) with the same name, and sets its
+// timestamp to the current time.
+func (v *gcsVolume) BlockWrite(ctx context.Context, hash string, data []byte) error {
+	return v.write(ctx, hash, data, map[string]string{gcsMtimeKey: strconv.FormatInt(time.Now().UnixNano(), 10)})
+}
+
+// BlockWriteSizeHint is like BlockWrite, but also stores the given
+// size hint in the object metadata.
+func (v *gcsVolume) BlockWriteSizeHint(ctx context.Context, hash string, data []byte, sizeHint int) error {
+	return v.write(ctx, hash, data, map[string]string{
+		gcsMtimeKey:    strconv.FormatInt(time.Now().UnixNano(), 10),
+		gcsSizeHintKey: strconv.Itoa(sizeHint),
+	})
+}
+
+// BlockRewrite replaces the stored data of an existing block,
+// keeping its metadata, including its timestamp.
+func (v *gcsVolume) BlockRewrite(ctx context.Context, hash string, data []byte) error {
+	obj, err := v.attrs(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if gcsTrashed(obj) {
+		return os.ErrNotExist
+	}
+	mtime, err := gcsMtime(obj)
+	if err != nil {
+		return err
+	}
+	metadata := map[string]string{}
+	for key, val := range obj.Metadata {
+		metadata[key] = val
+	}
+	metadata[gcsMtimeKey] = strconv.FormatInt(mtime.UnixNano(), 10)
+	return v.write(ctx, hash, data, metadata)
+}
+
+func (v *gcsVolume) write(ctx context.Context, hash string, data []byte, metadata map[string]string) error {
+	obj := &storage.Object{
+		Name:     hash,
+		Metadata: metadata,
+	}
+	if v.isKeepBlock(hash) && !v.encodedData {
+		// Let GCS verify the data we send.
+		md5, err := hex.DecodeString(hash)
+		if err != nil {
+			return err
+		}
+		obj.Md5Hash = base64.StdEncoding.EncodeToString(md5)
+	}
+	v.stats.TickOps("put")
+	v.stats.Tick(&v.stats.Ops, &v.stats.PutOps)
+	body := newCountingReader(bytes.NewReader(data), v.stats.TickOutBytes)
+	_, err := v.svc.Objects.Insert(v.Bucket, obj).
+		Media(body, googleapi.ContentType("application/octet-stream"), googleapi.ChunkSize(0)).
+		Context(ctx).
+		Do()
+	v.stats.TickErr(err)
+	return v.translateError(err)
+}
+
+// BlockTouch sets the timestamp for the given block to the current
+// time.
+func (v *gcsVolume) BlockTouch(hash string) error {
+	var err error
+	for attempt := 0; attempt < gcsMaxPatchAttempts; attempt++ {
+		var obj *storage.Object
+		obj, err = v.attrs(context.Background(), hash)
+		if err != nil {
+			return err
+		}
+		if gcsTrashed(obj) {
+			return os.ErrNotExist
+		}
+		err = v.patch(obj, map[string]string{gcsMtimeKey: strconv.FormatInt(time.Now().UnixNano(), 10)})
+		if !isPreconditionFailed(err) {
+			return err
+		}
+		// Someone else touched or rewrote the block since
+		// we got its metadata. Try again.
+	}
+	return err
+}
+
+// Mtime returns the stored timestamp for the given block.
+func (v *gcsVolume) Mtime(hash string) (time.Time, error) {
+	obj, err := v.attrs(context.Background(), hash)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if gcsTrashed(obj) {
+		return time.Time{}, os.ErrNotExist
+	}
+	return gcsMtime(obj)
+}
+
+// BlockTrash marks the given block as trash. If BlobTrashLifetime is
+// zero, the block is deleted immediately.
+func (v *gcsVolume) BlockTrash(hash string) error {
+	obj, err := v.attrs(context.Background(), hash)
+	if err != nil {
+		return err
+	}
+	if gcsTrashed(obj) {
+		return os.ErrNotExist
+	}
+	if t, err := gcsMtime(obj); err != nil {
+		return err
+	} else if time.Since(t) < v.cluster.Collections.BlobSigningTTL.Duration() {
+		return nil
+	}
+	if v.cluster.Collections.BlobTrashLifetime == 0 {
+		return v.del(hash, obj.Generation, obj.Metageneration)
+	}
+	expiresAt := time.Now().Add(v.cluster.Collections.BlobTrashLifetime.Duration())
+	return v.patch(obj, map[string]string{gcsExpiresAtKey: strconv.FormatInt(expiresAt.UnixNano(), 10)})
+}
+
+// BlockUntrash removes the trash mark from the given block, and sets
+// its timestamp to the current time.
+func (v *gcsVolume) BlockUntrash(hash string) error {
+	obj, err := v.attrs(context.Background(), hash)
+	if err != nil {
+		return err
+	}
+	if !gcsTrashed(obj) {
+		return os.ErrNotExist
+	}
+	return v.patch(obj, map[string]string{gcsMtimeKey: strconv.FormatInt(time.Now().UnixNano(), 10)}, gcsExpiresAtKey)
+}
+
+// EmptyTrash deletes trashed blocks whose trash deadlines have
+// passed.
+func (v *gcsVolume) EmptyTrash() {
+	var bytesDeleted, bytesInTrash int64
+	var blocksDeleted, blocksInTrash int64
+
+	// Define "ready to delete" as "...when EmptyTrash started".
+	startT := time.Now()
+
+	emptyOne := func(obj *storage.Object) {
+		atomic.AddInt64(&blocksInTrash, 1)
+		atomic.AddInt64(&bytesInTrash, int64(obj.Size))
+		expiresAt, err := strconv.ParseInt(obj.Metadata[gcsExpiresAtKey], 10, 64)
+		if err != nil {
+			v.logger.WithError(err).Warnf("EmptyTrash: object %q has invalid %s metadata", obj.Name, gcsExpiresAtKey)
+			return
+		}
+		if expiresAt > startT.UnixNano() {
+			return
+		}
+		err = v.del(obj.Name, obj.Generation, obj.Metageneration)
+		if isPreconditionFailed(err) {
+			// The block was rewritten or untrashed
+			// since we listed it.
+			v.logger.Infof("EmptyTrash: %s was modified after listing, not deleting", obj.Name)
+			return
+		} else if err != nil && !os.IsNotExist(err) {
+			v.logger.WithError(err).Errorf("EmptyTrash: error deleting %q", obj.Name)
+			return
+		}
+		atomic.AddInt64(&bytesDeleted, int64(obj.Size))
+		atomic.AddInt64(&blocksDeleted, 1)
+	}
+
+	var wg sync.WaitGroup
+	todo := make(chan *storage.Object, v.cluster.Collections.BlobDeleteConcurrency)
+	for i := 0; i < v.cluster.Collections.BlobDeleteConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for obj := range todo {
+				emptyOne(obj)
+			}
+		}()
+	}
+
+	err := v.list(context.Background(), "", func(obj *storage.Object) {
+		if v.isKeepBlock(obj.Name) && gcsTrashed(obj) {
+			todo <- obj
+		}
+	})
+	close(todo)
+	wg.Wait()
+
+	if err != nil {
+		v.logger.WithError(err).Error("EmptyTrash: list failed")
+	}
+	v.logger.Infof("EmptyTrash: stats for %v: Deleted %v bytes in %v blocks. Remaining in trash: %v bytes in %v blocks.", v.DeviceID(), bytesDeleted, blocksDeleted, bytesInTrash-bytesDeleted, blocksInTrash-blocksDeleted)
+}
+
+// Index writes a list of non-trashed blocks whose hashes begin with
+// the given prefix.
+func (v *gcsVolume) Index(ctx context.Context, prefix string, writer io.Writer) error {
+	return v.index(ctx, prefix, writer, false)
+}
+
+// IndexSizeHints is like Index, but also reports each block's size
+// hint. Read times are not supported.
+func (v *gcsVolume) IndexSizeHints(ctx context.Context, prefix string, readTimes bool, writer io.Writer) error {
+	if readTimes {
+		return errNoReadTimes
+	}
+	return v.index(ctx, prefix, writer, true)
+}
+
+func (v *gcsVolume) index(ctx context.Context, prefix string, writer io.Writer, sizeHints bool) error {
+	var err error
+	listErr := v.list(ctx, prefix, func(obj *storage.Object) {
+		if err != nil || !v.isKeepBlock(obj.Name) || gcsTrashed(obj) {
+			return
+		}
+		var t time.Time
+		t, err = gcsMtime(obj)
+		if err != nil {
+			return
+		}
+		if !sizeHints {
+			_, err = fmt.Fprintf(writer, "%s+%d %d\n", obj.Name, obj.Size, t.UnixNano())
+			return
+		}
+		sizeHint, herr := strconv.Atoi(obj.Metadata[gcsSizeHintKey])
+		if herr != nil || sizeHint < 0 {
+			sizeHint = -1
+		}
+		_, err = fmt.Fprintf(writer, "%s+%d %d %d\n", obj.Name, obj.Size, t.UnixNano(), sizeHint)
+	})
+	if listErr != nil {
+		return listErr
+	}
+	return err
+}
+
+// list calls fn for each object whose name begins with the given
+// prefix, fetching IndexPageSize objects at a time.
+func (v *gcsVolume) list(ctx context.Context, prefix string, fn func(*storage.Object)) error {
+	pageToken := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		v.stats.TickOps("list")
+		v.stats.Tick(&v.stats.Ops, &v.stats.ListOps)
+		call := v.svc.Objects.List(v.Bucket).
+			Prefix(prefix).
+			MaxResults(int64(v.IndexPageSize)).
+			Fields(gcsListFields).
+			Context(ctx)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		page, err := call.Do()
+		v.stats.TickErr(err)
+		if err != nil {
+			return v.translateError(err)
+		}
+		for _, obj := range page.Items {
+			if !strings.HasPrefix(obj.Name, prefix) {
+				v.logger.Warnf("list(prefix=%q) returned name %q", prefix, obj.Name)
+				continue
+			}
+			fn(obj)
+		}
+		if page.NextPageToken == "" || page.NextPageToken == pageToken {
+			return nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// InternalStats returns API call and I/O counters.
+func (v *gcsVolume) InternalStats() interface{} {
+	return &v.stats
+}
+
+type gcsStats struct {
+	statsTicker
+	Ops            uint64
+	GetOps         uint64
+	GetMetadataOps uint64
+	PutOps         uint64
+	PatchOps       uint64
+	DelOps         uint64
+	ListOps        uint64
+}
+
+func (s *gcsStats) TickErr(err error) {
+	if err == nil {
+		return
+	}
+	errType := fmt.Sprintf("%T", err)
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		errType = errType + fmt.Sprintf(" %d", gerr.Code)
+	}
+	s.statsTicker.TickErr(err, errType)
+}
@@ -0,0 +1,520 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	storage "google.golang.org/api/storage/v1"
+	check "gopkg.in/check.v1"
+)
+
+const gcsStubToken = "gcs-stub-access-token"
+
+type gcsStubObject struct {
+	data           []byte
+	metadata       map[string]string
+	generation     int64
+	metageneration int64
+	updated        time.Time
+}
+
+// gcsStubHandler is an in-memory implementation of the parts of the
+// Google Cloud Storage JSON API (and the OAuth2 token endpoint) used
+// by gcsVolume.
+type gcsStubHandler struct {
+	sync.Mutex
+	bucket     string
+	objects    map[string]*gcsStubObject
+	generation int64
+	// If not nil, media downloads wait until this channel is
+	// closed.
+	blockGet chan struct{}
+}
+
+func newGCSStubHandler(bucket string) *gcsStubHandler {
+	return &gcsStubHandler{bucket: bucket, objects: map[string]*gcsStubObject{}}
+}
+
+func (h *gcsStubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":%q,"token_type":"Bearer","expires_in":3600}`, gcsStubToken)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+gcsStubToken {
+		h.error(w, http.StatusUnauthorized)
+		return
+	}
+	bucketPath := "/storage/v1/b/" + h.bucket + "/o"
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/upload"+bucketPath:
+		h.serveUpload(w, r)
+	case r.Method == "GET" && r.URL.Path == bucketPath:
+		h.serveList(w, r)
+	case strings.HasPrefix(r.URL.Path, bucketPath+"/"):
+		h.serveObject(w, r, strings.TrimPrefix(r.URL.Path, bucketPath+"/"))
+	default:
+		h.error(w, http.StatusNotFound)
+	}
+}
+
+func (h *gcsStubHandler) error(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, code, http.StatusText(code))
+}
+
+func (h *gcsStubHandler) apiObject(name string, obj *gcsStubObject) *storage.Object {
+	return &storage.Object{
+		Bucket:         h.bucket,
+		Name:           name,
+		Size:           uint64(len(obj.data)),
+		Metadata:       obj.metadata,
+		Generation:     obj.generation,
+		Metageneration: obj.metageneration,
+		Updated:        obj.updated.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// checkPreconditions returns false (after sending an error response)
+// if the request has ifGenerationMatch or ifMetagenerationMatch
+// parameters that don't match obj.
+func (h *gcsStubHandler) checkPreconditions(w http.ResponseWriter, r *http.Request, obj *gcsStubObject) bool {
+	for param, actual := range map[string]int64{
+		"ifGenerationMatch":     obj.generation,
+		"ifMetagenerationMatch": obj.metageneration,
+	} {
+		if s := r.FormValue(param); s != "" && s != strconv.FormatInt(actual, 10) {
+			h.error(w, http.StatusPreconditionFailed)
+			return false
+		}
+	}
+	return true
+}
+
+func (h *gcsStubHandler) serveObject(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method == "GET" && r.FormValue("alt") == "media" && h.blockGet != nil {
+		select {
+		case <-h.blockGet:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	h.Lock()
+	defer h.Unlock()
+	obj := h.objects[name]
+	if obj == nil {
+		h.error(w, http.StatusNotFound)
+		return
+	}
+	if !h.checkPreconditions(w, r, obj) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		if r.FormValue("alt") == "media" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+			w.Write(obj.data)
+			return
+		}
+		json.NewEncoder(w).Encode(h.apiObject(name, obj))
+	case "PATCH":
+		var patch struct {
+			Metadata map[string]*string `json:"metadata"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+		md := map[string]string{}
+		for k, v := range obj.metadata {
+			md[k] = v
+		}
+		for k, v := range patch.Metadata {
+			if v == nil {
+				delete(md, k)
+			} else {
+				md[k] = *v
+			}
+		}
+		obj.metadata = md
+		obj.metageneration++
+		obj.updated = time.Now()
+		json.NewEncoder(w).Encode(h.apiObject(name, obj))
+	case "DELETE":
+		delete(h.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		h.error(w, http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *gcsStubHandler) serveUpload(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || r.FormValue("uploadType") != "multipart" || mediaType != "multipart/related" {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	var meta storage.Object
+	if err := json.NewDecoder(part).Decode(&meta); err != nil || meta.Name == "" {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(part)
+	if err != nil {
+		h.error(w, http.StatusBadRequest)
+		return
+	}
+	if meta.Md5Hash != "" {
+		sum := md5.Sum(data)
+		if meta.Md5Hash != base64.StdEncoding.EncodeToString(sum[:]) {
+			h.error(w, http.StatusBadRequest)
+			return
+		}
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.generation++
+	obj := &gcsStubObject{
+		data:           data,
+		metadata:       meta.Metadata,
+		generation:     h.generation,
+		metageneration: 1,
+		updated:        time.Now(),
+	}
+	h.objects[meta.Name] = obj
+	json.NewEncoder(w).Encode(h.apiObject(meta.Name, obj))
+}
+
+func (h *gcsStubHandler) serveList(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	prefix := r.FormValue("prefix")
+	pageToken := r.FormValue("pageToken")
+	limit, err := strconv.Atoi(r.FormValue("maxResults"))
+	if err != nil || limit < 1 {
+		limit = 1000
+	}
+	var names []string
+	for name := range h.objects {
+		if strings.HasPrefix(name, prefix) && name > pageToken {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var resp storage.Objects
+	for _, name := range names {
+		if len(resp.Items) == limit {
+			resp.NextPageToken = resp.Items[len(resp.Items)-1].Name
+			break
+		}
+		resp.Items = append(resp.Items, h.apiObject(name, h.objects[name]))
+	}
+	json.NewEncoder(w).Encode(&resp)
+}
+
+func (h *gcsStubHandler) setMtime(name string, t time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	obj, ok := h.objects[name]
+	if !ok {
+		return
+	}
+	md := map[string]string{gcsMtimeKey: strconv.FormatInt(t.UnixNano(), 10)}
+	for k, v := range obj.metadata {
+		if k != gcsMtimeKey {
+			md[k] = v
+		}
+	}
+	obj.metadata = md
+	obj.metageneration++
+}
+
+type testableGCSVolume struct {
+	*gcsVolume
+	stubHandler *gcsStubHandler
+	stub        *httptest.Server
+}
+
+func (s *gcsVolumeSuite) newTestableVolume(c *check.C, params newVolumeParams) *testableGCSVolume {
+	h := newGCSStubHandler("test-bucket")
+	stub := httptest.NewServer(h)
+	credsFile := s.writeCredentials(c, stub.URL+"/token")
+	v := &gcsVolume{
+		GCSVolumeDriverParameters: arvados.GCSVolumeDriverParameters{
+			Bucket:          "test-bucket",
+			CredentialsFile: credsFile,
+			Endpoint:        stub.URL + "/storage/v1/",
+		},
+		cluster:    params.Cluster,
+		volume:     params.ConfigVolume,
+		logger:     ctxlog.TestLogger(c),
+		metrics:    params.MetricsVecs,
+		bufferPool: params.BufferPool,
+	}
+	c.Assert(v.check(), check.IsNil)
+	return &testableGCSVolume{
+		gcsVolume:   v,
+		stubHandler: h,
+		stub:        stub,
+	}
+}
+
+// writeCredentials writes a service account key file that directs
+// the OAuth2 client to the given token URL, and returns its path.
+func (s *gcsVolumeSuite) writeCredentials(c *check.C, tokenURL string) string {
+	buf, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "test-project",
+		"private_key_id": "abcdef",
+		"private_key":    s.privateKey,
+		"client_email":   "keepstore@test-project.iam.gserviceaccount.com",
+		"client_id":      "123456",
+		"token_uri":      tokenURL,
+	})
+	c.Assert(err, check.IsNil)
+	fnm := filepath.Join(c.MkDir(), "credentials.json")
+	c.Assert(os.WriteFile(fnm, buf, 0600), check.IsNil)
+	return fnm
+}
+
+func (v *testableGCSVolume) TouchWithDate(hash string, t time.Time) {
+	v.stubHandler.setMtime(hash, t)
+}
+
+func (v *testableGCSVolume) Teardown() {
+	v.stub.Close()
+}
+
+func (v *testableGCSVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return "get", "put"
+}
+
+var _ = check.Suite(&gcsVolumeSuite{})
+
+type gcsVolumeSuite struct {
+	params     newVolumeParams
+	privateKey string
+}
+
+func (s *gcsVolumeSuite) SetUpSuite(c *check.C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, check.IsNil)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	c.Assert(err, check.IsNil)
+	s.privateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func (s *gcsVolumeSuite) SetUpTest(c *check.C) {
+	logger := ctxlog.TestLogger(c)
+	reg := prometheus.NewRegistry()
+	s.params = newVolumeParams{
+		UUID:        "zzzzz-nyw5e-999999999999999",
+		Cluster:     testCluster(c),
+		Logger:      logger,
+		MetricsVecs: newVolumeMetricsVecs(reg),
+		BufferPool:  newBufferPool(logger, 8, reg),
+	}
+}
+
+func (s *gcsVolumeSuite) TestGeneric(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableVolume(c, params)
+	})
+}
+
+func (s *gcsVolumeSuite) TestGenericReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableVolume(c, params)
+	})
+}
+
+func (s *gcsVolumeSuite) TestNewVolumeFromConfig(c *check.C) {
+	credsFile := s.writeCredentials(c, "http://localhost:1/token")
+	for _, trial := range []struct {
+		params   string
+		deviceID string
+	}{
+		{`{}`, ""},
+		{`{"Bucket": "b", "CredentialsFile": "/nonexistent"}`, ""},
+		{`{"Bucket": "b", "CredentialsFile": "` + credsFile + `", "Endpoint": "ftp://example.com/"}`, ""},
+		{`{"Bucket": "b", "CredentialsFile": "` + credsFile + `"}`, "gs://b"},
+		{`{"Bucket": "b", "CredentialsFile": "` + credsFile + `", "Endpoint": "https://gcs.example.com/storage/v1/"}`, "gs://b@gcs.example.com/storage/v1/"},
+	} {
+		c.Logf("trial: %s", trial.params)
+		params := s.params
+		params.ConfigVolume.DriverParameters = json.RawMessage(trial.params)
+		v, err := newGCSVolume(params)
+		if trial.deviceID == "" {
+			c.Check(err, check.NotNil)
+			continue
+		}
+		c.Assert(err, check.IsNil)
+		c.Check(v.DeviceID(), check.Equals, trial.deviceID)
+	}
+}
+
+func (s *gcsVolumeSuite) TestIndexPaging(c *check.C) {
+	v := s.newTestableVolume(c, s.params)
+	defer v.Teardown()
+	v.IndexPageSize = 3
+	for i := 0; i < 64; i++ {
+		data := []byte(fmt.Sprintf("%d", i))
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		c.Assert(v.BlockWrite(context.Background(), hash, data), check.IsNil)
+	}
+	buf := new(bytes.Buffer)
+	c.Check(v.Index(context.Background(), "", buf), check.IsNil)
+	c.Check(strings.Count(buf.String(), "\n"), check.Equals, 64)
+
+	buf.Reset()
+	c.Check(v.Index(context.Background(), "c", buf), check.IsNil)
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		c.Check(line, check.Matches, `c[0-9a-f]{31}\+\d+ \d+`)
+	}
+}
+
+func (s *gcsVolumeSuite) TestBadChecksumRejected(c *check.C) {
+	v := s.newTestableVolume(c, s.params)
+	defer v.Teardown()
+	err := v.BlockWrite(context.Background(), fooHash, []byte("bar"))
+	c.Check(err, check.ErrorMatches, `.*400.*`)
+	err = v.BlockRead(context.Background(), fooHash, brdiscard)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+
+	// Data stored by another volume (e.g., an erasure-coded
+	// shard) doesn't match its hash, and isn't checked.
+	v.encodedData = true
+	err = v.BlockWrite(context.Background(), fooHash, []byte("bar"))
+	c.Check(err, check.IsNil)
+}
+
+func (s *gcsVolumeSuite) TestTrashRace(c *check.C) {
+	v := s.newTestableVolume(c, s.params)
+	defer v.Teardown()
+	s.params.Cluster.Collections.BlobTrashLifetime = arvados.Duration(time.Hour)
+	c.Assert(v.BlockWrite(context.Background(), fooHash, []byte("foo")), check.IsNil)
+	v.TouchWithDate(fooHash, time.Now().Add(-2*s.params.Cluster.Collections.BlobSigningTTL.Duration()))
+
+	// Simulate the block being touched after BlockTrash checks
+	// its timestamp: the trash request must fail.
+	obj, err := v.attrs(context.Background(), fooHash)
+	c.Assert(err, check.IsNil)
+	c.Assert(v.BlockTouch(fooHash), check.IsNil)
+	err = v.patch(obj, map[string]string{gcsExpiresAtKey: "1"})
+	c.Check(isPreconditionFailed(err), check.Equals, true)
+	_, err = v.Mtime(fooHash)
+	c.Check(err, check.IsNil)
+}
+
+func (s *gcsVolumeSuite) TestBlockReadContextCancel(c *check.C) {
+	v := s.newTestableVolume(c, s.params)
+	defer v.Teardown()
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	v.stubHandler.blockGet = make(chan struct{})
+	defer close(v.stubHandler.blockGet)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := v.BlockRead(ctx, TestHash, brdiscard)
+	c.Check(err, check.Equals, context.DeadlineExceeded)
+}
+
+func (s *gcsVolumeSuite) TestSizeHints(c *check.C) {
+	v := s.newTestableVolume(c, s.params)
+	defer v.Teardown()
+	s.params.Cluster.Collections.BlobTrashLifetime = arvados.Duration(time.Hour)
+	c.Check(supportsSizeHints(v.gcsVolume), check.Equals, true)
+	c.Assert(v.BlockWriteSizeHint(context.Background(), fooHash, []byte("foo"), 1234), check.IsNil)
+	c.Assert(v.BlockWrite(context.Background(), barHash, []byte("bar")), check.IsNil)
+
+	buf := new(bytes.Buffer)
+	c.Check(v.IndexSizeHints(context.Background(), "", false, buf), check.IsNil)
+	c.Check(buf.String(), check.Matches, `(?ms).*^`+fooHash+`\+3 \d+ 1234$.*`)
+	c.Check(buf.String(), check.Matches, `(?ms).*^`+barHash+`\+3 \d+ -1$.*`)
+	c.Check(v.IndexSizeHints(context.Background(), "", true, buf), check.Equals, errNoReadTimes)
+
+	// Trashing, untrashing, and rewriting the block keep the
+	// size hint.
+	v.TouchWithDate(fooHash, time.Now().Add(-2*s.params.Cluster.Collections.BlobSigningTTL.Duration()))
+	c.Assert(v.BlockTrash(fooHash), check.IsNil)
+	c.Assert(v.BlockUntrash(fooHash), check.IsNil)
+	c.Assert(v.BlockRewrite(context.Background(), fooHash, []byte("foo")), check.IsNil)
+	buf.Reset()
+	c.Check(v.IndexSizeHints(context.Background(), fooHash, false, buf), check.IsNil)
+	c.Check(buf.String(), check.Matches, fooHash+`\+3 \d+ 1234\n`)
+
+	// Index does not report size hints.
+	buf.Reset()
+	c.Check(v.Index(context.Background(), fooHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Matches, fooHash+`\+3 \d+\n`)
+}
+
+func (s *gcsVolumeSuite) TestStats(c *check.C) {
+	v := s.newTestableVolume(c, s.params)
+	defer v.Teardown()
+
+	stats := func() string {
+		buf, err := json.Marshal(v.InternalStats())
+		c.Check(err, check.IsNil)
+		return string(buf)
+	}
+
+	c.Check(stats(), check.Matches, `.*"Ops":0,.*`)
+
+	err := v.BlockRead(context.Background(), fooHash, brdiscard)
+	c.Check(err, check.NotNil)
+	c.Check(stats(), check.Matches, `.*"Ops":[^0],.*`)
+	c.Check(stats(), check.Matches, `.*"Errors":[^0],.*`)
+	c.Check(stats(), check.Matches, `.*"\*googleapi\.Error 404":[^0].*`)
+	c.Check(stats(), check.Matches, `.*"InBytes":0,.*`)
+
+	err = v.BlockWrite(context.Background(), fooHash, []byte("foo"))
+	c.Check(err, check.IsNil)
+	c.Check(stats(), check.Matches, `.*"OutBytes":3,.*`)
+	c.Check(stats(), check.Matches, `.*"PutOps":1,.*`)
+
+	err = v.BlockRead(context.Background(), fooHash, brdiscard)
+	c.Check(err, check.IsNil)
+	err = v.BlockRead(context.Background(), fooHash, brdiscard)
+	c.Check(err, check.IsNil)
+	c.Check(stats(), check.Matches, `.*"InBytes":6,.*`)
+}
@@ -0,0 +1,635 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	driver["HTTPBlob"] = newHTTPBlobVolume
+}
+
+const (
+	httpBlobDefaultConnectTimeout = arvados.Duration(time.Minute)
+	httpBlobDefaultReadTimeout    = arvados.Duration(10 * time.Minute)
+	httpBlobDefaultIndexPageSize  = 1000
+)
+
+// httpBlobVolume stores blocks in an object store that speaks a
+// minimal REST dialect, relative to the configured Endpoint URL:
+//
+//	PUT {Endpoint}{key}     store an object (must be atomic)
+//	GET {Endpoint}{key}     retrieve an object
+//	HEAD {Endpoint}{key}    retrieve Content-Length and Last-Modified
+//	DELETE {Endpoint}{key}  delete an object
+//	GET {Endpoint}?prefix={prefix}&marker={marker}&limit={n}
+//	                        list objects (see httpBlobListResponse)
+//
+// A missing object is reported with status 404. Objects are never
+// modified in place, so timestamps and trash state are kept in
+// separate zero-length marker objects, similar to the S3 driver:
+//
+//	{hash}        block data
+//	recent/{hash} last-modified time is the block's Mtime
+//	trash/{hash}  if present, the block is trashed; last-modified
+//	              time is when it was trashed
+type httpBlobVolume struct {
+	arvados.HTTPBlobVolumeDriverParameters
+
+	cluster    *arvados.Cluster
+	volume     arvados.Volume
+	logger     logrus.FieldLogger
+	metrics    *volumeMetricsVecs
+	bufferPool *bufferPool
+	client     *http.Client
+	endpoint   *url.URL
+	stats      httpBlobStats
+
+	encodedData bool
+}
+
+// httpBlobListResponse is the expected response to a list request.
+// Items must be sorted by name, and must include only objects whose
+// names start with the given prefix and sort after the given marker.
+// NextMarker is empty if there are no more items to list.
+type httpBlobListResponse struct {
+	Items      []httpBlobListItem `json:"items"`
+	NextMarker string             `json:"next_marker"`
+}
+
+type httpBlobListItem struct {
+	Name  string    `json:"name"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+}
+
+// httpBlobStatusError is returned when the backend responds with an
+// unexpected HTTP status.
+type httpBlobStatusError struct {
+	Method     string
+	Key        string
+	StatusCode int
+	Status     string
+}
+
+func (e *httpBlobStatusError) Error() string {
+	return fmt.Sprintf("%s %q: %s", e.Method, e.Key, e.Status)
+}
+
+func newHTTPBlobVolume(params newVolumeParams) (volume, error) {
+	v := &httpBlobVolume{
+		cluster:     params.Cluster,
+		volume:      params.ConfigVolume,
+		metrics:     params.MetricsVecs,
+		bufferPool:  params.BufferPool,
+		encodedData: params.EncodedData,
+	}
+	err := json.Unmarshal(params.ConfigVolume.DriverParameters, v)
+	if err != nil {
+		return nil, err
+	}
+	v.logger = params.Logger.WithField("Volume", v.DeviceID())
+	return v, v.check()
+}
+
+func (v *httpBlobVolume) check() error {
+	if v.Endpoint == "" {
+		return errors.New("DriverParameters: Endpoint must be provided")
+	}
+	u, err := url.Parse(v.Endpoint)
+	if err != nil {
+		return fmt.Errorf("error parsing Endpoint %q: %w", v.Endpoint, err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid Endpoint %q: scheme must be http or https", v.Endpoint)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	v.endpoint = u
+	if v.IndexPageSize == 0 {
+		v.IndexPageSize = httpBlobDefaultIndexPageSize
+	}
+	// Zero timeouts mean "wait forever", which is a bad
+	// default. Default to long timeouts instead.
+	if v.ConnectTimeout == 0 {
+		v.ConnectTimeout = httpBlobDefaultConnectTimeout
+	}
+	if v.ReadTimeout == 0 {
+		v.ReadTimeout = httpBlobDefaultReadTimeout
+	}
+	v.client = &http.Client{
+		Timeout: v.ReadTimeout.Duration(),
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   v.ConnectTimeout.Duration(),
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: v.Insecure},
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	lbls := prometheus.Labels{"device_id": v.DeviceID()}
+	v.stats.opsCounters, v.stats.errCounters, v.stats.ioBytes = v.metrics.getCounterVecsFor(lbls)
+	return nil
+}
+
+// DeviceID returns a globally unique ID for the storage endpoint.
+func (v *httpBlobVolume) DeviceID() string {
+	return "httpblob://" + strings.TrimPrefix(strings.TrimPrefix(v.Endpoint, "https://"), "http://")
+}
+
+// do sends a request for the given object key (or, if key is empty,
+// the endpoint itself) and returns the response. If the response
+// status is not 2xx, the response body is closed and an error is
+// returned.
+func (v *httpBlobVolume) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, hdr http.Header) (*http.Response, error) {
+	u := *v.endpoint
+	u.Path += key
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vals := range hdr {
+		req.Header[k] = vals
+	}
+	if v.AuthorizationHeader != "" {
+		req.Header.Set("Authorization", v.AuthorizationHeader)
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			// Ensure we send "Content-Length: 0"
+			// instead of chunked encoding.
+			req.Body = http.NoBody
+		}
+	}
+	resp, err := v.client.Do(req)
+	if err == nil && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 65536))
+		resp.Body.Close()
+		err = &httpBlobStatusError{
+			Method:     method,
+			Key:        key,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+		resp = nil
+	}
+	v.stats.TickErr(err)
+	return resp, err
+}
+
+// If possible, translate an error returned by do() to a recognizable
+// error like os.ErrNotExist.
+func (v *httpBlobVolume) translateError(err error) error {
+	var serr *httpBlobStatusError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.Canceled):
+		return context.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return context.DeadlineExceeded
+	case errors.As(err, &serr) && serr.StatusCode == http.StatusNotFound:
+		return os.ErrNotExist
+	case errors.As(err, &serr) && serr.StatusCode == http.StatusServiceUnavailable:
+		return errVolumeUnavailable
+	default:
+		return err
+	}
+}
+
+// head returns the Last-Modified time of the given object.
+func (v *httpBlobVolume) head(key string) (time.Time, error) {
+	v.stats.TickOps("head")
+	v.stats.Tick(&v.stats.Ops, &v.stats.HeadOps)
+	resp, err := v.do(context.Background(), "HEAD", key, nil, nil, 0, nil)
+	if err != nil {
+		return time.Time{}, v.translateError(err)
+	}
+	resp.Body.Close()
+	t, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("HEAD %q: error parsing Last-Modified header: %w", key, err)
+	}
+	return t, nil
+}
+
+func (v *httpBlobVolume) put(ctx context.Context, key string, data []byte) error {
+	v.stats.TickOps("put")
+	v.stats.Tick(&v.stats.Ops, &v.stats.PutOps)
+	hdr := http.Header{"Content-Type": {"application/octet-stream"}}
+	if v.isKeepBlock(key) && !v.encodedData {
+		md5, err := hex.DecodeString(key)
+		if err != nil {
+			return err
+		}
+		hdr.Set("Content-Md5", base64.StdEncoding.EncodeToString(md5))
+	}
+	body := newCountingReader(bytes.NewReader(data), v.stats.TickOutBytes)
+	resp, err := v.do(ctx, "PUT", key, nil, body, int64(len(data)), hdr)
+	if err != nil {
+		return v.translateError(err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (v *httpBlobVolume) del(key string) error {
+	v.stats.TickOps("delete")
+	v.stats.Tick(&v.stats.Ops, &v.stats.DelOps)
+	resp, err := v.do(context.Background(), "DELETE", key, nil, nil, 0, nil)
+	if err != nil {
+		return v.translateError(err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (v *httpBlobVolume) isKeepBlock(s string) bool {
+	return keepBlockRegexp.MatchString(s)
+}
+
+// checkTrashed returns os.ErrNotExist if the given block has a trash
+// marker, nil if it doesn't, or some other error if the backend could
+// not tell us.
+func (v *httpBlobVolume) checkTrashed(hash string) error {
+	_, err := v.head("trash/" + hash)
+	if err == nil {
+		return os.ErrNotExist
+	} else if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// BlockRead reads a Keep block from the backend.
+func (v *httpBlobVolume) BlockRead(ctx context.Context, hash string, w io.WriterAt) error {
+	if err := v.checkTrashed(hash); err != nil {
+		return err
+	}
+	v.stats.TickOps("get")
+	v.stats.Tick(&v.stats.Ops, &v.stats.GetOps)
+	resp, err := v.do(ctx, "GET", hash, nil, nil, 0, nil)
+	if err != nil {
+		return v.translateError(err)
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength > maxStoredBlockSize {
+		return fmt.Errorf("GET %q: invalid size %d (max %d)", hash, resp.ContentLength, maxStoredBlockSize)
+	}
+	n, err := io.Copy(io.NewOffsetWriter(w, 0), newCountingReader(resp.Body, v.stats.TickInBytes))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		v.stats.TickErr(err)
+		return err
+	} else if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return fmt.Errorf("GET %q: short read (%d of %d bytes)", hash, n, resp.ContentLength)
+	}
+	return nil
+}
+
+// BlockWrite stores a block on the backend, and updates its
+// timestamp. If the block was in the trash, it is untrashed.
+func (v *httpBlobVolume) BlockWrite(ctx context.Context, hash string, data []byte) error {
+	err := v.put(ctx, hash, data)
+	if err != nil {
+		return err
+	}
+	err = v.put(ctx, "recent/"+hash, nil)
+	if err != nil {
+		return err
+	}
+	err = v.del("trash/" + hash)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// BlockTouch sets the timestamp for the given block to the current
+// time.
+func (v *httpBlobVolume) BlockTouch(hash string) error {
+	if err := v.checkTrashed(hash); err != nil {
+		return err
+	}
+	if _, err := v.head(hash); err != nil {
+		return err
+	}
+	return v.put(context.Background(), "recent/"+hash, nil)
+}
+
+// Mtime returns the stored timestamp for the given block.
+func (v *httpBlobVolume) Mtime(hash string) (time.Time, error) {
+	if err := v.checkTrashed(hash); err != nil {
+		return time.Time{}, err
+	}
+	datatime, err := v.head(hash)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := v.head("recent/" + hash)
+	if os.IsNotExist(err) {
+		// Block was stored by some other means, without a
+		// recent/X marker. Use the timestamp on the data
+		// object itself.
+		return datatime, nil
+	}
+	return t, err
+}
+
+// BlockTrash marks the given block as trash. If BlobTrashLifetime is
+// zero, the block is deleted immediately.
+func (v *httpBlobVolume) BlockTrash(hash string) error {
+	if t, err := v.Mtime(hash); err != nil {
+		return err
+	} else if time.Since(t) < v.cluster.Collections.BlobSigningTTL.Duration() {
+		return nil
+	}
+	if v.cluster.Collections.BlobTrashLifetime == 0 {
+		err := v.del(hash)
+		if err != nil {
+			return err
+		}
+		err = v.del("recent/" + hash)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return v.put(context.Background(), "trash/"+hash, nil)
+}
+
+// BlockUntrash removes the trash marker for the given block.
+func (v *httpBlobVolume) BlockUntrash(hash string) error {
+	if _, err := v.head("trash/" + hash); err != nil {
+		return err
+	}
+	if _, err := v.head(hash); err != nil {
+		return err
+	}
+	err := v.del("trash/" + hash)
+	if err != nil {
+		return err
+	}
+	return v.put(context.Background(), "recent/"+hash, nil)
+}
+
+// EmptyTrash deletes blocks whose trash markers are older than
+// BlobTrashLifetime.
+func (v *httpBlobVolume) EmptyTrash() {
+	var bytesDeleted, blocksDeleted, blocksInTrash int64
+
+	// Define "ready to delete" as "...when EmptyTrash started".
+	startT := time.Now()
+
+	emptyOne := func(trash *httpBlobListItem) {
+		hash := strings.TrimPrefix(trash.Name, "trash/")
+		if !v.isKeepBlock(hash) {
+			return
+		}
+		atomic.AddInt64(&blocksInTrash, 1)
+		if startT.Sub(trash.Mtime) < v.cluster.Collections.BlobTrashLifetime.Duration() {
+			return
+		}
+		if recent, err := v.head("recent/" + hash); err == nil && recent.After(trash.Mtime) {
+			// The block was written again after it was
+			// trashed, but the writer's attempt to delete
+			// the trash marker has not taken effect yet
+			// (or failed).
+			v.logger.Infof("EmptyTrash: %s was written (%s) after it was trashed (%s), removing trash marker", hash, recent, trash.Mtime)
+			if err := v.del(trash.Name); err != nil && !os.IsNotExist(err) {
+				v.logger.WithError(err).Warnf("EmptyTrash: error deleting %q", trash.Name)
+			}
+			return
+		}
+		size, err := v.headSize(hash)
+		if err != nil && !os.IsNotExist(err) {
+			v.logger.WithError(err).Warnf("EmptyTrash: HEAD %q failed", hash)
+			return
+		}
+		// Delete the data object first, so if anything goes
+		// wrong, the trash marker is still there and we'll
+		// try again next time.
+		for _, key := range []string{hash, "recent/" + hash, trash.Name} {
+			err := v.del(key)
+			if err != nil && !os.IsNotExist(err) {
+				v.logger.WithError(err).Errorf("EmptyTrash: error deleting %q", key)
+				return
+			}
+		}
+		atomic.AddInt64(&bytesDeleted, size)
+		atomic.AddInt64(&blocksDeleted, 1)
+	}
+
+	var wg sync.WaitGroup
+	todo := make(chan *httpBlobListItem, v.cluster.Collections.BlobDeleteConcurrency)
+	for i := 0; i < v.cluster.Collections.BlobDeleteConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for trash := range todo {
+				emptyOne(trash)
+			}
+		}()
+	}
+
+	trashL := httpBlobLister{volume: v, prefix: "trash/"}
+	for trash := trashL.Next(context.Background()); trash != nil; trash = trashL.Next(context.Background()) {
+		todo <- trash
+	}
+	close(todo)
+	wg.Wait()
+
+	if err := trashL.Error(); err != nil {
+		v.logger.WithError(err).Error("EmptyTrash: lister failed")
+	}
+	v.logger.Infof("EmptyTrash: stats for %v: Deleted %v bytes in %v blocks. Remaining in trash: %v blocks.", v.DeviceID(), bytesDeleted, blocksDeleted, blocksInTrash-blocksDeleted)
+}
+
+// headSize returns the Content-Length of the given object.
+func (v *httpBlobVolume) headSize(key string) (int64, error) {
+	v.stats.TickOps("head")
+	v.stats.Tick(&v.stats.Ops, &v.stats.HeadOps)
+	resp, err := v.do(context.Background(), "HEAD", key, nil, nil, 0, nil)
+	if err != nil {
+		return 0, v.translateError(err)
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// Index writes a list of non-trashed blocks whose hashes begin with
+// the given prefix.
+func (v *httpBlobVolume) Index(ctx context.Context, prefix string, writer io.Writer) error {
+	// Use a merge sort to find matching sets of X, recent/X, and
+	// trash/X.
+	dataL := httpBlobLister{volume: v, prefix: prefix}
+	recentL := httpBlobLister{volume: v, prefix: "recent/" + prefix}
+	trashL := httpBlobLister{volume: v, prefix: "trash/" + prefix}
+	recent := recentL.Next(ctx)
+	trash := trashL.Next(ctx)
+	for data := dataL.Next(ctx); data != nil; data = dataL.Next(ctx) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if data.Name >= "g" {
+			// "recent/*" and "trash/*" are lexically
+			// greater than all hex-encoded data hashes,
+			// so we can stop here.
+			break
+		}
+		hash := data.Name
+		if !v.isKeepBlock(hash) {
+			continue
+		}
+		for trash != nil && trash.Name[6:] < hash {
+			trash = trashL.Next(ctx)
+		}
+		if trash != nil && trash.Name[6:] == hash {
+			continue
+		}
+		stamp := data
+		for recent != nil && recent.Name[7:] < hash {
+			recent = recentL.Next(ctx)
+		}
+		if recent != nil && recent.Name[7:] == hash {
+			stamp = recent
+		}
+		// We truncate sub-second precision here. Otherwise
+		// timestamps will never match the RFC1123-formatted
+		// Last-Modified values returned by Mtime().
+		fmt.Fprintf(writer, "%s+%d %d\n", hash, data.Size, stamp.Mtime.Unix()*1000000000)
+	}
+	for _, l := range []*httpBlobLister{&dataL, &recentL, &trashL} {
+		if err := l.Error(); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// InternalStats returns API call and I/O counters.
+func (v *httpBlobVolume) InternalStats() interface{} {
+	return &v.stats
+}
+
+// httpBlobLister iterates over the objects whose names begin with
+// the given prefix, fetching one page at a time.
+type httpBlobLister struct {
+	volume *httpBlobVolume
+	prefix string
+	marker string
+	buf    []httpBlobListItem
+	done   bool
+	err    error
+}
+
+// Next returns the next item, fetching the next page if necessary. It
+// returns nil if the last available item has already been returned,
+// or an error occurs.
+func (l *httpBlobLister) Next(ctx context.Context) *httpBlobListItem {
+	for len(l.buf) == 0 && !l.done && l.err == nil {
+		l.getPage(ctx)
+	}
+	if len(l.buf) == 0 {
+		return nil
+	}
+	item := &l.buf[0]
+	l.buf = l.buf[1:]
+	return item
+}
+
+// Error returns the most recent error encountered by Next.
+func (l *httpBlobLister) Error() error {
+	return l.err
+}
+
+func (l *httpBlobLister) getPage(ctx context.Context) {
+	v := l.volume
+	v.stats.TickOps("list")
+	v.stats.Tick(&v.stats.Ops, &v.stats.ListOps)
+	query := url.Values{
+		"prefix": {l.prefix},
+		"limit":  {strconv.Itoa(v.IndexPageSize)},
+	}
+	if l.marker != "" {
+		query.Set("marker", l.marker)
+	}
+	resp, err := v.do(ctx, "GET", "", query, nil, 0, nil)
+	if err != nil {
+		l.err = v.translateError(err)
+		return
+	}
+	defer resp.Body.Close()
+	var page httpBlobListResponse
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	if err != nil {
+		l.err = fmt.Errorf("error decoding list response: %w", err)
+		v.stats.TickErr(l.err)
+		return
+	}
+	l.buf = make([]httpBlobListItem, 0, len(page.Items))
+	for _, item := range page.Items {
+		if !strings.HasPrefix(item.Name, l.prefix) {
+			v.logger.Warnf("httpBlobLister: list(prefix=%q) returned name %q", l.prefix, item.Name)
+			continue
+		}
+		l.buf = append(l.buf, item)
+	}
+	if page.NextMarker == "" || page.NextMarker == l.marker {
+		l.done = true
+	}
+	l.marker = page.NextMarker
+}
+
+type httpBlobStats struct {
+	statsTicker
+	Ops     uint64
+	GetOps  uint64
+	PutOps  uint64
+	HeadOps uint64
+	DelOps  uint64
+	ListOps uint64
+}
+
+func (s *httpBlobStats) TickErr(err error) {
+	if err == nil {
+		return
+	}
+	errType := fmt.Sprintf("%T", err)
+	var serr *httpBlobStatusError
+	if errors.As(err, &serr) {
+		errType = errType + fmt.Sprintf(" %d", serr.StatusCode)
+	}
+	s.statsTicker.TickErr(err, errType)
+}
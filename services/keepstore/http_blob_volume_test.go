@@ -0,0 +1,320 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"git.arvados.org/arvados.git/sdk/go/ctxlog"
+	"github.com/prometheus/client_golang/prometheus"
+	check "gopkg.in/check.v1"
+)
+
+type httpBlobStubObject struct {
+	Data  []byte
+	Mtime time.Time
+}
+
+// httpBlobStubHandler is an in-memory implementation of the object
+// store API used by httpBlobVolume.
+type httpBlobStubHandler struct {
+	sync.Mutex
+	objects map[string]*httpBlobStubObject
+	// If not empty, reject requests that don't have this
+	// Authorization header.
+	authorization string
+	// If not nil, GET requests for block data wait until this
+	// channel is closed.
+	blockGet chan struct{}
+}
+
+func newHTTPBlobStubHandler() *httpBlobStubHandler {
+	return &httpBlobStubHandler{objects: map[string]*httpBlobStubObject{}}
+}
+
+func (h *httpBlobStubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.authorization != "" && r.Header.Get("Authorization") != h.authorization {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if key == "" && r.Method == "GET" {
+		h.serveList(w, r)
+		return
+	}
+	if r.Method == "GET" && h.blockGet != nil && keepBlockRegexp.MatchString(key) {
+		select {
+		case <-h.blockGet:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	h.Lock()
+	defer h.Unlock()
+	obj := h.objects[key]
+	switch r.Method {
+	case "PUT":
+		if r.Header.Get("Content-Length") == "" {
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		h.objects[key] = &httpBlobStubObject{Data: data, Mtime: time.Now()}
+		w.WriteHeader(http.StatusCreated)
+	case "GET", "HEAD":
+		if obj == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.Data)))
+		w.Header().Set("Last-Modified", obj.Mtime.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			w.Write(obj.Data)
+		}
+	case "DELETE":
+		if obj == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(h.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *httpBlobStubHandler) serveList(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	prefix := r.FormValue("prefix")
+	marker := r.FormValue("marker")
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit < 1 {
+		limit = 1000
+	}
+	var names []string
+	for name := range h.objects {
+		if strings.HasPrefix(name, prefix) && name > marker {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var resp httpBlobListResponse
+	for _, name := range names {
+		if len(resp.Items) == limit {
+			resp.NextMarker = resp.Items[len(resp.Items)-1].Name
+			break
+		}
+		obj := h.objects[name]
+		resp.Items = append(resp.Items, httpBlobListItem{
+			Name:  name,
+			Size:  int64(len(obj.Data)),
+			Mtime: obj.Mtime,
+		})
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *httpBlobStubHandler) setMtime(key string, t time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	if obj, ok := h.objects[key]; ok {
+		obj.Mtime = t
+	} else {
+		h.objects[key] = &httpBlobStubObject{Mtime: t}
+	}
+}
+
+type testableHTTPBlobVolume struct {
+	*httpBlobVolume
+	stubHandler *httpBlobStubHandler
+	stub        *httptest.Server
+}
+
+func (s *httpBlobVolumeSuite) newTestableVolume(c *check.C, params newVolumeParams) *testableHTTPBlobVolume {
+	h := newHTTPBlobStubHandler()
+	stub := httptest.NewServer(h)
+	v := &httpBlobVolume{
+		HTTPBlobVolumeDriverParameters: arvados.HTTPBlobVolumeDriverParameters{
+			Endpoint: stub.URL + "/",
+		},
+		cluster:    params.Cluster,
+		volume:     params.ConfigVolume,
+		logger:     ctxlog.TestLogger(c),
+		metrics:    params.MetricsVecs,
+		bufferPool: params.BufferPool,
+	}
+	c.Assert(v.check(), check.IsNil)
+	return &testableHTTPBlobVolume{
+		httpBlobVolume: v,
+		stubHandler:    h,
+		stub:           stub,
+	}
+}
+
+func (v *testableHTTPBlobVolume) TouchWithDate(hash string, t time.Time) {
+	v.stubHandler.setMtime("recent/"+hash, t)
+}
+
+func (v *testableHTTPBlobVolume) Teardown() {
+	v.stub.Close()
+}
+
+func (v *testableHTTPBlobVolume) ReadWriteOperationLabelValues() (r, w string) {
+	return "get", "put"
+}
+
+var _ = check.Suite(&httpBlobVolumeSuite{})
+
+type httpBlobVolumeSuite struct {
+	params newVolumeParams
+}
+
+func (s *httpBlobVolumeSuite) SetUpTest(c *check.C) {
+	logger := ctxlog.TestLogger(c)
+	reg := prometheus.NewRegistry()
+	s.params = newVolumeParams{
+		UUID:        "zzzzz-nyw5e-999999999999999",
+		Cluster:     testCluster(c),
+		Logger:      logger,
+		MetricsVecs: newVolumeMetricsVecs(reg),
+		BufferPool:  newBufferPool(logger, 8, reg),
+	}
+}
+
+func (s *httpBlobVolumeSuite) TestGeneric(c *check.C) {
+	DoGenericVolumeTests(c, false, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableVolume(c, params)
+	})
+}
+
+func (s *httpBlobVolumeSuite) TestGenericReadOnly(c *check.C) {
+	DoGenericVolumeTests(c, true, func(t TB, params newVolumeParams) TestableVolume {
+		return s.newTestableVolume(c, params)
+	})
+}
+
+func (s *httpBlobVolumeSuite) TestNewVolumeFromConfig(c *check.C) {
+	for _, trial := range []struct {
+		params string
+		ok     bool
+	}{
+		{`{}`, false},
+		{`{"Endpoint": "ftp://example.com/"}`, false},
+		{`{"Endpoint": "https://example.com/keep"}`, true},
+		{`{"Endpoint": "http://example.com/keep/", "IndexPageSize": 10}`, true},
+	} {
+		c.Logf("trial: %s", trial.params)
+		params := s.params
+		params.ConfigVolume.DriverParameters = json.RawMessage(trial.params)
+		v, err := newHTTPBlobVolume(params)
+		if !trial.ok {
+			c.Check(err, check.NotNil)
+			continue
+		}
+		c.Assert(err, check.IsNil)
+		c.Check(v.(*httpBlobVolume).endpoint.Path, check.Equals, "/keep/")
+		c.Check(v.DeviceID(), check.Matches, `httpblob://example\.com/keep/?`)
+	}
+}
+
+func (s *httpBlobVolumeSuite) TestIndexPaging(c *check.C) {
+	v := s.newTestableVolume(c, s.params)
+	defer v.Teardown()
+	v.IndexPageSize = 3
+	for i := 0; i < 256; i++ {
+		data := []byte(fmt.Sprintf("%d", i))
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		c.Assert(v.BlockWrite(context.Background(), hash, data), check.IsNil)
+	}
+	buf := new(bytes.Buffer)
+	c.Check(v.Index(context.Background(), "", buf), check.IsNil)
+	c.Check(strings.Count(buf.String(), "\n"), check.Equals, 256)
+
+	buf.Reset()
+	c.Check(v.Index(context.Background(), "c", buf), check.IsNil)
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		c.Check(line, check.Matches, `c[0-9a-f]{31}\+\d+ \d+`)
+	}
+}
+
+func (s *httpBlobVolumeSuite) TestAuthorizationHeader(c *check.C) {
+	v := s.newTestableVolume(c, s.params)
+	defer v.Teardown()
+	v.stubHandler.authorization = "Bearer foobar"
+
+	err := v.BlockWrite(context.Background(), TestHash, TestBlock)
+	c.Check(err, check.ErrorMatches, `.*401 Unauthorized.*`)
+
+	v.AuthorizationHeader = "Bearer foobar"
+	err = v.BlockWrite(context.Background(), TestHash, TestBlock)
+	c.Check(err, check.IsNil)
+	buf := &brbuffer{}
+	err = v.BlockRead(context.Background(), TestHash, buf)
+	c.Check(err, check.IsNil)
+	c.Check(buf.String(), check.Equals, string(TestBlock))
+}
+
+func (s *httpBlobVolumeSuite) TestBlockReadContextCancel(c *check.C) {
+	v := s.newTestableVolume(c, s.params)
+	defer v.Teardown()
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	v.stubHandler.blockGet = make(chan struct{})
+	defer close(v.stubHandler.blockGet)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := v.BlockRead(ctx, TestHash, brdiscard)
+	c.Check(err, check.Equals, context.DeadlineExceeded)
+}
+
+func (s *httpBlobVolumeSuite) TestStats(c *check.C) {
+	v := s.newTestableVolume(c, s.params)
+	defer v.Teardown()
+
+	stats := func() string {
+		buf, err := json.Marshal(v.InternalStats())
+		c.Check(err, check.IsNil)
+		return string(buf)
+	}
+
+	c.Check(stats(), check.Matches, `.*"Ops":0,.*`)
+
+	err := v.BlockRead(context.Background(), fooHash, brdiscard)
+	c.Check(err, check.NotNil)
+	c.Check(stats(), check.Matches, `.*"Ops":[^0],.*`)
+	c.Check(stats(), check.Matches, `.*"Errors":[^0],.*`)
+	c.Check(stats(), check.Matches, `.*"\*keepstore\.httpBlobStatusError 404":[^0].*`)
+	c.Check(stats(), check.Matches, `.*"InBytes":0,.*`)
+
+	err = v.BlockWrite(context.Background(), fooHash, []byte("foo"))
+	c.Check(err, check.IsNil)
+	c.Check(stats(), check.Matches, `.*"OutBytes":3,.*`)
+	c.Check(stats(), check.Matches, `.*"PutOps":2,.*`)
+
+	err = v.BlockRead(context.Background(), fooHash, brdiscard)
+	c.Check(err, check.IsNil)
+	err = v.BlockRead(context.Background(), fooHash, brdiscard)
+	c.Check(err, check.IsNil)
+	c.Check(stats(), check.Matches, `.*"InBytes":6,.*`)
+}
@@ -39,6 +39,11 @@ import (
 // Maximum size of a keep block is 64 MiB.
 const BlockSize = 1 << 26
 
+// Maximum size of the data stored on a backend device for a single
+// block. This exceeds BlockSize to leave room for metadata added by
+// volume wrappers, e.g., encryption headers.
+const maxStoredBlockSize = BlockSize + 1024
+
 var (
 	errChecksum          = httpserver.ErrorWithStatus(errors.New("checksum mismatch in stored data"), http.StatusBadGateway)
 	errNoTokenProvided   = httpserver.ErrorWithStatus(errors.New("no token provided in Authorization header"), http.StatusUnauthorized)
@@ -50,19 +55,26 @@ var (
 	errInvalidLocator    = httpserver.ErrorWithStatus(errors.New("invalid locator"), http.StatusBadRequest)
 	errFull              = httpserver.ErrorWithStatus(errors.New("insufficient storage"), http.StatusInsufficientStorage)
 	errTooLarge          = httpserver.ErrorWithStatus(errors.New("request entity too large"), http.StatusRequestEntityTooLarge)
+	errNoReadTimes       = httpserver.ErrorWithStatus(errors.New("volume does not record read times"), http.StatusNotImplemented)
+	errNoSizeHints       = httpserver.ErrorWithStatus(errors.New("volume does not store size hints"), http.StatusNotImplemented)
+	errNoJournal         = httpserver.ErrorWithStatus(errors.New("change journal is not enabled"), http.StatusNotImplemented)
+	errJournalExpired    = httpserver.ErrorWithStatus(errors.New("changes since the requested time are no longer available"), http.StatusGone)
 	driver               = make(map[string]volumeDriver)
 )
 
 type indexOptions struct {
 	MountUUID string
 	Prefix    string
+	Since     int64 // only used by IndexChanges
 	WriteTo   io.Writer
 }
 
 type mount struct {
 	arvados.KeepMount
 	volume
-	priority int
+	priority  int
+	readTimes bool           // volume supports BlockMarkRead
+	journal   *changeJournal // nil if not enabled
 }
 
 type keepstore struct {
@@ -78,6 +90,8 @@ type keepstore struct {
 
 	remoteClients    map[string]*keepclient.KeepClient
 	remoteClientsMtx sync.Mutex
+
+	readTimes *readTimeRecorder
 }
 
 func newKeepstore(ctx context.Context, cluster *arvados.Cluster, token string, reg *prometheus.Registry, serviceURL arvados.URL) (*keepstore, error) {
@@ -111,6 +125,7 @@ func newKeepstore(ctx context.Context, cluster *arvados.Cluster, token string, r
 	if err != nil {
 		return nil, err
 	}
+	ks.readTimes = newReadTimeRecorder(ctx, ks)
 
 	return ks, nil
 }
@@ -129,14 +144,29 @@ func (ks *keepstore) setupMounts(metrics *volumeMetricsVecs) error {
 		if !ok {
 			return fmt.Errorf("volume %s: invalid driver %q", uuid, cfgvol.Driver)
 		}
-		vol, err := dri(newVolumeParams{
+		encrypt := cfgvol.Encryption.KeyID != "" || len(cfgvol.Encryption.Keys) > 0
+		params := newVolumeParams{
 			UUID:         uuid,
 			Cluster:      ks.cluster,
 			ConfigVolume: cfgvol,
 			Logger:       ks.logger,
 			MetricsVecs:  metrics,
 			BufferPool:   ks.bufferPool,
-		})
+			EncodedData:  cfgvol.Compression != "" || encrypt,
+		}
+		vol, err := dri(params)
+		if err == nil && cfgvol.Cache.Dir != "" {
+			// Cache the stored (encrypted and compressed)
+			// data, so the cache directory does not hold
+			// plaintext.
+			vol, err = newCachedVolume(vol, params)
+		}
+		if err == nil && encrypt {
+			vol, err = newEncryptedVolume(vol, params)
+		}
+		if err == nil && cfgvol.Compression != "" {
+			vol, err = newCompressedVolume(vol, params)
+		}
 		if err != nil {
 			return fmt.Errorf("error initializing volume %s: %s", uuid, err)
 		}
@@ -148,6 +178,11 @@ func (ks *keepstore) setupMounts(metrics *volumeMetricsVecs) error {
 		if repl < 1 {
 			repl = 1
 		}
+		if rv, ok := vol.(interface{ Replication() int }); ok && rv.Replication() > repl {
+			// Volume provides redundancy internally,
+			// e.g., erasure coding.
+			repl = rv.Replication()
+		}
 		pri := 0
 		for class, in := range cfgvol.StorageClasses {
 			p := ks.cluster.StorageClasses[class].Priority
@@ -156,8 +191,9 @@ func (ks *keepstore) setupMounts(metrics *volumeMetricsVecs) error {
 			}
 		}
 		mnt := &mount{
-			volume:   vol,
-			priority: pri,
+			volume:    vol,
+			priority:  pri,
+			readTimes: supportsReadTimes(vol),
 			KeepMount: arvados.KeepMount{
 				UUID:           uuid,
 				DeviceID:       vol.DeviceID(),
@@ -167,6 +203,9 @@ func (ks *keepstore) setupMounts(metrics *volumeMetricsVecs) error {
 				StorageClasses: sc,
 			},
 		}
+		if ks.cluster.Collections.BalanceFullIndexInterval > 0 {
+			mnt.journal = newChangeJournal()
+		}
 		ks.mounts[uuid] = mnt
 		ks.logger.Printf("started volume %s (%s), AllowWrite=%v, AllowTrash=%v", uuid, vol.DeviceID(), mnt.AllowWrite, mnt.AllowTrash)
 	}
@@ -313,6 +352,9 @@ func (ks *keepstore) BlockRead(ctx context.Context, opts arvados.BlockReadOption
 		// Ensure streamer flushes all buffered data without
 		// errors.
 		err = streamer.Close()
+		if err == nil && ks.isClientRead(ctx) {
+			ks.readTimes.markRead(mnt, li.hash)
+		}
 		return streamer.Wrote(), err
 	}
 	return 0, errToCaller
@@ -704,6 +746,99 @@ func (ks *keepstore) Index(ctx context.Context, opts indexOptions) error {
 	return nil
 }
 
+// IndexChanges writes an index of the blocks on the mount indicated
+// by opts.MountUUID that were added, touched, trashed, or untrashed
+// since opts.Since. Blocks that are currently stored are listed as in
+// Index. Blocks that have been removed are listed as
+// "{hash}+{size} -".
+//
+// It returns errJournalExpired if the mount's change journal does
+// not cover the entire time since opts.Since.
+func (ks *keepstore) IndexChanges(ctx context.Context, opts indexOptions) error {
+	mnt, ok := ks.mounts[opts.MountUUID]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if mnt.journal == nil {
+		return errNoJournal
+	}
+	hashes, sizes, err := mnt.journal.changes(opts.Since, opts.Prefix)
+	if err != nil {
+		return err
+	}
+	// Look up the current state of each changed block before
+	// writing anything, so errors can still be reported in the
+	// response status.
+	var buf bytes.Buffer
+	for i, hash := range hashes {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		size := sizes[i]
+		t, err := mnt.Mtime(hash)
+		if os.IsNotExist(err) {
+			if size < 0 {
+				// Can't tell the caller which entry to
+				// remove.
+				return errJournalExpired
+			}
+			fmt.Fprintf(&buf, "%s+%d -\n", hash, size)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if size < 0 {
+			var ok bool
+			size, ok = mnt.indexSize(ctx, hash)
+			if !ok {
+				// Trashed since we called Mtime.
+				// The caller will get the next
+				// change, or a full index, next time.
+				return errJournalExpired
+			}
+		}
+		fmt.Fprintf(&buf, "%s+%d %d\n", hash, size, t.UnixNano())
+	}
+	_, err = io.Copy(opts.WriteTo, &buf)
+	return err
+}
+
+// indexTime returns the current time, to be used as the "since" time
+// for a subsequent IndexChanges call after the caller receives an
+// Index or IndexChanges response for the given mount. It returns
+// false if the mount does not have a change journal.
+func (ks *keepstore) indexTime(mountUUID string) (int64, bool) {
+	mnt, ok := ks.mounts[mountUUID]
+	if !ok || mnt.journal == nil {
+		return 0, false
+	}
+	return time.Now().UnixNano(), true
+}
+
+// IndexReadTimes writes the read time index (see readTimeVolume) of
+// the mount indicated by opts.MountUUID.
+func (ks *keepstore) IndexReadTimes(ctx context.Context, opts indexOptions) error {
+	mnt, ok := ks.mounts[opts.MountUUID]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if !mnt.readTimes {
+		return errNoReadTimes
+	}
+	return mnt.volume.(readTimeVolume).IndexReadTimes(ctx, opts.Prefix, opts.WriteTo)
+}
+
+// isClientRead returns true if a block read with the given context
+// should count as a read for the purpose of cold storage (see
+// readTimeRecorder). Reads by other keepstore servers' pull workers,
+// and other reads made with the system root token (e.g., by
+// keep-balance), do not count: otherwise, copying a block to a cold
+// storage class would make it look recently read.
+func (ks *keepstore) isClientRead(ctx context.Context) bool {
+	token := ctxToken(ctx)
+	return token != pullWorkerToken && (token == "" || token != ks.cluster.SystemRootToken)
+}
+
 func ctxToken(ctx context.Context) string {
 	if c, ok := auth.FromContext(ctx); ok && len(c.Tokens) > 0 {
 		return c.Tokens[0]
@@ -919,6 +919,19 @@ func (v *stubVolume) BlockWrite(ctx context.Context, hash string, data []byte) e
 	return nil
 }
 
+func (v *stubVolume) BlockRewrite(ctx context.Context, hash string, data []byte) error {
+	v.log("rewrite", hash)
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	ent, ok := v.data[hash]
+	if !ok || !ent.trash.IsZero() {
+		return os.ErrNotExist
+	}
+	ent.data = append([]byte(nil), data...)
+	v.data[hash] = ent
+	return nil
+}
+
 func (v *stubVolume) DeviceID() string {
 	return fmt.Sprintf("%p", v)
 }
@@ -968,6 +981,11 @@ func (v *stubVolume) BlockTrash(hash string) error {
 	if !ok || !ent.trash.IsZero() {
 		return os.ErrNotExist
 	}
+	if time.Since(ent.mtime) < v.params.Cluster.Collections.BlobSigningTTL.Duration() {
+		// Like the real drivers, return success without
+		// trashing recently written blocks.
+		return nil
+	}
 	ent.trash = time.Now().Add(v.params.Cluster.Collections.BlobTrashLifetime.Duration())
 	v.data[hash] = ent
 	return nil
@@ -12,6 +12,10 @@ type volumeMetricsVecs struct {
 	ioBytes     *prometheus.CounterVec
 	errCounters *prometheus.CounterVec
 	opsCounters *prometheus.CounterVec
+
+	cacheRequests  *prometheus.CounterVec
+	cacheEvictions *prometheus.CounterVec
+	cacheBytes     *prometheus.GaugeVec
 }
 
 func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
@@ -46,6 +50,36 @@ func newVolumeMetricsVecs(reg *prometheus.Registry) *volumeMetricsVecs {
 		[]string{"device_id", "direction"},
 	)
 	reg.MustRegister(m.ioBytes)
+	m.cacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_cache_requests",
+			Help:      "Number of block reads from a volume's local cache, by result (hit or miss)",
+		},
+		[]string{"device_id", "result"},
+	)
+	reg.MustRegister(m.cacheRequests)
+	m.cacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_cache_evictions",
+			Help:      "Number of blocks deleted from a volume's local cache to stay within the size limit",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.cacheEvictions)
+	m.cacheBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "volume_cache_bytes",
+			Help:      "Size of a volume's local cache in bytes, as of the last cleanup",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(m.cacheBytes)
 
 	return m
 }
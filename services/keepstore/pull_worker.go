@@ -75,6 +75,11 @@ func (p *puller) SetPullList(newlist []PullListItem) {
 	p.cond.Broadcast()
 }
 
+// pullWorkerToken is the token pull workers send when reading blocks
+// from other keepstore servers. The locators they request are signed
+// with this token, so it doesn't need to be secret.
+const pullWorkerToken = "keepstore-token-used-for-pulling-data-from-same-cluster"
+
 func (p *puller) runWorker(ctx context.Context) {
 	if len(p.keepstore.mountsW) == 0 {
 		p.keepstore.logger.Infof("not running pull worker because there are no writable volumes")
@@ -85,7 +90,7 @@ func (p *puller) runWorker(ctx context.Context) {
 		p.keepstore.logger.Errorf("error setting up pull worker: %s", err)
 		return
 	}
-	c.AuthToken = "keepstore-token-used-for-pulling-data-from-same-cluster"
+	c.AuthToken = pullWorkerToken
 	ac, err := arvadosclient.New(c)
 	if err != nil {
 		p.keepstore.logger.Errorf("error setting up pull worker: %s", err)
@@ -0,0 +1,115 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Each block is marked as read at most once per mount in
+	// this interval. Cold storage thresholds are typically
+	// measured in days, so finer resolution is not useful.
+	readTimeInterval = time.Hour
+
+	// Maximum number of queued BlockMarkRead calls. When the
+	// queue is full, further reads are not recorded.
+	readTimeQueueSize = 1000
+
+	// Number of concurrent BlockMarkRead calls.
+	readTimeConcurrency = 4
+)
+
+type readTimeMark struct {
+	mnt  *mount
+	hash string
+}
+
+// readTimeRecorder records last-read times on volumes that support
+// them, so keep-balance can move blocks that have not been read
+// recently to a cold storage class.
+type readTimeRecorder struct {
+	logger logrus.FieldLogger
+	todo   chan readTimeMark
+
+	// Blocks marked during the current and previous
+	// readTimeInterval, keyed by mount UUID + hash.
+	marked     map[string]bool
+	prevMarked map[string]bool
+	rotated    time.Time
+	mtx        sync.Mutex
+}
+
+// newReadTimeRecorder returns a readTimeRecorder for the given
+// keepstore, or nil if no storage class has a ColdStorageClass.
+func newReadTimeRecorder(ctx context.Context, ks *keepstore) *readTimeRecorder {
+	enabled := false
+	for _, sc := range ks.cluster.StorageClasses {
+		if sc.ColdStorageClass != "" {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return nil
+	}
+	rec := &readTimeRecorder{
+		logger:  ks.logger,
+		todo:    make(chan readTimeMark, readTimeQueueSize),
+		marked:  map[string]bool{},
+		rotated: time.Now(),
+	}
+	for i := 0; i < readTimeConcurrency; i++ {
+		go rec.runWorker(ctx)
+	}
+	return rec
+}
+
+// markRead queues a BlockMarkRead call for the given block, unless
+// the block was already marked on the same mount recently, or the
+// mount does not support read times.
+func (rec *readTimeRecorder) markRead(mnt *mount, hash string) {
+	if rec == nil || !mnt.readTimes {
+		return
+	}
+	key := mnt.UUID + hash
+	rec.mtx.Lock()
+	if time.Since(rec.rotated) > readTimeInterval {
+		rec.prevMarked, rec.marked = rec.marked, map[string]bool{}
+		rec.rotated = time.Now()
+	}
+	if rec.marked[key] || rec.prevMarked[key] {
+		rec.mtx.Unlock()
+		return
+	}
+	rec.marked[key] = true
+	rec.mtx.Unlock()
+	select {
+	case rec.todo <- readTimeMark{mnt: mnt, hash: hash}:
+	default:
+		// Queue is full. Forget that we marked this block, so
+		// the next read tries again.
+		rec.mtx.Lock()
+		delete(rec.marked, key)
+		rec.mtx.Unlock()
+	}
+}
+
+func (rec *readTimeRecorder) runWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-rec.todo:
+			err := m.mnt.volume.(readTimeVolume).BlockMarkRead(m.hash)
+			if err != nil {
+				rec.logger.WithError(err).Warnf("error recording read time for block %s on %s", m.hash, m.mnt.UUID)
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"time"
+)
+
+type reencrypter struct{}
+
+// newReencrypter starts a goroutine for each writable encrypted
+// volume, which periodically re-encrypts blocks that were encrypted
+// with keys other than the volume's current key. Each goroutine
+// exits after a full pass finds no such blocks.
+func newReencrypter(ctx context.Context, ks *keepstore) *reencrypter {
+	for _, mnt := range ks.mounts {
+		if !mnt.KeepMount.AllowWrite {
+			continue
+		}
+		vol := mnt.volume
+		if cv, ok := vol.(*compressedVolume); ok {
+			vol = cv.volume
+		}
+		ev, ok := vol.(*encryptedVolume)
+		if !ok || ev.ReencryptInterval <= 0 {
+			continue
+		}
+		go func() {
+			ticker := time.NewTicker(ev.ReencryptInterval.Duration())
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				if ev.reencrypt(ctx) {
+					return
+				}
+			}
+		}()
+	}
+	return &reencrypter{}
+}
@@ -5,6 +5,7 @@
 package keepstore
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -28,13 +29,15 @@ type router struct {
 	keepstore *keepstore
 	puller    *puller
 	trasher   *trasher
+	scrubber  *scrubber
 }
 
-func newRouter(keepstore *keepstore, puller *puller, trasher *trasher) service.Handler {
+func newRouter(keepstore *keepstore, puller *puller, trasher *trasher, scrubber *scrubber) service.Handler {
 	rtr := &router{
 		keepstore: keepstore,
 		puller:    puller,
 		trasher:   trasher,
+		scrubber:  scrubber,
 	}
 	adminonly := func(h http.HandlerFunc) http.HandlerFunc {
 		return auth.RequireLiteralToken(keepstore.cluster.SystemRootToken, h).ServeHTTP
@@ -56,6 +59,8 @@ func newRouter(keepstore *keepstore, puller *puller, trasher *trasher) service.H
 	get.HandleFunc(`/mounts`, adminonly(rtr.handleMounts))
 	get.HandleFunc(`/mounts/{uuid}/blocks`, adminonly(rtr.handleIndex))
 	get.HandleFunc(`/mounts/{uuid}/blocks/{prefix:[0-9a-f]{0,32}}`, adminonly(rtr.handleIndex))
+	get.HandleFunc(`/mounts/{uuid}/readtimes`, adminonly(rtr.handleIndexReadTimes))
+	get.HandleFunc(`/mounts/{uuid}/scrub`, adminonly(rtr.handleScrubStatus))
 	put := r.Methods(http.MethodPut).Subrouter()
 	put.HandleFunc(locatorPath, rtr.handleBlockWrite)
 	put.HandleFunc(`/pull`, adminonly(rtr.handlePullList))
@@ -159,14 +164,50 @@ func (rtr *router) handleMounts(w http.ResponseWriter, req *http.Request) {
 	json.NewEncoder(w).Encode(rtr.keepstore.Mounts())
 }
 
+func (rtr *router) handleScrubStatus(w http.ResponseWriter, req *http.Request) {
+	status, err := rtr.scrubber.Status(mux.Vars(req)["uuid"])
+	if err != nil {
+		rtr.handleError(w, req, err)
+		return
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
 func (rtr *router) handleIndex(w http.ResponseWriter, req *http.Request) {
+	if t, ok := rtr.keepstore.indexTime(mux.Vars(req)["uuid"]); ok {
+		// Tell the caller what "since" value to use next
+		// time to get only the blocks that change after this
+		// response.
+		w.Header().Set(keepclient.XKeepIndexTime, strconv.FormatInt(t, 10))
+	}
+	if req.FormValue("since") == "" {
+		rtr.serveIndex(w, req, rtr.keepstore.Index)
+		return
+	}
+	since, err := strconv.ParseInt(req.FormValue("since"), 10, 64)
+	if err != nil || mux.Vars(req)["uuid"] == "" {
+		w.Header().Del(keepclient.XKeepIndexTime)
+		rtr.handleError(w, req, httpserver.ErrorWithStatus(errors.New("invalid since parameter, or no mount specified"), http.StatusBadRequest))
+		return
+	}
+	rtr.serveIndex(w, req, func(ctx context.Context, opts indexOptions) error {
+		opts.Since = since
+		return rtr.keepstore.IndexChanges(ctx, opts)
+	})
+}
+
+func (rtr *router) handleIndexReadTimes(w http.ResponseWriter, req *http.Request) {
+	rtr.serveIndex(w, req, rtr.keepstore.IndexReadTimes)
+}
+
+func (rtr *router) serveIndex(w http.ResponseWriter, req *http.Request, index func(context.Context, indexOptions) error) {
 	httpserver.ExemptFromDeadline(req)
 	prefix := req.FormValue("prefix")
 	if prefix == "" {
 		prefix = mux.Vars(req)["prefix"]
 	}
 	cw := &countingWriter{writer: w}
-	err := rtr.keepstore.Index(req.Context(), indexOptions{
+	err := index(req.Context(), indexOptions{
 		MountUUID: mux.Vars(req)["uuid"],
 		Prefix:    prefix,
 		WriteTo:   cw,
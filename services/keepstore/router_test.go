@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -46,7 +47,8 @@ func testRouter(t TB, cluster *arvados.Cluster, reg *prometheus.Registry) (*rout
 	}()
 	puller := newPuller(ctx, ks, reg)
 	trasher := newTrasher(ctx, ks, reg)
-	return newRouter(ks, puller, trasher).(*router), cancel
+	scrubber := newScrubber(ctx, ks, reg)
+	return newRouter(ks, puller, trasher, scrubber).(*router), cancel
 }
 
 func (s *routerSuite) SetUpTest(c *C) {
@@ -293,10 +295,12 @@ func (s *routerSuite) TestBlockTouch(c *C) {
 	c.Check(err, IsNil)
 	c.Check(t.Before(t1), Equals, true)
 
-	err = vol0.BlockTrash(fooHash)
-	c.Assert(err, IsNil)
-	err = vol1.BlockTrash(fooHash)
-	c.Assert(err, IsNil)
+	for _, vol := range []*stubVolume{vol0, vol1} {
+		err = vol.blockTouchWithTime(fooHash, time.Now().Add(-s.cluster.Collections.BlobSigningTTL.Duration()))
+		c.Assert(err, IsNil)
+		err = vol.BlockTrash(fooHash)
+		c.Assert(err, IsNil)
+	}
 	resp = call(router, "TOUCH", "http://example/"+fooHash+"+3", s.cluster.SystemRootToken, nil, nil)
 	c.Check(resp.Code, Equals, http.StatusNotFound)
 }
@@ -324,6 +328,8 @@ func (s *routerSuite) TestBlockUntrash(c *C) {
 	vol0 := router.keepstore.mountsW[0].volume.(*stubVolume)
 	err := vol0.BlockWrite(context.Background(), fooHash, []byte("foo"))
 	c.Assert(err, IsNil)
+	err = vol0.blockTouchWithTime(fooHash, time.Now().Add(-s.cluster.Collections.BlobSigningTTL.Duration()))
+	c.Assert(err, IsNil)
 	err = vol0.BlockTrash(fooHash)
 	c.Assert(err, IsNil)
 	err = vol0.BlockRead(context.Background(), fooHash, brdiscard)
@@ -519,6 +525,79 @@ func (s *routerSuite) TestIndex(c *C) {
 	}
 }
 
+func (s *routerSuite) TestIndexReadTimes(c *C) {
+	s.cluster.Volumes["zzzzz-nyw5e-000000000000000"] = arvados.Volume{
+		Replication:      1,
+		Driver:           "Directory",
+		DriverParameters: json.RawMessage(fmt.Sprintf(`{"Root":%q}`, c.MkDir())),
+		StorageClasses:   map[string]bool{"testclass1": true},
+	}
+	s.cluster.StorageClasses["testclass1"] = arvados.StorageClassConfig{
+		Default:          true,
+		ColdStorageClass: "testclass2",
+		ColdAfter:        arvados.Duration(time.Hour),
+	}
+	router, cancel := testRouter(c, s.cluster, nil)
+	defer cancel()
+
+	mnt := router.keepstore.mounts["zzzzz-nyw5e-000000000000000"]
+	c.Assert(mnt.BlockWrite(context.Background(), fooHash, []byte("foo")), IsNil)
+	resp := call(router, "GET", "http://example/mounts/zzzzz-nyw5e-000000000000000/readtimes", s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Matches, fooHash+`\+3 \d+ 0\n\n`)
+
+	locSigned := router.keepstore.signLocator(arvadostest.ActiveTokenV2, fooHash+"+3")
+	resp = call(router, "GET", "http://example/"+locSigned, arvadostest.ActiveTokenV2, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	// The read time is recorded asynchronously.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp = call(router, "GET", "http://example/mounts/zzzzz-nyw5e-000000000000000/readtimes?prefix=acb", s.cluster.SystemRootToken, nil, nil)
+		c.Check(resp.Code, Equals, http.StatusOK)
+		if !strings.HasSuffix(resp.Body.String(), " 0\n\n") || time.Now().After(deadline) {
+			break
+		}
+	}
+	c.Check(resp.Body.String(), Matches, fooHash+`\+3 \d+ [1-9]\d*\n\n`)
+
+	// Stub volumes don't record read times.
+	resp = call(router, "GET", "http://example/mounts/zzzzz-nyw5e-111111111111111/readtimes", s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusNotImplemented)
+	resp = call(router, "GET", "http://example/mounts/zzzzz-nyw5e-222222222222222/readtimes", s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusNotFound)
+}
+
+// Reads by pull workers and system components don't count as reads
+// for cold storage purposes.
+func (s *routerSuite) TestIndexReadTimesIgnoreSystemReads(c *C) {
+	s.cluster.Volumes["zzzzz-nyw5e-000000000000000"] = arvados.Volume{
+		Replication:      1,
+		Driver:           "Directory",
+		DriverParameters: json.RawMessage(fmt.Sprintf(`{"Root":%q}`, c.MkDir())),
+		StorageClasses:   map[string]bool{"testclass1": true},
+	}
+	s.cluster.StorageClasses["testclass1"] = arvados.StorageClassConfig{
+		Default:          true,
+		ColdStorageClass: "testclass2",
+		ColdAfter:        arvados.Duration(time.Hour),
+	}
+	router, cancel := testRouter(c, s.cluster, nil)
+	defer cancel()
+
+	mnt := router.keepstore.mounts["zzzzz-nyw5e-000000000000000"]
+	c.Assert(mnt.BlockWrite(context.Background(), fooHash, []byte("foo")), IsNil)
+	for _, token := range []string{s.cluster.SystemRootToken, pullWorkerToken} {
+		locSigned := router.keepstore.signLocator(token, fooHash+"+3")
+		resp := call(router, "GET", "http://example/"+locSigned, token, nil, nil)
+		c.Check(resp.Code, Equals, http.StatusOK)
+	}
+	// Give the read time recorder a chance to (wrongly) record
+	// the reads above.
+	time.Sleep(100 * time.Millisecond)
+	resp := call(router, "GET", "http://example/mounts/zzzzz-nyw5e-000000000000000/readtimes", s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusOK)
+	c.Check(resp.Body.String(), Matches, fooHash+`\+3 \d+ 0\n\n`)
+}
+
 // Check that the context passed to a volume method gets cancelled
 // when the http client hangs up.
 func (s *routerSuite) TestCancelOnDisconnect(c *C) {
@@ -73,6 +73,8 @@ type s3Volume struct {
 	region     string
 	startOnce  sync.Once
 
+	encodedData bool
+
 	overrideEndpoint *aws.Endpoint
 }
 
@@ -106,10 +108,11 @@ func (v *s3Volume) key(loc string) string {
 
 func news3Volume(params newVolumeParams) (volume, error) {
 	v := &s3Volume{
-		cluster:    params.Cluster,
-		volume:     params.ConfigVolume,
-		metrics:    params.MetricsVecs,
-		bufferPool: params.BufferPool,
+		cluster:     params.Cluster,
+		volume:      params.ConfigVolume,
+		metrics:     params.MetricsVecs,
+		bufferPool:  params.BufferPool,
+		encodedData: params.EncodedData,
 	}
 	err := json.Unmarshal(params.ConfigVolume.DriverParameters, v)
 	if err != nil {
@@ -361,6 +364,10 @@ func (v *s3Volume) EmptyTrash() {
 		if err != nil {
 			v.logger.WithError(err).Warnf("EmptyTrash: error deleting %q", "recent/"+key)
 		}
+		err = v.bucket.Del("lastread/" + key)
+		if err != nil && !os.IsNotExist(v.translateError(err)) {
+			v.logger.WithError(err).Warnf("EmptyTrash: error deleting %q", "lastread/"+key)
+		}
 	}
 
 	var wg sync.WaitGroup
@@ -512,7 +519,7 @@ func (v *s3Volume) writeObject(ctx context.Context, key string, r io.Reader) err
 		Body:   r,
 	}
 
-	if loc, ok := v.isKeepBlock(key); ok {
+	if loc, ok := v.isKeepBlock(key); ok && !v.encodedData {
 		var contentMD5 string
 		md5, err := hex.DecodeString(loc)
 		if err != nil {
@@ -557,6 +564,20 @@ func (v *s3Volume) BlockWrite(ctx context.Context, hash string, data []byte) err
 	return v.writeObject(ctx, "recent/"+key, nil)
 }
 
+// BlockRewrite replaces the data object of an existing block,
+// leaving the recent/X marker (and therefore the block's timestamp)
+// unchanged.
+func (v *s3Volume) BlockRewrite(ctx context.Context, hash string, data []byte) error {
+	key := v.key(hash)
+	_, err := v.head(key)
+	if err != nil {
+		return v.translateError(err)
+	}
+	rdr := bytes.NewReader(data)
+	r := newCountingReaderAtSeeker(rdr, v.bucket.stats.TickOutBytes)
+	return v.writeObject(ctx, key, r)
+}
+
 type s3awsLister struct {
 	Logger            logrus.FieldLogger
 	Bucket            *s3Bucket
@@ -647,8 +668,25 @@ func (lister *s3awsLister) pop() (k *types.Object) {
 // Index writes a complete list of locators with the given prefix
 // for which Get() can retrieve data.
 func (v *s3Volume) Index(ctx context.Context, prefix string, writer io.Writer) error {
+	return v.index(ctx, prefix, writer, false)
+}
+
+// IndexReadTimes is like Index, but also reports the timestamp of
+// each block's lastread/X marker as its last read time.
+func (v *s3Volume) IndexReadTimes(ctx context.Context, prefix string, writer io.Writer) error {
+	return v.index(ctx, prefix, writer, true)
+}
+
+// BlockMarkRead writes a lastread/X marker for the given block.
+func (v *s3Volume) BlockMarkRead(hash string) error {
+	err := v.writeObject(context.Background(), "lastread/"+v.key(hash), nil)
+	return v.translateError(err)
+}
+
+func (v *s3Volume) index(ctx context.Context, prefix string, writer io.Writer, readTimes bool) error {
 	prefix = v.key(prefix)
-	// Use a merge sort to find matching sets of X and recent/X.
+	// Use a merge sort to find matching sets of X, recent/X, and
+	// (if readTimes is true) lastread/X.
 	dataL := s3awsLister{
 		Logger:   v.logger,
 		Bucket:   v.bucket,
@@ -663,6 +701,17 @@ func (v *s3Volume) Index(ctx context.Context, prefix string, writer io.Writer) e
 		PageSize: v.IndexPageSize,
 		Stats:    &v.bucket.stats,
 	}
+	lastreadL := s3awsLister{
+		Logger:   v.logger,
+		Bucket:   v.bucket,
+		Prefix:   "lastread/" + prefix,
+		PageSize: v.IndexPageSize,
+		Stats:    &v.bucket.stats,
+	}
+	var lastread *types.Object
+	if readTimes {
+		lastread = lastreadL.First()
+	}
 	for data, recent := dataL.First(), recentL.First(); data != nil && dataL.Error() == nil; data = dataL.Next() {
 		if ctx.Err() != nil {
 			return ctx.Err()
@@ -704,10 +753,33 @@ func (v *s3Volume) Index(ctx context.Context, prefix string, writer io.Writer) e
 		if err := recentL.Error(); err != nil {
 			return err
 		}
-		// We truncate sub-second precision here. Otherwise
-		// timestamps will never match the RFC1123-formatted
-		// Last-Modified values parsed by Mtime().
-		fmt.Fprintf(writer, "%s+%d %d\n", loc, *data.Size, stamp.LastModified.Unix()*1000000000)
+		if !readTimes {
+			// We truncate sub-second precision here.
+			// Otherwise timestamps will never match the
+			// RFC1123-formatted Last-Modified values parsed
+			// by Mtime().
+			fmt.Fprintf(writer, "%s+%d %d\n", loc, *data.Size, stamp.LastModified.Unix()*1000000000)
+			continue
+		}
+
+		// Advance to the corresponding lastread/X marker, if
+		// any. If there is none, the block has not been read
+		// since read times were first recorded.
+		var readTime int64
+		for lastread != nil && lastreadL.Error() == nil {
+			if cmp := strings.Compare((*lastread.Key)[9:], *data.Key); cmp < 0 {
+				lastread = lastreadL.Next()
+				continue
+			} else if cmp == 0 {
+				readTime = lastread.LastModified.UnixNano()
+				lastread = lastreadL.Next()
+			}
+			break
+		}
+		if err := lastreadL.Error(); err != nil {
+			return err
+		}
+		fmt.Fprintf(writer, "%s+%d %d %d\n", loc, *data.Size, stamp.LastModified.Unix()*1000000000, readTime)
 	}
 	return dataL.Error()
 }
@@ -813,7 +885,17 @@ func (v *s3Volume) BlockTrash(loc string) error {
 		if !v.UnsafeDelete {
 			return errS3TrashDisabled
 		}
-		return v.translateError(v.bucket.Del(key))
+		err := v.bucket.Del(key)
+		if err != nil {
+			return v.translateError(err)
+		}
+		// There is no trash/X for EmptyTrash to find, so
+		// delete the lastread/X marker now.
+		err = v.bucket.Del("lastread/" + key)
+		if err != nil && !os.IsNotExist(v.translateError(err)) {
+			v.logger.WithError(err).Warnf("BlockTrash: error deleting %q", "lastread/"+key)
+		}
+		return nil
 	}
 	err := v.checkRaceWindow(key)
 	if err != nil {
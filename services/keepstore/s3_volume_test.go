@@ -129,6 +129,84 @@ func (s *stubbedS3Suite) TestIndex(c *check.C) {
 	}
 }
 
+func (s *stubbedS3Suite) TestIndexReadTimes(c *check.C) {
+	v := s.newTestableVolume(c, newVolumeParams{
+		Cluster:      s.cluster,
+		ConfigVolume: arvados.Volume{Replication: 2},
+		MetricsVecs:  newVolumeMetricsVecs(prometheus.NewRegistry()),
+		BufferPool:   newBufferPool(ctxlog.TestLogger(c), 8, prometheus.NewRegistry()),
+	}, 0)
+	v.IndexPageSize = 3
+	for i := 0; i < 16; i++ {
+		err := v.blockWriteWithoutMD5Check(fmt.Sprintf("%02x%030x", i, i), []byte{102, 111, 111})
+		c.Assert(err, check.IsNil)
+	}
+	for i := 0; i < 16; i += 3 {
+		c.Assert(v.BlockMarkRead(fmt.Sprintf("%02x%030x", i, i)), check.IsNil)
+	}
+	buf := new(bytes.Buffer)
+	c.Check(v.IndexReadTimes(context.Background(), "", buf), check.IsNil)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	c.Assert(lines, check.HasLen, 16)
+	for i, line := range lines {
+		if i%3 == 0 {
+			c.Check(line, check.Matches, fmt.Sprintf(`%02x%030x\+3 \d+ [1-9]\d*`, i, i))
+		} else {
+			c.Check(line, check.Matches, fmt.Sprintf(`%02x%030x\+3 \d+ 0`, i, i))
+		}
+	}
+
+	// Index doesn't include read times.
+	buf.Reset()
+	c.Check(v.Index(context.Background(), "", buf), check.IsNil)
+	c.Check(buf.String(), check.Matches, `(?m)(\w+\+3 \d+\n){16}`)
+}
+
+func (s *stubbedS3Suite) TestBlockTrashDeletesReadTime(c *check.C) {
+	s.cluster.Collections.BlobTrashLifetime.Set("0s")
+	v := s.newTestableVolume(c, newVolumeParams{
+		Cluster:      s.cluster,
+		ConfigVolume: arvados.Volume{Replication: 2},
+		MetricsVecs:  newVolumeMetricsVecs(prometheus.NewRegistry()),
+		BufferPool:   newBufferPool(ctxlog.TestLogger(c), 8, prometheus.NewRegistry()),
+	}, 0)
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	c.Assert(v.BlockMarkRead(TestHash), check.IsNil)
+	_, err := v.head("lastread/" + v.key(TestHash))
+	c.Assert(err, check.IsNil)
+	v.TouchWithDate(TestHash, time.Now().Add(-s.cluster.Collections.BlobSigningTTL.Duration()-time.Hour))
+
+	c.Check(v.BlockTrash(TestHash), check.IsNil)
+	_, err = v.head(v.key(TestHash))
+	c.Check(os.IsNotExist(v.translateError(err)), check.Equals, true)
+	_, err = v.head("lastread/" + v.key(TestHash))
+	c.Check(os.IsNotExist(v.translateError(err)), check.Equals, true)
+}
+
+func (s *stubbedS3Suite) TestBlockRewrite(c *check.C) {
+	v := s.newTestableVolume(c, newVolumeParams{
+		Cluster:      s.cluster,
+		ConfigVolume: arvados.Volume{Replication: 2},
+		MetricsVecs:  newVolumeMetricsVecs(prometheus.NewRegistry()),
+		BufferPool:   newBufferPool(ctxlog.TestLogger(c), 8, prometheus.NewRegistry()),
+	}, 0)
+	// Rewriting is only useful for encoded (e.g., encrypted)
+	// data, which doesn't match the block hash.
+	v.encodedData = true
+	c.Check(os.IsNotExist(v.BlockRewrite(context.Background(), TestHash, TestBlock)), check.Equals, true)
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	v.TouchWithDate(TestHash, t0)
+
+	c.Check(v.BlockRewrite(context.Background(), TestHash, TestBlock2), check.IsNil)
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(TestBlock2))
+	mtime, err := v.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+	c.Check(mtime.Equal(t0), check.Equals, true)
+}
+
 func (s *stubbedS3Suite) TestSignature(c *check.C) {
 	var header http.Header
 	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -263,6 +341,39 @@ func (s *stubbedS3Suite) TestStats(c *check.C) {
 	c.Check(stats(), check.Matches, `.*"InBytes":6,.*`)
 }
 
+func (s *stubbedS3Suite) TestEncrypted(c *check.C) {
+	v := s.newTestableVolume(c, newVolumeParams{
+		UUID:        "zzzzz-nyw5e-000000000000000",
+		Cluster:     s.cluster,
+		MetricsVecs: newVolumeMetricsVecs(prometheus.NewRegistry()),
+		BufferPool:  newBufferPool(ctxlog.TestLogger(c), 8, prometheus.NewRegistry()),
+	}, 5*time.Minute)
+	v.encodedData = true
+	ev, err := newEncryptedVolume(v, newVolumeParams{
+		Logger: ctxlog.TestLogger(c),
+		ConfigVolume: arvados.Volume{
+			Encryption: arvados.VolumeEncryption{
+				KeyID: "key1",
+				Keys:  map[string]string{"key1": testEncryptionKey1},
+			},
+		},
+	})
+	c.Assert(err, check.IsNil)
+
+	c.Assert(ev.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	buf := &brbuffer{}
+	c.Check(ev.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(TestBlock))
+
+	buf = &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+	c.Check(buf.Len(), check.Equals, len(TestBlock)+encryptedOverhead)
+
+	idx := &bytes.Buffer{}
+	c.Check(ev.Index(context.Background(), "", idx), check.IsNil)
+	c.Check(idx.String(), check.Matches, fmt.Sprintf(`%s\+%d \d+\n`, TestHash, len(TestBlock)))
+}
+
 type s3AWSBlockingHandler struct {
 	requested chan *http.Request
 	unblock   chan struct{}
@@ -0,0 +1,325 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Number of hex digits in each index prefix requested during
+	// a scrub pass. Indexing one prefix at a time keeps memory use
+	// bounded on large volumes.
+	scrubPrefixLength = 3
+
+	// Maximum number of corrupt blocks listed in a mount's scrub
+	// status.
+	scrubMaxReported = 100
+)
+
+// scrubCorruptBlock describes a corrupt block found by a scrub pass.
+type scrubCorruptBlock struct {
+	Hash        string    `json:"hash"`
+	Time        time.Time `json:"time"`
+	Reason      string    `json:"reason"`
+	Quarantined bool      `json:"quarantined"`
+}
+
+// scrubPass summarizes a scrub pass over one mount.
+type scrubPass struct {
+	StartTime   time.Time `json:"start_time"`
+	FinishTime  time.Time `json:"finish_time"` // zero if still running
+	Blocks      int64     `json:"blocks"`      // blocks read and verified
+	Bytes       int64     `json:"bytes"`
+	Corrupt     int64     `json:"corrupt"`
+	Errors      int64     `json:"errors"` // blocks that could not be read
+	Quarantined int64     `json:"quarantined"`
+	Error       string    `json:"error,omitempty"` // error that ended the pass early
+}
+
+// scrubStatus is the response body for GET /mounts/{uuid}/scrub.
+type scrubStatus struct {
+	Enabled       bool                `json:"enabled"`
+	Current       *scrubPass          `json:"current"`
+	Last          *scrubPass          `json:"last"`
+	CorruptBlocks []scrubCorruptBlock `json:"corrupt_blocks"` // most recent first
+}
+
+// scrubber periodically re-reads every block on each trashable
+// mount, verifies its hash, and trashes corrupt blocks so
+// keep-balance replaces them with good copies from other volumes.
+type scrubber struct {
+	keepstore *keepstore
+	status    map[string]*scrubStatus // keyed by mount UUID
+	mtx       sync.Mutex              // guards status and everything it points to
+
+	blocks      *prometheus.CounterVec
+	bytes       *prometheus.CounterVec
+	quarantined *prometheus.CounterVec
+}
+
+func newScrubber(ctx context.Context, keepstore *keepstore, reg *prometheus.Registry) *scrubber {
+	s := &scrubber{
+		keepstore: keepstore,
+		status:    map[string]*scrubStatus{},
+	}
+	s.blocks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "scrub_blocks",
+			Help:      "Number of blocks checked by the scrubber, by result (ok, corrupt, or error)",
+		},
+		[]string{"device_id", "result"},
+	)
+	reg.MustRegister(s.blocks)
+	s.bytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "scrub_bytes",
+			Help:      "Number of bytes read and verified by the scrubber",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(s.bytes)
+	s.quarantined = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "arvados",
+			Subsystem: "keepstore",
+			Name:      "scrub_quarantined_blocks",
+			Help:      "Number of corrupt blocks trashed by the scrubber",
+		},
+		[]string{"device_id"},
+	)
+	reg.MustRegister(s.quarantined)
+
+	interval := keepstore.cluster.Collections.BlobScrubInterval.Duration()
+	if interval <= 0 {
+		keepstore.logger.Info("not running scrubber because Collections.BlobScrubInterval is zero")
+		return s
+	}
+	for _, mnt := range keepstore.mountsR {
+		if !mnt.AllowTrash {
+			continue
+		}
+		s.status[mnt.UUID] = &scrubStatus{Enabled: true, CorruptBlocks: []scrubCorruptBlock{}}
+		go s.runMount(ctx, mnt, interval)
+	}
+	if len(s.status) == 0 {
+		keepstore.logger.Info("not running scrubber because there are no trashable volumes")
+	}
+	return s
+}
+
+// Status returns the scrub status of the given mount.
+func (s *scrubber) Status(mountUUID string) (scrubStatus, error) {
+	if _, ok := s.keepstore.mounts[mountUUID]; !ok {
+		return scrubStatus{}, os.ErrNotExist
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	st, ok := s.status[mountUUID]
+	if !ok {
+		return scrubStatus{CorruptBlocks: []scrubCorruptBlock{}}, nil
+	}
+	ret := scrubStatus{
+		Enabled:       st.Enabled,
+		CorruptBlocks: append([]scrubCorruptBlock{}, st.CorruptBlocks...),
+	}
+	if st.Current != nil {
+		pass := *st.Current
+		ret.Current = &pass
+	}
+	if st.Last != nil {
+		pass := *st.Last
+		ret.Last = &pass
+	}
+	return ret, nil
+}
+
+func (s *scrubber) runMount(ctx context.Context, mnt *mount, interval time.Duration) {
+	for {
+		start := time.Now()
+		s.scrubMount(ctx, mnt)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval - time.Since(start)):
+		}
+	}
+}
+
+// scrubMount does a single scrub pass over the given mount.
+func (s *scrubber) scrubMount(ctx context.Context, mnt *mount) {
+	logger := s.keepstore.logger.WithField("mount", mnt.UUID)
+	rate := int64(s.keepstore.cluster.Collections.BlobScrubRate)
+	pass := &scrubPass{StartTime: time.Now()}
+	s.mtx.Lock()
+	s.status[mnt.UUID].Current = pass
+	s.mtx.Unlock()
+	logger.Info("scrub: starting pass")
+
+	var bytesRead int64
+	for i := 0; i < 1<<(4*scrubPrefixLength) && ctx.Err() == nil; i++ {
+		prefix := fmt.Sprintf("%0*x", scrubPrefixLength, i)
+		var index bytes.Buffer
+		err := mnt.Index(ctx, prefix, &index)
+		if err != nil {
+			s.mtx.Lock()
+			pass.Error = fmt.Sprintf("error getting index for prefix %s: %s", prefix, err)
+			s.mtx.Unlock()
+			break
+		}
+		scanner := bufio.NewScanner(&index)
+		for scanner.Scan() && ctx.Err() == nil {
+			locator, _, _ := strings.Cut(scanner.Text(), " ")
+			hash, sizestr, ok := strings.Cut(locator, "+")
+			if !ok || !keepBlockRegexp.MatchString(hash) {
+				continue
+			}
+			size, err := strconv.Atoi(sizestr)
+			if err != nil {
+				continue
+			}
+			s.scrubBlock(ctx, mnt, pass, hash, size)
+			bytesRead += int64(size)
+			if rate > 0 {
+				due := pass.StartTime.Add(time.Duration(float64(bytesRead) / float64(rate) * float64(time.Second)))
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Until(due)):
+				}
+			}
+		}
+	}
+
+	s.mtx.Lock()
+	if pass.Error == "" && ctx.Err() != nil {
+		pass.Error = ctx.Err().Error()
+	}
+	pass.FinishTime = time.Now()
+	st := s.status[mnt.UUID]
+	st.Current = nil
+	st.Last = pass
+	summary := *pass
+	s.mtx.Unlock()
+
+	logger = logger.WithFields(map[string]interface{}{
+		"blocks":      summary.Blocks,
+		"bytes":       summary.Bytes,
+		"corrupt":     summary.Corrupt,
+		"errors":      summary.Errors,
+		"quarantined": summary.Quarantined,
+		"elapsed":     summary.FinishTime.Sub(summary.StartTime).Seconds(),
+	})
+	if summary.Error != "" {
+		logger.Warnf("scrub: pass ended early: %s", summary.Error)
+	} else if summary.Corrupt > 0 || summary.Errors > 0 {
+		logger.Warn("scrub: finished pass, found problems")
+	} else {
+		logger.Info("scrub: finished pass")
+	}
+}
+
+// scrubBlock reads the given block and verifies its hash and size. If
+// it is corrupt, scrubBlock records it in the mount's scrub status
+// and trashes it.
+func (s *scrubber) scrubBlock(ctx context.Context, mnt *mount, pass *scrubPass, hash string, size int) {
+	logger := s.keepstore.logger.WithField("mount", mnt.UUID).WithField("block", hash)
+	mtime, mtimeErr := mnt.Mtime(hash)
+	if os.IsNotExist(mtimeErr) {
+		// Deleted since we got the index.
+		return
+	}
+	buf := &memWriterAt{}
+	err := mnt.BlockRead(bypassCache(ctx), hash, buf)
+	reason := ""
+	switch {
+	case os.IsNotExist(err):
+		return
+	case ctx.Err() != nil:
+		return
+	case errors.Is(err, errChecksum):
+		reason = err.Error()
+	case err != nil:
+		logger.WithError(err).Warn("scrub: error reading block")
+		s.blocks.WithLabelValues(mnt.KeepMount.DeviceID, "error").Inc()
+		s.mtx.Lock()
+		pass.Errors++
+		s.mtx.Unlock()
+		return
+	case len(buf.buf) != size:
+		reason = fmt.Sprintf("data size %d does not match indexed size %d", len(buf.buf), size)
+	default:
+		if actual := fmt.Sprintf("%x", md5.Sum(buf.buf)); actual != hash {
+			reason = fmt.Sprintf("data has hash %s", actual)
+		}
+	}
+	s.bytes.WithLabelValues(mnt.KeepMount.DeviceID).Add(float64(len(buf.buf)))
+	if reason == "" {
+		s.blocks.WithLabelValues(mnt.KeepMount.DeviceID, "ok").Inc()
+		s.mtx.Lock()
+		pass.Blocks++
+		pass.Bytes += int64(len(buf.buf))
+		s.mtx.Unlock()
+		return
+	}
+	s.blocks.WithLabelValues(mnt.KeepMount.DeviceID, "corrupt").Inc()
+	logger.Errorf("scrub: corrupt block: %s", reason)
+
+	quarantined := false
+	if !s.keepstore.cluster.Collections.BlobTrash {
+		logger.Info("scrub: not trashing corrupt block because Collections.BlobTrash is false")
+	} else if mtimeErr != nil {
+		logger.WithError(mtimeErr).Warn("scrub: not trashing corrupt block because its timestamp could not be read")
+	} else if t, err := mnt.Mtime(hash); err != nil || !t.Equal(mtime) {
+		// The block was rewritten (possibly with good data) or
+		// deleted while we were reading it. Leave it for the
+		// next pass.
+		logger.Info("scrub: not trashing corrupt block because it was modified while being checked")
+	} else if time.Since(mtime) < s.keepstore.cluster.Collections.BlobSigningTTL.Duration() {
+		// BlockTrash would return success without trashing
+		// anything. Leave it for a later pass.
+		logger.Info("scrub: not trashing corrupt block yet because it was written less than BlobSigningTTL ago")
+	} else if err := mnt.BlockTrash(hash); err != nil {
+		logger.WithError(err).Warn("scrub: error trashing corrupt block")
+	} else {
+		logger.Info("scrub: trashed corrupt block")
+		quarantined = true
+		s.quarantined.WithLabelValues(mnt.KeepMount.DeviceID).Inc()
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	pass.Blocks++
+	pass.Bytes += int64(len(buf.buf))
+	pass.Corrupt++
+	if quarantined {
+		pass.Quarantined++
+	}
+	st := s.status[mnt.UUID]
+	st.CorruptBlocks = append([]scrubCorruptBlock{{
+		Hash:        hash,
+		Time:        time.Now(),
+		Reason:      reason,
+		Quarantined: quarantined,
+	}}, st.CorruptBlocks...)
+	if len(st.CorruptBlocks) > scrubMaxReported {
+		st.CorruptBlocks = st.CorruptBlocks[:scrubMaxReported]
+	}
+}
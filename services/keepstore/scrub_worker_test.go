@@ -0,0 +1,150 @@
+// Copyright (C) The Arvados Authors. All rights reserved.
+//
+// SPDX-License-Identifier: AGPL-3.0
+
+package keepstore
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"git.arvados.org/arvados.git/sdk/go/arvados"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "gopkg.in/check.v1"
+)
+
+// setupScrubTest configures a trashable and a read-only volume,
+// stores a good block (foo) and a corrupt block (bar) on the
+// trashable volume, and then starts a router and scrubber.
+func (s *routerSuite) setupScrubTest(c *C) (*router, context.CancelFunc) {
+	s.cluster.Collections.BlobScrubInterval = arvados.Duration(time.Hour)
+	s.cluster.Collections.BlobScrubRate = 0
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "stub"},
+		"zzzzz-nyw5e-111111111111111": {Replication: 1, Driver: "stub", ReadOnly: true},
+	}
+	reg := prometheus.NewRegistry()
+	ks, cancel := testKeepstore(c, s.cluster, reg)
+	stub := ks.mounts["zzzzz-nyw5e-000000000000000"].volume.(*stubVolume)
+	old := time.Now().Add(-s.cluster.Collections.BlobSigningTTL.Duration() - time.Hour)
+	stub.data[fooHash] = stubData{mtime: old, data: []byte("foo")}
+	stub.data[barHash] = stubData{mtime: old, data: []byte("baz")}
+	ctx, ctxcancel := context.WithCancel(context.Background())
+	go func() {
+		<-ctx.Done()
+		cancel()
+	}()
+	return newRouter(ks, newPuller(ctx, ks, reg), newTrasher(ctx, ks, reg), newScrubber(ctx, ks, reg)).(*router), ctxcancel
+}
+
+func (s *routerSuite) getScrubStatus(c *C, router *router, uuid string) scrubStatus {
+	resp := call(router, "GET", "http://example/mounts/"+uuid+"/scrub", s.cluster.SystemRootToken, nil, nil)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	var status scrubStatus
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &status), IsNil)
+	return status
+}
+
+func (s *routerSuite) waitScrubPass(c *C, router *router, uuid string) scrubStatus {
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		status := s.getScrubStatus(c, router, uuid)
+		if status.Last != nil || time.Now().After(deadline) {
+			c.Assert(status.Last, NotNil)
+			return status
+		}
+	}
+}
+
+func (s *routerSuite) TestScrub(c *C) {
+	router, cancel := s.setupScrubTest(c)
+	defer cancel()
+
+	status := s.waitScrubPass(c, router, "zzzzz-nyw5e-000000000000000")
+	c.Check(status.Enabled, Equals, true)
+	c.Check(status.Current, IsNil)
+	c.Check(status.Last.Error, Equals, "")
+	c.Check(status.Last.FinishTime.After(status.Last.StartTime), Equals, true)
+	c.Check(status.Last.Blocks, Equals, int64(2))
+	c.Check(status.Last.Bytes, Equals, int64(6))
+	c.Check(status.Last.Corrupt, Equals, int64(1))
+	c.Check(status.Last.Errors, Equals, int64(0))
+	c.Check(status.Last.Quarantined, Equals, int64(1))
+	c.Assert(status.CorruptBlocks, HasLen, 1)
+	c.Check(status.CorruptBlocks[0].Hash, Equals, barHash)
+	c.Check(status.CorruptBlocks[0].Reason, Matches, `data has hash .*`)
+	c.Check(status.CorruptBlocks[0].Quarantined, Equals, true)
+
+	stub := router.keepstore.mounts["zzzzz-nyw5e-000000000000000"].volume.(*stubVolume)
+	stub.mtx.Lock()
+	c.Check(stub.data[barHash].trash.IsZero(), Equals, false)
+	c.Check(stub.data[fooHash].trash.IsZero(), Equals, true)
+	stub.mtx.Unlock()
+
+	devid := router.keepstore.mounts["zzzzz-nyw5e-000000000000000"].KeepMount.DeviceID
+	c.Check(testutil.ToFloat64(router.scrubber.blocks.WithLabelValues(devid, "ok")), Equals, float64(1))
+	c.Check(testutil.ToFloat64(router.scrubber.blocks.WithLabelValues(devid, "corrupt")), Equals, float64(1))
+	c.Check(testutil.ToFloat64(router.scrubber.quarantined.WithLabelValues(devid)), Equals, float64(1))
+
+	// Read-only volumes are not scrubbed.
+	status = s.getScrubStatus(c, router, "zzzzz-nyw5e-111111111111111")
+	c.Check(status.Enabled, Equals, false)
+	c.Check(status.Last, IsNil)
+	c.Check(status.CorruptBlocks, HasLen, 0)
+
+	resp := call(router, "GET", "http://example/mounts/zzzzz-nyw5e-222222222222222/scrub", s.cluster.SystemRootToken, nil, nil)
+	c.Check(resp.Code, Equals, http.StatusNotFound)
+	resp = call(router, "GET", "http://example/mounts/zzzzz-nyw5e-000000000000000/scrub", "", nil, nil)
+	c.Check(resp.Code, Equals, http.StatusUnauthorized)
+}
+
+func (s *routerSuite) TestScrub_BlobTrashDisabled(c *C) {
+	s.cluster.Collections.BlobTrash = false
+	router, cancel := s.setupScrubTest(c)
+	defer cancel()
+
+	status := s.waitScrubPass(c, router, "zzzzz-nyw5e-000000000000000")
+	c.Check(status.Last.Corrupt, Equals, int64(1))
+	c.Check(status.Last.Quarantined, Equals, int64(0))
+	c.Assert(status.CorruptBlocks, HasLen, 1)
+	c.Check(status.CorruptBlocks[0].Quarantined, Equals, false)
+
+	stub := router.keepstore.mounts["zzzzz-nyw5e-000000000000000"].volume.(*stubVolume)
+	stub.mtx.Lock()
+	c.Check(stub.data[barHash].trash.IsZero(), Equals, true)
+	stub.mtx.Unlock()
+}
+
+// A corrupt block written less than BlobSigningTTL ago cannot be
+// trashed yet, so it is reported but not counted as quarantined.
+func (s *routerSuite) TestScrub_RecentlyWritten(c *C) {
+	s.cluster.Collections.BlobScrubInterval = arvados.Duration(time.Hour)
+	s.cluster.Collections.BlobScrubRate = 0
+	s.cluster.Volumes = map[string]arvados.Volume{
+		"zzzzz-nyw5e-000000000000000": {Replication: 1, Driver: "stub"},
+	}
+	reg := prometheus.NewRegistry()
+	ks, cancel := testKeepstore(c, s.cluster, reg)
+	defer cancel()
+	stub := ks.mounts["zzzzz-nyw5e-000000000000000"].volume.(*stubVolume)
+	stub.data[barHash] = stubData{mtime: time.Now().Add(-time.Hour), data: []byte("baz")}
+	ctx, ctxcancel := context.WithCancel(context.Background())
+	defer ctxcancel()
+	router := newRouter(ks, newPuller(ctx, ks, reg), newTrasher(ctx, ks, reg), newScrubber(ctx, ks, reg)).(*router)
+
+	status := s.waitScrubPass(c, router, "zzzzz-nyw5e-000000000000000")
+	c.Check(status.Last.Corrupt, Equals, int64(1))
+	c.Check(status.Last.Quarantined, Equals, int64(0))
+	c.Assert(status.CorruptBlocks, HasLen, 1)
+	c.Check(status.CorruptBlocks[0].Hash, Equals, barHash)
+	c.Check(status.CorruptBlocks[0].Quarantined, Equals, false)
+
+	stub.mtx.Lock()
+	c.Check(stub.data[barHash].trash.IsZero(), Equals, true)
+	stub.mtx.Unlock()
+
+	devid := ks.mounts["zzzzz-nyw5e-000000000000000"].KeepMount.DeviceID
+	c.Check(testutil.ToFloat64(router.scrubber.quarantined.WithLabelValues(devid)), Equals, float64(0))
+}
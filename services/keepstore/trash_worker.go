@@ -6,6 +6,7 @@ package keepstore
 
 import (
 	"context"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -147,6 +148,9 @@ func (t *trasher) runWorker(ctx context.Context, mntsAllowTrash []*mount) {
 					logger.Infof("stored mtime (%v) does not match trash list mtime (%v); skipping", mtime, reqMtime)
 					continue
 				}
+				if strings.ContainsRune(item.Locator, '+') {
+					mnt.journal.noteSize(li.hash, li.size)
+				}
 				err = mnt.BlockTrash(li.hash)
 				if err != nil {
 					logger.WithError(err).Info("error trashing block")
@@ -25,8 +25,13 @@ import (
 	"git.arvados.org/arvados.git/sdk/go/arvados"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
+// Extended attribute used to store a block's size hint (see
+// sizeHintVolume).
+const unixSizeHintXattr = "user.arvados.size_hint"
+
 func init() {
 	driver["Directory"] = newUnixVolume
 }
@@ -83,6 +88,10 @@ type unixVolume struct {
 	// to skip locking)
 	locker sync.Locker
 
+	// set after logging that the filesystem does not support
+	// extended attributes, so size hints cannot be stored
+	sizeHintsUnsupported atomic.Bool
+
 	os osWithStats
 }
 
@@ -188,6 +197,31 @@ func (v *unixVolume) BlockTouch(hash string) error {
 	return err
 }
 
+// BlockMarkRead sets the timestamp of the given block's
+// {hash}.lastread marker file to the current time, creating the
+// marker if needed.
+//
+// The read time is not stored as the block file's atime, because
+// the filesystem can update atime by itself (e.g., with relatime)
+// when keepstore reads a block for its own purposes.
+func (v *unixVolume) BlockMarkRead(hash string) error {
+	if _, err := v.os.Stat(v.blockPath(hash)); err != nil {
+		return v.translateError(err)
+	}
+	p := v.lastreadPath(hash)
+	f, err := v.os.OpenFile(p, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	ts := time.Now()
+	v.os.stats.TickOps("utimes")
+	v.os.stats.Tick(&v.os.stats.UtimesOps)
+	err = os.Chtimes(p, ts, ts)
+	v.os.stats.TickErr(err)
+	return err
+}
+
 // Mtime returns the stored timestamp for the given locator.
 func (v *unixVolume) Mtime(loc string) (time.Time, error) {
 	p := v.blockPath(loc)
@@ -204,7 +238,7 @@ func (v *unixVolume) stat(path string) (os.FileInfo, error) {
 	if err == nil {
 		if stat.Size() < 0 {
 			err = os.ErrInvalid
-		} else if stat.Size() > BlockSize {
+		} else if stat.Size() > maxStoredBlockSize {
 			err = errTooLarge
 		}
 	}
@@ -239,6 +273,35 @@ func (v *unixVolume) BlockRead(ctx context.Context, hash string, w io.WriterAt)
 // BlockWrite stores a block on the volume. If it already exists, its
 // timestamp is updated.
 func (v *unixVolume) BlockWrite(ctx context.Context, hash string, data []byte) error {
+	// ext4 uses a low-precision clock and effectively backdates
+	// files by up to 10 ms, sometimes across a 1-second boundary,
+	// which produces confusing results in logs and tests.  We
+	// avoid this by setting the output file's timestamps
+	// explicitly, using a higher resolution clock.
+	return v.writeBlock(ctx, hash, data, time.Now(), -1)
+}
+
+// BlockWriteSizeHint is like BlockWrite, but also stores the given
+// size hint in an extended attribute. If the filesystem does not
+// support extended attributes, the block is stored without a hint.
+func (v *unixVolume) BlockWriteSizeHint(ctx context.Context, hash string, data []byte, sizeHint int) error {
+	return v.writeBlock(ctx, hash, data, time.Now(), sizeHint)
+}
+
+// BlockRewrite replaces the stored data of an existing block,
+// leaving its timestamp and size hint unchanged.
+func (v *unixVolume) BlockRewrite(ctx context.Context, hash string, data []byte) error {
+	bpath := v.blockPath(hash)
+	fi, err := v.os.Stat(bpath)
+	if err != nil {
+		return v.translateError(err)
+	}
+	return v.writeBlock(ctx, hash, data, fi.ModTime(), v.getSizeHint(bpath))
+}
+
+// writeBlock stores a block with the given timestamp, and the given
+// size hint unless sizeHint < 0.
+func (v *unixVolume) writeBlock(ctx context.Context, hash string, data []byte, ts time.Time, sizeHint int) error {
 	if v.isFull() {
 		return errFull
 	}
@@ -267,27 +330,86 @@ func (v *unixVolume) BlockWrite(ctx context.Context, hash string, data []byte) e
 	if err = tmpfile.Close(); err != nil {
 		return fmt.Errorf("error closing %s: %s", tmpfile.Name(), err)
 	}
-	// ext4 uses a low-precision clock and effectively backdates
-	// files by up to 10 ms, sometimes across a 1-second boundary,
-	// which produces confusing results in logs and tests.  We
-	// avoid this by setting the output file's timestamps
-	// explicitly, using a higher resolution clock.
-	ts := time.Now()
 	v.os.stats.TickOps("utimes")
 	v.os.stats.Tick(&v.os.stats.UtimesOps)
 	if err = os.Chtimes(tmpfile.Name(), ts, ts); err != nil {
 		return fmt.Errorf("error setting timestamps on %s: %s", tmpfile.Name(), err)
 	}
+	if sizeHint >= 0 {
+		v.setSizeHint(tmpfile.Name(), sizeHint)
+	}
 	if err = v.os.Rename(tmpfile.Name(), bpath); err != nil {
 		return fmt.Errorf("error renaming %s to %s: %s", tmpfile.Name(), bpath, err)
 	}
 	return nil
 }
 
+// setSizeHint stores a size hint on the given file. Errors are
+// logged, not returned: without a hint, the block is still usable,
+// just more expensive to index.
+func (v *unixVolume) setSizeHint(path string, sizeHint int) {
+	if v.sizeHintsUnsupported.Load() {
+		return
+	}
+	err := v.os.Setxattr(path, unixSizeHintXattr, []byte(strconv.Itoa(sizeHint)))
+	if err != nil && !v.checkSizeHintsUnsupported(err) {
+		v.logger.WithError(err).Warnf("error storing size hint on %s", path)
+	}
+}
+
+// checkSizeHintsUnsupported returns true if err indicates that the
+// filesystem does not support extended attributes, in which case it
+// also logs a warning (once) and stops further attempts to use them.
+func (v *unixVolume) checkSizeHintsUnsupported(err error) bool {
+	if !errors.Is(err, unix.ENOTSUP) {
+		return false
+	}
+	if !v.sizeHintsUnsupported.Swap(true) {
+		v.logger.WithError(err).Warn("filesystem does not support extended attributes, cannot store size hints")
+	}
+	return true
+}
+
+// getSizeHint returns the size hint stored on the given file, or -1
+// if there is none.
+func (v *unixVolume) getSizeHint(path string) int {
+	if v.sizeHintsUnsupported.Load() {
+		return -1
+	}
+	buf := make([]byte, 20)
+	n, err := v.os.Getxattr(path, unixSizeHintXattr, buf)
+	if err != nil {
+		v.checkSizeHintsUnsupported(err)
+		return -1
+	}
+	sizeHint, err := strconv.Atoi(string(buf[:n]))
+	if err != nil || sizeHint < 0 {
+		return -1
+	}
+	return sizeHint
+}
+
 var blockDirRe = regexp.MustCompile(`^[0-9a-f]+$`)
 var blockFileRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+var unixLastreadRe = regexp.MustCompile(`^[0-9a-f]{32}\.lastread$`)
 
 func (v *unixVolume) Index(ctx context.Context, prefix string, w io.Writer) error {
+	return v.index(ctx, prefix, w, false, false)
+}
+
+// IndexReadTimes is like Index, but also reports the timestamp of
+// each block's {hash}.lastread marker file as its last read time.
+func (v *unixVolume) IndexReadTimes(ctx context.Context, prefix string, w io.Writer) error {
+	return v.index(ctx, prefix, w, true, false)
+}
+
+// IndexSizeHints is like Index (or IndexReadTimes, if readTimes is
+// true), but also reports each block's size hint.
+func (v *unixVolume) IndexSizeHints(ctx context.Context, prefix string, readTimes bool, w io.Writer) error {
+	return v.index(ctx, prefix, w, readTimes, true)
+}
+
+func (v *unixVolume) index(ctx context.Context, prefix string, w io.Writer, readTimes, sizeHints bool) error {
 	rootdir, err := v.os.Open(v.Root)
 	if err != nil {
 		return err
@@ -332,6 +454,25 @@ func (v *unixVolume) Index(ctx context.Context, prefix string, w io.Writer) erro
 			}
 		}
 
+		var lastread map[string]int64
+		if readTimes {
+			lastread = make(map[string]int64)
+			for _, dirent := range dirents {
+				name := dirent.Name()
+				if !strings.HasPrefix(name, prefix) || !unixLastreadRe.MatchString(name) {
+					continue
+				}
+				fileInfo, err := dirent.Info()
+				if os.IsNotExist(err) {
+					continue
+				} else if err != nil {
+					v.logger.WithError(err).Errorf("error getting FileInfo for %q in %q", name, blockdirpath)
+					return err
+				}
+				lastread[name[:32]] = fileInfo.ModTime().UnixNano()
+			}
+		}
+
 		for _, dirent := range dirents {
 			if ctx.Err() != nil {
 				return ctx.Err()
@@ -351,10 +492,18 @@ func (v *unixVolume) Index(ctx context.Context, prefix string, w io.Writer) erro
 			if !blockFileRe.MatchString(name) {
 				continue
 			}
+			var extra string
+			if readTimes {
+				extra = " " + strconv.FormatInt(lastread[name], 10)
+			}
+			if sizeHints {
+				extra += " " + strconv.Itoa(v.getSizeHint(filepath.Join(blockdirpath, name)))
+			}
 			_, err = fmt.Fprint(w,
 				name,
 				"+", fileInfo.Size(),
 				" ", fileInfo.ModTime().UnixNano(),
+				extra,
 				"\n")
 			if err != nil {
 				return fmt.Errorf("error writing: %s", err)
@@ -403,7 +552,14 @@ func (v *unixVolume) BlockTrash(loc string) error {
 	}
 
 	if v.cluster.Collections.BlobTrashLifetime == 0 {
-		return v.os.Remove(p)
+		err := v.os.Remove(p)
+		if err != nil {
+			return err
+		}
+		// There is no trash file for EmptyTrash to find, so
+		// delete the lastread marker now.
+		v.removeLastread(loc)
+		return nil
 	}
 	return v.os.Rename(p, fmt.Sprintf("%v.trash.%d", p, time.Now().Add(v.cluster.Collections.BlobTrashLifetime.Duration()).Unix()))
 }
@@ -454,6 +610,20 @@ func (v *unixVolume) blockPath(loc string) string {
 	return filepath.Join(v.blockDir(loc), loc)
 }
 
+// lastreadPath returns the fully qualified pathname of the marker
+// file that records the given block's last read time.
+func (v *unixVolume) lastreadPath(hash string) string {
+	return v.blockPath(hash) + ".lastread"
+}
+
+// removeLastread deletes the given block's lastread marker, if any.
+func (v *unixVolume) removeLastread(hash string) {
+	err := v.os.Remove(v.lastreadPath(hash))
+	if err != nil && !os.IsNotExist(err) {
+		v.logger.WithError(err).Warnf("error deleting %q", v.lastreadPath(hash))
+	}
+}
+
 // isFull returns true if the free space on the volume is less than
 // MinFreeKilobytes.
 func (v *unixVolume) isFull() (isFull bool) {
@@ -595,6 +765,9 @@ func (v *unixVolume) EmptyTrash() {
 			v.logger.WithError(err).Errorf("EmptyTrash: Remove(%q) failed", path)
 			return
 		}
+		if _, err := v.os.Stat(v.blockPath(matches[1])); os.IsNotExist(err) {
+			v.removeLastread(matches[1])
+		}
 		atomic.AddInt64(&bytesDeleted, info.Size())
 		atomic.AddInt64(&blocksDeleted, 1)
 	}
@@ -653,6 +826,7 @@ type unixStats struct {
 	RenameOps  uint64
 	UnlinkOps  uint64
 	ReaddirOps uint64
+	XattrOps   uint64
 }
 
 func (s *unixStats) TickErr(err error) {
@@ -706,6 +880,24 @@ func (o *osWithStats) Stat(path string) (os.FileInfo, error) {
 	return fi, err
 }
 
+func (o *osWithStats) Getxattr(path, attr string, dest []byte) (int, error) {
+	o.stats.TickOps("getxattr")
+	o.stats.Tick(&o.stats.XattrOps)
+	n, err := unix.Getxattr(path, attr, dest)
+	if err != unix.ENODATA {
+		o.stats.TickErr(err)
+	}
+	return n, err
+}
+
+func (o *osWithStats) Setxattr(path, attr string, data []byte) error {
+	o.stats.TickOps("setxattr")
+	o.stats.Tick(&o.stats.XattrOps)
+	err := unix.Setxattr(path, attr, data, 0)
+	o.stats.TickErr(err)
+	return err
+}
+
 func (o *osWithStats) TempFile(dir, base string) (*os.File, error) {
 	o.stats.TickOps("create")
 	o.stats.Tick(&o.stats.CreateOps)
@@ -143,6 +143,78 @@ func (s *unixVolumeSuite) TestPut(c *check.C) {
 	}
 }
 
+func (s *unixVolumeSuite) TestReadTimes(c *check.C) {
+	v := s.newTestableUnixVolume(c, s.params, false)
+	defer v.Teardown()
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	v.TouchWithDate(TestHash, t0)
+
+	// Not read since written.
+	buf := &bytes.Buffer{}
+	c.Check(v.IndexReadTimes(context.Background(), "", buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, fmt.Sprintf("%s+%d %d 0\n", TestHash, len(TestBlock), t0.UnixNano()))
+
+	// BlockMarkRead updates the read time, not the mtime.
+	c.Check(v.BlockMarkRead(TestHash), check.IsNil)
+	mtime, err := v.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+	c.Check(mtime.Equal(t0), check.Equals, true)
+	buf.Reset()
+	c.Check(v.IndexReadTimes(context.Background(), "", buf), check.IsNil)
+	var readTime int64
+	_, err = fmt.Sscanf(buf.String(), TestHash+"+%d %d %d\n", new(int), new(int64), &readTime)
+	c.Check(err, check.IsNil)
+	c.Check(readTime > time.Now().Add(-time.Minute).UnixNano(), check.Equals, true)
+
+	// Index doesn't include read times.
+	buf.Reset()
+	c.Check(v.Index(context.Background(), "", buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, fmt.Sprintf("%s+%d %d\n", TestHash, len(TestBlock), t0.UnixNano()))
+
+	// Reading the block and touching it don't change the read
+	// time, even if the filesystem updates atime.
+	time.Sleep(10 * time.Millisecond)
+	c.Check(v.BlockRead(context.Background(), TestHash, &brbuffer{}), check.IsNil)
+	c.Check(v.BlockTouch(TestHash), check.IsNil)
+	buf.Reset()
+	c.Check(v.IndexReadTimes(context.Background(), "", buf), check.IsNil)
+	c.Check(buf.String(), check.Matches, fmt.Sprintf(`%s\+\d+ \d+ %d\n`, TestHash, readTime))
+
+	// Deleting the block deletes the lastread marker.
+	v.cluster.Collections.BlobSigningTTL = 0
+	v.cluster.Collections.BlobTrashLifetime = 0
+	c.Check(v.BlockTrash(TestHash), check.IsNil)
+	_, err = os.Stat(v.lastreadPath(TestHash))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	c.Check(v.BlockMarkRead(TestHash), check.NotNil)
+}
+
+func (s *unixVolumeSuite) TestBlockRewrite(c *check.C) {
+	v := s.newTestableUnixVolume(c, s.params, false)
+	defer v.Teardown()
+	c.Check(os.IsNotExist(v.BlockRewrite(context.Background(), TestHash, TestBlock)), check.Equals, true)
+	c.Assert(v.BlockWrite(context.Background(), TestHash, TestBlock), check.IsNil)
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	v.TouchWithDate(TestHash, t0)
+	c.Assert(v.BlockMarkRead(TestHash), check.IsNil)
+	idx0 := &bytes.Buffer{}
+	c.Assert(v.IndexReadTimes(context.Background(), "", idx0), check.IsNil)
+
+	// The stored data is replaced, but the mtime and read time
+	// are unchanged.
+	c.Check(v.BlockRewrite(context.Background(), TestHash, TestBlock2), check.IsNil)
+	mtime, err := v.Mtime(TestHash)
+	c.Check(err, check.IsNil)
+	c.Check(mtime.Equal(t0), check.Equals, true)
+	idx := &bytes.Buffer{}
+	c.Check(v.IndexReadTimes(context.Background(), "", idx), check.IsNil)
+	c.Check(idx.String(), check.Equals, string(bytes.Replace(idx0.Bytes(), []byte(fmt.Sprintf("+%d ", len(TestBlock))), []byte(fmt.Sprintf("+%d ", len(TestBlock2))), 1)))
+	buf := &brbuffer{}
+	c.Check(v.BlockRead(context.Background(), TestHash, buf), check.IsNil)
+	c.Check(buf.String(), check.Equals, string(TestBlock2))
+}
+
 func (s *unixVolumeSuite) TestPutBadVolume(c *check.C) {
 	v := s.newTestableUnixVolume(c, s.params, false)
 	defer v.Teardown()
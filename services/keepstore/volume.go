@@ -6,7 +6,9 @@ package keepstore
 
 import (
 	"context"
+	"errors"
 	"io"
+	"sync"
 	"time"
 
 	"git.arvados.org/arvados.git/sdk/go/arvados"
@@ -84,6 +86,84 @@ type volume interface {
 	Index(ctx context.Context, prefix string, writeTo io.Writer) error
 }
 
+// readTimeVolume is implemented by volumes that can record the time
+// each block was last read, separately from the stored timestamp
+// used for garbage collection.
+type readTimeVolume interface {
+	// Record that the indicated block was read at the current
+	// time, without changing its stored timestamp.
+	BlockMarkRead(hash string) error
+
+	// Write an index like Index, but with a third field on each
+	// line: the time the block was last read, in nanoseconds
+	// since the UTC Unix epoch, or 0 if unknown.
+	IndexReadTimes(ctx context.Context, prefix string, writeTo io.Writer) error
+}
+
+// blockRewriter is implemented by volumes that can replace the
+// stored data of an existing block without changing its stored
+// timestamp (or its read time, if recorded).
+type blockRewriter interface {
+	// Replace the stored data of the indicated block. If the
+	// block does not exist, or has been trashed, BlockRewrite
+	// must return os.ErrNotExist.
+	BlockRewrite(ctx context.Context, hash string, data []byte) error
+}
+
+// sizeHintVolume is implemented by volumes that can store a size
+// hint with each block (e.g., the uncompressed size of a compressed
+// block) and report it in an index without reading the stored data.
+//
+// A block's size hint does not change when the block is touched,
+// trashed, untrashed, or rewritten.
+type sizeHintVolume interface {
+	// Store a block like BlockWrite, along with the given size
+	// hint.
+	BlockWriteSizeHint(ctx context.Context, hash string, data []byte, sizeHint int) error
+
+	// Write an index like Index (or like IndexReadTimes, if
+	// readTimes is true), but with an additional last field on
+	// each line: the size hint stored with the block, or -1 if
+	// none.
+	IndexSizeHints(ctx context.Context, prefix string, readTimes bool, writeTo io.Writer) error
+}
+
+// supportsSizeHints returns true if vol, or the volume wrapped by
+// vol, can store size hints.
+func supportsSizeHints(vol volume) bool {
+	for {
+		switch v := vol.(type) {
+		case *encryptedVolume:
+			vol = v.volume
+		case *cachedVolume:
+			vol = v.volume
+		case sizeHintVolume:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// supportsReadTimes returns true if vol, or the volume wrapped by
+// vol, can record last-read times.
+func supportsReadTimes(vol volume) bool {
+	for {
+		switch v := vol.(type) {
+		case *compressedVolume:
+			vol = v.volume
+		case *encryptedVolume:
+			vol = v.volume
+		case *cachedVolume:
+			vol = v.volume
+		case readTimeVolume:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
 type volumeDriver func(newVolumeParams) (volume, error)
 
 type newVolumeParams struct {
@@ -93,6 +173,12 @@ type newVolumeParams struct {
 	Logger       logrus.FieldLogger
 	MetricsVecs  *volumeMetricsVecs
 	BufferPool   *bufferPool
+
+	// EncodedData is true if the volume is used by another
+	// volume (e.g., an erasure-coded volume) to store data that
+	// does not match the hash argument passed to BlockWrite, so
+	// the driver must not use the hash to verify the data.
+	EncodedData bool
 }
 
 // ioStats tracks I/O statistics for a volume or server
@@ -106,3 +192,49 @@ type ioStats struct {
 	InBytes    uint64
 	OutBytes   uint64
 }
+
+// memWriterAt is an in-memory io.WriterAt. It accepts up to
+// maxStoredBlockSize bytes, plus room for the trailer on an
+// erasure-coded parity shard.
+type memWriterAt struct {
+	mtx sync.Mutex
+	buf []byte
+}
+
+func (b *memWriterAt) WriteAt(p []byte, offset int64) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if end := int(offset) + len(p); end > maxStoredBlockSize+ecTrailerSize {
+		return 0, errTooLarge
+	} else if short := end - len(b.buf); short > 0 {
+		b.buf = append(b.buf, make([]byte, short)...)
+	}
+	return copy(b.buf[offset:], p), nil
+}
+
+var errHeaderRead = errors.New("header read")
+
+// headerWriter is an io.WriterAt that retains the first len(buf)
+// bytes written to it, and returns errHeaderRead once it has received
+// them, so the caller stops reading.
+type headerWriter struct {
+	mtx  sync.Mutex
+	buf  []byte
+	have int
+}
+
+func newHeaderWriter(size int) *headerWriter {
+	return &headerWriter{buf: make([]byte, size)}
+}
+
+func (hw *headerWriter) WriteAt(p []byte, offset int64) (int, error) {
+	hw.mtx.Lock()
+	defer hw.mtx.Unlock()
+	if offset < int64(len(hw.buf)) {
+		hw.have += copy(hw.buf[offset:], p)
+	}
+	if hw.have >= len(hw.buf) {
+		return 0, errHeaderRead
+	}
+	return len(p), nil
+}
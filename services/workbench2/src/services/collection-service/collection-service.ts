@@ -27,6 +27,12 @@ type ReplaceFilesPayload = {
 
 type FileWithRelativePath = File & { relativePath?: string, webkitRelativePath?: string };
 
+export type PresignedUrl = {
+    url: string;
+    method: "GET" | "PUT";
+    expiresAt: string;
+}
+
 export const emptyCollectionPdh = "d41d8cd98f00b204e9800998ecf8427e+0";
 export const SOURCE_DESTINATION_EQUAL_ERROR_MESSAGE = "Source and destination cannot be the same";
 
@@ -370,6 +376,23 @@ export class CollectionService extends TrashableResourceService<CollectionResour
         form.submit();
         form.remove();
     }
+
+    // Get a URL that can be used, without any other credentials, to
+    // download (GET) or upload (PUT) a single file until it expires.
+    presignedUrl(collectionUuid: string, path: string, method: "GET" | "PUT" = "GET", expiresIn?: number): Promise<PresignedUrl> {
+        super.validateUuid(collectionUuid);
+        const params = {
+            path: path.replace(/^\//, ''),
+            method,
+            expiresIn,
+        };
+        return CommonService.defaultResponse(
+            this.serverApi.post(`/${this.resourceType}/${collectionUuid}/presigned_url`, null, {
+                params: CommonService.mapKeys(snakeCase)(params),
+            }),
+            this.actions
+        );
+    }
 }
 
 